@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	activityKindLivecomment = "livecomment"
+	activityKindLivestream  = "livestream"
+	activityKindReaction    = "reaction"
+
+	defaultActivitiesLimit = 20
+	maxActivitiesLimit     = 100
+)
+
+// ライブコメント・リアクション・配信を1つの時系列にまとめる
+// 配信は予約時刻 (start_at) を発生時刻として扱う
+func activitiesUnionQuery() string {
+	return `
+SELECT * FROM (
+	SELECT 'livecomment' AS kind, id, livestream_id, comment, tip, '' AS emoji_name, '' AS title, created_at
+	FROM ` + livecommentsAllTable() + ` lc WHERE user_id = ?
+	UNION ALL
+	SELECT 'reaction' AS kind, id, livestream_id, '' AS comment, 0 AS tip, emoji_name, '' AS title, created_at
+	FROM ` + reactionsAllTable() + ` r WHERE user_id = ?
+	UNION ALL
+	SELECT 'livestream' AS kind, id, id AS livestream_id, '' AS comment, 0 AS tip, '' AS emoji_name, title, start_at AS created_at
+	FROM livestreams WHERE user_id = ?
+) activities`
+}
+
+type ActivityModel struct {
+	Kind         string `db:"kind"`
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	Comment      string `db:"comment"`
+	Tip          int64  `db:"tip"`
+	EmojiName    string `db:"emoji_name"`
+	Title        string `db:"title"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type Activity struct {
+	Kind         string `json:"kind"`
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	Comment      string `json:"comment,omitempty"`
+	Tip          int64  `json:"tip,omitempty"`
+	EmojiName    string `json:"emoji_name,omitempty"`
+	Title        string `json:"title,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type ActivityFeed struct {
+	Activities []Activity `json:"activities"`
+	// 次のページを取得する際に cursor に指定する値 (続きが無い場合は空)
+	NextCursor string `json:"next_cursor"`
+}
+
+// カーソルは "<created_at>:<kind>:<id>" の形式で、並び順 (created_at, kind, id) の降順に対応する
+func formatActivityCursor(a ActivityModel) string {
+	return fmt.Sprintf("%d:%s:%d", a.CreatedAt, a.Kind, a.ID)
+}
+
+func parseActivityCursor(cursor string) (int64, string, int64, error) {
+	parts := strings.Split(cursor, ":")
+	if len(parts) != 3 {
+		return 0, "", 0, errors.New("invalid cursor")
+	}
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	switch parts[1] {
+	case activityKindLivecomment, activityKindLivestream, activityKindReaction:
+	default:
+		return 0, "", 0, errors.New("invalid cursor kind")
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	return createdAt, parts[1], id, nil
+}
+
+// ユーザのアクティビティフィード取得API
+// GET /api/user/:username/activity
+func getUserActivityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	username := c.Param("username")
+
+	var user UserModel
+	if err := dbConn.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+	}
+
+	limit := int64(defaultActivitiesLimit)
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if l > maxActivitiesLimit {
+			l = maxActivitiesLimit
+		}
+		limit = l
+	}
+
+	q := newSelectQuery(activitiesUnionQuery(), user.ID, user.ID, user.ID)
+	if v := c.QueryParam("cursor"); v != "" {
+		createdAt, kind, id, err := parseActivityCursor(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor query parameter")
+		}
+		q.Where("(created_at, kind, id) < (?, ?, ?)", createdAt, kind, id)
+	}
+	// 次ページの有無を判定するために1件多く取得する
+	query, args := q.OrderBy("created_at DESC, kind DESC, id DESC").Limit(limit + 1).Build()
+
+	var activityModels []ActivityModel
+	if err := dbConn.SelectContext(ctx, &activityModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get activities: "+err.Error()).SetInternal(err)
+	}
+
+	feed := ActivityFeed{Activities: []Activity{}}
+	if int64(len(activityModels)) > limit {
+		activityModels = activityModels[:limit]
+		feed.NextCursor = formatActivityCursor(activityModels[len(activityModels)-1])
+	}
+	for _, m := range activityModels {
+		feed.Activities = append(feed.Activities, Activity{
+			Kind:         m.Kind,
+			ID:           m.ID,
+			LivestreamID: m.LivestreamID,
+			Comment:      m.Comment,
+			Tip:          m.Tip,
+			EmojiName:    m.EmojiName,
+			Title:        m.Title,
+			CreatedAt:    m.CreatedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, feed)
+}
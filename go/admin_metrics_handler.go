@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	adminMetricsTopLivestreams = 10
+	adminMetricsTipDays        = 7
+)
+
+// httpCounters はプロセス起動からのリクエスト数の累計 (エラー率の算出用)
+var httpCounters struct {
+	requests     atomic.Int64
+	clientErrors atomic.Int64
+	serverErrors atomic.Int64
+}
+
+// httpStatsMiddleware はレスポンスのステータスコードを数える
+func httpStatsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				status = he.Code
+			}
+		}
+		httpCounters.requests.Add(1)
+		switch {
+		case status >= 500:
+			httpCounters.serverErrors.Add(1)
+		case status >= 400:
+			httpCounters.clientErrors.Add(1)
+		}
+		return err
+	}
+}
+
+type HTTPStats struct {
+	Requests     int64   `json:"requests"`
+	ClientErrors int64   `json:"client_errors"`
+	ServerErrors int64   `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+}
+
+func httpStats() HTTPStats {
+	s := HTTPStats{
+		Requests:     httpCounters.requests.Load(),
+		ClientErrors: httpCounters.clientErrors.Load(),
+		ServerErrors: httpCounters.serverErrors.Load(),
+	}
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.ServerErrors) / float64(s.Requests)
+	}
+	return s
+}
+
+type CountPerMinute struct {
+	Timestamp int64 `json:"timestamp" db:"timestamp"`
+	Count     int64 `json:"count" db:"count"`
+}
+
+type TipsPerDay struct {
+	// UTC
+	Date     string `json:"date"`
+	TotalTip int64  `json:"total_tip"`
+	TipCount int64  `json:"tip_count"`
+}
+
+type TopLivestream struct {
+	LivestreamID int64  `json:"livestream_id" db:"livestream_id"`
+	Title        string `json:"title" db:"title"`
+	ViewersCount int64  `json:"viewers_count" db:"viewers_count"`
+}
+
+type AdminMetrics struct {
+	GeneratedAt int64 `json:"generated_at"`
+	// 直近24時間にコメント・リアクション・視聴をしたユーザ数
+	DailyActiveUsers      int64            `json:"daily_active_users"`
+	LivecommentsPerMinute []CountPerMinute `json:"livecomments_per_minute"`
+	ReactionsLastHour     int64            `json:"reactions_last_hour"`
+	TipsPerDay            []TipsPerDay     `json:"tips_per_day"`
+	// 現在の同時視聴者数の多い配信
+	TopLivestreams []TopLivestream `json:"top_livestreams"`
+	// スパム報告の対応時間
+	ModerationSLA ModerationSLA `json:"moderation_sla"`
+	// 以下はこのサーバのプロセス起動からの累計
+	HTTP HTTPStats `json:"http"`
+	Tx   TxStats   `json:"tx"`
+	// 外部依存ごとの遮断状態
+	CircuitBreakers []CircuitBreakerStatus `json:"circuit_breakers"`
+}
+
+// プラットフォーム全体の指標取得API (管理者向け)
+// GET /api/admin/metrics
+func getAdminMetricsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	now := clock.Now()
+	metrics := AdminMetrics{
+		GeneratedAt:           now.Unix(),
+		LivecommentsPerMinute: []CountPerMinute{},
+		TipsPerDay:            []TipsPerDay{},
+		TopLivestreams:        []TopLivestream{},
+		HTTP:                  httpStats(),
+		Tx:                    txStats(),
+		CircuitBreakers:       circuitBreakerStatuses(),
+	}
+
+	dayAgo := now.Add(-24 * time.Hour).Unix()
+	if err := dbConn.GetContext(ctx, &metrics.DailyActiveUsers, `
+		SELECT COUNT(DISTINCT user_id) FROM (
+			SELECT user_id FROM `+livecommentsAllTable()+` lc WHERE created_at >= ?
+			UNION ALL
+			SELECT user_id FROM `+reactionsAllTable()+` r WHERE created_at >= ?
+			UNION ALL
+			SELECT user_id FROM livestream_viewers_history WHERE created_at >= ?
+		) t`, dayAgo, dayAgo, dayAgo); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count daily active users: "+err.Error()).SetInternal(err)
+	}
+
+	hourAgo := now.Add(-time.Hour).Unix()
+	if err := dbConn.SelectContext(ctx, &metrics.LivecommentsPerMinute, "SELECT created_at DIV 60 * 60 AS `timestamp`, COUNT(*) AS `count` FROM "+livecommentsAllTable()+" lc WHERE created_at >= ? GROUP BY `timestamp` ORDER BY `timestamp`", hourAgo); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments per minute: "+err.Error()).SetInternal(err)
+	}
+	if err := dbConn.GetContext(ctx, &metrics.ReactionsLastHour, "SELECT IFNULL(SUM(count), 0) FROM reaction_buckets WHERE bucket_start >= ?", hourAgo); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error()).SetInternal(err)
+	}
+
+	var tips []struct {
+		Day      int64 `db:"day"`
+		TotalTip int64 `db:"total_tip"`
+		TipCount int64 `db:"tip_count"`
+	}
+	tipsFrom := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -(adminMetricsTipDays - 1)).Unix()
+	if err := dbConn.SelectContext(ctx, &tips, "SELECT lc.created_at DIV 86400 AS day, SUM(lc.tip) AS total_tip, COUNT(*) AS tip_count FROM "+livecommentsAggregateTable()+" lc WHERE lc.tip > 0 AND lc.created_at >= ? GROUP BY day ORDER BY day", tipsFrom); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips per day: "+err.Error()).SetInternal(err)
+	}
+	for _, t := range tips {
+		metrics.TipsPerDay = append(metrics.TipsPerDay, TipsPerDay{
+			Date:     time.Unix(t.Day*86400, 0).UTC().Format(scheduleDateLayout),
+			TotalTip: t.TotalTip,
+			TipCount: t.TipCount,
+		})
+	}
+
+	if err := dbConn.SelectContext(ctx, &metrics.TopLivestreams, `
+		SELECT l.id AS livestream_id, l.title, COUNT(*) AS viewers_count
+		FROM livestream_presences p
+		INNER JOIN livestreams l ON l.id = p.livestream_id
+		WHERE p.last_seen_at >= ?
+		GROUP BY l.id, l.title
+		ORDER BY viewers_count DESC, l.id ASC
+		LIMIT ?`, now.Add(-presenceTTL).Unix(), adminMetricsTopLivestreams); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get top livestreams: "+err.Error()).SetInternal(err)
+	}
+
+	sla, err := computeModerationSLA(ctx, dbConn, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compute moderation sla: "+err.Error()).SetInternal(err)
+	}
+	metrics.ModerationSLA = sla
+
+	return c.JSON(http.StatusOK, metrics)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	analyticsWorkerEnabledEnvKey = "ISUCON13_ANALYTICS_WORKER_ENABLED"
+
+	analyticsWorkerInterval  = 1 * time.Minute
+	analyticsWorkerBatchSize = 10
+
+	// 時系列を集計する単位 (秒)
+	analyticsBucketSeconds = 60
+	analyticsTopCommenters = 10
+	// 平均の何倍以上のリアクションがあった区間をスパイクとみなすか
+	analyticsReactionSpikeFactor = 2
+)
+
+// 配信終了後の集計ワーカー
+// 初期データの終了済み配信を全て集計し始めてしまうので、デフォルトでは無効 (APIからの取得時に都度生成する)
+var analyticsWorkerEnabled = false
+
+type LivestreamAnalyticsModel struct {
+	LivestreamID int64  `db:"livestream_id"`
+	Report       []byte `db:"report"`
+	GeneratedAt  int64  `db:"generated_at"`
+}
+
+type TipsTimelineEntry struct {
+	Timestamp int64 `json:"timestamp"`
+	TotalTip  int64 `json:"total_tip"`
+	TipCount  int64 `json:"tip_count"`
+}
+
+type TopCommenter struct {
+	UserID            int64  `json:"user_id" db:"user_id"`
+	Username          string `json:"username" db:"username"`
+	TotalLivecomments int64  `json:"total_livecomments" db:"total_livecomments"`
+	TotalTip          int64  `json:"total_tip" db:"total_tip"`
+}
+
+type ReactionSpike struct {
+	Timestamp      int64  `json:"timestamp"`
+	TotalReactions int64  `json:"total_reactions"`
+	TopEmoji       string `json:"top_emoji"`
+}
+
+type ModerationEvent struct {
+	Timestamp  int64  `json:"timestamp" db:"created_at"`
+	Action     string `json:"action" db:"action"`
+	TargetType string `json:"target_type" db:"target_type"`
+	TargetID   int64  `json:"target_id" db:"target_id"`
+	ActorID    int64  `json:"actor_id" db:"actor_id"`
+}
+
+type LivestreamAnalytics struct {
+	LivestreamID      int64               `json:"livestream_id"`
+	StartAt           int64               `json:"start_at"`
+	EndAt             int64               `json:"end_at"`
+	PeakViewers       int64               `json:"peak_viewers"`
+	PeakViewersAt     int64               `json:"peak_viewers_at"`
+	TotalLivecomments int64               `json:"total_livecomments"`
+	TotalReactions    int64               `json:"total_reactions"`
+	TotalTip          int64               `json:"total_tip"`
+	TipsTimeline      []TipsTimelineEntry `json:"tips_timeline"`
+	TopCommenters     []TopCommenter      `json:"top_commenters"`
+	ReactionSpikes    []ReactionSpike     `json:"reaction_spikes"`
+	ModerationEvents  []ModerationEvent   `json:"moderation_events"`
+	// 配信のクリップの再生数 (配信終了後も増えるので、レポートには保存せず取得時に入れる)
+	TotalClipViews int64 `json:"total_clip_views"`
+	// 言語判定が終わったコメントの言語の内訳 (判定は非同期なので、取得時に集計する)
+	Languages   []LanguageBreakdownEntry `json:"languages"`
+	GeneratedAt int64                    `json:"generated_at"`
+}
+
+func loadAnalyticsConfig() error {
+	if v, ok := os.LookupEnv(analyticsWorkerEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", analyticsWorkerEnabledEnvKey, err)
+		}
+		analyticsWorkerEnabled = enabled
+	}
+	return nil
+}
+
+// 配信終了後の分析レポート取得API (配信者向け)
+// GET /api/livestream/:livestream_id/analytics
+// NOTE: /report はスパム報告一覧で使われているため、分析レポートは /analytics で提供する
+func getLivestreamAnalyticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var report []byte
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if livestreamModel.EndAt > clock.Now().Unix() {
+			return echo.NewHTTPError(http.StatusBadRequest, "analytics report is available after the livestream ends")
+		}
+
+		var analyticsModel LivestreamAnalyticsModel
+		err := tx.GetContext(ctx, &analyticsModel, "SELECT * FROM livestream_analytics WHERE livestream_id = ?", livestreamID)
+		if err == nil {
+			report = analyticsModel.Report
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream analytics: "+err.Error()).SetInternal(err)
+		}
+
+		// ワーカーがまだ集計していなければ、ここで生成して保存する
+		report, err = generateLivestreamAnalytics(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate livestream analytics: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var analytics LivestreamAnalytics
+	if err := json.Unmarshal(report, &analytics); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode livestream analytics: "+err.Error()).SetInternal(err)
+	}
+	if err := dbConn.GetContext(ctx, &analytics.TotalClipViews, "SELECT IFNULL(SUM(view_count), 0) FROM clips WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count clip views: "+err.Error()).SetInternal(err)
+	}
+	analytics.Languages, err = languageBreakdown(ctx, dbConn, "s.livestream_id = ?", livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get language breakdown: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, analytics)
+}
+
+// generateLivestreamAnalytics はレポートを集計して livestream_analytics に保存し、JSONを返す
+func generateLivestreamAnalytics(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) ([]byte, error) {
+	analytics, err := buildLivestreamAnalytics(ctx, tx, livestreamModel)
+	if err != nil {
+		return nil, err
+	}
+	report, err := json.Marshal(analytics)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_analytics (livestream_id, report, generated_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE report = VALUES(report), generated_at = VALUES(generated_at)", livestreamModel.ID, report, analytics.GeneratedAt); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func buildLivestreamAnalytics(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (LivestreamAnalytics, error) {
+	analytics := LivestreamAnalytics{
+		LivestreamID:     livestreamModel.ID,
+		StartAt:          livestreamModel.StartAt,
+		EndAt:            livestreamModel.EndAt,
+		TipsTimeline:     []TipsTimelineEntry{},
+		TopCommenters:    []TopCommenter{},
+		ReactionSpikes:   []ReactionSpike{},
+		ModerationEvents: []ModerationEvent{},
+		GeneratedAt:      clock.Now().Unix(),
+	}
+
+	// 同時視聴者数のピーク
+	var peak struct {
+		ViewersCount int64 `db:"viewers_count"`
+		SampledAt    int64 `db:"sampled_at"`
+	}
+	if err := tx.GetContext(ctx, &peak, "SELECT viewers_count, sampled_at FROM livestream_viewer_samples WHERE livestream_id = ? ORDER BY viewers_count DESC, sampled_at ASC LIMIT 1", livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LivestreamAnalytics{}, fmt.Errorf("failed to get peak viewers: %w", err)
+	}
+	analytics.PeakViewers = peak.ViewersCount
+	analytics.PeakViewersAt = peak.SampledAt
+
+	// チップの推移
+	var tips []struct {
+		Bucket   int64 `db:"bucket"`
+		TotalTip int64 `db:"total_tip"`
+		TipCount int64 `db:"tip_count"`
+	}
+	if err := tx.SelectContext(ctx, &tips, "SELECT lc.created_at DIV ? AS bucket, SUM(lc.tip) AS total_tip, COUNT(*) AS tip_count FROM "+livecommentsAggregateTable()+" lc WHERE lc.livestream_id = ? AND lc.tip > 0 GROUP BY bucket ORDER BY bucket", analyticsBucketSeconds, livestreamModel.ID); err != nil {
+		return LivestreamAnalytics{}, fmt.Errorf("failed to get tips timeline: %w", err)
+	}
+	for _, t := range tips {
+		analytics.TipsTimeline = append(analytics.TipsTimeline, TipsTimelineEntry{
+			Timestamp: t.Bucket * analyticsBucketSeconds,
+			TotalTip:  t.TotalTip,
+			TipCount:  t.TipCount,
+		})
+		analytics.TotalTip += t.TotalTip
+	}
+
+	if err := tx.GetContext(ctx, &analytics.TotalLivecomments, "SELECT COUNT(*) FROM "+livecommentsAggregateTable()+" lc WHERE lc.livestream_id = ?", livestreamModel.ID); err != nil {
+		return LivestreamAnalytics{}, fmt.Errorf("failed to count livecomments: %w", err)
+	}
+
+	// コメント数の多いユーザ
+	if err := tx.SelectContext(ctx, &analytics.TopCommenters, `
+		SELECT u.id AS user_id, u.name AS username, COUNT(*) AS total_livecomments, IFNULL(SUM(l.tip), 0) AS total_tip
+		FROM `+livecommentsAggregateTable()+` l
+		INNER JOIN users u ON u.id = l.user_id
+		WHERE l.livestream_id = ?
+		GROUP BY u.id, u.name
+		ORDER BY total_livecomments DESC, total_tip DESC, u.id ASC
+		LIMIT ?`, livestreamModel.ID, analyticsTopCommenters); err != nil {
+		return LivestreamAnalytics{}, fmt.Errorf("failed to get top commenters: %w", err)
+	}
+
+	// リアクションが集中した区間
+	var reactions []struct {
+		Bucket    int64  `db:"bucket"`
+		EmojiName string `db:"emoji_name"`
+		Count     int64  `db:"cnt"`
+	}
+	if err := tx.SelectContext(ctx, &reactions, "SELECT created_at DIV ? AS bucket, emoji_name, COUNT(*) AS cnt FROM "+reactionTable(livestreamModel.ID)+" WHERE livestream_id = ? GROUP BY bucket, emoji_name ORDER BY bucket, cnt DESC, emoji_name", analyticsBucketSeconds, livestreamModel.ID); err != nil {
+		return LivestreamAnalytics{}, fmt.Errorf("failed to get reactions timeline: %w", err)
+	}
+	var buckets []ReactionSpike
+	for _, r := range reactions {
+		ts := r.Bucket * analyticsBucketSeconds
+		if len(buckets) == 0 || buckets[len(buckets)-1].Timestamp != ts {
+			// 区間内で件数の多い順に並んでいるので、最初の絵文字がその区間の代表
+			buckets = append(buckets, ReactionSpike{Timestamp: ts, TopEmoji: r.EmojiName})
+		}
+		buckets[len(buckets)-1].TotalReactions += r.Count
+		analytics.TotalReactions += r.Count
+	}
+	if len(buckets) > 0 {
+		mean := analytics.TotalReactions / int64(len(buckets))
+		for _, b := range buckets {
+			if b.TotalReactions > 1 && b.TotalReactions >= mean*analyticsReactionSpikeFactor {
+				analytics.ReactionSpikes = append(analytics.ReactionSpikes, b)
+			}
+		}
+	}
+
+	// モデレーション操作
+	if err := tx.SelectContext(ctx, &analytics.ModerationEvents, "SELECT created_at, action, target_type, target_id, actor_id FROM audit_logs WHERE livestream_id = ? ORDER BY created_at, id", livestreamModel.ID); err != nil {
+		return LivestreamAnalytics{}, fmt.Errorf("failed to get moderation events: %w", err)
+	}
+
+	return analytics, nil
+}
+
+// runAnalyticsWorker は終了した配信のうち未集計のものを定期的に集計する
+func runAnalyticsWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(analyticsWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := aggregateEndedLivestreams(ctx); err != nil {
+				logger.Warnf("failed to aggregate livestream analytics: %v", err)
+			}
+		}
+	}
+}
+
+func aggregateEndedLivestreams(ctx context.Context) error {
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, `
+		SELECT l.* FROM livestreams l
+		LEFT JOIN livestream_analytics a ON a.livestream_id = l.id
+		WHERE l.end_at <= ? AND a.livestream_id IS NULL
+		ORDER BY l.end_at DESC
+		LIMIT ?`, clock.Now().Unix(), analyticsWorkerBatchSize); err != nil {
+		return err
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			_, err := generateLivestreamAnalytics(ctx, tx, livestreamModel)
+			return err
+		}); err != nil {
+			return fmt.Errorf("livestream_id=%d: %w", livestreamModel.ID, err)
+		}
+	}
+	return nil
+}
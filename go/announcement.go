@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxAnnouncementMessageLength   = 255
+	maxAnnouncementsPerLivestream  = 5
+	minAnnouncementIntervalMinutes = 1
+	maxAnnouncementIntervalMinutes = 24 * 60
+
+	announcementSchedulerInterval  = 15 * time.Second
+	announcementSchedulerBatchSize = 100
+)
+
+// LivestreamAnnouncementModel は配信中に定期的に投稿するお知らせ
+// next_post_at を過ぎていても、配信中でなければ投稿しない (配信が始まったらすぐに投稿する)
+type LivestreamAnnouncementModel struct {
+	ID              int64  `db:"id"`
+	LivestreamID    int64  `db:"livestream_id"`
+	Message         string `db:"message"`
+	IntervalMinutes int64  `db:"interval_minutes"`
+	NextPostAt      int64  `db:"next_post_at"`
+	CreatedAt       int64  `db:"created_at"`
+}
+
+type LivestreamAnnouncement struct {
+	ID              int64  `json:"id"`
+	Message         string `json:"message"`
+	IntervalMinutes int64  `json:"interval_minutes"`
+	NextPostAt      int64  `json:"next_post_at"`
+	CreatedAt       int64  `json:"created_at"`
+}
+
+type PostLivestreamAnnouncementRequest struct {
+	Message         string `json:"message"`
+	IntervalMinutes int64  `json:"interval_minutes"`
+}
+
+func newLivestreamAnnouncement(m LivestreamAnnouncementModel) LivestreamAnnouncement {
+	return LivestreamAnnouncement{
+		ID:              m.ID,
+		Message:         m.Message,
+		IntervalMinutes: m.IntervalMinutes,
+		NextPostAt:      m.NextPostAt,
+		CreatedAt:       m.CreatedAt,
+	}
+}
+
+// 配信の定期お知らせ一覧取得API (配信者向け)
+// GET /api/livestream/:livestream_id/announcements
+func getLivestreamAnnouncementsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var models []LivestreamAnnouncementModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM livestream_announcements WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get announcements: "+err.Error()).SetInternal(err)
+	}
+
+	announcements := make([]LivestreamAnnouncement, len(models))
+	for i, m := range models {
+		announcements[i] = newLivestreamAnnouncement(m)
+	}
+	return c.JSON(http.StatusOK, announcements)
+}
+
+// 配信の定期お知らせ追加API (配信者向け)
+// POST /api/livestream/:livestream_id/announcements
+func postLivestreamAnnouncementHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req PostLivestreamAnnouncementRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Message == "" || utf8.RuneCountInString(req.Message) > maxAnnouncementMessageLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "message must be 1 to 255 characters")
+	}
+	if req.IntervalMinutes < minAnnouncementIntervalMinutes || req.IntervalMinutes > maxAnnouncementIntervalMinutes {
+		return echo.NewHTTPError(http.StatusBadRequest, "interval_minutes must be between 1 and 1440")
+	}
+
+	now := clock.Now()
+	m := LivestreamAnnouncementModel{
+		LivestreamID:    livestreamID,
+		Message:         req.Message,
+		IntervalMinutes: req.IntervalMinutes,
+		NextPostAt:      now.Add(time.Duration(req.IntervalMinutes) * time.Minute).Unix(),
+		CreatedAt:       now.Unix(),
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var count int64
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_announcements WHERE livestream_id = ? FOR UPDATE", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count announcements: "+err.Error()).SetInternal(err)
+		}
+		if count >= maxAnnouncementsPerLivestream {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many announcements")
+		}
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_announcements (livestream_id, message, interval_minutes, next_post_at, created_at) VALUES (:livestream_id, :message, :interval_minutes, :next_post_at, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert announcement: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted announcement id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newLivestreamAnnouncement(m))
+}
+
+// 配信の定期お知らせ削除API (配信者向け)
+// DELETE /api/livestream/:livestream_id/announcements/:announcement_id
+func deleteLivestreamAnnouncementHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	announcementID, err := strconv.ParseInt(c.Param("announcement_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "announcement_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_announcements WHERE id = ? AND livestream_id = ?", announcementID, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete announcement: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "announcement not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func runAnnouncementScheduler(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(announcementSchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := postDueAnnouncements(ctx); err != nil {
+			logger.Warnf("failed to post announcements: %v", err)
+		}
+	}
+}
+
+// postDueAnnouncements は配信中の配信で投稿時刻を過ぎたお知らせを投稿する
+// 配信中かどうかは、メディアサーバから通知を受けていればその状態、受けていなければ配信枠で判断する
+func postDueAnnouncements(ctx context.Context) error {
+	now := clock.Now().Unix()
+	var ids []int64
+	if err := dbConn.SelectContext(ctx, &ids, `
+		SELECT a.id FROM livestream_announcements a
+		INNER JOIN livestreams l ON l.id = a.livestream_id
+		WHERE a.next_post_at <= ? AND (l.status = ? OR (l.status = ? AND l.start_at <= ? AND l.end_at > ?))
+		ORDER BY a.next_post_at
+		LIMIT ?`, now, livestreamStatusLive, livestreamStatusUpcoming, now, now, announcementSchedulerBatchSize); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var livestreamID int64
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			livestreamID = 0
+			now := clock.Now()
+			var m LivestreamAnnouncementModel
+			if err := tx.GetContext(ctx, &m, "SELECT * FROM livestream_announcements WHERE id = ? AND next_post_at <= ? FOR UPDATE", id, now.Unix()); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					// 他のサーバが投稿済み、もしくは削除済み
+					return nil
+				}
+				return err
+			}
+			var livestreamModel LivestreamModel
+			if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", m.LivestreamID); err != nil {
+				return err
+			}
+			livestreamID = livestreamModel.ID
+
+			// 止まっていた間の分はまとめて投稿せず、今から数え直す
+			if _, err := tx.ExecContext(ctx, "UPDATE livestream_announcements SET next_post_at = ? WHERE id = ?", now.Add(time.Duration(m.IntervalMinutes)*time.Minute).Unix(), m.ID); err != nil {
+				return err
+			}
+			livecommentModel := LivecommentModel{
+				UserID:       livestreamModel.UserID,
+				LivestreamID: livestreamModel.ID,
+				Comment:      m.Message,
+				CommentType:  livecommentTypeSystem,
+				CreatedAt:    now.Unix(),
+			}
+			if err := insertLivecomment(ctx, tx, &livecommentModel); err != nil {
+				return err
+			}
+			return emitLivecommentEvents(ctx, tx, livecommentModel, livestreamModel.UserID)
+		}); err != nil {
+			return err
+		}
+		if livestreamID != 0 {
+			markLivecommentTrimPending(livestreamID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	anonymizationStatusPending = "pending"
+	anonymizationStatusDone    = "done"
+	anonymizationStatusFailed  = "failed"
+
+	anonymizationWorkerInterval = 10 * time.Second
+
+	anonymizedDisplayName = "Deleted User"
+	anonymizedComment     = "[anonymized]"
+)
+
+var anonymizationWakeup = make(chan struct{}, 1)
+
+type UserAnonymizationModel struct {
+	ID          int64          `db:"id"`
+	UserID      int64          `db:"user_id"`
+	RequestedBy int64          `db:"requested_by"`
+	Status      string         `db:"status"`
+	Error       sql.NullString `db:"error"`
+	CreatedAt   int64          `db:"created_at"`
+	CompletedAt *int64         `db:"completed_at"`
+}
+
+type UserAnonymization struct {
+	ID          int64  `json:"id"`
+	UserID      int64  `json:"user_id"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+	CompletedAt *int64 `json:"completed_at,omitempty"`
+}
+
+func newUserAnonymization(m UserAnonymizationModel) UserAnonymization {
+	return UserAnonymization{
+		ID:          m.ID,
+		UserID:      m.UserID,
+		Status:      m.Status,
+		Error:       m.Error.String,
+		CreatedAt:   m.CreatedAt,
+		CompletedAt: m.CompletedAt,
+	}
+}
+
+// ユーザの匿名化の受付API (管理者向け)
+// POST /api/admin/users/:username/anonymize
+func postUserAnonymizationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	adminID := sess.Values[defaultUserIDKey].(int64)
+
+	var m UserAnonymizationModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var userID int64
+		if err := tx.GetContext(ctx, &userID, "SELECT id FROM users WHERE name = ?", c.Param("username")); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+
+		m = UserAnonymizationModel{
+			UserID:      userID,
+			RequestedBy: adminID,
+			Status:      anonymizationStatusPending,
+			CreatedAt:   clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO user_anonymizations (user_id, requested_by, status, created_at) VALUES (:user_id, :requested_by, :status, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user anonymization: "+err.Error()).SetInternal(err)
+		}
+		if m.ID, err = rs.LastInsertId(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user anonymization id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case anonymizationWakeup <- struct{}{}:
+	default:
+	}
+	return c.JSON(http.StatusAccepted, newUserAnonymization(m))
+}
+
+// ユーザの匿名化の状態取得API (管理者向け)
+// GET /api/admin/anonymizations/:anonymization_id
+func getUserAnonymizationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseInt(c.Param("anonymization_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "anonymization_id in path must be integer")
+	}
+
+	var m UserAnonymizationModel
+	if err := dbConn.GetContext(ctx, &m, "SELECT * FROM user_anonymizations WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "user anonymization not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user anonymization: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, newUserAnonymization(m))
+}
+
+func runAnonymizationWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(anonymizationWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-anonymizationWakeup:
+		}
+
+		var pendings []UserAnonymizationModel
+		if err := dbConn.SelectContext(ctx, &pendings, "SELECT * FROM user_anonymizations WHERE status = ? ORDER BY id", anonymizationStatusPending); err != nil {
+			logger.Warnf("failed to get pending user anonymizations: %v", err)
+			continue
+		}
+		for _, m := range pendings {
+			status, errMessage := anonymizationStatusDone, sql.NullString{}
+			if err := anonymizeUser(ctx, m); err != nil {
+				logger.Warnf("failed to anonymize user %d: %v", m.UserID, err)
+				status, errMessage = anonymizationStatusFailed, sql.NullString{String: err.Error(), Valid: true}
+			} else {
+				// 名前もアイコンも変わったので、古い名前で引けないようにする
+				invalidateIconIndex(ctx, logger, m.UserID)
+			}
+			if _, err := dbConn.ExecContext(ctx, "UPDATE user_anonymizations SET status = ?, error = ?, completed_at = ? WHERE id = ?", status, errMessage, clock.Now().Unix(), m.ID); err != nil {
+				logger.Warnf("failed to update user anonymization %d: %v", m.ID, err)
+			}
+		}
+	}
+}
+
+// anonymizeUser はユーザを特定できる情報を履歴から消す
+// コメント・リアクション・チップの行自体は残すので、配信や配信者の統計は変わらない
+// NOTE: チャンネルの表示名や、PowerDNS に登録したサブドメインはそのまま残る
+func anonymizeUser(ctx context.Context, m UserAnonymizationModel) error {
+	// 元のパスワードでログインできないよう、ランダムな値に置き換える
+	hashed, err := bcrypt.GenerateFromPassword([]byte(uuid.NewString()), bcryptDefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		queries := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"UPDATE users SET name = ?, display_name = ?, description = '', password = ?, email = NULL, email_normalized = NULL WHERE id = ?", []interface{}{"deleted-" + strconv.FormatInt(m.UserID, 10), anonymizedDisplayName, string(hashed), m.UserID}},
+			{"DELETE FROM icons WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM icon_variants WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM user_sessions WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM external_identities WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM user_profile_fields WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM tag_follow_settings WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM watch_history WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM user_mute_words WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM watch_room_members WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM donation_goals WHERE user_id = ?", []interface{}{m.UserID}},
+			// 支払い済みの期間は残し、以降は更新しない
+			{"UPDATE channel_memberships SET canceled_at = ? WHERE (user_id = ? OR owner_id = ?) AND canceled_at = 0", []interface{}{clock.Now().Unix(), m.UserID, m.UserID}},
+			{"DELETE FROM registration_events WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM suspicious_accounts WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM duplicate_account_candidates WHERE user_id = ? OR other_user_id = ?", []interface{}{m.UserID, m.UserID}},
+			{"UPDATE analytics_events SET user_id = NULL WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM image_reviews WHERE user_id = ?", []interface{}{m.UserID}},
+			// 表示名などを含むキャッシュやエクスポートは消す (領収書は必要になれば作り直される)
+			{"DELETE FROM payment_receipts WHERE user_id = ?", []interface{}{m.UserID}},
+			{"DELETE FROM user_exports WHERE user_id = ?", []interface{}{m.UserID}},
+			// 監査ログに残した削除済みコメントの本文
+			{"UPDATE audit_logs SET before_snapshot = JSON_SET(before_snapshot, '$.comment', ?) WHERE target_type = ? AND JSON_EXTRACT(before_snapshot, '$.user_id') = ?", []interface{}{anonymizedComment, auditTargetLivecomment, m.UserID}},
+		}
+		for _, q := range queries {
+			if _, err := tx.ExecContext(ctx, q.query, q.args...); err != nil {
+				return err
+			}
+		}
+		if err := bumpProfileVersion(ctx, tx, m.UserID); err != nil {
+			return err
+		}
+		return insertAuditLog(ctx, tx, m.RequestedBy, auditActionUserAnonymize, auditTargetUser, m.UserID, 0, nil, nil)
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	apiKeyPrefix = "isk_"
+	// 一覧で見せるキーの先頭の長さ (apiKeyPrefix 込み)
+	apiKeyDisplayPrefixLength = 12
+	maxAPIKeyNameLength       = 64
+	// 使用量の取得で返す日数
+	apiKeyUsageDays = 30
+
+	headerAPIKey             = "X-API-Key"
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+	headerRateLimitReset     = "X-RateLimit-Reset"
+
+	apiKeyReasonRateLimited  = "rate_limited"
+	apiKeyReasonDailyQuota   = "daily_quota_exceeded"
+	apiKeyContextKey         = "api_key"
+	apiKeyRateLimitWindowSec = 60
+)
+
+// apiKeyLimit は API キー1つあたりの上限 (発行時のプランで決まり、キーに保存する)
+type apiKeyLimit struct {
+	PerMinute int64
+	PerDay    int64
+}
+
+var apiKeyPlanLimits = map[string]apiKeyLimit{
+	planFree:    {PerMinute: 60, PerDay: 10000},
+	planCreator: {PerMinute: 300, PerDay: 100000},
+	planPro:     {PerMinute: 1200, PerDay: 1000000},
+}
+
+type APIKeyModel struct {
+	ID                 int64  `db:"id"`
+	UserID             int64  `db:"user_id"`
+	Name               string `db:"name"`
+	KeyHash            string `db:"key_hash"`
+	KeyPrefix          string `db:"key_prefix"`
+	RateLimitPerMinute int64  `db:"rate_limit_per_minute"`
+	DailyQuota         int64  `db:"daily_quota"`
+	CreatedAt          int64  `db:"created_at"`
+	RevokedAt          int64  `db:"revoked_at"`
+}
+
+type APIKey struct {
+	ID                 int64  `json:"id"`
+	Name               string `json:"name"`
+	KeyPrefix          string `json:"key_prefix"`
+	RateLimitPerMinute int64  `json:"rate_limit_per_minute"`
+	DailyQuota         int64  `json:"daily_quota"`
+	CreatedAt          int64  `json:"created_at"`
+	// 発行した時にだけ返す (保存しているのはハッシュだけ)
+	Key string `json:"key,omitempty"`
+}
+
+type PostAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+type APIKeyUsage struct {
+	// UTC の日付 (YYYY-MM-DD)
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+}
+
+func newAPIKey(m APIKeyModel) APIKey {
+	return APIKey{
+		ID:                 m.ID,
+		Name:               m.Name,
+		KeyPrefix:          m.KeyPrefix,
+		RateLimitPerMinute: m.RateLimitPerMinute,
+		DailyQuota:         m.DailyQuota,
+		CreatedAt:          m.CreatedAt,
+	}
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyRateWindow はキーごとの1分間の固定窓
+// 窓はプロセスごとに持つので、複数台で動かすと上限は台数倍になる (日ごとの上限は DB で数えるので正確)
+type apiKeyRateWindow struct {
+	start int64
+	count int64
+}
+
+var (
+	apiKeyRateMu      sync.Mutex
+	apiKeyRateWindows = map[int64]*apiKeyRateWindow{}
+)
+
+// allowAPIKeyRequest は1分間の上限に収まっていれば数えて true を返す
+func allowAPIKeyRequest(keyID, limit int64, now time.Time) (remaining, reset int64, ok bool) {
+	start := now.Unix() / apiKeyRateLimitWindowSec * apiKeyRateLimitWindowSec
+	reset = start + apiKeyRateLimitWindowSec
+
+	apiKeyRateMu.Lock()
+	defer apiKeyRateMu.Unlock()
+	w, found := apiKeyRateWindows[keyID]
+	if !found || w.start != start {
+		w = &apiKeyRateWindow{start: start}
+		apiKeyRateWindows[keyID] = w
+	}
+	if w.count >= limit {
+		return 0, reset, false
+	}
+	w.count++
+	return limit - w.count, reset, true
+}
+
+// meterAPIKeyRequest はその日の使用量を1増やし、増やした後の値を返す
+// LAST_INSERT_ID(expr) で、増やした値を同じクエリで受け取る
+func meterAPIKeyRequest(ctx context.Context, keyID int64, now time.Time) (int64, error) {
+	day := now.UTC().Truncate(24 * time.Hour).Unix()
+	rs, err := dbConn.ExecContext(ctx, "INSERT INTO api_key_usages (api_key_id, day, requests) VALUES (?, ?, LAST_INSERT_ID(1)) ON DUPLICATE KEY UPDATE requests = LAST_INSERT_ID(requests + 1)", keyID, day)
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+// apiKeyFromRequest は X-API-Key か Authorization: Bearer のキーを返す
+func apiKeyFromRequest(c echo.Context) string {
+	if key := c.Request().Header.Get(headerAPIKey); key != "" {
+		return key
+	}
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// apiKeyMiddleware は公開APIのキーを確かめ、1分間の上限と日ごとの上限を超えたら 429 を返す
+// 上限に収まったリクエストだけを使用量として数える
+func apiKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		key := apiKeyFromRequest(c)
+		if !strings.HasPrefix(key, apiKeyPrefix) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "api key is required")
+		}
+		var m APIKeyModel
+		if err := dbConn.GetContext(ctx, &m, "SELECT * FROM api_keys WHERE key_hash = ? AND revoked_at = 0", apiKeyHash(key)); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid api key")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api key: "+err.Error()).SetInternal(err)
+		}
+
+		now := clock.Now()
+		remaining, reset, ok := allowAPIKeyRequest(m.ID, m.RateLimitPerMinute, now)
+		h := c.Response().Header()
+		h.Set(headerRateLimitLimit, strconv.FormatInt(m.RateLimitPerMinute, 10))
+		h.Set(headerRateLimitRemaining, strconv.FormatInt(remaining, 10))
+		h.Set(headerRateLimitReset, strconv.FormatInt(reset, 10))
+		if !ok {
+			h.Set(echo.HeaderRetryAfter, strconv.FormatInt(reset-now.Unix(), 10))
+			return newReasonedError(http.StatusTooManyRequests, apiKeyReasonRateLimited, fmt.Sprintf("rate limit of %d requests per minute is exceeded", m.RateLimitPerMinute))
+		}
+
+		used, err := meterAPIKeyRequest(ctx, m.ID, now)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to meter api key usage: "+err.Error()).SetInternal(err)
+		}
+		if used > m.DailyQuota {
+			tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			h.Set(echo.HeaderRetryAfter, strconv.FormatInt(tomorrow.Unix()-now.Unix(), 10))
+			return newReasonedError(http.StatusTooManyRequests, apiKeyReasonDailyQuota, fmt.Sprintf("daily quota of %d requests is exceeded", m.DailyQuota))
+		}
+
+		c.Set(apiKeyContextKey, m)
+		return next(c)
+	}
+}
+
+// APIキーの一覧API
+// GET /api/user/me/api_keys
+func getAPIKeysHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var models []APIKeyModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM api_keys WHERE user_id = ? AND revoked_at = 0 ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api keys: "+err.Error()).SetInternal(err)
+	}
+	keys := make([]APIKey, len(models))
+	for i, m := range models {
+		keys[i] = newAPIKey(m)
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// APIキーの発行API
+// POST /api/user/me/api_keys
+// 上限はその時点のプランで決まる (プランを変えたら発行し直す)
+func postAPIKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PostAPIKeyRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxAPIKeyNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must be 1 to 64 characters")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate api key: "+err.Error()).SetInternal(err)
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+
+	m := APIKeyModel{
+		UserID:    userID,
+		Name:      req.Name,
+		KeyHash:   apiKeyHash(key),
+		KeyPrefix: key[:apiKeyDisplayPrefixLength],
+		CreatedAt: clock.Now().Unix(),
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := checkQuota(ctx, tx, userID, quotaAPITokens, 0); err != nil {
+			return err
+		}
+		plan, err := fetchUserPlan(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user plan: "+err.Error()).SetInternal(err)
+		}
+		limit, ok := apiKeyPlanLimits[plan]
+		if !ok {
+			limit = apiKeyPlanLimits[planFree]
+		}
+		m.RateLimitPerMinute, m.DailyQuota = limit.PerMinute, limit.PerDay
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO api_keys (user_id, name, key_hash, key_prefix, rate_limit_per_minute, daily_quota, created_at) VALUES (:user_id, :name, :key_hash, :key_prefix, :rate_limit_per_minute, :daily_quota, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert api key: "+err.Error()).SetInternal(err)
+		}
+		if m.ID, err = rs.LastInsertId(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted api key id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	res := newAPIKey(m)
+	res.Key = key
+	return c.JSON(http.StatusCreated, res)
+}
+
+// APIキーの失効API
+// DELETE /api/user/me/api_keys/:key_id
+func deleteAPIKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	keyID, err := strconv.ParseInt(c.Param("key_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "key_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at = 0", clock.Now().Unix(), keyID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke api key: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "api key not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// APIキーの使用量取得API
+// GET /api/user/me/api_keys/:key_id/usage
+// 直近30日の日ごとのリクエスト数 (上限で拒否したものは含まない)
+func getAPIKeyUsageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	keyID, err := strconv.ParseInt(c.Param("key_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "key_id in path must be integer")
+	}
+
+	usages := []APIKeyUsage{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var owner int64
+		if err := tx.GetContext(ctx, &owner, "SELECT user_id FROM api_keys WHERE id = ?", keyID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "api key not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api key: "+err.Error()).SetInternal(err)
+		}
+		if owner != userID {
+			return echo.NewHTTPError(http.StatusNotFound, "api key not found")
+		}
+
+		since := clock.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(apiKeyUsageDays - 1)).Unix()
+		var rows []struct {
+			Day      int64 `db:"day"`
+			Requests int64 `db:"requests"`
+		}
+		if err := tx.SelectContext(ctx, &rows, "SELECT day, requests FROM api_key_usages WHERE api_key_id = ? AND day >= ? ORDER BY day", keyID, since); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api key usage: "+err.Error()).SetInternal(err)
+		}
+		for _, r := range rows {
+			usages = append(usages, APIKeyUsage{Day: time.Unix(r.Day, 0).UTC().Format("2006-01-02"), Requests: r.Requests})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, usages)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultV2ListLimit = 50
+	maxV2ListLimit     = 100
+
+	// v1 の一覧APIはレスポンスが配列なので、次のページのカーソルはヘッダで返す
+	headerNextCursor = "X-Next-Cursor"
+)
+
+// ListResponse は v2 の一覧APIで共通のレスポンス
+// 項目は v1 と同じ型 (フィールド名はすべて snake_case) をそのまま使う
+type ListResponse struct {
+	Items interface{} `json:"items"`
+	// 次のページを取得する際に cursor に指定する値 (続きが無い場合は空)
+	NextCursor string `json:"next_cursor"`
+	// with_total=true を指定した場合だけ返す (cursor に関わらず条件に合う全件数)
+	Total *int64 `json:"total,omitempty"`
+	// 1つの配信の一覧で、項目から配信を省いた場合だけ返す (embed_livestream)
+	Livestream *Livestream `json:"livestream,omitempty"`
+}
+
+// listParams は v2 の一覧APIで共通のクエリパラメータ
+// 並び順は常に id の降順で、カーソルは前のページの最後の項目の id
+type listParams struct {
+	Limit     int64
+	Cursor    int64
+	WithTotal bool
+}
+
+func parseListParams(c echo.Context) (listParams, error) {
+	p := listParams{Limit: defaultV2ListLimit}
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || l < 1 {
+			return listParams{}, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if l > maxV2ListLimit {
+			l = maxV2ListLimit
+		}
+		p.Limit = l
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		cursor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || cursor < 1 {
+			return listParams{}, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor query parameter")
+		}
+		p.Cursor = cursor
+	}
+	if v := c.QueryParam("with_total"); v != "" {
+		withTotal, err := strconv.ParseBool(v)
+		if err != nil {
+			return listParams{}, echo.NewHTTPError(http.StatusBadRequest, "with_total query parameter must be bool")
+		}
+		p.WithTotal = withTotal
+	}
+	return p, nil
+}
+
+// parseV1ListParams は v1 の一覧APIの limit / cursor を読む
+// どちらも指定が無ければ paged = false で、従来どおり全件を返す
+// v1 の limit は以前から上限が無いので maxV2ListLimit で丸めない
+func parseV1ListParams(c echo.Context) (p listParams, paged bool, err error) {
+	if c.QueryParam("limit") == "" && c.QueryParam("cursor") == "" {
+		return listParams{}, false, nil
+	}
+	if p, err = parseListParams(c); err != nil {
+		return listParams{}, false, err
+	}
+	if l, err := strconv.ParseInt(c.QueryParam("limit"), 10, 64); err == nil && l > p.Limit {
+		p.Limit = l
+	}
+	return p, true, nil
+}
+
+// setNextCursorHeader は v1 の一覧APIで次のページがあればカーソルをヘッダに入れる
+func setNextCursorHeader(c echo.Context, next string) {
+	if next != "" {
+		c.Response().Header().Set(headerNextCursor, next)
+	}
+}
+
+// apply はカーソル・並び順・件数を q に追加する
+// 次ページの有無を判定するために1件多く取得する
+func (p listParams) apply(q *selectQuery, idColumn string) {
+	if p.Cursor > 0 {
+		q.Where(idColumn+" < ?", p.Cursor)
+	}
+	q.OrderBy(idColumn + " DESC").Limit(p.Limit + 1)
+}
+
+// applyByCreatedAt は v1 の並び順 (created_at の降順) のままページングする
+// 同じ時刻の行は id で並べ、カーソルは id のまま (カーソルの行より後ろを table から引いて比べる)
+func (p listParams) applyByCreatedAt(q *selectQuery, table string) {
+	if p.Cursor > 0 {
+		q.Where("(created_at, id) < (SELECT created_at, id FROM "+table+" WHERE id = ?)", p.Cursor)
+	}
+	q.OrderBy("created_at DESC, id DESC").Limit(p.Limit + 1)
+}
+
+// page は取得した n 件のうち返す件数と次のカーソルを返す
+func (p listParams) page(n int, idAt func(i int) int64) (int, string) {
+	if int64(n) <= p.Limit {
+		return n, ""
+	}
+	return int(p.Limit), strconv.FormatInt(idAt(int(p.Limit)-1), 10)
+}
+
+// total は with_total が指定されていれば件数を数える
+func (p listParams) total(c echo.Context, tx *sqlx.Tx, query string, args []interface{}) (*int64, error) {
+	if !p.WithTotal {
+		return nil, nil
+	}
+	var total int64
+	if err := tx.GetContext(c.Request().Context(), &total, query, args...); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to count items: "+err.Error()).SetInternal(err)
+	}
+	return &total, nil
+}
+
+// ライブコメント一覧API (v2)
+// GET /api/v2/livestream/:livestream_id/livecomment?type=&limit=&cursor=&with_total=&embed_livestream=
+func getLivecommentsV2Handler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	p, err := parseListParams(c)
+	if err != nil {
+		return err
+	}
+	embed, err := embedLivestreamParam(c, false)
+	if err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM "+livecommentTable(livestreamID)).Where("livestream_id = ?", livestreamID)
+	if err := q.WhereInListParam(c, "type", "comment_type", isValidLivecommentType); err != nil {
+		return err
+	}
+	excludeHeldLivecomments(q, livestreamID, userID)
+	countQuery, countArgs := q.BuildCount("SELECT COUNT(*) FROM " + livecommentTable(livestreamID))
+	p.apply(q, "id")
+	query, args := q.Build()
+
+	res := ListResponse{Items: []Livecomment{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamID, userID); err != nil {
+			return err
+		}
+
+		var livecommentModels []LivecommentModel
+		if err := tx.SelectContext(ctx, &livecommentModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error()).SetInternal(err)
+		}
+		n, next := p.page(len(livecommentModels), func(i int) int64 { return livecommentModels[i].ID })
+		// ミュートしたコメントはページを切ってから除く (カーソルがずれないように)
+		visible, err := filterMutedLivecomments(ctx, userID, livecommentModels[:n])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to filter muted livecomments: "+err.Error()).SetInternal(err)
+		}
+		livecomments, err := fillLivecommentResponses(ctx, tx, visible)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error()).SetInternal(err)
+		}
+		res.Items, res.NextCursor = livecomments, next
+		if !embed {
+			res.Items = compactLivecomments(livecomments)
+			if res.Livestream, err = fetchListLivestream(ctx, tx, livestreamID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		res.Total, err = p.total(c, tx, countQuery, countArgs)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// リアクション一覧API (v2)
+// GET /api/v2/livestream/:livestream_id/reaction?limit=&cursor=&with_total=
+func getReactionsV2Handler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	p, err := parseListParams(c)
+	if err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	q := newSelectQuery("SELECT * FROM "+reactionTable(livestreamID)).Where("livestream_id = ?", livestreamID)
+	countQuery, countArgs := q.BuildCount("SELECT COUNT(*) FROM " + reactionTable(livestreamID))
+	p.apply(q, "id")
+	query, args := q.Build()
+
+	res := ListResponse{Items: []Reaction{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamID, userID); err != nil {
+			return err
+		}
+
+		var reactionModels []ReactionModel
+		if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error()).SetInternal(err)
+		}
+		n, next := p.page(len(reactionModels), func(i int) int64 { return reactionModels[i].ID })
+		reactions, err := fillReactionResponses(ctx, tx, reactionModels[:n])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error()).SetInternal(err)
+		}
+		res.Items, res.NextCursor = reactions, next
+
+		res.Total, err = p.total(c, tx, countQuery, countArgs)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 配信検索API (v2)
+// GET /api/v2/livestream/search?tag=&limit=&cursor=&with_total=
+// v1 と違い、タグを指定した場合もページングできる
+func searchLivestreamsV2Handler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	p, err := parseListParams(c)
+	if err != nil {
+		return err
+	}
+
+	res := ListResponse{Items: []Livestream{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		q := newSelectQuery("SELECT * FROM livestreams").Where("visibility <> ?", livestreamVisibilityUnlisted)
+		if playlistHealthCheckEnabled {
+			q.Where(healthyLivestreamCondition("livestreams"))
+		}
+		if tagName := c.QueryParam("tag"); tagName != "" {
+			// 表記揺れ・同義語も同じタグとして扱う
+			resolver, err := loadTagResolver(ctx, tx)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error()).SetInternal(err)
+			}
+			tagIDs := resolver.searchIDs(tagName)
+			if len(tagIDs) == 0 {
+				if p.WithTotal {
+					res.Total = new(int64)
+				}
+				return nil
+			}
+			args := make([]interface{}, len(tagIDs))
+			for i, id := range tagIDs {
+				args[i] = id
+			}
+			q.Where("id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?"+strings.Repeat(", ?", len(tagIDs)-1)+"))", args...)
+		}
+		countQuery, countArgs := q.BuildCount("SELECT COUNT(*) FROM livestreams")
+		p.apply(q, "id")
+		query, args := q.Build()
+
+		var livestreamModels []LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+		}
+		n, next := p.page(len(livestreamModels), func(i int) int64 { return livestreamModels[i].ID })
+		livestreams := make([]Livestream, n)
+		for i := range livestreams {
+			livestream, err := fillLivestreamResponse(ctx, tx, livestreamModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			livestreams[i] = livestream
+		}
+		res.Items, res.NextCursor = livestreams, next
+
+		res.Total, err = p.total(c, tx, countQuery, countArgs)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// ライブコメントのスパム報告一覧API (v2, 配信者向け)
+// GET /api/v2/livestream/:livestream_id/report?limit=&cursor=&with_total=&embed_livestream=
+func getLivecommentReportsV2Handler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	p, err := parseListParams(c)
+	if err != nil {
+		return err
+	}
+	embed, err := embedLivestreamParam(c, false)
+	if err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM livecomment_reports").Where("livestream_id = ?", livestreamID)
+	countQuery, countArgs := q.BuildCount("SELECT COUNT(*) FROM livecomment_reports")
+	p.apply(q, "id")
+	query, args := q.Build()
+
+	res := ListResponse{Items: []LivecommentReport{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var reportModels []LivecommentReportModel
+		if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error()).SetInternal(err)
+		}
+		n, next := p.page(len(reportModels), func(i int) int64 { return reportModels[i].ID })
+		reports, err := fillLivecommentReportResponses(ctx, tx, reportModels[:n])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment reports: "+err.Error()).SetInternal(err)
+		}
+		res.Items, res.NextCursor = reports, next
+		if !embed {
+			res.Items = compactLivecommentReports(reports)
+			if res.Livestream, err = fetchListLivestream(ctx, tx, livestreamID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		res.Total, err = p.total(c, tx, countQuery, countArgs)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
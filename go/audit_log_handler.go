@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	auditActionNGWordAdd         = "ng_word.add"
+	auditActionLivecommentDelete = "livecomment.delete"
+	auditActionReportCreate      = "livecomment_report.create"
+	auditActionReportResolve     = "livecomment_report.resolve"
+	auditActionUserAnonymize     = "user.anonymize"
+
+	auditTargetNGWord            = "ng_word"
+	auditTargetLivecomment       = "livecomment"
+	auditTargetLivecommentReport = "livecomment_report"
+	auditTargetUser              = "user"
+
+	defaultAuditLogsLimit = 100
+	maxAuditLogsLimit     = 1000
+)
+
+type AuditLogModel struct {
+	ID             int64  `db:"id"`
+	ActorID        int64  `db:"actor_id"`
+	Action         string `db:"action"`
+	TargetType     string `db:"target_type"`
+	TargetID       int64  `db:"target_id"`
+	LivestreamID   int64  `db:"livestream_id"`
+	BeforeSnapshot []byte `db:"before_snapshot"`
+	AfterSnapshot  []byte `db:"after_snapshot"`
+	CreatedAt      int64  `db:"created_at"`
+}
+
+type AuditLog struct {
+	ID           int64           `json:"id"`
+	ActorID      int64           `json:"actor_id"`
+	Action       string          `json:"action"`
+	TargetType   string          `json:"target_type"`
+	TargetID     int64           `json:"target_id"`
+	LivestreamID int64           `json:"livestream_id"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	CreatedAt    int64           `json:"created_at"`
+}
+
+// insertAuditLog は操作と同じトランザクション内で監査ログを書き込む
+// before/after には操作前後のスナップショットを渡す (存在しない場合はnil)
+func insertAuditLog(ctx context.Context, tx *sqlx.Tx, actorID int64, action, targetType string, targetID, livestreamID int64, before, after interface{}) error {
+	auditLog := AuditLogModel{
+		ActorID:      actorID,
+		Action:       action,
+		TargetType:   targetType,
+		TargetID:     targetID,
+		LivestreamID: livestreamID,
+		CreatedAt:    clock.Now().Unix(),
+	}
+
+	var err error
+	if before != nil {
+		if auditLog.BeforeSnapshot, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		if auditLog.AfterSnapshot, err = json.Marshal(after); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO audit_logs (actor_id, action, target_type, target_id, livestream_id, before_snapshot, after_snapshot, created_at) VALUES (:actor_id, :action, :target_type, :target_id, :livestream_id, :before_snapshot, :after_snapshot, :created_at)", auditLog)
+	return err
+}
+
+// 監査ログ検索API (管理者向け)
+// GET /api/admin/audit_logs
+func getAuditLogsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM audit_logs").OrderBy("created_at DESC, id DESC")
+	for _, key := range []string{"actor_id", "target_id", "livestream_id"} {
+		if err := q.WhereInt64Param(c, key, key+" = ?"); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"action", "target_type"} {
+		if v := c.QueryParam(key); v != "" {
+			q.Where(key+" = ?", v)
+		}
+	}
+	if err := q.WhereInt64Param(c, "since", "created_at >= ?"); err != nil {
+		return err
+	}
+	if err := q.WhereInt64Param(c, "until", "created_at < ?"); err != nil {
+		return err
+	}
+
+	limit := int64(defaultAuditLogsLimit)
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		if l > maxAuditLogsLimit {
+			l = maxAuditLogsLimit
+		}
+		limit = l
+	}
+	query, args := q.Limit(limit).Build()
+
+	var auditLogModels []AuditLogModel
+	if err := dbConn.SelectContext(ctx, &auditLogModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get audit logs: "+err.Error()).SetInternal(err)
+	}
+
+	auditLogs := make([]AuditLog, len(auditLogModels))
+	for i, m := range auditLogModels {
+		auditLogs[i] = AuditLog{
+			ID:           m.ID,
+			ActorID:      m.ActorID,
+			Action:       m.Action,
+			TargetType:   m.TargetType,
+			TargetID:     m.TargetID,
+			LivestreamID: m.LivestreamID,
+			Before:       m.BeforeSnapshot,
+			After:        m.AfterSnapshot,
+			CreatedAt:    m.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, auditLogs)
+}
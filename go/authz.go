@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 配信者本人
+	authzRoleOwner = "owner"
+
+	// 他のサーバでの付与・剥奪は、この時間だけ遅れて反映される
+	authzRoleCacheTTL = 10 * time.Second
+)
+
+// 配信に対する操作
+const (
+	actionModerate          = "livestream.moderate"
+	actionViewReports       = "livestream.view_reports"
+	actionViewAnalytics     = "livestream.view_analytics"
+	actionManageLivestream  = "livestream.manage"
+	actionRunPrivilegedChat = "livestream.run_privileged_command"
+	actionCancelReservation = "livestream.cancel_reservation"
+)
+
+type authzPolicy struct {
+	// 操作できる役割 (配信者本人か、チャンネルでの役割)
+	Roles []string
+	// 拒否したときのステータスとメッセージ (これまでの個別のチェックと同じにしている)
+	DeniedStatus  int
+	DeniedMessage string
+}
+
+var authzPolicies = map[string]authzPolicy{
+	actionModerate: {
+		Roles:         []string{authzRoleOwner},
+		DeniedStatus:  http.StatusBadRequest,
+		DeniedMessage: "A streamer can't moderate livestreams that other streamers own",
+	},
+	actionViewReports: {
+		Roles:         []string{authzRoleOwner},
+		DeniedStatus:  http.StatusForbidden,
+		DeniedMessage: "can't get other streamer's livecomment reports",
+	},
+	actionViewAnalytics: {
+		Roles:         []string{authzRoleOwner},
+		DeniedStatus:  http.StatusForbidden,
+		DeniedMessage: "can't get other streamer's analytics report",
+	},
+	actionManageLivestream: {
+		Roles:         []string{authzRoleOwner},
+		DeniedStatus:  http.StatusForbidden,
+		DeniedMessage: "A streamer can't manage livestreams that other streamers own",
+	},
+	actionRunPrivilegedChat: {
+		Roles:         []string{authzRoleOwner, channelRoleVIP},
+		DeniedStatus:  http.StatusForbidden,
+		DeniedMessage: "only the streamer and VIPs can run this command",
+	},
+	actionCancelReservation: {
+		Roles:         []string{authzRoleOwner},
+		DeniedStatus:  http.StatusForbidden,
+		DeniedMessage: "can't cancel other streamer's livestream",
+	},
+}
+
+// routePermissions はルートごとに必要な操作 (echo のルート定義と同じ形式で c.Path() と比較する)
+// パスの :livestream_id の配信に対して authorizationMiddleware が検証する
+var routePermissions = map[string]string{
+	http.MethodPost + " /api/livestream/:livestream_id/moderate":                           actionModerate,
+	http.MethodGet + " /api/livestream/:livestream_id/report":                              actionViewReports,
+	http.MethodPost + " /api/livestream/:livestream_id/report/:report_id/resolve":          actionModerate,
+	http.MethodGet + " /api/v2/livestream/:livestream_id/report":                           actionViewReports,
+	http.MethodGet + " /api/livestream/:livestream_id/analytics":                           actionViewAnalytics,
+	http.MethodGet + " /api/livestream/:livestream_id/spam_holds":                          actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/spam_holds/:livecomment_id/approve": actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/spam_holds/:livecomment_id/reject":  actionManageLivestream,
+	http.MethodGet + " /api/livestream/:livestream_id/blocklists":                          actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/blocklists":                         actionManageLivestream,
+	http.MethodDelete + " /api/livestream/:livestream_id/blocklists/:blocklist_id":         actionManageLivestream,
+	http.MethodGet + " /api/livestream/:livestream_id/commands":                            actionManageLivestream,
+	http.MethodPut + " /api/livestream/:livestream_id/commands/:command":                   actionManageLivestream,
+	http.MethodPut + " /api/livestream/:livestream_id/comment_rules":                       actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/stream_key":                         actionManageLivestream,
+	http.MethodDelete + " /api/livestream/:livestream_id/stream_key":                       actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/captions":                           actionManageLivestream,
+	http.MethodDelete + " /api/livestream/:livestream_id/captions/:caption_id":             actionManageLivestream,
+	http.MethodGet + " /api/livestream/:livestream_id/announcements":                       actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/announcements":                      actionManageLivestream,
+	http.MethodDelete + " /api/livestream/:livestream_id/announcements/:announcement_id":   actionManageLivestream,
+	http.MethodGet + " /api/livestream/:livestream_id/highlights":                          actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/highlights/:highlight_id/confirm":   actionManageLivestream,
+	http.MethodDelete + " /api/livestream/:livestream_id/highlights/:highlight_id":         actionManageLivestream,
+	http.MethodPut + " /api/livestream/:livestream_id/questions/:question_id":              actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/raid":                               actionManageLivestream,
+	http.MethodPost + " /api/livestream/:livestream_id/chat_imports":                       actionManageLivestream,
+	http.MethodGet + " /api/livestream/:livestream_id/chat_imports/:import_id":             actionManageLivestream,
+	http.MethodDelete + " /api/livestream/:livestream_id/reservation":                      actionCancelReservation,
+}
+
+// authzLivestream は認可に使う配信の情報 (配信者とチャンネルは作成後に変わらないので、期限なしで覚えておく)
+type authzLivestream struct {
+	OwnerID   int64
+	ChannelID int64
+}
+
+type authzRoleEntry struct {
+	Role      string
+	ExpiresAt time.Time
+}
+
+var authzCache = struct {
+	sync.RWMutex
+	livestreams map[int64]authzLivestream
+	roles       map[channelRoleKey]authzRoleEntry
+}{
+	livestreams: map[int64]authzLivestream{},
+	roles:       map[channelRoleKey]authzRoleEntry{},
+}
+
+var errAuthzLivestreamNotFound = errors.New("livestream not found")
+
+func authzLivestreamOf(ctx context.Context, db sqlx.QueryerContext, livestreamID int64) (authzLivestream, error) {
+	authzCache.RLock()
+	l, ok := authzCache.livestreams[livestreamID]
+	authzCache.RUnlock()
+	if ok {
+		return l, nil
+	}
+
+	var m LivestreamModel
+	if err := sqlx.GetContext(ctx, db, &m, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return authzLivestream{}, errAuthzLivestreamNotFound
+		}
+		return authzLivestream{}, err
+	}
+	l = authzLivestream{OwnerID: m.UserID, ChannelID: m.ChannelID}
+	authzCache.Lock()
+	authzCache.livestreams[livestreamID] = l
+	authzCache.Unlock()
+	return l, nil
+}
+
+func authzRoleOf(ctx context.Context, db sqlx.QueryerContext, key channelRoleKey) (string, error) {
+	now := clock.Now()
+	authzCache.RLock()
+	entry, ok := authzCache.roles[key]
+	authzCache.RUnlock()
+	if ok && now.Before(entry.ExpiresAt) {
+		return entry.Role, nil
+	}
+
+	role, err := fetchChannelRole(ctx, db, key)
+	if err != nil {
+		return "", err
+	}
+	authzCache.Lock()
+	authzCache.roles[key] = authzRoleEntry{Role: role, ExpiresAt: now.Add(authzRoleCacheTTL)}
+	authzCache.Unlock()
+	return role, nil
+}
+
+// invalidateAuthzChannelRoles はチャンネルでの役割を変えたときに呼ぶ (そのチャンネルの分をすべて捨てる)
+func invalidateAuthzChannelRoles(ownerID, channelID int64) {
+	authzCache.Lock()
+	for key := range authzCache.roles {
+		if key.OwnerID == ownerID && key.ChannelID == channelID {
+			delete(authzCache.roles, key)
+		}
+	}
+	authzCache.Unlock()
+}
+
+// resetAuthzCache は初期化でデータを入れ直したときに呼ぶ
+func resetAuthzCache() {
+	authzCache.Lock()
+	authzCache.livestreams = map[int64]authzLivestream{}
+	authzCache.roles = map[channelRoleKey]authzRoleEntry{}
+	authzCache.Unlock()
+}
+
+// Can はユーザが配信に対して action を行えるかを返す
+// 配信が無ければ errAuthzLivestreamNotFound を返す
+func Can(ctx context.Context, db sqlx.QueryerContext, userID int64, action string, livestreamID int64) (bool, error) {
+	policy, ok := authzPolicies[action]
+	if !ok {
+		return false, errors.New("unknown action: " + action)
+	}
+	l, err := authzLivestreamOf(ctx, db, livestreamID)
+	if err != nil {
+		return false, err
+	}
+
+	var role string
+	var roleLoaded bool
+	for _, allowed := range policy.Roles {
+		if allowed == authzRoleOwner {
+			if l.OwnerID == userID {
+				return true, nil
+			}
+			continue
+		}
+		if !roleLoaded {
+			if role, err = authzRoleOf(ctx, db, channelRoleKey{OwnerID: l.OwnerID, ChannelID: l.ChannelID, UserID: userID}); err != nil {
+				return false, err
+			}
+			roleLoaded = true
+		}
+		if role == allowed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorize は Can で拒否された場合のエラーを返す
+func authorize(ctx context.Context, db sqlx.QueryerContext, userID int64, action string, livestreamID int64) error {
+	ok, err := Can(ctx, db, userID, action, livestreamID)
+	if err != nil {
+		if errors.Is(err, errAuthzLivestreamNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to authorize: "+err.Error()).SetInternal(err)
+	}
+	if !ok {
+		policy := authzPolicies[action]
+		return echo.NewHTTPError(policy.DeniedStatus, policy.DeniedMessage)
+	}
+	return nil
+}
+
+// authorizationMiddleware は routePermissions に載っているルートで、パスの配信に対する操作を認可する
+func authorizationMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		action, ok := routePermissions[c.Request().Method+" "+c.Path()]
+		if !ok {
+			return next(c)
+		}
+
+		if err := verifyUserSession(c); err != nil {
+			return err
+		}
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+
+		livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		}
+		if err := authorize(c.Request().Context(), dbConn, userID, action, livestreamID); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
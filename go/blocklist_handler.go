@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	auditActionBlocklistWordAdd    = "blocklist_word.add"
+	auditActionBlocklistWordDelete = "blocklist_word.delete"
+	auditTargetBlocklistWord       = "blocklist_word"
+)
+
+type BlocklistModel struct {
+	ID          int64  `db:"id"`
+	UserID      int64  `db:"user_id"`
+	Name        string `db:"name"`
+	Description string `db:"description"`
+	Published   bool   `db:"published"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
+type BlocklistWordModel struct {
+	ID          int64  `db:"id"`
+	BlocklistID int64  `db:"blocklist_id"`
+	Word        string `db:"word"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
+type BlocklistWord struct {
+	ID   int64  `json:"id"`
+	Word string `json:"word"`
+}
+
+type Blocklist struct {
+	ID          int64           `json:"id"`
+	Owner       string          `json:"owner"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Published   bool            `json:"published"`
+	Words       []BlocklistWord `json:"words"`
+	CreatedAt   int64           `json:"created_at"`
+}
+
+type PostBlocklistRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Published   bool   `json:"published"`
+}
+
+type PostBlocklistWordRequest struct {
+	Word string `json:"word"`
+}
+
+type SubscribeBlocklistRequest struct {
+	BlocklistID int64 `json:"blocklist_id"`
+}
+
+// matchNGWords はコメントがいずれかのNGワードを含むかを判定する
+// 照合順序が utf8mb4_bin なので、LIKE '%word%' と同じく大文字小文字を区別する部分一致になる
+func matchNGWords(comment string, words []string) bool {
+	for _, w := range words {
+		if w != "" && strings.Contains(comment, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSpamWords は配信のNGワードと、配信が購読しているブロックリストの語をまとめて返す
+// 非公開にされたブロックリストは、作成者自身の配信でなければ無視する
+func fetchSpamWords(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) ([]string, error) {
+	var words []string
+	if err := tx.SelectContext(ctx, &words, `
+		SELECT word FROM ng_words WHERE user_id = ? AND livestream_id = ?
+		UNION
+		SELECT w.word FROM livestream_blocklists lb
+		INNER JOIN blocklists b ON b.id = lb.blocklist_id
+		INNER JOIN blocklist_words w ON w.blocklist_id = b.id
+		WHERE lb.livestream_id = ? AND (b.published = TRUE OR b.user_id = ?)`,
+		livestreamModel.UserID, livestreamModel.ID, livestreamModel.ID, livestreamModel.UserID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return words, nil
+}
+
+func fillBlocklistResponse(ctx context.Context, tx *sqlx.Tx, m BlocklistModel) (Blocklist, error) {
+	var ownerName string
+	if err := tx.GetContext(ctx, &ownerName, "SELECT name FROM users WHERE id = ?", m.UserID); err != nil {
+		return Blocklist{}, err
+	}
+
+	var wordModels []BlocklistWordModel
+	if err := tx.SelectContext(ctx, &wordModels, "SELECT * FROM blocklist_words WHERE blocklist_id = ? ORDER BY id", m.ID); err != nil {
+		return Blocklist{}, err
+	}
+	words := make([]BlocklistWord, len(wordModels))
+	for i, w := range wordModels {
+		words[i] = BlocklistWord{ID: w.ID, Word: w.Word}
+	}
+
+	return Blocklist{
+		ID:          m.ID,
+		Owner:       ownerName,
+		Name:        m.Name,
+		Description: m.Description,
+		Published:   m.Published,
+		Words:       words,
+		CreatedAt:   m.CreatedAt,
+	}, nil
+}
+
+// getVisibleBlocklist は公開されているか自分の作ったブロックリストを返す
+func getVisibleBlocklist(ctx context.Context, tx *sqlx.Tx, blocklistID, userID int64) (BlocklistModel, error) {
+	var m BlocklistModel
+	if err := tx.GetContext(ctx, &m, "SELECT * FROM blocklists WHERE id = ?", blocklistID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return BlocklistModel{}, echo.NewHTTPError(http.StatusNotFound, "blocklist not found")
+		}
+		return BlocklistModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get blocklist: "+err.Error()).SetInternal(err)
+	}
+	if !m.Published && m.UserID != userID {
+		return BlocklistModel{}, echo.NewHTTPError(http.StatusNotFound, "blocklist not found")
+	}
+	return m, nil
+}
+
+// ブロックリスト作成API
+// POST /api/blocklist
+func postBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostBlocklistRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+
+	var blocklist Blocklist
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m := BlocklistModel{
+			UserID:      userID,
+			Name:        req.Name,
+			Description: req.Description,
+			Published:   req.Published,
+			CreatedAt:   clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO blocklists (user_id, name, description, published, created_at) VALUES (:user_id, :name, :description, :published, :created_at)", &m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert blocklist: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted blocklist id: "+err.Error()).SetInternal(err)
+		}
+
+		blocklist, err = fillBlocklistResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill blocklist: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, blocklist)
+}
+
+// 公開ブロックリスト一覧取得API
+// GET /api/blocklist
+func getBlocklistsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM blocklists").
+		Where("published = TRUE").
+		OrderBy("id DESC")
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var blocklists []Blocklist
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []BlocklistModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get blocklists: "+err.Error()).SetInternal(err)
+		}
+
+		blocklists = make([]Blocklist, len(models))
+		for i := range models {
+			b, err := fillBlocklistResponse(ctx, tx, models[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill blocklist: "+err.Error()).SetInternal(err)
+			}
+			blocklists[i] = b
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, blocklists)
+}
+
+// ブロックリスト取得API
+// GET /api/blocklist/:blocklist_id
+func getBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	blocklistID, err := strconv.ParseInt(c.Param("blocklist_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "blocklist_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var blocklist Blocklist
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getVisibleBlocklist(ctx, tx, blocklistID, userID)
+		if err != nil {
+			return err
+		}
+		blocklist, err = fillBlocklistResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill blocklist: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, blocklist)
+}
+
+// ブロックリストへの語の追加API (作成者のみ)
+// POST /api/blocklist/:blocklist_id/words
+func postBlocklistWordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	blocklistID, err := strconv.ParseInt(c.Param("blocklist_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "blocklist_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostBlocklistWordRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Word == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "word must not be empty")
+	}
+
+	var word BlocklistWord
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getVisibleBlocklist(ctx, tx, blocklistID, userID)
+		if err != nil {
+			return err
+		}
+		if m.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "only the owner can edit the blocklist")
+		}
+
+		createdAt := clock.Now().Unix()
+		rs, err := tx.ExecContext(ctx, "INSERT INTO blocklist_words (blocklist_id, word, created_at) VALUES (?, ?, ?)", blocklistID, req.Word, createdAt)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert blocklist word: "+err.Error()).SetInternal(err)
+		}
+		wordID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted blocklist word id: "+err.Error()).SetInternal(err)
+		}
+		after := BlocklistWordModel{ID: wordID, BlocklistID: blocklistID, Word: req.Word, CreatedAt: createdAt}
+		if err := insertAuditLog(ctx, tx, userID, auditActionBlocklistWordAdd, auditTargetBlocklistWord, wordID, 0, nil, after); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		word = BlocklistWord{ID: wordID, Word: req.Word}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, word)
+}
+
+// ブロックリストからの語の削除API (作成者のみ)
+// DELETE /api/blocklist/:blocklist_id/words/:word_id
+func deleteBlocklistWordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	blocklistID, err := strconv.ParseInt(c.Param("blocklist_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "blocklist_id in path must be integer")
+	}
+	wordID, err := strconv.ParseInt(c.Param("word_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "word_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getVisibleBlocklist(ctx, tx, blocklistID, userID)
+		if err != nil {
+			return err
+		}
+		if m.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "only the owner can edit the blocklist")
+		}
+
+		var word BlocklistWordModel
+		if err := tx.GetContext(ctx, &word, "SELECT * FROM blocklist_words WHERE id = ? AND blocklist_id = ? FOR UPDATE", wordID, blocklistID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "blocklist word not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get blocklist word: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM blocklist_words WHERE id = ?", word.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete blocklist word: "+err.Error()).SetInternal(err)
+		}
+		if err := insertAuditLog(ctx, tx, userID, auditActionBlocklistWordDelete, auditTargetBlocklistWord, word.ID, 0, word, nil); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信が購読しているブロックリスト一覧取得API (配信者向け)
+// GET /api/livestream/:livestream_id/blocklists
+func getLivestreamBlocklistsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var blocklists []Blocklist
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []BlocklistModel
+		if err := tx.SelectContext(ctx, &models, `
+			SELECT b.* FROM livestream_blocklists lb
+			INNER JOIN blocklists b ON b.id = lb.blocklist_id
+			WHERE lb.livestream_id = ?
+			ORDER BY lb.created_at`, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream blocklists: "+err.Error()).SetInternal(err)
+		}
+
+		blocklists = make([]Blocklist, len(models))
+		for i := range models {
+			b, err := fillBlocklistResponse(ctx, tx, models[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill blocklist: "+err.Error()).SetInternal(err)
+			}
+			blocklists[i] = b
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, blocklists)
+}
+
+// ブロックリストの購読API (配信者向け)
+// POST /api/livestream/:livestream_id/blocklists
+func subscribeBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *SubscribeBlocklistRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var blocklist Blocklist
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getVisibleBlocklist(ctx, tx, req.BlocklistID, userID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livestream_blocklists (livestream_id, blocklist_id, created_at) VALUES (?, ?, ?)", livestreamID, m.ID, clock.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to subscribe blocklist: "+err.Error()).SetInternal(err)
+		}
+
+		blocklist, err = fillBlocklistResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill blocklist: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, blocklist)
+}
+
+// ブロックリストの購読解除API (配信者向け)
+// DELETE /api/livestream/:livestream_id/blocklists/:blocklist_id
+func unsubscribeBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	blocklistID, err := strconv.ParseInt(c.Param("blocklist_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "blocklist_id in path must be integer")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_blocklists WHERE livestream_id = ? AND blocklist_id = ?", livestreamID, blocklistID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to unsubscribe blocklist: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "blocklist subscription not found")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
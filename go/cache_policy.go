@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Cache-Control の値
+const (
+	cachePolicyNoStore      = "no-store"
+	cachePolicyPrivate      = "private, no-cache"
+	cachePolicyStatic       = "public, max-age=60"
+	cachePolicyStaticLong   = "public, max-age=300"
+	cachePolicyStaleListing = "public, max-age=5, stale-while-revalidate=30"
+)
+
+type cachePolicyRule struct {
+	Method string
+	// echo のルート定義と同じ形式 (c.Path() と比較する)
+	Path   string
+	Policy string
+}
+
+// cachePolicyRules はルートごとのキャッシュポリシー
+// ここに無いルートは defaultCachePolicy になる
+var cachePolicyRules = []cachePolicyRule{
+	// 自分の情報は共有キャッシュに載せない
+	// no-store にすると ETag による再検証が効かなくなるので no-cache にしておく
+	{http.MethodGet, "/api/user/me", cachePolicyPrivate},
+	{http.MethodGet, "/api/user/:username", cachePolicyPrivate},
+	{http.MethodGet, "/api/user/:username/icon", cachePolicyStatic},
+	{http.MethodGet, "/api/channel/:channel_name/icon", cachePolicyStatic},
+	{http.MethodGet, "/api/tag", cachePolicyStaticLong},
+	// 配信一覧 (トレンド相当) は多少古くてもよい
+	{http.MethodGet, "/api/livestream/search", cachePolicyStaleListing},
+	{http.MethodGet, "/api/schedule", cachePolicyStaleListing},
+	{http.MethodGet, "/api/clips/trending", cachePolicyStaleListing},
+	// オーバーレイのウィジェットが数秒おきに読む
+	{http.MethodGet, "/api/user/:username/donation_goals", cachePolicyStaleListing},
+}
+
+const defaultCachePolicy = cachePolicyNoStore
+
+var cachePolicyIndex = func() map[string]string {
+	m := make(map[string]string, len(cachePolicyRules))
+	for _, r := range cachePolicyRules {
+		m[r.Method+" "+r.Path] = r.Policy
+	}
+	return m
+}()
+
+// cachePolicyMiddleware はルートに応じて Cache-Control を付ける
+// ハンドラで個別に設定した場合はそちらが優先される
+func cachePolicyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		policy, ok := cachePolicyIndex[c.Request().Method+" "+c.Path()]
+		if !ok {
+			policy = defaultCachePolicy
+		}
+		c.Response().Header().Set(echo.HeaderCacheControl, policy)
+		return next(c)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	signedAssetKindCaption = "caption"
+
+	maxCaptionBytes       = 1024 * 1024
+	maxCaptionLabelLength = 64
+	// プレイヤーが字幕を読み込むまでの時間に十分な長さ
+	captionURLTTL = 6 * time.Hour
+)
+
+var (
+	// BCP 47 の言語タグ (ja, en-US, zh-Hant など)
+	captionLanguagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	utf8BOM                = []byte("\xef\xbb\xbf")
+)
+
+func init() {
+	registerSignedAsset(signedAssetKindCaption, func(ctx context.Context, captionID int64) (string, []byte, error) {
+		var body []byte
+		if err := dbConn.GetContext(ctx, &body, "SELECT body FROM livestream_captions WHERE id = ?", captionID); err != nil {
+			return "", nil, err
+		}
+		return "text/vtt; charset=utf-8", body, nil
+	})
+}
+
+// LivestreamCaptionModel はアーカイブの字幕 (WebVTT)
+// 差し替えたら別の ID になるので、同じ ID の中身は変わらない (署名付きURLの期限までキャッシュしてよい)
+type LivestreamCaptionModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	Language     string `db:"language"`
+	Label        string `db:"label"`
+	Body         []byte `db:"body"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type LivestreamCaption struct {
+	ID        int64  `json:"id"`
+	Language  string `json:"language"`
+	Label     string `json:"label"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+	// 署名付きURL (<track src> にそのまま使える)
+	URL string `json:"url"`
+}
+
+type PostLivestreamCaptionRequest struct {
+	Language string `json:"language"`
+	// 省略したら language
+	Label string `json:"label"`
+	// WebVTT の本文
+	Content string `json:"content"`
+}
+
+func newLivestreamCaption(id int64, language, label string, size, createdAt int64) LivestreamCaption {
+	return LivestreamCaption{
+		ID:        id,
+		Language:  language,
+		Label:     label,
+		Size:      size,
+		CreatedAt: createdAt,
+		URL:       signAssetURL(signedAssetKindCaption, id, captionURLTTL),
+	}
+}
+
+// validateWebVTT は WebVTT のファイルとして扱えるかを確かめ、BOM を除いた本文を返す
+func validateWebVTT(content []byte) ([]byte, error) {
+	if len(content) > maxCaptionBytes {
+		return nil, errors.New("caption file is too large")
+	}
+	if !utf8.Valid(content) {
+		return nil, errors.New("caption file must be encoded in UTF-8")
+	}
+	content = bytes.TrimPrefix(content, utf8BOM)
+	// 先頭行は "WEBVTT" だけか、空白に続けてヘッダの説明
+	if !bytes.HasPrefix(content, []byte("WEBVTT")) {
+		return nil, errors.New("caption file must start with WEBVTT")
+	}
+	if rest := content[len("WEBVTT"):]; len(rest) > 0 && rest[0] != ' ' && rest[0] != '\t' && rest[0] != '\n' && rest[0] != '\r' {
+		return nil, errors.New("caption file must start with WEBVTT")
+	}
+	return content, nil
+}
+
+// アーカイブの字幕一覧取得API
+// GET /api/livestream/:livestream_id/captions
+func getLivestreamCaptionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	captions := []LivestreamCaption{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamID, userID); err != nil {
+			return err
+		}
+
+		// 本文は読まない
+		var rows []struct {
+			ID        int64  `db:"id"`
+			Language  string `db:"language"`
+			Label     string `db:"label"`
+			Size      int64  `db:"size"`
+			CreatedAt int64  `db:"created_at"`
+		}
+		if err := tx.SelectContext(ctx, &rows, "SELECT id, language, label, LENGTH(body) AS size, created_at FROM livestream_captions WHERE livestream_id = ? ORDER BY language", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get captions: "+err.Error()).SetInternal(err)
+		}
+		for _, r := range rows {
+			captions = append(captions, newLivestreamCaption(r.ID, r.Language, r.Label, r.Size, r.CreatedAt))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, captions)
+}
+
+// アーカイブの字幕の追加API (配信者向け)
+// POST /api/livestream/:livestream_id/captions
+// 同じ言語の字幕があれば差し替える
+func postLivestreamCaptionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req PostLivestreamCaptionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if !captionLanguagePattern.MatchString(req.Language) {
+		return echo.NewHTTPError(http.StatusBadRequest, "language must be a BCP 47 language tag")
+	}
+	if req.Label == "" {
+		req.Label = req.Language
+	}
+	if utf8.RuneCountInString(req.Label) > maxCaptionLabelLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "label is too long")
+	}
+	body, err := validateWebVTT([]byte(req.Content))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	m := LivestreamCaptionModel{
+		LivestreamID: livestreamID,
+		Language:     req.Language,
+		Label:        req.Label,
+		Body:         body,
+		CreatedAt:    clock.Now().Unix(),
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if livestreamModel.EndAt > clock.Now().Unix() {
+			return echo.NewHTTPError(http.StatusBadRequest, "captions can be attached after the livestream ends")
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_captions WHERE livestream_id = ? AND language = ?", livestreamID, req.Language); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete caption: "+err.Error()).SetInternal(err)
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_captions (livestream_id, language, label, body, created_at) VALUES (:livestream_id, :language, :label, :body, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert caption: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted caption id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newLivestreamCaption(m.ID, m.Language, m.Label, int64(len(m.Body)), m.CreatedAt))
+}
+
+// アーカイブの字幕の削除API (配信者向け)
+// DELETE /api/livestream/:livestream_id/captions/:caption_id
+func deleteLivestreamCaptionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	captionID, err := strconv.ParseInt(c.Param("caption_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "caption_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_captions WHERE id = ? AND livestream_id = ?", captionID, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete caption: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "caption not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
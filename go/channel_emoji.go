@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const maxChannelEmojis = 50
+
+// shortcode は英小文字・数字・アンダースコアの2〜32文字
+var channelEmojiShortcodePattern = regexp.MustCompile(`^[a-z0-9_]{2,32}$`)
+
+// channelKey はチャンネルを表す (プライマリチャンネルの channel_id は全員 0 なので、配信者と組にする)
+type channelKey struct {
+	OwnerID   int64
+	ChannelID int64
+}
+
+type ChannelEmojiModel struct {
+	ID        int64  `db:"id"`
+	OwnerID   int64  `db:"owner_id"`
+	ChannelID int64  `db:"channel_id"`
+	Shortcode string `db:"shortcode"`
+	Image     []byte `db:"image"`
+	Approved  bool   `db:"approved"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ChannelEmoji struct {
+	ID        int64  `json:"id"`
+	Shortcode string `json:"shortcode"`
+	ImageURL  string `json:"image_url"`
+	CreatedAt int64  `json:"created_at"`
+	// 画像の審査が終わるまでは使えない
+	PendingReview bool `json:"pending_review,omitempty"`
+}
+
+// EmoteSpan はコメント中の :shortcode: の位置 (文字単位の [Start, End))
+type EmoteSpan struct {
+	Start     int    `json:"start"`
+	End       int    `json:"end"`
+	EmojiID   int64  `json:"emoji_id"`
+	Shortcode string `json:"shortcode"`
+	ImageURL  string `json:"image_url"`
+}
+
+func channelEmojiImageURL(id int64) string {
+	return "/api/emojis/" + strconv.FormatInt(id, 10) + "/image"
+}
+
+func newChannelEmoji(m ChannelEmojiModel) ChannelEmoji {
+	return ChannelEmoji{
+		ID:            m.ID,
+		Shortcode:     m.Shortcode,
+		ImageURL:      channelEmojiImageURL(m.ID),
+		CreatedAt:     m.CreatedAt,
+		PendingReview: !m.Approved,
+	}
+}
+
+// customEmojiShortcode はリアクションの emoji_name が :shortcode: の形ならその shortcode を返す
+func customEmojiShortcode(emojiName string) (string, bool) {
+	if len(emojiName) < 2 || emojiName[0] != ':' || emojiName[len(emojiName)-1] != ':' {
+		return "", false
+	}
+	return emojiName[1 : len(emojiName)-1], true
+}
+
+// channelEmojisOf は配信のチャンネルで使える (審査済みの) 絵文字を shortcode ごとに返す
+// 画像は含まない。1リクエストの間はローダーに覚えておく
+func channelEmojisOf(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (map[string]ChannelEmojiModel, error) {
+	key := channelKey{OwnerID: livestreamModel.UserID, ChannelID: livestreamModel.ChannelID}
+	loader := loaderFrom(ctx)
+	if emojis, ok := loader.channelEmojiSet(key); ok {
+		return emojis, nil
+	}
+
+	var models []ChannelEmojiModel
+	if err := tx.SelectContext(ctx, &models, "SELECT id, owner_id, channel_id, shortcode, approved, created_at FROM channel_emojis WHERE owner_id = ? AND channel_id = ? AND approved", key.OwnerID, key.ChannelID); err != nil {
+		return nil, err
+	}
+	emojis := make(map[string]ChannelEmojiModel, len(models))
+	for _, m := range models {
+		emojis[m.Shortcode] = m
+	}
+	loader.setChannelEmojiSet(key, emojis)
+	return emojis, nil
+}
+
+// emoteSpansOf はコメント中の :shortcode: のうち、配信のチャンネルの絵文字に一致するものを返す
+// ほとんどのコメントには ':' が2つも無いので、その場合は絵文字を引かない
+func emoteSpansOf(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, comment string) ([]EmoteSpan, error) {
+	if strings.Count(comment, ":") < 2 {
+		return nil, nil
+	}
+	emojis, err := channelEmojisOf(ctx, tx, livestreamModel)
+	if err != nil || len(emojis) == 0 {
+		return nil, err
+	}
+
+	var spans []EmoteSpan
+	for i := 0; i < len(comment); {
+		if comment[i] != ':' {
+			i++
+			continue
+		}
+		end := strings.IndexByte(comment[i+1:], ':')
+		if end < 0 {
+			break
+		}
+		end += i + 1
+		m, ok := emojis[comment[i+1:end]]
+		if !ok {
+			// 閉じの ':' が次の絵文字の始まりかもしれない
+			i = end
+			continue
+		}
+		start := utf8.RuneCountInString(comment[:i])
+		spans = append(spans, EmoteSpan{
+			Start:     start,
+			End:       start + utf8.RuneCountInString(comment[i:end+1]),
+			EmojiID:   m.ID,
+			Shortcode: m.Shortcode,
+			ImageURL:  channelEmojiImageURL(m.ID),
+		})
+		i = end + 1
+	}
+	return spans, nil
+}
+
+// verifyReactionEmoji は :shortcode: のリアクションが配信のチャンネルの絵文字かを確かめる
+// それ以外の emoji_name はこれまで通りそのまま受け付ける
+func verifyReactionEmoji(ctx context.Context, tx *sqlx.Tx, livestreamID int64, emojiName string) error {
+	shortcode, ok := customEmojiShortcode(emojiName)
+	if !ok {
+		return nil
+	}
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+	}
+	emojis, err := channelEmojisOf(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel emojis: "+err.Error()).SetInternal(err)
+	}
+	if _, ok := emojis[shortcode]; !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown custom emoji")
+	}
+	return nil
+}
+
+// チャンネルのカスタム絵文字一覧API
+// GET /api/channel/:channel_name/emojis
+// 配信者本人には審査待ちのものも返す
+func getChannelEmojisHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveChannel(ctx, c.Param("channel_name"))
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT id, owner_id, channel_id, shortcode, approved, created_at FROM channel_emojis WHERE owner_id = ? AND channel_id = ?"
+	if channel.UserID != userID {
+		query += " AND approved"
+	}
+	var models []ChannelEmojiModel
+	if err := dbConn.SelectContext(ctx, &models, query+" ORDER BY shortcode", channel.UserID, channel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel emojis: "+err.Error()).SetInternal(err)
+	}
+
+	emojis := make([]ChannelEmoji, len(models))
+	for i, m := range models {
+		emojis[i] = newChannelEmoji(m)
+	}
+	return c.JSON(http.StatusOK, emojis)
+}
+
+// カスタム絵文字の追加API (配信者向け)
+// POST /api/channel/:channel_name/emojis/:shortcode
+// 画像はアイコンと同じく、そのまま送るか {"image": "<base64>"} で送る
+func postChannelEmojiHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+	shortcode := c.Param("shortcode")
+	if !channelEmojiShortcodePattern.MatchString(shortcode) {
+		return echo.NewHTTPError(http.StatusBadRequest, "shortcode must be 2 to 32 characters of [a-z0-9_]")
+	}
+
+	uploaded, err := readIconUpload(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the uploaded emoji: "+err.Error())
+	}
+	image, err := normalizeEmojiImage(uploaded)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the image: "+err.Error())
+	}
+	moderation := moderateImage(ctx, image)
+	if moderation.Verdict == imageVerdictReject {
+		return echo.NewHTTPError(http.StatusBadRequest, "the image was rejected by moderation")
+	}
+
+	m := ChannelEmojiModel{
+		OwnerID:   userID,
+		ChannelID: channel.ID,
+		Shortcode: shortcode,
+		Image:     image,
+		Approved:  moderation.Verdict != imageVerdictFlag,
+		CreatedAt: clock.Now().Unix(),
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var count int64
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM channel_emojis WHERE owner_id = ? AND channel_id = ? FOR UPDATE", userID, channel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count channel emojis: "+err.Error()).SetInternal(err)
+		}
+		if count >= maxChannelEmojis {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many channel emojis")
+		}
+
+		// 審査待ちの間は画像を審査の側に持たせるので、こちらは空にしておく
+		stored := m.Image
+		if !m.Approved {
+			stored = []byte{}
+		}
+		rs, err := tx.ExecContext(ctx, "INSERT INTO channel_emojis (owner_id, channel_id, shortcode, image, approved, created_at) VALUES (?, ?, ?, ?, ?, ?)", m.OwnerID, m.ChannelID, m.Shortcode, stored, m.Approved, m.CreatedAt)
+		if err != nil {
+			if isDuplicateEntryError(err) {
+				return echo.NewHTTPError(http.StatusConflict, "the shortcode is already used")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert channel emoji: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted channel emoji id: "+err.Error()).SetInternal(err)
+		}
+		if !m.Approved {
+			if _, err := enqueueImageReview(ctx, tx, imageReviewTargetChannelEmoji, m.ID, userID, m.Image, moderation); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue image review: "+err.Error()).SetInternal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !m.Approved {
+		return c.JSON(http.StatusAccepted, newChannelEmoji(m))
+	}
+	return c.JSON(http.StatusCreated, newChannelEmoji(m))
+}
+
+// カスタム絵文字の削除API (配信者向け)
+// DELETE /api/channel/:channel_name/emojis/:shortcode
+// 既にあるリアクションは emoji_name のまま残る (画像は表示されなくなる)
+func deleteChannelEmojiHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM channel_emojis WHERE owner_id = ? AND channel_id = ? AND shortcode = ?", userID, channel.ID, c.Param("shortcode"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete channel emoji: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "channel emoji not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// カスタム絵文字の画像取得API
+// GET /api/emojis/:emoji_id/image
+func getChannelEmojiImageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	emojiID, err := strconv.ParseInt(c.Param("emoji_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji_id in path must be integer")
+	}
+
+	var image []byte
+	if err := dbConn.GetContext(ctx, &image, "SELECT image FROM channel_emojis WHERE id = ? AND approved", emojiID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "channel emoji not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel emoji: "+err.Error()).SetInternal(err)
+	}
+	return c.Blob(http.StatusOK, "image/png", image)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信がどのチャンネルにも紐付いていない場合の channel_id
+// 既存の配信はすべてこの値で、配信者のプライマリチャンネルに属するものとして扱う
+const primaryChannelID = 0
+
+type ChannelModel struct {
+	ID          int64  `db:"id"`
+	UserID      int64  `db:"user_id"`
+	Name        string `db:"name"`
+	DisplayName string `db:"display_name"`
+	Description string `db:"description"`
+	DarkMode    bool   `db:"dark_mode"`
+	Icon        []byte `db:"icon"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
+type Channel struct {
+	ID          int64  `json:"id"`
+	Owner       string `json:"owner"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	Theme       Theme  `json:"theme"`
+	IconHash    string `json:"icon_hash"`
+	IsPrimary   bool   `json:"is_primary"`
+	// 期限内のメンバーシップの数
+	MemberCount int64 `json:"member_count"`
+}
+
+type PostChannelRequest struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	Theme       struct {
+		DarkMode bool `json:"dark_mode"`
+	} `json:"theme"`
+	// base64エンコードされた画像 (省略時はNoImage)
+	Icon []byte `json:"icon"`
+}
+
+// 画像の無いユーザ・チャンネルはすべて NoImage なので、ハッシュは一度だけ計算する
+var fallbackIconHash = sync.OnceValues(func() (string, error) {
+	image, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return "", err
+	}
+	return hexSHA256(image), nil
+})
+
+// iconHashOf はアイコンのハッシュを返す (画像が空なら NoImage のハッシュ)
+func iconHashOf(image []byte) (string, error) {
+	if len(image) == 0 {
+		return fallbackIconHash()
+	}
+	return hexSHA256(image), nil
+}
+
+// hexSHA256 は sha256 を16進の文字列にする
+// 一覧では行ごとに呼ばれるので、fmt.Sprintf("%x") を使わずに割り当てを1回で済ませる
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	var buf [sha256.Size * 2]byte
+	hex.Encode(buf[:], sum[:])
+	return string(buf[:])
+}
+
+func fillChannelResponse(owner UserModel, m ChannelModel) (Channel, error) {
+	iconHash, err := iconHashOf(m.Icon)
+	if err != nil {
+		return Channel{}, err
+	}
+	return Channel{
+		ID:          m.ID,
+		Owner:       owner.Name,
+		Name:        m.Name,
+		DisplayName: m.DisplayName,
+		Description: m.Description,
+		Theme: Theme{
+			ID:       m.ID,
+			DarkMode: m.DarkMode,
+		},
+		IconHash: iconHash,
+	}, nil
+}
+
+// primaryChannel はユーザ自身のプロフィールをプライマリチャンネルとして返す
+func primaryChannel(ctx context.Context, owner UserModel) (Channel, error) {
+	user, err := fetchUserDetailsByID(ctx, owner.ID)
+	if err != nil {
+		return Channel{}, err
+	}
+	return Channel{
+		ID:          primaryChannelID,
+		Owner:       owner.Name,
+		Name:        owner.Name,
+		DisplayName: user.DisplayName,
+		Description: user.Description,
+		Theme:       user.Theme,
+		IconHash:    user.IconHash,
+		IsPrimary:   true,
+	}, nil
+}
+
+// verifyChannelOwner は channel_id が userID の所有するチャンネルかどうかを確認する
+func verifyChannelOwner(ctx context.Context, tx *sqlx.Tx, userID, channelID int64) error {
+	if channelID == primaryChannelID {
+		return nil
+	}
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM channels WHERE id = ?", channelID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "not found channel that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel: "+err.Error()).SetInternal(err)
+	}
+	if ownerID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't use other user's channel")
+	}
+	return nil
+}
+
+// チャンネル作成API
+// POST /api/channel
+func postChannelHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PostChannelRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "channel name is required")
+	}
+
+	normalized, err := normalizeUploadedImage(req.Icon)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the icon: "+err.Error())
+	}
+	req.Icon = normalized
+
+	// flag されたアイコンは審査が終わるまで付けずに作る
+	moderation := moderateImage(ctx, req.Icon)
+	if moderation.Verdict == imageVerdictReject {
+		return echo.NewHTTPError(http.StatusBadRequest, "the image was rejected by moderation")
+	}
+	icon := req.Icon
+	if moderation.Verdict == imageVerdictFlag {
+		icon = nil
+	}
+
+	var channel Channel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var owner UserModel
+		if err := tx.GetContext(ctx, &owner, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+
+		// プライマリチャンネルはユーザ名で引けるので、ユーザ名と同じチャンネル名は作れない
+		taken, err := nameTakenForUpdate(ctx, tx, "users", req.Name)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to check user name: "+err.Error()).SetInternal(err)
+		}
+		if taken {
+			return echo.NewHTTPError(http.StatusBadRequest, "channel name is already used")
+		}
+
+		m := ChannelModel{
+			UserID:      userID,
+			Name:        req.Name,
+			DisplayName: req.DisplayName,
+			Description: req.Description,
+			DarkMode:    req.Theme.DarkMode,
+			Icon:        icon,
+			CreatedAt:   clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO channels (user_id, name, display_name, description, dark_mode, icon, created_at) VALUES (:user_id, :name, :display_name, :description, :dark_mode, :icon, :created_at)", m)
+		if err != nil {
+			if isDuplicateEntryError(err) {
+				return echo.NewHTTPError(http.StatusBadRequest, "channel name is already used")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert channel: "+err.Error()).SetInternal(err)
+		}
+		if m.ID, err = rs.LastInsertId(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted channel id: "+err.Error()).SetInternal(err)
+		}
+		if moderation.Verdict == imageVerdictFlag {
+			if _, err := enqueueImageReview(ctx, tx, imageReviewTargetChannelIcon, m.ID, userID, req.Icon, moderation); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue image review: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		channel, err = fillChannelResponse(owner, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill channel: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, channel)
+}
+
+// ユーザのチャンネル一覧取得API (プライマリチャンネルが先頭)
+// GET /api/user/:username/channel
+func getUserChannelsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	username := c.Param("username")
+
+	var owner UserModel
+	if err := dbConn.GetContext(ctx, &owner, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+	}
+
+	primary, err := primaryChannel(ctx, owner)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill primary channel: "+err.Error()).SetInternal(err)
+	}
+
+	var channelModels []ChannelModel
+	if err := dbConn.SelectContext(ctx, &channelModels, "SELECT * FROM channels WHERE user_id = ? ORDER BY id", owner.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channels: "+err.Error()).SetInternal(err)
+	}
+
+	channels := []Channel{primary}
+	for _, m := range channelModels {
+		channel, err := fillChannelResponse(owner, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill channel: "+err.Error()).SetInternal(err)
+		}
+		channels = append(channels, channel)
+	}
+	for i := range channels {
+		channels[i].MemberCount, err = countChannelMembers(ctx, owner.ID, channels[i].ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count channel members: "+err.Error()).SetInternal(err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, channels)
+}
+
+// nameTakenForUpdate は name が table (users か channels) で使われているかを返す
+// ユーザ名とチャンネル名は同じ名前空間なので、登録とチャンネル作成はお互いのテーブルをこれで確かめる
+// 無い場合も FOR UPDATE のギャップロックでコミットまで同じ名前の INSERT を待たせる
+// (同時に確かめ合った場合はデッドロックになり、withTx のリトライで後から来た方が弾かれる)
+func nameTakenForUpdate(ctx context.Context, tx *sqlx.Tx, table, name string) (bool, error) {
+	var n int64
+	if err := tx.GetContext(ctx, &n, "SELECT COUNT(*) FROM "+table+" WHERE name = ? FOR UPDATE", name); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// findChannelByName はチャンネル名からチャンネルと所有者を引く
+// channels に存在しない場合はユーザ名とみなし、そのユーザのプライマリチャンネルを返す
+func findChannelByName(ctx context.Context, name string) (ChannelModel, UserModel, error) {
+	var (
+		m     ChannelModel
+		owner UserModel
+	)
+	err := dbConn.GetContext(ctx, &m, "SELECT * FROM channels WHERE name = ?", name)
+	if err == nil {
+		if err := dbConn.GetContext(ctx, &owner, "SELECT * FROM users WHERE id = ?", m.UserID); err != nil {
+			return ChannelModel{}, UserModel{}, err
+		}
+		return m, owner, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return ChannelModel{}, UserModel{}, err
+	}
+
+	if err := dbConn.GetContext(ctx, &owner, "SELECT * FROM users WHERE name = ?", name); err != nil {
+		return ChannelModel{}, UserModel{}, err
+	}
+	return ChannelModel{ID: primaryChannelID, UserID: owner.ID, Name: owner.Name}, owner, nil
+}
+
+// チャンネル取得API
+// GET /api/channel/:channel_name
+func getChannelHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	m, owner, err := findChannelByName(ctx, c.Param("channel_name"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found channel that has the given name")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel: "+err.Error()).SetInternal(err)
+	}
+
+	var channel Channel
+	if m.ID == primaryChannelID {
+		channel, err = primaryChannel(ctx, owner)
+	} else {
+		channel, err = fillChannelResponse(owner, m)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill channel: "+err.Error()).SetInternal(err)
+	}
+	channel.MemberCount, err = countChannelMembers(ctx, owner.ID, m.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count channel members: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, channel)
+}
+
+// チャンネルのアイコン取得API
+// GET /api/channel/:channel_name/icon
+func getChannelIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	m, owner, err := findChannelByName(ctx, c.Param("channel_name"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found channel that has the given name")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel: "+err.Error()).SetInternal(err)
+	}
+
+	image := m.Icon
+	if m.ID == primaryChannelID {
+		if err := dbConn.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", owner.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error()).SetInternal(err)
+		}
+	}
+	if len(image) == 0 {
+		return c.File(fallbackImage)
+	}
+	return c.Blob(http.StatusOK, "image/jpeg", image)
+}
+
+// チャンネルの配信一覧取得API
+// GET /api/channel/:channel_name/livestream
+func getChannelLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	m, owner, err := findChannelByName(ctx, c.Param("channel_name"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found channel that has the given name")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel: "+err.Error()).SetInternal(err)
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND channel_id = ? ORDER BY start_at DESC, id DESC", owner.ID, m.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 月額の課金間隔
+	membershipPeriod = 30 * 24 * time.Hour
+
+	maxMembershipTierNameLength  = 64
+	maxMembershipTierFlairLength = 32
+	maxMembershipTiersPerChannel = 10
+
+	membershipRenewalWorkerInterval  = 1 * time.Minute
+	membershipRenewalWorkerBatchSize = 100
+
+	livecommentReasonMembersOnly = "members_only"
+)
+
+// ChannelMembershipTierModel はチャンネルのメンバーシップのプラン
+// 価格を変えると既存のメンバーの次回の更新額も変わってしまうので、作った後は変更できない
+type ChannelMembershipTierModel struct {
+	ID        int64  `db:"id"`
+	OwnerID   int64  `db:"owner_id"`
+	ChannelID int64  `db:"channel_id"`
+	Name      string `db:"name"`
+	Price     int64  `db:"price"`
+	Flair     string `db:"flair"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// ChannelMembershipModel はチャンネルのメンバー
+// 解約していなければ expires_at に同じプランで更新する
+type ChannelMembershipModel struct {
+	ID         int64 `db:"id"`
+	OwnerID    int64 `db:"owner_id"`
+	ChannelID  int64 `db:"channel_id"`
+	UserID     int64 `db:"user_id"`
+	TierID     int64 `db:"tier_id"`
+	StartedAt  int64 `db:"started_at"`
+	ExpiresAt  int64 `db:"expires_at"`
+	CanceledAt int64 `db:"canceled_at"`
+}
+
+type MembershipTier struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Price     int64  `json:"price"`
+	Flair     string `json:"flair"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ChannelMembership struct {
+	Tier      MembershipTier `json:"tier"`
+	StartedAt int64          `json:"started_at"`
+	ExpiresAt int64          `json:"expires_at"`
+	// 解約済みの場合のみ入る (expires_at まではメンバーのまま)
+	CanceledAt int64 `json:"canceled_at,omitempty"`
+}
+
+type PostMembershipTierRequest struct {
+	Name  string `json:"name"`
+	Price int64  `json:"price"`
+	// メンバーのコメントに付ける表示 (絵文字など)
+	Flair string `json:"flair"`
+}
+
+type PostChannelMembershipRequest struct {
+	TierID int64 `json:"tier_id"`
+}
+
+func newMembershipTier(m ChannelMembershipTierModel) MembershipTier {
+	return MembershipTier{
+		ID:        m.ID,
+		Name:      m.Name,
+		Price:     m.Price,
+		Flair:     m.Flair,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+func newChannelMembership(m ChannelMembershipModel, tier ChannelMembershipTierModel) ChannelMembership {
+	return ChannelMembership{
+		Tier:       newMembershipTier(tier),
+		StartedAt:  m.StartedAt,
+		ExpiresAt:  m.ExpiresAt,
+		CanceledAt: m.CanceledAt,
+	}
+}
+
+// resolveChannel はパスのチャンネルを引く (所有者でなくてもよい)
+func resolveChannel(ctx context.Context, name string) (ChannelModel, error) {
+	m, _, err := findChannelByName(ctx, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ChannelModel{}, echo.NewHTTPError(http.StatusNotFound, "not found channel that has the given name")
+		}
+		return ChannelModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel: "+err.Error()).SetInternal(err)
+	}
+	return m, nil
+}
+
+// memberFlairOf はライブコメントのユーザが配信のチャンネルのメンバーなら、そのプランの表示を返す
+// プランの表示は必須なので、メンバーかどうかの判定にも使える
+func memberFlairOf(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) (string, error) {
+	key := channelRoleKey{OwnerID: livestreamModel.UserID, ChannelID: livestreamModel.ChannelID, UserID: userID}
+	loader := loaderFrom(ctx)
+	if flair, ok := loader.memberFlair(key); ok {
+		return flair, nil
+	}
+
+	var flair string
+	if err := tx.GetContext(ctx, &flair, `
+		SELECT t.flair FROM channel_memberships m
+		INNER JOIN channel_membership_tiers t ON t.id = m.tier_id
+		WHERE m.owner_id = ? AND m.channel_id = ? AND m.user_id = ? AND m.expires_at > ?`,
+		key.OwnerID, key.ChannelID, key.UserID, clock.Now().Unix()); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		flair = ""
+	}
+	loader.setMemberFlair(key, flair)
+	return flair, nil
+}
+
+// checkMembersOnlyLivecomment はメンバー限定の配信で、メンバーでないユーザのコメントを拒否する
+// 配信者本人とVIPは対象外
+func checkMembersOnlyLivecomment(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) error {
+	if livestreamModel.UserID == userID {
+		return nil
+	}
+
+	role, err := fetchChannelRole(ctx, tx, channelRoleKey{OwnerID: livestreamModel.UserID, ChannelID: livestreamModel.ChannelID, UserID: userID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel role: "+err.Error()).SetInternal(err)
+	}
+	if role == channelRoleVIP {
+		return nil
+	}
+
+	flair, err := memberFlairOf(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership: "+err.Error()).SetInternal(err)
+	}
+	if flair == "" {
+		return newReasonedError(http.StatusForbidden, livecommentReasonMembersOnly, "only channel members can comment on this livestream")
+	}
+	return nil
+}
+
+// countChannelMembers は期限内のメンバー数を返す (解約済みでも期限内なら数える)
+func countChannelMembers(ctx context.Context, ownerID, channelID int64) (int64, error) {
+	var count int64
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM channel_memberships WHERE owner_id = ? AND channel_id = ? AND expires_at > ?", ownerID, channelID, clock.Now().Unix()); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// chargeMembership はメンバーシップの月額を台帳に記帳する
+// チップと同じく記帳時点の手数料率で計算する
+func chargeMembership(ctx context.Context, tx *sqlx.Tx, m ChannelMembershipModel, tier ChannelMembershipTierModel, now int64) error {
+	revenueTier, err := fetchRevenueTier(ctx, tx, m.OwnerID)
+	if err != nil {
+		return err
+	}
+	fee, net, percent := revenuePolicy.split(revenueTier, tier.Price)
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO payment_ledger (livecomment_id, livestream_id, streamer_id, tipper_id, tier, cut_percent, gross, platform_fee, net, created_at, kind, membership_id)
+		VALUES (:livecomment_id, :livestream_id, :streamer_id, :tipper_id, :tier, :cut_percent, :gross, :platform_fee, :net, :created_at, :kind, :membership_id)`, PaymentLedgerEntryModel{
+		StreamerID:   m.OwnerID,
+		TipperID:     m.UserID,
+		Tier:         revenueTier,
+		CutPercent:   percent,
+		Gross:        tier.Price,
+		PlatformFee:  fee,
+		Net:          net,
+		CreatedAt:    now,
+		Kind:         paymentKindMembership,
+		MembershipID: m.ID,
+	})
+	return err
+}
+
+// チャンネルのメンバーシップのプラン一覧取得API
+// GET /api/channel/:channel_name/membership_tiers
+func getMembershipTiersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	channel, err := resolveChannel(ctx, c.Param("channel_name"))
+	if err != nil {
+		return err
+	}
+
+	var models []ChannelMembershipTierModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM channel_membership_tiers WHERE owner_id = ? AND channel_id = ? ORDER BY price, id", channel.UserID, channel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership tiers: "+err.Error()).SetInternal(err)
+	}
+
+	tiers := make([]MembershipTier, len(models))
+	for i, m := range models {
+		tiers[i] = newMembershipTier(m)
+	}
+	return c.JSON(http.StatusOK, tiers)
+}
+
+// メンバーシップのプラン作成API (配信者向け)
+// POST /api/channel/:channel_name/membership_tiers
+func postMembershipTierHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+
+	var req PostMembershipTierRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxMembershipTierNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must be 1 to 64 characters")
+	}
+	if req.Flair == "" || utf8.RuneCountInString(req.Flair) > maxMembershipTierFlairLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "flair must be 1 to 32 characters")
+	}
+	if req.Price <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "price must be positive")
+	}
+
+	m := ChannelMembershipTierModel{
+		OwnerID:   userID,
+		ChannelID: channel.ID,
+		Name:      req.Name,
+		Price:     req.Price,
+		Flair:     req.Flair,
+		CreatedAt: clock.Now().Unix(),
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var count int64
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM channel_membership_tiers WHERE owner_id = ? AND channel_id = ? FOR UPDATE", userID, channel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count membership tiers: "+err.Error()).SetInternal(err)
+		}
+		if count >= maxMembershipTiersPerChannel {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many membership tiers")
+		}
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO channel_membership_tiers (owner_id, channel_id, name, price, flair, created_at) VALUES (:owner_id, :channel_id, :name, :price, :flair, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert membership tier: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted membership tier id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newMembershipTier(m))
+}
+
+// メンバーシップのプラン削除API (配信者向け)
+// DELETE /api/channel/:channel_name/membership_tiers/:tier_id
+// 更新待ちのメンバーがいるプランは消せない (解約されて期限が切れるのを待つ)
+func deleteMembershipTierHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+	tierID, err := strconv.ParseInt(c.Param("tier_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tier_id in path must be integer")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var tier ChannelMembershipTierModel
+		if err := tx.GetContext(ctx, &tier, "SELECT * FROM channel_membership_tiers WHERE id = ? AND owner_id = ? AND channel_id = ? FOR UPDATE", tierID, userID, channel.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "membership tier not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership tier: "+err.Error()).SetInternal(err)
+		}
+
+		var members int64
+		if err := tx.GetContext(ctx, &members, "SELECT COUNT(*) FROM channel_memberships WHERE tier_id = ? AND (canceled_at = 0 OR expires_at > ?)", tierID, clock.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count members: "+err.Error()).SetInternal(err)
+		}
+		if members > 0 {
+			return echo.NewHTTPError(http.StatusConflict, "the membership tier has members")
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM channel_membership_tiers WHERE id = ?", tierID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete membership tier: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 自分のメンバーシップ取得API
+// GET /api/channel/:channel_name/membership
+func getChannelMembershipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveChannel(ctx, c.Param("channel_name"))
+	if err != nil {
+		return err
+	}
+
+	var membership ChannelMembership
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var m ChannelMembershipModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM channel_memberships WHERE owner_id = ? AND channel_id = ? AND user_id = ? AND expires_at > ?", channel.UserID, channel.ID, userID, clock.Now().Unix()); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not a member of the channel")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership: "+err.Error()).SetInternal(err)
+		}
+		var tier ChannelMembershipTierModel
+		if err := tx.GetContext(ctx, &tier, "SELECT * FROM channel_membership_tiers WHERE id = ?", m.TierID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership tier: "+err.Error()).SetInternal(err)
+		}
+		membership = newChannelMembership(m, tier)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, membership)
+}
+
+// メンバーシップ加入API
+// POST /api/channel/:channel_name/membership
+// 加入時に1か月分を記帳し、以降は解約するまで毎月更新する
+// 解約済みで期限内の同じプランに加入し直した場合は、解約を取り消すだけで記帳しない
+func postChannelMembershipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveChannel(ctx, c.Param("channel_name"))
+	if err != nil {
+		return err
+	}
+	if channel.UserID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't join your own channel")
+	}
+
+	var req PostChannelMembershipRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var (
+		membership ChannelMembership
+		created    bool
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		created = false
+
+		var tier ChannelMembershipTierModel
+		if err := tx.GetContext(ctx, &tier, "SELECT * FROM channel_membership_tiers WHERE id = ? AND owner_id = ? AND channel_id = ?", req.TierID, channel.UserID, channel.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "membership tier not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership tier: "+err.Error()).SetInternal(err)
+		}
+
+		now := clock.Now()
+		var m ChannelMembershipModel
+		err := tx.GetContext(ctx, &m, "SELECT * FROM channel_memberships WHERE owner_id = ? AND channel_id = ? AND user_id = ? FOR UPDATE", channel.UserID, channel.ID, userID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership: "+err.Error()).SetInternal(err)
+		}
+		if err == nil && m.ExpiresAt > now.Unix() {
+			if m.TierID != tier.ID {
+				return echo.NewHTTPError(http.StatusConflict, "already a member of another tier")
+			}
+			if m.CanceledAt == 0 {
+				return echo.NewHTTPError(http.StatusConflict, "already a member of the channel")
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE channel_memberships SET canceled_at = 0 WHERE id = ?", m.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to resume membership: "+err.Error()).SetInternal(err)
+			}
+			m.CanceledAt = 0
+			membership = newChannelMembership(m, tier)
+			return nil
+		}
+
+		// 期限切れのメンバーシップは新しく入り直したものとして扱う
+		m = ChannelMembershipModel{
+			OwnerID:   channel.UserID,
+			ChannelID: channel.ID,
+			UserID:    userID,
+			TierID:    tier.ID,
+			StartedAt: now.Unix(),
+			ExpiresAt: now.Add(membershipPeriod).Unix(),
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM channel_memberships WHERE owner_id = ? AND channel_id = ? AND user_id = ?", m.OwnerID, m.ChannelID, m.UserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete expired membership: "+err.Error()).SetInternal(err)
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO channel_memberships (owner_id, channel_id, user_id, tier_id, started_at, expires_at) VALUES (:owner_id, :channel_id, :user_id, :tier_id, :started_at, :expires_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert membership: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted membership id: "+err.Error()).SetInternal(err)
+		}
+		if err := chargeMembership(ctx, tx, m, tier, now.Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert payment ledger entry: "+err.Error()).SetInternal(err)
+		}
+		membership = newChannelMembership(m, tier)
+		created = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if created {
+		return c.JSON(http.StatusCreated, membership)
+	}
+	return c.JSON(http.StatusOK, membership)
+}
+
+// メンバーシップ解約API
+// DELETE /api/channel/:channel_name/membership
+// 次回から更新しなくなるだけで、支払い済みの期間はメンバーのまま (返金はしない)
+func deleteChannelMembershipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveChannel(ctx, c.Param("channel_name"))
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now().Unix()
+	rs, err := dbConn.ExecContext(ctx, "UPDATE channel_memberships SET canceled_at = ? WHERE owner_id = ? AND channel_id = ? AND user_id = ? AND canceled_at = 0 AND expires_at > ?", now, channel.UserID, channel.ID, userID, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel membership: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not a member of the channel")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func runMembershipRenewalWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(membershipRenewalWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := renewMemberships(ctx, logger); err != nil {
+			logger.Warnf("failed to renew memberships: %v", err)
+		}
+	}
+}
+
+// renewMemberships は期限を迎えた解約していないメンバーシップを1か月延長して記帳する
+// サーバが止まっていた間の分はまとめて請求せず、更新した時点から1か月とする
+func renewMemberships(ctx context.Context, logger echo.Logger) error {
+	var ids []int64
+	if err := dbConn.SelectContext(ctx, &ids, "SELECT id FROM channel_memberships WHERE expires_at <= ? AND canceled_at = 0 ORDER BY expires_at LIMIT ?", clock.Now().Unix(), membershipRenewalWorkerBatchSize); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			now := clock.Now()
+			var m ChannelMembershipModel
+			if err := tx.GetContext(ctx, &m, "SELECT * FROM channel_memberships WHERE id = ? AND expires_at <= ? AND canceled_at = 0 FOR UPDATE", id, now.Unix()); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					// 他のワーカーが更新済み、もしくは解約済み
+					return nil
+				}
+				return err
+			}
+
+			expiresAt := time.Unix(m.ExpiresAt, 0).Add(membershipPeriod)
+			if !expiresAt.After(now) {
+				expiresAt = now.Add(membershipPeriod)
+			}
+			m.ExpiresAt = expiresAt.Unix()
+			if _, err := tx.ExecContext(ctx, "UPDATE channel_memberships SET expires_at = ? WHERE id = ?", m.ExpiresAt, m.ID); err != nil {
+				return err
+			}
+
+			var tier ChannelMembershipTierModel
+			if err := tx.GetContext(ctx, &tier, "SELECT * FROM channel_membership_tiers WHERE id = ?", m.TierID); err != nil {
+				return err
+			}
+			return chargeMembership(ctx, tx, m, tier, now.Unix())
+		}); err != nil {
+			return err
+		}
+		logger.Debugf("renewed membership: id=%d", id)
+	}
+	return nil
+}
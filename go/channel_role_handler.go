@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livecommentCooldownEnvKey = "ISUCON13_LIVECOMMENT_COOLDOWN_SECONDS"
+
+	channelRoleVIP = "vip"
+
+	livecommentReasonCooldown = "cooldown"
+)
+
+// 同じ配信に続けてコメントできるまでの間隔 (スローモード)
+// 0 なら制限しない。ベンチマーカーは連投してくるので、デフォルトでは無効
+var livecommentCooldown time.Duration
+
+func loadLivecommentCooldownConfig() error {
+	if v, ok := os.LookupEnv(livecommentCooldownEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as non-negative integer: %s", livecommentCooldownEnvKey, v)
+		}
+		livecommentCooldown = time.Duration(sec) * time.Second
+	}
+	return nil
+}
+
+// チャンネルは (配信者, channel_id) で一意になる (プライマリチャンネルの channel_id は全員 0 のため)
+type channelRoleKey struct {
+	OwnerID   int64
+	ChannelID int64
+	UserID    int64
+}
+
+type ChannelRoleModel struct {
+	OwnerID   int64  `db:"owner_id"`
+	ChannelID int64  `db:"channel_id"`
+	UserID    int64  `db:"user_id"`
+	Role      string `db:"role"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ChannelRole struct {
+	User      User   `json:"user"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// fetchChannelRole はユーザのチャンネルでの役割を返す (役割が無ければ空文字)
+func fetchChannelRole(ctx context.Context, db sqlx.QueryerContext, key channelRoleKey) (string, error) {
+	loader := loaderFrom(ctx)
+	if role, ok := loader.role(key); ok {
+		return role, nil
+	}
+
+	var role string
+	if err := sqlx.GetContext(ctx, db, &role, "SELECT role FROM channel_roles WHERE owner_id = ? AND channel_id = ? AND user_id = ?", key.OwnerID, key.ChannelID, key.UserID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		role = ""
+	}
+	loader.setRole(key, role)
+	return role, nil
+}
+
+// badgesOf はライブコメントのユーザに付けるバッジを返す
+func badgesOf(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) ([]string, error) {
+	role, err := fetchChannelRole(ctx, tx, channelRoleKey{OwnerID: livestreamModel.UserID, ChannelID: livestreamModel.ChannelID, UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, nil
+	}
+	return []string{role}, nil
+}
+
+// checkLivecommentCooldown はスローモード中の連投を拒否する
+// 配信者本人とVIPは対象外
+func checkLivecommentCooldown(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) error {
+	if livecommentCooldown <= 0 || livestreamModel.UserID == userID {
+		return nil
+	}
+
+	role, err := fetchChannelRole(ctx, tx, channelRoleKey{OwnerID: livestreamModel.UserID, ChannelID: livestreamModel.ChannelID, UserID: userID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel role: "+err.Error()).SetInternal(err)
+	}
+	if role == channelRoleVIP {
+		return nil
+	}
+
+	var lastCreatedAt sql.NullInt64
+	if err := tx.GetContext(ctx, &lastCreatedAt, "SELECT MAX(created_at) FROM "+livecommentTable(livestreamModel.ID)+" WHERE user_id = ? AND livestream_id = ?", userID, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last livecomment: "+err.Error()).SetInternal(err)
+	}
+	if lastCreatedAt.Valid && clock.Now().Unix()-lastCreatedAt.Int64 < int64(livecommentCooldown/time.Second) {
+		return newReasonedError(http.StatusTooManyRequests, livecommentReasonCooldown, "slow mode is enabled on this livestream")
+	}
+	return nil
+}
+
+// resolveOwnedChannel はパスのチャンネルがログインユーザのものであることを確認する
+func resolveOwnedChannel(ctx context.Context, name string, userID int64) (ChannelModel, error) {
+	m, owner, err := findChannelByName(ctx, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ChannelModel{}, echo.NewHTTPError(http.StatusNotFound, "not found channel that has the given name")
+		}
+		return ChannelModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel: "+err.Error()).SetInternal(err)
+	}
+	if owner.ID != userID {
+		return ChannelModel{}, echo.NewHTTPError(http.StatusForbidden, "can't manage other user's channel")
+	}
+	return m, nil
+}
+
+// チャンネルのVIP一覧取得API (配信者向け)
+// GET /api/channel/:channel_name/vip
+func getChannelVIPsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+
+	var roles []ChannelRole
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []ChannelRoleModel
+		if err := tx.SelectContext(ctx, &models, "SELECT * FROM channel_roles WHERE owner_id = ? AND channel_id = ? AND role = ? ORDER BY created_at", userID, channel.ID, channelRoleVIP); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get channel roles: "+err.Error()).SetInternal(err)
+		}
+
+		roles = make([]ChannelRole, len(models))
+		for i, m := range models {
+			user, err := fillUserResponseByID(ctx, tx, m.UserID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+			}
+			roles[i] = ChannelRole{User: user, Role: m.Role, CreatedAt: m.CreatedAt}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, roles)
+}
+
+// VIP付与API (配信者向け)
+// PUT /api/channel/:channel_name/vip/:username
+func grantChannelVIPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+
+	var role ChannelRole
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var target UserModel
+		if err := tx.GetContext(ctx, &target, "SELECT * FROM users WHERE name = ?", c.Param("username")); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "user not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+
+		now := clock.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "INSERT INTO channel_roles (owner_id, channel_id, user_id, role, created_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE role = VALUES(role)", userID, channel.ID, target.ID, channelRoleVIP, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to grant channel role: "+err.Error()).SetInternal(err)
+		}
+
+		user, err := fillUserResponse(ctx, tx, target)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+		}
+		role = ChannelRole{User: user, Role: channelRoleVIP, CreatedAt: now}
+		return nil
+	}); err != nil {
+		return err
+	}
+	invalidateAuthzChannelRoles(userID, channel.ID)
+
+	return c.JSON(http.StatusOK, role)
+}
+
+// VIP剥奪API (配信者向け)
+// DELETE /api/channel/:channel_name/vip/:username
+func revokeChannelVIPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, `
+			DELETE r FROM channel_roles r
+			INNER JOIN users u ON u.id = r.user_id
+			WHERE r.owner_id = ? AND r.channel_id = ? AND u.name = ? AND r.role = ?`,
+			userID, channel.ID, c.Param("username"), channelRoleVIP)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke channel role: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "the user is not a VIP of the channel")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	invalidateAuthzChannelRoles(userID, channel.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
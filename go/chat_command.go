@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	chatCommandsEnabledEnvKey = "ISUCON13_CHAT_COMMANDS_ENABLED"
+
+	chatCommandPrefix = "!"
+)
+
+// "!" で始まるコメントをコマンドとして処理するか
+// ベンチマーカーのコメントに応答が混ざらないよう、デフォルトでは無効
+var chatCommandsEnabled = false
+
+func loadChatCommandConfig() error {
+	if v, ok := os.LookupEnv(chatCommandsEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", chatCommandsEnabledEnvKey, err)
+		}
+		chatCommandsEnabled = enabled
+	}
+	return nil
+}
+
+// chatCommandContext はコマンドを実行するときに渡す情報
+type chatCommandContext struct {
+	Livestream LivestreamModel
+	// コマンドを投稿したユーザ
+	UserID int64
+	Args   []string
+}
+
+type chatCommand struct {
+	Name        string
+	Description string
+	// 配信者とVIPだけが実行できる
+	Privileged bool
+	// 配信ごとの設定が無い場合に有効か
+	DefaultEnabled bool
+	// チャットに投稿する応答を返す (空なら応答しない)
+	Run func(ctx context.Context, tx *sqlx.Tx, cc chatCommandContext) (string, error)
+}
+
+var chatCommands = map[string]chatCommand{}
+
+// registerChatCommand はコマンドを登録する (init から呼ぶ)
+func registerChatCommand(cmd chatCommand) {
+	if _, ok := chatCommands[cmd.Name]; ok {
+		panic("chat command " + cmd.Name + " is already registered")
+	}
+	chatCommands[cmd.Name] = cmd
+}
+
+func init() {
+	registerChatCommand(chatCommand{
+		Name:           "uptime",
+		Description:    "配信開始からの経過時間",
+		DefaultEnabled: true,
+		Run: func(_ context.Context, _ *sqlx.Tx, cc chatCommandContext) (string, error) {
+			elapsed := clock.Now().Unix() - cc.Livestream.StartAt
+			if elapsed < 0 {
+				return "配信はまだ始まっていません", nil
+			}
+			d := time.Duration(elapsed) * time.Second
+			return fmt.Sprintf("配信開始から%d時間%d分経過しました", int(d.Hours()), int(d.Minutes())%60), nil
+		},
+	})
+	registerChatCommand(chatCommand{
+		Name:           "so",
+		Description:    "他の配信者を紹介する (!so <ユーザ名>)",
+		Privileged:     true,
+		DefaultEnabled: true,
+		Run: func(ctx context.Context, tx *sqlx.Tx, cc chatCommandContext) (string, error) {
+			if len(cc.Args) == 0 {
+				return "使い方: !so <ユーザ名>", nil
+			}
+			var user UserModel
+			if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", strings.TrimPrefix(cc.Args[0], "@")); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return fmt.Sprintf("%s というユーザは見つかりませんでした", cc.Args[0]), nil
+				}
+				return "", err
+			}
+			return fmt.Sprintf("%s さん (@%s) の配信もチェックしてください！", user.DisplayName, user.Name), nil
+		},
+	})
+	registerChatCommand(chatCommand{
+		Name:           "commands",
+		Description:    "使えるコマンドの一覧",
+		DefaultEnabled: true,
+		Run: func(ctx context.Context, tx *sqlx.Tx, cc chatCommandContext) (string, error) {
+			settings, err := fetchChatCommandSettings(ctx, tx, cc.Livestream.ID)
+			if err != nil {
+				return "", err
+			}
+			var names []string
+			for _, s := range settings {
+				if s.Enabled {
+					names = append(names, chatCommandPrefix+s.Name)
+				}
+			}
+			return "使えるコマンド: " + strings.Join(names, " "), nil
+		},
+	})
+}
+
+type ChatCommandSetting struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Privileged  bool   `json:"privileged"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// fetchChatCommandSettings は配信での各コマンドの有効・無効を名前順に返す
+func fetchChatCommandSettings(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]ChatCommandSetting, error) {
+	var rows []struct {
+		Command string `db:"command"`
+		Enabled bool   `db:"enabled"`
+	}
+	if err := tx.SelectContext(ctx, &rows, "SELECT command, enabled FROM livestream_chat_commands WHERE livestream_id = ?", livestreamID); err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		overrides[r.Command] = r.Enabled
+	}
+
+	settings := make([]ChatCommandSetting, 0, len(chatCommands))
+	for _, cmd := range chatCommands {
+		enabled, ok := overrides[cmd.Name]
+		if !ok {
+			enabled = cmd.DefaultEnabled
+		}
+		settings = append(settings, ChatCommandSetting{
+			Name:        cmd.Name,
+			Description: cmd.Description,
+			Privileged:  cmd.Privileged,
+			Enabled:     enabled,
+		})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings, nil
+}
+
+// processChatCommand はコメントがコマンドであれば実行し、応答をボットのコメントとして投稿する
+// コマンドのコメント自体は通常のコメントとして残す。投稿と同じトランザクションで呼ぶこと
+func processChatCommand(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64, comment string) error {
+	if !chatCommandsEnabled || !strings.HasPrefix(comment, chatCommandPrefix) {
+		return nil
+	}
+	fields := strings.Fields(strings.TrimPrefix(comment, chatCommandPrefix))
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, ok := chatCommands[strings.ToLower(fields[0])]
+	if !ok {
+		return nil
+	}
+
+	enabled := cmd.DefaultEnabled
+	if err := tx.GetContext(ctx, &enabled, "SELECT enabled FROM livestream_chat_commands WHERE livestream_id = ? AND command = ?", livestreamModel.ID, cmd.Name); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+	if cmd.Privileged {
+		allowed, err := Can(ctx, tx, userID, actionRunPrivilegedChat, livestreamModel.ID)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return nil
+		}
+	}
+
+	reply, err := cmd.Run(ctx, tx, chatCommandContext{Livestream: livestreamModel, UserID: userID, Args: fields[1:]})
+	if err != nil {
+		return err
+	}
+	if reply == "" {
+		return nil
+	}
+	// 応答の送り主は配信者とする
+	return insertServerLivecomment(ctx, tx, livestreamModel.ID, livestreamModel.UserID, livecommentTypeBot, reply)
+}
+
+// 配信のチャットコマンド設定取得API (配信者向け)
+// GET /api/livestream/:livestream_id/commands
+func getChatCommandsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var settings []ChatCommandSetting
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		settings, err = fetchChatCommandSettings(ctx, tx, int64(livestreamID))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat command settings: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+type PutChatCommandRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// 配信のチャットコマンドの有効・無効を切り替えるAPI (配信者向け)
+// PUT /api/livestream/:livestream_id/commands/:command
+func putChatCommandHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	cmd, ok := chatCommands[c.Param("command")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "chat command not found")
+	}
+
+	var req PutChatCommandRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_chat_commands (livestream_id, command, enabled) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)", livestreamID, cmd.Name, req.Enabled); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update chat command setting: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ChatCommandSetting{
+		Name:        cmd.Name,
+		Description: cmd.Description,
+		Privileged:  cmd.Privileged,
+		Enabled:     req.Enabled,
+	})
+}
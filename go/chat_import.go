@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	echolog "github.com/labstack/gommon/log"
+)
+
+const (
+	chatImportStatusPending = "pending"
+	chatImportStatusRunning = "running"
+	chatImportStatusDone    = "done"
+	chatImportStatusFailed  = "failed"
+
+	chatImportFormatCSV  = "csv"
+	chatImportFormatJSON = "json"
+
+	chatImportWorkerInterval = 10 * time.Second
+	// 1トランザクションで書き込むコメント数 (ここごとに進捗を更新する)
+	chatImportBatchSize       = 500
+	maxChatImportMessages     = 100000
+	maxChatImportMessageLen   = 10000
+	maxChatImportAuthorLen    = 64
+	chatImportGuestNamePrefix = "guest_"
+)
+
+var (
+	chatImportPlatformPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+	chatImportWakeup          = make(chan struct{}, 1)
+)
+
+// ChatImportModel は他の配信サービスから書き出したチャットログの取り込みジョブ
+// 取り込み前のファイルをそのまま payload に持つ
+type ChatImportModel struct {
+	ID           int64          `db:"id"`
+	UserID       int64          `db:"user_id"`
+	LivestreamID int64          `db:"livestream_id"`
+	Platform     string         `db:"platform"`
+	Format       string         `db:"format"`
+	Payload      []byte         `db:"payload"`
+	Status       string         `db:"status"`
+	Total        int64          `db:"total"`
+	Processed    int64          `db:"processed"`
+	Imported     int64          `db:"imported"`
+	Skipped      int64          `db:"skipped"`
+	Error        sql.NullString `db:"error"`
+	CreatedAt    int64          `db:"created_at"`
+	CompletedAt  *int64         `db:"completed_at"`
+}
+
+type ChatImport struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	Platform     string `json:"platform"`
+	Format       string `json:"format"`
+	Status       string `json:"status"`
+	// 読み込んだメッセージ数 (パースが終わるまでは 0)
+	Total     int64 `json:"total"`
+	Processed int64 `json:"processed"`
+	Imported  int64 `json:"imported"`
+	// 本文が空・配信時間の外など、取り込まなかったメッセージ数
+	Skipped     int64  `json:"skipped"`
+	Error       string `json:"error,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+	CompletedAt *int64 `json:"completed_at,omitempty"`
+}
+
+// chatImportColumns は payload 以外の列 (一覧や進捗の取得で使う)
+const chatImportColumns = "id, user_id, livestream_id, platform, format, status, total, processed, imported, skipped, error, created_at, completed_at"
+
+func newChatImport(m ChatImportModel) ChatImport {
+	return ChatImport{
+		ID:           m.ID,
+		LivestreamID: m.LivestreamID,
+		Platform:     m.Platform,
+		Format:       m.Format,
+		Status:       m.Status,
+		Total:        m.Total,
+		Processed:    m.Processed,
+		Imported:     m.Imported,
+		Skipped:      m.Skipped,
+		Error:        m.Error.String,
+		CreatedAt:    m.CreatedAt,
+		CompletedAt:  m.CompletedAt,
+	}
+}
+
+// chatImportMessage はチャットログの1行
+type chatImportMessage struct {
+	Author  string
+	Message string
+	// UNIX 時刻 (秒)
+	CreatedAt int64
+}
+
+// chatImportFormatOf は format の指定が無ければ Content-Type から判断する
+func chatImportFormatOf(format, contentType string) (string, error) {
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch mediaType {
+		case "text/csv":
+			format = chatImportFormatCSV
+		case echo.MIMEApplicationJSON:
+			format = chatImportFormatJSON
+		}
+	}
+	if format != chatImportFormatCSV && format != chatImportFormatJSON {
+		return "", fmt.Errorf("format must be %s or %s", chatImportFormatCSV, chatImportFormatJSON)
+	}
+	return format, nil
+}
+
+// enqueueChatImport はアーカイブ済みの配信にチャットログの取り込みを積む
+// 配信者かどうかは呼び出し側で確かめる (API は routePermissions で authorizationMiddleware が見る)
+func enqueueChatImport(ctx context.Context, userID, livestreamID int64, platform, format string, payload []byte) (ChatImportModel, error) {
+	if !chatImportPlatformPattern.MatchString(platform) {
+		return ChatImportModel{}, echo.NewHTTPError(http.StatusBadRequest, "platform must be 1 to 32 characters of [a-z0-9_]")
+	}
+	if len(payload) == 0 {
+		return ChatImportModel{}, echo.NewHTTPError(http.StatusBadRequest, "chat log is empty")
+	}
+
+	m := ChatImportModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		Platform:     platform,
+		Format:       format,
+		Payload:      payload,
+		Status:       chatImportStatusPending,
+		CreatedAt:    clock.Now().Unix(),
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if livestreamModel.EndAt > clock.Now().Unix() {
+			return echo.NewHTTPError(http.StatusBadRequest, "chat logs can be imported after the livestream ends")
+		}
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO chat_imports (user_id, livestream_id, platform, format, payload, status, created_at) VALUES (:user_id, :livestream_id, :platform, :format, :payload, :status, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert chat import: "+err.Error()).SetInternal(err)
+		}
+		if m.ID, err = rs.LastInsertId(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted chat import id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return ChatImportModel{}, err
+	}
+	return m, nil
+}
+
+// チャットログの取り込みAPI (配信者向け)
+// POST /api/livestream/:livestream_id/chat_imports?platform=twitch&format=csv
+// 本文はファイルをそのまま送る。format を省略したら Content-Type (text/csv, application/json) で判断する
+func postChatImportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	format, err := chatImportFormatOf(c.QueryParam("format"), c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	payload, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the chat log: "+err.Error())
+	}
+
+	m, err := enqueueChatImport(ctx, userID, livestreamID, c.QueryParam("platform"), format, payload)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case chatImportWakeup <- struct{}{}:
+	default:
+	}
+	return c.JSON(http.StatusAccepted, newChatImport(m))
+}
+
+// チャットログの取り込みの進捗取得API (配信者向け)
+// GET /api/livestream/:livestream_id/chat_imports/:import_id
+func getChatImportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	importID, err := strconv.ParseInt(c.Param("import_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "import_id in path must be integer")
+	}
+
+	var m ChatImportModel
+	if err := dbConn.GetContext(ctx, &m, "SELECT "+chatImportColumns+" FROM chat_imports WHERE id = ? AND livestream_id = ? AND user_id = ?", importID, livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "chat import not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat import: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, newChatImport(m))
+}
+
+// runChatImportWorker は受け付けた取り込みを1件ずつ処理する
+func runChatImportWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(chatImportWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-chatImportWakeup:
+		}
+		for {
+			processed, err := processNextChatImport(ctx, nil)
+			if err != nil {
+				logger.Warnf("failed to process chat import: %v", err)
+				break
+			}
+			if !processed {
+				break
+			}
+		}
+	}
+}
+
+// processNextChatImport は待っている取り込みを1件取って処理する
+// progress はバッチを書き込むたびに呼ばれる (nil でよい)
+func processNextChatImport(ctx context.Context, progress func(ChatImportModel)) (bool, error) {
+	var m ChatImportModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM chat_imports WHERE status = ? ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED", chatImportStatusPending); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE chat_imports SET status = ? WHERE id = ?", chatImportStatusRunning, m.ID)
+		return err
+	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	runErr := runChatImport(ctx, &m, progress)
+	now := clock.Now().Unix()
+	if runErr != nil {
+		// 書き込み済みのバッチは残す (進捗から、どこまで取り込んだかが分かる)
+		if _, err := dbConn.ExecContext(ctx, "UPDATE chat_imports SET status = ?, error = ?, completed_at = ? WHERE id = ?", chatImportStatusFailed, runErr.Error(), now, m.ID); err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+	// 取り込み終わったファイルは持っておく必要が無い
+	if _, err := dbConn.ExecContext(ctx, "UPDATE chat_imports SET status = ?, payload = '', completed_at = ? WHERE id = ?", chatImportStatusDone, now, m.ID); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func runChatImport(ctx context.Context, m *ChatImportModel, progress func(ChatImportModel)) error {
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", m.LivestreamID); err != nil {
+		return fmt.Errorf("failed to get livestream: %w", err)
+	}
+
+	messages, err := parseChatLog(m.Format, m.Payload, livestreamModel.StartAt)
+	if err != nil {
+		return err
+	}
+	if len(messages) > maxChatImportMessages {
+		return fmt.Errorf("too many messages (%d > %d)", len(messages), maxChatImportMessages)
+	}
+	m.Total = int64(len(messages))
+	if _, err := dbConn.ExecContext(ctx, "UPDATE chat_imports SET total = ? WHERE id = ?", m.Total, m.ID); err != nil {
+		return err
+	}
+
+	guests := map[string]int64{}
+	for start := 0; start < len(messages); start += chatImportBatchSize {
+		batch := messages[start:min(start+chatImportBatchSize, len(messages))]
+		var (
+			imported, skipped int64
+			// このバッチで引いたゲスト (コミットされてから guests に入れる)
+			batchGuests map[string]int64
+		)
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			imported, skipped = 0, 0
+			batchGuests = map[string]int64{}
+			livecomments := make([]LivecommentModel, 0, len(batch))
+			for _, msg := range batch {
+				if msg.Author == "" || msg.Message == "" || utf8.RuneCountInString(msg.Message) > maxChatImportMessageLen ||
+					msg.CreatedAt < livestreamModel.StartAt || msg.CreatedAt > livestreamModel.EndAt {
+					skipped++
+					continue
+				}
+				guestID, ok := guests[msg.Author]
+				if !ok {
+					if guestID, ok = batchGuests[msg.Author]; !ok {
+						var err error
+						if guestID, err = resolveChatImportGuest(ctx, tx, m.Platform, msg.Author); err != nil {
+							return err
+						}
+						batchGuests[msg.Author] = guestID
+					}
+				}
+				livecomments = append(livecomments, LivecommentModel{
+					UserID:       guestID,
+					LivestreamID: m.LivestreamID,
+					Comment:      msg.Message,
+					CommentType:  livecommentTypeUser,
+					CreatedAt:    msg.CreatedAt,
+				})
+			}
+			if err := insertLivecomments(ctx, tx, livecomments); err != nil {
+				return fmt.Errorf("failed to insert livecomments: %w", err)
+			}
+			imported = int64(len(livecomments))
+			_, err := tx.ExecContext(ctx, "UPDATE chat_imports SET processed = processed + ?, imported = imported + ?, skipped = skipped + ? WHERE id = ?", len(batch), imported, skipped, m.ID)
+			return err
+		}); err != nil {
+			return err
+		}
+		for author, id := range batchGuests {
+			guests[author] = id
+		}
+		m.Processed += int64(len(batch))
+		m.Imported += imported
+		m.Skipped += skipped
+		if progress != nil {
+			progress(*m)
+		}
+	}
+	return nil
+}
+
+// resolveChatImportGuest は取り込み元の投稿者に対応するゲストユーザを返す (無ければ作る)
+// ゲストはログインできない (パスワードのハッシュが bcrypt の形式でない) ユーザで、サービスと投稿者名の組ごとに1人
+func resolveChatImportGuest(ctx context.Context, tx *sqlx.Tx, platform, author string) (int64, error) {
+	var userID int64
+	err := tx.GetContext(ctx, &userID, "SELECT user_id FROM chat_import_guests WHERE platform = ? AND external_name = ?", platform, author)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	sum := sha256.Sum256([]byte(platform + "\x00" + author))
+	name := chatImportGuestNamePrefix + platform + "_" + hex.EncodeToString(sum[:8])
+	rs, err := tx.ExecContext(ctx, "INSERT INTO users (name, display_name, description, password, created_at) VALUES (?, ?, ?, ?, ?)", name, author, "imported from "+platform, "!", clock.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert guest user: %w", err)
+	}
+	if userID, err = rs.LastInsertId(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", userID, false); err != nil {
+		return 0, fmt.Errorf("failed to insert guest theme: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO chat_import_guests (platform, external_name, user_id) VALUES (?, ?, ?)", platform, author, userID); err != nil {
+		return 0, fmt.Errorf("failed to insert guest: %w", err)
+	}
+	return userID, nil
+}
+
+// parseChatLog はチャットログを読む
+// CSV は見出し行に author, message と、timestamp か offset の列を持つ (列の順は問わない)
+// JSON は {"author", "message", "timestamp" | "offset"} の配列
+// timestamp は UNIX 時刻 (秒かミリ秒) か RFC 3339、offset は配信開始からの秒数
+func parseChatLog(format string, payload []byte, startAt int64) ([]chatImportMessage, error) {
+	payload = bytes.TrimPrefix(payload, utf8BOM)
+	switch format {
+	case chatImportFormatCSV:
+		return parseChatLogCSV(payload, startAt)
+	case chatImportFormatJSON:
+		return parseChatLogJSON(payload, startAt)
+	}
+	return nil, fmt.Errorf("unknown chat log format '%s'", format)
+}
+
+func parseChatLogCSV(payload []byte, startAt int64) ([]chatImportMessage, error) {
+	r := csv.NewReader(bytes.NewReader(payload))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	authorCol, okAuthor := columns["author"]
+	messageCol, okMessage := columns["message"]
+	timestampCol, okTimestamp := columns["timestamp"]
+	offsetCol, okOffset := columns["offset"]
+	if !okAuthor || !okMessage || (!okTimestamp && !okOffset) {
+		return nil, errors.New("csv header must have author, message and timestamp or offset")
+	}
+
+	var messages []chatImportMessage
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv: %w", err)
+		}
+		field := func(i int) string {
+			if i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		var createdAt int64
+		if okTimestamp {
+			createdAt, err = parseChatImportTimestamp(field(timestampCol))
+		} else {
+			createdAt, err = parseChatImportOffset(field(offsetCol), startAt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		messages = append(messages, newChatImportMessage(field(authorCol), field(messageCol), createdAt))
+	}
+}
+
+func parseChatLogJSON(payload []byte, startAt int64) ([]chatImportMessage, error) {
+	var rows []struct {
+		Author  string `json:"author"`
+		Message string `json:"message"`
+		// 数値と文字列のどちらでもよい
+		Timestamp json.RawMessage `json:"timestamp"`
+		Offset    json.RawMessage `json:"offset"`
+	}
+	if err := json.Unmarshal(payload, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode json: %w", err)
+	}
+
+	messages := make([]chatImportMessage, 0, len(rows))
+	for i, row := range rows {
+		var (
+			createdAt int64
+			err       error
+		)
+		switch {
+		case len(row.Timestamp) > 0:
+			createdAt, err = parseChatImportTimestamp(jsonScalarString(row.Timestamp))
+		case len(row.Offset) > 0:
+			createdAt, err = parseChatImportOffset(jsonScalarString(row.Offset), startAt)
+		default:
+			err = errors.New("timestamp or offset is required")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		messages = append(messages, newChatImportMessage(row.Author, row.Message, createdAt))
+	}
+	return messages, nil
+}
+
+// jsonScalarString は JSON の文字列なら中身を、それ以外ならそのままの表記を返す
+func jsonScalarString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// newChatImportMessage は前後の空白を落とし、長すぎる投稿者名を切り詰める
+// 投稿者名か本文が空のものは取り込むときに飛ばす
+func newChatImportMessage(author, message string, createdAt int64) chatImportMessage {
+	author = strings.TrimSpace(author)
+	if utf8.RuneCountInString(author) > maxChatImportAuthorLen {
+		author = string([]rune(author)[:maxChatImportAuthorLen])
+	}
+	return chatImportMessage{Author: author, Message: strings.TrimSpace(message), CreatedAt: createdAt}
+}
+
+// parseChatImportTimestamp は UNIX 時刻 (秒かミリ秒) か RFC 3339 の時刻を UNIX 時刻 (秒) にする
+// 10^11 を超える数値はミリ秒とみなす (秒なら西暦5000年以降になる)
+func parseChatImportTimestamp(v string) (int64, error) {
+	v = strings.TrimSpace(v)
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		if n > 1e11 {
+			n /= 1000
+		}
+		return int64(n), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp '%s'", v)
+	}
+	return t.Unix(), nil
+}
+
+func parseChatImportOffset(v string, startAt int64) (int64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid offset '%s'", v)
+	}
+	return startAt + int64(n), nil
+}
+
+// runChatImportCommand は `isupipe import-chat -livestream ID -platform NAME [-format csv|json] FILE` として、
+// 配信者の代わりにチャットログを取り込む (API と同じジョブを積み、その場で処理して進捗を出す)
+// API のリクエストサイズの上限を超える大きなログを移行するときに使う
+func runChatImportCommand(args []string) int {
+	logger := echolog.New("import-chat")
+	logger.SetLevel(echolog.INFO)
+
+	fs := flag.NewFlagSet("import-chat", flag.ContinueOnError)
+	livestreamID := fs.Int64("livestream", 0, "id of the archived livestream to import into")
+	platform := fs.String("platform", "", "name of the platform the log was exported from (e.g. twitch)")
+	format := fs.String("format", "", "csv or json (defaults to the file extension)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *livestreamID <= 0 || fs.NArg() != 1 {
+		logger.Errorf("usage: import-chat -livestream ID -platform NAME [-format csv|json] FILE")
+		return 2
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	if _, err := chatImportFormatOf(*format, ""); err != nil {
+		logger.Errorf("%v", err)
+		return 2
+	}
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		logger.Errorf("failed to read chat log: %v", err)
+		return 1
+	}
+
+	conn, err := connectDB(logger)
+	if err != nil {
+		logger.Errorf("failed to connect db: %v", err)
+		return 1
+	}
+	defer conn.Close()
+	dbConn = conn
+
+	ctx := context.Background()
+	if err := loadLivecommentShardConfig(); err != nil {
+		logger.Errorf("failed to load livecomment shard config: %v", err)
+		return 1
+	}
+	if err := loadColdStorageConfig(); err != nil {
+		logger.Errorf("failed to load cold storage config: %v", err)
+		return 1
+	}
+	if coldStorageEnabled {
+		if err := refreshColdLivestreams(ctx); err != nil {
+			logger.Errorf("failed to refresh cold livestreams: %v", err)
+			return 1
+		}
+	}
+
+	var ownerID int64
+	if err := dbConn.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", *livestreamID); err != nil {
+		logger.Errorf("failed to get livestream: %v", err)
+		return 1
+	}
+	m, err := enqueueChatImport(ctx, ownerID, *livestreamID, *platform, *format, payload)
+	if err != nil {
+		logger.Errorf("failed to enqueue chat import: %v", err)
+		return 1
+	}
+	logger.Infof("enqueued chat import %d", m.ID)
+
+	// 先に積まれていた取り込みも順に処理する
+	for {
+		processed, err := processNextChatImport(ctx, func(p ChatImportModel) {
+			logger.Infof("chat import %d: %d/%d processed (%d imported, %d skipped)", p.ID, p.Processed, p.Total, p.Imported, p.Skipped)
+		})
+		if err != nil {
+			logger.Errorf("failed to process chat import: %v", err)
+			return 1
+		}
+		if !processed {
+			break
+		}
+	}
+
+	if err := dbConn.GetContext(ctx, &m, "SELECT "+chatImportColumns+" FROM chat_imports WHERE id = ?", m.ID); err != nil {
+		logger.Errorf("failed to get chat import: %v", err)
+		return 1
+	}
+	if m.Status != chatImportStatusDone {
+		logger.Errorf("chat import %d %s: %s", m.ID, m.Status, m.Error.String)
+		return 1
+	}
+	logger.Infof("chat import %d done: %d imported, %d skipped", m.ID, m.Imported, m.Skipped)
+	return 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	circuitBreakerThresholdEnvKey   = "ISUCON13_CIRCUIT_BREAKER_FAILURE_THRESHOLD"
+	circuitBreakerOpenSecondsEnvKey = "ISUCON13_CIRCUIT_BREAKER_OPEN_SECONDS"
+
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerOpen      = 30 * time.Second
+	// pdnsutil が応答しないときに登録を待たせ続けない
+	powerDNSCommandTimeout = 5 * time.Second
+
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+
+	circuitPowerDNS        = "powerdns"
+	circuitImageModeration = "image_moderation"
+	circuitToxicity        = "toxicity"
+	circuitGeoIP           = "geoip"
+	circuitMailer          = "mailer"
+	// webhook は送り先ごとに分ける (1つの送り先が落ちていても他には送る)
+	circuitWebhookPrefix    = "webhook:"
+	circuitLinkUnfurlPrefix = "unfurl:"
+	// 配信の URL の確認はホストごと
+	circuitPlaylistHealthPrefix = "playlist_health:"
+)
+
+// errCircuitOpen は遮断中で呼び出しをしなかったことを表す
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// 外部依存の呼び出しを続けて失敗したら、一定時間呼ばずにすぐ失敗させる
+// 時間が経ったら1回だけ試し (half-open)、成功すれば元に戻す
+var (
+	circuitBreakerThreshold = defaultCircuitBreakerThreshold
+	circuitBreakerOpen      = defaultCircuitBreakerOpen
+
+	circuitBreakersMu sync.Mutex
+	circuitBreakers   = map[string]*circuitBreaker{}
+)
+
+func loadCircuitBreakerConfig() error {
+	if v, ok := os.LookupEnv(circuitBreakerThresholdEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", circuitBreakerThresholdEnvKey, v)
+		}
+		circuitBreakerThreshold = n
+	}
+	if v, ok := os.LookupEnv(circuitBreakerOpenSecondsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", circuitBreakerOpenSecondsEnvKey, v)
+		}
+		circuitBreakerOpen = time.Duration(n) * time.Second
+	}
+	return nil
+}
+
+type circuitBreaker struct {
+	name string
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// half-open で試している呼び出しがあるか
+	probing bool
+}
+
+// getCircuitBreaker は名前ごとの遮断器を返す (無ければ作る)
+func getCircuitBreaker(name string) *circuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	b, ok := circuitBreakers[name]
+	if !ok {
+		b = &circuitBreaker{name: name, state: circuitClosed}
+		circuitBreakers[name] = b
+	}
+	return b
+}
+
+// Do は遮断中でなければ fn を呼び、結果を記録する
+func (b *circuitBreaker) Do(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < circuitBreakerOpen {
+			return fmt.Errorf("%s: %w", b.name, errCircuitOpen)
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return nil
+	case circuitHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%s: %w", b.name, errCircuitOpen)
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= circuitBreakerThreshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+type CircuitBreakerStatus struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	// 遮断した日時 (UNIX時間)。閉じていれば省略
+	OpenedAt int64 `json:"opened_at,omitempty"`
+}
+
+func circuitBreakerStatuses() []CircuitBreakerStatus {
+	circuitBreakersMu.Lock()
+	breakers := make([]*circuitBreaker, 0, len(circuitBreakers))
+	for _, b := range circuitBreakers {
+		breakers = append(breakers, b)
+	}
+	circuitBreakersMu.Unlock()
+
+	statuses := make([]CircuitBreakerStatus, len(breakers))
+	for i, b := range breakers {
+		b.mu.Lock()
+		statuses[i] = CircuitBreakerStatus{Name: b.name, State: b.state, Failures: b.failures}
+		if b.state != circuitClosed {
+			statuses[i].OpenedAt = b.openedAt.Unix()
+		}
+		b.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
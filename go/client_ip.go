@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	trustedProxyCIDRsEnvKey = "ISUCON13_TRUSTED_PROXY_CIDRS"
+)
+
+// X-Forwarded-For を遡って信用するプロキシ (nginx・LB) の範囲
+// デフォルトは同じホストの nginx だけ (ループバック)
+var defaultTrustedProxyCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// clientIPExtractor は接続元の IP を取り出す
+// X-Forwarded-For は信用するプロキシから来た分だけを右から遡り、最初の信用しないアドレスを接続元とする
+// (echo のデフォルトの RealIP は左端を返すので、クライアントが自由に偽れる)
+var clientIPExtractor = mustTrustedProxyExtractor(defaultTrustedProxyCIDRs)
+
+func trustedProxyExtractor(cidrs []string) (echo.IPExtractor, error) {
+	// echo のデフォルトではプライベートアドレスなども信用するので、指定した範囲だけに絞る
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+func mustTrustedProxyExtractor(cidrs []string) echo.IPExtractor {
+	extractor, err := trustedProxyExtractor(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return extractor
+}
+
+// loadTrustedProxyConfig は信用するプロキシを読み、e.IPExtractor にも設定する (c.RealIP() も同じ結果になる)
+func loadTrustedProxyConfig(e *echo.Echo) error {
+	if v, ok := os.LookupEnv(trustedProxyCIDRsEnvKey); ok {
+		extractor, err := trustedProxyExtractor(splitCommaList(v))
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as CIDR list: %+v", trustedProxyCIDRsEnvKey, err)
+		}
+		clientIPExtractor = extractor
+	}
+	e.IPExtractor = clientIPExtractor
+	return nil
+}
+
+// clientIP はリクエストの接続元の IP を返す (監査ログ・スロットリングなど、偽られると困る箇所で使う)
+func clientIP(c echo.Context) string {
+	return clientIPExtractor(c.Request())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		want   string
+	}{
+		{name: "direct", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "forged header from outside", remote: "203.0.113.5:1234", xff: "127.0.0.1", want: "203.0.113.5"},
+		{name: "through nginx", remote: "127.0.0.1:1234", xff: "198.51.100.7", want: "198.51.100.7"},
+		{name: "forged header through nginx", remote: "127.0.0.1:1234", xff: "127.0.0.1, 198.51.100.7", want: "198.51.100.7"},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set(echo.HeaderXForwardedFor, tt.xff)
+			}
+			if got := clientIP(e.NewContext(req, httptest.NewRecorder())); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
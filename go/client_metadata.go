@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	clientMetadataEnabledEnvKey       = "ISUCON13_CLIENT_METADATA_ENABLED"
+	clientMetadataRetentionDaysEnvKey = "ISUCON13_CLIENT_METADATA_RETENTION_DAYS"
+	geoIPResolverEnvKey               = "ISUCON13_GEOIP_RESOLVER"
+	geoIPAPIURLEnvKey                 = "ISUCON13_GEOIP_API_URL"
+
+	geoIPResolverHTTP = "http"
+
+	defaultClientMetadataRetentionDays = 30
+	geoIPAPITimeout                    = 500 * time.Millisecond
+)
+
+// 荒らし調査用にコメント・報告の送信元を記録する (保持期間を過ぎたものはメンテナンスジョブで消す)
+// 1投稿ごとにINSERTが増えるので、デフォルトでは無効
+var (
+	clientMetadataEnabled                   = false
+	clientMetadataRetention                 = defaultClientMetadataRetentionDays * 24 * time.Hour
+	geoIP                   countryResolver = noopCountryResolver{}
+)
+
+// countryResolver はIPアドレスから国コードを引く (引けなければ空文字)
+type countryResolver interface {
+	Country(ctx context.Context, ip string) (string, error)
+}
+
+type noopCountryResolver struct{}
+
+func (noopCountryResolver) Country(context.Context, string) (string, error) { return "", nil }
+
+// httpCountryResolver は外部のGeoIP APIに問い合わせる
+// GET <url>?ip=<ip> に対して {"country": "JP"} が返ってくる想定
+type httpCountryResolver struct {
+	url    string
+	client *http.Client
+}
+
+func (r *httpCountryResolver) Country(ctx context.Context, ip string) (string, error) {
+	var country string
+	err := getCircuitBreaker(circuitGeoIP).Do(func() error {
+		var err error
+		country, err = r.country(ctx, ip)
+		return err
+	})
+	return country, err
+}
+
+func (r *httpCountryResolver) country(ctx context.Context, ip string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+"?ip="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("geoip api returned status %d", resp.StatusCode)
+	}
+	var res struct {
+		Country string `json:"country"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Country, nil
+}
+
+func loadClientMetadataConfig() error {
+	if v, ok := os.LookupEnv(clientMetadataEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", clientMetadataEnabledEnvKey, err)
+		}
+		clientMetadataEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(clientMetadataRetentionDaysEnvKey); ok {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", clientMetadataRetentionDaysEnvKey, v)
+		}
+		clientMetadataRetention = time.Duration(days) * 24 * time.Hour
+	}
+
+	switch v := os.Getenv(geoIPResolverEnvKey); v {
+	case "":
+		geoIP = noopCountryResolver{}
+	case geoIPResolverHTTP:
+		u, ok := os.LookupEnv(geoIPAPIURLEnvKey)
+		if !ok || u == "" {
+			return fmt.Errorf("environment variable '%s' must be provided when '%s' is %s", geoIPAPIURLEnvKey, geoIPResolverEnvKey, geoIPResolverHTTP)
+		}
+		geoIP = &httpCountryResolver{url: u, client: &http.Client{Timeout: geoIPAPITimeout}}
+	default:
+		return fmt.Errorf("unknown geoip resolver '%s'", v)
+	}
+	return nil
+}
+
+type ClientMetadataModel struct {
+	TargetType string `db:"target_type"`
+	TargetID   int64  `db:"target_id"`
+	IP         string `db:"ip"`
+	Country    string `db:"country"`
+	CreatedAt  int64  `db:"created_at"`
+}
+
+type ClientMetadata struct {
+	TargetType string `json:"target_type"`
+	TargetID   int64  `json:"target_id"`
+	IP         string `json:"ip"`
+	Country    string `json:"country,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// resolveClientMetadata はリクエストの送信元を調べる
+// 外部APIを叩くことがあるので、トランザクションを張る前に呼ぶ
+// 国の解決に失敗しても投稿自体は止めない
+func resolveClientMetadata(ctx context.Context, c echo.Context) ClientMetadataModel {
+	if !clientMetadataEnabled {
+		return ClientMetadataModel{}
+	}
+
+	// X-Forwarded-For は信用するプロキシが付けた分だけを見る (左端はクライアントが偽れる)
+	ip := clientIP(c)
+	country, err := geoIP.Country(ctx, ip)
+	if err != nil {
+		c.Logger().Warnf("failed to resolve country of %s: %v", ip, err)
+		country = ""
+	}
+	return ClientMetadataModel{IP: ip, Country: country}
+}
+
+// insertClientMetadata は送信元を記録する
+func insertClientMetadata(ctx context.Context, tx *sqlx.Tx, m ClientMetadataModel, targetType string, targetID int64) error {
+	if !clientMetadataEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO client_metadata (target_type, target_id, ip, country, created_at) VALUES (?, ?, ?, ?, ?)", targetType, targetID, m.IP, m.Country, clock.Now().Unix())
+	return err
+}
+
+// 送信元記録の検索API (管理者向け)
+// GET /api/admin/audit_logs/client_metadata
+func getClientMetadataHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM client_metadata").
+		OrderBy("created_at DESC").
+		Limit(defaultAuditLogsLimit)
+	for _, key := range []string{"target_type", "ip", "country"} {
+		if v := c.QueryParam(key); v != "" {
+			q.Where(key+" = ?", v)
+		}
+	}
+	if err := q.WhereInt64Param(c, "target_id", "target_id = ?"); err != nil {
+		return err
+	}
+	if err := q.WhereInt64Param(c, "since", "created_at >= ?"); err != nil {
+		return err
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var models []ClientMetadataModel
+	if err := dbConn.SelectContext(ctx, &models, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get client metadata: "+err.Error()).SetInternal(err)
+	}
+
+	metadata := make([]ClientMetadata, len(models))
+	for i, m := range models {
+		metadata[i] = ClientMetadata(m)
+	}
+
+	return c.JSON(http.StatusOK, metadata)
+}
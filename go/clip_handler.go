@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// クリップの長さの上限 (秒)
+	maxClipSeconds = 180
+	// トレンドの集計に使う直近の期間
+	clipTrendingWindow = 24 * time.Hour
+	// トレンドのデフォルトの件数
+	defaultClipTrendingLimit = 20
+)
+
+type ClipModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Title        string `db:"title"`
+	StartOffset  int64  `db:"start_offset"`
+	EndOffset    int64  `db:"end_offset"`
+	ViewCount    int64  `db:"view_count"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type Clip struct {
+	ID         int64      `json:"id"`
+	Livestream Livestream `json:"livestream"`
+	// クリップを作ったユーザ
+	User  User   `json:"user"`
+	Title string `json:"title"`
+	// 配信開始からの秒数
+	StartOffset int64 `json:"start_offset"`
+	EndOffset   int64 `json:"end_offset"`
+	ViewCount   int64 `json:"view_count"`
+	CreatedAt   int64 `json:"created_at"`
+}
+
+type PostClipRequest struct {
+	Title       string `json:"title"`
+	StartOffset int64  `json:"start_offset"`
+	EndOffset   int64  `json:"end_offset"`
+}
+
+func fillClipResponse(ctx context.Context, tx *sqlx.Tx, m ClipModel) (Clip, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", m.LivestreamID); err != nil {
+		return Clip{}, err
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return Clip{}, err
+	}
+	user, err := fillUserResponseByID(ctx, tx, m.UserID)
+	if err != nil {
+		return Clip{}, err
+	}
+	return Clip{
+		ID:          m.ID,
+		Livestream:  livestream,
+		User:        user,
+		Title:       m.Title,
+		StartOffset: m.StartOffset,
+		EndOffset:   m.EndOffset,
+		ViewCount:   m.ViewCount,
+		CreatedAt:   m.CreatedAt,
+	}, nil
+}
+
+func fillClipResponses(ctx context.Context, tx *sqlx.Tx, clipModels []ClipModel) ([]Clip, error) {
+	userIDs := make([]int64, len(clipModels))
+	for i := range clipModels {
+		userIDs[i] = clipModels[i].UserID
+	}
+	if err := loaderFrom(ctx).primeUsers(ctx, tx, userIDs); err != nil {
+		return nil, err
+	}
+
+	clips := make([]Clip, len(clipModels))
+	for i := range clipModels {
+		clip, err := fillClipResponse(ctx, tx, clipModels[i])
+		if err != nil {
+			return nil, err
+		}
+		clips[i] = clip
+	}
+	return clips, nil
+}
+
+// クリップ作成API
+// POST /api/livestream/:livestream_id/clips
+// 終了した配信 (アーカイブ) の区間だけを切り出せる
+func postClipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req PostClipRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Title == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "title must not be empty")
+	}
+	if req.StartOffset < 0 || req.EndOffset <= req.StartOffset || req.EndOffset-req.StartOffset > maxClipSeconds {
+		return echo.NewHTTPError(http.StatusBadRequest, "clip must be between 1 and 180 seconds from start_offset to end_offset")
+	}
+
+	var clip Clip
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamModel.ID, userID); err != nil {
+			return err
+		}
+		if livestreamModel.EndAt > clock.Now().Unix() {
+			return echo.NewHTTPError(http.StatusBadRequest, "clips can be created after the livestream ends")
+		}
+		if req.EndOffset > livestreamModel.EndAt-livestreamModel.StartAt {
+			return echo.NewHTTPError(http.StatusBadRequest, "end_offset exceeds the length of the livestream")
+		}
+
+		clipModel := ClipModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userID,
+			Title:        req.Title,
+			StartOffset:  req.StartOffset,
+			EndOffset:    req.EndOffset,
+			CreatedAt:    clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO clips (livestream_id, user_id, title, start_offset, end_offset, created_at) VALUES (:livestream_id, :user_id, :title, :start_offset, :end_offset, :created_at)", clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert clip: "+err.Error()).SetInternal(err)
+		}
+		clipID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted clip id: "+err.Error()).SetInternal(err)
+		}
+		clipModel.ID = clipID
+
+		clip, err = fillClipResponse(ctx, tx, clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, clip)
+}
+
+// 配信のクリップ一覧取得API
+// GET /api/livestream/:livestream_id/clips
+func getLivestreamClipsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	q := newSelectQuery("SELECT * FROM clips").
+		Where("livestream_id = ?", livestreamID).
+		OrderBy("created_at DESC")
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	clips := []Clip{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, int64(livestreamID), userID); err != nil {
+			return err
+		}
+
+		var clipModels []ClipModel
+		if err := tx.SelectContext(ctx, &clipModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clips: "+err.Error()).SetInternal(err)
+		}
+		if len(clipModels) == 0 {
+			return nil
+		}
+		clips, err = fillClipResponses(ctx, tx, clipModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clips: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, clips)
+}
+
+// トレンドのクリップ一覧取得API
+// GET /api/clips/trending?limit=
+// 直近24時間の再生数が多い順に返す。公開の配信のクリップだけが対象
+func getTrendingClipsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	q := newSelectQuery(`
+		SELECT c.* FROM clips c
+		INNER JOIN livestreams l ON l.id = c.livestream_id
+		INNER JOIN (
+			SELECT clip_id, COUNT(*) AS recent_views FROM clip_views WHERE viewed_at >= ? GROUP BY clip_id
+		) v ON v.clip_id = c.id`, clock.Now().Add(-clipTrendingWindow).Unix()).
+		Where("l.visibility = ?", livestreamVisibilityPublic).
+		OrderBy("v.recent_views DESC, c.id DESC").
+		Limit(defaultClipTrendingLimit)
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	clips := []Clip{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var clipModels []ClipModel
+		if err := tx.SelectContext(ctx, &clipModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get trending clips: "+err.Error()).SetInternal(err)
+		}
+		if len(clipModels) == 0 {
+			return nil
+		}
+		var err error
+		clips, err = fillClipResponses(ctx, tx, clipModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clips: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, clips)
+}
+
+// クリップの再生を記録するAPI
+// POST /api/clips/:clip_id/view
+// 再生数はクリップの view_count と、配信の分析レポートのクリップ再生数に反映される
+func postClipViewHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	clipID, err := strconv.Atoi(c.Param("clip_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "clip_id in path must be integer")
+	}
+
+	var clip Clip
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var clipModel ClipModel
+		if err := tx.GetContext(ctx, &clipModel, "SELECT * FROM clips WHERE id = ?", clipID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "clip not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clip: "+err.Error()).SetInternal(err)
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, clipModel.LivestreamID, userID); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO clip_views (clip_id, livestream_id, user_id, viewed_at) VALUES (?, ?, ?, ?)", clipModel.ID, clipModel.LivestreamID, userID, clock.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert clip view: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE clips SET view_count = view_count + 1 WHERE id = ?", clipModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update clip view count: "+err.Error()).SetInternal(err)
+		}
+		clipModel.ViewCount++
+
+		clip, err = fillClipResponse(ctx, tx, clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, clip)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const clockStartAtEnvKey = "ISUCON13_CLOCK_START_AT"
+
+// Clock は現在時刻の取得元
+// セッション期限や予約期間など時刻に依存する処理は time.Now() を直接呼ばずにこれを経由する
+type Clock interface {
+	Now() time.Time
+}
+
+// clock はハンドラが参照する時刻源 (テストでは frozenClock に差し替える)
+var clock Clock = systemClock{}
+
+// loadClockConfig は ISUCON13_CLOCK_START_AT (UNIX 時刻・秒) があれば、起動した時点をその時刻とする時計にする
+// テストで時刻に依存する振る舞い (strict での過去の予約の拒否など) を固定の予約期間に合わせて確かめるためのもので、デフォルトでは使わない
+func loadClockConfig() error {
+	v, ok := os.LookupEnv(clockStartAtEnvKey)
+	if !ok || v == "" {
+		return nil
+	}
+	startAt, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse environment variable '%s' as unix time: %+v", clockStartAtEnvKey, err)
+	}
+	clock = offsetClock{offset: time.Unix(startAt, 0).Sub(time.Now())}
+	return nil
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// offsetClock は実際の時刻から offset だけずらした時刻を返す (止まらずに進む)
+type offsetClock struct {
+	offset time.Duration
+}
+
+func (c offsetClock) Now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+// frozenClock は Set/Advance で明示的に進めない限り同じ時刻を返し続ける
+type frozenClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFrozenClock(now time.Time) *frozenClock {
+	return &frozenClock{now: now}
+}
+
+func (c *frozenClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *frozenClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *frozenClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// freezeClockForTest は clock を now で止めた frozenClock に差し替える
+func freezeClockForTest(t *testing.T, now time.Time) *frozenClock {
+	t.Helper()
+	saved := clock
+	c := newFrozenClock(now)
+	clock = c
+	t.Cleanup(func() { clock = saved })
+	return c
+}
+
+func TestUptimeCommand(t *testing.T) {
+	startAt := time.Unix(1700874000, 0)
+	c := freezeClockForTest(t, startAt.Add(-time.Minute))
+	uptime := chatCommands["uptime"]
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    string
+	}{
+		{name: "before start", elapsed: -time.Minute, want: "配信はまだ始まっていません"},
+		{name: "just started", elapsed: 0, want: "配信開始から0時間0分経過しました"},
+		{name: "minutes", elapsed: 59*time.Minute + 59*time.Second, want: "配信開始から0時間59分経過しました"},
+		{name: "hours", elapsed: 2*time.Hour + 5*time.Minute, want: "配信開始から2時間5分経過しました"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.Set(startAt.Add(tt.elapsed))
+			got, err := uptime.Run(context.Background(), nil, chatCommandContext{Livestream: LivestreamModel{StartAt: startAt.Unix()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("uptime = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TTL 内なら DB を引かずに覚えている役割を返す (db が nil なので、引きに行くと落ちる)
+func TestAuthzRoleCacheHit(t *testing.T) {
+	now := time.Unix(1700874000, 0)
+	c := freezeClockForTest(t, now)
+	resetAuthzCache()
+	t.Cleanup(resetAuthzCache)
+
+	key := channelRoleKey{OwnerID: 1, ChannelID: 2, UserID: 3}
+	authzCache.roles[key] = authzRoleEntry{Role: channelRoleVIP, ExpiresAt: now.Add(authzRoleCacheTTL)}
+
+	for _, d := range []time.Duration{0, authzRoleCacheTTL - time.Second} {
+		c.Set(now.Add(d))
+		role, err := authzRoleOf(context.Background(), nil, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != channelRoleVIP {
+			t.Errorf("role after %v = %q, want %q", d, role, channelRoleVIP)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// contract は記録したリクエストとレスポンスの組 (golden ファイル) をサーバに流し、レスポンスが変わっていないかを確かめる
+//
+// fill 系の関数やトランザクションを書き換えるときに、ベンチマーカーから見た振る舞いが変わっていないことを確かめるためのもの
+// golden ファイルは testdata/*.json をファイル名の順に流す (最初に /api/initialize を流すこと)
+// シナリオごとに Cookie を分けるので、ログインはシナリオの中で行う
+// 実行ごとに変わる ID は capture でレスポンスから取り出し、後のステップのパスやボディで {{name}} として使う
+//
+//	go run ./cmd/contract -target http://pipe.u.isucon.local:8080 -connect 127.0.0.1:8080
+//	go run ./cmd/contract -record -run login   # 今のサーバのレスポンスで golden ファイルを書き直す
+//
+// go test からも流せる (CONTRACT_TARGET が無ければスキップする。make contract も同じ)
+//
+//	CONTRACT_TARGET=http://pipe.u.isucon.local:8080 CONTRACT_CONNECT=127.0.0.1:8080 go test ./cmd/contract
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scenario は golden ファイル1つ分
+type scenario struct {
+	Name  string `json:"name"`
+	Steps []step `json:"steps"`
+}
+
+type step struct {
+	Request struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+		// 省略した場合はステータスだけを比べる
+		Body json.RawMessage `json:"body,omitempty"`
+	} `json:"response"`
+	// 比べないフィールド (実行ごとに変わる ID や時刻など)
+	// "livestream.id" のようにドットで区切り、配列の要素は "*" で表す ("tags.*.id")
+	Ignore []string `json:"ignore,omitempty"`
+	// レスポンスから取り出して、後のステップで {{name}} として使う値 (name とパスの組。パスは Ignore と同じ書き方で、配列は添字)
+	Capture map[string]string `json:"capture,omitempty"`
+}
+
+func main() {
+	var (
+		target  = flag.String("target", "http://pipe.u.isucon.local:8080", "base URL of the target host")
+		connect = flag.String("connect", "", "dial this address instead of resolving the target host (e.g. 127.0.0.1:8080)")
+		dir     = flag.String("dir", "cmd/contract/testdata", "directory of golden files")
+		run     = flag.String("run", "", "only replay golden files whose name matches this regexp")
+		record  = flag.Bool("record", false, "overwrite golden files with the current responses")
+		timeout = flag.Duration("timeout", 10*time.Second, "per request timeout")
+	)
+	flag.Parse()
+
+	var filter *regexp.Regexp
+	if *run != "" {
+		var err error
+		if filter, err = regexp.Compile(*run); err != nil {
+			log.Fatalf("invalid -run: %v", err)
+		}
+	}
+
+	paths, err := goldenFiles(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for _, path := range paths {
+		if filter != nil && !filter.MatchString(filepath.Base(path)) {
+			continue
+		}
+		if err := replayFile(context.Background(), newClient(*connect, *timeout), *target, path, *record); err != nil {
+			fmt.Printf("FAIL %s\n%v\n", filepath.Base(path), err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", filepath.Base(path))
+	}
+	if failed > 0 {
+		fmt.Printf("%d golden file(s) failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+// goldenFiles は dir の golden ファイルを流す順 (ファイル名の順) に返す
+func goldenFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list golden files: %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no golden files in %s", dir)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func newClient(connect string, timeout time.Duration) *http.Client {
+	jar, _ := cookiejar.New(nil)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if connect != "" {
+		// Cookieのドメイン (u.isucon.local) に合わせたホスト名のまま、接続先だけを差し替える
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, connect)
+		}
+	}
+	return &http.Client{
+		Jar:       jar,
+		Transport: transport,
+		Timeout:   timeout,
+		// リダイレクトもレスポンスとして比べる
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func replayFile(ctx context.Context, client *http.Client, target, path string, record bool) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sc scenario
+	if err := json.Unmarshal(raw, &sc); err != nil {
+		return fmt.Errorf("failed to parse golden file: %w", err)
+	}
+
+	vars := map[string]string{}
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		status, body, err := send(ctx, client, target, st, vars)
+		if err != nil {
+			return fmt.Errorf("step %d (%s %s): %w", i+1, st.Request.Method, st.Request.Path, err)
+		}
+		if err := capture(st, body, vars); err != nil {
+			return fmt.Errorf("step %d (%s %s): %w", i+1, st.Request.Method, st.Request.Path, err)
+		}
+		if record {
+			st.Response.Status = status
+			st.Response.Body = nil
+			if len(bytes.TrimSpace(body)) > 0 && json.Valid(body) {
+				st.Response.Body = json.RawMessage(body)
+			}
+			continue
+		}
+		if err := compare(st, status, body); err != nil {
+			return fmt.Errorf("step %d (%s %s): %w", i+1, st.Request.Method, st.Request.Path, err)
+		}
+	}
+
+	if !record {
+		return nil
+	}
+	out, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(out, '\n'), 0o644)
+}
+
+func send(ctx context.Context, client *http.Client, target string, st *step, vars map[string]string) (int, []byte, error) {
+	var reqBody io.Reader
+	if len(st.Request.Body) > 0 {
+		reqBody = strings.NewReader(expandVars(string(st.Request.Body), vars))
+	}
+	req, err := http.NewRequestWithContext(ctx, st.Request.Method, target+expandVars(st.Request.Path, vars), reqBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, body, nil
+}
+
+// expandVars は {{name}} を capture した値に置き換える
+func expandVars(s string, vars map[string]string) string {
+	for name, v := range vars {
+		s = strings.ReplaceAll(s, "{{"+name+"}}", v)
+	}
+	return s
+}
+
+// capture は st.Capture で指した値をレスポンスから取り出して vars に入れる
+func capture(st *step, body []byte, vars map[string]string) error {
+	if len(st.Capture) == 0 {
+		return nil
+	}
+	// ID を 1.7e+06 のような表記にしないよう、数値は json.Number のまま読む
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("response body is not json: %s", truncate(body))
+	}
+	for name, path := range st.Capture {
+		found, ok := lookupPath(v, strings.Split(path, "."))
+		if !ok {
+			return fmt.Errorf("capture %s: %s is not in the response: %s", name, path, truncate(body))
+		}
+		vars[name] = fmt.Sprint(found)
+	}
+	return nil
+}
+
+// lookupPath は keys で指した値を返す (配列は添字で指す)
+func lookupPath(v interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = t[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func compare(st *step, status int, body []byte) error {
+	if status != st.Response.Status {
+		return fmt.Errorf("status: want %d, got %d (body: %s)", st.Response.Status, status, truncate(body))
+	}
+	if len(st.Response.Body) == 0 {
+		return nil
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(st.Response.Body, &want); err != nil {
+		return fmt.Errorf("golden body is not json: %w", err)
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		return fmt.Errorf("response body is not json: %s", truncate(body))
+	}
+	for _, path := range st.Ignore {
+		keys := strings.Split(path, ".")
+		removePath(want, keys)
+		removePath(got, keys)
+	}
+	if diff := diffJSON("$", want, got); diff != "" {
+		return fmt.Errorf("body differs at %s", diff)
+	}
+	return nil
+}
+
+// removePath は keys で指したフィールドを消す ("*" は配列の全要素)
+func removePath(v interface{}, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(keys) == 1 {
+			delete(t, keys[0])
+			return
+		}
+		removePath(t[keys[0]], keys[1:])
+	case []interface{}:
+		if keys[0] != "*" {
+			return
+		}
+		for _, e := range t {
+			removePath(e, keys[1:])
+		}
+	}
+}
+
+// diffJSON は最初に見つかった違いの場所と値を返す (違いが無ければ空文字)
+func diffJSON(at string, want, got interface{}) string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: want object, got %s", at, short(got))
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			wv, wok := w[k]
+			gv, gok := g[k]
+			switch {
+			case !wok:
+				return fmt.Sprintf("%s.%s: unexpected field %s", at, k, short(gv))
+			case !gok:
+				return fmt.Sprintf("%s.%s: missing field (want %s)", at, k, short(wv))
+			}
+			if d := diffJSON(at+"."+k, wv, gv); d != "" {
+				return d
+			}
+		}
+		return ""
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: want array, got %s", at, short(got))
+		}
+		if len(w) != len(g) {
+			return fmt.Sprintf("%s: want %d elements, got %d", at, len(w), len(g))
+		}
+		for i := range w {
+			if d := diffJSON(fmt.Sprintf("%s[%d]", at, i), w[i], g[i]); d != "" {
+				return d
+			}
+		}
+		return ""
+	}
+	if !reflect.DeepEqual(want, got) {
+		return fmt.Sprintf("%s: want %s, got %s", at, short(want), short(got))
+	}
+	return ""
+}
+
+func short(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return truncate(b)
+}
+
+func truncate(b []byte) string {
+	const max = 200
+	if len(b) > max {
+		return string(b[:max]) + "..."
+	}
+	return string(b)
+}
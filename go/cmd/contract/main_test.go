@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// golden ファイルを CONTRACT_TARGET のサーバに流す (CONTRACT_RECORD=1 で書き直す)
+//
+//	CONTRACT_TARGET=http://pipe.u.isucon.local:8080 CONTRACT_CONNECT=127.0.0.1:8080 go test ./cmd/contract
+func TestContract(t *testing.T) {
+	target := os.Getenv("CONTRACT_TARGET")
+	if target == "" {
+		t.Skip("CONTRACT_TARGET is not set")
+	}
+	paths, err := goldenFiles("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := os.Getenv("CONTRACT_RECORD") == "1"
+	for _, path := range paths {
+		// 後のファイルは /api/initialize の後の状態を前提にしているので、失敗しても順に流し続ける
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			if err := replayFile(context.Background(), newClient(os.Getenv("CONTRACT_CONNECT"), 10*time.Second), target, path, record); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+var varPattern = regexp.MustCompile(`\{\{([^}]+)\}\}`)
+
+// サーバが無くても、golden ファイルが読めて、使う値をその前のステップで capture していることを確かめる
+func TestGoldenFiles(t *testing.T) {
+	paths, err := goldenFiles("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sc scenario
+			if err := json.Unmarshal(raw, &sc); err != nil {
+				t.Fatalf("failed to parse golden file: %v", err)
+			}
+			if i == 0 && (len(sc.Steps) == 0 || sc.Steps[0].Request.Path != "/api/initialize") {
+				t.Error("the first golden file must start with /api/initialize")
+			}
+			captured := map[string]bool{}
+			for j, st := range sc.Steps {
+				if st.Request.Method == "" || st.Request.Path == "" || st.Response.Status == 0 {
+					t.Errorf("step %d: method, path and status are required", j+1)
+				}
+				for _, m := range varPattern.FindAllStringSubmatch(st.Request.Path+string(st.Request.Body), -1) {
+					if !captured[m[1]] {
+						t.Errorf("step %d: {{%s}} is not captured by an earlier step", j+1, m[1])
+					}
+				}
+				if len(st.Capture) > 0 && len(st.Response.Body) == 0 {
+					t.Errorf("step %d: capture needs the response body", j+1)
+				}
+				for name, path := range st.Capture {
+					var body interface{}
+					if err := json.Unmarshal(st.Response.Body, &body); err == nil {
+						if _, ok := lookupPath(body, strings.Split(path, ".")); !ok {
+							t.Errorf("step %d: capture %s: %s is not in the golden body", j+1, name, path)
+						}
+					}
+					captured[name] = true
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureAndExpand(t *testing.T) {
+	st := &step{Capture: map[string]string{"livestream_id": "id", "owner": "owner.name", "first_tag": "tags.0.id"}}
+	vars := map[string]string{}
+	if err := capture(st, []byte(`{"id":1700001,"owner":{"name":"test001"},"tags":[{"id":3}]}`), vars); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expandVars("/api/livestream/{{livestream_id}}/tags/{{first_tag}}?owner={{owner}}", vars), "/api/livestream/1700001/tags/3?owner=test001"; got != want {
+		t.Errorf("expandVars() = %s, want %s", got, want)
+	}
+
+	st = &step{Capture: map[string]string{"missing": "tags.1.id"}}
+	if err := capture(st, []byte(`{"tags":[{"id":3}]}`), map[string]string{}); err == nil {
+		t.Error("capture of a missing path should fail")
+	}
+}
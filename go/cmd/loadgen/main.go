@@ -0,0 +1,374 @@
+// loadgen は公式ベンチマーカーを使わずに最適化の効果を測るための負荷生成ツール
+//
+// 視聴者のポーリング、コメントのバースト、アイコン取得、モデレーションを
+// 重み付きで混ぜたトラフィックを対象ホストに流し、エンドポイントごとの P50/P99 を出力する
+//
+//	go run ./cmd/loadgen -target http://pipe.u.isucon.local:8080 -connect 127.0.0.1:8080 -concurrency 32 -duration 60s
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type scenario struct {
+	name   string
+	weight int
+	run    func(ctx context.Context, w *worker) (string, error)
+}
+
+type livestream struct {
+	ID    int64 `json:"id"`
+	Owner struct {
+		Name string `json:"name"`
+	} `json:"owner"`
+}
+
+type worker struct {
+	client      *http.Client
+	target      string
+	rnd         *rand.Rand
+	livestreams []livestream
+	owned       []livestream
+	usernames   []string
+	recorder    *recorder
+}
+
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		latencies: map[string][]time.Duration{},
+		errors:    map[string]int{},
+	}
+}
+
+func (r *recorder) record(endpoint string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[endpoint] = append(r.latencies[endpoint], d)
+	if err != nil {
+		r.errors[endpoint]++
+	}
+}
+
+func (r *recorder) report(out io.Writer, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	endpoints := make([]string, 0, len(r.latencies))
+	for endpoint := range r.latencies {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	fmt.Fprintf(out, "%-48s %8s %8s %8s %10s %10s %10s\n", "ENDPOINT", "COUNT", "ERRORS", "RPS", "P50", "P99", "MAX")
+	for _, endpoint := range endpoints {
+		ds := r.latencies[endpoint]
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Fprintf(out, "%-48s %8d %8d %8.1f %10s %10s %10s\n",
+			endpoint,
+			len(ds),
+			r.errors[endpoint],
+			float64(len(ds))/elapsed.Seconds(),
+			percentile(ds, 0.50).Round(time.Microsecond),
+			percentile(ds, 0.99).Round(time.Microsecond),
+			ds[len(ds)-1].Round(time.Microsecond),
+		)
+	}
+}
+
+// percentile はソート済みのレイテンシ列から p (0〜1) 分位点を返す
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
+
+func (w *worker) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, w.target+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func (w *worker) randomLivestream() (livestream, bool) {
+	if len(w.livestreams) == 0 {
+		return livestream{}, false
+	}
+	return w.livestreams[w.rnd.Intn(len(w.livestreams))], true
+}
+
+var comments = []string{
+	"こんにちは！",
+	"今日も楽しみにしてました",
+	"すごい！",
+	"888888",
+	"初見です",
+	"wwwwww",
+}
+
+var emojis = []string{"tada", "innocent", "smile", "heart", "+1"}
+
+var scenarios = []scenario{
+	{
+		name:   "viewer polling",
+		weight: 50,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			ls, ok := w.randomLivestream()
+			if !ok {
+				return "", nil
+			}
+			endpoint := "GET /api/livestream/:livestream_id/livecomment"
+			return endpoint, w.do(ctx, http.MethodGet, fmt.Sprintf("/api/livestream/%d/livecomment?limit=50", ls.ID), nil, nil)
+		},
+	},
+	{
+		name:   "reaction polling",
+		weight: 15,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			ls, ok := w.randomLivestream()
+			if !ok {
+				return "", nil
+			}
+			endpoint := "GET /api/livestream/:livestream_id/reaction"
+			return endpoint, w.do(ctx, http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction?limit=50", ls.ID), nil, nil)
+		},
+	},
+	{
+		name:   "comment burst",
+		weight: 15,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			ls, ok := w.randomLivestream()
+			if !ok {
+				return "", nil
+			}
+			endpoint := "POST /api/livestream/:livestream_id/livecomment"
+			// 1回の実行で 1〜5 件続けて投稿する
+			burst := 1 + w.rnd.Intn(5)
+			for i := 0; i < burst; i++ {
+				req := map[string]interface{}{
+					"comment": comments[w.rnd.Intn(len(comments))],
+					"tip":     0,
+				}
+				if w.rnd.Intn(10) == 0 {
+					req["tip"] = 100 * (1 + w.rnd.Intn(50))
+				}
+				start := time.Now()
+				err := w.do(ctx, http.MethodPost, fmt.Sprintf("/api/livestream/%d/livecomment", ls.ID), req, nil)
+				w.recorder.record(endpoint, time.Since(start), err)
+			}
+			return "", nil
+		},
+	},
+	{
+		name:   "reaction",
+		weight: 10,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			ls, ok := w.randomLivestream()
+			if !ok {
+				return "", nil
+			}
+			endpoint := "POST /api/livestream/:livestream_id/reaction"
+			req := map[string]string{"emoji_name": emojis[w.rnd.Intn(len(emojis))]}
+			return endpoint, w.do(ctx, http.MethodPost, fmt.Sprintf("/api/livestream/%d/reaction", ls.ID), req, nil)
+		},
+	},
+	{
+		name:   "icon fetch",
+		weight: 20,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			if len(w.usernames) == 0 {
+				return "", nil
+			}
+			username := w.usernames[w.rnd.Intn(len(w.usernames))]
+			endpoint := "GET /api/user/:username/icon"
+			return endpoint, w.do(ctx, http.MethodGet, "/api/user/"+username+"/icon", nil, nil)
+		},
+	},
+	{
+		name:   "moderation",
+		weight: 2,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			if len(w.owned) == 0 {
+				return "", nil
+			}
+			ls := w.owned[w.rnd.Intn(len(w.owned))]
+			endpoint := "POST /api/livestream/:livestream_id/moderate"
+			req := map[string]string{"ng_word": fmt.Sprintf("loadgen-ng-%d", w.rnd.Int63())}
+			return endpoint, w.do(ctx, http.MethodPost, fmt.Sprintf("/api/livestream/%d/moderate", ls.ID), req, nil)
+		},
+	},
+	{
+		name:   "statistics",
+		weight: 3,
+		run: func(ctx context.Context, w *worker) (string, error) {
+			ls, ok := w.randomLivestream()
+			if !ok {
+				return "", nil
+			}
+			endpoint := "GET /api/livestream/:livestream_id/statistics"
+			return endpoint, w.do(ctx, http.MethodGet, fmt.Sprintf("/api/livestream/%d/statistics", ls.ID), nil, nil)
+		},
+	},
+}
+
+func pickScenario(rnd *rand.Rand) scenario {
+	total := 0
+	for _, s := range scenarios {
+		total += s.weight
+	}
+	n := rnd.Intn(total)
+	for _, s := range scenarios {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+	return scenarios[len(scenarios)-1]
+}
+
+func newClient(connect string, timeout time.Duration) *http.Client {
+	jar, _ := cookiejar.New(nil)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	if connect != "" {
+		// Cookieのドメイン (u.isucon.local) に合わせたホスト名のまま、接続先だけを差し替える
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, connect)
+		}
+	}
+	return &http.Client{
+		Jar:       jar,
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+func setupWorker(ctx context.Context, w *worker, username, password string) error {
+	if err := w.do(ctx, http.MethodPost, "/api/login", map[string]string{
+		"username": username,
+		"password": password,
+	}, nil); err != nil {
+		return fmt.Errorf("failed to login as %s: %w", username, err)
+	}
+
+	if err := w.do(ctx, http.MethodGet, "/api/livestream/search?limit=100", nil, &w.livestreams); err != nil {
+		return fmt.Errorf("failed to list livestreams: %w", err)
+	}
+	if err := w.do(ctx, http.MethodGet, "/api/livestream", nil, &w.owned); err != nil {
+		return fmt.Errorf("failed to list own livestreams: %w", err)
+	}
+
+	seen := map[string]struct{}{}
+	for _, ls := range w.livestreams {
+		if _, ok := seen[ls.Owner.Name]; ok {
+			continue
+		}
+		seen[ls.Owner.Name] = struct{}{}
+		w.usernames = append(w.usernames, ls.Owner.Name)
+	}
+	return nil
+}
+
+func main() {
+	var (
+		target      = flag.String("target", "http://pipe.u.isucon.local:8080", "base URL of the target host")
+		connect     = flag.String("connect", "", "dial this address instead of resolving the target host (e.g. 127.0.0.1:8080)")
+		concurrency = flag.Int("concurrency", 16, "number of concurrent virtual users")
+		duration    = flag.Duration("duration", 30*time.Second, "how long to generate load")
+		timeout     = flag.Duration("timeout", 10*time.Second, "per request timeout")
+		users       = flag.String("users", "test001", "comma separated usernames used to log in (assigned round-robin)")
+		password    = flag.String("password", "test", "password for the users")
+		seed        = flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	)
+	flag.Parse()
+
+	usernames := strings.Split(*users, ",")
+	rec := newRecorder()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		w := &worker{
+			client:   newClient(*connect, *timeout),
+			target:   strings.TrimSuffix(*target, "/"),
+			rnd:      rand.New(rand.NewSource(*seed + int64(i))),
+			recorder: rec,
+		}
+		username := strings.TrimSpace(usernames[i%len(usernames)])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := setupWorker(ctx, w, username, *password); err != nil {
+				log.Printf("worker setup failed: %v", err)
+				return
+			}
+			for ctx.Err() == nil {
+				s := pickScenario(w.rnd)
+				began := time.Now()
+				endpoint, err := s.run(ctx, w)
+				if endpoint == "" || ctx.Err() != nil {
+					continue
+				}
+				rec.record(endpoint, time.Since(began), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rec.report(os.Stdout, time.Since(start))
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	coldStorageEnabledEnvKey      = "ISUCON13_COLD_STORAGE_ENABLED"
+	coldStorageGraceSecondsEnvKey = "ISUCON13_COLD_STORAGE_GRACE_SECONDS"
+
+	defaultColdStorageGrace = 1 * time.Hour
+
+	// cold に移した配信の一覧の読み直しと、移動をこの間隔で行う
+	coldStorageMoverInterval = 5 * time.Second
+	// 一覧を読み直す前の他のサーバが hot を読むので、移してからしばらくは hot にもコピーを残す
+	coldStoragePurgeDelay = 1 * time.Minute
+	// 1回に移す配信の数
+	coldStorageMoveBatchSize = 20
+
+	livecommentsColdTable = "livecomments_cold"
+	reactionsColdTable    = "reactions_cold"
+)
+
+// 終了してから coldStorageGrace 経った配信のコメント・リアクションを cold のテーブルに移し、hot のテーブルのインデックスを小さく保つ
+// 読み書きは livecommentTable / reactionTable が配信に応じたテーブルを返す。デフォルトでは無効
+// 無効に戻すと cold に移した分は見えなくなるので、先に hot へ戻しておくこと
+var (
+	coldStorageEnabled = false
+	coldStorageGrace   = defaultColdStorageGrace
+)
+
+// coldLivestreams は cold に移した配信 (全サーバが coldStorageMoverInterval ごとに読み直す)
+var coldLivestreams = struct {
+	sync.RWMutex
+	ids map[int64]struct{}
+}{
+	ids: map[int64]struct{}{},
+}
+
+func loadColdStorageConfig() error {
+	if v, ok := os.LookupEnv(coldStorageEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", coldStorageEnabledEnvKey, err)
+		}
+		coldStorageEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(coldStorageGraceSecondsEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as non-negative integer: %s", coldStorageGraceSecondsEnvKey, v)
+		}
+		coldStorageGrace = time.Duration(sec) * time.Second
+	}
+	return nil
+}
+
+func isColdLivestream(livestreamID int64) bool {
+	if !coldStorageEnabled {
+		return false
+	}
+	coldLivestreams.RLock()
+	_, ok := coldLivestreams.ids[livestreamID]
+	coldLivestreams.RUnlock()
+	return ok
+}
+
+// reactionTable は配信のリアクションを読むテーブル名を返す (書き込みは insertReaction を使う)
+func reactionTable(livestreamID int64) string {
+	if isColdLivestream(livestreamID) {
+		return reactionsColdTable
+	}
+	return "reactions"
+}
+
+// reactionsAllTable は配信を絞らずにリアクションを引くときのテーブル式を返す (別名を付けて使う)
+func reactionsAllTable() string {
+	return hotColdUnion([]string{"reactions"}, reactionsColdTable)
+}
+
+// hotColdUnion は hot と cold のテーブルをまとめたテーブル式を返す
+// hot に残っているコピーを二重に数えないよう、cold に移した配信の分は hot から除く
+func hotColdUnion(hotTables []string, coldTable string) string {
+	if !coldStorageEnabled {
+		if len(hotTables) == 1 {
+			return hotTables[0]
+		}
+		selects := make([]string, len(hotTables))
+		for i, table := range hotTables {
+			selects[i] = "SELECT * FROM " + table
+		}
+		return "(" + strings.Join(selects, " UNION ALL ") + ")"
+	}
+
+	selects := make([]string, 0, len(hotTables)+1)
+	for _, table := range hotTables {
+		selects = append(selects, "SELECT * FROM "+table+" h WHERE NOT EXISTS (SELECT 1 FROM cold_livestreams c WHERE c.livestream_id = h.livestream_id)")
+	}
+	selects = append(selects, "SELECT * FROM "+coldTable)
+	return "(" + strings.Join(selects, " UNION ALL ") + ")"
+}
+
+// insertReaction はリアクションを書き込み、m.ID に ID を入れる
+// ID は hot のテーブルの AUTO_INCREMENT で払い出すので、cold に移した配信の分は書いてから移す
+func insertReaction(ctx context.Context, tx *sqlx.Tx, m *ReactionModel) error {
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", m)
+	if err != nil {
+		return err
+	}
+	if m.ID, err = rs.LastInsertId(); err != nil {
+		return err
+	}
+	if isColdLivestream(m.LivestreamID) {
+		return moveLateRowsToCold(ctx, tx, m.LivestreamID)
+	}
+	return nil
+}
+
+// insertReactions はリアクションをまとめて書き込む (ID は返さない)
+func insertReactions(ctx context.Context, tx *sqlx.Tx, ms []ReactionModel) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", ms); err != nil {
+		return err
+	}
+	moved := map[int64]bool{}
+	for _, m := range ms {
+		if !moved[m.LivestreamID] && isColdLivestream(m.LivestreamID) {
+			if err := moveLateRowsToCold(ctx, tx, m.LivestreamID); err != nil {
+				return err
+			}
+			moved[m.LivestreamID] = true
+		}
+	}
+	return nil
+}
+
+func refreshColdLivestreams(ctx context.Context) error {
+	var ids []int64
+	if err := dbConn.SelectContext(ctx, &ids, "SELECT livestream_id FROM cold_livestreams"); err != nil {
+		return err
+	}
+	m := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		m[id] = struct{}{}
+	}
+	coldLivestreams.Lock()
+	coldLivestreams.ids = m
+	coldLivestreams.Unlock()
+	return nil
+}
+
+// resetColdLivestreams は初期化で cold のテーブルを空にしたときに呼ぶ
+func resetColdLivestreams() {
+	coldLivestreams.Lock()
+	coldLivestreams.ids = map[int64]struct{}{}
+	coldLivestreams.Unlock()
+}
+
+func runColdStorageMover(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(coldStorageMoverInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := refreshColdLivestreams(ctx); err != nil {
+			logger.Warnf("failed to refresh cold livestreams: %v", err)
+			continue
+		}
+		if err := moveFinishedLivestreams(ctx); err != nil {
+			logger.Warnf("failed to move finished livestreams to cold storage: %v", err)
+		}
+		if err := purgeMovedLivestreams(ctx); err != nil {
+			logger.Warnf("failed to purge moved livestreams from hot storage: %v", err)
+		}
+	}
+}
+
+// moveFinishedLivestreams は終了してから coldStorageGrace 経った配信を cold にコピーする
+// hot の分は coldStoragePurgeDelay 経ってから purgeMovedLivestreams で消す
+func moveFinishedLivestreams(ctx context.Context) error {
+	var ids []int64
+	if err := dbConn.SelectContext(ctx, &ids, `
+		SELECT l.id FROM livestreams l
+		WHERE l.end_at < ? AND NOT EXISTS (SELECT 1 FROM cold_livestreams c WHERE c.livestream_id = l.id)
+		ORDER BY l.end_at
+		LIMIT ?`, clock.Now().Add(-coldStorageGrace).Unix(), coldStorageMoveBatchSize); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			hot := livecommentHotTable(id)
+			var lastLivecommentID, lastReactionID int64
+			if err := tx.GetContext(ctx, &lastLivecommentID, "SELECT IFNULL(MAX(id), 0) FROM "+hot+" WHERE livestream_id = ?", id); err != nil {
+				return err
+			}
+			if err := tx.GetContext(ctx, &lastReactionID, "SELECT IFNULL(MAX(id), 0) FROM reactions WHERE livestream_id = ?", id); err != nil {
+				return err
+			}
+
+			// 複数のサーバで同時に動くので、印を付けられたサーバだけが移す
+			rs, err := tx.ExecContext(ctx, "INSERT IGNORE INTO cold_livestreams (livestream_id, last_livecomment_id, last_reaction_id, moved_at) VALUES (?, ?, ?, ?)", id, lastLivecommentID, lastReactionID, clock.Now().Unix())
+			if err != nil {
+				return err
+			}
+			if n, err := rs.RowsAffected(); err != nil || n == 0 {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, "INSERT INTO "+livecommentsColdTable+" SELECT * FROM "+hot+" WHERE livestream_id = ? AND id <= ?", id, lastLivecommentID); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO "+reactionsColdTable+" SELECT * FROM reactions WHERE livestream_id = ? AND id <= ?", id, lastReactionID)
+			return err
+		}); err != nil {
+			return fmt.Errorf("livestream %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// purgeMovedLivestreams は全サーバが cold を読むようになった配信について、hot に残したコピーを消す
+func purgeMovedLivestreams(ctx context.Context) error {
+	var ids []int64
+	if err := dbConn.SelectContext(ctx, &ids, "SELECT livestream_id FROM cold_livestreams WHERE purged_at IS NULL AND moved_at < ? ORDER BY moved_at LIMIT ?", clock.Now().Add(-coldStoragePurgeDelay).Unix(), coldStorageMoveBatchSize); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			// 一覧を読み直す前のサーバが hot に書いた分を先に移す
+			if err := moveLateRowsToCold(ctx, tx, id); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+livecommentHotTable(id)+" WHERE livestream_id = ?", id); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE livestream_id = ?", id); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "UPDATE cold_livestreams SET purged_at = ? WHERE livestream_id = ?", clock.Now().Unix(), id)
+			return err
+		}); err != nil {
+			return fmt.Errorf("livestream %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// moveLateRowsToCold は cold に移した後で hot に書かれたコメント・リアクションを cold に移す
+func moveLateRowsToCold(ctx context.Context, tx *sqlx.Tx, livestreamID int64) error {
+	var last struct {
+		LivecommentID int64 `db:"last_livecomment_id"`
+		ReactionID    int64 `db:"last_reaction_id"`
+	}
+	if err := tx.GetContext(ctx, &last, "SELECT last_livecomment_id, last_reaction_id FROM cold_livestreams WHERE livestream_id = ?", livestreamID); err != nil {
+		return err
+	}
+
+	hot := livecommentHotTable(livestreamID)
+	moves := []struct {
+		hot, cold string
+		lastID    int64
+	}{
+		{hot, livecommentsColdTable, last.LivecommentID},
+		{"reactions", reactionsColdTable, last.ReactionID},
+	}
+	for _, m := range moves {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+m.cold+" SELECT * FROM "+m.hot+" WHERE livestream_id = ? AND id > ?", livestreamID, m.lastID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+m.hot+" WHERE livestream_id = ? AND id > ?", livestreamID, m.lastID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
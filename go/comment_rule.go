@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livecommentReasonTooLong   = "too_long"
+	livecommentReasonEmojiOnly = "emoji_only"
+	livecommentReasonLink      = "link"
+	livecommentReasonCaps      = "caps"
+
+	maxLivecommentRuleLength = 10000
+	// 大文字の割合は、大文字・小文字のある文字がこれだけ無いコメントには適用しない ("GG" などを弾かないため)
+	minCapsRuleLetters = 8
+)
+
+type LivecommentRulesModel struct {
+	LivestreamID   int64 `db:"livestream_id"`
+	MaxLength      int64 `db:"max_length"`
+	BlockEmojiOnly bool  `db:"block_emoji_only"`
+	BlockLinks     bool  `db:"block_links"`
+	MaxCapsPercent int64 `db:"max_caps_percent"`
+	MembersOnly    bool  `db:"members_only"`
+	UpdatedAt      int64 `db:"updated_at"`
+}
+
+// LivecommentRules は配信ごとのコメントの内容ルール (0 はその項目を制限しない)
+type LivecommentRules struct {
+	// 文字数 (コードポイント数) の上限
+	MaxLength int64 `json:"max_length"`
+	// 絵文字だけのコメントを拒否する
+	BlockEmojiOnly bool `json:"block_emoji_only"`
+	// URL を含むコメントを拒否する
+	BlockLinks bool `json:"block_links"`
+	// 英字のうち大文字が占める割合 (%) の上限
+	MaxCapsPercent int64 `json:"max_caps_percent"`
+	// チャンネルのメンバー (とVIP) だけがコメントできる
+	MembersOnly bool `json:"members_only"`
+}
+
+// livecommentRuleViolation はルールに違反したときの理由とメッセージ
+type livecommentRuleViolation struct {
+	Reason  string
+	Message string
+}
+
+// evaluateLivecommentRules はコメントが違反しているルールを返す (違反していなければ nil)
+// DB を引かない純粋な関数にしておく
+func evaluateLivecommentRules(rules LivecommentRules, comment string) *livecommentRuleViolation {
+	if rules.MaxLength > 0 && int64(utf8.RuneCountInString(comment)) > rules.MaxLength {
+		return &livecommentRuleViolation{Reason: livecommentReasonTooLong, Message: "comment is longer than " + strconv.FormatInt(rules.MaxLength, 10) + " characters"}
+	}
+	if rules.BlockEmojiOnly && isEmojiOnly(comment) {
+		return &livecommentRuleViolation{Reason: livecommentReasonEmojiOnly, Message: "emoji-only comments are not allowed on this livestream"}
+	}
+	if rules.BlockLinks && containsLink(comment) {
+		return &livecommentRuleViolation{Reason: livecommentReasonLink, Message: "links are not allowed on this livestream"}
+	}
+	if rules.MaxCapsPercent > 0 && rules.MaxCapsPercent < 100 {
+		var upper, cased int64
+		for _, r := range comment {
+			if unicode.IsUpper(r) {
+				upper++
+				cased++
+			} else if unicode.IsLower(r) {
+				cased++
+			}
+		}
+		if cased >= minCapsRuleLetters && upper*100 > rules.MaxCapsPercent*cased {
+			return &livecommentRuleViolation{Reason: livecommentReasonCaps, Message: "too many capital letters"}
+		}
+	}
+	return nil
+}
+
+// isEmojiOnly は空白を除くと絵文字 (と、その修飾に使う文字) だけのコメントかを返す
+func isEmojiOnly(comment string) bool {
+	var emoji bool
+	for _, r := range comment {
+		switch {
+		case unicode.IsSpace(r):
+		case r == 0x200D, r == 0xFE0E, r == 0xFE0F, r == 0x20E3:
+			// ZWJ・異体字セレクタ・キーキャップ
+		case r >= 0x1F3FB && r <= 0x1F3FF, r >= 0xE0020 && r <= 0xE007F:
+			// 肌の色・タグ (地域の旗)
+		case unicode.Is(unicode.So, r):
+			emoji = true
+		default:
+			return false
+		}
+	}
+	return emoji
+}
+
+func containsLink(comment string) bool {
+	lower := strings.ToLower(comment)
+	return strings.Contains(lower, "http://") || strings.Contains(lower, "https://") || strings.Contains(lower, "www.")
+}
+
+func fetchLivecommentRules(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (LivecommentRules, error) {
+	var m LivecommentRulesModel
+	if err := tx.GetContext(ctx, &m, "SELECT * FROM livestream_comment_rules WHERE livestream_id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivecommentRules{}, nil
+		}
+		return LivecommentRules{}, err
+	}
+	return LivecommentRules{
+		MaxLength:      m.MaxLength,
+		BlockEmojiOnly: m.BlockEmojiOnly,
+		BlockLinks:     m.BlockLinks,
+		MaxCapsPercent: m.MaxCapsPercent,
+		MembersOnly:    m.MembersOnly,
+	}, nil
+}
+
+// checkLivecommentRules は配信のルールに違反したコメントを拒否する
+// 配信者本人は対象外
+func checkLivecommentRules(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64, comment string) error {
+	if livestreamModel.UserID == userID {
+		return nil
+	}
+	rules, err := fetchLivecommentRules(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get comment rules: "+err.Error()).SetInternal(err)
+	}
+	if rules.MembersOnly {
+		if err := checkMembersOnlyLivecomment(ctx, tx, livestreamModel, userID); err != nil {
+			return err
+		}
+	}
+	if v := evaluateLivecommentRules(rules, comment); v != nil {
+		return newReasonedError(http.StatusBadRequest, v.Reason, v.Message)
+	}
+	return nil
+}
+
+// 配信のコメントルール取得API
+// GET /api/livestream/:livestream_id/comment_rules
+// 投稿前にクライアントで確認できるよう、視聴者も取得できる
+func getLivecommentRulesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var rules LivecommentRules
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rules, err = fetchLivecommentRules(ctx, tx, livestreamID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get comment rules: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, rules)
+}
+
+// 配信のコメントルール設定API (配信者向け)
+// PUT /api/livestream/:livestream_id/comment_rules
+func putLivecommentRulesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req LivecommentRules
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.MaxLength < 0 || req.MaxLength > maxLivecommentRuleLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_length must be between 0 and "+strconv.Itoa(maxLivecommentRuleLength))
+	}
+	if req.MaxCapsPercent < 0 || req.MaxCapsPercent > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_caps_percent must be between 0 and 100")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m := LivecommentRulesModel{
+			LivestreamID:   livestreamID,
+			MaxLength:      req.MaxLength,
+			BlockEmojiOnly: req.BlockEmojiOnly,
+			BlockLinks:     req.BlockLinks,
+			MaxCapsPercent: req.MaxCapsPercent,
+			MembersOnly:    req.MembersOnly,
+			UpdatedAt:      clock.Now().Unix(),
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_comment_rules (livestream_id, max_length, block_emoji_only, block_links, max_caps_percent, members_only, updated_at) VALUES (:livestream_id, :max_length, :block_emoji_only, :block_links, :max_caps_percent, :members_only, :updated_at) ON DUPLICATE KEY UPDATE max_length = VALUES(max_length), block_emoji_only = VALUES(block_emoji_only), block_links = VALUES(block_links), max_caps_percent = VALUES(max_caps_percent), members_only = VALUES(members_only), updated_at = VALUES(updated_at)", m); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update comment rules: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluateLivecommentRules(t *testing.T) {
+	all := LivecommentRules{MaxLength: 20, BlockEmojiOnly: true, BlockLinks: true, MaxCapsPercent: 50}
+	tests := []struct {
+		name    string
+		rules   LivecommentRules
+		comment string
+		// 違反しない場合は空
+		want string
+	}{
+		{name: "no rules", rules: LivecommentRules{}, comment: "HTTPS://EXAMPLE.COM 🎉🎉🎉 " + strings.Repeat("あ", 100)},
+		{name: "no match", rules: all, comment: "こんにちは、楽しみです"},
+
+		{name: "max length exactly", rules: LivecommentRules{MaxLength: 5}, comment: "あいうえお"},
+		{name: "too long counts runes", rules: LivecommentRules{MaxLength: 5}, comment: "あいうえおか", want: livecommentReasonTooLong},
+
+		{name: "emoji only", rules: LivecommentRules{BlockEmojiOnly: true}, comment: "🎉 👍🏽 ❤️", want: livecommentReasonEmojiOnly},
+		{name: "emoji only with zwj", rules: LivecommentRules{BlockEmojiOnly: true}, comment: "👨‍👩‍👧", want: livecommentReasonEmojiOnly},
+		{name: "emoji with text", rules: LivecommentRules{BlockEmojiOnly: true}, comment: "最高 🎉"},
+		{name: "blank", rules: LivecommentRules{BlockEmojiOnly: true}, comment: "   "},
+
+		{name: "link", rules: LivecommentRules{BlockLinks: true}, comment: "見てね https://example.com", want: livecommentReasonLink},
+		{name: "link case insensitive", rules: LivecommentRules{BlockLinks: true}, comment: "WWW.EXAMPLE.COM", want: livecommentReasonLink},
+		{name: "no link", rules: LivecommentRules{BlockLinks: true}, comment: "example dot com"},
+
+		{name: "caps", rules: LivecommentRules{MaxCapsPercent: 50}, comment: "THIS IS GREAT", want: livecommentReasonCaps},
+		{name: "caps at limit", rules: LivecommentRules{MaxCapsPercent: 50}, comment: "ABCDefgh"},
+		{name: "caps short comment", rules: LivecommentRules{MaxCapsPercent: 50}, comment: "GG WP"},
+		{name: "caps 100 percent is unlimited", rules: LivecommentRules{MaxCapsPercent: 100}, comment: "THIS IS GREAT"},
+
+		// 複数のルールに違反した場合は 文字数 → 絵文字 → URL → 大文字 の順で最初のものを返す
+		{name: "too long before link", rules: all, comment: "https://example.com/" + strings.Repeat("a", 20), want: livecommentReasonTooLong},
+		{name: "emoji before caps", rules: all, comment: "🎉🎉🎉", want: livecommentReasonEmojiOnly},
+		{name: "link before caps", rules: all, comment: "WWW.EXAMPLE.COM", want: livecommentReasonLink},
+		{name: "caps when others pass", rules: all, comment: "AMAZING STREAM", want: livecommentReasonCaps},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := evaluateLivecommentRules(tt.rules, tt.comment)
+			if tt.want == "" {
+				if v != nil {
+					t.Errorf("evaluateLivecommentRules() = %s, want no violation", v.Reason)
+				}
+				return
+			}
+			if v == nil {
+				t.Fatalf("evaluateLivecommentRules() = nil, want %s", tt.want)
+			}
+			if v.Reason != tt.want {
+				t.Errorf("evaluateLivecommentRules() = %s, want %s", v.Reason, tt.want)
+			}
+			if v.Message == "" {
+				t.Error("violation has no message")
+			}
+		})
+	}
+}
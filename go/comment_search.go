@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	commentSearchEnabledEnvKey = "ISUCON13_COMMENT_SEARCH_ENABLED"
+
+	// ngram のトークン長 (ngram_token_size のデフォルト) より短い語は FULLTEXT で引けない
+	minCommentSearchQueryLength = 2
+	maxCommentSearchQueryLength = 100
+
+	// FULLTEXT インデックスが無い (パーティション分割したテーブル・初期化の後に作ったシャードなど)
+	mysqlErrFTMatchingKeyNotFound = 1191
+)
+
+// 配信者が自分の配信のコメントを検索できるようにするか
+// livecomments の FULLTEXT インデックスはコメントの投稿ごとに更新が掛かるので、デフォルトでは無効
+// 有効にすると init.sh が sql/comment_search.sql でインデックスを張る (init.sh と同じ環境変数を見る)
+var commentSearchEnabled = false
+
+func loadCommentSearchConfig() error {
+	if v, ok := os.LookupEnv(commentSearchEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", commentSearchEnabledEnvKey, err)
+		}
+		commentSearchEnabled = enabled
+	}
+	return nil
+}
+
+// commentSearchColumns は LivecommentModel の列 (退避先には archived_at があるので * にしない)
+const commentSearchColumns = "lc.id, lc.user_id, lc.livestream_id, lc.comment, lc.tip, lc.comment_type, lc.created_at"
+
+// commentSearchTables は自分の配信のコメントが入りうるテーブルを返す
+// hot (シャード分割していれば全シャード)・cold・退避先をそれぞれ FULLTEXT で引いて、あとでまとめる
+func commentSearchTables() []string {
+	tables := []string{"livecomments"}
+	if livecommentShards > 0 {
+		tables = make([]string, livecommentShards)
+		for i := range tables {
+			tables[i] = livecommentShardTable(i)
+		}
+	}
+	return append(tables, livecommentsColdTable, "livecomments_archive")
+}
+
+// commentSearchPhrase は BOOLEAN MODE で q をひと続きの語句として探す検索式を返す
+// ngram では語句の検索が部分一致に近い振る舞いになる
+func commentSearchPhrase(q string) string {
+	return `"` + strings.ReplaceAll(q, `"`, " ") + `"`
+}
+
+// commentSearchLikePattern は FULLTEXT インデックスが無いテーブルで使う LIKE のパターンを返す
+func commentSearchLikePattern(q string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + r.Replace(q) + "%"
+}
+
+func isFTMatchingKeyNotFoundError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrFTMatchingKeyNotFound
+}
+
+// searchOwnedComments はテーブルごとに自分の配信のコメントから q を探し、id の降順で返す
+// ページングは各テーブルから limit+1 件ずつ取ってまとめ、全体で limit+1 件に切る
+// cold へ移している途中のコメントは hot と cold の両方に見えるので id で重複を除く
+func searchOwnedComments(ctx context.Context, tx *sqlx.Tx, userID int64, q string, p listParams) ([]LivecommentModel, error) {
+	phrase, like := commentSearchPhrase(q), commentSearchLikePattern(q)
+
+	seen := map[int64]struct{}{}
+	var models []LivecommentModel
+	for _, table := range commentSearchTables() {
+		selectComments := func(cond string, arg interface{}) ([]LivecommentModel, error) {
+			sq := newSelectQuery("SELECT "+commentSearchColumns+" FROM "+table+" lc INNER JOIN livestreams l ON l.id = lc.livestream_id").
+				Where("l.user_id = ?", userID).
+				Where(cond, arg)
+			p.apply(sq, "lc.id")
+			query, args := sq.Build()
+			var found []LivecommentModel
+			err := tx.SelectContext(ctx, &found, query, args...)
+			return found, err
+		}
+		found, err := selectComments("MATCH(lc.comment) AGAINST(? IN BOOLEAN MODE)", phrase)
+		if isFTMatchingKeyNotFoundError(err) {
+			found, err = selectComments("lc.comment LIKE ?", like)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range found {
+			if _, ok := seen[m.ID]; ok {
+				continue
+			}
+			seen[m.ID] = struct{}{}
+			models = append(models, m)
+		}
+	}
+
+	sort.Slice(models, func(i, j int) bool { return models[i].ID > models[j].ID })
+	if int64(len(models)) > p.Limit+1 {
+		models = models[:p.Limit+1]
+	}
+	return models, nil
+}
+
+// countOwnedComments は with_total のためにテーブルごとの件数を足し合わせる
+// cold へ移している途中のコメントは二重に数えることがある
+func countOwnedComments(ctx context.Context, tx *sqlx.Tx, userID int64, q string) (int64, error) {
+	phrase, like := commentSearchPhrase(q), commentSearchLikePattern(q)
+
+	var total int64
+	for _, table := range commentSearchTables() {
+		base := "SELECT COUNT(*) FROM " + table + " lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE l.user_id = ?"
+		var n int64
+		err := tx.GetContext(ctx, &n, base+" AND MATCH(lc.comment) AGAINST(? IN BOOLEAN MODE)", userID, phrase)
+		if isFTMatchingKeyNotFoundError(err) {
+			err = tx.GetContext(ctx, &n, base+" AND lc.comment LIKE ?", userID, like)
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// 自分の配信のコメント検索API
+// GET /api/user/me/comments/search?q=&limit=&cursor=&with_total=
+// 終了して cold に移した配信や、保持上限を超えて退避したコメントも含めて探す
+func searchMyCommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	if !commentSearchEnabled {
+		return echo.NewHTTPError(http.StatusNotFound, "comment search is disabled")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if n := utf8.RuneCountInString(q); n < minCommentSearchQueryLength || n > maxCommentSearchQueryLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter must be 2 to 100 characters")
+	}
+	p, err := parseListParams(c)
+	if err != nil {
+		return err
+	}
+
+	res := ListResponse{Items: []Livecomment{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		livecommentModels, err := searchOwnedComments(ctx, tx, userID, q, p)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to search livecomments: "+err.Error()).SetInternal(err)
+		}
+		n, next := p.page(len(livecommentModels), func(i int) int64 { return livecommentModels[i].ID })
+		livecomments, err := fillLivecommentResponses(ctx, tx, livecommentModels[:n])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error()).SetInternal(err)
+		}
+		res.Items, res.NextCursor = livecomments, next
+
+		if p.WithTotal {
+			total, err := countOwnedComments(ctx, tx, userID, q)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error()).SetInternal(err)
+			}
+			res.Total = &total
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
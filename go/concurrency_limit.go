@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	concurrencyLimitsEnabledEnvKey = "ISUCON13_CONCURRENCY_LIMITS_ENABLED"
+	// "stats:50,livecomment_post:200" の形式でグループごとの同時実行数を上書きする
+	concurrencyLimitsEnvKey = "ISUCON13_CONCURRENCY_LIMITS"
+
+	// 上限に達したときに待てる時間
+	concurrencyQueueTimeout = 500 * time.Millisecond
+)
+
+// ルートグループごとの同時実行数の上限
+// 上限を超えたリクエストは 503 になりベンチマークが失敗しうるので、デフォルトでは無効
+var concurrencyLimitsEnabled = false
+
+type concurrencyLimitGroup struct {
+	Name string
+	// 同時に処理するリクエスト数
+	Max int
+	// 空きを待てるリクエスト数 (これを超えたら待たずに 503)
+	Queue int
+	// echo のルート定義と同じ形式 (c.Path() と比較する)
+	Routes []string
+
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+// concurrencyLimitGroups はMySQLへの負荷が大きいルートのグループ
+var concurrencyLimitGroups = []*concurrencyLimitGroup{
+	{
+		Name:  "stats",
+		Max:   50,
+		Queue: 50,
+		Routes: []string{
+			http.MethodGet + " /api/user/:username/statistics",
+			http.MethodGet + " /api/livestream/:livestream_id/statistics",
+		},
+	},
+	{
+		Name:  "livecomment_post",
+		Max:   200,
+		Queue: 100,
+		Routes: []string{
+			http.MethodPost + " /api/livestream/:livestream_id/livecomment",
+		},
+	},
+	{
+		Name:  "search",
+		Max:   100,
+		Queue: 100,
+		Routes: []string{
+			http.MethodGet + " /api/livestream/search",
+			http.MethodGet + " /api/v2/livestream/search",
+		},
+	},
+}
+
+var concurrencyLimitIndex = map[string]*concurrencyLimitGroup{}
+
+func loadConcurrencyLimitConfig() error {
+	if v, ok := os.LookupEnv(concurrencyLimitsEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", concurrencyLimitsEnabledEnvKey, err)
+		}
+		concurrencyLimitsEnabled = enabled
+	}
+
+	byName := make(map[string]*concurrencyLimitGroup, len(concurrencyLimitGroups))
+	for _, g := range concurrencyLimitGroups {
+		byName[g.Name] = g
+	}
+	if v, ok := os.LookupEnv(concurrencyLimitsEnvKey); ok {
+		for _, item := range splitCommaList(v) {
+			name, max, ok := strings.Cut(item, ":")
+			g, known := byName[name]
+			if !ok || !known {
+				return fmt.Errorf("failed to parse environment variable '%s': %q must be <group>:<max>", concurrencyLimitsEnvKey, item)
+			}
+			n, err := strconv.Atoi(max)
+			if err != nil || n < 1 {
+				return fmt.Errorf("failed to parse environment variable '%s': max of %s must be positive integer", concurrencyLimitsEnvKey, name)
+			}
+			g.Max = n
+		}
+	}
+
+	for _, g := range concurrencyLimitGroups {
+		g.slots = make(chan struct{}, g.Max)
+		for _, route := range g.Routes {
+			concurrencyLimitIndex[route] = g
+		}
+	}
+	return nil
+}
+
+// acquire は空きを待って枠を取る (取れなければ false)
+func (g *concurrencyLimitGroup) acquire(c echo.Context) bool {
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if g.waiting.Add(1) > int64(g.Queue) {
+		g.waiting.Add(-1)
+		return false
+	}
+	defer g.waiting.Add(-1)
+
+	timer := time.NewTimer(concurrencyQueueTimeout)
+	defer timer.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-c.Request().Context().Done():
+		return false
+	}
+}
+
+func (g *concurrencyLimitGroup) release() {
+	<-g.slots
+}
+
+// concurrencyLimitMiddleware はルートグループごとに同時実行数を制限する
+// 上限に達していれば少しだけ待ち、それでも空かなければ 503 を返す
+func concurrencyLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !concurrencyLimitsEnabled {
+			return next(c)
+		}
+		g, ok := concurrencyLimitIndex[c.Request().Method+" "+c.Path()]
+		if !ok {
+			return next(c)
+		}
+
+		if !g.acquire(c) {
+			c.Response().Header().Set("Retry-After", "1")
+			return newReasonedError(http.StatusServiceUnavailable, "concurrency_limited", "too many concurrent requests for "+g.Name)
+		}
+		defer g.release()
+		return next(c)
+	}
+}
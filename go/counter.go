@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	counterBackendEnvKey = "ISUCON13_COUNTER_BACKEND"
+
+	counterBackendMySQL  = "mysql"
+	counterBackendRedis  = "redis"
+	counterBackendMemory = "memory"
+
+	counterReconcileInterval = 5 * time.Minute
+	// 作り直すときに1回の HSET に載せる件数
+	counterHSetBatchSize = 1000
+)
+
+// Counter は配信ごとの件数を数える
+// 実装を差し替えて性能を比べられるよう、ハンドラはこのインターフェース越しに使う
+type Counter interface {
+	// Incr は key の件数に delta を足す (書き込みのコミット後に呼ぶ)
+	Incr(ctx context.Context, key, delta int64) error
+	Get(ctx context.Context, key int64) (int64, error)
+	// Snapshot は0件でない key の件数をすべて返す
+	Snapshot(ctx context.Context) (map[int64]int64, error)
+}
+
+// counterSource は件数の元になる MySQL のクエリ (テーブルが配信によって変わるので関数にしている)
+type counterSource struct {
+	Name string
+	// key を1つ取って件数を返す
+	CountQuery func(key int64) string
+	// key と件数 (cnt) の組を返す
+	SnapshotQuery func() string
+}
+
+var (
+	// 配信ごとの視聴者数 (視聴履歴の件数)
+	livestreamViewersSource = counterSource{
+		Name: "livestream_viewers",
+		CountQuery: func(int64) string {
+			return "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?"
+		},
+		SnapshotQuery: func() string {
+			return "SELECT livestream_id AS `key`, COUNT(*) AS cnt FROM livestream_viewers_history GROUP BY livestream_id"
+		},
+	}
+	// 配信ごとのリアクション数 (いいねもリアクションの1つとして数える)
+	livestreamReactionsSource = counterSource{
+		Name: "livestream_reactions",
+		CountQuery: func(key int64) string {
+			return "SELECT COUNT(*) FROM " + reactionTable(key) + " WHERE livestream_id = ?"
+		},
+		SnapshotQuery: func() string {
+			return "SELECT r.livestream_id AS `key`, COUNT(*) AS cnt FROM " + reactionsAllTable() + " r GROUP BY r.livestream_id"
+		},
+	}
+)
+
+// デフォルトの mysql は毎回元のテーブルを数える (これまでと同じ)
+// redis / memory は件数を別に持ち、起動時と定期的に MySQL から作り直す
+// memory はサーバごとに数えるので、複数台に振り分ける場合は使えない
+var (
+	counterBackend = counterBackendMySQL
+
+	livestreamViewersCounter   Counter
+	livestreamReactionsCounter Counter
+
+	// MySQL から作り直す必要のある (件数を別に持つ) もの
+	materializedCounters []materializedCounter
+)
+
+type materializedCounter struct {
+	Counter interface {
+		Counter
+		reset(ctx context.Context, values map[int64]int64) error
+	}
+	Source counterSource
+}
+
+func loadCounterConfig() error {
+	if v, ok := os.LookupEnv(counterBackendEnvKey); ok && v != "" {
+		counterBackend = v
+	}
+	switch counterBackend {
+	case counterBackendMySQL, counterBackendMemory:
+	case counterBackendRedis:
+		if redisConn == nil {
+			return fmt.Errorf("environment variable '%s' must be provided when '%s' is %s", redisAddrEnvKey, counterBackendEnvKey, counterBackendRedis)
+		}
+	default:
+		return fmt.Errorf("environment variable '%s' must be one of %s, %s or %s", counterBackendEnvKey, counterBackendMySQL, counterBackendRedis, counterBackendMemory)
+	}
+
+	livestreamViewersCounter = newCounter(livestreamViewersSource)
+	livestreamReactionsCounter = newCounter(livestreamReactionsSource)
+	return nil
+}
+
+func newCounter(source counterSource) Counter {
+	var m materializedCounter
+	switch counterBackend {
+	case counterBackendRedis:
+		m = materializedCounter{Counter: &redisCounter{key: "counter:" + source.Name}, Source: source}
+	case counterBackendMemory:
+		m = materializedCounter{Counter: &memoryCounter{values: map[int64]int64{}}, Source: source}
+	default:
+		return mysqlCounter{source: source}
+	}
+	materializedCounters = append(materializedCounters, m)
+	return m.Counter
+}
+
+// incrCounter はコミット済みの書き込みを件数に反映する
+// 失敗しても書き込み自体は成功しているので、作り直しでずれを直す
+func incrCounter(ctx context.Context, logger echo.Logger, counter Counter, key, delta int64) {
+	if delta == 0 {
+		return
+	}
+	if err := counter.Incr(ctx, key, delta); err != nil {
+		logger.Warnf("failed to increment counter: %v", err)
+	}
+}
+
+// mysqlCounter は元のテーブルを毎回数える (Incr では何もしない)
+type mysqlCounter struct {
+	source counterSource
+}
+
+func (c mysqlCounter) Incr(ctx context.Context, key, delta int64) error {
+	return nil
+}
+
+func (c mysqlCounter) Get(ctx context.Context, key int64) (int64, error) {
+	var n int64
+	err := dbConn.GetContext(ctx, &n, c.source.CountQuery(key), key)
+	return n, err
+}
+
+func (c mysqlCounter) Snapshot(ctx context.Context) (map[int64]int64, error) {
+	var rows []struct {
+		Key int64 `db:"key"`
+		Cnt int64 `db:"cnt"`
+	}
+	if err := dbConn.SelectContext(ctx, &rows, c.source.SnapshotQuery()); err != nil {
+		return nil, err
+	}
+	values := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		values[row.Key] = row.Cnt
+	}
+	return values, nil
+}
+
+type memoryCounter struct {
+	mu     sync.RWMutex
+	values map[int64]int64
+}
+
+func (c *memoryCounter) Incr(ctx context.Context, key, delta int64) error {
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCounter) Get(ctx context.Context, key int64) (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.values[key], nil
+}
+
+func (c *memoryCounter) Snapshot(ctx context.Context) (map[int64]int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make(map[int64]int64, len(c.values))
+	for k, v := range c.values {
+		if v != 0 {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+func (c *memoryCounter) reset(ctx context.Context, values map[int64]int64) error {
+	c.mu.Lock()
+	c.values = values
+	c.mu.Unlock()
+	return nil
+}
+
+// redisCounter は件数を1つのハッシュに持つ (field が key)
+type redisCounter struct {
+	key string
+}
+
+func (c *redisCounter) Incr(ctx context.Context, key, delta int64) error {
+	_, err := redisConn.Do(ctx, "HINCRBY", c.key, strconv.FormatInt(key, 10), strconv.FormatInt(delta, 10))
+	return err
+}
+
+func (c *redisCounter) Get(ctx context.Context, key int64) (int64, error) {
+	reply, err := redisConn.Do(ctx, "HGET", c.key, strconv.FormatInt(key, 10))
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected HGET reply")
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (c *redisCounter) Snapshot(ctx context.Context) (map[int64]int64, error) {
+	reply, err := redisConn.Do(ctx, "HGETALL", c.key)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return nil, fmt.Errorf("unexpected HGETALL reply")
+	}
+	values := make(map[int64]int64, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		field, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		k, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if v != 0 {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+// reset は一時キーに書いてから RENAME で差し替える
+func (c *redisCounter) reset(ctx context.Context, values map[int64]int64) error {
+	tmp := c.key + ":rebuild"
+	cmds := [][]string{{"DEL", tmp}}
+	args := []string{"HSET", tmp}
+	for k, v := range values {
+		args = append(args, strconv.FormatInt(k, 10), strconv.FormatInt(v, 10))
+		if len(args) >= 2+counterHSetBatchSize*2 {
+			cmds = append(cmds, args)
+			args = []string{"HSET", tmp}
+		}
+	}
+	if len(args) > 2 {
+		cmds = append(cmds, args)
+	}
+	if len(values) == 0 {
+		cmds = append(cmds, []string{"DEL", c.key})
+	} else {
+		cmds = append(cmds, []string{"RENAME", tmp, c.key})
+	}
+	return execRedisPipeline(ctx, cmds)
+}
+
+// reconcileCounters は MySQL から数え直して redis / memory の件数を置き換える
+// 数え直してから置き換えるまでの間の Incr は失われるが、次の作り直しで直る
+// 最初の作り直しは起動時に済ませておく (それまでは0件に見えるので)
+func reconcileCounters(ctx context.Context) error {
+	for _, m := range materializedCounters {
+		values, err := mysqlCounter{source: m.Source}.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if err := m.Counter.reset(ctx, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCounterReconciler(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(counterReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := reconcileCounters(ctx); err != nil {
+			logger.Warnf("failed to reconcile counters: %v", err)
+		}
+	}
+}
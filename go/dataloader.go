@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type requestLoaderKey struct{}
+
+// requestLoader は1リクエストの間だけユーザ (テーマ・アイコン込み) の取得結果を覚えておく
+// 同じ配信者のコメントが並ぶような一覧で、同じユーザを何度も引かないようにするためのもの
+// リクエストをまたいでは共有しないので、更新との整合性は気にしなくてよい
+type requestLoader struct {
+	mu    sync.Mutex
+	users map[int64]User
+	// チャンネルでの役割 (役割が無い場合は空文字)
+	roles map[channelRoleKey]string
+	// チャンネルのメンバーシップの表示 (メンバーでない場合は空文字)
+	memberFlairs map[channelRoleKey]string
+	// チャンネルのカスタム絵文字 (shortcode ごと)
+	channelEmojis map[channelKey]map[string]ChannelEmojiModel
+}
+
+// requestLoaderMiddleware はリクエストのcontextに requestLoader を仕込む
+func requestLoaderMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		c.SetRequest(req.WithContext(withRequestLoader(req.Context())))
+		return next(c)
+	}
+}
+
+// withRequestLoader は空の requestLoader を持たせた ctx を返す
+func withRequestLoader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestLoaderKey{}, &requestLoader{users: map[int64]User{}, roles: map[channelRoleKey]string{}, memberFlairs: map[channelRoleKey]string{}, channelEmojis: map[channelKey]map[string]ChannelEmojiModel{}})
+}
+
+// loaderFrom は ctx の requestLoader を返す (ミドルウェアを通っていない場合は nil)
+func loaderFrom(ctx context.Context) *requestLoader {
+	l, _ := ctx.Value(requestLoaderKey{}).(*requestLoader)
+	return l
+}
+
+func (l *requestLoader) user(id int64) (User, bool) {
+	if l == nil {
+		return User{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u, ok := l.users[id]
+	return u, ok
+}
+
+func (l *requestLoader) setUser(u User) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.users[u.ID] = u
+	l.mu.Unlock()
+}
+
+func (l *requestLoader) role(key channelRoleKey) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.roles[key]
+	return r, ok
+}
+
+func (l *requestLoader) setRole(key channelRoleKey, role string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.roles[key] = role
+	l.mu.Unlock()
+}
+
+func (l *requestLoader) memberFlair(key channelRoleKey) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.memberFlairs[key]
+	return f, ok
+}
+
+func (l *requestLoader) setMemberFlair(key channelRoleKey, flair string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.memberFlairs[key] = flair
+	l.mu.Unlock()
+}
+
+func (l *requestLoader) channelEmojiSet(key channelKey) (map[string]ChannelEmojiModel, bool) {
+	if l == nil {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	emojis, ok := l.channelEmojis[key]
+	return emojis, ok
+}
+
+func (l *requestLoader) setChannelEmojiSet(key channelKey, emojis map[string]ChannelEmojiModel) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.channelEmojis[key] = emojis
+	l.mu.Unlock()
+}
+
+// primeUsers はまだ読み込んでいないユーザを1クエリでまとめて読み込む
+func (l *requestLoader) primeUsers(ctx context.Context, db sqlx.QueryerContext, ids []int64) error {
+	if l == nil {
+		return nil
+	}
+
+	seen := make(map[int64]struct{}, len(ids))
+	var missing []int64
+	l.mu.Lock()
+	for _, id := range ids {
+		if _, ok := l.users[id]; ok {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		missing = append(missing, id)
+	}
+	l.mu.Unlock()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	users, err := fetchUsersByIDs(ctx, db, missing)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	for id, u := range users {
+		l.users[id] = u
+	}
+	l.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	domainEventsEnabledEnvKey     = "ISUCON13_DOMAIN_EVENTS_ENABLED"
+	domainEventsRedisStreamEnvKey = "ISUCON13_DOMAIN_EVENTS_REDIS_STREAM"
+
+	domainEventCommentPosted  = "CommentPosted"
+	domainEventTipReceived    = "TipReceived"
+	domainEventUserRegistered = "UserRegistered"
+	domainEventStreamStarted  = "StreamStarted"
+
+	domainEventAggregateLivecomment = "livecomment"
+	domainEventAggregateUser        = "user"
+	domainEventAggregateLivestream  = "livestream"
+
+	// 配信開始は書き込みでは起きないので、開始時刻を過ぎた配信を定期的に拾う
+	streamStartScanInterval = 10 * time.Second
+	// これより前に始まった配信は拾い直さない (起動直後に過去の配信を全部流さないため)
+	streamStartLookback = 1 * time.Hour
+
+	domainEventRelayInterval  = 1 * time.Second
+	domainEventRelayBatchSize = 500
+	// id は採番順でコミット順ではないので、少し古くなったものから流す
+	domainEventRelayDelay = 2 * time.Second
+	// Redis stream に残す件数の目安
+	domainEventStreamMaxLen = 100000
+
+	defaultDomainEventsLimit = 100
+)
+
+// ドメインイベントを append-only の events テーブルに書く
+// 書き込みのたびに INSERT が増えるので、デフォルトでは無効
+// ISUCON13_DOMAIN_EVENTS_REDIS_STREAM を指定すると、その名前の Redis stream にも流す
+var (
+	domainEventsEnabled     = false
+	domainEventsRedisStream = ""
+)
+
+func loadDomainEventsConfig() error {
+	if v, ok := os.LookupEnv(domainEventsEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", domainEventsEnabledEnvKey, err)
+		}
+		domainEventsEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(domainEventsRedisStreamEnvKey); ok && v != "" {
+		if redisConn == nil {
+			return fmt.Errorf("environment variable '%s' must be provided when '%s' is set", redisAddrEnvKey, domainEventsRedisStreamEnvKey)
+		}
+		domainEventsRedisStream = v
+	}
+	return nil
+}
+
+type DomainEventModel struct {
+	ID            int64   `db:"id"`
+	EventType     string  `db:"event_type"`
+	AggregateType string  `db:"aggregate_type"`
+	AggregateID   int64   `db:"aggregate_id"`
+	Payload       string  `db:"payload"`
+	DedupeKey     *string `db:"dedupe_key"`
+	CreatedAt     int64   `db:"created_at"`
+}
+
+type DomainEvent struct {
+	ID            int64           `json:"id"`
+	EventType     string          `json:"event_type"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateID   int64           `json:"aggregate_id"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     int64           `json:"created_at"`
+}
+
+type CommentPostedEvent struct {
+	LivecommentID int64  `json:"livecomment_id"`
+	LivestreamID  int64  `json:"livestream_id"`
+	UserID        int64  `json:"user_id"`
+	CommentType   string `json:"comment_type"`
+	Tip           int64  `json:"tip"`
+}
+
+type TipReceivedEvent struct {
+	LivecommentID int64 `json:"livecomment_id"`
+	LivestreamID  int64 `json:"livestream_id"`
+	TipperID      int64 `json:"tipper_id"`
+	StreamerID    int64 `json:"streamer_id"`
+	Tip           int64 `json:"tip"`
+}
+
+// 名前などの個人情報は載せない (匿名化しても events は書き換えないので)
+type UserRegisteredEvent struct {
+	UserID int64 `json:"user_id"`
+}
+
+type StreamStartedEvent struct {
+	LivestreamID int64 `json:"livestream_id"`
+	UserID       int64 `json:"user_id"`
+	StartAt      int64 `json:"start_at"`
+}
+
+// emitDomainEvent はイベントを書く
+// 元の書き込みと同じトランザクションで呼ぶこと (ロールバックされればイベントも残らない)
+func emitDomainEvent(ctx context.Context, tx *sqlx.Tx, eventType, aggregateType string, aggregateID int64, payload interface{}) error {
+	if !domainEventsEnabled {
+		return nil
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO events (event_type, aggregate_type, aggregate_id, payload, created_at) VALUES (?, ?, ?, ?, ?)",
+		eventType, aggregateType, aggregateID, string(encoded), clock.Now().Unix())
+	return err
+}
+
+// emitLivecommentEvents はコメント投稿とチップのイベントを書く
+func emitLivecommentEvents(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel, streamerID int64) error {
+	if err := emitDomainEvent(ctx, tx, domainEventCommentPosted, domainEventAggregateLivecomment, livecommentModel.ID, CommentPostedEvent{
+		LivecommentID: livecommentModel.ID,
+		LivestreamID:  livecommentModel.LivestreamID,
+		UserID:        livecommentModel.UserID,
+		CommentType:   livecommentModel.CommentType,
+		Tip:           livecommentModel.Tip,
+	}); err != nil {
+		return err
+	}
+	if livecommentModel.Tip <= 0 {
+		return nil
+	}
+	return emitDomainEvent(ctx, tx, domainEventTipReceived, domainEventAggregateLivecomment, livecommentModel.ID, TipReceivedEvent{
+		LivecommentID: livecommentModel.ID,
+		LivestreamID:  livecommentModel.LivestreamID,
+		TipperID:      livecommentModel.UserID,
+		StreamerID:    streamerID,
+		Tip:           livecommentModel.Tip,
+	})
+}
+
+func runStreamStartScanner(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(streamStartScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := emitStreamStartedEvents(ctx); err != nil {
+			logger.Warnf("failed to emit stream started events: %v", err)
+		}
+	}
+}
+
+// emitStreamStartedEvents は開始時刻を過ぎた配信の StreamStarted を書く
+// dedupe_key で配信ごとに1回だけにする
+func emitStreamStartedEvents(ctx context.Context) error {
+	now := clock.Now()
+	var livestreams []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreams, `
+		SELECT l.* FROM livestreams l
+		LEFT JOIN events e ON e.dedupe_key = CONCAT('stream_started:', l.id)
+		WHERE l.start_at <= ? AND l.start_at > ? AND e.id IS NULL`,
+		now.Unix(), now.Add(-streamStartLookback).Unix()); err != nil {
+		return err
+	}
+	if len(livestreams) == 0 {
+		return nil
+	}
+
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		for _, l := range livestreams {
+			payload, err := json.Marshal(StreamStartedEvent{LivestreamID: l.ID, UserID: l.UserID, StartAt: l.StartAt})
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO events (event_type, aggregate_type, aggregate_id, payload, dedupe_key, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+				domainEventStreamStarted, domainEventAggregateLivestream, l.ID, string(payload), "stream_started:"+strconv.FormatInt(l.ID, 10), now.Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func domainEventRelayCursorKey() string {
+	return domainEventsRedisStream + ":relay_cursor"
+}
+
+// runDomainEventRelay は events テーブルを id 順に読んで Redis stream に流す
+// どこまで流したかは Redis に持つので、Redis を作り直した場合は最初から流し直す
+func runDomainEventRelay(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(domainEventRelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := relayDomainEvents(ctx); err != nil {
+			logger.Warnf("failed to relay domain events: %v", err)
+		}
+	}
+}
+
+func relayDomainEvents(ctx context.Context) error {
+	var cursor int64
+	reply, err := redisConn.Do(ctx, "GET", domainEventRelayCursorKey())
+	if err != nil {
+		return err
+	}
+	if s, ok := reply.(string); ok {
+		if cursor, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var models []DomainEventModel
+		if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM events WHERE id > ? AND created_at <= ? ORDER BY id LIMIT ?", cursor, clock.Now().Add(-domainEventRelayDelay).Unix(), domainEventRelayBatchSize); err != nil {
+			return err
+		}
+		if len(models) == 0 {
+			return nil
+		}
+
+		cmds := make([][]string, 0, len(models)+1)
+		for _, m := range models {
+			cmds = append(cmds, []string{
+				"XADD", domainEventsRedisStream, "MAXLEN", "~", strconv.Itoa(domainEventStreamMaxLen), "*",
+				"id", strconv.FormatInt(m.ID, 10),
+				"event_type", m.EventType,
+				"aggregate_type", m.AggregateType,
+				"aggregate_id", strconv.FormatInt(m.AggregateID, 10),
+				"payload", m.Payload,
+				"created_at", strconv.FormatInt(m.CreatedAt, 10),
+			})
+		}
+		cursor = models[len(models)-1].ID
+		cmds = append(cmds, []string{"SET", domainEventRelayCursorKey(), strconv.FormatInt(cursor, 10)})
+		if err := execRedisPipeline(ctx, cmds); err != nil {
+			return err
+		}
+		if len(models) < domainEventRelayBatchSize {
+			return nil
+		}
+	}
+}
+
+// ドメインイベントの取得API (管理者向け)
+// GET /api/admin/events?after_id=
+// 利用側は最後に受け取った id を after_id に渡して続きを読む
+func getDomainEventsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM events").
+		OrderBy("id").
+		Limit(defaultDomainEventsLimit)
+	if err := q.WhereInt64Param(c, "after_id", "id > ?"); err != nil {
+		return err
+	}
+	for _, key := range []string{"event_type", "aggregate_type"} {
+		if v := c.QueryParam(key); v != "" {
+			q.Where(key+" = ?", v)
+		}
+	}
+	if err := q.WhereInt64Param(c, "aggregate_id", "aggregate_id = ?"); err != nil {
+		return err
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var models []DomainEventModel
+	if err := dbConn.SelectContext(ctx, &models, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get events: "+err.Error()).SetInternal(err)
+	}
+
+	events := make([]DomainEvent, len(models))
+	for i, m := range models {
+		events[i] = DomainEvent{
+			ID:            m.ID,
+			EventType:     m.EventType,
+			AggregateType: m.AggregateType,
+			AggregateID:   m.AggregateID,
+			Payload:       json.RawMessage(m.Payload),
+			CreatedAt:     m.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	webhookKindDonationGoalCompleted = "donation_goal.completed"
+
+	maxDonationGoalTitleLength = 64
+	maxActiveDonationGoals     = 5
+)
+
+// DonationGoalModel は配信者が決めたチップの目標 (期間中に受け取ったチップを配信をまたいで数える)
+// 削除されたコメントのチップは差し引かない (達成の通知は取り消せないので)
+type DonationGoalModel struct {
+	ID            int64          `db:"id"`
+	UserID        int64          `db:"user_id"`
+	Title         string         `db:"title"`
+	TargetAmount  int64          `db:"target_amount"`
+	CurrentAmount int64          `db:"current_amount"`
+	StartsAt      int64          `db:"starts_at"`
+	EndsAt        int64          `db:"ends_at"`
+	WebhookURL    sql.NullString `db:"webhook_url"`
+	CompletedAt   int64          `db:"completed_at"`
+	CreatedAt     int64          `db:"created_at"`
+}
+
+type DonationGoal struct {
+	ID            int64  `json:"id"`
+	Title         string `json:"title"`
+	TargetAmount  int64  `json:"target_amount"`
+	CurrentAmount int64  `json:"current_amount"`
+	// 0 から 100 (達成後は 100 で止める)
+	ProgressPercent int64 `json:"progress_percent"`
+	StartsAt        int64 `json:"starts_at"`
+	EndsAt          int64 `json:"ends_at"`
+	CompletedAt     int64 `json:"completed_at,omitempty"`
+	// 配信者本人にだけ返す
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+type PostDonationGoalRequest struct {
+	Title        string `json:"title"`
+	TargetAmount int64  `json:"target_amount"`
+	// 省略したら今から
+	StartsAt   int64  `json:"starts_at"`
+	EndsAt     int64  `json:"ends_at"`
+	WebhookURL string `json:"webhook_url"`
+}
+
+// donationGoalCompletedPayload は達成時の webhook の本文
+type donationGoalCompletedPayload struct {
+	GoalID        int64  `json:"goal_id"`
+	Title         string `json:"title"`
+	TargetAmount  int64  `json:"target_amount"`
+	CurrentAmount int64  `json:"current_amount"`
+	LivestreamID  int64  `json:"livestream_id"`
+	CompletedAt   int64  `json:"completed_at"`
+}
+
+// donationGoalWebhook はコミット後に送る達成の webhook
+type donationGoalWebhook struct {
+	url     string
+	payload donationGoalCompletedPayload
+}
+
+func newDonationGoal(m DonationGoalModel, withWebhook bool) DonationGoal {
+	goal := DonationGoal{
+		ID:            m.ID,
+		Title:         m.Title,
+		TargetAmount:  m.TargetAmount,
+		CurrentAmount: m.CurrentAmount,
+		StartsAt:      m.StartsAt,
+		EndsAt:        m.EndsAt,
+		CompletedAt:   m.CompletedAt,
+	}
+	goal.ProgressPercent = m.CurrentAmount * 100 / m.TargetAmount
+	if goal.ProgressPercent > 100 {
+		goal.ProgressPercent = 100
+	}
+	if withWebhook {
+		goal.WebhookURL = m.WebhookURL.String
+	}
+	return goal
+}
+
+// addDonationGoalProgress はチップを配信者の期間中の目標に足し、達成した目標のシステムコメントを書く
+// チップ付きのコメントと同じトランザクションで呼び、返した webhook はコミット後に sendDonationGoalWebhooks で送る
+func addDonationGoalProgress(ctx context.Context, tx *sqlx.Tx, streamerID, livestreamID, tip int64) ([]donationGoalWebhook, error) {
+	if tip <= 0 {
+		return nil, nil
+	}
+	now := clock.Now().Unix()
+	rs, err := tx.ExecContext(ctx, "UPDATE donation_goals SET current_amount = current_amount + ? WHERE user_id = ? AND starts_at <= ? AND ends_at > ?", tip, streamerID, now, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := rs.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+
+	var completed []DonationGoalModel
+	if err := tx.SelectContext(ctx, &completed, "SELECT * FROM donation_goals WHERE user_id = ? AND starts_at <= ? AND ends_at > ? AND completed_at = 0 AND current_amount >= target_amount", streamerID, now, now); err != nil {
+		return nil, err
+	}
+	var webhooks []donationGoalWebhook
+	for _, g := range completed {
+		if _, err := tx.ExecContext(ctx, "UPDATE donation_goals SET completed_at = ? WHERE id = ?", now, g.ID); err != nil {
+			return nil, err
+		}
+		if err := insertServerLivecomment(ctx, tx, livestreamID, streamerID, livecommentTypeSystem, fmt.Sprintf("目標「%s」を達成しました！ (%d / %d)", g.Title, g.CurrentAmount, g.TargetAmount)); err != nil {
+			return nil, err
+		}
+		if g.WebhookURL.Valid {
+			webhooks = append(webhooks, donationGoalWebhook{url: g.WebhookURL.String, payload: donationGoalCompletedPayload{
+				GoalID:        g.ID,
+				Title:         g.Title,
+				TargetAmount:  g.TargetAmount,
+				CurrentAmount: g.CurrentAmount,
+				LivestreamID:  livestreamID,
+				CompletedAt:   now,
+			}})
+		}
+	}
+	return webhooks, nil
+}
+
+// sendDonationGoalWebhooks は達成の webhook を送る (失敗しても再送はしない)
+func sendDonationGoalWebhooks(ctx context.Context, logger echo.Logger, webhooks []donationGoalWebhook) {
+	for _, w := range webhooks {
+		if err := postWebhook(ctx, w.url, webhookKindDonationGoalCompleted, w.payload); err != nil {
+			logger.Warnf("failed to post donation goal webhook: %v", err)
+		}
+	}
+}
+
+// 自分の目標一覧取得API (配信者向け)
+// GET /api/user/me/donation_goals
+func getMyDonationGoalsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var models []DonationGoalModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM donation_goals WHERE user_id = ? ORDER BY ends_at DESC, id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get donation goals: "+err.Error()).SetInternal(err)
+	}
+	goals := make([]DonationGoal, len(models))
+	for i := range models {
+		goals[i] = newDonationGoal(models[i], true)
+	}
+
+	return c.JSON(http.StatusOK, goals)
+}
+
+// 目標の作成API (配信者向け)
+// POST /api/user/me/donation_goals
+func postDonationGoalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PostDonationGoalRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "title must not be empty")
+	}
+	if utf8.RuneCountInString(req.Title) > maxDonationGoalTitleLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "title is too long")
+	}
+	if req.TargetAmount <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "target_amount must be positive")
+	}
+	now := clock.Now().Unix()
+	if req.StartsAt == 0 {
+		req.StartsAt = now
+	}
+	if req.EndsAt <= req.StartsAt || req.EndsAt <= now {
+		return echo.NewHTTPError(http.StatusBadRequest, "ends_at must be after starts_at and now")
+	}
+	webhookURL := sql.NullString{String: req.WebhookURL, Valid: req.WebhookURL != ""}
+	if webhookURL.Valid {
+		u, err := url.Parse(req.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "webhook_url must be http(s) url")
+		}
+	}
+
+	m := DonationGoalModel{
+		UserID:       userID,
+		Title:        req.Title,
+		TargetAmount: req.TargetAmount,
+		StartsAt:     req.StartsAt,
+		EndsAt:       req.EndsAt,
+		WebhookURL:   webhookURL,
+		CreatedAt:    now,
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var count int64
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM donation_goals WHERE user_id = ? AND ends_at > ? FOR UPDATE", userID, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count donation goals: "+err.Error()).SetInternal(err)
+		}
+		if count >= maxActiveDonationGoals {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many donation goals")
+		}
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO donation_goals (user_id, title, target_amount, starts_at, ends_at, webhook_url, created_at) VALUES (:user_id, :title, :target_amount, :starts_at, :ends_at, :webhook_url, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert donation goal: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted donation goal id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newDonationGoal(m, true))
+}
+
+// 目標の削除API (配信者向け)
+// DELETE /api/user/me/donation_goals/:goal_id
+func deleteDonationGoalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	goalID, err := strconv.ParseInt(c.Param("goal_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "goal_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM donation_goals WHERE id = ? AND user_id = ?", goalID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete donation goal: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "donation goal not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信者の期間中の目標の取得API (オーバーレイのウィジェット向け)
+// GET /api/user/:username/donation_goals
+// 配信ソフトのブラウザソースから読むので、ログインは不要
+func getUserDonationGoalsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var userID int64
+	if err := dbConn.GetContext(ctx, &userID, "SELECT id FROM users WHERE name = ?", c.Param("username")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+	}
+
+	now := clock.Now().Unix()
+	var models []DonationGoalModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM donation_goals WHERE user_id = ? AND starts_at <= ? AND ends_at > ? ORDER BY ends_at, id", userID, now, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get donation goals: "+err.Error()).SetInternal(err)
+	}
+	goals := make([]DonationGoal, len(models))
+	for i := range models {
+		goals[i] = newDonationGoal(models[i], false)
+	}
+
+	return c.JSON(http.StatusOK, goals)
+}
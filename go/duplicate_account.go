@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	duplicateAccountDetectionEnabledEnvKey = "ISUCON13_DUPLICATE_ACCOUNT_DETECTION_ENABLED"
+
+	duplicateAccountDetectorInterval = 10 * time.Minute
+	// これより多くのユーザが同じ値を持つ場合は、共有の回線や定番のアイコンとみなして候補にしない
+	maxDuplicateAccountGroupSize = 5
+	// 数字や記号を除いたユーザ名がこれより短い場合は比べない ("a1" と "a2" などを拾わないため)
+	minDuplicateAccountNameLength = 4
+
+	duplicateAccountStatusOpen      = "open"
+	duplicateAccountStatusDismissed = "dismissed"
+
+	auditActionDuplicateAccountDismiss = "duplicate_account.dismiss"
+	auditTargetDuplicateAccount        = "duplicate_account_candidate"
+)
+
+// 別アカウント (サブ垢) の候補の検出
+// 全ユーザのアイコンと名前を読むので、デフォルトでは無効
+// 登録元のIPは登録の連投検知 (ISUCON13_REGISTRATION_ABUSE_ENABLED) が有効な間に記録されたものだけを使う
+var duplicateAccountDetectionEnabled = false
+
+// DuplicateAccountCandidateModel は同一人物かもしれないユーザの組 (user_id < other_user_id)
+// 一致した信号は一度立ったら落とさない (解除済みの組は再び開かない)
+type DuplicateAccountCandidateModel struct {
+	ID          int64  `db:"id"`
+	UserID      int64  `db:"user_id"`
+	OtherUserID int64  `db:"other_user_id"`
+	IPOverlap   bool   `db:"ip_overlap"`
+	IconMatch   bool   `db:"icon_match"`
+	NameSimilar bool   `db:"name_similar"`
+	Score       int64  `db:"score"`
+	Status      string `db:"status"`
+	CreatedAt   int64  `db:"created_at"`
+	UpdatedAt   int64  `db:"updated_at"`
+}
+
+type DuplicateAccountCandidate struct {
+	ID        int64 `json:"id"`
+	User      User  `json:"user"`
+	OtherUser User  `json:"other_user"`
+	// 一致した信号 (ip_overlap, icon_match, name_similar)
+	Signals []string `json:"signals"`
+	// 一致した信号の数
+	Score     int64  `json:"score"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// duplicateAccountPair は検出した組と一致した信号
+type duplicateAccountPair struct {
+	IPOverlap   bool
+	IconMatch   bool
+	NameSimilar bool
+}
+
+func loadDuplicateAccountConfig() error {
+	if v, ok := os.LookupEnv(duplicateAccountDetectionEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", duplicateAccountDetectionEnabledEnvKey, err)
+		}
+		duplicateAccountDetectionEnabled = enabled
+	}
+	return nil
+}
+
+// normalizeAccountName はユーザ名から数字・記号を除いて小文字にする ("Alice_01" と "alice2" を同じにする)
+func normalizeAccountName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func runDuplicateAccountDetector(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(duplicateAccountDetectorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := detectDuplicateAccounts(ctx); err != nil {
+			logger.Warnf("failed to detect duplicate accounts: %v", err)
+		}
+	}
+}
+
+// detectDuplicateAccounts は同じ値を持つユーザを組にして候補表に書き込む
+func detectDuplicateAccounts(ctx context.Context) error {
+	pairs := map[[2]int64]*duplicateAccountPair{}
+	addGroups := func(groups map[string][]int64, mark func(p *duplicateAccountPair)) {
+		for _, userIDs := range groups {
+			if len(userIDs) < 2 || len(userIDs) > maxDuplicateAccountGroupSize {
+				continue
+			}
+			for i := range userIDs {
+				for j := range userIDs {
+					if userIDs[i] >= userIDs[j] {
+						continue
+					}
+					key := [2]int64{userIDs[i], userIDs[j]}
+					if pairs[key] == nil {
+						pairs[key] = &duplicateAccountPair{}
+					}
+					mark(pairs[key])
+				}
+			}
+		}
+	}
+
+	// 登録元のIP
+	var registrations []struct {
+		Key    string `db:"k"`
+		UserID int64  `db:"user_id"`
+	}
+	if err := dbConn.SelectContext(ctx, &registrations, "SELECT DISTINCT ip AS k, user_id FROM registration_events WHERE ip != ''"); err != nil {
+		return err
+	}
+	ipGroups := map[string][]int64{}
+	for _, r := range registrations {
+		ipGroups[r.Key] = append(ipGroups[r.Key], r.UserID)
+	}
+	addGroups(ipGroups, func(p *duplicateAccountPair) { p.IPOverlap = true })
+
+	// アイコン (アイコンを設定していないユーザは比べない)
+	var icons []struct {
+		Key    string `db:"k"`
+		UserID int64  `db:"user_id"`
+	}
+	if err := dbConn.SelectContext(ctx, &icons, "SELECT DISTINCT SHA2(image, 256) AS k, user_id FROM icons"); err != nil {
+		return err
+	}
+	iconGroups := map[string][]int64{}
+	for _, i := range icons {
+		iconGroups[i.Key] = append(iconGroups[i.Key], i.UserID)
+	}
+	addGroups(iconGroups, func(p *duplicateAccountPair) { p.IconMatch = true })
+
+	// ユーザ名 (匿名化済みのユーザは除く)
+	var users []struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := dbConn.SelectContext(ctx, &users, "SELECT id, name FROM users WHERE name NOT LIKE 'deleted-%'"); err != nil {
+		return err
+	}
+	nameGroups := map[string][]int64{}
+	for _, u := range users {
+		if n := normalizeAccountName(u.Name); len([]rune(n)) >= minDuplicateAccountNameLength {
+			nameGroups[n] = append(nameGroups[n], u.ID)
+		}
+	}
+	addGroups(nameGroups, func(p *duplicateAccountPair) { p.NameSimilar = true })
+
+	now := clock.Now().Unix()
+	for key, p := range pairs {
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			_, err := tx.NamedExecContext(ctx, `
+				INSERT INTO duplicate_account_candidates (user_id, other_user_id, ip_overlap, icon_match, name_similar, score, status, created_at, updated_at)
+				VALUES (:user_id, :other_user_id, :ip_overlap, :icon_match, :name_similar, :score, :status, :created_at, :updated_at)
+				ON DUPLICATE KEY UPDATE
+					updated_at = IF(ip_overlap >= VALUES(ip_overlap) AND icon_match >= VALUES(icon_match) AND name_similar >= VALUES(name_similar), updated_at, VALUES(updated_at)),
+					ip_overlap = ip_overlap OR VALUES(ip_overlap),
+					icon_match = icon_match OR VALUES(icon_match),
+					name_similar = name_similar OR VALUES(name_similar),
+					score = ip_overlap + icon_match + name_similar`, DuplicateAccountCandidateModel{
+				UserID:      key[0],
+				OtherUserID: key[1],
+				IPOverlap:   p.IPOverlap,
+				IconMatch:   p.IconMatch,
+				NameSimilar: p.NameSimilar,
+				Score:       p.score(),
+				Status:      duplicateAccountStatusOpen,
+				CreatedAt:   now,
+				UpdatedAt:   now,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *duplicateAccountPair) score() int64 {
+	var n int64
+	for _, b := range []bool{p.IPOverlap, p.IconMatch, p.NameSimilar} {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+func (m DuplicateAccountCandidateModel) signals() []string {
+	signals := []string{}
+	if m.IPOverlap {
+		signals = append(signals, "ip_overlap")
+	}
+	if m.IconMatch {
+		signals = append(signals, "icon_match")
+	}
+	if m.NameSimilar {
+		signals = append(signals, "name_similar")
+	}
+	return signals
+}
+
+// 別アカウントの候補一覧API (管理者向け)
+// GET /api/admin/duplicate_accounts?status=&min_score=&limit=
+// 一致した信号の多い順
+func getDuplicateAccountsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = duplicateAccountStatusOpen
+	}
+	q := newSelectQuery("SELECT * FROM duplicate_account_candidates").
+		Where("status = ?", status).
+		OrderBy("score DESC, updated_at DESC, id DESC")
+	if err := q.WhereInt64Param(c, "min_score", "score >= ?"); err != nil {
+		return err
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var candidates []DuplicateAccountCandidate
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []DuplicateAccountCandidateModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get duplicate account candidates: "+err.Error()).SetInternal(err)
+		}
+		candidates = make([]DuplicateAccountCandidate, len(models))
+		for i, m := range models {
+			user, err := fillUserResponseByID(ctx, tx, m.UserID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+			}
+			other, err := fillUserResponseByID(ctx, tx, m.OtherUserID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+			}
+			candidates[i] = DuplicateAccountCandidate{
+				ID:        m.ID,
+				User:      user,
+				OtherUser: other,
+				Signals:   m.signals(),
+				Score:     m.Score,
+				Status:    m.Status,
+				CreatedAt: m.CreatedAt,
+				UpdatedAt: m.UpdatedAt,
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, candidates)
+}
+
+// 別アカウントの候補の解除API (管理者向け)
+// POST /api/admin/duplicate_accounts/:candidate_id/dismiss
+func dismissDuplicateAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	candidateID, err := strconv.ParseInt(c.Param("candidate_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "candidate_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var m DuplicateAccountCandidateModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM duplicate_account_candidates WHERE id = ? FOR UPDATE", candidateID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "duplicate account candidate not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get duplicate account candidate: "+err.Error()).SetInternal(err)
+		}
+		before := m
+		m.Status = duplicateAccountStatusDismissed
+		m.UpdatedAt = clock.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "UPDATE duplicate_account_candidates SET status = ?, updated_at = ? WHERE id = ?", m.Status, m.UpdatedAt, candidateID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to dismiss duplicate account candidate: "+err.Error()).SetInternal(err)
+		}
+		if err := insertAuditLog(ctx, tx, userID, auditActionDuplicateAccountDismiss, auditTargetDuplicateAccount, m.ID, 0, before, m); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	echolog "github.com/labstack/gommon/log"
+)
+
+// explainCheck は EXPLAIN で索引が効いているかを確かめる、よく呼ばれるクエリ
+// 引数は初期データにある値にしておく (存在しない値だと const table 扱いになって確かめられない)
+type explainCheck struct {
+	Name  string
+	Query string
+	Args  []interface{}
+	// ファイルソートを許す (絞り込んだ後の件数が少ないと分かっている場合)
+	AllowFilesort bool
+}
+
+// explainChecks はクエリの一覧 (ハンドラのクエリを変えたらこちらも合わせること)
+func explainChecks() []explainCheck {
+	return []explainCheck{
+		{Name: "livecomments by livestream", Query: "SELECT * FROM " + livecommentHotTable(1) + " WHERE livestream_id = ? ORDER BY created_at DESC LIMIT ?", Args: []interface{}{1, 50}},
+		{Name: "reactions by livestream", Query: "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC LIMIT ?", Args: []interface{}{1, 50}},
+		{Name: "livecomments by user", Query: "SELECT * FROM " + livecommentHotTable(1) + " WHERE user_id = ? ORDER BY created_at DESC LIMIT ?", Args: []interface{}{1, 50}},
+		{Name: "user by name", Query: "SELECT * FROM users WHERE name = ?", Args: []interface{}{"test001"}},
+		{Name: "icon by user", Query: "SELECT image FROM icons WHERE user_id = ?", Args: []interface{}{1}},
+		{Name: "theme by user", Query: "SELECT * FROM themes WHERE user_id = ?", Args: []interface{}{1}},
+		{Name: "tags of livestream", Query: "SELECT t.id, t.name FROM livestream_tags lt LEFT JOIN tags t ON lt.tag_id = t.id WHERE lt.livestream_id = ?", Args: []interface{}{1}},
+		{Name: "livestreams by user", Query: "SELECT * FROM livestreams WHERE user_id = ? ORDER BY start_at DESC", Args: []interface{}{1}},
+		{Name: "notifications by user", Query: "SELECT * FROM notifications WHERE user_id = ? ORDER BY created_at DESC LIMIT ?", Args: []interface{}{1, 50}},
+		// 期間内の枠は多くないので、並べ替えは許す
+		{Name: "reservation slots in range", Query: "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", Args: []interface{}{1700874000, 1701478800}, AllowFilesort: true},
+	}
+}
+
+// runExplainCheckCommand は `isupipe explain-check [-v] [names...]` として、
+// 初期データを入れた DB で explainChecks を EXPLAIN し、全件走査かファイルソートがあれば失敗する
+// 索引を消したりクエリを変えたりして遅くなっていないかを、ベンチマークを回す前に確かめるためのもの
+func runExplainCheckCommand(args []string) int {
+	logger := echolog.New("explain-check")
+	logger.SetLevel(echolog.INFO)
+
+	fs := flag.NewFlagSet("explain-check", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "print the plan of every query")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := loadLivecommentShardConfig(); err != nil {
+		logger.Errorf("failed to load livecomment shard config: %v", err)
+		return 1
+	}
+	checks := explainChecks()
+	if names := fs.Args(); len(names) > 0 {
+		selected := checks[:0]
+		for _, check := range checks {
+			for _, name := range names {
+				if check.Name == name {
+					selected = append(selected, check)
+					break
+				}
+			}
+		}
+		if len(selected) != len(names) {
+			logger.Errorf("unknown explain check in %q", strings.Join(names, ", "))
+			return 2
+		}
+		checks = selected
+	}
+
+	conn, err := connectDB(logger)
+	if err != nil {
+		logger.Errorf("failed to connect db: %v", err)
+		return 1
+	}
+	defer conn.Close()
+	dbConn = conn
+
+	ctx := context.Background()
+	status := 0
+	for _, check := range checks {
+		plan, err := explainQuery(ctx, check.Query, check.Args)
+		if err != nil {
+			logger.Errorf("%s: failed to explain: %v", check.Name, err)
+			status = 1
+			continue
+		}
+		violations := explainViolations(plan, check.AllowFilesort)
+		for _, v := range violations {
+			logger.Errorf("%s: %s", check.Name, v)
+		}
+		if len(violations) > 0 {
+			status = 1
+		}
+		if *verbose || len(violations) > 0 {
+			for _, row := range plan {
+				logger.Infof("%s: table=%v type=%v key=%v rows=%v extra=%v", check.Name, row["table"], row["type"], row["key"], row["rows"], row["Extra"])
+			}
+		}
+	}
+	if status == 0 {
+		logger.Infof("all %d queries use indexes", len(checks))
+	}
+	return status
+}
+
+// explainViolations は EXPLAIN の結果から全件走査とファイルソートを探す
+func explainViolations(plan []map[string]interface{}, allowFilesort bool) []string {
+	var violations []string
+	for _, row := range plan {
+		table := fmt.Sprint(row["table"])
+		// <derived2> や <union1,2> などの一時表は対象外
+		if strings.HasPrefix(table, "<") {
+			continue
+		}
+		if fmt.Sprint(row["type"]) == "ALL" {
+			violations = append(violations, "full table scan on "+table)
+		}
+		if !allowFilesort && strings.Contains(fmt.Sprint(row["Extra"]), "Using filesort") {
+			violations = append(violations, "filesort on "+table)
+		}
+	}
+	return violations
+}
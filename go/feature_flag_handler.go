@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// DBの変更を各プロセスのキャッシュに反映させる間隔
+	featureFlagsRefreshInterval = 5 * time.Second
+
+	auditActionFeatureFlagUpdate = "feature_flag.update"
+	auditTargetFeatureFlag       = "feature_flag"
+
+	// フラグで段階的に有効にする機能
+	// スパムスコアによるコメントの保留 (ISUCON13_SPAM_SCORE_ENABLED で有効にしたうえで、投稿者で絞る)
+	featureFlagSpamScore = "spam_score"
+	// Redis のランキングによる順位のキャッシュ (ISUCON13_REDIS_LEADERBOARD_ENABLED で有効にしたうえで、閲覧者で絞る)
+	featureFlagLeaderboardCache = "leaderboard_cache"
+)
+
+type FeatureFlagModel struct {
+	ID             int64  `db:"id" json:"id"`
+	Name           string `db:"name" json:"name"`
+	Enabled        bool   `db:"enabled" json:"enabled"`
+	RolloutPercent int64  `db:"rollout_percent" json:"rollout_percent"`
+	Description    string `db:"description" json:"description"`
+	UpdatedAt      int64  `db:"updated_at" json:"updated_at"`
+}
+
+type PutFeatureFlagRequest struct {
+	Enabled        bool   `json:"enabled"`
+	RolloutPercent *int64 `json:"rollout_percent"`
+	Description    string `json:"description"`
+}
+
+// featureFlags はDBのフラグをメモリにキャッシュしたもの
+var featureFlags = struct {
+	sync.RWMutex
+	m map[string]FeatureFlagModel
+}{m: map[string]FeatureFlagModel{}}
+
+func refreshFeatureFlags(ctx context.Context) error {
+	var flags []FeatureFlagModel
+	if err := dbConn.SelectContext(ctx, &flags, "SELECT * FROM feature_flags"); err != nil {
+		return err
+	}
+	m := make(map[string]FeatureFlagModel, len(flags))
+	for _, f := range flags {
+		m[f.Name] = f
+	}
+	featureFlags.Lock()
+	featureFlags.m = m
+	featureFlags.Unlock()
+	return nil
+}
+
+func runFeatureFlagRefresher(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(featureFlagsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := refreshFeatureFlags(ctx); err != nil {
+				logger.Warnf("failed to refresh feature flags: %v", err)
+			}
+		}
+	}
+}
+
+// featureEnabled はフラグ name が userID に対して有効かどうかを返す
+// 未登録・無効なフラグは常に false
+// rollout_percent が100未満の場合は、フラグ名とユーザIDから決まるバケットで一部のユーザだけ有効にする
+func featureEnabled(name string, userID int64) bool {
+	featureFlags.RLock()
+	f, ok := featureFlags.m[name]
+	featureFlags.RUnlock()
+	if !ok || !f.Enabled {
+		return false
+	}
+	if f.RolloutPercent >= 100 {
+		return true
+	}
+	return int64(rolloutBucket(name, userID)) < f.RolloutPercent
+}
+
+// featureAllowed は env で有効にした機能を、フラグ name が登録されていればその設定で絞り込む
+// 未登録なら全員に有効 (env だけで切り替えていたときと同じ)。フラグを無効にすれば再起動せずに止められる
+func featureAllowed(name string, userID int64) bool {
+	featureFlags.RLock()
+	_, ok := featureFlags.m[name]
+	featureFlags.RUnlock()
+	return !ok || featureEnabled(name, userID)
+}
+
+// rolloutBucket は 0〜99 のバケットを返す (同じフラグ・ユーザなら常に同じ値)
+func rolloutBucket(name string, userID int64) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte(":" + strconv.FormatInt(userID, 10)))
+	return h.Sum32() % 100
+}
+
+// フィーチャーフラグ一覧取得API (管理者向け)
+// GET /api/admin/feature_flags
+func getFeatureFlagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	flags := []FeatureFlagModel{}
+	if err := dbConn.SelectContext(ctx, &flags, "SELECT * FROM feature_flags ORDER BY name"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get feature flags: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, flags)
+}
+
+// フィーチャーフラグの作成・切り替えAPI (管理者向け)
+// PUT /api/admin/feature_flags/:name
+func putFeatureFlagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	name := c.Param("name")
+	var req PutFeatureFlagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	rolloutPercent := int64(100)
+	if req.RolloutPercent != nil {
+		rolloutPercent = *req.RolloutPercent
+	}
+	if rolloutPercent < 0 || rolloutPercent > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "rollout_percent must be between 0 and 100")
+	}
+
+	var flag FeatureFlagModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		// 新規作成の場合は変更前のスナップショット無し
+		var before interface{}
+		var current FeatureFlagModel
+		err := tx.GetContext(ctx, &current, "SELECT * FROM feature_flags WHERE name = ? FOR UPDATE", name)
+		if err == nil {
+			before = current
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get feature flag: "+err.Error()).SetInternal(err)
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO feature_flags (name, enabled, rollout_percent, description, updated_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE enabled = VALUES(enabled), rollout_percent = VALUES(rollout_percent), description = VALUES(description), updated_at = VALUES(updated_at)", name, req.Enabled, rolloutPercent, req.Description, clock.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update feature flag: "+err.Error()).SetInternal(err)
+		}
+		if err := tx.GetContext(ctx, &flag, "SELECT * FROM feature_flags WHERE name = ?", name); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get feature flag: "+err.Error()).SetInternal(err)
+		}
+
+		if err := insertAuditLog(ctx, tx, userID, auditActionFeatureFlagUpdate, auditTargetFeatureFlag, flag.ID, 0, before, flag); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// 自プロセスには即時反映する
+	if err := refreshFeatureFlags(ctx); err != nil {
+		c.Logger().Warnf("failed to refresh feature flags: %v", err)
+	}
+
+	return c.JSON(http.StatusOK, flag)
+}
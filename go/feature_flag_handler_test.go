@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func setFeatureFlagsForTest(t *testing.T, flags ...FeatureFlagModel) {
+	t.Helper()
+	m := make(map[string]FeatureFlagModel, len(flags))
+	for _, f := range flags {
+		m[f.Name] = f
+	}
+	featureFlags.Lock()
+	saved := featureFlags.m
+	featureFlags.m = m
+	featureFlags.Unlock()
+	t.Cleanup(func() {
+		featureFlags.Lock()
+		featureFlags.m = saved
+		featureFlags.Unlock()
+	})
+}
+
+func TestFeatureFlags(t *testing.T) {
+	setFeatureFlagsForTest(t,
+		FeatureFlagModel{Name: "off", Enabled: false, RolloutPercent: 100},
+		FeatureFlagModel{Name: "all", Enabled: true, RolloutPercent: 100},
+		FeatureFlagModel{Name: "none", Enabled: true, RolloutPercent: 0},
+		FeatureFlagModel{Name: "half", Enabled: true, RolloutPercent: 50},
+	)
+
+	tests := []struct {
+		name        string
+		wantEnabled bool
+		wantAllowed bool
+	}{
+		{name: "unregistered", wantEnabled: false, wantAllowed: true},
+		{name: "off", wantEnabled: false, wantAllowed: false},
+		{name: "all", wantEnabled: true, wantAllowed: true},
+		{name: "none", wantEnabled: false, wantAllowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for userID := int64(1); userID <= 100; userID++ {
+				if got := featureEnabled(tt.name, userID); got != tt.wantEnabled {
+					t.Fatalf("featureEnabled(%s, %d) = %v, want %v", tt.name, userID, got, tt.wantEnabled)
+				}
+				if got := featureAllowed(tt.name, userID); got != tt.wantAllowed {
+					t.Fatalf("featureAllowed(%s, %d) = %v, want %v", tt.name, userID, got, tt.wantAllowed)
+				}
+			}
+		})
+	}
+
+	t.Run("half", func(t *testing.T) {
+		var enabled int
+		for userID := int64(1); userID <= 1000; userID++ {
+			got := featureEnabled("half", userID)
+			if got != (rolloutBucket("half", userID) < 50) {
+				t.Fatalf("featureEnabled(half, %d) = %v, does not follow its bucket", userID, got)
+			}
+			if got != featureEnabled("half", userID) {
+				t.Fatalf("featureEnabled(half, %d) is not stable", userID)
+			}
+			if featureAllowed("half", userID) != got {
+				t.Fatalf("featureAllowed(half, %d) differs from featureEnabled", userID)
+			}
+			if got {
+				enabled++
+			}
+		}
+		if enabled < 400 || enabled > 600 {
+			t.Errorf("%d of 1000 users enabled at 50%% rollout", enabled)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package fixtures
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Livestream は INSERT した配信と、一緒に入れたコメント・リアクション
+type Livestream struct {
+	ID      int64
+	OwnerID int64
+	// WithComments / WithReactions を呼ばなかった場合は空
+	Commenter      User
+	LivecommentIDs []int64
+	ReactionIDs    []int64
+}
+
+type LivestreamBuilder struct {
+	owner       *User
+	title       string
+	description string
+	startAt     time.Time
+	endAt       time.Time
+	tagIDs      []int64
+	comments    int
+	reactions   int
+}
+
+// NewLivestream は1時間後から1時間の配信のビルダーを返す
+// WithOwner を呼ばなければ配信者も作る
+func NewLivestream() *LivestreamBuilder {
+	n := nextSequence()
+	startAt := time.Now().Truncate(time.Hour).Add(time.Hour)
+	return &LivestreamBuilder{
+		title:       fmt.Sprintf("fixture livestream %d", n),
+		description: "fixture",
+		startAt:     startAt,
+		endAt:       startAt.Add(time.Hour),
+	}
+}
+
+func (b *LivestreamBuilder) WithOwner(owner User) *LivestreamBuilder {
+	b.owner = &owner
+	return b
+}
+
+func (b *LivestreamBuilder) WithTitle(title string) *LivestreamBuilder {
+	b.title = title
+	return b
+}
+
+func (b *LivestreamBuilder) WithSchedule(startAt, endAt time.Time) *LivestreamBuilder {
+	b.startAt = startAt
+	b.endAt = endAt
+	return b
+}
+
+// WithTags は既存のタグ (初期データの tags) を付ける
+func (b *LivestreamBuilder) WithTags(tagIDs ...int64) *LivestreamBuilder {
+	b.tagIDs = append(b.tagIDs, tagIDs...)
+	return b
+}
+
+// WithComments は視聴者1人からのコメントを n 件入れる (新しいものほど created_at が大きい)
+// コメントは livecomments に入れるので、シャードを使う場合は入れた後に振り分け直すこと
+func (b *LivestreamBuilder) WithComments(n int) *LivestreamBuilder {
+	b.comments = n
+	return b
+}
+
+// WithReactions は視聴者1人からのリアクションを n 件入れる
+func (b *LivestreamBuilder) WithReactions(n int) *LivestreamBuilder {
+	b.reactions = n
+	return b
+}
+
+// Insert は配信・タグと、指定があればコメント・リアクションと視聴者を INSERT する
+func (b *LivestreamBuilder) Insert(ctx context.Context, db sqlx.ExtContext) (Livestream, error) {
+	if b.owner == nil {
+		owner, err := NewUser().Insert(ctx, db)
+		if err != nil {
+			return Livestream{}, err
+		}
+		b.owner = &owner
+	}
+
+	rs, err := db.ExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		b.owner.ID, b.title, b.description, "https://media.xiii.isucon.dev/api/4/playlist.m3u8", "https://media.xiii.isucon.dev/isucon12_final.webp", b.startAt.Unix(), b.endAt.Unix())
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to insert livestream: %w", err)
+	}
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		return Livestream{}, err
+	}
+	for _, tagID := range b.tagIDs {
+		if _, err := db.ExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, tagID); err != nil {
+			return Livestream{}, fmt.Errorf("failed to insert livestream tag: %w", err)
+		}
+	}
+
+	livestream := Livestream{ID: livestreamID, OwnerID: b.owner.ID}
+	if b.comments == 0 && b.reactions == 0 {
+		return livestream, nil
+	}
+
+	livestream.Commenter, err = NewUser().Insert(ctx, db)
+	if err != nil {
+		return Livestream{}, err
+	}
+	createdAt := b.startAt.Unix()
+	for i := 0; i < b.comments; i++ {
+		rs, err := db.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)",
+			livestream.Commenter.ID, livestreamID, fmt.Sprintf("fixture comment %d", i+1), 0, createdAt+int64(i))
+		if err != nil {
+			return Livestream{}, fmt.Errorf("failed to insert livecomment: %w", err)
+		}
+		id, err := rs.LastInsertId()
+		if err != nil {
+			return Livestream{}, err
+		}
+		livestream.LivecommentIDs = append(livestream.LivecommentIDs, id)
+	}
+	for i := 0; i < b.reactions; i++ {
+		rs, err := db.ExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (?, ?, ?, ?)",
+			livestream.Commenter.ID, livestreamID, "tada", createdAt+int64(i))
+		if err != nil {
+			return Livestream{}, fmt.Errorf("failed to insert reaction: %w", err)
+		}
+		id, err := rs.LastInsertId()
+		if err != nil {
+			return Livestream{}, err
+		}
+		livestream.ReactionIDs = append(livestream.ReactionIDs, id)
+	}
+	return livestream, nil
+}
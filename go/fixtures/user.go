@@ -0,0 +1,123 @@
+// Package fixtures はテスト用のデータを DB に入れるビルダー
+//
+// ハンドラが前提にしている行の組 (ユーザとテーマ、配信と配信者など) を揃えて INSERT する
+//
+//	owner, err := fixtures.NewUser().WithIcon().WithTheme(true).Insert(ctx, db)
+//	livestream, err := fixtures.NewLivestream().WithOwner(owner).WithComments(10).Insert(ctx, db)
+//
+// INSERT は直接流すので、件数やランキングなどの派生データは作り直しを待つこと
+package fixtures
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultPassword はビルダーで作るユーザのパスワード (初期データと同じ)
+const DefaultPassword = "test"
+
+// DefaultIcon は WithIcon で入れる画像 (NoImage と区別できればよいので中身は JPEG でなくてよい)
+var DefaultIcon = []byte("fixtures-icon")
+
+// 同じテストの中で名前がぶつからないようにするための連番
+var sequence atomic.Int64
+
+func nextSequence() int64 {
+	return sequence.Add(1)
+}
+
+// User は INSERT したユーザ
+type User struct {
+	ID       int64
+	Name     string
+	Password string
+	// アイコンを入れなかった場合は nil
+	Icon []byte
+}
+
+type UserBuilder struct {
+	name        string
+	displayName string
+	description string
+	password    string
+	darkMode    bool
+	icon        []byte
+}
+
+// NewUser は名前が重ならないユーザのビルダーを返す
+// 登録APIと同じく、テーマは必ず作る (ライトモード)
+func NewUser() *UserBuilder {
+	n := nextSequence()
+	return &UserBuilder{
+		name:        fmt.Sprintf("fixture%d", n),
+		displayName: fmt.Sprintf("fixture user %d", n),
+		description: "fixture",
+		password:    DefaultPassword,
+	}
+}
+
+func (b *UserBuilder) WithName(name string) *UserBuilder {
+	b.name = name
+	return b
+}
+
+func (b *UserBuilder) WithDisplayName(displayName string) *UserBuilder {
+	b.displayName = displayName
+	return b
+}
+
+func (b *UserBuilder) WithPassword(password string) *UserBuilder {
+	b.password = password
+	return b
+}
+
+// WithTheme はテーマのダークモードを設定する
+func (b *UserBuilder) WithTheme(darkMode bool) *UserBuilder {
+	b.darkMode = darkMode
+	return b
+}
+
+// WithIcon は DefaultIcon をアイコンにする
+func (b *UserBuilder) WithIcon() *UserBuilder {
+	return b.WithIconImage(DefaultIcon)
+}
+
+func (b *UserBuilder) WithIconImage(image []byte) *UserBuilder {
+	b.icon = image
+	return b
+}
+
+// Insert はユーザ・テーマ・アイコンを INSERT する
+func (b *UserBuilder) Insert(ctx context.Context, db sqlx.ExtContext) (User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(b.password), bcrypt.MinCost)
+	if err != nil {
+		return User{}, err
+	}
+	rs, err := db.ExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES (?, ?, ?, ?)", b.name, b.displayName, b.description, hashedPassword)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to insert user: %w", err)
+	}
+	userID, err := rs.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", userID, b.darkMode); err != nil {
+		return User{}, fmt.Errorf("failed to insert theme: %w", err)
+	}
+	if b.icon != nil {
+		if _, err := db.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, b.icon); err != nil {
+			return User{}, fmt.Errorf("failed to insert icon: %w", err)
+		}
+	}
+
+	return User{
+		ID:       userID,
+		Name:     b.name,
+		Password: b.password,
+		Icon:     b.icon,
+	}, nil
+}
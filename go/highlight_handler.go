@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	highlightDetectionEnabledEnvKey = "ISUCON13_HIGHLIGHT_DETECTION_ENABLED"
+
+	highlightDetectorInterval  = time.Minute
+	highlightDetectorBatchSize = 10
+	// 平均 + 標準偏差の何倍を超えた区間を盛り上がりとみなすか
+	highlightSpikeSigma = 2.0
+	// 盛り上がりとみなす区間のリアクション+コメント数の下限 (視聴者の少ない配信で誤検出しないように)
+	highlightMinBucketScore = 5
+	// 盛り上がりの前後に付ける余白の区間数
+	highlightPaddingBuckets = 1
+
+	highlightStatusSuggested = "suggested"
+	highlightStatusConfirmed = "confirmed"
+)
+
+// 終了した配信から見どころを検出するジョブ
+// 配信ごとに集計クエリを流すので、デフォルトでは無効
+var highlightDetectionEnabled = false
+
+func loadHighlightConfig() error {
+	if v, ok := os.LookupEnv(highlightDetectionEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", highlightDetectionEnabledEnvKey, err)
+		}
+		highlightDetectionEnabled = enabled
+	}
+	return nil
+}
+
+type HighlightModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	StartOffset  int64  `db:"start_offset"`
+	EndOffset    int64  `db:"end_offset"`
+	Score        int64  `db:"score"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type Highlight struct {
+	ID           int64 `json:"id"`
+	LivestreamID int64 `json:"livestream_id"`
+	// 配信開始からの秒数
+	StartOffset int64 `json:"start_offset"`
+	EndOffset   int64 `json:"end_offset"`
+	// 区間内のリアクション+コメント数
+	Score     int64  `json:"score"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func fillHighlightResponse(m HighlightModel) Highlight {
+	return Highlight{
+		ID:           m.ID,
+		LivestreamID: m.LivestreamID,
+		StartOffset:  m.StartOffset,
+		EndOffset:    m.EndOffset,
+		Score:        m.Score,
+		Status:       m.Status,
+		CreatedAt:    m.CreatedAt,
+	}
+}
+
+// runHighlightDetector は終了した配信のうち未検出のものについて見どころを検出する
+func runHighlightDetector(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(highlightDetectorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var livestreams []LivestreamModel
+		if err := dbConn.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams l WHERE l.end_at < ? AND NOT EXISTS (SELECT 1 FROM highlight_detections d WHERE d.livestream_id = l.id) ORDER BY l.end_at LIMIT ?", clock.Now().Unix(), highlightDetectorBatchSize); err != nil {
+			logger.Warnf("failed to get livestreams for highlight detection: %v", err)
+			continue
+		}
+		for _, ls := range livestreams {
+			if err := detectHighlights(ctx, ls); err != nil {
+				logger.Warnf("failed to detect highlights of livestream %d: %v", ls.ID, err)
+			}
+		}
+	}
+}
+
+type highlightBucket struct {
+	BucketStart int64 `db:"bucket_start"`
+	Score       int64 `db:"score"`
+}
+
+// detectHighlights は10秒ごとのリアクション数とコメント数を足したものから、突出した区間を見どころの候補として保存する
+func detectHighlights(ctx context.Context, livestreamModel LivestreamModel) error {
+	var buckets []highlightBucket
+	if err := dbConn.SelectContext(ctx, &buckets, `
+		SELECT bucket_start, SUM(score) AS score FROM (
+			SELECT bucket_start, count AS score FROM reaction_buckets WHERE livestream_id = ?
+			UNION ALL
+			SELECT lc.created_at - lc.created_at % ? AS bucket_start, COUNT(*) AS score FROM `+livecommentsAggregateTable()+` lc WHERE lc.livestream_id = ? GROUP BY bucket_start
+		) t
+		GROUP BY bucket_start
+		ORDER BY bucket_start`, livestreamModel.ID, reactionBucketSeconds, livestreamModel.ID); err != nil {
+		return err
+	}
+
+	// 配信中の区間全体で平均をとる (何も無かった区間は 0 として扱う)
+	n := (livestreamModel.EndAt - livestreamModel.StartAt) / reactionBucketSeconds
+	if n < 1 {
+		n = 1
+	}
+	var sum, sqSum float64
+	for _, b := range buckets {
+		sum += float64(b.Score)
+		sqSum += float64(b.Score) * float64(b.Score)
+	}
+	mean := sum / float64(n)
+	stddev := math.Sqrt(math.Max(sqSum/float64(n)-mean*mean, 0))
+	threshold := math.Max(mean+highlightSpikeSigma*stddev, highlightMinBucketScore)
+
+	// 閾値を超えた区間をつなげて1つの見どころにする
+	var highlights []HighlightModel
+	now := clock.Now().Unix()
+	for _, b := range buckets {
+		if float64(b.Score) < threshold {
+			continue
+		}
+		start := b.BucketStart - highlightPaddingBuckets*reactionBucketSeconds - livestreamModel.StartAt
+		end := b.BucketStart + (highlightPaddingBuckets+1)*reactionBucketSeconds - livestreamModel.StartAt
+		if start < 0 {
+			start = 0
+		}
+		if last := len(highlights) - 1; last >= 0 && highlights[last].EndOffset >= start {
+			highlights[last].EndOffset = end
+			highlights[last].Score += b.Score
+			continue
+		}
+		highlights = append(highlights, HighlightModel{
+			LivestreamID: livestreamModel.ID,
+			StartOffset:  start,
+			EndOffset:    end,
+			Score:        b.Score,
+			Status:       highlightStatusSuggested,
+			CreatedAt:    now,
+		})
+	}
+
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "INSERT IGNORE INTO highlight_detections (livestream_id, detected_at) VALUES (?, ?)", livestreamModel.ID, now)
+		if err != nil {
+			return err
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// 他のプロセスが検出済み
+			return nil
+		}
+		for _, h := range highlights {
+			if _, err := tx.NamedExecContext(ctx, "INSERT INTO highlights (livestream_id, start_offset, end_offset, score, status, created_at) VALUES (:livestream_id, :start_offset, :end_offset, :score, :status, :created_at)", h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 見どころの候補一覧取得API (配信者向け)
+// GET /api/livestream/:livestream_id/highlights
+func getHighlightsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	highlights := []Highlight{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var highlightModels []HighlightModel
+		if err := tx.SelectContext(ctx, &highlightModels, "SELECT * FROM highlights WHERE livestream_id = ? ORDER BY start_offset", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get highlights: "+err.Error()).SetInternal(err)
+		}
+		for _, m := range highlightModels {
+			highlights = append(highlights, fillHighlightResponse(m))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, highlights)
+}
+
+// 見どころの候補を確定するAPI (配信者向け)
+// POST /api/livestream/:livestream_id/highlights/:highlight_id/confirm
+func confirmHighlightHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	highlightID, err := strconv.Atoi(c.Param("highlight_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "highlight_id in path must be integer")
+	}
+
+	var highlight Highlight
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE highlights SET status = ? WHERE id = ? AND livestream_id = ?", highlightStatusConfirmed, highlightID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to confirm highlight: "+err.Error()).SetInternal(err)
+		}
+		var m HighlightModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM highlights WHERE id = ? AND livestream_id = ?", highlightID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "highlight not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get highlight: "+err.Error()).SetInternal(err)
+		}
+		highlight = fillHighlightResponse(m)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, highlight)
+}
+
+// 見どころの候補を削除するAPI (配信者向け)
+// DELETE /api/livestream/:livestream_id/highlights/:highlight_id
+func deleteHighlightHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	highlightID, err := strconv.Atoi(c.Param("highlight_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "highlight_id in path must be integer")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM highlights WHERE id = ? AND livestream_id = ?", highlightID, livestreamID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete highlight: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "highlight not found")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// プロフィールに載せられる応援コメントの数
+const maxHighlightedComments = 10
+
+// HighlightedCommentModel は配信者がプロフィールに載せた応援コメント (チップ付きのコメント)
+// 元のコメントが退避・削除されても表示できるよう、本文とチップは載せた時点の内容を持つ
+type HighlightedCommentModel struct {
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	CommenterID   int64  `db:"commenter_id"`
+	Comment       string `db:"comment"`
+	Tip           int64  `db:"tip"`
+	Position      int64  `db:"position"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type HighlightedComment struct {
+	ID            int64  `json:"id"`
+	LivecommentID int64  `json:"livecomment_id"`
+	LivestreamID  int64  `json:"livestream_id"`
+	Commenter     User   `json:"commenter"`
+	Comment       string `json:"comment"`
+	Tip           int64  `json:"tip"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+type PostHighlightedCommentRequest struct {
+	LivestreamID  int64 `json:"livestream_id"`
+	LivecommentID int64 `json:"livecomment_id"`
+}
+
+type PutHighlightedCommentOrderRequest struct {
+	// 載せている応援コメントの ID をすべて、表示する順に並べる
+	IDs []int64 `json:"ids"`
+}
+
+// fetchHighlightedComments は配信者がプロフィールに載せた応援コメントを表示順に返す
+func fetchHighlightedComments(ctx context.Context, tx *sqlx.Tx, userID int64) ([]HighlightedComment, error) {
+	var models []HighlightedCommentModel
+	if err := tx.SelectContext(ctx, &models, "SELECT * FROM highlighted_comments WHERE user_id = ? ORDER BY position", userID); err != nil {
+		return nil, err
+	}
+	commenterIDs := make([]int64, len(models))
+	for i := range models {
+		commenterIDs[i] = models[i].CommenterID
+	}
+	if err := loaderFrom(ctx).primeUsers(ctx, tx, commenterIDs); err != nil {
+		return nil, err
+	}
+
+	comments := make([]HighlightedComment, len(models))
+	for i, m := range models {
+		commenter, err := fillUserResponseByID(ctx, tx, m.CommenterID)
+		if err != nil {
+			return nil, err
+		}
+		comments[i] = HighlightedComment{
+			ID:            m.ID,
+			LivecommentID: m.LivecommentID,
+			LivestreamID:  m.LivestreamID,
+			Commenter:     commenter,
+			Comment:       m.Comment,
+			Tip:           m.Tip,
+			CreatedAt:     m.CreatedAt,
+		}
+	}
+	return comments, nil
+}
+
+// プロフィールに載せている応援コメントの一覧API (配信者向け)
+// GET /api/user/me/highlighted_comments
+func getMyHighlightedCommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var comments []HighlightedComment
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		comments, err = fetchHighlightedComments(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get highlighted comments: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, comments)
+}
+
+// 応援コメントをプロフィールに載せるAPI (配信者向け)
+// POST /api/user/me/highlighted_comments
+// 自分の配信に付いたチップ付きのコメントだけを載せられる。末尾に追加する
+func postHighlightedCommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PostHighlightedCommentRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var comments []HighlightedComment
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", req.LivestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't highlight comments on other streamer's livestream")
+		}
+
+		livecommentModel, err := getLivecommentWithArchive(ctx, tx, req.LivestreamID, req.LivecommentID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error()).SetInternal(err)
+		}
+		if livecommentModel.LivestreamID != livestreamModel.ID {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+		if livecommentModel.Tip <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "only comments with tips can be highlighted")
+		}
+
+		// 同時に追加されても上限と表示順が崩れないよう、配信者の行をロックしておく
+		var count int64
+		var lastPosition sql.NullInt64
+		if err := tx.QueryRowxContext(ctx, "SELECT COUNT(*), MAX(position) FROM highlighted_comments WHERE user_id = ? FOR UPDATE", userID).Scan(&count, &lastPosition); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count highlighted comments: "+err.Error()).SetInternal(err)
+		}
+		if count >= maxHighlightedComments {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many highlighted comments")
+		}
+
+		m := HighlightedCommentModel{
+			UserID:        userID,
+			LivecommentID: livecommentModel.ID,
+			LivestreamID:  livecommentModel.LivestreamID,
+			CommenterID:   livecommentModel.UserID,
+			Comment:       livecommentModel.Comment,
+			Tip:           livecommentModel.Tip,
+			Position:      lastPosition.Int64 + 1,
+			CreatedAt:     clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO highlighted_comments (user_id, livecomment_id, livestream_id, commenter_id, comment, tip, position, created_at) VALUES (:user_id, :livecomment_id, :livestream_id, :commenter_id, :comment, :tip, :position, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert highlighted comment: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusConflict, "the livecomment is already highlighted")
+		}
+		if err := bumpProfileVersion(ctx, tx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to bump profile version: "+err.Error()).SetInternal(err)
+		}
+
+		comments, err = fetchHighlightedComments(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get highlighted comments: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, comments)
+}
+
+// プロフィールの応援コメントの並べ替えAPI (配信者向け)
+// PUT /api/user/me/highlighted_comments/order
+func putHighlightedCommentOrderHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PutHighlightedCommentOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var comments []HighlightedComment
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var ids []int64
+		if err := tx.SelectContext(ctx, &ids, "SELECT id FROM highlighted_comments WHERE user_id = ? FOR UPDATE", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get highlighted comments: "+err.Error()).SetInternal(err)
+		}
+		current := make(map[int64]bool, len(ids))
+		for _, id := range ids {
+			current[id] = true
+		}
+		if len(req.IDs) != len(ids) {
+			return echo.NewHTTPError(http.StatusBadRequest, "ids must list all highlighted comments")
+		}
+		for _, id := range req.IDs {
+			if !current[id] {
+				return echo.NewHTTPError(http.StatusBadRequest, "ids must list all highlighted comments exactly once: "+strconv.FormatInt(id, 10))
+			}
+			delete(current, id)
+		}
+
+		for i, id := range req.IDs {
+			if _, err := tx.ExecContext(ctx, "UPDATE highlighted_comments SET position = ? WHERE id = ?", i+1, id); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update highlighted comment: "+err.Error()).SetInternal(err)
+			}
+		}
+		if err := bumpProfileVersion(ctx, tx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to bump profile version: "+err.Error()).SetInternal(err)
+		}
+
+		var err error
+		comments, err = fetchHighlightedComments(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get highlighted comments: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, comments)
+}
+
+// プロフィールから応援コメントを外すAPI (配信者向け)
+// DELETE /api/user/me/highlighted_comments/:highlight_id
+func deleteHighlightedCommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	highlightID, err := strconv.ParseInt(c.Param("highlight_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "highlight_id in path must be integer")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM highlighted_comments WHERE id = ? AND user_id = ?", highlightID, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete highlighted comment: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "highlighted comment not found")
+		}
+		if err := bumpProfileVersion(ctx, tx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to bump profile version: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
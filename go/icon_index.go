@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	iconIndexEnabledEnvKey = "ISUCON13_ICON_INDEX_ENABLED"
+	iconIndexDirEnvKey     = "ISUCON13_ICON_INDEX_DIR"
+
+	// 他のサーバに無効化を伝える Redis の channel
+	iconIndexInvalidationChannel = "icon_index:invalidate"
+	// 全件を捨てるときのメッセージ (それ以外はユーザID)
+	iconIndexInvalidateAll = "*"
+
+	iconIndexResubscribeInterval = 1 * time.Second
+)
+
+// アイコン取得APIで、ユーザ名からユーザID・アイコンのハッシュをメモリで引き、画像はハッシュ名のファイルから返す
+// 更新はコミット後に無効化するが、複数台構成では Redis (ISUCON13_REDIS_ADDR) が無いと他のサーバの古い値が残るので、デフォルトでは無効
+var (
+	iconIndexEnabled = false
+	iconIndexDir     = filepath.Join(os.TempDir(), "isucon13-icons")
+)
+
+func loadIconIndexConfig() error {
+	if v, ok := os.LookupEnv(iconIndexEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", iconIndexEnabledEnvKey, err)
+		}
+		iconIndexEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(iconIndexDirEnvKey); ok && v != "" {
+		iconIndexDir = v
+	}
+	if !iconIndexEnabled {
+		return nil
+	}
+	return os.MkdirAll(iconIndexDir, 0o755)
+}
+
+type iconIndexEntry struct {
+	UserID int64
+	// アイコンが無ければ空文字 (fallbackImage を返す)
+	IconHash string
+}
+
+// iconIndexCall は同じユーザ名の読み込み中のもの (同時に来たリクエストは結果を待って使う)
+type iconIndexCall struct {
+	done  chan struct{}
+	entry iconIndexEntry
+	found bool
+	err   error
+}
+
+var iconIndex = struct {
+	sync.RWMutex
+	byName map[string]iconIndexEntry
+	// 無効化はユーザIDで届くので、ユーザ名を引けるようにしておく
+	nameByID map[int64]string
+	// アイコンのハッシュ → ファイルのパス (同じハッシュなら中身は変わらないので消さない)
+	files map[string]string
+	// 無効化のたびに増やす。読み込み中に無効化されたものは載せない
+	generation uint64
+	loading    map[string]*iconIndexCall
+}{
+	byName:   map[string]iconIndexEntry{},
+	nameByID: map[int64]string{},
+	files:    map[string]string{},
+	loading:  map[string]*iconIndexCall{},
+}
+
+// lookupIconIndex はユーザ名からアイコンのファイルを引く
+// 載っていなければ DB から読み込む (ユーザがいなければ found = false)
+func lookupIconIndex(ctx context.Context, username string) (path string, found bool, err error) {
+	iconIndex.RLock()
+	entry, ok := iconIndex.byName[username]
+	if ok {
+		path = iconIndex.files[entry.IconHash]
+	}
+	iconIndex.RUnlock()
+	if ok {
+		return path, true, nil
+	}
+
+	entry, found, err = loadIconIndexEntry(ctx, username)
+	if err != nil || !found {
+		return "", found, err
+	}
+	iconIndex.RLock()
+	path = iconIndex.files[entry.IconHash]
+	iconIndex.RUnlock()
+	return path, true, nil
+}
+
+// loadIconIndexEntry は同じユーザ名の読み込みを1回にまとめる
+func loadIconIndexEntry(ctx context.Context, username string) (iconIndexEntry, bool, error) {
+	iconIndex.Lock()
+	if call, ok := iconIndex.loading[username]; ok {
+		iconIndex.Unlock()
+		select {
+		case <-call.done:
+			return call.entry, call.found, call.err
+		case <-ctx.Done():
+			return iconIndexEntry{}, false, ctx.Err()
+		}
+	}
+	call := &iconIndexCall{done: make(chan struct{})}
+	iconIndex.loading[username] = call
+	generation := iconIndex.generation
+	iconIndex.Unlock()
+
+	// 待っている他のリクエストがいるので、このリクエストが切れても最後まで読む
+	call.entry, call.found, call.err = fetchIconIndexEntry(context.WithoutCancel(ctx), username)
+
+	iconIndex.Lock()
+	delete(iconIndex.loading, username)
+	if call.err == nil && call.found && iconIndex.generation == generation {
+		iconIndex.byName[username] = call.entry
+		iconIndex.nameByID[call.entry.UserID] = username
+	}
+	iconIndex.Unlock()
+	close(call.done)
+	return call.entry, call.found, call.err
+}
+
+func fetchIconIndexEntry(ctx context.Context, username string) (iconIndexEntry, bool, error) {
+	var row struct {
+		ID    int64  `db:"id"`
+		Image []byte `db:"image"`
+	}
+	if err := dbConn.GetContext(ctx, &row, "SELECT u.id, i.image FROM users u LEFT JOIN icons i ON i.user_id = u.id WHERE u.name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return iconIndexEntry{}, false, nil
+		}
+		return iconIndexEntry{}, false, err
+	}
+
+	entry := iconIndexEntry{UserID: row.ID}
+	if row.Image == nil {
+		return entry, true, nil
+	}
+	entry.IconHash = hexSHA256(row.Image)
+	if err := storeIconIndexFile(entry.IconHash, row.Image); err != nil {
+		return iconIndexEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// storeIconIndexFile は画像をハッシュ名のファイルに書く
+// 読み込み中のファイルを見せないよう、一時ファイルに書いてから rename する
+func storeIconIndexFile(hash string, image []byte) error {
+	iconIndex.RLock()
+	_, ok := iconIndex.files[hash]
+	iconIndex.RUnlock()
+	if ok {
+		return nil
+	}
+
+	path := filepath.Join(iconIndexDir, hash+".jpg")
+	tmp, err := os.CreateTemp(iconIndexDir, hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(image); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	iconIndex.Lock()
+	iconIndex.files[hash] = path
+	iconIndex.Unlock()
+	return nil
+}
+
+// dropIconIndex はこのサーバに載っている分を捨てる (userID が0なら全件)
+func dropIconIndex(userID int64) {
+	iconIndex.Lock()
+	defer iconIndex.Unlock()
+	iconIndex.generation++
+	if userID == 0 {
+		iconIndex.byName = map[string]iconIndexEntry{}
+		iconIndex.nameByID = map[int64]string{}
+		return
+	}
+	if name, ok := iconIndex.nameByID[userID]; ok {
+		delete(iconIndex.byName, name)
+		delete(iconIndex.nameByID, userID)
+	}
+}
+
+// invalidateIconIndex はユーザのアイコン・名前が変わったことを全サーバに伝える (userID が0なら全件)
+// 書き込みのコミット後に呼ぶこと
+func invalidateIconIndex(ctx context.Context, logger echo.Logger, userID int64) {
+	if !iconIndexEnabled {
+		return
+	}
+	dropIconIndex(userID)
+	if redisConn == nil {
+		return
+	}
+	payload := iconIndexInvalidateAll
+	if userID != 0 {
+		payload = strconv.FormatInt(userID, 10)
+	}
+	if _, err := redisConn.Do(ctx, "PUBLISH", iconIndexInvalidationChannel, payload); err != nil {
+		logger.Warnf("failed to publish icon index invalidation: %v", err)
+	}
+}
+
+// runIconIndexSubscriber は他のサーバからの無効化を受け取る
+// 購読が切れている間のメッセージは受け取れないので、繋ぎ直したら全件捨てる
+func runIconIndexSubscriber(ctx context.Context, logger echo.Logger) {
+	for {
+		dropIconIndex(0)
+		err := redisConn.Subscribe(ctx, iconIndexInvalidationChannel, func(payload string) {
+			if payload == iconIndexInvalidateAll {
+				dropIconIndex(0)
+				return
+			}
+			userID, err := strconv.ParseInt(payload, 10, 64)
+			if err != nil {
+				logger.Warnf("invalid icon index invalidation: %q", payload)
+				return
+			}
+			dropIconIndex(userID)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warnf("icon index subscription was closed: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(iconIndexResubscribeInterval):
+		}
+	}
+}
+
+// acceptsIconVariant は Accept ヘッダが別形式のアイコンを受け付けるか (インデックスは元の JPEG だけを持つ)
+func acceptsIconVariant(accept string) bool {
+	for _, format := range imageVariantFormats {
+		if acceptsContentType(accept, imageVariantEncoders[format].ContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveIndexedIcon はインデックスからアイコンを返す (使えない場合は ok = false)
+func serveIndexedIcon(c echo.Context, username string) (ok bool, err error) {
+	if !iconIndexEnabled || acceptsIconVariant(c.Request().Header.Get(echo.HeaderAccept)) {
+		return false, nil
+	}
+
+	path, found, err := lookupIconIndex(c.Request().Context(), username)
+	if err != nil {
+		return true, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error()).SetInternal(err)
+	}
+	if !found {
+		return true, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+
+	if len(imageVariantFormats) > 0 {
+		c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	}
+	if path == "" {
+		return true, c.File(fallbackImage)
+	}
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return true, echo.NewHTTPError(http.StatusInternalServerError, "failed to read user icon: "+err.Error()).SetInternal(err)
+	}
+	return true, c.Blob(http.StatusOK, "image/jpeg", image)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errInvalidIconUpload = errors.New("request body must be a json object with base64 encoded image")
+
+// readIconUpload はアイコンのアップロードを読み、画像を返す
+// 画像をそのまま送る (Content-Type: image/* か application/octet-stream) こともできる
+// JSON の場合も base64 の文字列を丸ごと溜めずに、読みながら復号する
+func readIconUpload(c echo.Context) ([]byte, error) {
+	body := c.Request().Body
+	if mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType)); err == nil {
+		if strings.HasPrefix(mediaType, "image/") || mediaType == echo.MIMEOctetStream {
+			return io.ReadAll(body)
+		}
+	}
+	return decodeIconUploadJSON(bufio.NewReader(body))
+}
+
+// decodeIconUploadJSON は {"image": "<base64>"} の image を復号する
+// image 以外のフィールドは読み飛ばす
+func decodeIconUploadJSON(br *bufio.Reader) ([]byte, error) {
+	if c, err := nextJSONByte(br); err != nil || c != '{' {
+		return nil, errInvalidIconUpload
+	}
+	var image []byte
+	for {
+		c, err := nextJSONByte(br)
+		if err != nil {
+			return nil, errInvalidIconUpload
+		}
+		if c == '}' {
+			return image, nil
+		}
+		if c != '"' {
+			return nil, errInvalidIconUpload
+		}
+		key, err := readJSONKey(br)
+		if err != nil {
+			return nil, err
+		}
+		if c, err := nextJSONByte(br); err != nil || c != ':' {
+			return nil, errInvalidIconUpload
+		}
+
+		if key == "image" {
+			image, err = readBase64JSONValue(br)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// 知らないフィールドは小さいはずなので普通に読む
+			dec := json.NewDecoder(br)
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, errInvalidIconUpload
+			}
+			br = bufio.NewReader(io.MultiReader(dec.Buffered(), br))
+		}
+
+		c, err = nextJSONByte(br)
+		if err != nil {
+			return nil, errInvalidIconUpload
+		}
+		switch c {
+		case ',':
+		case '}':
+			return image, nil
+		default:
+			return nil, errInvalidIconUpload
+		}
+	}
+}
+
+// nextJSONByte は空白を読み飛ばした次の 1 バイトを返す
+func nextJSONByte(br *bufio.Reader) (byte, error) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c, nil
+	}
+}
+
+// readJSONKey は開きの '"' を読んだ後のキーを読む
+func readJSONKey(br *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", errInvalidIconUpload
+		}
+		buf.WriteByte(c)
+		if c == '\\' {
+			e, err := br.ReadByte()
+			if err != nil {
+				return "", errInvalidIconUpload
+			}
+			buf.WriteByte(e)
+			continue
+		}
+		if c == '"' {
+			break
+		}
+	}
+	var key string
+	if err := json.Unmarshal(buf.Bytes(), &key); err != nil {
+		return "", errInvalidIconUpload
+	}
+	return key, nil
+}
+
+// readBase64JSONValue は base64 の文字列 (もしくは null) を読みながら復号する
+func readBase64JSONValue(br *bufio.Reader) ([]byte, error) {
+	c, err := nextJSONByte(br)
+	if err != nil {
+		return nil, errInvalidIconUpload
+	}
+	if c == 'n' {
+		rest := make([]byte, 3)
+		if _, err := io.ReadFull(br, rest); err != nil || string(rest) != "ull" {
+			return nil, errInvalidIconUpload
+		}
+		return nil, nil
+	}
+	if c != '"' {
+		return nil, errInvalidIconUpload
+	}
+
+	s := &jsonBase64StringReader{br: br}
+	image, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, s))
+	if err != nil {
+		if errors.Is(err, errRequestBodyTooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to decode image as base64: %w", err)
+	}
+	if !s.closed {
+		return nil, errInvalidIconUpload
+	}
+	return image, nil
+}
+
+// jsonBase64StringReader は JSON の文字列の中身を閉じの '"' まで返す
+// base64 に出てくるエスケープは "\/" だけなので、それ以外は受け付けない
+type jsonBase64StringReader struct {
+	br     *bufio.Reader
+	closed bool
+}
+
+func (r *jsonBase64StringReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+	var n int
+	for n < len(p) {
+		if n > 0 && r.br.Buffered() == 0 {
+			// 溜まっている分を返してから次を読む
+			break
+		}
+		c, err := r.br.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		switch c {
+		case '"':
+			r.closed = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case '\\':
+			e, err := r.br.ReadByte()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return n, io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+			if e != '/' {
+				return n, errInvalidIconUpload
+			}
+			c = e
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
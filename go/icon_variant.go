@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	imageVariantsEnvKey = "ISUCON13_IMAGE_VARIANTS"
+
+	imageFormatWebP = "webp"
+	imageFormatAVIF = "avif"
+)
+
+// imageVariantEncoder は JPEG などの元画像から別形式の画像を作る外部コマンド
+// 標準ライブラリには WebP/AVIF のエンコーダが無いので、libwebp/libavif のコマンドに任せる
+type imageVariantEncoder struct {
+	Format      string
+	ContentType string
+	// 入力ファイルと出力ファイルのパスを受け取ってコマンドを組み立てる
+	Command func(in, out string) *exec.Cmd
+}
+
+var imageVariantEncoders = map[string]imageVariantEncoder{
+	imageFormatWebP: {
+		Format:      imageFormatWebP,
+		ContentType: "image/webp",
+		Command: func(in, out string) *exec.Cmd {
+			return exec.Command("cwebp", "-quiet", "-q", "80", in, "-o", out)
+		},
+	},
+	imageFormatAVIF: {
+		Format:      imageFormatAVIF,
+		ContentType: "image/avif",
+		Command: func(in, out string) *exec.Cmd {
+			return exec.Command("avifenc", "-q", "60", in, out)
+		},
+	},
+}
+
+// 生成する形式 (Accept で優先する順)。空なら作らない (デフォルト)
+// サムネイルは URL で受け取っていて画像の実体を持たないので、アイコンだけが対象
+var imageVariantFormats []string
+
+func loadImageVariantsConfig() error {
+	v, ok := os.LookupEnv(imageVariantsEnvKey)
+	if !ok {
+		return nil
+	}
+	for _, format := range splitCommaList(v) {
+		if _, ok := imageVariantEncoders[format]; !ok {
+			return fmt.Errorf("unknown image variant format '%s' in environment variable '%s'", format, imageVariantsEnvKey)
+		}
+		imageVariantFormats = append(imageVariantFormats, format)
+	}
+	return nil
+}
+
+func (e imageVariantEncoder) encode(image []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "icon-variant-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in")
+	out := filepath.Join(dir, "out."+e.Format)
+	if err := os.WriteFile(in, image, 0o600); err != nil {
+		return nil, err
+	}
+	if output, err := e.Command(in, out).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, string(output))
+	}
+	return os.ReadFile(out)
+}
+
+// storeIconVariants はアイコンの別形式を作り直して icon_variants に保存する
+// エンコードに失敗した形式は保存せず、配信時は元の画像にフォールバックする
+func storeIconVariants(ctx context.Context, tx *sqlx.Tx, userID int64, image []byte) error {
+	if len(imageVariantFormats) == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM icon_variants WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, format := range imageVariantFormats {
+		variant, err := imageVariantEncoders[format].encode(image)
+		if err != nil {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO icon_variants (user_id, format, image) VALUES (?, ?, ?)", userID, format, variant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiateIconVariant は Accept ヘッダで受け付けられる別形式のアイコンを探す
+// 見つからなければ ok = false (元の JPEG を返す)
+func negotiateIconVariant(ctx context.Context, tx *sqlx.Tx, accept string, userID int64) (contentType string, image []byte, ok bool, err error) {
+	for _, format := range imageVariantFormats {
+		encoder := imageVariantEncoders[format]
+		if !acceptsContentType(accept, encoder.ContentType) {
+			continue
+		}
+		err := tx.GetContext(ctx, &image, "SELECT image FROM icon_variants WHERE user_id = ? AND format = ?", userID, format)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", nil, false, err
+		}
+		return encoder.ContentType, image, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// acceptsContentType は Accept ヘッダが contentType を明示的に受け付けているか
+// q=0 で拒否されているものは除く。image/* などのワイルドカードでは別形式を選ばない
+func acceptsContentType(accept, contentType string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), contentType) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && k == "q" && strings.Trim(strings.TrimSpace(v), "0.") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
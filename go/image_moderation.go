@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	imageModeratorEnvKey        = "ISUCON13_IMAGE_MODERATOR"
+	imageModerationAPIURLEnvKey = "ISUCON13_IMAGE_MODERATION_API_URL"
+
+	imageModeratorNoop = "noop"
+	imageModeratorHTTP = "http"
+
+	imageModerationAPITimeout = 5 * time.Second
+
+	imageVerdictAllow  = "allow"
+	imageVerdictFlag   = "flag"
+	imageVerdictReject = "reject"
+
+	// 審査待ちの画像の差し替え先
+	imageReviewTargetUserIcon     = "user_icon"
+	imageReviewTargetChannelIcon  = "channel_icon"
+	imageReviewTargetChannelEmoji = "channel_emoji"
+
+	imageReviewStatusPending  = "pending"
+	imageReviewStatusApproved = "approved"
+	imageReviewStatusRejected = "rejected"
+
+	auditActionImageReviewApprove = "image_review.approve"
+	auditActionImageReviewReject  = "image_review.reject"
+	auditTargetImageReview        = "image_review"
+)
+
+// imageModeration はアップロードされた画像の判定結果
+type imageModeration struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// ImageModerator はアイコンなどのアップロード画像を判定する
+// サムネイルは URL で受け取っていて画像の実体を持たないので対象外
+type ImageModerator interface {
+	Name() string
+	Moderate(ctx context.Context, image []byte) (imageModeration, error)
+}
+
+// noopImageModerator は常に許可する (デフォルト)
+type noopImageModerator struct{}
+
+func (noopImageModerator) Name() string { return imageModeratorNoop }
+
+func (noopImageModerator) Moderate(context.Context, []byte) (imageModeration, error) {
+	return imageModeration{Verdict: imageVerdictAllow}, nil
+}
+
+// httpImageModerator は外部の判定APIに画像をそのまま POST する
+// {"verdict": "allow|flag|reject", "reason": "..."} が返ってくる想定
+type httpImageModerator struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpImageModerator) Name() string { return imageModeratorHTTP }
+
+func (h *httpImageModerator) Moderate(ctx context.Context, image []byte) (imageModeration, error) {
+	var res imageModeration
+	err := getCircuitBreaker(circuitImageModeration).Do(func() error {
+		var err error
+		res, err = h.moderate(ctx, image)
+		return err
+	})
+	return res, err
+}
+
+func (h *httpImageModerator) moderate(ctx context.Context, image []byte) (imageModeration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(image))
+	if err != nil {
+		return imageModeration{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return imageModeration{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return imageModeration{}, fmt.Errorf("image moderation api returned status %d", resp.StatusCode)
+	}
+	var res imageModeration
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return imageModeration{}, err
+	}
+	switch res.Verdict {
+	case imageVerdictAllow, imageVerdictFlag, imageVerdictReject:
+	default:
+		return imageModeration{}, fmt.Errorf("image moderation api returned unknown verdict '%s'", res.Verdict)
+	}
+	return res, nil
+}
+
+var imageModerator ImageModerator = noopImageModerator{}
+
+func loadImageModerationConfig() error {
+	switch v := os.Getenv(imageModeratorEnvKey); v {
+	case "", imageModeratorNoop:
+		imageModerator = noopImageModerator{}
+	case imageModeratorHTTP:
+		url, ok := os.LookupEnv(imageModerationAPIURLEnvKey)
+		if !ok || url == "" {
+			return fmt.Errorf("environment variable '%s' must be provided when '%s' is %s", imageModerationAPIURLEnvKey, imageModeratorEnvKey, imageModeratorHTTP)
+		}
+		imageModerator = &httpImageModerator{url: url, client: &http.Client{Timeout: imageModerationAPITimeout}}
+	default:
+		return fmt.Errorf("unknown image moderator '%s'", v)
+	}
+	return nil
+}
+
+// moderateImage はアップロード画像を判定する
+// 判定APIが失敗したときは公開せず審査待ちに回す
+func moderateImage(ctx context.Context, image []byte) imageModeration {
+	if len(image) == 0 {
+		return imageModeration{Verdict: imageVerdictAllow}
+	}
+	res, err := imageModerator.Moderate(ctx, image)
+	if err != nil {
+		return imageModeration{Verdict: imageVerdictFlag, Reason: "moderation failed: " + err.Error()}
+	}
+	return res
+}
+
+type ImageReviewModel struct {
+	ID         int64  `db:"id"`
+	TargetType string `db:"target_type"`
+	TargetID   int64  `db:"target_id"`
+	UserID     int64  `db:"user_id"`
+	Image      []byte `db:"image"`
+	Moderator  string `db:"moderator"`
+	Reason     string `db:"reason"`
+	Status     string `db:"status"`
+	CreatedAt  int64  `db:"created_at"`
+	ReviewedAt *int64 `db:"reviewed_at"`
+}
+
+type ImageReview struct {
+	ID         int64  `json:"id"`
+	TargetType string `json:"target_type"`
+	TargetID   int64  `json:"target_id"`
+	User       User   `json:"user"`
+	Moderator  string `json:"moderator"`
+	Reason     string `json:"reason"`
+	Status     string `json:"status"`
+	CreatedAt  int64  `json:"created_at"`
+	ReviewedAt *int64 `json:"reviewed_at,omitempty"`
+}
+
+// enqueueImageReview は flag された画像を審査待ちに積む
+func enqueueImageReview(ctx context.Context, tx *sqlx.Tx, targetType string, targetID, userID int64, image []byte, res imageModeration) (int64, error) {
+	rs, err := tx.ExecContext(ctx, "INSERT INTO image_reviews (target_type, target_id, user_id, image, moderator, reason, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", targetType, targetID, userID, image, imageModerator.Name(), res.Reason, imageReviewStatusPending, clock.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+// 画像の審査待ち一覧API (管理者向け)
+// GET /api/admin/image_reviews
+func getImageReviewsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT id, target_type, target_id, user_id, moderator, reason, status, created_at, reviewed_at FROM image_reviews")
+	status := c.QueryParam("status")
+	if status == "" {
+		status = imageReviewStatusPending
+	}
+	q.Where("status = ?", status).OrderBy("id")
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var reviews []ImageReview
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []ImageReviewModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get image reviews: "+err.Error()).SetInternal(err)
+		}
+		reviews = make([]ImageReview, len(models))
+		for i, m := range models {
+			user, err := fillUserResponseByID(ctx, tx, m.UserID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+			}
+			reviews[i] = ImageReview{
+				ID:         m.ID,
+				TargetType: m.TargetType,
+				TargetID:   m.TargetID,
+				User:       user,
+				Moderator:  m.Moderator,
+				Reason:     m.Reason,
+				Status:     m.Status,
+				CreatedAt:  m.CreatedAt,
+				ReviewedAt: m.ReviewedAt,
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, reviews)
+}
+
+// 審査待ち画像の承認API (管理者向け)
+// POST /api/admin/image_reviews/:review_id/approve
+// 承認すると画像を差し替え先に反映する
+func approveImageReviewHandler(c echo.Context) error {
+	return resolveImageReview(c, imageReviewStatusApproved)
+}
+
+// 審査待ち画像の却下API (管理者向け)
+// POST /api/admin/image_reviews/:review_id/reject
+func rejectImageReviewHandler(c echo.Context) error {
+	return resolveImageReview(c, imageReviewStatusRejected)
+}
+
+func resolveImageReview(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	reviewID, err := strconv.ParseInt(c.Param("review_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "review_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var m ImageReviewModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM image_reviews WHERE id = ? FOR UPDATE", reviewID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "image review not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get image review: "+err.Error()).SetInternal(err)
+		}
+		if m.Status != imageReviewStatusPending {
+			return echo.NewHTTPError(http.StatusConflict, "image review is already resolved")
+		}
+
+		if status == imageReviewStatusApproved {
+			switch m.TargetType {
+			case imageReviewTargetUserIcon:
+				if _, err := replaceUserIcon(ctx, tx, m.TargetID, m.Image); err != nil {
+					return err
+				}
+			case imageReviewTargetChannelIcon:
+				if _, err := tx.ExecContext(ctx, "UPDATE channels SET icon = ? WHERE id = ?", m.Image, m.TargetID); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to update channel icon: "+err.Error()).SetInternal(err)
+				}
+			case imageReviewTargetChannelEmoji:
+				if _, err := tx.ExecContext(ctx, "UPDATE channel_emojis SET image = ?, approved = TRUE WHERE id = ?", m.Image, m.TargetID); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to update channel emoji: "+err.Error()).SetInternal(err)
+				}
+			}
+		}
+		// 却下された絵文字は shortcode を空けるために消す
+		if status == imageReviewStatusRejected && m.TargetType == imageReviewTargetChannelEmoji {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM channel_emojis WHERE id = ?", m.TargetID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete channel emoji: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		reviewedAt := clock.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "UPDATE image_reviews SET status = ?, reviewed_at = ? WHERE id = ?", status, reviewedAt, reviewID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update image review: "+err.Error()).SetInternal(err)
+		}
+
+		// 画像の実体は監査ログに載せない
+		before := m
+		before.Image = nil
+		after := before
+		after.Status = status
+		after.ReviewedAt = &reviewedAt
+		action := auditActionImageReviewApprove
+		if status == imageReviewStatusRejected {
+			action = auditActionImageReviewReject
+		}
+		if err := insertAuditLog(ctx, tx, userID, action, auditTargetImageReview, m.ID, 0, before, after); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if status == imageReviewStatusApproved && m.TargetType == imageReviewTargetUserIcon {
+		invalidateIconIndex(ctx, c.Logger(), m.TargetID)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
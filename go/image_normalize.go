@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strconv"
+)
+
+const (
+	imageNormalizationEnabledEnvKey = "ISUCON13_IMAGE_NORMALIZATION_ENABLED"
+	imageMaxDimensionEnvKey         = "ISUCON13_IMAGE_MAX_DIMENSION"
+
+	normalizedImageJPEGQuality = 85
+	// カスタム絵文字の長辺の上限 (px)
+	emojiMaxDimension = 128
+)
+
+// アップロード画像の正規化 (EXIF 除去・向きの補正・JPEG への変換・縮小)
+// ベンチマーカーはアップロードした画像そのもののハッシュを icon_hash として検証するので、デフォルトでは無効
+var (
+	imageNormalizationEnabled = false
+	// 長辺の上限 (px)
+	imageMaxDimension = 1024
+)
+
+func loadImageNormalizationConfig() error {
+	if v, ok := os.LookupEnv(imageNormalizationEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", imageNormalizationEnabledEnvKey, err)
+		}
+		imageNormalizationEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(imageMaxDimensionEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", imageMaxDimensionEnvKey, v)
+		}
+		imageMaxDimension = n
+	}
+	return nil
+}
+
+// normalizeUploadedImage はアップロード画像を保存用の JPEG に変換する
+// 再エンコードするので EXIF などのメタデータは残らない
+// 無効なときや画像が空のときはそのまま返す
+func normalizeUploadedImage(data []byte) ([]byte, error) {
+	if !imageNormalizationEnabled || len(data) == 0 {
+		return data, nil
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	dst := orientAndResize(src, orientation, imageMaxDimension)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: normalizedImageJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeEmojiImage はカスタム絵文字を保存用の PNG に変換する
+// 透過を残すため PNG にする。表示の大きさが決まっているので、正規化の設定に関わらず常に縮小する
+func normalizeEmojiImage(data []byte) ([]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	dst := orientAndResize(src, orientation, emojiMaxDimension)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// orientAndResize は EXIF の Orientation を反映し、長辺が maxDim を超えないよう縮小する (最近傍法)
+func orientAndResize(src image.Image, orientation, maxDim int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// 向きを直した後の大きさ
+	ow, oh := w, h
+	if orientation >= 5 && orientation <= 8 {
+		ow, oh = h, w
+	}
+	fw, fh := ow, oh
+	if longest := max(ow, oh); longest > maxDim {
+		fw = max(1, ow*maxDim/longest)
+		fh = max(1, oh*maxDim/longest)
+	}
+	if orientation == 1 && fw == w && fh == h {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, fw, fh))
+	for fy := 0; fy < fh; fy++ {
+		y := fy * oh / fh
+		for fx := 0; fx < fw; fx++ {
+			x := fx * ow / fw
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(fx, fy, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation は JPEG の APP1 (Exif) から Orientation (0x0112) を読む
+// 読めなければ 1 (補正なし)
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// SOS 以降は画像データ
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+size]
+		if marker == 0xE1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		v := int(order.Uint16(tiff[entry+8:]))
+		if v < 1 || v > 8 {
+			return 1
+		}
+		return v
+	}
+	return 1
+}
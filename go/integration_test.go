@@ -0,0 +1,287 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Docker で MySQL を立ち上げ、スキーマと初期データを投入した上でアプリを起動し、
+// register → login → reserve → comment → moderate → stats の一連の HTTP フローを検証する
+//
+// 使い方: go test -tags integration -run TestIntegration .
+// 必要なもの: docker (MySQL のイメージは MYSQL_IMAGE、ポートは MYSQL_PORT で変えられる)
+
+const (
+	integrationHost = "pipe.u.isucon.local"
+	// 結合テストで使う MySQL のイメージ・ポートのデフォルト
+	defaultIntegrationMySQLImage = "mysql:8.0"
+	defaultIntegrationMySQLPort  = "13306"
+)
+
+func integrationEnv(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// startIntegrationMySQL は initdb.d を流した MySQL のコンテナを起動し、接続できるまで待つ
+func startIntegrationMySQL(t *testing.T, port string) {
+	t.Helper()
+
+	schemaDir, err := filepath.Abs("../sql/initdb.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("isupipe-integration-mysql-%d", os.Getpid())
+	out, err := exec.Command("docker", "run", "-d", "--name", name,
+		"-e", "MYSQL_ROOT_PASSWORD=root",
+		"-p", port+":3306",
+		"-v", schemaDir+":/docker-entrypoint-initdb.d:ro",
+		integrationEnv("MYSQL_IMAGE", defaultIntegrationMySQLImage),
+	).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to start mysql container: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("docker", "rm", "-f", name).Run()
+	})
+
+	conf := mysql.NewConfig()
+	conf.Net = "tcp"
+	conf.Addr = net.JoinHostPort("127.0.0.1", port)
+	conf.User = "isucon"
+	conf.Passwd = "isucon"
+	conf.DBName = "isupipe"
+	db, err := sql.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 60; i++ {
+		var one int
+		if err := db.QueryRow("SELECT 1 FROM users LIMIT 1").Scan(&one); err == nil || err == sql.ErrNoRows {
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+	t.Fatal("mysql did not accept connections")
+}
+
+// startIntegrationApp はアプリをビルドして起動する
+// initializeHandler は ../sql/init.sh を相対パスで実行するので go ディレクトリで起動する
+func startIntegrationApp(t *testing.T, mysqlPort string) *bytes.Buffer {
+	t.Helper()
+
+	workDir := t.TempDir()
+	// PowerDNS はテスト対象外なので、pdnsutil はスタブで置き換える
+	binDir := filepath.Join(workDir, "bin")
+	if err := os.Mkdir(binDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "pdnsutil"), []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(workDir, "isupipe")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build app: %v: %s", err, out)
+	}
+
+	var logs bytes.Buffer
+	cmd := exec.Command(bin)
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+	cmd.Env = append(os.Environ(),
+		"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"ISUCON13_MYSQL_DIALCONFIG_ADDRESS=127.0.0.1",
+		"ISUCON13_MYSQL_DIALCONFIG_PORT="+mysqlPort,
+		"ISUCON13_MYSQL_DIALCONFIG_USER=isucon",
+		"ISUCON13_MYSQL_DIALCONFIG_PASSWORD=isucon",
+		"ISUCON13_MYSQL_DIALCONFIG_DATABASE=isupipe",
+		"ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS=127.0.0.1",
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return &logs
+}
+
+// integrationClient は Host を pipe.u.isucon.local にしたまま 127.0.0.1 につなぎ、Cookie を引き継ぐクライアント
+type integrationClient struct {
+	t      *testing.T
+	client *http.Client
+	base   string
+	failed int
+}
+
+func newIntegrationClient(t *testing.T) *integrationClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort)))
+		},
+	}
+	return &integrationClient{
+		t:      t,
+		client: &http.Client{Jar: jar, Transport: transport, Timeout: 30 * time.Second},
+		base:   "http://" + net.JoinHostPort(integrationHost, strconv.Itoa(listenPort)),
+	}
+}
+
+// request は期待したステータスでなければ失敗として数え、レスポンスボディを返す
+func (ic *integrationClient) request(method, path string, expected int, body string) []byte {
+	ic.t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = bytes.NewBufferString(body)
+	}
+	req, err := http.NewRequest(method, ic.base+path, reader)
+	if err != nil {
+		ic.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := ic.client.Do(req)
+	if err != nil {
+		ic.t.Errorf("FAIL %s %s: %v", method, path, err)
+		ic.failed++
+		return nil
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	if res.StatusCode != expected {
+		ic.t.Errorf("FAIL %s %s -> %d (expected %d): %s", method, path, res.StatusCode, expected, b)
+		ic.failed++
+	}
+	return b
+}
+
+func (ic *integrationClient) waitReady() {
+	ic.t.Helper()
+	for i := 0; i < 30; i++ {
+		if res, err := ic.client.Get(ic.base + "/api/tag"); err == nil {
+			res.Body.Close()
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	ic.t.Fatal("application did not start")
+}
+
+func integrationID(t *testing.T, body []byte) int64 {
+	t.Helper()
+	var v struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("failed to decode id from %s: %v", body, err)
+	}
+	return v.ID
+}
+
+func TestIntegration(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is required")
+	}
+
+	mysqlPort := integrationEnv("MYSQL_PORT", defaultIntegrationMySQLPort)
+	startIntegrationMySQL(t, mysqlPort)
+	logs := startIntegrationApp(t, mysqlPort)
+	ic := newIntegrationClient(t)
+	ic.waitReady()
+	// パスワード付き配信を見る、配信者とは別のユーザ
+	viewer := newIntegrationClient(t)
+	defer func() {
+		if failed := ic.failed + viewer.failed; failed > 0 {
+			t.Logf("%d request(s) failed. application log:\n%s", failed, logs.String())
+		}
+	}()
+
+	ic.request("POST", "/api/initialize", http.StatusOK, "")
+
+	ic.request("POST", "/api/register", http.StatusCreated, `{"name":"integration","display_name":"結合テスト","description":"integration test user","password":"s3cret","theme":{"dark_mode":true}}`)
+	ic.request("POST", "/api/login", http.StatusUnauthorized, `{"username":"integration","password":"wrong"}`)
+	ic.request("POST", "/api/login", http.StatusOK, `{"username":"integration","password":"s3cret"}`)
+	ic.request("GET", "/api/user/me", http.StatusOK, "")
+	ic.request("GET", "/api/user/integration", http.StatusOK, "")
+	ic.request("GET", "/api/user/integration/theme", http.StatusOK, "")
+	ic.request("GET", "/api/user/integration/icon", http.StatusOK, "")
+
+	// 予約枠の先頭 (initial_reservation_slots.sql) を予約する
+	body := ic.request("POST", "/api/livestream/reservation", http.StatusCreated, `{"tags":[1,2],"title":"integration","description":"integration test stream","playlist_url":"https://example.com/playlist.m3u8","thumbnail_url":"https://example.com/thumbnail.webp","start_at":1700874000,"end_at":1700877600}`)
+	livestreamPath := fmt.Sprintf("/api/livestream/%d", integrationID(t, body))
+
+	ic.request("GET", livestreamPath, http.StatusOK, "")
+	ic.request("GET", "/api/livestream", http.StatusOK, "")
+	ic.request("GET", "/api/livestream/search?tag=%E3%83%A9%E3%82%A4%E3%83%96%E9%85%8D%E4%BF%A1", http.StatusOK, "")
+	ic.request("POST", livestreamPath+"/enter", http.StatusOK, "")
+
+	body = ic.request("POST", livestreamPath+"/livecomment", http.StatusCreated, `{"comment":"こんにちは","tip":100}`)
+	livecommentID := integrationID(t, body)
+	ic.request("GET", livestreamPath+"/livecomment?limit=10", http.StatusOK, "")
+	ic.request("POST", livestreamPath+"/reaction", http.StatusCreated, `{"emoji_name":"tada"}`)
+	ic.request("GET", livestreamPath+"/reaction", http.StatusOK, "")
+	ic.request("POST", fmt.Sprintf("%s/livecomment/%d/report", livestreamPath, livecommentID), http.StatusCreated, "")
+	ic.request("GET", livestreamPath+"/report", http.StatusOK, "")
+
+	ic.request("POST", livestreamPath+"/moderate", http.StatusCreated, `{"ng_word":"スパム"}`)
+	ic.request("GET", livestreamPath+"/ngwords", http.StatusOK, "")
+	ic.request("POST", livestreamPath+"/livecomment", http.StatusBadRequest, `{"comment":"これはスパムです","tip":0}`)
+
+	ic.request("GET", livestreamPath+"/statistics", http.StatusOK, "")
+	ic.request("GET", "/api/user/integration/statistics", http.StatusOK, "")
+	ic.request("GET", "/api/payment", http.StatusOK, "")
+	ic.request("DELETE", livestreamPath+"/exit", http.StatusOK, "")
+
+	// パスワード付き配信のコメント・リアクションは unlock で得たトークンが無ければ読み書きできない
+	body = ic.request("POST", "/api/livestream/reservation", http.StatusCreated, `{"tags":[1],"title":"protected","description":"password protected stream","playlist_url":"https://example.com/playlist.m3u8","thumbnail_url":"https://example.com/thumbnail.webp","start_at":1700877600,"end_at":1700881200,"visibility":"password","password":"open-sesame"}`)
+	protectedPath := fmt.Sprintf("/api/livestream/%d", integrationID(t, body))
+	ic.request("GET", protectedPath+"/reaction", http.StatusOK, "")
+
+	viewer.request("POST", "/api/register", http.StatusCreated, `{"name":"integration-viewer","display_name":"視聴者","description":"integration test viewer","password":"s3cret","theme":{"dark_mode":false}}`)
+	viewer.request("POST", "/api/login", http.StatusOK, `{"username":"integration-viewer","password":"s3cret"}`)
+	viewer.request("GET", protectedPath+"/livecomment", http.StatusForbidden, "")
+	viewer.request("GET", protectedPath+"/reaction", http.StatusForbidden, "")
+	viewer.request("GET", "/api/v2"+strings.TrimPrefix(protectedPath, "/api")+"/reaction", http.StatusForbidden, "")
+	viewer.request("POST", protectedPath+"/reaction", http.StatusForbidden, `{"emoji_name":"tada"}`)
+	viewer.request("POST", protectedPath+"/unlock", http.StatusUnauthorized, `{"password":"wrong"}`)
+
+	body = viewer.request("POST", protectedPath+"/unlock", http.StatusOK, `{"password":"open-sesame"}`)
+	var unlocked struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &unlocked); err != nil {
+		t.Fatalf("failed to decode token from %s: %v", body, err)
+	}
+	token := "?token=" + unlocked.Token
+	viewer.request("GET", protectedPath+"/livecomment"+token, http.StatusOK, "")
+	viewer.request("POST", protectedPath+"/reaction"+token, http.StatusCreated, `{"emoji_name":"tada"}`)
+	viewer.request("GET", protectedPath+"/reaction"+token, http.StatusOK, "")
+	viewer.request("GET", "/api/v2"+strings.TrimPrefix(protectedPath, "/api")+"/reaction"+token, http.StatusOK, "")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	internalAllowedCIDRsEnvKey = "ISUCON13_INTERNAL_ALLOWED_CIDRS"
+	internalTokenEnvKey        = "ISUCON13_INTERNAL_TOKEN"
+	internalTrustProxyEnvKey   = "ISUCON13_INTERNAL_TRUST_PROXY"
+)
+
+// internalAuthConfig は管理・デバッグ用のルートへのアクセス制限
+// 許可するCIDRに含まれる接続元か、Authorization: Bearer <token> が一致するリクエストだけを通す
+type internalAuthConfig struct {
+	AllowedNets []*net.IPNet
+	Token       string
+	// X-Forwarded-For を接続元として信用するか (nginx の後ろで動かす場合に使う)
+	// 信用するのは ISUCON13_TRUSTED_PROXY_CIDRS のプロキシが付けた分だけ (clientIP)
+	TrustProxy bool
+}
+
+var internalAuthConf internalAuthConfig
+
+func loadInternalAuthConfig() error {
+	if v, ok := os.LookupEnv(internalAllowedCIDRsEnvKey); ok {
+		for _, cidr := range splitCommaList(v) {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("failed to parse environment variable '%s' as CIDR list: %+v", internalAllowedCIDRsEnvKey, err)
+			}
+			internalAuthConf.AllowedNets = append(internalAuthConf.AllowedNets, n)
+		}
+	}
+	internalAuthConf.Token = os.Getenv(internalTokenEnvKey)
+	if v, ok := os.LookupEnv(internalTrustProxyEnvKey); ok {
+		trust, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", internalTrustProxyEnvKey, err)
+		}
+		internalAuthConf.TrustProxy = trust
+	}
+	return nil
+}
+
+func (conf internalAuthConfig) configured() bool {
+	return len(conf.AllowedNets) > 0 || conf.Token != ""
+}
+
+func (conf internalAuthConfig) allowed(c echo.Context) bool {
+	if conf.Token != "" {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok && subtle.ConstantTimeCompare([]byte(token), []byte(conf.Token)) == 1 {
+			return true
+		}
+	}
+
+	addr := c.Request().RemoteAddr
+	if conf.TrustProxy {
+		addr = clientIP(c)
+	} else if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range conf.AllowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalAuthMiddleware は管理・デバッグ用のルートを接続元とトークンで制限する
+// requireConfig が false の場合、制限が設定されていなければ素通しする (管理APIは別途管理者のセッションを検証している)
+// pprof などセッションを見ないルートは requireConfig を true にして、未設定なら常に拒否する
+func internalAuthMiddleware(requireConfig bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !internalAuthConf.configured() {
+				if requireConfig {
+					return echo.NewHTTPError(http.StatusForbidden, "internal routes are disabled")
+				}
+				return next(c)
+			}
+			if !internalAuthConf.allowed(c) {
+				return echo.NewHTTPError(http.StatusForbidden, "access to internal routes is not allowed")
+			}
+			return next(c)
+		}
+	}
+}
+
+// registerInternalRoutes は pprof と Prometheus 形式のメトリクスを /api/internal 以下に登録する
+func registerInternalRoutes(g *echo.Group) {
+	g.GET("/debug/pprof/", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	g.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	g.GET("/debug/pprof/:name", func(c echo.Context) error {
+		pprof.Handler(c.Param("name")).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+	g.GET("/metrics", getInternalMetricsHandler)
+	g.GET("/debug/slow-queries", getSlowQueriesHandler)
+	g.DELETE("/debug/slow-queries", deleteSlowQueriesHandler)
+	// メディアサーバからのストリームキーの検証
+	g.POST("/ingest/auth", postIngestAuthHandler)
+	g.POST("/ingest/started", postIngestStartedHandler)
+	g.POST("/ingest/stopped", postIngestStoppedHandler)
+}
+
+// プロセス内のカウンタを Prometheus のテキスト形式で返す
+// GET /api/internal/metrics
+func getInternalMetricsHandler(c echo.Context) error {
+	h, tx := httpStats(), txStats()
+
+	var sb strings.Builder
+	writeCounter := func(name, help string, v int64) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	writeCounter("isupipe_http_requests_total", "Total number of HTTP requests.", h.Requests)
+	writeCounter("isupipe_http_client_errors_total", "Total number of HTTP 4xx responses.", h.ClientErrors)
+	writeCounter("isupipe_http_server_errors_total", "Total number of HTTP 5xx responses.", h.ServerErrors)
+	writeCounter("isupipe_tx_commits_total", "Total number of committed transactions.", tx.Commits)
+	writeCounter("isupipe_tx_rollbacks_total", "Total number of rolled back transactions.", tx.Rollbacks)
+	writeCounter("isupipe_tx_retries_total", "Total number of retried transactions.", tx.Retries)
+	writeCounter("isupipe_tx_failures_total", "Total number of failed transactions.", tx.Failures)
+
+	// DB から集計する値は、取れなくても他のメトリクスは返す
+	if sla, err := computeModerationSLA(c.Request().Context(), dbConn, 0); err != nil {
+		c.Logger().Warnf("failed to compute moderation sla: %v", err)
+	} else {
+		name := "isupipe_report_resolution_seconds"
+		fmt.Fprintf(&sb, "# HELP %s Time from livecomment report to resolution, over reports resolved in the last %d seconds.\n# TYPE %s summary\n", name, sla.WindowSeconds, name)
+		fmt.Fprintf(&sb, "%s{quantile=\"0.5\"} %d\n%s{quantile=\"0.9\"} %d\n", name, sla.MedianSeconds, name, sla.P90Seconds)
+		fmt.Fprintf(&sb, "%s_sum %d\n%s_count %d\n", name, sla.sumSeconds, name, sla.ResolvedReports)
+		fmt.Fprintf(&sb, "# HELP isupipe_open_reports Number of unresolved livecomment reports.\n# TYPE isupipe_open_reports gauge\nisupipe_open_reports %d\n", sla.OpenReports)
+	}
+
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(sb.String()))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	languageDetectionEnabledEnvKey = "ISUCON13_LANGUAGE_DETECTION_ENABLED"
+
+	languageDetectionWorkerInterval  = 5 * time.Second
+	languageDetectionWorkerBatchSize = 500
+
+	// 判定できなかったコメント (絵文字だけ、短すぎるなど) の言語
+	languageUndetermined = "und"
+)
+
+// コメントの言語判定 (配信者向けの分析で使う)
+// コメントごとに行が増えるので、デフォルトでは無効
+var (
+	languageDetectionEnabled = false
+	languageDetectionWakeup  = make(chan struct{}, 1)
+)
+
+// ラテン文字の言語は、よく出てくる短い語で見分ける
+var latinLanguageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "you", "this", "that", "it", "to", "of", "what", "lol", "nice"},
+	"es": {"el", "la", "que", "de", "es", "y", "los", "muy", "por", "hola", "jaja"},
+	"pt": {"o", "que", "de", "é", "não", "muito", "com", "você", "obrigado", "kkk"},
+	"fr": {"le", "la", "et", "est", "les", "je", "pas", "c'est", "très", "merci"},
+	"de": {"der", "die", "und", "ist", "das", "nicht", "ich", "sehr", "danke"},
+	"id": {"yang", "dan", "ini", "itu", "tidak", "aku", "kamu", "wkwk", "mantap"},
+}
+
+type LanguageBreakdownEntry struct {
+	Language     string `json:"language" db:"language"`
+	Livecomments int64  `json:"livecomments" db:"livecomments"`
+}
+
+type ChannelLanguageBreakdown struct {
+	ChannelName string                   `json:"channel_name"`
+	Languages   []LanguageBreakdownEntry `json:"languages"`
+}
+
+func loadLanguageDetectionConfig() error {
+	if v, ok := os.LookupEnv(languageDetectionEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", languageDetectionEnabledEnvKey, err)
+		}
+		languageDetectionEnabled = enabled
+	}
+	return nil
+}
+
+// detectLanguage はコメントの言語を BCP 47 の言語コードで返す
+// 文字の種類で判定し、ラテン文字だけの場合は短い語の出現数で見分ける
+func detectLanguage(comment string) string {
+	counts := map[string]int{}
+	var letters int
+	for _, r := range comment {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			counts["ja"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Han, r):
+			counts["han"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["latin"]++
+		default:
+			continue
+		}
+		letters++
+	}
+	if letters == 0 {
+		return languageUndetermined
+	}
+
+	// 漢字は仮名が混ざっていれば日本語、ハングルが混ざっていれば韓国語とみなす
+	if counts["ja"] > 0 {
+		return "ja"
+	}
+	if counts["ko"] > 0 && counts["ko"] >= counts["latin"] {
+		return "ko"
+	}
+	best, bestCount := "", 0
+	for lang, n := range counts {
+		if n > bestCount || (n == bestCount && lang < best) {
+			best, bestCount = lang, n
+		}
+	}
+	switch best {
+	case "han":
+		return "zh"
+	case "latin":
+		return detectLatinLanguage(comment)
+	}
+	return best
+}
+
+func detectLatinLanguage(comment string) string {
+	words := strings.FieldsFunc(strings.ToLower(comment), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	best, bestHits := languageUndetermined, 0
+	for lang, stopwords := range latinLanguageStopwords {
+		var hits int
+		for _, w := range words {
+			for _, s := range stopwords {
+				if w == s {
+					hits++
+					break
+				}
+			}
+		}
+		if hits > bestHits || (hits == bestHits && hits > 0 && lang < best) {
+			best, bestHits = lang, hits
+		}
+	}
+	return best
+}
+
+// enqueueLanguageDetection はコメントを言語判定待ちに積む
+// 投稿と同じトランザクションで呼ぶこと
+func enqueueLanguageDetection(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) error {
+	if !languageDetectionEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO livecomment_languages (livecomment_id, livestream_id, created_at) VALUES (?, ?, ?)", livecommentModel.ID, livecommentModel.LivestreamID, livecommentModel.CreatedAt)
+	return err
+}
+
+// wakeLanguageDetectionWorker は言語判定ワーカーを起こす (コミット後に呼ぶ)
+func wakeLanguageDetectionWorker() {
+	if !languageDetectionEnabled {
+		return
+	}
+	select {
+	case languageDetectionWakeup <- struct{}{}:
+	default:
+	}
+}
+
+func runLanguageDetectionWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(languageDetectionWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-languageDetectionWakeup:
+		}
+		if err := detectPendingLivecommentLanguages(ctx); err != nil {
+			logger.Warnf("failed to detect livecomment languages: %v", err)
+		}
+	}
+}
+
+func detectPendingLivecommentLanguages(ctx context.Context) error {
+	var pendings []struct {
+		LivecommentID int64  `db:"livecomment_id"`
+		Comment       string `db:"comment"`
+	}
+	if err := dbConn.SelectContext(ctx, &pendings, `
+		SELECT s.livecomment_id, lc.comment
+		FROM livecomment_languages s
+		INNER JOIN `+livecommentsAllTable()+` lc ON lc.id = s.livecomment_id AND lc.livestream_id = s.livestream_id
+		WHERE s.detected_at IS NULL
+		ORDER BY s.created_at
+		LIMIT ?`, languageDetectionWorkerBatchSize); err != nil {
+		return err
+	}
+
+	// 判定は DB を引かないので、まとめて1トランザクションで書き込む
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		now := clock.Now().Unix()
+		for _, p := range pendings {
+			if _, err := tx.ExecContext(ctx, "UPDATE livecomment_languages SET language = ?, detected_at = ? WHERE livecomment_id = ? AND detected_at IS NULL", detectLanguage(p.Comment), now, p.LivecommentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// languageBreakdown は判定済みのコメントを言語ごとに数える (多い順)
+func languageBreakdown(ctx context.Context, db sqlx.QueryerContext, where string, args ...interface{}) ([]LanguageBreakdownEntry, error) {
+	entries := []LanguageBreakdownEntry{}
+	if err := sqlx.SelectContext(ctx, db, &entries, `
+		SELECT s.language, COUNT(*) AS livecomments
+		FROM livecomment_languages s
+		INNER JOIN livestreams l ON l.id = s.livestream_id
+		WHERE s.detected_at IS NOT NULL AND `+where+`
+		GROUP BY s.language
+		ORDER BY livecomments DESC, s.language`, args...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// チャンネルのコメントの言語内訳取得API (配信者向け)
+// GET /api/channel/:channel_name/analytics/languages
+func getChannelLanguageBreakdownHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	channel, err := resolveOwnedChannel(ctx, c.Param("channel_name"), userID)
+	if err != nil {
+		return err
+	}
+
+	languages, err := languageBreakdown(ctx, dbConn, "l.user_id = ? AND l.channel_id = ?", userID, channel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get language breakdown: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, ChannelLanguageBreakdown{
+		ChannelName: channel.Name,
+		Languages:   languages,
+	})
+}
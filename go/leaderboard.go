@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	leaderboardEnabledEnvKey = "ISUCON13_REDIS_LEADERBOARD_ENABLED"
+
+	leaderboardReconcileInterval = 5 * time.Minute
+	// 作り直すときに1回の ZADD に載せる件数
+	leaderboardZAddBatchSize = 1000
+
+	leaderboardUsers       = "users"
+	leaderboardLivestreams = "livestreams"
+
+	leaderboardKindTips      = "tips"
+	leaderboardKindReactions = "reactions"
+	// 統計APIのランクに使う (リアクション数 + チップ合計)
+	leaderboardKindScore = "score"
+)
+
+// チップ・リアクションのランキングを Redis の sorted set で持つ
+// ISUCON13_REDIS_ADDR も必要。デフォルトでは無効 (ランクは毎回 MySQL で集計する)
+var (
+	leaderboardEnabled = false
+	leaderboardWakeup  = make(chan struct{}, 1)
+)
+
+func loadLeaderboardConfig() error {
+	if v, ok := os.LookupEnv(leaderboardEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", leaderboardEnabledEnvKey, err)
+		}
+		leaderboardEnabled = enabled
+	}
+	if leaderboardEnabled && redisConn == nil {
+		return fmt.Errorf("environment variable '%s' must be provided when '%s' is true", redisAddrEnvKey, leaderboardEnabledEnvKey)
+	}
+	return nil
+}
+
+func leaderboardKey(entity, kind string) string {
+	return "leaderboard:" + entity + ":" + kind
+}
+
+// 同点のときは member の辞書順が大きい方を上位にする (MySQL で集計していたときと同じ順)
+// 配信IDは辞書順が数値順と一致するように0埋めする
+func livestreamLeaderboardMember(livestreamID int64) string {
+	return fmt.Sprintf("%020d", livestreamID)
+}
+
+// leaderboardDelta は1回の書き込みでランキングに足す量
+type leaderboardDelta struct {
+	LivestreamID int64
+	StreamerName string
+	Tips         int64
+	Reactions    int64
+}
+
+// newLeaderboardDelta は配信者の名前を引いてランキングの差分を作る
+// 書き込みと同じトランザクションで呼び、反映はコミット後に applyLeaderboardDelta で行う
+func newLeaderboardDelta(ctx context.Context, tx *sqlx.Tx, livestreamID, tips, reactions int64) (leaderboardDelta, error) {
+	if !leaderboardEnabled || (tips == 0 && reactions == 0) {
+		return leaderboardDelta{}, nil
+	}
+	d := leaderboardDelta{LivestreamID: livestreamID, Tips: tips, Reactions: reactions}
+	if err := tx.GetContext(ctx, &d.StreamerName, "SELECT u.name FROM livestreams l INNER JOIN users u ON u.id = l.user_id WHERE l.id = ?", livestreamID); err != nil {
+		return leaderboardDelta{}, err
+	}
+	return d, nil
+}
+
+// applyLeaderboardDelta はコミット済みの書き込みをランキングに反映する
+// 失敗しても書き込み自体は成功しているので、作り直しを早めるだけにする
+func applyLeaderboardDelta(ctx context.Context, logger echo.Logger, d leaderboardDelta) {
+	if !leaderboardEnabled || d.LivestreamID == 0 {
+		return
+	}
+
+	var cmds [][]string
+	for _, target := range []struct {
+		entity string
+		member string
+	}{
+		{leaderboardUsers, d.StreamerName},
+		{leaderboardLivestreams, livestreamLeaderboardMember(d.LivestreamID)},
+	} {
+		if d.Tips != 0 {
+			cmds = append(cmds, []string{"ZINCRBY", leaderboardKey(target.entity, leaderboardKindTips), strconv.FormatInt(d.Tips, 10), target.member})
+		}
+		if d.Reactions != 0 {
+			cmds = append(cmds, []string{"ZINCRBY", leaderboardKey(target.entity, leaderboardKindReactions), strconv.FormatInt(d.Reactions, 10), target.member})
+		}
+		cmds = append(cmds, []string{"ZINCRBY", leaderboardKey(target.entity, leaderboardKindScore), strconv.FormatInt(d.Tips+d.Reactions, 10), target.member})
+	}
+	if err := execRedisPipeline(ctx, cmds); err != nil {
+		logger.Warnf("failed to update leaderboard: %v", err)
+		wakeLeaderboardReconciler()
+	}
+}
+
+// addLeaderboardMember は0点の参加者をランキングに載せる (ランクは全員の中での順位なので)
+func addLeaderboardMember(ctx context.Context, logger echo.Logger, entity, member string) {
+	if !leaderboardEnabled {
+		return
+	}
+	cmds := make([][]string, 0, 3)
+	for _, kind := range []string{leaderboardKindTips, leaderboardKindReactions, leaderboardKindScore} {
+		cmds = append(cmds, []string{"ZADD", leaderboardKey(entity, kind), "NX", "0", member})
+	}
+	if err := execRedisPipeline(ctx, cmds); err != nil {
+		logger.Warnf("failed to add leaderboard member: %v", err)
+		wakeLeaderboardReconciler()
+	}
+}
+
+func execRedisPipeline(ctx context.Context, cmds [][]string) error {
+	replies, err := redisConn.Pipeline(ctx, cmds)
+	if err != nil {
+		return err
+	}
+	for _, r := range replies {
+		if e, ok := r.(redisError); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// leaderboardRank は1始まりの順位を返す (ランキングに載っていなければ ok = false)
+func leaderboardRank(ctx context.Context, entity, member string) (rank int64, ok bool, err error) {
+	reply, err := redisConn.Do(ctx, "ZREVRANK", leaderboardKey(entity, leaderboardKindScore), member)
+	if err != nil {
+		return 0, false, err
+	}
+	if reply == nil {
+		return 0, false, nil
+	}
+	n, isInt := reply.(int64)
+	if !isInt {
+		return 0, false, errors.New("unexpected ZREVRANK reply")
+	}
+	return n + 1, true, nil
+}
+
+// lookupLeaderboardRank は Redis から順位を引く
+// 無効なとき (フラグで閲覧者から外したときも)・載っていないとき・Redis に繋がらないときは ok = false (呼び出し側で集計する)
+func lookupLeaderboardRank(c echo.Context, entity, member string) (int64, bool) {
+	if !leaderboardEnabled {
+		return 0, false
+	}
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	if !featureAllowed(featureFlagLeaderboardCache, userID) {
+		return 0, false
+	}
+	rank, ok, err := leaderboardRank(c.Request().Context(), entity, member)
+	if err != nil {
+		c.Logger().Warnf("failed to get leaderboard rank: %v", err)
+		return 0, false
+	}
+	return rank, ok
+}
+
+func wakeLeaderboardReconciler() {
+	select {
+	case leaderboardWakeup <- struct{}{}:
+	default:
+	}
+}
+
+func runLeaderboardReconciler(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(leaderboardReconcileInterval)
+	defer ticker.Stop()
+	for {
+		if err := reconcileLeaderboards(ctx); err != nil {
+			logger.Warnf("failed to reconcile leaderboards: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-leaderboardWakeup:
+		}
+	}
+}
+
+type leaderboardRow struct {
+	Member    string `db:"member"`
+	Tips      int64  `db:"tips"`
+	Reactions int64  `db:"reactions"`
+}
+
+// reconcileLeaderboards は MySQL から集計し直してランキングを置き換える
+// 削除されたコメントのチップや、Redis への反映に失敗した分はここで直る
+func reconcileLeaderboards(ctx context.Context) error {
+	var users []leaderboardRow
+	if err := dbConn.SelectContext(ctx, &users, `
+		SELECT u.name AS member, IFNULL(t.tips, 0) AS tips, IFNULL(r.reactions, 0) AS reactions FROM users u
+		LEFT JOIN (
+			SELECT l.user_id, SUM(lc.tip) AS tips FROM livestreams l
+			INNER JOIN `+livecommentsAggregateTable()+` lc ON lc.livestream_id = l.id
+			GROUP BY l.user_id
+		) t ON t.user_id = u.id
+		LEFT JOIN (
+			SELECT l.user_id, COUNT(*) AS reactions FROM livestreams l
+			INNER JOIN `+reactionsAllTable()+` r ON r.livestream_id = l.id
+			GROUP BY l.user_id
+		) r ON r.user_id = u.id`); err != nil {
+		return err
+	}
+	if err := replaceLeaderboard(ctx, leaderboardUsers, users); err != nil {
+		return err
+	}
+
+	var livestreams []struct {
+		ID        int64 `db:"id"`
+		Tips      int64 `db:"tips"`
+		Reactions int64 `db:"reactions"`
+	}
+	if err := dbConn.SelectContext(ctx, &livestreams, `
+		SELECT l.id, IFNULL(t.tips, 0) AS tips, IFNULL(r.reactions, 0) AS reactions FROM livestreams l
+		LEFT JOIN (
+			SELECT lc.livestream_id, SUM(lc.tip) AS tips FROM `+livecommentsAggregateTable()+` lc
+			GROUP BY lc.livestream_id
+		) t ON t.livestream_id = l.id
+		LEFT JOIN (
+			SELECT r.livestream_id, COUNT(*) AS reactions FROM `+reactionsAllTable()+` r
+			GROUP BY livestream_id
+		) r ON r.livestream_id = l.id`); err != nil {
+		return err
+	}
+	rows := make([]leaderboardRow, len(livestreams))
+	for i, l := range livestreams {
+		rows[i] = leaderboardRow{Member: livestreamLeaderboardMember(l.ID), Tips: l.Tips, Reactions: l.Reactions}
+	}
+	return replaceLeaderboard(ctx, leaderboardLivestreams, rows)
+}
+
+// replaceLeaderboard は一時キーに書いてから RENAME で差し替える
+// 集計から差し替えまでの間の書き込みは次の作り直しで反映される
+func replaceLeaderboard(ctx context.Context, entity string, rows []leaderboardRow) error {
+	for _, kind := range []string{leaderboardKindTips, leaderboardKindReactions, leaderboardKindScore} {
+		key := leaderboardKey(entity, kind)
+		tmp := key + ":rebuild"
+		cmds := [][]string{{"DEL", tmp}}
+		for start := 0; start < len(rows); start += leaderboardZAddBatchSize {
+			end := start + leaderboardZAddBatchSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+			args := []string{"ZADD", tmp}
+			for _, row := range rows[start:end] {
+				var score int64
+				switch kind {
+				case leaderboardKindTips:
+					score = row.Tips
+				case leaderboardKindReactions:
+					score = row.Reactions
+				default:
+					score = row.Tips + row.Reactions
+				}
+				args = append(args, strconv.FormatInt(score, 10), row.Member)
+			}
+			cmds = append(cmds, args)
+		}
+		if len(rows) == 0 {
+			cmds = append(cmds, []string{"DEL", key})
+		} else {
+			cmds = append(cmds, []string{"RENAME", tmp, key})
+		}
+		if err := execRedisPipeline(ctx, cmds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	linkUnfurlEnabledEnvKey        = "ISUCON13_LINK_UNFURL_ENABLED"
+	linkAllowlistEnvKey            = "ISUCON13_LINK_ALLOWLIST"
+	linkMinAccountAgeSecondsEnvKey = "ISUCON13_LINK_MIN_ACCOUNT_AGE_SECONDS"
+
+	livecommentReasonNewAccountLink = "new_account_link"
+
+	linkUnfurlStatusPending = "pending"
+	linkUnfurlStatusReady   = "ready"
+	linkUnfurlStatusFailed  = "failed"
+
+	linkUnfurlWorkerInterval  = 5 * time.Second
+	linkUnfurlWorkerBatchSize = 20
+	linkUnfurlFetchTimeout    = 3 * time.Second
+	// 取得したタイトルはこの間使い回し、過ぎてから同じ URL が投稿されたら取り直す
+	linkUnfurlCacheTTL = 24 * time.Hour
+
+	maxLinkUnfurlsPerComment = 3
+	maxLinkUnfurlBodyBytes   = 512 * 1024
+	maxLinkUnfurlRedirects   = 3
+	maxLinkUnfurlTitleLength = 200
+)
+
+// コメント中のリンクの展開 (許可したドメインだけタイトルを取りに行く)
+// 外部へのリクエストが増えるので、デフォルトでは無効
+//
+// linkMinAccountAge が 0 より大きければ、登録してから日の浅いアカウントは許可したドメイン以外のリンクを投稿できない
+// (こちらは展開が無効でも効く)
+var (
+	linkUnfurlEnabled = false
+	linkAllowlist     []string
+	linkMinAccountAge time.Duration
+	linkUnfurlWakeup  = make(chan struct{}, 1)
+	linkUnfurlClient  = &http.Client{
+		Timeout: linkUnfurlFetchTimeout,
+		// 許可していないドメインへは転送させない
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxLinkUnfurlRedirects {
+				return errors.New("too many redirects")
+			}
+			if !isAllowlistedLinkHost(req.URL.Hostname()) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+)
+
+var (
+	linkPattern    = regexp.MustCompile(`(?i)(?:https?://|www\.)[^\s<>"]+`)
+	ogTitlePattern = regexp.MustCompile(`(?is)<meta[^>]+property=["']og:title["'][^>]+content=["']([^"']*)["']`)
+	titlePattern   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// LinkPreview はコメント中のリンクのプレビュー (取得できたものだけ返す)
+type LinkPreview struct {
+	URL    string `json:"url" db:"url"`
+	Domain string `json:"domain" db:"domain"`
+	Title  string `json:"title" db:"title"`
+}
+
+func loadLinkUnfurlConfig() error {
+	if v, ok := os.LookupEnv(linkUnfurlEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", linkUnfurlEnabledEnvKey, err)
+		}
+		linkUnfurlEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(linkAllowlistEnvKey); ok {
+		linkAllowlist = nil
+		for _, d := range splitCommaList(v) {
+			linkAllowlist = append(linkAllowlist, strings.ToLower(strings.TrimPrefix(d, ".")))
+		}
+	}
+	if v, ok := os.LookupEnv(linkMinAccountAgeSecondsEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as non-negative integer: %s", linkMinAccountAgeSecondsEnvKey, v)
+		}
+		linkMinAccountAge = time.Duration(sec) * time.Second
+	}
+	return nil
+}
+
+// commentLink はコメントから見つけたリンク
+type commentLink struct {
+	URL    string
+	Domain string
+}
+
+// findCommentLinks はコメント中の http(s) のリンクを出現順に返す (重複は除く)
+func findCommentLinks(comment string) []commentLink {
+	var links []commentLink
+	seen := map[string]bool{}
+	for _, raw := range linkPattern.FindAllString(comment, -1) {
+		raw = strings.TrimRight(raw, ".,!?:;)]}'\"」』）。、")
+		if strings.HasPrefix(strings.ToLower(raw), "www.") {
+			raw = "http://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		links = append(links, commentLink{URL: u.String(), Domain: strings.ToLower(u.Hostname())})
+	}
+	return links
+}
+
+// isAllowlistedLinkHost は許可したドメイン (とそのサブドメイン) かを返す
+func isAllowlistedLinkHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, d := range linkAllowlist {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLivecommentLinks は登録直後のアカウントからの、許可していないドメインへのリンクを拒否する
+// 配信者本人は対象外
+func checkLivecommentLinks(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64, comment string) error {
+	if linkMinAccountAge <= 0 || livestreamModel.UserID == userID {
+		return nil
+	}
+	var blocked bool
+	for _, link := range findCommentLinks(comment) {
+		if !isAllowlistedLinkHost(link.Domain) {
+			blocked = true
+			break
+		}
+	}
+	if !blocked {
+		return nil
+	}
+
+	var createdAt int64
+	if err := tx.GetContext(ctx, &createdAt, "SELECT created_at FROM users WHERE id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+	}
+	if clock.Now().Unix()-createdAt < int64(linkMinAccountAge/time.Second) {
+		return newReasonedError(http.StatusBadRequest, livecommentReasonNewAccountLink, "new accounts can't post links to this domain")
+	}
+	return nil
+}
+
+func linkURLHash(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
+
+// enqueueLinkUnfurls はコメント中の許可したドメインのリンクを展開待ちに積む
+// 同じ URL は使い回し、linkUnfurlCacheTTL より古ければ取り直す。投稿と同じトランザクションで呼ぶこと
+func enqueueLinkUnfurls(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) error {
+	if !linkUnfurlEnabled {
+		return nil
+	}
+	var position int
+	for _, link := range findCommentLinks(livecommentModel.Comment) {
+		if position >= maxLinkUnfurlsPerComment {
+			break
+		}
+		if !isAllowlistedLinkHost(link.Domain) {
+			continue
+		}
+		hash := linkURLHash(link.URL)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO link_unfurls (url_hash, url, domain, status, requested_at) VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE status = IF(status <> ? AND fetched_at < ?, ?, status)`,
+			hash, link.URL, link.Domain, linkUnfurlStatusPending, livecommentModel.CreatedAt,
+			linkUnfurlStatusPending, livecommentModel.CreatedAt-int64(linkUnfurlCacheTTL/time.Second), linkUnfurlStatusPending); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livecomment_links (livecomment_id, url_hash, position) VALUES (?, ?, ?)", livecommentModel.ID, hash, position); err != nil {
+			return err
+		}
+		position++
+	}
+	return nil
+}
+
+// wakeLinkUnfurlWorker は展開ワーカーを起こす (コミット後に呼ぶ)
+func wakeLinkUnfurlWorker() {
+	if !linkUnfurlEnabled {
+		return
+	}
+	select {
+	case linkUnfurlWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runLinkUnfurlWorker は展開待ちのリンクのタイトルを取得し続ける
+func runLinkUnfurlWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(linkUnfurlWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-linkUnfurlWakeup:
+		}
+		if err := unfurlPendingLinks(ctx, logger); err != nil {
+			logger.Warnf("failed to unfurl links: %v", err)
+		}
+	}
+}
+
+type pendingLinkUnfurl struct {
+	URLHash string `db:"url_hash"`
+	URL     string `db:"url"`
+	Domain  string `db:"domain"`
+}
+
+func unfurlPendingLinks(ctx context.Context, logger echo.Logger) error {
+	var pendings []pendingLinkUnfurl
+	if err := dbConn.SelectContext(ctx, &pendings, "SELECT url_hash, url, domain FROM link_unfurls WHERE status = ? ORDER BY requested_at LIMIT ?", linkUnfurlStatusPending, linkUnfurlWorkerBatchSize); err != nil {
+		return err
+	}
+
+	for _, p := range pendings {
+		status := linkUnfurlStatusReady
+		var title string
+		err := getCircuitBreaker(circuitLinkUnfurlPrefix + p.Domain).Do(func() error {
+			var err error
+			title, err = fetchLinkTitle(ctx, p.URL)
+			return err
+		})
+		if errors.Is(err, errCircuitOpen) {
+			// 遮断中は次回に回す
+			continue
+		}
+		if err != nil {
+			logger.Warnf("failed to unfurl %s: %v", p.URL, err)
+			status = linkUnfurlStatusFailed
+		}
+		if _, err := dbConn.ExecContext(ctx, "UPDATE link_unfurls SET status = ?, title = ?, fetched_at = ? WHERE url_hash = ?", status, title, clock.Now().Unix(), p.URLHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchLinkTitle はページのタイトル (og:title があればそちら) を返す
+func fetchLinkTitle(ctx context.Context, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "isupipe-unfurl/1.0")
+	req.Header.Set("Accept", "text/html")
+	resp, err := linkUnfurlClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unfurl returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLinkUnfurlBodyBytes))
+	if err != nil {
+		return "", err
+	}
+
+	var title string
+	if m := ogTitlePattern.FindSubmatch(body); m != nil {
+		title = string(m[1])
+	} else if m := titlePattern.FindSubmatch(body); m != nil {
+		title = string(m[1])
+	}
+	title = strings.Join(strings.Fields(html.UnescapeString(title)), " ")
+	if runes := []rune(title); len(runes) > maxLinkUnfurlTitleLength {
+		title = string(runes[:maxLinkUnfurlTitleLength]) + "…"
+	}
+	return title, nil
+}
+
+// linkPreviewsOf は取得済みのリンクのプレビューを返す (展開が無効なら引かない)
+func linkPreviewsOf(ctx context.Context, tx *sqlx.Tx, livecommentID int64) ([]LinkPreview, error) {
+	if !linkUnfurlEnabled {
+		return nil, nil
+	}
+	var previews []LinkPreview
+	if err := tx.SelectContext(ctx, &previews, `
+		SELECT u.url, u.domain, u.title FROM livecomment_links l
+		INNER JOIN link_unfurls u ON u.url_hash = l.url_hash
+		WHERE l.livecomment_id = ? AND u.status = ?
+		ORDER BY l.position`, livecommentID, linkUnfurlStatusReady); err != nil {
+		return nil, err
+	}
+	return previews, nil
+}
@@ -8,7 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"time"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
@@ -21,12 +21,13 @@ type PostLivecommentRequest struct {
 }
 
 type LivecommentModel struct {
-	ID           int64  `db:"id"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	Comment      string `db:"comment"`
-	Tip          int64  `db:"tip"`
-	CreatedAt    int64  `db:"created_at"`
+	ID           int64  `db:"id" json:"id"`
+	UserID       int64  `db:"user_id" json:"user_id"`
+	LivestreamID int64  `db:"livestream_id" json:"livestream_id"`
+	Comment      string `db:"comment" json:"comment"`
+	Tip          int64  `db:"tip" json:"tip"`
+	CommentType  string `db:"comment_type" json:"comment_type"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
 }
 
 type Livecomment struct {
@@ -35,22 +36,37 @@ type Livecomment struct {
 	Livestream Livestream `json:"livestream"`
 	Comment    string     `json:"comment"`
 	Tip        int64      `json:"tip"`
-	CreatedAt  int64      `json:"created_at"`
+	// user, system, bot のいずれか
+	CommentType string `json:"comment_type"`
+	CreatedAt   int64  `json:"created_at"`
+	// 取得済みのリンクのプレビュー (リンクの展開が有効な場合のみ)
+	Links []LinkPreview `json:"links,omitempty"`
+	// 配信のチャンネルのメンバーの場合のみ入る (プランの表示)
+	MemberFlair string `json:"member_flair,omitempty"`
+	// コメント中のチャンネルのカスタム絵文字
+	Emotes []EmoteSpan `json:"emotes,omitempty"`
 }
 
 type LivecommentReport struct {
 	ID          int64       `json:"id"`
 	Reporter    User        `json:"reporter"`
 	Livecomment Livecomment `json:"livecomment"`
-	CreatedAt   int64       `json:"created_at"`
+	// 自動採点で作られた報告の場合のみ入る
+	Source    string `json:"source,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	// 解決済みの場合のみ入る
+	ResolvedAt int64 `json:"resolved_at,omitempty"`
 }
 
 type LivecommentReportModel struct {
-	ID            int64 `db:"id"`
-	UserID        int64 `db:"user_id"`
-	LivestreamID  int64 `db:"livestream_id"`
-	LivecommentID int64 `db:"livecomment_id"`
-	CreatedAt     int64 `db:"created_at"`
+	ID            int64  `db:"id" json:"id"`
+	UserID        int64  `db:"user_id" json:"user_id"`
+	LivestreamID  int64  `db:"livestream_id" json:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id" json:"livecomment_id"`
+	Source        string `db:"source" json:"source"`
+	CreatedAt     int64  `db:"created_at" json:"created_at"`
+	// 未解決なら 0
+	ResolvedAt int64 `db:"resolved_at" json:"resolved_at"`
 }
 
 type ModerateRequest struct {
@@ -65,6 +81,38 @@ type NGWord struct {
 	CreatedAt    int64  `json:"created_at" db:"created_at"`
 }
 
+const (
+	// limit が無い場合に最初に確保しておくコメント数
+	defaultLivecommentBufferSize = 64
+	// これより大きいバッファは使い回さない (一度だけの大きな取得でメモリを抱え続けないため)
+	maxPooledLivecommentBufferSize = 1000
+)
+
+// livecommentBufferPool はコメント一覧のレスポンスを組み立てるバッファ
+// 一覧の取得はポーリングで最も多く呼ばれるので、リクエストごとに確保し直さない
+var livecommentBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]Livecomment, 0, defaultLivecommentBufferSize)
+		return &buf
+	},
+}
+
+func getLivecommentBuffer() *[]Livecomment {
+	return livecommentBufferPool.Get().(*[]Livecomment)
+}
+
+// putLivecommentBuffer はレスポンスを書き終えたバッファを戻す
+func putLivecommentBuffer(buf *[]Livecomment) {
+	if cap(*buf) > maxPooledLivecommentBufferSize {
+		return
+	}
+	// 前のリクエストのユーザや配信を抱えたままにしない
+	s := (*buf)[:cap(*buf)]
+	clear(s)
+	*buf = s[:0]
+	livecommentBufferPool.Put(buf)
+}
+
 func getLivecommentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -78,45 +126,95 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	q := newSelectQuery("SELECT * FROM "+livecommentTable(int64(livestreamID))).
+		Where("livestream_id = ?", livestreamID).
+		OrderBy("created_at DESC")
+	if err := q.WhereInListParam(c, "type", "comment_type", isValidLivecommentType); err != nil {
+		return err
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	// v1 はレスポンスが配列なので、省いた配信は返さない (配信は URL の livestream_id で分かる)
+	embed, err := embedLivestreamParam(c, true)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
 	}
-	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	excludeHeldLivecomments(q, int64(livestreamID), userID)
+	query, args := q.Build()
+	// 件数を数えるクエリは往復が増えるので、limit が無い場合は伸びるに任せる
+	capacity := min(q.LimitOr(defaultLivecommentBufferSize), maxPooledLivecommentBufferSize)
+
+	buf := getLivecommentBuffer()
+	defer putLivecommentBuffer(buf)
+	livecomments := *buf
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, int64(livestreamID), userID); err != nil {
+			return err
+		}
+
+		livecommentModels := make([]LivecommentModel, 0, capacity)
+		if err := tx.SelectContext(ctx, &livecommentModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error()).SetInternal(err)
+		}
+		livecommentModels, err := filterMutedLivecomments(ctx, userID, livecommentModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to filter muted livecomments: "+err.Error()).SetInternal(err)
+		}
+
+		// リトライされても前回の途中結果が残らないよう、毎回先頭から詰める
+		livecomments, err = appendLivecommentResponses(ctx, tx, (*buf)[:0], livecommentModels)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error()).SetInternal(err)
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+		*buf = livecomments
+
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+	if !embed {
+		return c.JSON(http.StatusOK, compactLivecomments(livecomments))
 	}
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	return c.JSON(http.StatusOK, livecomments)
+}
+
+// fillLivecommentResponses は投稿者をまとめて取得してからレスポンスを組み立てる
+func fillLivecommentResponses(ctx context.Context, tx *sqlx.Tx, livecommentModels []LivecommentModel) ([]Livecomment, error) {
+	return appendLivecommentResponses(ctx, tx, make([]Livecomment, 0, len(livecommentModels)), livecommentModels)
+}
+
+// appendLivecommentResponses は組み立てたレスポンスを dst に追記する
+// 一覧のコメントはほとんど同じ配信のものなので、配信のレスポンスは配信ごとに1回だけ組み立てる
+func appendLivecommentResponses(ctx context.Context, tx *sqlx.Tx, dst []Livecomment, livecommentModels []LivecommentModel) ([]Livecomment, error) {
+	userIDs := make([]int64, len(livecommentModels))
+	for i := range livecommentModels {
+		userIDs[i] = livecommentModels[i].UserID
+	}
+	if err := loaderFrom(ctx).primeUsers(ctx, tx, userIDs); err != nil {
+		return nil, err
 	}
 
-	livecomments := make([]Livecomment, len(livecommentModels))
+	livestreams := filledLivestreams{}
 	for i := range livecommentModels {
-		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i])
+		ls, err := livestreams.get(ctx, tx, livecommentModels[i].LivestreamID)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
+			return nil, err
 		}
-
-		livecomments[i] = livecomment
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		livecomment, err := fillLivecommentResponseFor(ctx, tx, livecommentModels[i], ls.model, ls.response)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, livecomment)
 	}
-
-	return c.JSON(http.StatusOK, livecomments)
+	return dst, nil
 }
 
 func getNgwords(c echo.Context) error {
@@ -136,23 +234,14 @@ func getNgwords(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.JSON(http.StatusOK, []*NGWord{})
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error()).SetInternal(err)
 		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, ngWords)
@@ -181,73 +270,120 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	clientMetadata := resolveClientMetadata(ctx, c)
+
+	var (
+		livecomment  Livecomment
+		rankingDelta leaderboardDelta
+		goalWebhooks []donationGoalWebhook
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+			}
 		}
-	}
 
-	// スパム判定
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
-	}
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamModel.ID, userID); err != nil {
+			return err
+		}
+		if err := checkLivecommentCooldown(ctx, tx, livestreamModel, userID); err != nil {
+			return err
+		}
+		if err := checkLivecommentRules(ctx, tx, livestreamModel, userID, req.Comment); err != nil {
+			return err
+		}
+		if err := checkLivecommentLinks(ctx, tx, livestreamModel, userID, req.Comment); err != nil {
+			return err
+		}
 
-	var hitSpam int
-	for _, ngword := range ngwords {
-		query := `
-		SELECT COUNT(*)
-		FROM
-		(SELECT ? AS text) AS texts
-		INNER JOIN
-		(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-		ON texts.text LIKE patterns.pattern;
-		`
-		if err := tx.GetContext(ctx, &hitSpam, query, req.Comment, ngword.Word); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
+		// スパム判定 (配信のNGワード + 購読しているブロックリスト)
+		spamWords, err := fetchSpamWords(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error()).SetInternal(err)
 		}
-		c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
-		if hitSpam >= 1 {
+		if matchNGWords(req.Comment, spamWords) {
+			c.Logger().Infof("[hitSpam] comment = %s", req.Comment)
 			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 		}
-	}
+		var signals spamSignals
+		spamScoring := spamScoreEnabled && featureAllowed(featureFlagSpamScore, userID)
+		if spamScoring {
+			signals, err = computeSpamSignals(ctx, tx, userID, req.Comment, spamWords)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to compute spam score: "+err.Error()).SetInternal(err)
+			}
+		}
 
-	now := time.Now().Unix()
-	livecommentModel := LivecommentModel{
-		UserID:       userID,
-		LivestreamID: int64(livestreamID),
-		Comment:      req.Comment,
-		Tip:          req.Tip,
-		CreatedAt:    now,
-	}
+		now := clock.Now().Unix()
+		livecommentModel := LivecommentModel{
+			UserID:       userID,
+			LivestreamID: int64(livestreamID),
+			Comment:      req.Comment,
+			Tip:          req.Tip,
+			CommentType:  livecommentTypeUser,
+			CreatedAt:    now,
+		}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
-	}
+		if err := insertLivecomment(ctx, tx, &livecommentModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error()).SetInternal(err)
+		}
 
-	livecommentID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
-	}
-	livecommentModel.ID = livecommentID
+		if err := insertClientMetadata(ctx, tx, clientMetadata, auditTargetLivecomment, livecommentModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert client metadata: "+err.Error()).SetInternal(err)
+		}
+		if spamScoring {
+			if err := holdSpamLivecomment(ctx, tx, livecommentModel, signals); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to hold spam livecomment: "+err.Error()).SetInternal(err)
+			}
+		}
+		if err := enqueueToxicityScoring(ctx, tx, livecommentModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue toxicity scoring: "+err.Error()).SetInternal(err)
+		}
+		if err := enqueueLinkUnfurls(ctx, tx, livecommentModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue link unfurls: "+err.Error()).SetInternal(err)
+		}
+		if err := enqueueLanguageDetection(ctx, tx, livecommentModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue language detection: "+err.Error()).SetInternal(err)
+		}
+		if err := insertPaymentLedgerEntry(ctx, tx, livecommentModel, livestreamModel.UserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert payment ledger entry: "+err.Error()).SetInternal(err)
+		}
+		goalWebhooks, err = addDonationGoalProgress(ctx, tx, livestreamModel.UserID, livestreamModel.ID, req.Tip)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update donation goals: "+err.Error()).SetInternal(err)
+		}
+		if err := emitLivecommentEvents(ctx, tx, livecommentModel, livestreamModel.UserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to emit livecomment events: "+err.Error()).SetInternal(err)
+		}
+		rankingDelta, err = newLeaderboardDelta(ctx, tx, livestreamModel.ID, req.Tip, 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get leaderboard delta: "+err.Error()).SetInternal(err)
+		}
+		if err := processChatCommand(ctx, tx, livestreamModel, userID, req.Comment); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to process chat command: "+err.Error()).SetInternal(err)
+		}
 
-	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
-	}
+		livecomment, err = fillLivecommentResponse(ctx, tx, livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error()).SetInternal(err)
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
+	}
+	wakeToxicityWorker()
+	wakeLinkUnfurlWorker()
+	wakeLanguageDetectionWorker()
+	markLivecommentTrimPending(int64(livestreamID))
+	applyLeaderboardDelta(ctx, c.Logger(), rankingDelta)
+	if len(goalWebhooks) > 0 {
+		// 送り先が遅くてもコメントの投稿は待たせない
+		go sendDonationGoalWebhooks(context.WithoutCancel(ctx), c.Logger(), goalWebhooks)
 	}
 
 	return c.JSON(http.StatusCreated, livecomment)
@@ -275,53 +411,63 @@ func reportLivecommentHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	clientMetadata := resolveClientMetadata(ctx, c)
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	var report LivecommentReport
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+			}
 		}
-	}
 
-	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+		var livecommentModel LivecommentModel
+		if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM "+livecommentTable(int64(livestreamID))+" WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error()).SetInternal(err)
+			}
+		}
+		if livecommentModel.CommentType != livecommentTypeUser {
+			return echo.NewHTTPError(http.StatusBadRequest, "only livecomments posted by users can be reported")
 		}
-	}
 
-	now := time.Now().Unix()
-	reportModel := LivecommentReportModel{
-		UserID:        int64(userID),
-		LivestreamID:  int64(livestreamID),
-		LivecommentID: int64(livecommentID),
-		CreatedAt:     now,
-	}
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
-	}
-	reportID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
-	}
-	reportModel.ID = reportID
+		now := clock.Now().Unix()
+		reportModel := LivecommentReportModel{
+			UserID:        int64(userID),
+			LivestreamID:  int64(livestreamID),
+			LivecommentID: int64(livecommentID),
+			Source:        livecommentReportSourceUser,
+			CreatedAt:     now,
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, source, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :source, :created_at)", &reportModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error()).SetInternal(err)
+		}
+		reportID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error()).SetInternal(err)
+		}
+		reportModel.ID = reportID
 
-	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
-	}
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		if err := insertAuditLog(ctx, tx, userID, auditActionReportCreate, auditTargetLivecommentReport, reportID, int64(livestreamID), nil, reportModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		if err := insertClientMetadata(ctx, tx, clientMetadata, auditTargetLivecommentReport, reportID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert client metadata: "+err.Error()).SetInternal(err)
+		}
+
+		report, err = fillLivecommentReportResponse(ctx, tx, reportModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusCreated, report)
@@ -351,71 +497,109 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	var (
+		wordID       int64
+		rankingDelta leaderboardDelta
+		deletedIDs   []int64
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := checkQuota(ctx, tx, userID, quotaNGWords, int64(livestreamID)); err != nil {
+			return err
+		}
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-	if len(ownedLivestreams) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
-	}
+		ngWord := NGWord{
+			UserID:       int64(userID),
+			LivestreamID: int64(livestreamID),
+			Word:         req.NGWord,
+			CreatedAt:    clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &ngWord)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error()).SetInternal(err)
+		}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		Word:         req.NGWord,
-		CreatedAt:    time.Now().Unix(),
-	})
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
-	}
+		wordID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error()).SetInternal(err)
+		}
+		ngWord.ID = wordID
 
-	wordID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
-	}
-
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
-	}
-
-	// NGワードにヒットする過去の投稿も全削除する
-	for _, ngword := range ngwords {
-		// ライブコメント一覧取得
-		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments"); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
-		}
-
-		for _, livecomment := range livecomments {
-			query := `
-			DELETE FROM livecomments
-			WHERE
-			id = ? AND
-			livestream_id = ? AND
-			(SELECT COUNT(*)
-			FROM
-			(SELECT ? AS text) AS texts
-			INNER JOIN
-			(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-			ON texts.text LIKE patterns.pattern) >= 1;
-			`
-			if _, err := tx.ExecContext(ctx, query, livecomment.ID, livestreamID, livecomment.Comment, ngword.Word); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+		if err := insertAuditLog(ctx, tx, userID, auditActionNGWordAdd, auditTargetNGWord, wordID, int64(livestreamID), nil, ngWord); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+
+		var ngwords []*NGWord
+		if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error()).SetInternal(err)
+		}
+
+		// NGワードにヒットする過去の投稿も全削除する
+		var totalDeleted, deletedTips int64
+		deletedIDs = nil
+		for _, ngword := range ngwords {
+			// ライブコメント一覧取得
+			var livecomments []*LivecommentModel
+			if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM "+livecommentTable(int64(livestreamID))+" WHERE livestream_id = ?", livestreamID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error()).SetInternal(err)
+			}
+
+			for _, livecomment := range livecomments {
+				query := `
+				DELETE FROM ` + livecommentTable(int64(livestreamID)) + `
+				WHERE
+				id = ? AND
+				livestream_id = ? AND
+				(SELECT COUNT(*)
+				FROM
+				(SELECT ? AS text) AS texts
+				INNER JOIN
+				(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
+				ON texts.text LIKE patterns.pattern) >= 1;
+				`
+				rs, err := tx.ExecContext(ctx, query, livecomment.ID, livestreamID, livecomment.Comment, ngword.Word)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error()).SetInternal(err)
+				}
+				deleted, err := rs.RowsAffected()
+				if err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted livecomments count: "+err.Error()).SetInternal(err)
+				}
+				totalDeleted += deleted
+				if deleted > 0 {
+					deletedTips += livecomment.Tip
+					deletedIDs = append(deletedIDs, livecomment.ID)
+					if err := insertAuditLog(ctx, tx, userID, auditActionLivecommentDelete, auditTargetLivecomment, livecomment.ID, int64(livestreamID), livecomment, nil); err != nil {
+						return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+					}
+				}
 			}
 		}
-	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		if err := resolveLivecommentReports(ctx, tx, int64(livestreamID), deletedIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to resolve livecomment reports: "+err.Error()).SetInternal(err)
+		}
+		if rankingDelta, err = newLeaderboardDelta(ctx, tx, int64(livestreamID), -deletedTips, 0); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get leaderboard delta: "+err.Error()).SetInternal(err)
+		}
+
+		if moderationNoticeEnabled && totalDeleted > 0 {
+			if err := insertServerLivecomment(ctx, tx, int64(livestreamID), userID, livecommentTypeSystem, fmt.Sprintf("%d件のコメントがモデレーションにより削除されました", totalDeleted)); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert moderation notice: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
+	applyLeaderboardDelta(ctx, c.Logger(), rankingDelta)
+	publishModerationEvent(ctx, c.Logger(), ModerationBroadcast{
+		Type:           moderationEventLivecommentsDeleted,
+		LivestreamID:   int64(livestreamID),
+		LivecommentIDs: deletedIDs,
+		Reason:         moderationReasonNGWord,
+		CreatedAt:      clock.Now().Unix(),
+	})
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"word_id": wordID,
@@ -423,60 +607,85 @@ func moderateHandler(c echo.Context) error {
 }
 
 func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) (Livecomment, error) {
-	commentOwnerModel := UserModel{}
-	if err := tx.GetContext(ctx, &commentOwnerModel, "SELECT * FROM users WHERE id = ?", livecommentModel.UserID); err != nil {
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livecommentModel.LivestreamID); err != nil {
 		return Livecomment{}, err
 	}
-	commentOwner, err := fillUserResponse(ctx, tx, commentOwnerModel)
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return Livecomment{}, err
 	}
+	return fillLivecommentResponseFor(ctx, tx, livecommentModel, livestreamModel, livestream)
+}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livecommentModel.LivestreamID); err != nil {
+// fillLivecommentResponseFor は組み立て済みの配信のレスポンスを使ってコメントのレスポンスを組み立てる
+func fillLivecommentResponseFor(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel, livestreamModel LivestreamModel, livestream Livestream) (Livecomment, error) {
+	commentOwner, err := fillUserResponseByID(ctx, tx, livecommentModel.UserID)
+	if err != nil {
 		return Livecomment{}, err
 	}
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+
+	// commentOwner はローダーのキャッシュのコピーなので、書き換えても他に影響しない
+	commentOwner.Badges, err = badgesOf(ctx, tx, livestreamModel, commentOwner.ID)
+	if err != nil {
+		return Livecomment{}, err
+	}
+	links, err := linkPreviewsOf(ctx, tx, livecommentModel.ID)
+	if err != nil {
+		return Livecomment{}, err
+	}
+	memberFlair, err := memberFlairOf(ctx, tx, livestreamModel, commentOwner.ID)
+	if err != nil {
+		return Livecomment{}, err
+	}
+	emotes, err := emoteSpansOf(ctx, tx, livestreamModel, livecommentModel.Comment)
 	if err != nil {
 		return Livecomment{}, err
 	}
 
 	livecomment := Livecomment{
-		ID:         livecommentModel.ID,
-		User:       commentOwner,
-		Livestream: livestream,
-		Comment:    livecommentModel.Comment,
-		Tip:        livecommentModel.Tip,
-		CreatedAt:  livecommentModel.CreatedAt,
+		ID:          livecommentModel.ID,
+		User:        commentOwner,
+		Livestream:  livestream,
+		Comment:     livecommentModel.Comment,
+		Tip:         livecommentModel.Tip,
+		CommentType: livecommentModel.CommentType,
+		CreatedAt:   livecommentModel.CreatedAt,
+		Links:       links,
+		MemberFlair: memberFlair,
+		Emotes:      emotes,
 	}
 
 	return livecomment, nil
 }
 
 func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel LivecommentReportModel) (LivecommentReport, error) {
-	reporterModel := UserModel{}
-	if err := tx.GetContext(ctx, &reporterModel, "SELECT * FROM users WHERE id = ?", reportModel.UserID); err != nil {
-		return LivecommentReport{}, err
-	}
-	reporter, err := fillUserResponse(ctx, tx, reporterModel)
+	reporter, err := fillUserResponseByID(ctx, tx, reportModel.UserID)
 	if err != nil {
 		return LivecommentReport{}, err
 	}
 
-	livecommentModel := LivecommentModel{}
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", reportModel.LivecommentID); err != nil {
+	livecommentModel, err := getLivecommentWithArchive(ctx, tx, reportModel.LivestreamID, reportModel.LivecommentID)
+	if err != nil {
 		return LivecommentReport{}, err
 	}
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
 		return LivecommentReport{}, err
 	}
+	return newLivecommentReport(reportModel, reporter, livecomment), nil
+}
 
+func newLivecommentReport(reportModel LivecommentReportModel, reporter User, livecomment Livecomment) LivecommentReport {
 	report := LivecommentReport{
 		ID:          reportModel.ID,
 		Reporter:    reporter,
 		Livecomment: livecomment,
 		CreatedAt:   reportModel.CreatedAt,
+		ResolvedAt:  reportModel.ResolvedAt,
+	}
+	if reportModel.Source != livecommentReportSourceUser {
+		report.Source = reportModel.Source
 	}
-	return report, nil
+	return report
 }
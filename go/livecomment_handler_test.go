@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	echolog "github.com/labstack/gommon/log"
+)
+
+// コメント一覧のレスポンスの組み立てのベンチマーク
+// 初期データを入れた MySQL (ISUCON13_MYSQL_DIALCONFIG_* で指定) が必要で、つながらなければスキップする
+//
+//	go test -run '^$' -bench LivecommentResponses -benchmem .
+//
+// Append はハンドラと同じく livecommentBufferPool のバッファに詰め、Fill は毎回スライスを確保する
+
+const benchmarkLivecommentsLimit = 50
+
+// openBenchmarkLivecomments はコメントの最も多い配信のコメントを読み、ベンチマークで使うトランザクションを返す
+func openBenchmarkLivecomments(b *testing.B) (*sqlx.Tx, []LivecommentModel) {
+	b.Helper()
+
+	conn, err := connectDB(echolog.New("bench"))
+	if err != nil {
+		b.Skipf("mysql is not available: %v", err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	dbConn = conn
+
+	tx, err := conn.Beginx()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = tx.Rollback() })
+
+	var livestreamID int64
+	if err := tx.Get(&livestreamID, "SELECT livestream_id FROM livecomments GROUP BY livestream_id ORDER BY COUNT(*) DESC LIMIT 1"); err != nil {
+		b.Skipf("no livecomments in the database: %v", err)
+	}
+	var models []LivecommentModel
+	if err := tx.Select(&models, "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC LIMIT ?", livestreamID, benchmarkLivecommentsLimit); err != nil {
+		b.Fatal(err)
+	}
+	return tx, models
+}
+
+func BenchmarkAppendLivecommentResponses(b *testing.B) {
+	tx, models := openBenchmarkLivecomments(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// リクエストごとにローダーは作り直される
+		ctx := withRequestLoader(context.Background())
+		buf := getLivecommentBuffer()
+		livecomments, err := appendLivecommentResponses(ctx, tx, (*buf)[:0], models)
+		if err != nil {
+			b.Fatal(err)
+		}
+		*buf = livecomments
+		putLivecommentBuffer(buf)
+	}
+}
+
+func BenchmarkFillLivecommentResponses(b *testing.B) {
+	tx, models := openBenchmarkLivecomments(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := withRequestLoader(context.Background())
+		if _, err := fillLivecommentResponses(ctx, tx, models); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
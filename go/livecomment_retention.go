@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livecommentRetentionCapEnvKey = "ISUCON13_LIVECOMMENT_RETENTION_CAP"
+
+	livecommentTrimmerInterval = 30 * time.Second
+	// 1トランザクションで退避する件数
+	livecommentTrimBatchSize = 1000
+)
+
+// 配信ごとに livecomments に残すコメント数の上限 (超えた分は古い順に livecomments_archive に退避する)
+// 0 なら退避しない。デフォルトでは無効
+var livecommentRetentionCap int64
+
+// 退避が必要かもしれない配信 (コメントが投稿された配信)
+var (
+	livecommentTrimMu      sync.Mutex
+	livecommentTrimPending = map[int64]struct{}{}
+)
+
+func loadLivecommentRetentionConfig() error {
+	if v, ok := os.LookupEnv(livecommentRetentionCapEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as non-negative integer: %s", livecommentRetentionCapEnvKey, v)
+		}
+		livecommentRetentionCap = n
+	}
+	return nil
+}
+
+// livecommentsAggregateTable は集計クエリで使う livecomments のテーブル式を返す
+// 退避している場合はチップやコメント数が減らないよう、退避先も含めて集計する
+func livecommentsAggregateTable() string {
+	if livecommentRetentionCap <= 0 {
+		return livecommentsAllTable()
+	}
+	return `(
+		SELECT id, user_id, livestream_id, comment, tip, comment_type, created_at FROM ` + livecommentsAllTable() + ` lc
+		UNION ALL
+		SELECT id, user_id, livestream_id, comment, tip, comment_type, created_at FROM livecomments_archive
+	)`
+}
+
+// getLivecommentWithArchive は退避済みのコメントも含めてコメントを引く (報告一覧など、古いコメントを参照する箇所で使う)
+func getLivecommentWithArchive(ctx context.Context, tx *sqlx.Tx, livestreamID, livecommentID int64) (LivecommentModel, error) {
+	var m LivecommentModel
+	err := tx.GetContext(ctx, &m, "SELECT * FROM "+livecommentTable(livestreamID)+" WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.GetContext(ctx, &m, "SELECT id, user_id, livestream_id, comment, tip, comment_type, created_at FROM livecomments_archive WHERE id = ?", livecommentID)
+	}
+	return m, err
+}
+
+// markLivecommentTrimPending はコメントが増えた配信を退避の対象に積む
+func markLivecommentTrimPending(livestreamID int64) {
+	if livecommentRetentionCap <= 0 {
+		return
+	}
+	livecommentTrimMu.Lock()
+	livecommentTrimPending[livestreamID] = struct{}{}
+	livecommentTrimMu.Unlock()
+}
+
+func runLivecommentTrimmer(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(livecommentTrimmerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		livecommentTrimMu.Lock()
+		pending := livecommentTrimPending
+		livecommentTrimPending = map[int64]struct{}{}
+		livecommentTrimMu.Unlock()
+
+		for livestreamID := range pending {
+			if err := trimLivecomments(ctx, livestreamID); err != nil {
+				logger.Warnf("failed to trim livecomments of livestream %d: %v", livestreamID, err)
+				markLivecommentTrimPending(livestreamID)
+			}
+		}
+	}
+}
+
+// trimLivecomments は配信の新しい方から livecommentRetentionCap 件を残し、それより古いコメントを退避する
+func trimLivecomments(ctx context.Context, livestreamID int64) error {
+	table := livecommentTable(livestreamID)
+	for {
+		var archived int64
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			// 残す中で一番古いコメントより前のものを退避する
+			var boundaryIDs []int64
+			if err := tx.SelectContext(ctx, &boundaryIDs, "SELECT id FROM "+table+" WHERE livestream_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?", livestreamID, livecommentRetentionCap-1); err != nil {
+				return err
+			}
+			if len(boundaryIDs) == 0 {
+				return nil
+			}
+
+			var ids []int64
+			if err := tx.SelectContext(ctx, &ids, "SELECT id FROM "+table+" WHERE livestream_id = ? AND id < ? ORDER BY id LIMIT ? FOR UPDATE", livestreamID, boundaryIDs[0], livecommentTrimBatchSize); err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+
+			query, args, err := sqlx.In(`
+				INSERT INTO livecomments_archive (id, user_id, livestream_id, comment, tip, comment_type, created_at, archived_at)
+				SELECT id, user_id, livestream_id, comment, tip, comment_type, created_at, ? FROM `+table+` WHERE livestream_id = ? AND id IN (?)`, clock.Now().Unix(), livestreamID, ids)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+			query, args, err = sqlx.In("DELETE FROM "+table+" WHERE livestream_id = ? AND id IN (?)", livestreamID, ids)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+			archived = int64(len(ids))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if archived < livecommentTrimBatchSize {
+			return nil
+		}
+	}
+}
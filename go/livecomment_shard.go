@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	livecommentShardsEnvKey = "ISUCON13_LIVECOMMENT_SHARDS"
+
+	maxLivecommentShards = 64
+	// シャード分割時に ID を払い出すテーブル (1行だけ持つ)
+	livecommentIDSequenceTable = "livecomment_id_seq"
+)
+
+// ライブコメントを livestream_id のハッシュで livecomments_shard_N テーブルに振り分ける数
+// 0 なら分割せず livecomments だけを使う。デフォルトでは無効 (お試し段階)
+//
+// 配信を指定した読み書きは livecommentTable で1つのシャードに絞り、それ以外は全シャードをまとめて引く
+// 同じトランザクションで他のテーブルと JOIN するので、シャードは同じデータベースの中に作る
+var livecommentShards int
+
+func loadLivecommentShardConfig() error {
+	if v, ok := os.LookupEnv(livecommentShardsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxLivecommentShards {
+			return fmt.Errorf("failed to parse environment variable '%s' as integer between 0 and %d: %s", livecommentShardsEnvKey, maxLivecommentShards, v)
+		}
+		livecommentShards = n
+	}
+	return nil
+}
+
+// livecommentShardOf は配信のコメントを置くシャードの番号を返す
+// MySQL の CRC32(livestream_id) % N と同じ値になる (既存データの振り分けで使う)
+func livecommentShardOf(livestreamID int64) int {
+	return int(crc32.ChecksumIEEE([]byte(strconv.FormatInt(livestreamID, 10))) % uint32(livecommentShards))
+}
+
+func livecommentShardTable(shard int) string {
+	return "livecomments_shard_" + strconv.Itoa(shard)
+}
+
+// livecommentHotTable は配信のコメントを書き込むテーブル名を返す
+func livecommentHotTable(livestreamID int64) string {
+	if livecommentShards <= 0 {
+		return "livecomments"
+	}
+	return livecommentShardTable(livecommentShardOf(livestreamID))
+}
+
+// livecommentTable は配信のコメントを読む (書き込み以外で使う) テーブル名を返す
+// cold に移した配信は livecomments_cold になる
+func livecommentTable(livestreamID int64) string {
+	if isColdLivestream(livestreamID) {
+		return livecommentsColdTable
+	}
+	return livecommentHotTable(livestreamID)
+}
+
+// livecommentsAllTable は配信を絞らずにコメントを引くときのテーブル式を返す (別名を付けて使う)
+func livecommentsAllTable() string {
+	if livecommentShards <= 0 {
+		return hotColdUnion([]string{"livecomments"}, livecommentsColdTable)
+	}
+	tables := make([]string, livecommentShards)
+	for i := range tables {
+		tables[i] = livecommentShardTable(i)
+	}
+	return hotColdUnion(tables, livecommentsColdTable)
+}
+
+// allocateLivecommentIDs は n 件分の連続した ID を払い出し、先頭の ID を返す
+// シャードごとの AUTO_INCREMENT では ID が重複するため、1つの連番から取る
+// 行ロックを投稿のトランザクションの間持ち続けないよう、トランザクションの外で払い出す (ロールバックすると欠番になる)
+func allocateLivecommentIDs(ctx context.Context, n int) (int64, error) {
+	rs, err := dbConn.ExecContext(ctx, "UPDATE "+livecommentIDSequenceTable+" SET id = LAST_INSERT_ID(id + ?)", n)
+	if err != nil {
+		return 0, err
+	}
+	last, err := rs.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return last - int64(n) + 1, nil
+}
+
+// insertLivecomment はコメントを配信のシャードに書き込み、m.ID に ID を入れる
+// cold に移した配信の分は書いてから cold に移す
+func insertLivecomment(ctx context.Context, tx *sqlx.Tx, m *LivecommentModel) error {
+	if livecommentShards <= 0 {
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, comment_type, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :comment_type, :created_at)", m)
+		if err != nil {
+			return err
+		}
+		if m.ID, err = rs.LastInsertId(); err != nil {
+			return err
+		}
+	} else {
+		id, err := allocateLivecommentIDs(ctx, 1)
+		if err != nil {
+			return fmt.Errorf("failed to allocate livecomment id: %w", err)
+		}
+		m.ID = id
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO "+livecommentHotTable(m.LivestreamID)+" (id, user_id, livestream_id, comment, tip, comment_type, created_at) VALUES (:id, :user_id, :livestream_id, :comment, :tip, :comment_type, :created_at)", m); err != nil {
+			return err
+		}
+	}
+	if isColdLivestream(m.LivestreamID) {
+		return moveLateRowsToCold(ctx, tx, m.LivestreamID)
+	}
+	return nil
+}
+
+// insertLivecomments はコメントをまとめて書き込む (ID は返さない)
+func insertLivecomments(ctx context.Context, tx *sqlx.Tx, ms []LivecommentModel) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	if livecommentShards <= 0 {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, comment_type, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :comment_type, :created_at)", ms); err != nil {
+			return err
+		}
+	} else {
+		first, err := allocateLivecommentIDs(ctx, len(ms))
+		if err != nil {
+			return fmt.Errorf("failed to allocate livecomment ids: %w", err)
+		}
+		byTable := map[string][]LivecommentModel{}
+		for i, m := range ms {
+			m.ID = first + int64(i)
+			table := livecommentHotTable(m.LivestreamID)
+			byTable[table] = append(byTable[table], m)
+		}
+		for table, rows := range byTable {
+			if _, err := tx.NamedExecContext(ctx, "INSERT INTO "+table+" (id, user_id, livestream_id, comment, tip, comment_type, created_at) VALUES (:id, :user_id, :livestream_id, :comment, :tip, :comment_type, :created_at)", rows); err != nil {
+				return err
+			}
+		}
+	}
+
+	moved := map[int64]bool{}
+	for _, m := range ms {
+		if !moved[m.LivestreamID] && isColdLivestream(m.LivestreamID) {
+			if err := moveLateRowsToCold(ctx, tx, m.LivestreamID); err != nil {
+				return err
+			}
+			moved[m.LivestreamID] = true
+		}
+	}
+	return nil
+}
+
+// prepareLivecommentShards はシャードのテーブルを用意し、livecomments に残っているコメントをシャードに移す
+// reset なら先にシャードを空にする (初期化で livecomments を入れ直したとき)
+func prepareLivecommentShards(ctx context.Context, reset bool) error {
+	if livecommentShards <= 0 {
+		return nil
+	}
+
+	// DDL は暗黙にコミットされるので、トランザクションの外で流す
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS " + livecommentIDSequenceTable + " (id BIGINT NOT NULL) ENGINE=InnoDB",
+		"INSERT INTO " + livecommentIDSequenceTable + " (id) SELECT 0 FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM " + livecommentIDSequenceTable + ")",
+	}
+	for i := 0; i < livecommentShards; i++ {
+		stmts = append(stmts, "CREATE TABLE IF NOT EXISTS "+livecommentShardTable(i)+" LIKE livecomments")
+		if reset {
+			stmts = append(stmts, "TRUNCATE TABLE "+livecommentShardTable(i))
+		}
+	}
+	for _, stmt := range stmts {
+		if _, err := dbConn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		for i := 0; i < livecommentShards; i++ {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO "+livecommentShardTable(i)+" SELECT * FROM livecomments WHERE CRC32(livestream_id) % ? = ?", livecommentShards, i); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livecomments"); err != nil {
+			return err
+		}
+
+		// 退避済みのコメントも同じ連番から取った ID を持つ
+		var maxID int64
+		if err := tx.GetContext(ctx, &maxID, "SELECT GREATEST((SELECT IFNULL(MAX(id), 0) FROM "+livecommentsAllTable()+" lc), (SELECT IFNULL(MAX(id), 0) FROM livecomments_archive))"); err != nil {
+			return err
+		}
+		if reset {
+			_, err := tx.ExecContext(ctx, "UPDATE "+livecommentIDSequenceTable+" SET id = ?", maxID)
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE "+livecommentIDSequenceTable+" SET id = GREATEST(id, ?)", maxID)
+		return err
+	})
+}
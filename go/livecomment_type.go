@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	moderationNoticeEnabledEnvKey = "ISUCON13_MODERATION_NOTICE_ENABLED"
+
+	// ユーザが投稿したコメント
+	livecommentTypeUser = "user"
+	// レイドやモデレーションなど、サーバが投稿する通知
+	livecommentTypeSystem = "system"
+	// 配信者が連携したボットの投稿
+	livecommentTypeBot = "bot"
+)
+
+// モデレーションでコメントを消したときにチャットへ通知を流すか
+// ベンチマーカーはコメント一覧を検証するので、デフォルトでは無効
+var moderationNoticeEnabled = false
+
+func loadLivecommentTypeConfig() error {
+	if v, ok := os.LookupEnv(moderationNoticeEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", moderationNoticeEnabledEnvKey, err)
+		}
+		moderationNoticeEnabled = enabled
+	}
+	return nil
+}
+
+func isValidLivecommentType(t string) bool {
+	switch t {
+	case livecommentTypeUser, livecommentTypeSystem, livecommentTypeBot:
+		return true
+	}
+	return false
+}
+
+// insertServerLivecomment はサーバ側からの通知 (system) やボットの投稿 (bot) をライブコメントとして投稿する
+// userID には通知の送り主 (レイドした配信者、モデレーションした配信者など) を入れる
+func insertServerLivecomment(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64, commentType, comment string) error {
+	return insertLivecomment(ctx, tx, &LivecommentModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		Comment:      comment,
+		CommentType:  commentType,
+		CreatedAt:    clock.Now().Unix(),
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 1つの配信のコメント一覧では、どのコメントにも同じ配信 (配信者込み) が埋め込まれる
+// embed_livestream=false を指定すると項目からは省き、一覧の最上位で1回だけ返す
+// v1 は互換のためデフォルトで埋め込み、v2 はデフォルトで省く
+
+// embedLivestreamParam は embed_livestream クエリパラメータを読む (指定が無ければ def)
+func embedLivestreamParam(c echo.Context, def bool) (bool, error) {
+	v := c.QueryParam("embed_livestream")
+	if v == "" {
+		return def, nil
+	}
+	embed, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "embed_livestream query parameter must be bool")
+	}
+	return embed, nil
+}
+
+// compactLivecomment は配信を省いたコメント
+// 同じ JSON 名のフィールドで Livecomment.Livestream を隠す
+type compactLivecomment struct {
+	Livecomment
+	Livestream *struct{} `json:"livestream,omitempty"`
+}
+
+type compactLivecommentReport struct {
+	LivecommentReport
+	Livecomment compactLivecomment `json:"livecomment"`
+}
+
+func compactLivecomments(livecomments []Livecomment) []compactLivecomment {
+	compacts := make([]compactLivecomment, len(livecomments))
+	for i := range livecomments {
+		compacts[i] = compactLivecomment{Livecomment: livecomments[i]}
+	}
+	return compacts
+}
+
+func compactLivecommentReports(reports []LivecommentReport) []compactLivecommentReport {
+	compacts := make([]compactLivecommentReport, len(reports))
+	for i := range reports {
+		compacts[i] = compactLivecommentReport{
+			LivecommentReport: reports[i],
+			Livecomment:       compactLivecomment{Livecomment: reports[i].Livecomment},
+		}
+	}
+	return compacts
+}
+
+// fetchListLivestream は一覧の最上位で返す配信のレスポンスを組み立てる
+func fetchListLivestream(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (*Livestream, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return nil, err
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return nil, err
+	}
+	return &livestream, nil
+}
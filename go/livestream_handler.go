@@ -2,13 +2,11 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
@@ -25,6 +23,17 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// 配信するチャンネル (省略時はプライマリチャンネル)
+	ChannelID int64 `json:"channel_id"`
+	// 予約枠が満席だった場合にwaitlistへ登録するかどうか
+	Waitlist bool `json:"waitlist"`
+	// public (省略時), unlisted, password のいずれか
+	Visibility string `json:"visibility"`
+	// visibility が password の場合の閲覧パスワード
+	Password string `json:"password"`
+
+	// waitlist から繰り上げる場合は登録時にハッシュ化済みのものを使う
+	passwordHash string
 }
 
 type LivestreamViewerModel struct {
@@ -34,14 +43,18 @@ type LivestreamViewerModel struct {
 }
 
 type LivestreamModel struct {
-	ID           int64  `db:"id" json:"id"`
-	UserID       int64  `db:"user_id" json:"user_id"`
-	Title        string `db:"title" json:"title"`
-	Description  string `db:"description" json:"description"`
-	PlaylistUrl  string `db:"playlist_url" json:"playlist_url"`
-	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
-	StartAt      int64  `db:"start_at" json:"start_at"`
-	EndAt        int64  `db:"end_at" json:"end_at"`
+	ID           int64          `db:"id" json:"id"`
+	UserID       int64          `db:"user_id" json:"user_id"`
+	Title        string         `db:"title" json:"title"`
+	Description  string         `db:"description" json:"description"`
+	PlaylistUrl  string         `db:"playlist_url" json:"playlist_url"`
+	ThumbnailUrl string         `db:"thumbnail_url" json:"thumbnail_url"`
+	StartAt      int64          `db:"start_at" json:"start_at"`
+	EndAt        int64          `db:"end_at" json:"end_at"`
+	ChannelID    int64          `db:"channel_id" json:"channel_id"`
+	Visibility   string         `db:"visibility" json:"visibility"`
+	PasswordHash sql.NullString `db:"password_hash" json:"-"`
+	Status       string         `db:"status" json:"status"`
 }
 
 type Livestream struct {
@@ -54,6 +67,12 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	// プライマリチャンネルの配信では省略される
+	ChannelID int64 `json:"channel_id,omitempty"`
+	// 公開配信では省略される
+	Visibility string `json:"visibility,omitempty"`
+	// メディアサーバから配信の開始を通知されるまでは省略される
+	Status string `json:"status,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -88,12 +107,45 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	var (
+		livestream    Livestream
+		waitlistEntry *ReservationWaitlistEntry
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		livestreamModel, err := reserveLivestream(ctx, tx, c.Logger(), userID, req)
+		var re *reasonedError
+		if req.Waitlist && errors.As(err, &re) && re.Reason == reservationReasonSlotFull {
+			entry, err := joinReservationWaitlist(ctx, tx, userID, req)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to join reservation waitlist: "+err.Error()).SetInternal(err)
+			}
+			waitlistEntry = &entry
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		livestream, err = fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if waitlistEntry != nil {
+		return c.JSON(http.StatusAccepted, waitlistEntry)
 	}
-	defer tx.Rollback()
+	wakeTagFollowWorker()
+	addLeaderboardMember(ctx, c.Logger(), leaderboardLivestreams, livestreamLeaderboardMember(livestream.ID))
+	return c.JSON(http.StatusCreated, livestream)
+}
 
+// reserveLivestream は予約枠を確保して配信を登録する (waitlistの繰り上げからも使う)
+func reserveLivestream(ctx context.Context, tx *sqlx.Tx, logger echo.Logger, userID int64, req *ReserveLivestreamRequest) (*LivestreamModel, error) {
 	// 2023/11/25 10:00からの１年間の期間内であるかチェック
 	var (
 		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
@@ -102,25 +154,54 @@ func reserveLivestreamHandler(c echo.Context) error {
 		reserveEndAt   = time.Unix(req.EndAt, 0)
 	)
 	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+		return nil, newReasonedError(http.StatusBadRequest, reservationReasonOutOfTerm, "bad reservation time range")
+	}
+	if reservationStrict {
+		if reserveStartAt.Before(clock.Now()) {
+			return nil, newReasonedError(http.StatusBadRequest, reservationReasonPast, "can't reserve livestream in the past")
+		}
+		var overlaps int64
+		if err := tx.GetContext(ctx, &overlaps, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND start_at < ? AND end_at > ?", userID, req.EndAt, req.StartAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to count overlapping livestreams: "+err.Error()).SetInternal(err)
+		}
+		if overlaps > 0 {
+			return nil, newReasonedError(http.StatusBadRequest, reservationReasonOverlap, "reservation overlaps with your other livestream")
+		}
+	}
+
+	if err := verifyChannelOwner(ctx, tx, userID, req.ChannelID); err != nil {
+		return nil, err
+	}
+	if err := checkQuota(ctx, tx, userID, quotaStreamsPerWeek, req.StartAt); err != nil {
+		return nil, err
+	}
+
+	if req.Visibility == "" {
+		req.Visibility = livestreamVisibilityPublic
+	}
+	if !isValidLivestreamVisibility(req.Visibility) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "visibility must be one of public, unlisted or password")
+	}
+	if err := hashLivestreamPassword(req); err != nil {
+		return nil, err
 	}
 
 	// 予約枠をみて、予約が可能か調べる
 	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
 	var slots []*ReservationSlotModel
 	if err := tx.SelectContext(ctx, &slots, `
-		SELECT start_at, end_at, slot 
-		FROM reservation_slots 
-		WHERE start_at >= ? AND end_at <= ? 
-		FOR UPDATE`, req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	SELECT start_at, end_at, slot 
+	FROM reservation_slots 
+	WHERE start_at >= ? AND end_at <= ? 
+	FOR UPDATE`, req.StartAt, req.EndAt); err != nil {
+		logger.Warnf("予約枠一覧取得でエラー発生: %+v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error()).SetInternal(err)
 	}
 
 	for _, slot := range slots {
 		if slot.Slot < 1 {
-			c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+			logger.Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
+			return nil, newReasonedError(http.StatusBadRequest, reservationReasonSlotFull, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
 		}
 	}
 
@@ -133,108 +214,127 @@ func reserveLivestreamHandler(c echo.Context) error {
 			ThumbnailUrl: req.ThumbnailUrl,
 			StartAt:      req.StartAt,
 			EndAt:        req.EndAt,
+			ChannelID:    req.ChannelID,
+			Visibility:   req.Visibility,
+			PasswordHash: sql.NullString{String: req.passwordHash, Valid: req.passwordHash != ""},
 		}
 	)
 
 	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error()).SetInternal(err)
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, channel_id, visibility, password_hash) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :channel_id, :visibility, :password_hash)", livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error()).SetInternal(err)
 	}
 
 	livestreamID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error()).SetInternal(err)
 	}
 	livestreamModel.ID = livestreamID
 
-	// タグ追加
-	for _, tagID := range req.Tags {
+	// タグ追加 (同義語は正規のタグに寄せる)
+	resolver, err := loadTagResolver(ctx, tx)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error()).SetInternal(err)
+	}
+	for _, tagID := range resolver.canonicalIDs(req.Tags) {
 		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
 			LivestreamID: livestreamID,
 			TagID:        tagID,
 		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error()).SetInternal(err)
 		}
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if err := enqueueTagFollowJob(ctx, tx, livestreamID); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue tag follow job: "+err.Error()).SetInternal(err)
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	return livestreamModel, nil
 }
 
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	keyTagName := c.QueryParam("tag")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	// 検索条件なしの場合のクエリ
+	q := newSelectQuery("SELECT * FROM livestreams").
+		Where("visibility <> ?", livestreamVisibilityUnlisted).
+		OrderBy("id DESC")
+	if playlistHealthCheckEnabled {
+		q.Where(healthyLivestreamCondition("livestreams"))
 	}
-	defer tx.Rollback()
-
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
-
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
-		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+	if keyTagName == "" {
+		if err := q.LimitFromParam(c, "limit"); err != nil {
+			return err
 		}
+	}
 
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			ls := LivestreamModel{}
-			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	var livestreams []Livestream
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModels []*LivestreamModel
+		if keyTagName != "" {
+			// タグによる取得 (表記揺れ・同義語も同じタグとして扱う)
+			resolver, err := loadTagResolver(ctx, tx)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error()).SetInternal(err)
+			}
+			tagIDList := resolver.searchIDs(keyTagName)
+			if len(tagIDList) == 0 {
+				livestreams = []Livestream{}
+				return nil
 			}
 
-			livestreamModels = append(livestreamModels, &ls)
-		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
+			query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error()).SetInternal(err)
+			}
+			var keyTaggedLivestreams []*LivestreamTagModel
+			if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error()).SetInternal(err)
 			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
-		}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+			lsQuery := "SELECT * FROM livestreams WHERE id = ?"
+			if playlistHealthCheckEnabled {
+				lsQuery += " AND " + healthyLivestreamCondition("livestreams")
+			}
+			for _, keyTaggedLivestream := range keyTaggedLivestreams {
+				ls := LivestreamModel{}
+				if err := tx.GetContext(ctx, &ls, lsQuery, keyTaggedLivestream.LivestreamID); err != nil {
+					if playlistHealthCheckEnabled && errors.Is(err, sql.ErrNoRows) {
+						continue
+					}
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+				}
+				if ls.Visibility == livestreamVisibilityUnlisted {
+					continue
+				}
+
+				livestreamModels = append(livestreamModels, &ls)
+			}
+		} else {
+			// 検索条件なし
+			query, args := q.Build()
+			if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+			}
 		}
-	}
 
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		livestreams = make([]Livestream, len(livestreamModels))
+		for i := range livestreamModels {
+			livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			livestreams[i] = livestream
 		}
-		livestreams[i] = livestream
-	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
@@ -246,32 +346,29 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	var livestreams []Livestream
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		var livestreamModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+		}
+		livestreams = make([]Livestream, len(livestreamModels))
+		for i := range livestreamModels {
+			livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			livestreams[i] = livestream
 		}
-		livestreams[i] = livestream
-	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
@@ -285,36 +382,33 @@ func getUserLivestreamsHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "user not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	var livestreams []Livestream
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var user UserModel
+		if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "user not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+			}
 		}
-	}
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		var livestreamModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+		}
+		livestreams = make([]Livestream, len(livestreamModels))
+		for i := range livestreamModels {
+			livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			livestreams[i] = livestream
 		}
-		livestreams[i] = livestream
-	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
@@ -338,25 +432,26 @@ func enterLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	viewer := LivestreamViewerModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
-	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		viewer := LivestreamViewerModel{
+			UserID:       int64(userID),
+			LivestreamID: int64(livestreamID),
+			CreatedAt:    clock.Now().Unix(),
+		}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
-	}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error()).SetInternal(err)
+		}
+		// 視聴開始は最初のheartbeatとして扱う
+		if err := touchPresence(ctx, tx, userID, int64(livestreamID)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream presence: "+err.Error()).SetInternal(err)
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
+	incrCounter(ctx, c.Logger(), livestreamViewersCounter, int64(livestreamID), 1)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -378,19 +473,24 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
-	}
+	var exited int64
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error()).SetInternal(err)
+		}
+		if exited, err = rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_presences WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream presence: "+err.Error()).SetInternal(err)
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
+	incrCounter(ctx, c.Logger(), livestreamViewersCounter, int64(livestreamID), -exited)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -407,28 +507,33 @@ func getLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
 
-	livestreamModel := LivestreamModel{}
-	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
-	}
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
-	}
+	var livestream Livestream
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		livestreamModel := LivestreamModel{}
+		err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamModel.ID, userID); err != nil {
+			return err
+		}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-	}
+		livestream, err = fillLivestreamResponse(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, livestream)
@@ -446,46 +551,132 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	p, paged, err := parseV1ListParams(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
+	}
+	embed, err := embedLivestreamParam(c, true)
+	if err != nil {
+		return err
 	}
-	defer tx.Rollback()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	q := newSelectQuery("SELECT * FROM livecomment_reports").Where("livestream_id = ?", livestreamID)
+	if paged {
+		p.apply(q, "id")
 	}
+	query, args := q.Build()
 
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
+	var (
+		reports []LivecommentReport
+		next    string
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var reportModels []LivecommentReportModel
+		if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error()).SetInternal(err)
+		}
+		n := len(reportModels)
+		if paged {
+			n, next = p.page(n, func(i int) int64 { return reportModels[i].ID })
+		}
 
-	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
+		var err error
+		reports, err = fillLivecommentReportResponses(ctx, tx, reportModels[:n])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error()).SetInternal(err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+	setNextCursorHeader(c, next)
+	if !embed {
+		return c.JSON(http.StatusOK, compactLivecommentReports(reports))
 	}
+	return c.JSON(http.StatusOK, reports)
+}
 
-	reports := make([]LivecommentReport, len(reportModels))
+// fillLivecommentReportResponses は報告者と報告されたコメントをまとめて取得してからレスポンスを組み立てる
+// コメントは配信ごとに IN で引き、見つからないもの (退避済み) だけを1件ずつ引き直す
+func fillLivecommentReportResponses(ctx context.Context, tx *sqlx.Tx, reportModels []LivecommentReportModel) ([]LivecommentReport, error) {
+	userIDs := make([]int64, len(reportModels))
+	livecommentIDs := map[int64][]int64{}
 	for i := range reportModels {
-		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
+		userIDs[i] = reportModels[i].UserID
+		livecommentIDs[reportModels[i].LivestreamID] = append(livecommentIDs[reportModels[i].LivestreamID], reportModels[i].LivecommentID)
+	}
+	if err := loaderFrom(ctx).primeUsers(ctx, tx, userIDs); err != nil {
+		return nil, err
+	}
+
+	found := make(map[int64]LivecommentModel, len(reportModels))
+	for livestreamID, ids := range livecommentIDs {
+		query, args, err := sqlx.In("SELECT * FROM "+livecommentTable(livestreamID)+" WHERE livestream_id = ? AND id IN (?)", livestreamID, ids)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+			return nil, err
+		}
+		var models []LivecommentModel
+		if err := tx.SelectContext(ctx, &models, tx.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, m := range models {
+			found[m.ID] = m
+		}
+	}
+	livecommentModels := make([]LivecommentModel, len(reportModels))
+	for i := range reportModels {
+		m, ok := found[reportModels[i].LivecommentID]
+		if !ok {
+			var err error
+			if m, err = getLivecommentWithArchive(ctx, tx, reportModels[i].LivestreamID, reportModels[i].LivecommentID); err != nil {
+				return nil, err
+			}
 		}
-		reports[i] = report
+		livecommentModels[i] = m
+	}
+	livecomments, err := fillLivecommentResponses(ctx, tx, livecommentModels)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	reports := make([]LivecommentReport, len(reportModels))
+	for i := range reportModels {
+		reporter, err := fillUserResponseByID(ctx, tx, reportModels[i].UserID)
+		if err != nil {
+			return nil, err
+		}
+		reports[i] = newLivecommentReport(reportModels[i], reporter, livecomments[i])
 	}
+	return reports, nil
+}
 
-	return c.JSON(http.StatusOK, reports)
+// filledLivestream は組み立て済みの配信のレスポンス
+type filledLivestream struct {
+	model    LivestreamModel
+	response Livestream
 }
+
+// filledLivestreams は一覧の中で配信のレスポンスを配信ごとに1回だけ組み立てる (コメント・リアクションの一覧で使う)
+type filledLivestreams map[int64]filledLivestream
+
+func (m filledLivestreams) get(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (filledLivestream, error) {
+	if ls, ok := m[livestreamID]; ok {
+		return ls, nil
+	}
+	var ls filledLivestream
+	if err := tx.GetContext(ctx, &ls.model, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return filledLivestream{}, err
+	}
+	var err error
+	if ls.response, err = fillLivestreamResponse(ctx, tx, ls.model); err != nil {
+		return filledLivestream{}, err
+	}
+	m[livestreamID] = ls
+	return ls, nil
+}
+
 func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
 	type LivestreamResponseModel struct {
 		LivestreamModel
@@ -542,18 +733,10 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		tags = []Tag{}
 	}
 
-	// Process icon image
-	var image []byte
-	if firstResponse.Icon != nil && len(firstResponse.Icon) > 0 {
-		image = firstResponse.Icon
-	} else {
-		var err error
-		image, err = os.ReadFile(fallbackImage)
-		if err != nil {
-			return Livestream{}, err
-		}
+	iconHash, err := iconHashOf(firstResponse.Icon)
+	if err != nil {
+		return Livestream{}, err
 	}
-	iconHash := sha256.Sum256(image)
 
 	var owner = User{
 		ID:          firstResponse.OwnerID,
@@ -564,7 +747,7 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 			ID:       firstResponse.ThemesID,
 			DarkMode: firstResponse.DarkMode,
 		},
-		IconHash: fmt.Sprintf("%x", iconHash),
+		IconHash: iconHash,
 	}
 
 	// Create the Livestream response
@@ -578,6 +761,9 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+		ChannelID:    livestreamModel.ChannelID,
+		Visibility:   responseVisibility(livestreamModel),
+		Status:       responseStatus(livestreamModel),
 	}
 
 	return livestream, nil
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	echolog "github.com/labstack/gommon/log"
+)
+
+// 期間外・(strict で) 過去の予約は DB を引く前に拒否する
+func TestReserveLivestreamRejects(t *testing.T) {
+	freezeClockForTest(t, time.Date(2023, 11, 25, 3, 0, 0, 0, time.UTC))
+	saved := reservationStrict
+	reservationStrict = true
+	t.Cleanup(func() { reservationStrict = saved })
+
+	tests := []struct {
+		name    string
+		startAt time.Time
+		want    string
+	}{
+		{name: "before term", startAt: time.Date(2023, 11, 24, 0, 0, 0, 0, time.UTC), want: reservationReasonOutOfTerm},
+		{name: "after term", startAt: time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC), want: reservationReasonOutOfTerm},
+		{name: "past", startAt: time.Date(2023, 11, 25, 2, 0, 0, 0, time.UTC), want: reservationReasonPast},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ReserveLivestreamRequest{StartAt: tt.startAt.Unix(), EndAt: tt.startAt.Add(time.Hour).Unix()}
+			_, err := reserveLivestream(context.Background(), nil, echolog.New("test"), 1, req)
+			var re *reasonedError
+			if !errors.As(err, &re) {
+				t.Fatalf("reserveLivestream() error = %v, want reason %s", err, tt.want)
+			}
+			if re.Reason != tt.want {
+				t.Errorf("reason = %s, want %s", re.Reason, tt.want)
+			}
+		})
+	}
+}
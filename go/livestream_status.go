@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信の状態 (メディアサーバからの通知で切り替わる)
+// 初期データや通知を受けていない配信は upcoming のまま (start_at / end_at で判断する)
+const (
+	livestreamStatusUpcoming = "upcoming"
+	livestreamStatusLive     = "live"
+	livestreamStatusEnded    = "ended"
+)
+
+func responseStatus(m LivestreamModel) string {
+	if m.Status == livestreamStatusUpcoming {
+		return ""
+	}
+	return m.Status
+}
+
+// 配信開始の通知API (メディアサーバ向け)
+// POST /api/internal/ingest/started
+func postIngestStartedHandler(c echo.Context) error {
+	return handleIngestCallback(c, ingestCallPublish)
+}
+
+// 配信終了の通知API (メディアサーバ向け)
+// POST /api/internal/ingest/stopped
+func postIngestStoppedHandler(c echo.Context) error {
+	return handleIngestCallback(c, ingestCallPublishDone)
+}
+
+// onLivestreamStatusChanged は状態が変わったことを視聴中のクライアントに流し、終了したら分析レポートを作る
+// コミット後に呼ぶこと
+func onLivestreamStatusChanged(ctx context.Context, logger echo.Logger, livestreamModel LivestreamModel) {
+	publishModerationEvent(ctx, logger, ModerationBroadcast{
+		Type:         moderationEventStatusChanged,
+		LivestreamID: livestreamModel.ID,
+		Status:       livestreamModel.Status,
+		CreatedAt:    clock.Now().Unix(),
+	})
+
+	if livestreamModel.Status != livestreamStatusEnded {
+		return
+	}
+	// 再開して終わり直したら作り直す。失敗しても取得時に生成されるので、通知自体は成功にする
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := generateLivestreamAnalytics(ctx, tx, livestreamModel)
+		return err
+	}); err != nil {
+		logger.Warnf("failed to generate livestream analytics: livestream_id=%d: %v", livestreamModel.ID, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	livestreamVisibilityPublic   = "public"
+	livestreamVisibilityUnlisted = "unlisted"
+	livestreamVisibilityPassword = "password"
+
+	// unlock API で払い出したトークンを載せるヘッダ (クエリパラメータ token でも可)
+	livestreamTokenHeader = "X-Livestream-Token"
+	livestreamTokenTTL    = 24 * time.Hour
+
+	livestreamReasonLocked = "locked"
+)
+
+type LivestreamAccessTokenModel struct {
+	Token        string `db:"token"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	ExpiresAt    int64  `db:"expires_at"`
+}
+
+type UnlockLivestreamRequest struct {
+	Password string `json:"password"`
+}
+
+type UnlockLivestreamResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func isValidLivestreamVisibility(v string) bool {
+	switch v {
+	case livestreamVisibilityPublic, livestreamVisibilityUnlisted, livestreamVisibilityPassword:
+		return true
+	}
+	return false
+}
+
+func responseVisibility(m LivestreamModel) string {
+	if m.Visibility == livestreamVisibilityPublic {
+		return ""
+	}
+	return m.Visibility
+}
+
+// hashLivestreamPassword は password 配信の閲覧パスワードをハッシュ化して req に持たせる
+func hashLivestreamPassword(req *ReserveLivestreamRequest) error {
+	if req.Visibility != livestreamVisibilityPassword {
+		req.passwordHash = ""
+		return nil
+	}
+	if req.passwordHash != "" {
+		return nil
+	}
+	if req.Password == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "password is required for password-protected livestream")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error()).SetInternal(err)
+	}
+	req.passwordHash = string(hashed)
+	return nil
+}
+
+// verifyLivestreamAccess はパスワード付き配信を閲覧できるかを検証する
+// 配信者本人か、unlock API で得たトークンを持っている場合のみ許可する
+// 配信が存在しない場合は呼び出し元の挙動に任せる
+func verifyLivestreamAccess(ctx context.Context, tx *sqlx.Tx, c echo.Context, livestreamID, userID int64) error {
+	var ls struct {
+		UserID     int64  `db:"user_id"`
+		Visibility string `db:"visibility"`
+	}
+	if err := tx.GetContext(ctx, &ls, "SELECT user_id, visibility FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+	}
+	if ls.Visibility != livestreamVisibilityPassword || ls.UserID == userID {
+		return nil
+	}
+
+	token := c.Request().Header.Get(livestreamTokenHeader)
+	if token == "" {
+		token = c.QueryParam("token")
+	}
+	if token == "" {
+		return newReasonedError(http.StatusForbidden, livestreamReasonLocked, "this livestream is protected by password")
+	}
+
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_access_tokens WHERE token = ? AND livestream_id = ? AND user_id = ? AND expires_at > ?", token, livestreamID, userID, clock.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream access token: "+err.Error()).SetInternal(err)
+	}
+	if count == 0 {
+		return newReasonedError(http.StatusForbidden, livestreamReasonLocked, "this livestream is protected by password")
+	}
+	return nil
+}
+
+// パスワード付き配信の閲覧トークン発行API
+// POST /api/livestream/:livestream_id/unlock
+func unlockLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *UnlockLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var res UnlockLivestreamResponse
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if livestreamModel.Visibility != livestreamVisibilityPassword || !livestreamModel.PasswordHash.Valid {
+			return echo.NewHTTPError(http.StatusBadRequest, "this livestream is not protected by password")
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(livestreamModel.PasswordHash.String), []byte(req.Password)); err != nil {
+			if err == bcrypt.ErrMismatchedHashAndPassword {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid password")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error()).SetInternal(err)
+		}
+
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate token: "+err.Error()).SetInternal(err)
+		}
+		m := LivestreamAccessTokenModel{
+			Token:        hex.EncodeToString(b),
+			LivestreamID: livestreamID,
+			UserID:       userID,
+			ExpiresAt:    clock.Now().Add(livestreamTokenTTL).Unix(),
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_access_tokens (token, livestream_id, user_id, expires_at) VALUES (:token, :livestream_id, :user_id, :expires_at)", m); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream access token: "+err.Error()).SetInternal(err)
+		}
+
+		res = UnlockLivestreamResponse{Token: m.Token, ExpiresAt: m.ExpiresAt}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
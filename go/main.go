@@ -4,6 +4,9 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -11,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -31,6 +35,8 @@ var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 管理者として扱うユーザ名 (ISUCON13_ADMIN_USERNAMES にカンマ区切りで指定)
+	adminUsernames = map[string]struct{}{}
 )
 
 func init() {
@@ -38,6 +44,13 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv("ISUCON13_ADMIN_USERNAMES"); ok {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				adminUsernames[name] = struct{}{}
+			}
+		}
+	}
 }
 
 type InitializeResponse struct {
@@ -98,9 +111,19 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		"interpolateParams": "true",
 	}
 
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
-	if err != nil {
-		return nil, err
+	var db *sqlx.DB
+	if queryInstrumentationEnabled() {
+		connector, err := mysql.NewConnector(conf)
+		if err != nil {
+			return nil, err
+		}
+		db = sqlx.NewDb(sql.OpenDB(queryLogConnector{connector}), "mysql")
+	} else {
+		var err error
+		db, err = sqlx.Open("mysql", conf.FormatDSN())
+		if err != nil {
+			return nil, err
+		}
 	}
 	db.SetMaxOpenConns(10)
 
@@ -114,8 +137,29 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 func initializeHandler(c echo.Context) error {
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error()).SetInternal(err)
+	}
+	// ユーザを入れ直したので、ユーザIDやアイコンが変わっている
+	invalidateIconIndex(c.Request().Context(), c.Logger(), 0)
+	resetAuthzCache()
+	resetMuteMatcherCache()
+	resetColdLivestreams()
+	// init.sh は livecomments に入れ直すので、シャードに振り分け直す
+	if err := prepareLivecommentShards(c.Request().Context(), true); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to prepare livecomment shards: "+err.Error()).SetInternal(err)
+	}
+	// データを入れ直したので件数も数え直す
+	if err := reconcileCounters(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile counters: "+err.Error()).SetInternal(err)
+	}
+	if leaderboardEnabled {
+		// データを入れ直したのでランキングも作り直す
+		if err := reconcileLeaderboards(c.Request().Context()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile leaderboards: "+err.Error()).SetInternal(err)
+		}
 	}
+	// 初期化で流したクエリは集計から除く
+	resetQueryLog()
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -124,13 +168,85 @@ func initializeHandler(c echo.Context) error {
 }
 
 func main() {
+	// サブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "maintenance" {
+		os.Exit(runMaintenanceCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		os.Exit(runSeedCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "explain-check" {
+		os.Exit(runExplainCheckCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-chat" {
+		os.Exit(runChatImportCommand(os.Args[2:]))
+	}
+
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(echolog.DEBUG)
 	e.Use(middleware.Logger())
+	e.Use(httpStatsMiddleware)
+	if err := loadClockConfig(); err != nil {
+		e.Logger.Errorf("failed to load clock config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadCookieConfig(); err != nil {
+		e.Logger.Errorf("failed to load cookie config: %v", err)
+		os.Exit(1)
+	}
+	loadAssetSigningKey()
+	if err := loadImageNormalizationConfig(); err != nil {
+		e.Logger.Errorf("failed to load image normalization config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadImageVariantsConfig(); err != nil {
+		e.Logger.Errorf("failed to load image variants config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadImageModerationConfig(); err != nil {
+		e.Logger.Errorf("failed to load image moderation config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadOAuthConfig(); err != nil {
+		e.Logger.Errorf("failed to load oauth config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadSessionConfig(); err != nil {
+		e.Logger.Errorf("failed to load session config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadTrustedProxyConfig(e); err != nil {
+		e.Logger.Errorf("failed to load trusted proxy config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadInternalAuthConfig(); err != nil {
+		e.Logger.Errorf("failed to load internal auth config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadCORSConfig(); err != nil {
+		e.Logger.Errorf("failed to load CORS config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadConcurrencyLimitConfig(); err != nil {
+		e.Logger.Errorf("failed to load concurrency limit config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadCircuitBreakerConfig(); err != nil {
+		e.Logger.Errorf("failed to load circuit breaker config: %v", err)
+		os.Exit(1)
+	}
+	e.Use(corsMiddleware())
+	e.Use(requestSizeLimitMiddleware)
+	e.Use(nPlusOneDetectorMiddleware)
 	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.local"
+	cookieStore.Options = sessionCookieOptions()
 	e.Use(session.Middleware(cookieStore))
+	e.Use(requestLoaderMiddleware)
+	e.Use(cachePolicyMiddleware)
+	e.Use(concurrencyLimitMiddleware)
+	e.Use(csrfMiddleware())
+	e.Use(authorizationMiddleware)
 	// e.Use(middleware.Recover())
 
 	// 初期化
@@ -143,53 +259,274 @@ func main() {
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// 予約枠の残数
+	e.GET("/api/reservation/slots", getReservationSlotsHandler)
+	// 予約のキャンセルとwaitlist
+	e.DELETE("/api/livestream/:livestream_id/reservation", cancelReservationHandler)
+	// 繰り返し予約
+	e.POST("/api/livestream/reservation/series", reserveSeriesHandler)
+	e.GET("/api/livestream/reservation/series/:series_id", getSeriesHandler)
+	e.PUT("/api/livestream/reservation/series/:series_id", putSeriesHandler)
+	e.DELETE("/api/livestream/reservation/series/:series_id", cancelSeriesHandler)
+	e.GET("/api/livestream/reservation/waitlist", getReservationWaitlistHandler)
+	e.DELETE("/api/livestream/reservation/waitlist/:waitlist_id", leaveReservationWaitlistHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	// 配信予定カレンダー
+	e.GET("/api/schedule", getScheduleHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// パスワード付き配信の閲覧トークン発行
+	e.POST("/api/livestream/:livestream_id/unlock", unlockLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	// モデレーションによる削除の通知 (Server-Sent Events)
+	e.GET("/api/livestream/:livestream_id/moderation/events", getModerationEventsHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	// 10秒ごとのリアクション数の推移
+	e.GET("/api/livestream/:livestream_id/reactions/timeline", getReactionTimelineHandler)
+	// チャットコマンドの設定 (配信者向け)
+	e.GET("/api/livestream/:livestream_id/commands", getChatCommandsHandler)
+	e.PUT("/api/livestream/:livestream_id/commands/:command", putChatCommandHandler)
+	// 配信ごとのコメントルール (文字数・絵文字のみ・リンク・大文字)
+	e.GET("/api/livestream/:livestream_id/comment_rules", getLivecommentRulesHandler)
+	e.PUT("/api/livestream/:livestream_id/comment_rules", putLivecommentRulesHandler)
+	// 配信ソフトに設定するストリームキー (配信者向け)
+	e.POST("/api/livestream/:livestream_id/stream_key", postStreamKeyHandler)
+	e.DELETE("/api/livestream/:livestream_id/stream_key", deleteStreamKeyHandler)
+	// レイド (視聴者を別の配信に送る)
+	e.POST("/api/livestream/:livestream_id/raid", postRaidHandler)
+	e.GET("/api/livestream/:livestream_id/raid", getRaidHandler)
+	// 質問の受付 (Q&A)
+	e.GET("/api/livestream/:livestream_id/questions", getQuestionsHandler)
+	e.POST("/api/livestream/:livestream_id/questions", postQuestionHandler)
+	e.PUT("/api/livestream/:livestream_id/questions/:question_id", putQuestionStatusHandler)
+	e.POST("/api/livestream/:livestream_id/questions/:question_id/upvote", upvoteQuestionHandler)
+	e.DELETE("/api/livestream/:livestream_id/questions/:question_id/upvote", upvoteQuestionHandler)
+	// アーカイブのクリップ
+	e.POST("/api/livestream/:livestream_id/clips", postClipHandler)
+	e.GET("/api/livestream/:livestream_id/clips", getLivestreamClipsHandler)
+	// アーカイブの字幕 (WebVTT)。本文は署名付きURL (/api/assets/caption/:id) で配信する
+	e.GET("/api/livestream/:livestream_id/captions", getLivestreamCaptionsHandler)
+	e.POST("/api/livestream/:livestream_id/captions", postLivestreamCaptionHandler)
+	e.DELETE("/api/livestream/:livestream_id/captions/:caption_id", deleteLivestreamCaptionHandler)
+	// 他の配信サービスのチャットログの取り込み (アーカイブ向け)
+	e.POST("/api/livestream/:livestream_id/chat_imports", postChatImportHandler)
+	e.GET("/api/livestream/:livestream_id/chat_imports/:import_id", getChatImportHandler)
+	// 配信中に定期的に投稿するお知らせ (配信者向け)
+	e.GET("/api/livestream/:livestream_id/announcements", getLivestreamAnnouncementsHandler)
+	e.POST("/api/livestream/:livestream_id/announcements", postLivestreamAnnouncementHandler)
+	e.DELETE("/api/livestream/:livestream_id/announcements/:announcement_id", deleteLivestreamAnnouncementHandler)
+	e.GET("/api/clips/trending", getTrendingClipsHandler)
+	e.POST("/api/clips/:clip_id/view", postClipViewHandler)
+	// 視聴ルーム (一緒に配信を見る少人数のルーム)
+	e.POST("/api/livestream/:livestream_id/rooms", postWatchRoomHandler)
+	e.GET("/api/rooms/:room_id", getWatchRoomHandler)
+	e.POST("/api/rooms/:room_id/members", postWatchRoomMemberHandler)
+	e.DELETE("/api/rooms/:room_id/members/me", deleteWatchRoomMemberHandler)
+	e.GET("/api/rooms/:room_id/messages", getWatchRoomMessagesHandler)
+	e.POST("/api/rooms/:room_id/messages", postWatchRoomMessageHandler)
+	// 見どころの候補 (配信者向け)
+	e.GET("/api/livestream/:livestream_id/highlights", getHighlightsHandler)
+	e.POST("/api/livestream/:livestream_id/highlights/:highlight_id/confirm", confirmHighlightHandler)
+	e.DELETE("/api/livestream/:livestream_id/highlights/:highlight_id", deleteHighlightHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
+	e.POST("/api/livestream/:livestream_id/report/:report_id/resolve", resolveLivecommentReportHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	// スパムスコアで保留されたコメントの確認
+	e.GET("/api/livestream/:livestream_id/spam_holds", getLivecommentSpamHoldsHandler)
+	e.POST("/api/livestream/:livestream_id/spam_holds/:livecomment_id/approve", approveLivecommentSpamHoldHandler)
+	e.POST("/api/livestream/:livestream_id/spam_holds/:livecomment_id/reject", rejectLivecommentSpamHoldHandler)
+	// 購読しているブロックリスト (配信者向け)
+	e.GET("/api/livestream/:livestream_id/blocklists", getLivestreamBlocklistsHandler)
+	e.POST("/api/livestream/:livestream_id/blocklists", subscribeBlocklistHandler)
+	e.DELETE("/api/livestream/:livestream_id/blocklists/:blocklist_id", unsubscribeBlocklistHandler)
+
+	// 共有ブロックリスト
+	e.POST("/api/blocklist", postBlocklistHandler)
+	e.GET("/api/blocklist", getBlocklistsHandler)
+	e.GET("/api/blocklist/:blocklist_id", getBlocklistHandler)
+	e.POST("/api/blocklist/:blocklist_id/words", postBlocklistWordHandler)
+	e.DELETE("/api/blocklist/:blocklist_id/words/:word_id", deleteBlocklistWordHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴継続の通知 (viewer)
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
+	// 現在の同時視聴者数
+	e.GET("/api/livestream/:livestream_id/viewers", getLivestreamViewersHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
+	// 外部アカウント (GitHub/Google) でのログインと連携
+	e.GET("/api/oauth/:provider/authorize", oauthAuthorizeHandler)
+	e.GET("/api/oauth/:provider/callback", oauthCallbackHandler)
+	e.GET("/api/user/me/identities", getMyExternalIdentitiesHandler)
+	e.DELETE("/api/user/me/identities/:provider", deleteMyExternalIdentityHandler)
 	e.GET("/api/user/me", getMeHandler)
+	// プランと使用量
+	e.GET("/api/user/me/quota", getMyQuotaHandler)
+	// ログイン中の端末 (セッション) の一覧と失効
+	e.GET("/api/user/me/sessions", getMySessionsHandler)
+	e.DELETE("/api/user/me/sessions/:session_id", deleteMySessionHandler)
+	// プロフィール項目 (リンクなど)
+	e.PUT("/api/user/me/profile/:key", putProfileFieldHandler)
+	e.DELETE("/api/user/me/profile/:key", deleteProfileFieldHandler)
+	// 自分にだけ適用するミュートワード
+	e.GET("/api/user/me/mute_words", getMuteWordsHandler)
+	e.POST("/api/user/me/mute_words", postMuteWordHandler)
+	e.DELETE("/api/user/me/mute_words/:word_id", deleteMuteWordHandler)
+	// チップの目標 (配信者向け) と、オーバーレイのウィジェット向けの進捗
+	e.GET("/api/user/me/donation_goals", getMyDonationGoalsHandler)
+	e.POST("/api/user/me/donation_goals", postDonationGoalHandler)
+	e.DELETE("/api/user/me/donation_goals/:goal_id", deleteDonationGoalHandler)
+	e.GET("/api/user/:username/donation_goals", getUserDonationGoalsHandler)
+	// プロフィールに載せる応援コメント (配信者向け)
+	e.GET("/api/user/me/highlighted_comments", getMyHighlightedCommentsHandler)
+	e.POST("/api/user/me/highlighted_comments", postHighlightedCommentHandler)
+	e.PUT("/api/user/me/highlighted_comments/order", putHighlightedCommentOrderHandler)
+	e.DELETE("/api/user/me/highlighted_comments/:highlight_id", deleteHighlightedCommentHandler)
+	// クライアントの計測イベント
+	e.POST("/api/events", postTelemetryHandler)
+	// 視聴履歴 (heartbeat で記録する)
+	e.GET("/api/user/me/history", getWatchHistoryHandler)
+	// おすすめ配信
+	e.GET("/api/recommendations", getRecommendationsHandler)
+	// タグのフォロー
+	e.GET("/api/user/me/tag_follows", getTagFollowsHandler)
+	e.PUT("/api/user/me/tag_follows/:tag_id", followTagHandler)
+	e.DELETE("/api/user/me/tag_follows/:tag_id", unfollowTagHandler)
+	e.PUT("/api/user/me/tag_follow_settings", putTagFollowSettingsHandler)
+	// 週次ダイジェストメール
+	e.GET("/api/user/me/streamer_digest_settings", getStreamerDigestSettingsHandler)
+	e.PUT("/api/user/me/streamer_digest_settings", putStreamerDigestSettingsHandler)
+	// 公開APIのキー
+	e.GET("/api/user/me/api_keys", getAPIKeysHandler)
+	e.POST("/api/user/me/api_keys", postAPIKeyHandler)
+	e.DELETE("/api/user/me/api_keys/:key_id", deleteAPIKeyHandler)
+	e.GET("/api/user/me/api_keys/:key_id/usage", getAPIKeyUsageHandler)
+	// 自分の配信のコメント検索
+	e.GET("/api/user/me/comments/search", searchMyCommentsHandler)
+	// 自分のデータのエクスポート
+	e.POST("/api/user/me/export", postUserExportHandler)
+	e.GET("/api/user/me/export/:export_id", getUserExportHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	// スパム報告の対応時間 (中央値・P90)
+	e.GET("/api/user/:username/statistics/moderation", getUserModerationSLAHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
+	// 署名付きURLでのアセット取得 (Cookie を使わない)
+	e.GET("/api/assets/:kind/:id", getSignedAssetHandler)
+	e.GET("/api/user/:username/activity", getUserActivityHandler)
 	e.POST("/api/icon", postIconHandler)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	// 配信終了後の分析レポート
+	e.GET("/api/livestream/:livestream_id/analytics", getLivestreamAnalyticsHandler)
+
+	// channel
+	e.POST("/api/channel", postChannelHandler)
+	e.GET("/api/user/:username/channel", getUserChannelsHandler)
+	e.GET("/api/channel/:channel_name", getChannelHandler)
+	e.GET("/api/channel/:channel_name/icon", getChannelIconHandler)
+	e.GET("/api/channel/:channel_name/livestream", getChannelLivestreamsHandler)
+	// チャンネルのVIP (スローモードの対象外)
+	e.GET("/api/channel/:channel_name/vip", getChannelVIPsHandler)
+	e.PUT("/api/channel/:channel_name/vip/:username", grantChannelVIPHandler)
+	e.DELETE("/api/channel/:channel_name/vip/:username", revokeChannelVIPHandler)
+	// チャンネルのコメントの言語内訳 (配信者向け)
+	e.GET("/api/channel/:channel_name/analytics/languages", getChannelLanguageBreakdownHandler)
+	// チャンネルのメンバーシップ (月額)
+	e.GET("/api/channel/:channel_name/membership_tiers", getMembershipTiersHandler)
+	e.POST("/api/channel/:channel_name/membership_tiers", postMembershipTierHandler)
+	e.DELETE("/api/channel/:channel_name/membership_tiers/:tier_id", deleteMembershipTierHandler)
+	e.GET("/api/channel/:channel_name/membership", getChannelMembershipHandler)
+	e.POST("/api/channel/:channel_name/membership", postChannelMembershipHandler)
+	e.DELETE("/api/channel/:channel_name/membership", deleteChannelMembershipHandler)
+	// カスタム絵文字
+	e.GET("/api/channel/:channel_name/emojis", getChannelEmojisHandler)
+	e.POST("/api/channel/:channel_name/emojis/:shortcode", postChannelEmojiHandler)
+	e.DELETE("/api/channel/:channel_name/emojis/:shortcode", deleteChannelEmojiHandler)
+	e.GET("/api/emojis/:emoji_id/image", getChannelEmojiImageHandler)
+
+	// 通知
+	e.GET("/api/notifications", getNotificationsHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
+	// 配信者の収益 (手数料を引く前と後)
+	e.GET("/api/payment/payout", getPayoutSummaryHandler)
+	// 配信者の月ごとの領収書
+	e.GET("/api/payment/receipts", getPaymentReceiptHandler)
+
+	// v2: 一覧APIは {items, next_cursor, total} の形で返す
+	v2 := e.Group("/api/v2")
+	v2.GET("/livestream/search", searchLivestreamsV2Handler)
+	v2.GET("/livestream/:livestream_id/livecomment", getLivecommentsV2Handler)
+	v2.GET("/livestream/:livestream_id/reaction", getReactionsV2Handler)
+	v2.GET("/livestream/:livestream_id/report", getLivecommentReportsV2Handler)
+
+	// 公開API: セッションの代わりに API キーで呼ぶ読み取り専用のAPI
+	public := e.Group("/api/public", apiKeyMiddleware)
+	public.GET("/users/:username", getPublicUserHandler)
+	public.GET("/livestreams", getPublicLivestreamsHandler)
+	public.GET("/clips/:clip_id", getPublicClipHandler)
+
+	// admin
+	admin := e.Group("/api/admin", internalAuthMiddleware(false))
+	admin.GET("/audit_logs", getAuditLogsHandler)
+	admin.GET("/metrics", getAdminMetricsHandler)
+	admin.GET("/audit_logs/client_metadata", getClientMetadataHandler)
+	admin.GET("/events", getDomainEventsHandler)
+	admin.GET("/feature_flags", getFeatureFlagsHandler)
+	admin.PUT("/feature_flags/:name", putFeatureFlagHandler)
+	admin.PUT("/revenue_tiers/:username", putRevenueTierHandler)
+	admin.PUT("/users/:username/plan", putUserPlanHandler)
+	admin.POST("/users/:username/anonymize", postUserAnonymizationHandler)
+	admin.GET("/anonymizations/:anonymization_id", getUserAnonymizationHandler)
+	admin.GET("/tag_synonyms", getTagSynonymsHandler)
+	admin.PUT("/tag_synonyms/:alias", putTagSynonymHandler)
+	admin.DELETE("/tag_synonyms/:alias", deleteTagSynonymHandler)
+	admin.GET("/image_reviews", getImageReviewsHandler)
+	admin.POST("/image_reviews/:review_id/approve", approveImageReviewHandler)
+	admin.POST("/image_reviews/:review_id/reject", rejectImageReviewHandler)
+	admin.GET("/suspicious_accounts", getSuspiciousAccountsHandler)
+	admin.POST("/suspicious_accounts/:username/dismiss", dismissSuspiciousAccountHandler)
+	admin.GET("/duplicate_accounts", getDuplicateAccountsHandler)
+	admin.POST("/duplicate_accounts/:candidate_id/dismiss", dismissDuplicateAccountHandler)
+
+	// pprof・メトリクス (接続元かトークンの設定が必要)
+	registerInternalRoutes(e.Group("/api/internal", internalAuthMiddleware(true)))
 
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
+	if err := loadQueryLogConfig(); err != nil {
+		e.Logger.Errorf("failed to load query log config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadNPlusOneConfig(); err != nil {
+		e.Logger.Errorf("failed to load n+1 detector config: %v", err)
+		os.Exit(1)
+	}
 	conn, err := connectDB(e.Logger)
 	if err != nil {
 		e.Logger.Errorf("failed to connect db: %v", err)
@@ -198,6 +535,248 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	if err := loadCommentSearchConfig(); err != nil {
+		e.Logger.Errorf("failed to load comment search config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadSchemaCheckConfig(); err != nil {
+		e.Logger.Errorf("failed to load schema check config: %v", err)
+		os.Exit(1)
+	}
+	if err := runSchemaCheck(context.Background(), e.Logger); err != nil {
+		e.Logger.Errorf("schema check failed: %v", err)
+		os.Exit(1)
+	}
+	if err := loadReservationConfig(); err != nil {
+		e.Logger.Errorf("failed to load reservation config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadPresenceConfig(); err != nil {
+		e.Logger.Errorf("failed to load presence config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadLivecommentCooldownConfig(); err != nil {
+		e.Logger.Errorf("failed to load livecomment cooldown config: %v", err)
+		os.Exit(1)
+	}
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go runPresenceSweeper(bgCtx, e.Logger)
+	go runWaitlistWorker(bgCtx, e.Logger)
+	go runUserExportWorker(bgCtx, e.Logger)
+	go runAnonymizationWorker(bgCtx, e.Logger)
+	go runChatImportWorker(bgCtx, e.Logger)
+	go runMembershipRenewalWorker(bgCtx, e.Logger)
+	go runAnnouncementScheduler(bgCtx, e.Logger)
+	go runTelemetryWriter(bgCtx, e.Logger)
+
+	if err := refreshFeatureFlags(bgCtx); err != nil {
+		e.Logger.Warnf("failed to load feature flags: %v", err)
+	}
+	go runFeatureFlagRefresher(bgCtx, e.Logger)
+
+	if err := loadAnalyticsConfig(); err != nil {
+		e.Logger.Errorf("failed to load analytics config: %v", err)
+		os.Exit(1)
+	}
+	if analyticsWorkerEnabled {
+		go runAnalyticsWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadToxicityConfig(); err != nil {
+		e.Logger.Errorf("failed to load toxicity config: %v", err)
+		os.Exit(1)
+	}
+	if toxicityEnabled {
+		go runToxicityWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadLanguageDetectionConfig(); err != nil {
+		e.Logger.Errorf("failed to load language detection config: %v", err)
+		os.Exit(1)
+	}
+	if languageDetectionEnabled {
+		go runLanguageDetectionWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadLinkUnfurlConfig(); err != nil {
+		e.Logger.Errorf("failed to load link unfurl config: %v", err)
+		os.Exit(1)
+	}
+	if linkUnfurlEnabled {
+		go runLinkUnfurlWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadPlaylistHealthConfig(); err != nil {
+		e.Logger.Errorf("failed to load playlist health config: %v", err)
+		os.Exit(1)
+	}
+	if playlistHealthCheckEnabled {
+		go runPlaylistHealthWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadLivecommentTypeConfig(); err != nil {
+		e.Logger.Errorf("failed to load livecomment type config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadChatCommandConfig(); err != nil {
+		e.Logger.Errorf("failed to load chat command config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadTagFollowConfig(); err != nil {
+		e.Logger.Errorf("failed to load tag follow config: %v", err)
+		os.Exit(1)
+	}
+	if tagFollowNotificationsEnabled {
+		go runTagFollowWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadMailerConfig(); err != nil {
+		e.Logger.Errorf("failed to load mailer config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadStreamerDigestConfig(); err != nil {
+		e.Logger.Errorf("failed to load streamer digest config: %v", err)
+		os.Exit(1)
+	}
+	if streamerDigestEnabled {
+		go runStreamerDigestWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadRecommendationConfig(); err != nil {
+		e.Logger.Errorf("failed to load recommendation config: %v", err)
+		os.Exit(1)
+	}
+	if recommendationsEnabled {
+		go runRecommendationWorker(bgCtx, e.Logger)
+	}
+
+	if err := loadHighlightConfig(); err != nil {
+		e.Logger.Errorf("failed to load highlight config: %v", err)
+		os.Exit(1)
+	}
+	if highlightDetectionEnabled {
+		go runHighlightDetector(bgCtx, e.Logger)
+	}
+
+	loadRedisConfig()
+	if err := loadLeaderboardConfig(); err != nil {
+		e.Logger.Errorf("failed to load leaderboard config: %v", err)
+		os.Exit(1)
+	}
+	if leaderboardEnabled {
+		go runLeaderboardReconciler(bgCtx, e.Logger)
+	}
+	if err := loadCounterConfig(); err != nil {
+		e.Logger.Errorf("failed to load counter config: %v", err)
+		os.Exit(1)
+	}
+	if len(materializedCounters) > 0 {
+		if err := reconcileCounters(bgCtx); err != nil {
+			e.Logger.Errorf("failed to reconcile counters: %v", err)
+			os.Exit(1)
+		}
+		go runCounterReconciler(bgCtx, e.Logger)
+	}
+
+	if err := loadDomainEventsConfig(); err != nil {
+		e.Logger.Errorf("failed to load domain events config: %v", err)
+		os.Exit(1)
+	}
+	if domainEventsEnabled {
+		go runStreamStartScanner(bgCtx, e.Logger)
+		if domainEventsRedisStream != "" {
+			go runDomainEventRelay(bgCtx, e.Logger)
+		}
+	}
+
+	if err := loadSpamScoreConfig(); err != nil {
+		e.Logger.Errorf("failed to load spam score config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadRegistrationAbuseConfig(); err != nil {
+		e.Logger.Errorf("failed to load registration abuse config: %v", err)
+		os.Exit(1)
+	}
+	if registrationAbuseEnabled {
+		go runRegistrationAbuseAnalyzer(bgCtx, e.Logger)
+	}
+
+	if err := loadDuplicateAccountConfig(); err != nil {
+		e.Logger.Errorf("failed to load duplicate account config: %v", err)
+		os.Exit(1)
+	}
+	if duplicateAccountDetectionEnabled {
+		go runDuplicateAccountDetector(bgCtx, e.Logger)
+	}
+
+	if err := loadIconIndexConfig(); err != nil {
+		e.Logger.Errorf("failed to load icon index config: %v", err)
+		os.Exit(1)
+	}
+	if iconIndexEnabled && redisConn != nil {
+		go runIconIndexSubscriber(bgCtx, e.Logger)
+	}
+	if redisConn != nil {
+		go runModerationEventSubscriber(bgCtx, e.Logger)
+	}
+
+	if err := loadClientMetadataConfig(); err != nil {
+		e.Logger.Errorf("failed to load client metadata config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadQuotaConfig(); err != nil {
+		e.Logger.Errorf("failed to load quota config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadRevenueShareConfig(); err != nil {
+		e.Logger.Errorf("failed to load revenue share config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadLivecommentShardConfig(); err != nil {
+		e.Logger.Errorf("failed to load livecomment shard config: %v", err)
+		os.Exit(1)
+	}
+	if err := prepareLivecommentShards(bgCtx, false); err != nil {
+		e.Logger.Errorf("failed to prepare livecomment shards: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadColdStorageConfig(); err != nil {
+		e.Logger.Errorf("failed to load cold storage config: %v", err)
+		os.Exit(1)
+	}
+	if coldStorageEnabled {
+		// 一覧を読むまでは移した配信も hot を読んでしまうので、起動時に読んでおく
+		if err := refreshColdLivestreams(bgCtx); err != nil {
+			e.Logger.Errorf("failed to refresh cold livestreams: %v", err)
+			os.Exit(1)
+		}
+		go runColdStorageMover(bgCtx, e.Logger)
+	}
+
+	if err := loadLivecommentRetentionConfig(); err != nil {
+		e.Logger.Errorf("failed to load livecomment retention config: %v", err)
+		os.Exit(1)
+	}
+	if livecommentRetentionCap > 0 {
+		go runLivecommentTrimmer(bgCtx, e.Logger)
+	}
+
+	if err := loadMaintenanceConfig(); err != nil {
+		e.Logger.Errorf("failed to load maintenance config: %v", err)
+		os.Exit(1)
+	}
+	if maintenanceEnabled || clientMetadataEnabled {
+		go runMaintenanceScheduler(bgCtx, e.Logger)
+	}
+
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
 		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
@@ -215,12 +794,38 @@ func main() {
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// クライアントが機械的に判別するための失敗理由 (無い場合は省略)
+	Reason string `json:"reason,omitempty"`
+}
+
+// reasonedError はレスポンスに失敗理由 (reason) を含めたい場合に返すエラー
+type reasonedError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func newReasonedError(code int, reason, message string) *reasonedError {
+	return &reasonedError{Code: code, Reason: reason, Message: message}
+}
+
+// echo.HTTPError と同じ形式にしておく
+func (e *reasonedError) Error() string {
+	return fmt.Sprintf("code=%d, message=%s", e.Code, e.Message)
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
+	var re *reasonedError
+	if errors.As(err, &re) {
+		if e := c.JSON(re.Code, &ErrorResponse{Error: re.Error(), Reason: re.Reason}); e != nil {
+			c.Logger().Errorf("%+v", e)
+		}
+		return
+	}
 	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
+		// Internal (DB のエラーなど) はメッセージにも入っているので、レスポンスには載せない
+		if e := c.JSON(he.Code, &ErrorResponse{Error: fmt.Sprintf("code=%d, message=%v", he.Code, he.Message)}); e != nil {
 			c.Logger().Errorf("%+v", e)
 		}
 		return
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	echolog "github.com/labstack/gommon/log"
+)
+
+const (
+	maintenanceEnabledEnvKey = "ISUCON13_MAINTENANCE_ENABLED"
+	retentionDaysEnvKey      = "ISUCON13_RETENTION_DAYS"
+
+	defaultRetentionDays = 30
+	// 1回のDELETEで消す行数 (ロックを長く握らないように分割する)
+	maintenanceDeleteBatchSize = 1000
+)
+
+// 配信・報告の古いデータを消すメンテナンスジョブ
+// 統計APIの値が変わってしまうので、デフォルトでは無効
+var (
+	maintenanceEnabled = false
+	retentionPeriod    = defaultRetentionDays * 24 * time.Hour
+)
+
+func loadMaintenanceConfig() error {
+	if v, ok := os.LookupEnv(maintenanceEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", maintenanceEnabledEnvKey, err)
+		}
+		maintenanceEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(retentionDaysEnvKey); ok {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", retentionDaysEnvKey, v)
+		}
+		retentionPeriod = time.Duration(days) * 24 * time.Hour
+	}
+	return nil
+}
+
+type maintenanceTask struct {
+	Name string
+	// cron形式 (分 時 日 月 曜日)
+	Schedule string
+	// スケジューラで実行するかどうか (CLIからは常に実行できる)
+	Enabled func() bool
+	// 削除 (集計の場合は更新) した行数を返す
+	Run func(ctx context.Context) (int64, error)
+}
+
+func isMaintenanceEnabled() bool { return maintenanceEnabled }
+
+// maintenanceTasks は実行できるメンテナンスジョブの一覧
+// NOTE: ログインセッションはCookieに持つが、セッションの追跡を有効にすると user_sessions に残るので、期限切れのものを消す
+// NOTE: ライブコメントは論理削除していない (モデレーションで物理削除している) ので、対応するジョブは無い
+var maintenanceTasks = []maintenanceTask{
+	{
+		Name:     "viewers_history",
+		Schedule: "10 4 * * *",
+		Enabled:  isMaintenanceEnabled,
+		Run: func(ctx context.Context) (int64, error) {
+			return deleteInBatches(ctx, "DELETE FROM livestream_viewers_history WHERE livestream_id IN (SELECT id FROM livestreams WHERE end_at < ?)", clock.Now().Add(-retentionPeriod).Unix())
+		},
+	},
+	{
+		// 同時視聴者数のサンプルは配信終了後の分析レポートのピークにしか使わない (レポートは livestream_analytics に残る)
+		Name:     "viewer_samples",
+		Schedule: "15 4 * * *",
+		Enabled:  isMaintenanceEnabled,
+		Run: func(ctx context.Context) (int64, error) {
+			return deleteInBatches(ctx, "DELETE FROM livestream_viewer_samples WHERE livestream_id IN (SELECT id FROM livestreams WHERE end_at < ?)", clock.Now().Add(-retentionPeriod).Unix())
+		},
+	},
+	{
+		Name:     "access_tokens",
+		Schedule: "*/15 * * * *",
+		Enabled:  isMaintenanceEnabled,
+		Run: func(ctx context.Context) (int64, error) {
+			return deleteInBatches(ctx, "DELETE FROM livestream_access_tokens WHERE expires_at < ?", clock.Now().Unix())
+		},
+	},
+	{
+		Name:     "user_sessions",
+		Schedule: "*/15 * * * *",
+		Enabled:  func() bool { return sessionTrackingEnabled },
+		Run: func(ctx context.Context) (int64, error) {
+			return deleteInBatches(ctx, "DELETE FROM user_sessions WHERE expires_at < ?", clock.Now().Unix())
+		},
+	},
+	{
+		// 解決 (削除・却下・配信者の判断) してから保持期間が過ぎた報告を消す (未解決の resolved_at は 0)
+		Name:     "resolved_reports",
+		Schedule: "20 4 * * *",
+		Enabled:  isMaintenanceEnabled,
+		Run: func(ctx context.Context) (int64, error) {
+			return deleteInBatches(ctx, "DELETE FROM livecomment_reports WHERE resolved_at > 0 AND resolved_at < ?", clock.Now().Add(-retentionPeriod).Unix())
+		},
+	},
+	{
+		Name:     "client_metadata",
+		Schedule: "0 * * * *",
+		Enabled:  func() bool { return clientMetadataEnabled },
+		Run: func(ctx context.Context) (int64, error) {
+			return deleteInBatches(ctx, "DELETE FROM client_metadata WHERE created_at < ?", clock.Now().Add(-clientMetadataRetention).Unix())
+		},
+	},
+}
+
+// deleteInBatches は query に LIMIT を付けて、消す行がなくなるまで繰り返す
+func deleteInBatches(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	var total int64
+	args = append(args, maintenanceDeleteBatchSize)
+	for {
+		rs, err := dbConn.ExecContext(ctx, query+" LIMIT ?", args...)
+		if err != nil {
+			return total, err
+		}
+		n, err := rs.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < maintenanceDeleteBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// cronSchedule は cron 形式のスケジュール (分 時 日 月 曜日)
+// 各フィールドは *, */n, 数値, a-b とそのカンマ区切りに対応する
+type cronSchedule struct {
+	fields [5]map[int]struct{}
+}
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("cron schedule must have 5 fields: %q", spec)
+	}
+
+	s := &cronSchedule{}
+	for i, part := range parts {
+		min, max := cronFieldRanges[i][0], cronFieldRanges[i][1]
+		values := map[int]struct{}{}
+		for _, item := range strings.Split(part, ",") {
+			lo, hi, step := min, max, 1
+			rangePart := item
+			if idx := strings.Index(item, "/"); idx >= 0 {
+				n, err := strconv.Atoi(item[idx+1:])
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("invalid step in cron schedule: %q", spec)
+				}
+				step = n
+				rangePart = item[:idx]
+			}
+			if rangePart != "*" {
+				bounds := strings.SplitN(rangePart, "-", 2)
+				var err error
+				if lo, err = strconv.Atoi(bounds[0]); err != nil {
+					return nil, fmt.Errorf("invalid value in cron schedule: %q", spec)
+				}
+				hi = lo
+				if len(bounds) == 2 {
+					if hi, err = strconv.Atoi(bounds[1]); err != nil {
+						return nil, fmt.Errorf("invalid value in cron schedule: %q", spec)
+					}
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("out of range value in cron schedule: %q", spec)
+			}
+			for v := lo; v <= hi; v += step {
+				values[v] = struct{}{}
+			}
+		}
+		s.fields[i] = values
+	}
+	return s, nil
+}
+
+func (s *cronSchedule) Match(t time.Time) bool {
+	for i, v := range []int{t.Minute(), t.Hour(), t.Day(), int(t.Month()), int(t.Weekday())} {
+		if _, ok := s.fields[i][v]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func runMaintenanceTask(ctx context.Context, logger echo.Logger, task maintenanceTask) error {
+	startedAt := clock.Now()
+	n, err := task.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("maintenance task %s failed after affecting %d rows: %w", task.Name, n, err)
+	}
+	logger.Infof("maintenance task %s affected %d rows in %s", task.Name, n, clock.Now().Sub(startedAt))
+	return nil
+}
+
+// runMaintenanceScheduler は毎分、スケジュールに一致するメンテナンスジョブを実行する
+func runMaintenanceScheduler(ctx context.Context, logger echo.Logger) {
+	schedules := make([]*cronSchedule, len(maintenanceTasks))
+	for i, task := range maintenanceTasks {
+		s, err := parseCronSchedule(task.Schedule)
+		if err != nil {
+			logger.Errorf("failed to parse schedule of maintenance task %s: %v", task.Name, err)
+			return
+		}
+		schedules[i] = s
+	}
+
+	for {
+		now := clock.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		for i, task := range maintenanceTasks {
+			if !task.Enabled() || !schedules[i].Match(next) {
+				continue
+			}
+			if err := runMaintenanceTask(ctx, logger, task); err != nil {
+				logger.Warnf("%v", err)
+			}
+		}
+	}
+}
+
+// runMaintenanceCommand は `isupipe maintenance [task...]` として手動でジョブを実行する
+// タスク名を省略すると全てのジョブを実行する
+func runMaintenanceCommand(args []string) int {
+	logger := echolog.New("maintenance")
+	logger.SetLevel(echolog.INFO)
+
+	if err := loadClockConfig(); err != nil {
+		logger.Errorf("failed to load clock config: %v", err)
+		return 1
+	}
+	if err := loadMaintenanceConfig(); err != nil {
+		logger.Errorf("failed to load maintenance config: %v", err)
+		return 1
+	}
+	if err := loadClientMetadataConfig(); err != nil {
+		logger.Errorf("failed to load client metadata config: %v", err)
+		return 1
+	}
+	if err := loadSessionConfig(); err != nil {
+		logger.Errorf("failed to load session config: %v", err)
+		return 1
+	}
+
+	tasks := maintenanceTasks
+	if len(args) > 0 {
+		tasks = nil
+		for _, name := range args {
+			var found bool
+			for _, task := range maintenanceTasks {
+				if task.Name == name {
+					tasks = append(tasks, task)
+					found = true
+					break
+				}
+			}
+			if !found {
+				names := make([]string, len(maintenanceTasks))
+				for i, task := range maintenanceTasks {
+					names[i] = task.Name
+				}
+				logger.Errorf("unknown maintenance task %q (available: %s)", name, strings.Join(names, ", "))
+				return 2
+			}
+		}
+	}
+
+	conn, err := connectDB(logger)
+	if err != nil {
+		logger.Errorf("failed to connect db: %v", err)
+		return 1
+	}
+	defer conn.Close()
+	dbConn = conn
+
+	ctx := context.Background()
+	status := 0
+	for _, task := range tasks {
+		if err := runMaintenanceTask(ctx, logger, task); err != nil {
+			logger.Errorf("%v", err)
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// スパム報告の対応時間 (報告から解決まで) を集計する期間 (解決した日時で絞る)
+const moderationSLAWindow = 7 * 24 * time.Hour
+
+// ModerationSLA はスパム報告の対応時間の指標
+type ModerationSLA struct {
+	WindowSeconds int64 `json:"window_seconds"`
+	// 期間中に解決した報告の数
+	ResolvedReports int64 `json:"resolved_reports"`
+	// 未解決の報告の数 (期間に関わらず)
+	OpenReports   int64 `json:"open_reports"`
+	MedianSeconds int64 `json:"median_seconds"`
+	P90Seconds    int64 `json:"p90_seconds"`
+
+	// Prometheus の summary に出す合計
+	sumSeconds int64
+}
+
+// computeModerationSLA は配信者の配信に付いた報告の対応時間を集計する (streamerID が 0 ならプラットフォーム全体)
+func computeModerationSLA(ctx context.Context, db sqlx.QueryerContext, streamerID int64) (ModerationSLA, error) {
+	sla := ModerationSLA{WindowSeconds: int64(moderationSLAWindow / time.Second)}
+
+	from := "FROM livecomment_reports r"
+	var args []interface{}
+	if streamerID != 0 {
+		from += " INNER JOIN livestreams l ON l.id = r.livestream_id AND l.user_id = ?"
+		args = append(args, streamerID)
+	}
+
+	var durations []int64
+	if err := sqlx.SelectContext(ctx, db, &durations, "SELECT r.resolved_at - r.created_at AS duration "+from+" WHERE r.resolved_at >= ? ORDER BY duration", append(args, clock.Now().Add(-moderationSLAWindow).Unix())...); err != nil {
+		return ModerationSLA{}, err
+	}
+	if err := sqlx.GetContext(ctx, db, &sla.OpenReports, "SELECT COUNT(*) "+from+" WHERE r.resolved_at = 0", args...); err != nil {
+		return ModerationSLA{}, err
+	}
+
+	sla.ResolvedReports = int64(len(durations))
+	for _, d := range durations {
+		sla.sumSeconds += d
+	}
+	sla.MedianSeconds = durationQuantile(durations, 0.5)
+	sla.P90Seconds = durationQuantile(durations, 0.9)
+	return sla, nil
+}
+
+// durationQuantile は昇順に並んだ sorted の q 分位点を返す (nearest-rank)
+func durationQuantile(sorted []int64, q float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// resolveLivecommentReports はコメントに付いた未解決の報告を解決済みにする
+// コメントを削除・却下したときに同じトランザクションで呼ぶ
+func resolveLivecommentReports(ctx context.Context, tx *sqlx.Tx, livestreamID int64, livecommentIDs []int64) error {
+	if len(livecommentIDs) == 0 {
+		return nil
+	}
+	args := []interface{}{clock.Now().Unix(), livestreamID}
+	for _, id := range livecommentIDs {
+		args = append(args, id)
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE livecomment_reports SET resolved_at = ? WHERE livestream_id = ? AND livecomment_id IN (?"+strings.Repeat(", ?", len(livecommentIDs)-1)+") AND resolved_at = 0", args...)
+	return err
+}
+
+// スパム報告を解決済みにするAPI (配信者向け)
+// POST /api/livestream/:livestream_id/report/:report_id/resolve
+// コメントを残したまま報告を退ける場合に使う (削除・却下したコメントの報告は自動で解決済みになる)
+func resolveLivecommentReportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	reportID, err := strconv.ParseInt(c.Param("report_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "report_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var report LivecommentReport
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var m LivecommentReportModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM livecomment_reports WHERE id = ? AND livestream_id = ? FOR UPDATE", reportID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livecomment report not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report: "+err.Error()).SetInternal(err)
+		}
+		if m.ResolvedAt != 0 {
+			return echo.NewHTTPError(http.StatusConflict, "livecomment report is already resolved")
+		}
+
+		before := m
+		m.ResolvedAt = clock.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "UPDATE livecomment_reports SET resolved_at = ? WHERE id = ?", m.ResolvedAt, m.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to resolve livecomment report: "+err.Error()).SetInternal(err)
+		}
+		if err := insertAuditLog(ctx, tx, userID, auditActionReportResolve, auditTargetLivecommentReport, m.ID, livestreamID, before, m); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+
+		var err error
+		report, err = fillLivecommentReportResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// 配信者のスパム報告の対応時間の取得API
+// GET /api/user/:username/statistics/moderation
+func getUserModerationSLAHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	var user UserModel
+	if err := dbConn.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", c.Param("username")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+	}
+
+	sla, err := computeModerationSLA(ctx, dbConn, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compute moderation sla: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, sla)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	moderationEventLivecommentsDeleted = "livecomments_deleted"
+	// 配信の状態 (upcoming / live / ended) が変わった
+	moderationEventStatusChanged = "status_changed"
+	// 視聴ルームのチャット (ルームに参加して購読しているクライアントにだけ届く)
+	moderationEventRoomMessage = "room_message"
+
+	moderationReasonNGWord = "ng_word"
+	moderationReasonSpam   = "spam"
+
+	// 他のサーバにイベントを伝える Redis の channel
+	moderationEventChannel = "moderation:events"
+
+	// プロキシに切られないよう、イベントが無くてもこの間隔でコメント行を送る
+	moderationStreamHeartbeatInterval = 15 * time.Second
+	// 送りきれずにこれだけ溜まったクライアントは切断する (再接続してコメント一覧を取り直してもらう)
+	moderationStreamBufferSize      = 32
+	moderationStreamResubscribeWait = 1 * time.Second
+)
+
+// ModerationBroadcast はモデレーションなどで配信の表示が変わったことを視聴中のクライアントに知らせる
+type ModerationBroadcast struct {
+	Type           string  `json:"type"`
+	LivestreamID   int64   `json:"livestream_id"`
+	LivecommentIDs []int64 `json:"livecomment_ids,omitempty"`
+	Reason         string  `json:"reason,omitempty"`
+	// status_changed のときだけ
+	Status string `json:"status,omitempty"`
+	// room_message のときだけ
+	RoomID      int64             `json:"room_id,omitempty"`
+	RoomMessage *WatchRoomMessage `json:"room_message,omitempty"`
+	CreatedAt   int64             `json:"created_at"`
+}
+
+// moderationHub はこのサーバに繋いでいるクライアント (配信ごと)
+// 値は購読しているルームの ID (ルームに入っていなければ 0)
+var moderationHub = struct {
+	sync.Mutex
+	subscribers map[int64]map[chan ModerationBroadcast]int64
+}{
+	subscribers: map[int64]map[chan ModerationBroadcast]int64{},
+}
+
+func subscribeModerationEvents(livestreamID, roomID int64) (<-chan ModerationBroadcast, func()) {
+	ch := make(chan ModerationBroadcast, moderationStreamBufferSize)
+	moderationHub.Lock()
+	subs, ok := moderationHub.subscribers[livestreamID]
+	if !ok {
+		subs = map[chan ModerationBroadcast]int64{}
+		moderationHub.subscribers[livestreamID] = subs
+	}
+	subs[ch] = roomID
+	moderationHub.Unlock()
+
+	unsubscribe := func() {
+		moderationHub.Lock()
+		defer moderationHub.Unlock()
+		removeModerationSubscriber(livestreamID, ch)
+	}
+	return ch, unsubscribe
+}
+
+// removeModerationSubscriber は moderationHub のロックを取って呼ぶ
+func removeModerationSubscriber(livestreamID int64, ch chan ModerationBroadcast) {
+	subs := moderationHub.subscribers[livestreamID]
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(moderationHub.subscribers, livestreamID)
+	}
+}
+
+// deliverModerationEvent はこのサーバに繋いでいるクライアントにイベントを渡す
+func deliverModerationEvent(ev ModerationBroadcast) {
+	moderationHub.Lock()
+	defer moderationHub.Unlock()
+	for ch, roomID := range moderationHub.subscribers[ev.LivestreamID] {
+		if ev.RoomID != 0 && ev.RoomID != roomID {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			removeModerationSubscriber(ev.LivestreamID, ch)
+		}
+	}
+}
+
+// publishModerationEvent はイベントを全サーバのクライアントに流す
+// 書き込みのコミット後に呼ぶこと
+func publishModerationEvent(ctx context.Context, logger echo.Logger, ev ModerationBroadcast) {
+	if ev.Type == moderationEventLivecommentsDeleted && len(ev.LivecommentIDs) == 0 {
+		return
+	}
+	// Redis があれば購読経由で自分にも届くので、直接は渡さない
+	if redisConn == nil {
+		deliverModerationEvent(ev)
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		logger.Warnf("failed to marshal moderation event: %v", err)
+		return
+	}
+	if _, err := redisConn.Do(ctx, "PUBLISH", moderationEventChannel, string(payload)); err != nil {
+		logger.Warnf("failed to publish moderation event: %v", err)
+	}
+}
+
+// runModerationEventSubscriber は他のサーバで起きたモデレーションを受け取る
+func runModerationEventSubscriber(ctx context.Context, logger echo.Logger) {
+	for {
+		err := redisConn.Subscribe(ctx, moderationEventChannel, func(payload string) {
+			var ev ModerationBroadcast
+			if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+				logger.Warnf("invalid moderation event: %q", payload)
+				return
+			}
+			deliverModerationEvent(ev)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warnf("moderation event subscription was closed: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(moderationStreamResubscribeWait):
+		}
+	}
+}
+
+// モデレーションイベントの購読API (Server-Sent Events)
+// GET /api/livestream/:livestream_id/moderation/events
+// 削除されたコメントの ID が届くので、クライアントは次のポーリングを待たずに表示から外す
+// 配信の開始・終了 (status_changed) も届く
+// room_id を付けると、参加している視聴ルームのチャット (room_message) も同じ接続で届く
+func getModerationEventsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	var roomID int64
+	if v := c.QueryParam("room_id"); v != "" {
+		if roomID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "room_id in query must be integer")
+		}
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamID, userID); err != nil {
+			return err
+		}
+		if roomID == 0 {
+			return nil
+		}
+		room, err := getWatchRoomAsMember(ctx, tx, roomID, userID)
+		if err != nil {
+			return err
+		}
+		if room.LivestreamID != livestreamID {
+			return echo.NewHTTPError(http.StatusNotFound, "watch room not found")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	events, unsubscribe := subscribeModerationEvents(livestreamID, roomID)
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(moderationStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case ev, ok := <-events:
+			if !ok {
+				// 送りきれなかったので切断する
+				return nil
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return nil
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxMuteWordsPerUser = 100
+	maxMuteWordLength   = 64
+
+	// 他のサーバでの追加・削除は、この時間だけ遅れて反映される
+	muteMatcherCacheTTL = 10 * time.Second
+)
+
+// MuteWordModel は視聴者が自分にだけ適用するミュートワード (配信者の NG ワードとは別)
+type MuteWordModel struct {
+	ID        int64  `json:"id" db:"id"`
+	UserID    int64  `json:"-" db:"user_id"`
+	Word      string `json:"word" db:"word"`
+	CreatedAt int64  `json:"created_at" db:"created_at"`
+}
+
+type PostMuteWordRequest struct {
+	Word string `json:"word"`
+}
+
+// muteMatcher はユーザのミュートワードのどれかを含むかを判定する (大文字・小文字は区別しない)
+// ミュートワードが無ければ nil
+type muteMatcher struct {
+	re *regexp.Regexp
+}
+
+func newMuteMatcher(words []string) *muteMatcher {
+	if len(words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return &muteMatcher{re: regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))}
+}
+
+func (m *muteMatcher) match(comment string) bool {
+	return m != nil && m.re.MatchString(comment)
+}
+
+type muteMatcherEntry struct {
+	matcher   *muteMatcher
+	expiresAt time.Time
+}
+
+var muteMatcherCache = struct {
+	sync.RWMutex
+	m map[int64]muteMatcherEntry
+}{
+	m: map[int64]muteMatcherEntry{},
+}
+
+func muteMatcherOf(ctx context.Context, userID int64) (*muteMatcher, error) {
+	now := clock.Now()
+	muteMatcherCache.RLock()
+	entry, ok := muteMatcherCache.m[userID]
+	muteMatcherCache.RUnlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.matcher, nil
+	}
+
+	var words []string
+	if err := dbConn.SelectContext(ctx, &words, "SELECT word FROM user_mute_words WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	matcher := newMuteMatcher(words)
+	muteMatcherCache.Lock()
+	muteMatcherCache.m[userID] = muteMatcherEntry{matcher: matcher, expiresAt: now.Add(muteMatcherCacheTTL)}
+	muteMatcherCache.Unlock()
+	return matcher, nil
+}
+
+func invalidateMuteMatcher(userID int64) {
+	muteMatcherCache.Lock()
+	delete(muteMatcherCache.m, userID)
+	muteMatcherCache.Unlock()
+}
+
+// resetMuteMatcherCache は初期化でデータを入れ直したときに呼ぶ
+func resetMuteMatcherCache() {
+	muteMatcherCache.Lock()
+	muteMatcherCache.m = map[int64]muteMatcherEntry{}
+	muteMatcherCache.Unlock()
+}
+
+// filterMutedLivecomments は視聴者のミュートワードを含むコメントを除く (自分のコメントは除かない)
+// 件数の指定は取得時に効いているので、除いた分だけ少なく返る
+func filterMutedLivecomments(ctx context.Context, userID int64, livecommentModels []LivecommentModel) ([]LivecommentModel, error) {
+	matcher, err := muteMatcherOf(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if matcher == nil {
+		return livecommentModels, nil
+	}
+	// 呼び出し元は元のスライスを使わないので、同じ配列に詰め直す
+	filtered := livecommentModels[:0]
+	for _, m := range livecommentModels {
+		if m.UserID != userID && matcher.match(m.Comment) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered, nil
+}
+
+// ミュートワード一覧取得API
+// GET /api/user/me/mute_words
+func getMuteWordsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	words := []MuteWordModel{}
+	if err := dbConn.SelectContext(ctx, &words, "SELECT * FROM user_mute_words WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get mute words: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, words)
+}
+
+// ミュートワード追加API
+// POST /api/user/me/mute_words
+func postMuteWordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PostMuteWordRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	word := strings.TrimSpace(req.Word)
+	if word == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "word must not be empty")
+	}
+	if len([]rune(word)) > maxMuteWordLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "word is too long")
+	}
+
+	m := MuteWordModel{UserID: userID, Word: word, CreatedAt: clock.Now().Unix()}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var count int64
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM user_mute_words WHERE user_id = ? FOR UPDATE", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count mute words: "+err.Error()).SetInternal(err)
+		}
+		if count >= maxMuteWordsPerUser {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many mute words")
+		}
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO user_mute_words (user_id, word, created_at) VALUES (:user_id, :word, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert mute word: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusConflict, "the word is already muted")
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted mute word id: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	invalidateMuteMatcher(userID)
+
+	return c.JSON(http.StatusCreated, m)
+}
+
+// ミュートワード削除API
+// DELETE /api/user/me/mute_words/:word_id
+func deleteMuteWordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	wordID, err := strconv.ParseInt(c.Param("word_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "word_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM user_mute_words WHERE id = ? AND user_id = ?", wordID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete mute word: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "mute word not found")
+	}
+	invalidateMuteMatcher(userID)
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	nPlusOneThresholdEnvKey = "ISUCON13_N_PLUS_ONE_THRESHOLD"
+
+	// ログに載せる fingerprint の数
+	maxNPlusOneReportedFingerprints = 5
+	// 1リクエストで流れたクエリ数を返すヘッダ (検知が有効な場合のみ)
+	headerQueryCount = "X-Query-Count"
+)
+
+// 開発用の N+1 の検知
+// 1リクエストで同じ形のクエリがこの回数を超えて流れたら警告を出す (0 なら無効)
+// すべてのクエリを数えるので、デフォルトでは無効
+var nPlusOneThreshold = 0
+
+type requestQueryCounterKey struct{}
+
+// requestQueryCounter は1リクエストで流れたクエリを形ごとに数える
+type requestQueryCounter struct {
+	mu            sync.Mutex
+	total         int
+	byFingerprint map[string]int
+}
+
+func loadNPlusOneConfig() error {
+	if v, ok := os.LookupEnv(nPlusOneThresholdEnvKey); ok {
+		threshold, err := strconv.Atoi(v)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as non-negative integer: %+v", nPlusOneThresholdEnvKey, err)
+		}
+		nPlusOneThreshold = threshold
+	}
+	return nil
+}
+
+// requestQueryCounterFrom は ctx の requestQueryCounter を返す (検知が無効な場合は nil)
+func requestQueryCounterFrom(ctx context.Context) *requestQueryCounter {
+	counter, _ := ctx.Value(requestQueryCounterKey{}).(*requestQueryCounter)
+	return counter
+}
+
+func (r *requestQueryCounter) add(fingerprint string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.total++
+	r.byFingerprint[fingerprint]++
+	r.mu.Unlock()
+}
+
+func (r *requestQueryCounter) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total
+}
+
+// repeated は閾値を超えて流れた形を多い順に返す
+func (r *requestQueryCounter) repeated(threshold int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var fingerprints []string
+	for f, n := range r.byFingerprint {
+		if n > threshold {
+			fingerprints = append(fingerprints, f)
+		}
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		a, b := r.byFingerprint[fingerprints[i]], r.byFingerprint[fingerprints[j]]
+		if a != b {
+			return a > b
+		}
+		return fingerprints[i] < fingerprints[j]
+	})
+	for i, f := range fingerprints {
+		fingerprints[i] = fmt.Sprintf("%dx %s", r.byFingerprint[f], f)
+	}
+	return fingerprints
+}
+
+// nPlusOneDetectorMiddleware はリクエストごとにクエリを数え、同じ形のクエリが閾値を超えたら警告を出す
+// 数はレスポンスヘッダにも付ける (ヘッダを書いた時点までの数)
+func nPlusOneDetectorMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if nPlusOneThreshold <= 0 {
+			return next(c)
+		}
+
+		counter := &requestQueryCounter{byFingerprint: map[string]int{}}
+		req := c.Request()
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestQueryCounterKey{}, counter)))
+		c.Response().Before(func() {
+			c.Response().Header().Set(headerQueryCount, strconv.Itoa(counter.count()))
+		})
+
+		err := next(c)
+
+		if repeated := counter.repeated(nPlusOneThreshold); len(repeated) > 0 {
+			if len(repeated) > maxNPlusOneReportedFingerprints {
+				repeated = repeated[:maxNPlusOneReportedFingerprints]
+			}
+			c.Logger().Warnf("possible N+1 at %s %s: %d queries in total; %s", req.Method, c.Path(), counter.count(), strings.Join(repeated, "; "))
+		}
+		return err
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	notificationKindWaitlistPromoted = "waitlist.promoted"
+	notificationKindWaitlistRejected = "waitlist.rejected"
+
+	defaultNotificationsLimit = 50
+)
+
+type NotificationModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Kind      string `db:"kind"`
+	Payload   []byte `db:"payload"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type Notification struct {
+	ID        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+// insertNotification はユーザへの通知を追加する
+func insertNotification(ctx context.Context, tx *sqlx.Tx, userID int64, kind string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO notifications (user_id, kind, payload, created_at) VALUES (?, ?, ?, ?)", userID, kind, b, clock.Now().Unix())
+	return err
+}
+
+// 自分宛の通知一覧取得API
+// GET /api/notifications
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	q := newSelectQuery("SELECT * FROM notifications").
+		Where("user_id = ?", userID).
+		OrderBy("created_at DESC, id DESC").
+		Limit(defaultNotificationsLimit)
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	if err := q.WhereInt64Param(c, "since", "created_at >= ?"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var notificationModels []NotificationModel
+	if err := dbConn.SelectContext(ctx, &notificationModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error()).SetInternal(err)
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i, m := range notificationModels {
+		notifications[i] = Notification{
+			ID:        m.ID,
+			Kind:      m.Kind,
+			Payload:   m.Payload,
+			CreatedAt: m.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, notifications)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	oauthRedirectBaseURLEnvKey = "ISUCON13_OAUTH_REDIRECT_BASE_URL"
+
+	oauthProviderGitHub = "github"
+	oauthProviderGoogle = "google"
+
+	// 認可リクエストの state を持つ Cookie セッション
+	oauthStateSessionName = "oauth_state"
+	oauthStateTTL         = 10 * time.Minute
+	oauthHTTPTimeout      = 5 * time.Second
+)
+
+// oauthProvider は OAuth2 (authorization code flow) のプロバイダ設定
+type oauthProvider struct {
+	Name         string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+	ClientID     string
+	ClientSecret string
+	// ユーザ情報APIのレスポンスから外部IDとメールアドレスを取り出す
+	ParseUser func(body []byte) (externalID, email string, err error)
+}
+
+// client id と secret の両方が環境変数で与えられたプロバイダだけ有効にする
+var (
+	oauthProviders       = map[string]*oauthProvider{}
+	oauthRedirectBaseURL string
+	oauthHTTPClient      = &http.Client{Timeout: oauthHTTPTimeout}
+)
+
+func loadOAuthConfig() error {
+	candidates := []*oauthProvider{
+		{
+			Name:        oauthProviderGitHub,
+			AuthURL:     "https://github.com/login/oauth/authorize",
+			TokenURL:    "https://github.com/login/oauth/access_token",
+			UserInfoURL: "https://api.github.com/user",
+			Scopes:      []string{"read:user", "user:email"},
+			ParseUser: func(body []byte) (string, string, error) {
+				var u struct {
+					ID    int64  `json:"id"`
+					Email string `json:"email"`
+				}
+				if err := json.Unmarshal(body, &u); err != nil {
+					return "", "", err
+				}
+				return strconv.FormatInt(u.ID, 10), u.Email, nil
+			},
+		},
+		{
+			Name:        oauthProviderGoogle,
+			AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:    "https://oauth2.googleapis.com/token",
+			UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+			Scopes:      []string{"openid", "email"},
+			ParseUser: func(body []byte) (string, string, error) {
+				var u struct {
+					Sub   string `json:"sub"`
+					Email string `json:"email"`
+				}
+				if err := json.Unmarshal(body, &u); err != nil {
+					return "", "", err
+				}
+				return u.Sub, u.Email, nil
+			},
+		},
+	}
+
+	for _, p := range candidates {
+		prefix := "ISUCON13_OAUTH_" + strings.ToUpper(p.Name)
+		p.ClientID = os.Getenv(prefix + "_CLIENT_ID")
+		p.ClientSecret = os.Getenv(prefix + "_CLIENT_SECRET")
+		if p.ClientID == "" && p.ClientSecret == "" {
+			continue
+		}
+		if p.ClientID == "" || p.ClientSecret == "" {
+			return fmt.Errorf("both environment variables '%s_CLIENT_ID' and '%s_CLIENT_SECRET' must be provided", prefix, prefix)
+		}
+		oauthProviders[p.Name] = p
+	}
+
+	if len(oauthProviders) > 0 {
+		v, ok := os.LookupEnv(oauthRedirectBaseURLEnvKey)
+		if !ok || v == "" {
+			return fmt.Errorf("environment variable '%s' must be provided when oauth providers are configured", oauthRedirectBaseURLEnvKey)
+		}
+		oauthRedirectBaseURL = strings.TrimSuffix(v, "/")
+	}
+	return nil
+}
+
+func (p *oauthProvider) redirectURL() string {
+	return oauthRedirectBaseURL + "/api/oauth/" + p.Name + "/callback"
+}
+
+// exchange は認可コードをアクセストークンに交換し、外部アカウントの情報を取得する
+func (p *oauthProvider) exchange(ctx context.Context, code string) (externalID, email string, err error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL()},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", "", err
+	}
+	if token.AccessToken == "" {
+		return "", "", errors.New("token endpoint returned no access token")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err = oauthHTTPClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("userinfo endpoint returned status %d", resp.StatusCode)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", "", err
+	}
+	externalID, email, err = p.ParseUser(body)
+	if err != nil {
+		return "", "", err
+	}
+	if externalID == "" || externalID == "0" {
+		return "", "", errors.New("userinfo endpoint returned no user id")
+	}
+	return externalID, email, nil
+}
+
+func lookupOAuthProvider(c echo.Context) (*oauthProvider, error) {
+	p, ok := oauthProviders[c.Param("provider")]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "oauth provider is not configured")
+	}
+	return p, nil
+}
+
+type ExternalIdentityModel struct {
+	ID         int64          `db:"id"`
+	UserID     int64          `db:"user_id"`
+	Provider   string         `db:"provider"`
+	ExternalID string         `db:"external_id"`
+	Email      sql.NullString `db:"email"`
+	CreatedAt  int64          `db:"created_at"`
+}
+
+type ExternalIdentity struct {
+	Provider   string `json:"provider"`
+	ExternalID string `json:"external_id"`
+	Email      string `json:"email,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+func newExternalIdentity(m ExternalIdentityModel) ExternalIdentity {
+	return ExternalIdentity{
+		Provider:   m.Provider,
+		ExternalID: m.ExternalID,
+		Email:      m.Email.String,
+		CreatedAt:  m.CreatedAt,
+	}
+}
+
+// OAuth 認可開始API
+// GET /api/oauth/:provider/authorize
+// ?link=true のときはログイン中のユーザに外部アカウントを連携する
+func oauthAuthorizeHandler(c echo.Context) error {
+	p, err := lookupOAuthProvider(c)
+	if err != nil {
+		return err
+	}
+
+	var linkUserID int64
+	if c.QueryParam("link") == "true" {
+		if err := verifyUserSession(c); err != nil {
+			return err
+		}
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		linkUserID = sess.Values[defaultUserIDKey].(int64)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate oauth state: "+err.Error()).SetInternal(err)
+	}
+	state := hex.EncodeToString(buf)
+
+	stateSess, err := session.Get(oauthStateSessionName, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session: "+err.Error()).SetInternal(err)
+	}
+	stateSess.Options = sessionCookieOptions()
+	stateSess.Options.MaxAge = int(oauthStateTTL.Seconds())
+	stateSess.Values["state"] = state
+	stateSess.Values["provider"] = p.Name
+	stateSess.Values["link_user_id"] = linkUserID
+	stateSess.Values["expires"] = clock.Now().Add(oauthStateTTL).Unix()
+	if err := stateSess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error()).SetInternal(err)
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.redirectURL()},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+	}
+	return c.Redirect(http.StatusFound, p.AuthURL+"?"+q.Encode())
+}
+
+// OAuth コールバックAPI
+// GET /api/oauth/:provider/callback
+// 連携済みの外部アカウントならパスワードログインと同じセッションを発行する
+func oauthCallbackHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	p, err := lookupOAuthProvider(c)
+	if err != nil {
+		return err
+	}
+
+	stateSess, err := session.Get(oauthStateSessionName, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid oauth state")
+	}
+	state, _ := stateSess.Values["state"].(string)
+	provider, _ := stateSess.Values["provider"].(string)
+	linkUserID, _ := stateSess.Values["link_user_id"].(int64)
+	expires, _ := stateSess.Values["expires"].(int64)
+
+	// state は一度きり
+	stateSess.Options = sessionCookieOptions()
+	stateSess.Options.MaxAge = -1
+	if err := stateSess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error()).SetInternal(err)
+	}
+
+	if state == "" || state != c.QueryParam("state") || provider != p.Name || clock.Now().Unix() > expires {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid oauth state")
+	}
+	code := c.QueryParam("code")
+	if code == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "code is required")
+	}
+
+	externalID, email, err := p.exchange(ctx, code)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to exchange oauth code: "+err.Error())
+	}
+
+	if linkUserID != 0 {
+		var identity ExternalIdentityModel
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			identity = ExternalIdentityModel{
+				UserID:     linkUserID,
+				Provider:   p.Name,
+				ExternalID: externalID,
+				Email:      sql.NullString{String: email, Valid: email != ""},
+				CreatedAt:  clock.Now().Unix(),
+			}
+			if _, err := tx.NamedExecContext(ctx, "INSERT INTO external_identities (user_id, provider, external_id, email, created_at) VALUES (:user_id, :provider, :external_id, :email, :created_at)", identity); err != nil {
+				if isDuplicateEntryError(err) {
+					return echo.NewHTTPError(http.StatusConflict, "the external account or provider is already linked")
+				}
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert external identity: "+err.Error()).SetInternal(err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusCreated, newExternalIdentity(identity))
+	}
+
+	var userModel UserModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &userModel, "SELECT u.* FROM users u INNER JOIN external_identities e ON e.user_id = u.id WHERE e.provider = ? AND e.external_id = ?", p.Name, externalID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "the external account is not linked to any user")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := issueUserSession(c, userModel); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// 連携済み外部アカウント一覧API
+// GET /api/user/me/identities
+func getMyExternalIdentitiesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var models []ExternalIdentityModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM external_identities WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get external identities: "+err.Error()).SetInternal(err)
+	}
+
+	identities := make([]ExternalIdentity, len(models))
+	for i := range models {
+		identities[i] = newExternalIdentity(models[i])
+	}
+	return c.JSON(http.StatusOK, identities)
+}
+
+// 外部アカウントの連携解除API
+// DELETE /api/user/me/identities/:provider
+func deleteMyExternalIdentityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM external_identities WHERE user_id = ? AND provider = ?", userID, c.Param("provider"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete external identity: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "external identity not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
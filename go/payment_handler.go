@@ -3,6 +3,8 @@ package main
 import (
 	"net/http"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -13,22 +15,83 @@ type PaymentResult struct {
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(lc.tip), 0) FROM "+livecommentsAggregateTable()+" lc"); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, &PaymentResult{
 		TotalTip: totalTip,
 	})
 }
+
+type PayoutAmount struct {
+	Gross       int64 `json:"gross" db:"gross"`
+	PlatformFee int64 `json:"platform_fee" db:"platform_fee"`
+	Net         int64 `json:"net" db:"net"`
+}
+
+type LivestreamPayout struct {
+	LivestreamID int64 `json:"livestream_id"`
+	PayoutAmount
+}
+
+type PayoutSummary struct {
+	Total       PayoutAmount       `json:"total"`
+	Livestreams []LivestreamPayout `json:"livestreams"`
+	// メンバーシップの月額 (配信に紐付かない)
+	Memberships PayoutAmount `json:"memberships"`
+}
+
+// 配信者向けの収益サマリ
+// NOTE: 台帳に記帳されたチップのみが対象 (台帳を導入する前の初期データのチップは含まない)
+func getPayoutSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var summary PayoutSummary
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var rows []struct {
+			LivestreamID int64 `db:"livestream_id"`
+			Gross        int64 `db:"gross"`
+			PlatformFee  int64 `db:"platform_fee"`
+			Net          int64 `db:"net"`
+		}
+		if err := tx.SelectContext(ctx, &rows, "SELECT livestream_id, SUM(gross) AS gross, SUM(platform_fee) AS platform_fee, SUM(net) AS net FROM payment_ledger WHERE streamer_id = ? AND kind = ? GROUP BY livestream_id ORDER BY livestream_id", userID, paymentKindTip); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payout: "+err.Error()).SetInternal(err)
+		}
+		if err := tx.GetContext(ctx, &summary.Memberships, "SELECT IFNULL(SUM(gross), 0) AS gross, IFNULL(SUM(platform_fee), 0) AS platform_fee, IFNULL(SUM(net), 0) AS net FROM payment_ledger WHERE streamer_id = ? AND kind = ?", userID, paymentKindMembership); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get membership payout: "+err.Error()).SetInternal(err)
+		}
+		summary.Total = summary.Memberships
+
+		summary.Livestreams = make([]LivestreamPayout, len(rows))
+		for i, r := range rows {
+			summary.Livestreams[i] = LivestreamPayout{
+				LivestreamID: r.LivestreamID,
+				PayoutAmount: PayoutAmount{Gross: r.Gross, PlatformFee: r.PlatformFee, Net: r.Net},
+			}
+			summary.Total.Gross += r.Gross
+			summary.Total.PlatformFee += r.PlatformFee
+			summary.Total.Net += r.Net
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
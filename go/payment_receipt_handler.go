@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const receiptMonthLayout = "2006-01"
+
+// 領収書の明細 (PDFに出す場合もこの並びで1行ずつ出す想定)
+type ReceiptItem struct {
+	// チップを受け取った日時 (UNIX時間)
+	PaidAt int64 `json:"paid_at" db:"paid_at"`
+	// tip か membership (membership の場合は配信・コメントの項目は空)
+	Kind            string `json:"kind" db:"kind"`
+	LivestreamID    int64  `json:"livestream_id" db:"livestream_id"`
+	LivestreamTitle string `json:"livestream_title" db:"livestream_title"`
+	LivecommentID   int64  `json:"livecomment_id" db:"livecomment_id"`
+	CutPercent      int64  `json:"cut_percent" db:"cut_percent"`
+	PayoutAmount
+}
+
+type Receipt struct {
+	// 対象月 (UTC, YYYY-MM)
+	Month string `json:"month"`
+	// 月が締まっているか (締まっていなければ今後も明細が増える)
+	Closed   bool          `json:"closed"`
+	IssuedAt int64         `json:"issued_at"`
+	Streamer User          `json:"streamer"`
+	Items    []ReceiptItem `json:"items"`
+	Total    PayoutAmount  `json:"total"`
+}
+
+// 配信者向けの月ごとの領収書取得API
+// GET /api/payment/receipts?month=YYYY-MM
+// 締まった月の領収書は内容が変わらないので、初回に作ったものを payment_receipts に保存して返す
+func getPaymentReceiptHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	monthStart, err := time.ParseInLocation(receiptMonthLayout, c.QueryParam("month"), time.UTC)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "month query parameter must be formatted as YYYY-MM")
+	}
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	month := monthStart.Format(receiptMonthLayout)
+	now := clock.Now()
+	if monthStart.After(now) {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't issue receipt for future month")
+	}
+	closed := !monthEnd.After(now)
+
+	var receipt Receipt
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if closed {
+			var body []byte
+			err := tx.GetContext(ctx, &body, "SELECT body FROM payment_receipts WHERE user_id = ? AND month = ?", userID, month)
+			if err == nil {
+				if err := json.Unmarshal(body, &receipt); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode cached receipt: "+err.Error()).SetInternal(err)
+				}
+				return nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get cached receipt: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		streamer, err := fillUserResponseByID(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+		}
+
+		var items []ReceiptItem
+		if err := tx.SelectContext(ctx, &items, `
+			SELECT p.created_at AS paid_at, p.kind, p.livestream_id, IFNULL(l.title, '') AS livestream_title, p.livecomment_id, p.cut_percent, p.gross, p.platform_fee, p.net
+			FROM payment_ledger p
+			LEFT JOIN livestreams l ON l.id = p.livestream_id
+			WHERE p.streamer_id = ? AND p.created_at >= ? AND p.created_at < ?
+			ORDER BY p.created_at, p.id`, userID, monthStart.Unix(), monthEnd.Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payment ledger: "+err.Error()).SetInternal(err)
+		}
+
+		receipt = Receipt{
+			Month:    month,
+			Closed:   closed,
+			IssuedAt: now.Unix(),
+			Streamer: streamer,
+			Items:    items,
+		}
+		if receipt.Items == nil {
+			receipt.Items = []ReceiptItem{}
+		}
+		for _, item := range items {
+			receipt.Total.Gross += item.Gross
+			receipt.Total.PlatformFee += item.PlatformFee
+			receipt.Total.Net += item.Net
+		}
+
+		if !closed {
+			return nil
+		}
+		body, err := json.Marshal(receipt)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode receipt: "+err.Error()).SetInternal(err)
+		}
+		// 同時に作られた場合は先に保存されたものを正とする
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO payment_receipts (user_id, month, body, created_at) VALUES (?, ?, ?, ?)", userID, month, body, now.Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to cache receipt: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=\"receipt-%s.json\"", month))
+	return c.JSON(http.StatusOK, receipt)
+}
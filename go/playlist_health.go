@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	playlistHealthCheckEnabledEnvKey = "ISUCON13_PLAYLIST_HEALTH_CHECK_ENABLED"
+
+	notificationKindLivestreamBrokenURL = "livestream.broken_url"
+
+	playlistHealthWorkerInterval  = 1 * time.Minute
+	playlistHealthWorkerBatchSize = 50
+	// 同じ配信はこの間隔を空けて確認し直す
+	playlistHealthRecheckInterval = 5 * time.Minute
+	playlistHealthCheckTimeout    = 3 * time.Second
+)
+
+// 予定・配信中の配信の playlist_url / thumbnail_url を定期的に HEAD で確認する
+// 外部へのリクエストが増えるので、デフォルトでは無効
+var (
+	playlistHealthCheckEnabled = false
+	playlistHealthClient       = &http.Client{Timeout: playlistHealthCheckTimeout}
+)
+
+// LivestreamURLHealthModel は最後に確認した URL とその結果
+// 確認した後で URL を直していれば、次の確認を待たずに壊れていない扱いにする
+type LivestreamURLHealthModel struct {
+	LivestreamID    int64  `db:"livestream_id"`
+	PlaylistUrl     string `db:"playlist_url"`
+	PlaylistBroken  bool   `db:"playlist_broken"`
+	ThumbnailUrl    string `db:"thumbnail_url"`
+	ThumbnailBroken bool   `db:"thumbnail_broken"`
+	CheckedAt       int64  `db:"checked_at"`
+}
+
+// healthyLivestreamCondition は table (livestreams かその別名) の URL が壊れていると確認済みでなければ真になる条件
+// 配信一覧・おすすめから、直るまで外すのに使う
+func healthyLivestreamCondition(table string) string {
+	return `NOT EXISTS (
+		SELECT 1 FROM livestream_url_health h
+		WHERE h.livestream_id = ` + table + `.id AND (
+			(h.playlist_broken AND h.playlist_url = ` + table + `.playlist_url) OR
+			(h.thumbnail_broken AND h.thumbnail_url = ` + table + `.thumbnail_url)
+		)
+	)`
+}
+
+func loadPlaylistHealthConfig() error {
+	if v, ok := os.LookupEnv(playlistHealthCheckEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", playlistHealthCheckEnabledEnvKey, err)
+		}
+		playlistHealthCheckEnabled = enabled
+	}
+	return nil
+}
+
+func runPlaylistHealthWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(playlistHealthWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := checkLivestreamURLs(ctx, logger); err != nil {
+			logger.Warnf("failed to check livestream urls: %v", err)
+		}
+	}
+}
+
+// checkLivestreamURLs は確認してから時間の経った配信 (未確認のものを優先) の URL を確認する
+func checkLivestreamURLs(ctx context.Context, logger echo.Logger) error {
+	now := clock.Now()
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, `
+		SELECT l.* FROM livestreams l
+		LEFT JOIN livestream_url_health h ON h.livestream_id = l.id
+		WHERE l.end_at > ? AND (h.checked_at IS NULL OR h.checked_at < ?)
+		ORDER BY IFNULL(h.checked_at, 0), l.start_at
+		LIMIT ?`, now.Unix(), now.Add(-playlistHealthRecheckInterval).Unix(), playlistHealthWorkerBatchSize); err != nil {
+		return err
+	}
+
+	for _, l := range livestreamModels {
+		playlistBroken, err := isBrokenURL(ctx, l.PlaylistUrl)
+		if errors.Is(err, errCircuitOpen) {
+			// 遮断中は次回に回す
+			continue
+		}
+		thumbnailBroken, err := isBrokenURL(ctx, l.ThumbnailUrl)
+		if errors.Is(err, errCircuitOpen) {
+			continue
+		}
+
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			return recordLivestreamURLHealth(ctx, tx, l, LivestreamURLHealthModel{
+				LivestreamID:    l.ID,
+				PlaylistUrl:     l.PlaylistUrl,
+				PlaylistBroken:  playlistBroken,
+				ThumbnailUrl:    l.ThumbnailUrl,
+				ThumbnailBroken: thumbnailBroken,
+				CheckedAt:       clock.Now().Unix(),
+			})
+		}); err != nil {
+			return fmt.Errorf("livestream_id=%d: %w", l.ID, err)
+		}
+		if playlistBroken || thumbnailBroken {
+			logger.Infof("livestream_id=%d has broken urls: playlist=%t thumbnail=%t", l.ID, playlistBroken, thumbnailBroken)
+		}
+	}
+	return nil
+}
+
+// recordLivestreamURLHealth は確認結果を保存し、新たに壊れていた URL があれば配信者に通知する
+func recordLivestreamURLHealth(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, m LivestreamURLHealthModel) error {
+	var prev LivestreamURLHealthModel
+	if err := tx.GetContext(ctx, &prev, "SELECT * FROM livestream_url_health WHERE livestream_id = ? FOR UPDATE", m.LivestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if _, err := tx.NamedExecContext(ctx, `
+		INSERT INTO livestream_url_health (livestream_id, playlist_url, playlist_broken, thumbnail_url, thumbnail_broken, checked_at)
+		VALUES (:livestream_id, :playlist_url, :playlist_broken, :thumbnail_url, :thumbnail_broken, :checked_at)
+		ON DUPLICATE KEY UPDATE playlist_url = VALUES(playlist_url), playlist_broken = VALUES(playlist_broken),
+			thumbnail_url = VALUES(thumbnail_url), thumbnail_broken = VALUES(thumbnail_broken), checked_at = VALUES(checked_at)`, m); err != nil {
+		return err
+	}
+
+	// 同じ URL が壊れたままなら通知し直さない
+	var brokenURLs []string
+	if m.PlaylistBroken && !(prev.PlaylistBroken && prev.PlaylistUrl == m.PlaylistUrl) {
+		brokenURLs = append(brokenURLs, m.PlaylistUrl)
+	}
+	if m.ThumbnailBroken && !(prev.ThumbnailBroken && prev.ThumbnailUrl == m.ThumbnailUrl) {
+		brokenURLs = append(brokenURLs, m.ThumbnailUrl)
+	}
+	if len(brokenURLs) == 0 {
+		return nil
+	}
+	return insertNotification(ctx, tx, livestreamModel.UserID, notificationKindLivestreamBrokenURL, map[string]interface{}{
+		"livestream_id": livestreamModel.ID,
+		"title":         livestreamModel.Title,
+		"broken_urls":   brokenURLs,
+	})
+}
+
+// isBrokenURL は URL に HEAD して、取得できない (4xx/5xx か接続できない) なら true を返す
+// 遮断はホストごとで、URL が無いだけ (4xx) のときは失敗に数えない
+func isBrokenURL(ctx context.Context, rawURL string) (bool, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return true, nil
+	}
+
+	var statusCode int
+	err = getCircuitBreaker(circuitPlaylistHealthPrefix + u.Hostname()).Do(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "isupipe-healthcheck/1.0")
+		resp, err := playlistHealthClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		statusCode = resp.StatusCode
+		if statusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("health check returned status %d", statusCode)
+		}
+		return nil
+	})
+	if errors.Is(err, errCircuitOpen) {
+		return false, err
+	}
+	return err != nil || statusCode >= http.StatusBadRequest, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	presenceTTLEnvKey = "ISUCON13_PRESENCE_TTL_SECONDS"
+
+	// heartbeatがこの秒数届かなかった視聴者は離脱したものとみなす
+	defaultPresenceTTL = 30 * time.Second
+)
+
+var presenceTTL = defaultPresenceTTL
+
+type ViewersResponse struct {
+	LivestreamID int64 `json:"livestream_id"`
+	ViewersCount int64 `json:"viewers_count"`
+}
+
+func loadPresenceConfig() error {
+	if v, ok := os.LookupEnv(presenceTTLEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			return fmt.Errorf("%s must be positive integer: %q", presenceTTLEnvKey, v)
+		}
+		presenceTTL = time.Duration(sec) * time.Second
+	}
+	return nil
+}
+
+// touchPresence は視聴者の最終生存時刻を更新する (未登録なら追加)
+func touchPresence(ctx context.Context, tx *sqlx.Tx, userID, livestreamID int64) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO livestream_presences (user_id, livestream_id, last_seen_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE last_seen_at = VALUES(last_seen_at)", userID, livestreamID, clock.Now().Unix())
+	return err
+}
+
+// 視聴中であることを定期的に通知するAPI (viewer)
+// POST /api/livestream/:livestream_id/heartbeat
+// 本文に {"position": 秒} があれば再生位置として視聴履歴に残す
+func heartbeatLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req HeartbeatRequest
+	if c.Request().ContentLength != 0 {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		}
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		if err := touchPresence(ctx, tx, userID, int64(livestreamID)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream presence: "+err.Error()).SetInternal(err)
+		}
+		if err := recordWatchHistory(ctx, tx, userID, int64(livestreamID), req.Position); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update watch history: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 現在の同時視聴者数取得API
+// GET /api/livestream/:livestream_id/viewers
+func getLivestreamViewersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// スイーパーの実行間隔の間に期限切れになった視聴者も数えないよう、時刻でも絞り込む
+	var count int64
+	threshold := clock.Now().Add(-presenceTTL).Unix()
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_presences WHERE livestream_id = ? AND last_seen_at >= ?", livestreamID, threshold); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, ViewersResponse{
+		LivestreamID: int64(livestreamID),
+		ViewersCount: count,
+	})
+}
+
+// sweepStalePresences は heartbeat の途絶えた視聴者を削除する
+func sweepStalePresences(ctx context.Context) (int64, error) {
+	threshold := clock.Now().Add(-presenceTTL).Unix()
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_presences WHERE last_seen_at < ?", threshold)
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+// sampleViewersCount は配信ごとの現在の同時視聴者数を記録する (分析レポートのピーク算出用)
+// 終了した配信のサンプルはメンテナンスジョブ (viewer_samples) で消す
+func sampleViewersCount(ctx context.Context) error {
+	_, err := dbConn.ExecContext(ctx, "INSERT INTO livestream_viewer_samples (livestream_id, viewers_count, sampled_at) SELECT livestream_id, COUNT(*), ? FROM livestream_presences GROUP BY livestream_id", clock.Now().Unix())
+	return err
+}
+
+// runPresenceSweeper は ctx がキャンセルされるまで定期的に期限切れの視聴者を掃除する
+func runPresenceSweeper(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(presenceTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := sweepStalePresences(ctx)
+			if err != nil {
+				logger.Warnf("failed to sweep livestream presences: %v", err)
+				continue
+			}
+			if n > 0 {
+				logger.Debugf("swept %d stale livestream presences", n)
+			}
+			if err := sampleViewersCount(ctx); err != nil {
+				logger.Warnf("failed to sample viewers count: %v", err)
+			}
+		}
+	}
+}
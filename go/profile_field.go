@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// custom_ で始まる自由な項目の上限
+	maxCustomProfileFields     = 10
+	maxCustomProfileFieldValue = 100
+)
+
+// profileFieldRule は決まったキーの項目の検証ルール
+type profileFieldRule struct {
+	MaxLength int
+	// URL の項目ならホスト名 (サブドメインも許す)。nil ならURLではない
+	// 空のスライスなら任意のホストの http(s) URL
+	Hosts []string
+}
+
+var profileFieldRules = map[string]profileFieldRule{
+	"twitter":  {MaxLength: 255, Hosts: []string{"twitter.com", "x.com"}},
+	"youtube":  {MaxLength: 255, Hosts: []string{"youtube.com", "youtu.be"}},
+	"website":  {MaxLength: 255, Hosts: []string{}},
+	"location": {MaxLength: 64},
+	"pronouns": {MaxLength: 32},
+}
+
+var customProfileFieldKeyPattern = regexp.MustCompile(`^custom_[a-z0-9_]{1,32}$`)
+
+// validateProfileField はキーと値が使えるかを確かめ、使えなければ理由を返す
+func validateProfileField(key, value string) string {
+	rule, ok := profileFieldRules[key]
+	if !ok {
+		if !customProfileFieldKeyPattern.MatchString(key) {
+			return "unknown profile field key"
+		}
+		rule = profileFieldRule{MaxLength: maxCustomProfileFieldValue}
+	}
+
+	if value == "" {
+		return "value must not be empty"
+	}
+	if utf8.RuneCountInString(value) > rule.MaxLength {
+		return "value is too long"
+	}
+	if rule.Hosts == nil {
+		return ""
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "value must be http(s) url"
+	}
+	if len(rule.Hosts) == 0 {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range rule.Hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return ""
+		}
+	}
+	return "url host is not allowed for this field"
+}
+
+type ProfileFieldModel struct {
+	UserID    int64  `db:"user_id"`
+	FieldKey  string `db:"field_key"`
+	Value     string `db:"value"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+// fetchProfileFields はユーザ詳細に載せるプロフィール項目を引く
+func fetchProfileFields(ctx context.Context, tx *sqlx.Tx, userID int64) (map[string]string, error) {
+	var models []ProfileFieldModel
+	if err := tx.SelectContext(ctx, &models, "SELECT * FROM user_profile_fields WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]string, len(models))
+	for _, m := range models {
+		fields[m.FieldKey] = m.Value
+	}
+	return fields, nil
+}
+
+type PutProfileFieldRequest struct {
+	Value string `json:"value"`
+}
+
+// プロフィール項目の設定API
+// PUT /api/user/me/profile/:key
+func putProfileFieldHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PutProfileFieldRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	key := c.Param("key")
+	value := strings.TrimSpace(req.Value)
+	if reason := validateProfileField(key, value); reason != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, reason)
+	}
+
+	var fields map[string]string
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if _, ok := profileFieldRules[key]; !ok {
+			var count int64
+			if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM user_profile_fields WHERE user_id = ? AND field_key LIKE 'custom\\_%' AND field_key <> ? FOR UPDATE", userID, key); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to count profile fields: "+err.Error()).SetInternal(err)
+			}
+			if count >= maxCustomProfileFields {
+				return echo.NewHTTPError(http.StatusBadRequest, "too many custom profile fields")
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_profile_fields (user_id, field_key, value, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), updated_at = VALUES(updated_at)", userID, key, value, clock.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update profile field: "+err.Error()).SetInternal(err)
+		}
+		if err := bumpProfileVersion(ctx, tx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to bump profile version: "+err.Error()).SetInternal(err)
+		}
+
+		var err error
+		fields, err = fetchProfileFields(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get profile fields: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, fields)
+}
+
+// プロフィール項目の削除API
+// DELETE /api/user/me/profile/:key
+func deleteProfileFieldHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM user_profile_fields WHERE user_id = ? AND field_key = ?", userID, c.Param("key"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete profile field: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "profile field not found")
+		}
+		if err := bumpProfileVersion(ctx, tx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to bump profile version: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 公開API (/api/public) はセッションを使わず、API キーで呼ぶ読み取り専用のAPI
+// 公開 (visibility が public) の配信とそのクリップだけを返す
+// 項目は v1 と同じ型で、一覧は v2 と同じ {items, next_cursor, total} の形
+
+// ユーザのプロフィール取得API (公開API)
+// GET /api/public/users/:username
+func getPublicUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	user, err := fetchUserDetailsByName(ctx, c.Param("username"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch user details: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// 配信一覧API (公開API)
+// GET /api/public/livestreams?status=&limit=&cursor=&with_total=
+// status を指定しなければすべての状態の配信を返す
+func getPublicLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	p, err := parseListParams(c)
+	if err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM livestreams").Where("visibility = ?", livestreamVisibilityPublic)
+	switch status := c.QueryParam("status"); status {
+	case "":
+	case livestreamStatusUpcoming, livestreamStatusLive, livestreamStatusEnded:
+		q.Where("status = ?", status)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be upcoming, live or ended")
+	}
+	if playlistHealthCheckEnabled {
+		q.Where(healthyLivestreamCondition("livestreams"))
+	}
+	countQuery, countArgs := q.BuildCount("SELECT COUNT(*) FROM livestreams")
+	p.apply(q, "id")
+	query, args := q.Build()
+
+	res := ListResponse{Items: []Livestream{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModels []LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+		}
+		n, next := p.page(len(livestreamModels), func(i int) int64 { return livestreamModels[i].ID })
+		livestreams := make([]Livestream, n)
+		for i := range livestreams {
+			livestream, err := fillLivestreamResponse(ctx, tx, livestreamModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			livestreams[i] = livestream
+		}
+		res.Items, res.NextCursor = livestreams, next
+
+		var err error
+		res.Total, err = p.total(c, tx, countQuery, countArgs)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// クリップ取得API (公開API)
+// GET /api/public/clips/:clip_id
+func getPublicClipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	clipID, err := strconv.ParseInt(c.Param("clip_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "clip_id in path must be integer")
+	}
+
+	var clip Clip
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var m ClipModel
+		if err := tx.GetContext(ctx, &m, "SELECT c.* FROM clips c INNER JOIN livestreams l ON l.id = c.livestream_id WHERE c.id = ? AND l.visibility = ?", clipID, livestreamVisibilityPublic); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "clip not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clip: "+err.Error()).SetInternal(err)
+		}
+		var err error
+		if clip, err = fillClipResponse(ctx, tx, m); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, clip)
+}
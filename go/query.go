@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// selectQuery は WHERE / ORDER BY / LIMIT などの任意句を組み立てる
+// SQL文字列に入るのはコード中の定数だけで、リクエスト由来の値は必ずプレースホルダ経由で渡す
+type selectQuery struct {
+	base       string
+	conditions []string
+	args       []interface{}
+	orderBy    string
+	limit      int64
+	hasLimit   bool
+}
+
+// base に ? を含む場合は、その値を args に渡す
+func newSelectQuery(base string, args ...interface{}) *selectQuery {
+	return &selectQuery{base: base, args: args}
+}
+
+// Where は AND で連結される条件を追加する (cond 中の ? が args に対応する)
+func (q *selectQuery) Where(cond string, args ...interface{}) *selectQuery {
+	q.conditions = append(q.conditions, cond)
+	q.args = append(q.args, args...)
+	return q
+}
+
+// OrderBy はソート順を指定する (呼び出し側の定数のみを渡すこと)
+func (q *selectQuery) OrderBy(clause string) *selectQuery {
+	q.orderBy = clause
+	return q
+}
+
+func (q *selectQuery) Limit(n int64) *selectQuery {
+	q.limit = n
+	q.hasLimit = true
+	return q
+}
+
+// LimitOr は LIMIT が指定されていればその値を、無ければ def を返す (結果を受けるスライスの容量の目安)
+func (q *selectQuery) LimitOr(def int64) int64 {
+	if q.hasLimit {
+		return q.limit
+	}
+	return def
+}
+
+func (q *selectQuery) Build() (string, []interface{}) {
+	var sb strings.Builder
+	sb.WriteString(q.base)
+	args := append([]interface{}{}, q.args...)
+	if len(q.conditions) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(q.conditions, " AND "))
+	}
+	if q.orderBy != "" {
+		sb.WriteString(" ORDER BY ")
+		sb.WriteString(q.orderBy)
+	}
+	if q.hasLimit {
+		sb.WriteString(" LIMIT ?")
+		args = append(args, q.limit)
+	}
+	return sb.String(), args
+}
+
+// BuildCount は同じ条件で件数を数えるクエリを組み立てる (ORDER BY と LIMIT は付けない)
+// base は "SELECT COUNT(*) FROM ..." で、newSelectQuery の base と同じ数の ? を持つこと
+func (q *selectQuery) BuildCount(base string) (string, []interface{}) {
+	count := *q
+	count.base = base
+	count.orderBy = ""
+	count.hasLimit = false
+	return count.Build()
+}
+
+// LimitFromParam はクエリパラメータ key が指定されていれば LIMIT 句を追加する
+func (q *selectQuery) LimitFromParam(c echo.Context, key string) error {
+	v := c.QueryParam(key)
+	if v == "" {
+		return nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, key+" query parameter must be integer")
+	}
+	q.Limit(limit)
+	return nil
+}
+
+// WhereInt64Param はクエリパラメータ key が指定されていれば cond の条件を追加する
+func (q *selectQuery) WhereInt64Param(c echo.Context, key, cond string) error {
+	v := c.QueryParam(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, key+" query parameter must be integer")
+	}
+	q.Where(cond, n)
+	return nil
+}
+
+// WhereInListParam はクエリパラメータ key にカンマ区切りで値が指定されていれば column IN (...) の条件を追加する
+// column はコード中の定数で、値は valid で検証したものだけを使う
+func (q *selectQuery) WhereInListParam(c echo.Context, key, column string, valid func(string) bool) error {
+	v := c.QueryParam(key)
+	if v == "" {
+		return nil
+	}
+	values := splitCommaList(v)
+	if len(values) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		if !valid(value) {
+			return echo.NewHTTPError(http.StatusBadRequest, key+" query parameter contains invalid value: "+value)
+		}
+		args[i] = value
+	}
+	q.Where(column+" IN (?"+strings.Repeat(", ?", len(values)-1)+")", args...)
+	return nil
+}
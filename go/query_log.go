@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	queryLogEnabledEnvKey = "ISUCON13_QUERY_LOG_ENABLED"
+
+	// これより多くの種類のクエリは (other) にまとめる (IN の個数違いなどで際限なく増えないように)
+	maxQueryFingerprints  = 2000
+	queryFingerprintOther = "(other)"
+
+	defaultSlowQueriesLimit = 20
+)
+
+// クエリごとの実行時間の記録 (チューニング中に pt-query-digest を回さずに遅いクエリを見るためのもの)
+// すべてのクエリでロックを取るので、デフォルトでは無効
+var queryLogEnabled = false
+
+// queryStat は同じ形 (fingerprint) のクエリの実行時間の累計
+type queryStat struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+	// 最も遅かった実行のクエリと引数 (EXPLAIN に使う)
+	SlowestQuery string
+	SlowestArgs  []interface{}
+	LastSeenAt   time.Time
+}
+
+var queryLog = struct {
+	mu    sync.Mutex
+	stats map[string]*queryStat
+	since time.Time
+}{stats: map[string]*queryStat{}, since: time.Now()}
+
+type queryLogSkipKey struct{}
+
+type SlowQuery struct {
+	Fingerprint string  `json:"fingerprint"`
+	Count       int64   `json:"count"`
+	TotalMillis float64 `json:"total_ms"`
+	AvgMillis   float64 `json:"avg_ms"`
+	MaxMillis   float64 `json:"max_ms"`
+	LastSeenAt  int64   `json:"last_seen_at"`
+	// explain=true の場合のみ入る (SELECT のみ)
+	Explain      []map[string]interface{} `json:"explain,omitempty"`
+	ExplainError string                   `json:"explain_error,omitempty"`
+}
+
+type SlowQueriesResponse struct {
+	// 集計を始めた時刻 (起動時か、最後に初期化した時刻)
+	Since   int64       `json:"since"`
+	Queries []SlowQuery `json:"queries"`
+}
+
+func loadQueryLogConfig() error {
+	if v, ok := os.LookupEnv(queryLogEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", queryLogEnabledEnvKey, err)
+		}
+		queryLogEnabled = enabled
+	}
+	return nil
+}
+
+// resetQueryLog は集計を捨てる (ベンチマークの回ごとに見られるよう、初期化時に呼ぶ)
+func resetQueryLog() {
+	queryLog.mu.Lock()
+	queryLog.stats = map[string]*queryStat{}
+	queryLog.since = time.Now()
+	queryLog.mu.Unlock()
+}
+
+// queryInstrumentationEnabled はドライバに queryLogConn を被せるか
+func queryInstrumentationEnabled() bool {
+	return queryLogEnabled || nPlusOneThreshold > 0
+}
+
+// observeQuery は実行したクエリを集計とリクエストごとの数に加える
+func observeQuery(ctx context.Context, query string, args []driver.NamedValue, elapsed time.Duration) {
+	if ctx.Value(queryLogSkipKey{}) != nil {
+		return
+	}
+	counter := requestQueryCounterFrom(ctx)
+	if !queryLogEnabled && counter == nil {
+		return
+	}
+	fingerprint := fingerprintQuery(query)
+	if queryLogEnabled {
+		recordQuery(fingerprint, query, args, elapsed)
+	}
+	counter.add(fingerprint)
+}
+
+func recordQuery(fingerprint, query string, args []driver.NamedValue, elapsed time.Duration) {
+	queryLog.mu.Lock()
+	defer queryLog.mu.Unlock()
+	s, ok := queryLog.stats[fingerprint]
+	if !ok {
+		if len(queryLog.stats) >= maxQueryFingerprints {
+			fingerprint = queryFingerprintOther
+			s = queryLog.stats[fingerprint]
+		}
+		if s == nil {
+			s = &queryStat{}
+			queryLog.stats[fingerprint] = s
+		}
+	}
+	s.Count++
+	s.Total += elapsed
+	s.LastSeenAt = time.Now()
+	if elapsed >= s.Max {
+		s.Max = elapsed
+		s.SlowestQuery = query
+		s.SlowestArgs = make([]interface{}, len(args))
+		for i, a := range args {
+			s.SlowestArgs[i] = a.Value
+		}
+	}
+}
+
+var (
+	queryPlaceholderListPattern = regexp.MustCompile(`\?(?:\s*,\s*\?)+`)
+	queryValuesListPattern      = regexp.MustCompile(`(\([^()]*\))(?:\s*,\s*\([^()]*\))+`)
+)
+
+// fingerprintQuery はクエリから値を除いて形だけにする
+// 文字列・数値のリテラルは ? に、? の並びは ?+ に、VALUES の複数行は1行にまとめる
+func fingerprintQuery(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+	space := false
+	var last byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			continue
+		case c == '\'' || c == '"':
+			// 閉じの引用符まで読み飛ばす (\ と二重の引用符によるエスケープを考慮する)
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' {
+					i++
+					continue
+				}
+				if query[i] == c {
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			c = '?'
+		case c >= '0' && c <= '9' && (space || !isQueryIdentByte(last)):
+			for i+1 < len(query) && (query[i+1] >= '0' && query[i+1] <= '9' || query[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+		last = c
+	}
+	fingerprint := queryPlaceholderListPattern.ReplaceAllString(b.String(), "?+")
+	return queryValuesListPattern.ReplaceAllString(fingerprint, "$1")
+}
+
+// isQueryIdentByte は直前の文字が識別子の一部か (t1 や user_id2 の数字を値とみなさないため)
+func isQueryIdentByte(c byte) bool {
+	return c == '_' || c == '`' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// queryLogConnector は接続ごとに queryLogConn を被せる
+type queryLogConnector struct {
+	driver.Connector
+}
+
+func (c queryLogConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &queryLogConn{Conn: conn}, nil
+}
+
+// queryLogConn は ExecContext / QueryContext の実行時間を記録する
+// interpolateParams=true なので、ほぼすべてのクエリがここを通る (プリペアドステートメントは記録しない)
+// QueryContext は結果を読み終わるまでではなく、最初の応答までの時間になる
+type queryLogConn struct {
+	driver.Conn
+}
+
+func (c *queryLogConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rs, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, query, args, time.Since(start))
+	}
+	return rs, err
+}
+
+func (c *queryLogConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, query, args, time.Since(start))
+	}
+	return rows, err
+}
+
+// 以下はドライバの接続が持つ機能をそのまま見せるためのもの
+
+func (c *queryLogConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *queryLogConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *queryLogConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *queryLogConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *queryLogConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *queryLogConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// 遅いクエリの一覧API
+// GET /api/internal/debug/slow-queries?sort=total|avg|max|count&limit=&explain=true
+// 同じ形のクエリごとに、既定では合計の実行時間が長い順
+func getSlowQueriesHandler(c echo.Context) error {
+	if !queryLogEnabled {
+		return echo.NewHTTPError(http.StatusNotFound, "query log is disabled (set "+queryLogEnabledEnvKey+"=true)")
+	}
+
+	limit := defaultSlowQueriesLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = n
+	}
+	explain := false
+	if v := c.QueryParam("explain"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "explain query parameter must be bool")
+		}
+		explain = b
+	}
+
+	type entry struct {
+		fingerprint string
+		stat        queryStat
+	}
+	queryLog.mu.Lock()
+	since := queryLog.since
+	entries := make([]entry, 0, len(queryLog.stats))
+	for f, s := range queryLog.stats {
+		entries = append(entries, entry{fingerprint: f, stat: *s})
+	}
+	queryLog.mu.Unlock()
+
+	var less func(a, b queryStat) bool
+	switch c.QueryParam("sort") {
+	case "", "total":
+		less = func(a, b queryStat) bool { return a.Total > b.Total }
+	case "avg":
+		less = func(a, b queryStat) bool { return a.Total/time.Duration(a.Count) > b.Total/time.Duration(b.Count) }
+	case "max":
+		less = func(a, b queryStat) bool { return a.Max > b.Max }
+	case "count":
+		less = func(a, b queryStat) bool { return a.Count > b.Count }
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be one of total, avg, max, count")
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if less(entries[i].stat, entries[j].stat) != less(entries[j].stat, entries[i].stat) {
+			return less(entries[i].stat, entries[j].stat)
+		}
+		return entries[i].fingerprint < entries[j].fingerprint
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	queries := make([]SlowQuery, len(entries))
+	for i, e := range entries {
+		queries[i] = SlowQuery{
+			Fingerprint: e.fingerprint,
+			Count:       e.stat.Count,
+			TotalMillis: durationMillis(e.stat.Total),
+			AvgMillis:   durationMillis(e.stat.Total / time.Duration(e.stat.Count)),
+			MaxMillis:   durationMillis(e.stat.Max),
+			LastSeenAt:  e.stat.LastSeenAt.Unix(),
+		}
+		if explain && strings.HasPrefix(e.fingerprint, "select ") {
+			plan, err := explainQuery(c.Request().Context(), e.stat.SlowestQuery, e.stat.SlowestArgs)
+			if err != nil {
+				queries[i].ExplainError = err.Error()
+			} else {
+				queries[i].Explain = plan
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, SlowQueriesResponse{
+		Since:   since.Unix(),
+		Queries: queries,
+	})
+}
+
+// 遅いクエリの集計のリセットAPI
+// DELETE /api/internal/debug/slow-queries
+func deleteSlowQueriesHandler(c echo.Context) error {
+	resetQueryLog()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// explainQuery は最も遅かった実行と同じ引数で EXPLAIN する
+// key が NULL なら索引が使われておらず、Extra に Using index があれば索引だけで返せている (カバリングインデックス)
+func explainQuery(ctx context.Context, query string, args []interface{}) ([]map[string]interface{}, error) {
+	ctx = context.WithValue(ctx, queryLogSkipKey{}, struct{}{})
+	rows, err := dbConn.QueryxContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plan := []map[string]interface{}{}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		for k, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[k] = string(b)
+			}
+		}
+		plan = append(plan, row)
+	}
+	return plan, rows.Err()
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
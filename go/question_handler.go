@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	questionStatusOpen      = "open"
+	questionStatusAnswered  = "answered"
+	questionStatusDismissed = "dismissed"
+
+	maxQuestionLength = 255
+)
+
+type QuestionModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	LivestreamID int64  `db:"livestream_id"`
+	Question     string `db:"question"`
+	Status       string `db:"status"`
+	Upvotes      int64  `db:"upvotes"`
+	CreatedAt    int64  `db:"created_at"`
+	ResolvedAt   int64  `db:"resolved_at"`
+}
+
+type Question struct {
+	ID           int64  `json:"id"`
+	User         User   `json:"user"`
+	LivestreamID int64  `json:"livestream_id"`
+	Question     string `json:"question"`
+	Status       string `json:"status"`
+	Upvotes      int64  `json:"upvotes"`
+	// リクエストしたユーザが投票済みか
+	Upvoted    bool  `json:"upvoted"`
+	CreatedAt  int64 `json:"created_at"`
+	ResolvedAt int64 `json:"resolved_at,omitempty"`
+}
+
+type PostQuestionRequest struct {
+	Question string `json:"question"`
+}
+
+type PutQuestionStatusRequest struct {
+	Status string `json:"status"`
+}
+
+func fillQuestionResponse(ctx context.Context, tx *sqlx.Tx, m QuestionModel, upvoted bool) (Question, error) {
+	user, err := fillUserResponseByID(ctx, tx, m.UserID)
+	if err != nil {
+		return Question{}, err
+	}
+	return Question{
+		ID:           m.ID,
+		User:         user,
+		LivestreamID: m.LivestreamID,
+		Question:     m.Question,
+		Status:       m.Status,
+		Upvotes:      m.Upvotes,
+		Upvoted:      upvoted,
+		CreatedAt:    m.CreatedAt,
+		ResolvedAt:   m.ResolvedAt,
+	}, nil
+}
+
+// 配信の質問一覧取得API
+// GET /api/livestream/:livestream_id/questions?status=open
+// 投票の多い順 (同数なら古い順) に返す。status を省略すると全ての質問を返す
+func getQuestionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	q := newSelectQuery("SELECT * FROM questions").
+		Where("livestream_id = ?", livestreamID).
+		OrderBy("upvotes DESC, created_at ASC")
+	if status := c.QueryParam("status"); status != "" {
+		q.Where("status = ?", status)
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	questions := []Question{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, int64(livestreamID), userID); err != nil {
+			return err
+		}
+
+		var questionModels []QuestionModel
+		if err := tx.SelectContext(ctx, &questionModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get questions: "+err.Error()).SetInternal(err)
+		}
+		if len(questionModels) == 0 {
+			return nil
+		}
+
+		questionIDs := make([]int64, len(questionModels))
+		userIDs := make([]int64, len(questionModels))
+		for i, m := range questionModels {
+			questionIDs[i] = m.ID
+			userIDs[i] = m.UserID
+		}
+		if err := loaderFrom(ctx).primeUsers(ctx, tx, userIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load users: "+err.Error()).SetInternal(err)
+		}
+
+		query, args, err := sqlx.In("SELECT question_id FROM question_upvotes WHERE user_id = ? AND question_id IN (?)", userID, questionIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error()).SetInternal(err)
+		}
+		var upvotedIDs []int64
+		if err := tx.SelectContext(ctx, &upvotedIDs, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get upvotes: "+err.Error()).SetInternal(err)
+		}
+		upvoted := make(map[int64]struct{}, len(upvotedIDs))
+		for _, id := range upvotedIDs {
+			upvoted[id] = struct{}{}
+		}
+
+		for _, m := range questionModels {
+			_, ok := upvoted[m.ID]
+			question, err := fillQuestionResponse(ctx, tx, m, ok)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error()).SetInternal(err)
+			}
+			questions = append(questions, question)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, questions)
+}
+
+// 質問投稿API
+// POST /api/livestream/:livestream_id/questions
+func postQuestionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req PostQuestionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Question == "" || len([]rune(req.Question)) > maxQuestionLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "question must be between 1 and 255 characters")
+	}
+
+	var question Question
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamModel.ID, userID); err != nil {
+			return err
+		}
+
+		// コメントと同じくNGワードを含む質問は受け付けない
+		spamWords, err := fetchSpamWords(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error()).SetInternal(err)
+		}
+		if matchNGWords(req.Question, spamWords) {
+			return echo.NewHTTPError(http.StatusBadRequest, "この質問がスパム判定されました")
+		}
+
+		questionModel := QuestionModel{
+			UserID:       userID,
+			LivestreamID: livestreamModel.ID,
+			Question:     req.Question,
+			Status:       questionStatusOpen,
+			CreatedAt:    clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO questions (user_id, livestream_id, question, status, created_at) VALUES (:user_id, :livestream_id, :question, :status, :created_at)", questionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert question: "+err.Error()).SetInternal(err)
+		}
+		questionID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted question id: "+err.Error()).SetInternal(err)
+		}
+		questionModel.ID = questionID
+
+		question, err = fillQuestionResponse(ctx, tx, questionModel, false)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, question)
+}
+
+// 質問への投票API
+// POST /api/livestream/:livestream_id/questions/:question_id/upvote (投票)
+// DELETE /api/livestream/:livestream_id/questions/:question_id/upvote (取り消し)
+func upvoteQuestionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	questionID, err := strconv.Atoi(c.Param("question_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "question_id in path must be integer")
+	}
+	upvote := c.Request().Method == http.MethodPost
+
+	var question Question
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, int64(livestreamID), userID); err != nil {
+			return err
+		}
+
+		var m QuestionModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM questions WHERE id = ? AND livestream_id = ? FOR UPDATE", questionID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "question not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get question: "+err.Error()).SetInternal(err)
+		}
+
+		// 投票数は question_upvotes の件数を questions.upvotes に集計しておく
+		var rs sql.Result
+		if upvote {
+			rs, err = tx.ExecContext(ctx, "INSERT IGNORE INTO question_upvotes (question_id, user_id, created_at) VALUES (?, ?, ?)", m.ID, userID, clock.Now().Unix())
+		} else {
+			rs, err = tx.ExecContext(ctx, "DELETE FROM question_upvotes WHERE question_id = ? AND user_id = ?", m.ID, userID)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update upvote: "+err.Error()).SetInternal(err)
+		}
+		n, err := rs.RowsAffected()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		}
+		if n > 0 {
+			delta := int64(1)
+			if !upvote {
+				delta = -1
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE questions SET upvotes = upvotes + ? WHERE id = ?", delta, m.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update upvotes: "+err.Error()).SetInternal(err)
+			}
+			m.Upvotes += delta
+		}
+
+		question, err = fillQuestionResponse(ctx, tx, m, upvote)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, question)
+}
+
+// 質問を回答済み・却下にするAPI (配信者向け)
+// PUT /api/livestream/:livestream_id/questions/:question_id
+func putQuestionStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	questionID, err := strconv.Atoi(c.Param("question_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "question_id in path must be integer")
+	}
+
+	var req PutQuestionStatusRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	switch req.Status {
+	case questionStatusOpen, questionStatusAnswered, questionStatusDismissed:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be one of open, answered, dismissed")
+	}
+
+	var question Question
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var resolvedAt int64
+		if req.Status != questionStatusOpen {
+			resolvedAt = clock.Now().Unix()
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE questions SET status = ?, resolved_at = ? WHERE id = ? AND livestream_id = ?", req.Status, resolvedAt, questionID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update question: "+err.Error()).SetInternal(err)
+		}
+
+		var m QuestionModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM questions WHERE id = ? AND livestream_id = ?", questionID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "question not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get question: "+err.Error()).SetInternal(err)
+		}
+		var upvoted int64
+		if err := tx.GetContext(ctx, &upvoted, "SELECT COUNT(*) FROM question_upvotes WHERE question_id = ? AND user_id = ?", m.ID, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get upvote: "+err.Error()).SetInternal(err)
+		}
+
+		question, err = fillQuestionResponse(ctx, tx, m, upvoted > 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, question)
+}
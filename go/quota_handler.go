@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	quotaEnabledEnvKey = "ISUCON13_QUOTA_ENABLED"
+
+	planFree    = "free"
+	planCreator = "creator"
+	planPro     = "pro"
+
+	quotaStreamsPerWeek = "streams_per_week"
+	quotaNGWords        = "ng_words"
+	quotaWebhooks       = "webhooks"
+	quotaAPITokens      = "api_tokens"
+
+	quotaReasonExceeded = "quota_exceeded"
+
+	auditActionUserPlanUpdate = "user.plan_update"
+)
+
+// プランごとの上限を超えた書き込みを拒否するか
+// ベンチマーカーのユーザは全て free なので、デフォルトでは無効 (使用量の取得だけできる)
+var quotaEnabled = false
+
+// planQuotas はプランごとの上限
+// ng_words は配信ごと、streams_per_week は配信開始日時が属する週 (UTC, 月曜始まり) ごとの数
+var planQuotas = map[string]map[string]int64{
+	planFree: {
+		quotaStreamsPerWeek: 3,
+		quotaNGWords:        20,
+		quotaWebhooks:       1,
+		quotaAPITokens:      1,
+	},
+	planCreator: {
+		quotaStreamsPerWeek: 14,
+		quotaNGWords:        200,
+		quotaWebhooks:       5,
+		quotaAPITokens:      5,
+	},
+	planPro: {
+		quotaStreamsPerWeek: 50,
+		quotaNGWords:        1000,
+		quotaWebhooks:       20,
+		quotaAPITokens:      20,
+	},
+}
+
+// 使用量を返す順
+var quotaKinds = []string{quotaStreamsPerWeek, quotaNGWords, quotaWebhooks, quotaAPITokens}
+
+func loadQuotaConfig() error {
+	if v, ok := os.LookupEnv(quotaEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", quotaEnabledEnvKey, err)
+		}
+		quotaEnabled = enabled
+	}
+	return nil
+}
+
+func isValidPlan(plan string) bool {
+	_, ok := planQuotas[plan]
+	return ok
+}
+
+// weekRange は t が属する週 (UTC, 月曜始まり) の範囲を返す
+func weekRange(t time.Time) (int64, int64) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	return start.Unix(), start.AddDate(0, 0, 7).Unix()
+}
+
+// quotaUsage は上限の対象となっている数を数える
+// scopeID は ng_words では配信ID、streams_per_week では週に含まれる日時 (UNIX時間)
+// NOTE: Webhook の機能はまだ無いので常に 0 を返す (追加したらここで数える)
+func quotaUsage(ctx context.Context, tx *sqlx.Tx, userID int64, kind string, scopeID int64) (int64, error) {
+	var used int64
+	switch kind {
+	case quotaStreamsPerWeek:
+		from, to := weekRange(time.Unix(scopeID, 0))
+		if err := tx.GetContext(ctx, &used, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND start_at >= ? AND start_at < ?", userID, from, to); err != nil {
+			return 0, err
+		}
+	case quotaNGWords:
+		if err := tx.GetContext(ctx, &used, "SELECT COUNT(*) FROM ng_words WHERE user_id = ? AND livestream_id = ?", userID, scopeID); err != nil {
+			return 0, err
+		}
+	case quotaAPITokens:
+		if err := tx.GetContext(ctx, &used, "SELECT COUNT(*) FROM api_keys WHERE user_id = ? AND revoked_at = 0", userID); err != nil {
+			return 0, err
+		}
+	}
+	return used, nil
+}
+
+func fetchUserPlan(ctx context.Context, tx *sqlx.Tx, userID int64) (string, error) {
+	var plan string
+	if err := tx.GetContext(ctx, &plan, "SELECT plan FROM users WHERE id = ?", userID); err != nil {
+		return "", err
+	}
+	return plan, nil
+}
+
+// checkQuota はもう1件追加すると上限を超える場合に 403 を返す
+// 書き込みと同じトランザクションで呼ぶこと
+func checkQuota(ctx context.Context, tx *sqlx.Tx, userID int64, kind string, scopeID int64) error {
+	if !quotaEnabled {
+		return nil
+	}
+	plan, err := fetchUserPlan(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user plan: "+err.Error()).SetInternal(err)
+	}
+	limit, ok := planQuotas[plan][kind]
+	if !ok {
+		return nil
+	}
+	used, err := quotaUsage(ctx, tx, userID, kind, scopeID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get quota usage: "+err.Error()).SetInternal(err)
+	}
+	if used >= limit {
+		return newReasonedError(http.StatusForbidden, quotaReasonExceeded, fmt.Sprintf("%s quota of %s plan is exceeded (limit %d)", kind, plan, limit))
+	}
+	return nil
+}
+
+type QuotaUsage struct {
+	Kind  string `json:"kind"`
+	Used  int64  `json:"used"`
+	Limit int64  `json:"limit"`
+}
+
+type QuotaUsageResponse struct {
+	Plan     string       `json:"plan"`
+	Enforced bool         `json:"enforced"`
+	Usages   []QuotaUsage `json:"usages"`
+}
+
+// 自分のプランと使用量の取得API
+// GET /api/user/me/quota?livestream_id=
+// streams_per_week は今週の数、ng_words は livestream_id を指定した場合にその配信の数を返す
+func getMyQuotaHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var livestreamID int64
+	if v := c.QueryParam("livestream_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "livestream_id query parameter must be integer")
+		}
+		livestreamID = id
+	}
+
+	res := QuotaUsageResponse{Enforced: quotaEnabled}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		plan, err := fetchUserPlan(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user plan: "+err.Error()).SetInternal(err)
+		}
+		res.Plan = plan
+
+		for _, kind := range quotaKinds {
+			scopeID := clock.Now().Unix()
+			if kind == quotaNGWords {
+				scopeID = livestreamID
+			}
+			used, err := quotaUsage(ctx, tx, userID, kind, scopeID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get quota usage: "+err.Error()).SetInternal(err)
+			}
+			res.Usages = append(res.Usages, QuotaUsage{Kind: kind, Used: used, Limit: planQuotas[plan][kind]})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type PutUserPlanRequest struct {
+	Plan string `json:"plan"`
+}
+
+// ユーザのプラン変更API (管理者向け)
+// PUT /api/admin/users/:username/plan
+func putUserPlanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var req PutUserPlanRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if !isValidPlan(req.Plan) {
+		return echo.NewHTTPError(http.StatusBadRequest, "plan must be one of free, creator, pro")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	username := c.Param("username")
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var user struct {
+			ID   int64  `db:"id"`
+			Plan string `db:"plan"`
+		}
+		if err := tx.GetContext(ctx, &user, "SELECT id, plan FROM users WHERE name = ? FOR UPDATE", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET plan = ? WHERE id = ?", req.Plan, user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user plan: "+err.Error()).SetInternal(err)
+		}
+		before := map[string]string{"username": username, "plan": user.Plan}
+		after := map[string]string{"username": username, "plan": req.Plan}
+		if err := insertAuditLog(ctx, tx, userID, auditActionUserPlanUpdate, auditTargetUser, user.ID, 0, before, after); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"username": username, "plan": req.Plan})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type RaidModel struct {
+	ID               int64 `db:"id"`
+	UserID           int64 `db:"user_id"`
+	FromLivestreamID int64 `db:"from_livestream_id"`
+	ToLivestreamID   int64 `db:"to_livestream_id"`
+	ViewersCount     int64 `db:"viewers_count"`
+	CreatedAt        int64 `db:"created_at"`
+}
+
+type Raid struct {
+	ID               int64 `json:"id"`
+	FromLivestreamID int64 `json:"from_livestream_id"`
+	ToLivestreamID   int64 `json:"to_livestream_id"`
+	// レイドで送った視聴者数
+	ViewersCount int64 `json:"viewers_count"`
+	CreatedAt    int64 `json:"created_at"`
+}
+
+type PostRaidRequest struct {
+	TargetLivestreamID int64 `json:"target_livestream_id"`
+}
+
+func fillRaidResponse(m RaidModel) Raid {
+	return Raid{
+		ID:               m.ID,
+		FromLivestreamID: m.FromLivestreamID,
+		ToLivestreamID:   m.ToLivestreamID,
+		ViewersCount:     m.ViewersCount,
+		CreatedAt:        m.CreatedAt,
+	}
+}
+
+// 視聴者を別の配信に送るAPI (レイド, 配信者向け)
+// POST /api/livestream/:livestream_id/raid
+// 送った視聴者は送り先の配信で、視聴者数とは別にレイドで来た視聴者として数える
+func postRaidHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req PostRaidRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.TargetLivestreamID == int64(livestreamID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't raid own livestream")
+	}
+
+	var raid Raid
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		now := clock.Now().Unix()
+		var from, to LivestreamModel
+		if err := tx.GetContext(ctx, &from, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if err := tx.GetContext(ctx, &to, "SELECT * FROM livestreams WHERE id = ?", req.TargetLivestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "target livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get target livestream: "+err.Error()).SetInternal(err)
+		}
+		if from.StartAt > now || from.EndAt <= now {
+			return echo.NewHTTPError(http.StatusBadRequest, "livestream is not on air")
+		}
+		if to.StartAt > now || to.EndAt <= now {
+			return echo.NewHTTPError(http.StatusBadRequest, "target livestream is not on air")
+		}
+		// パスワード付きの配信には視聴者を送っても入れない
+		if to.Visibility == livestreamVisibilityPassword {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't raid password protected livestream")
+		}
+
+		var viewerIDs []int64
+		if err := tx.SelectContext(ctx, &viewerIDs, "SELECT user_id FROM livestream_presences WHERE livestream_id = ? AND last_seen_at >= ? AND user_id != ?", from.ID, clock.Now().Add(-presenceTTL).Unix(), userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream viewers: "+err.Error()).SetInternal(err)
+		}
+
+		raidModel := RaidModel{
+			UserID:           userID,
+			FromLivestreamID: from.ID,
+			ToLivestreamID:   to.ID,
+			ViewersCount:     int64(len(viewerIDs)),
+			CreatedAt:        now,
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO raids (user_id, from_livestream_id, to_livestream_id, viewers_count, created_at) VALUES (:user_id, :from_livestream_id, :to_livestream_id, :viewers_count, :created_at)", raidModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert raid: "+err.Error()).SetInternal(err)
+		}
+		raidID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted raid id: "+err.Error()).SetInternal(err)
+		}
+		raidModel.ID = raidID
+
+		// 視聴中の状態を送り先に移す (視聴者のクライアントは送り元のコメントか GET .../raid を見て移動する)
+		for _, viewerID := range viewerIDs {
+			if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO raid_viewers (raid_id, livestream_id, user_id) VALUES (?, ?, ?)", raidID, to.ID, viewerID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert raid viewer: "+err.Error()).SetInternal(err)
+			}
+			if err := touchPresence(ctx, tx, viewerID, to.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream presence: "+err.Error()).SetInternal(err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_presences WHERE livestream_id = ? AND user_id != ?", from.ID, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream presences: "+err.Error()).SetInternal(err)
+		}
+
+		raider, err := fillUserResponseByID(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+		}
+		if err := insertServerLivecomment(ctx, tx, from.ID, userID, livecommentTypeSystem, fmt.Sprintf("%d人の視聴者と「%s」にレイドしました", raidModel.ViewersCount, to.Title)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert raid livecomment: "+err.Error()).SetInternal(err)
+		}
+		if err := insertServerLivecomment(ctx, tx, to.ID, userID, livecommentTypeSystem, fmt.Sprintf("%sさんが%d人の視聴者とレイドしてきました", raider.DisplayName, raidModel.ViewersCount)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert raid livecomment: "+err.Error()).SetInternal(err)
+		}
+
+		raid = fillRaidResponse(raidModel)
+		return nil
+	}); err != nil {
+		return err
+	}
+	markLivecommentTrimPending(raid.FromLivestreamID)
+	markLivecommentTrimPending(raid.ToLivestreamID)
+
+	return c.JSON(http.StatusCreated, raid)
+}
+
+// 配信から最後に行われたレイドの取得API (視聴者のクライアントが移動先を知るため)
+// GET /api/livestream/:livestream_id/raid
+func getRaidHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var raidModel RaidModel
+	if err := dbConn.GetContext(ctx, &raidModel, "SELECT * FROM raids WHERE from_livestream_id = ? ORDER BY id DESC LIMIT 1", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "raid not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get raid: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, fillRaidResponse(raidModel))
+}
@@ -3,10 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
@@ -14,11 +12,11 @@ import (
 )
 
 type ReactionModel struct {
-	ID           int64  `db:"id"`
-	EmojiName    string `db:"emoji_name"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	CreatedAt    int64  `db:"created_at"`
+	ID           int64  `db:"id" json:"id"`
+	EmojiName    string `db:"emoji_name" json:"emoji_name"`
+	UserID       int64  `db:"user_id" json:"user_id"`
+	LivestreamID int64  `db:"livestream_id" json:"livestream_id"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
 }
 
 type Reaction struct {
@@ -27,6 +25,8 @@ type Reaction struct {
 	User       User       `json:"user"`
 	Livestream Livestream `json:"livestream"`
 	CreatedAt  int64      `json:"created_at"`
+	// :shortcode: のチャンネルのカスタム絵文字の場合のみ入る
+	EmojiURL string `json:"emoji_url,omitempty"`
 }
 
 type PostReactionRequest struct {
@@ -46,40 +46,54 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	p, paged, err := parseV1ListParams(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
 	}
-	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	q := newSelectQuery("SELECT * FROM "+reactionTable(int64(livestreamID))).
+		Where("livestream_id = ?", livestreamID)
+	if paged {
+		p.applyByCreatedAt(q, reactionTable(int64(livestreamID)))
+	} else {
+		q.OrderBy("created_at DESC")
+	}
+	query, args := q.Build()
+
+	var (
+		reactions []Reaction
+		next      string
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, int64(livestreamID), userID); err != nil {
+			return err
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
-	}
 
-	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
-	}
+		reactionModels := []ReactionModel{}
+		if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
+		}
+		n := len(reactionModels)
+		if paged {
+			n, next = p.page(n, func(i int) int64 { return reactionModels[i].ID })
+		}
 
-	reactions := make([]Reaction, len(reactionModels))
-	for i := range reactionModels {
-		reaction, err := fillReactionResponse(ctx, tx, reactionModels[i])
+		var err error
+		reactions, err = fillReactionResponses(ctx, tx, reactionModels[:n])
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error()).SetInternal(err)
 		}
-
-		reactions[i] = reaction
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
+	setNextCursorHeader(c, next)
 	return c.JSON(http.StatusOK, reactions)
 }
 
@@ -105,52 +119,79 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		EmojiName:    req.EmojiName,
-		CreatedAt:    time.Now().Unix(),
-	}
+	var (
+		reaction     Reaction
+		rankingDelta leaderboardDelta
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamAccess(ctx, tx, c, int64(livestreamID), userID); err != nil {
+			return err
+		}
+		if err := verifyReactionEmoji(ctx, tx, int64(livestreamID), req.EmojiName); err != nil {
+			return err
+		}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
-	}
+		reactionModel := ReactionModel{
+			UserID:       int64(userID),
+			LivestreamID: int64(livestreamID),
+			EmojiName:    req.EmojiName,
+			CreatedAt:    clock.Now().Unix(),
+		}
 
-	reactionID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
-	}
-	reactionModel.ID = reactionID
+		err := insertReaction(ctx, tx, &reactionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error()).SetInternal(err)
+		}
 
-	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
-	}
+		if err := recordReactionBucket(ctx, tx, reactionModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record reaction bucket: "+err.Error()).SetInternal(err)
+		}
+		if rankingDelta, err = newLeaderboardDelta(ctx, tx, reactionModel.LivestreamID, 0, 1); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get leaderboard delta: "+err.Error()).SetInternal(err)
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		reaction, err = fillReactionResponse(ctx, tx, reactionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+	applyLeaderboardDelta(ctx, c.Logger(), rankingDelta)
+	incrCounter(ctx, c.Logger(), livestreamReactionsCounter, reaction.Livestream.ID, 1)
 
 	return c.JSON(http.StatusCreated, reaction)
 }
 
-func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
-		return Reaction{}, err
+// fillReactionResponses はリアクションしたユーザをまとめて取得してからレスポンスを組み立てる
+// 一覧のリアクションはほとんど同じ配信のものなので、配信のレスポンスは配信ごとに1回だけ組み立てる
+func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel) ([]Reaction, error) {
+	userIDs := make([]int64, len(reactionModels))
+	for i := range reactionModels {
+		userIDs[i] = reactionModels[i].UserID
 	}
-	user, err := fillUserResponse(ctx, tx, userModel)
-	if err != nil {
-		return Reaction{}, err
+	if err := loaderFrom(ctx).primeUsers(ctx, tx, userIDs); err != nil {
+		return nil, err
 	}
 
+	livestreams := filledLivestreams{}
+	reactions := make([]Reaction, len(reactionModels))
+	for i := range reactionModels {
+		ls, err := livestreams.get(ctx, tx, reactionModels[i].LivestreamID)
+		if err != nil {
+			return nil, err
+		}
+		reaction, err := fillReactionResponseFor(ctx, tx, reactionModels[i], ls.model, ls.response)
+		if err != nil {
+			return nil, err
+		}
+		reactions[i] = reaction
+	}
+	return reactions, nil
+}
+
+func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
 	livestreamModel := LivestreamModel{}
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
 		return Reaction{}, err
@@ -159,6 +200,15 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 	if err != nil {
 		return Reaction{}, err
 	}
+	return fillReactionResponseFor(ctx, tx, reactionModel, livestreamModel, livestream)
+}
+
+// fillReactionResponseFor は組み立て済みの配信のレスポンスを使ってリアクションのレスポンスを組み立てる
+func fillReactionResponseFor(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel, livestreamModel LivestreamModel, livestream Livestream) (Reaction, error) {
+	user, err := fillUserResponseByID(ctx, tx, reactionModel.UserID)
+	if err != nil {
+		return Reaction{}, err
+	}
 
 	reaction := Reaction{
 		ID:         reactionModel.ID,
@@ -167,6 +217,15 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 		Livestream: livestream,
 		CreatedAt:  reactionModel.CreatedAt,
 	}
+	if shortcode, ok := customEmojiShortcode(reactionModel.EmojiName); ok {
+		emojis, err := channelEmojisOf(ctx, tx, livestreamModel)
+		if err != nil {
+			return Reaction{}, err
+		}
+		if m, ok := emojis[shortcode]; ok {
+			reaction.EmojiURL = channelEmojiImageURL(m.ID)
+		}
+	}
 
 	return reaction, nil
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/isucon/isucon13/webapp/go/fixtures"
+	"github.com/jmoiron/sqlx"
+	echolog "github.com/labstack/gommon/log"
+)
+
+// openTestTx は MySQL (ISUCON13_MYSQL_DIALCONFIG_* で指定) のトランザクションを返す
+// つながらなければスキップし、入れた行はテストの終わりにロールバックする
+func openTestTx(t *testing.T) *sqlx.Tx {
+	t.Helper()
+
+	conn, err := connectDB(echolog.New("test"))
+	if err != nil {
+		t.Skipf("mysql is not available: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	dbConn = conn
+
+	tx, err := conn.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tx.Rollback() })
+	return tx
+}
+
+// limit を指定しても v1 の並び順 (created_at の降順) のままページングできること
+func TestPagedReactions(t *testing.T) {
+	tx := openTestTx(t)
+	ctx := withRequestLoader(context.Background())
+
+	owner, err := fixtures.NewUser().WithIcon().Insert(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	livestream, err := fixtures.NewLivestream().WithOwner(owner).WithReactions(4).Insert(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先頭のリアクションと同じ時刻のものを足して、id で並ぶことを確かめる
+	var createdAt int64
+	if err := tx.GetContext(ctx, &createdAt, "SELECT created_at FROM reactions WHERE id = ?", livestream.ReactionIDs[0]); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := tx.ExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (?, ?, ?, ?)", livestream.Commenter.ID, livestream.ID, "tada", createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiedID, err := rs.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := livestream.ReactionIDs
+	want := []int64{ids[3], ids[2], ids[1], tiedID, ids[0]}
+
+	var got []int64
+	p := listParams{Limit: 2}
+	for page := 0; page < len(want); page++ {
+		q := newSelectQuery("SELECT * FROM "+reactionTable(livestream.ID)).Where("livestream_id = ?", livestream.ID)
+		p.applyByCreatedAt(q, reactionTable(livestream.ID))
+		query, args := q.Build()
+		var models []ReactionModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			t.Fatal(err)
+		}
+		n, next := p.page(len(models), func(i int) int64 { return models[i].ID })
+
+		reactions, err := fillReactionResponses(ctx, tx, models[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range reactions {
+			if r.Livestream.ID != livestream.ID || r.Livestream.Owner.Name != owner.Name {
+				t.Errorf("reaction %d has livestream %d owned by %q", r.ID, r.Livestream.ID, r.Livestream.Owner.Name)
+			}
+			got = append(got, r.ID)
+		}
+		if next == "" {
+			break
+		}
+		p.Cursor = models[n-1].ID
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// リアクション数を集計する区間の秒数
+const reactionBucketSeconds = 10
+
+func reactionBucketStart(createdAt int64) int64 {
+	return createdAt - createdAt%reactionBucketSeconds
+}
+
+// recordReactionBucket はリアクションを10秒ごとの集計に加算する
+// 投稿と同じトランザクションで呼ぶこと
+func recordReactionBucket(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO reaction_buckets (livestream_id, bucket_start, count) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE count = count + 1", reactionModel.LivestreamID, reactionBucketStart(reactionModel.CreatedAt))
+	return err
+}
+
+// backfillReactionBuckets は reactions から集計を作り直す
+// 集計を入れる前のリアクション (初期データなど) を反映するためのバッチで、`isupipe maintenance reaction_buckets` で実行する
+func backfillReactionBuckets(ctx context.Context) (int64, error) {
+	rs, err := dbConn.ExecContext(ctx, `
+		INSERT INTO reaction_buckets (livestream_id, bucket_start, count)
+		SELECT livestream_id, created_at - created_at % ?, COUNT(*) FROM `+reactionsAllTable()+` r GROUP BY livestream_id, created_at - created_at % ?
+		ON DUPLICATE KEY UPDATE count = VALUES(count)`, reactionBucketSeconds, reactionBucketSeconds)
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+type ReactionTimelineBucket struct {
+	// 配信開始からの秒数
+	Offset int64 `json:"offset"`
+	// 区間の開始時刻 (UNIX時間)
+	StartAt int64 `json:"start_at"`
+	Count   int64 `json:"count"`
+}
+
+type ReactionTimeline struct {
+	LivestreamID  int64                    `json:"livestream_id"`
+	BucketSeconds int64                    `json:"bucket_seconds"`
+	Buckets       []ReactionTimelineBucket `json:"buckets"`
+}
+
+// 配信のリアクション数の推移取得API (アーカイブ再生時のヒートマップ用)
+// GET /api/livestream/:livestream_id/reactions/timeline
+// リアクションが無い区間は返さない
+func getReactionTimelineHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	timeline := ReactionTimeline{
+		LivestreamID:  int64(livestreamID),
+		BucketSeconds: reactionBucketSeconds,
+		Buckets:       []ReactionTimelineBucket{},
+	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamModel.ID, userID); err != nil {
+			return err
+		}
+
+		if err := tx.SelectContext(ctx, &timeline.Buckets, "SELECT bucket_start - ? AS `offset`, bucket_start AS start_at, count FROM reaction_buckets WHERE livestream_id = ? ORDER BY bucket_start", livestreamModel.StartAt, livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction buckets: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, timeline)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	recommendationsEnabledEnvKey = "ISUCON13_RECOMMENDATIONS_ENABLED"
+
+	recommendationWorkerInterval = 10 * time.Minute
+	// ユーザごとに保存するおすすめの件数
+	recommendationsPerUser = 20
+
+	// 行動ごとの重み
+	recommendationWeightWatch    = 1.0
+	recommendationWeightComment  = 2.0
+	recommendationWeightReaction = 1.0
+	// 視聴履歴は10分見るごとに1、上限3
+	recommendationWatchSecondsUnit = 600
+	recommendationMaxWatchWeight   = 3.0
+)
+
+// おすすめ配信の定期生成
+// 全ユーザの視聴・コメント・リアクションを読むので、デフォルトでは無効
+var recommendationsEnabled = false
+
+func loadRecommendationConfig() error {
+	if v, ok := os.LookupEnv(recommendationsEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", recommendationsEnabledEnvKey, err)
+		}
+		recommendationsEnabled = enabled
+	}
+	return nil
+}
+
+func runRecommendationWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(recommendationWorkerInterval)
+	defer ticker.Stop()
+	for {
+		if err := buildRecommendations(ctx); err != nil {
+			logger.Warnf("failed to build recommendations: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type recommendationInteraction struct {
+	UserID       int64   `db:"user_id"`
+	LivestreamID int64   `db:"livestream_id"`
+	Weight       float64 `db:"weight"`
+}
+
+type recommendationScore struct {
+	livestreamID int64
+	score        float64
+}
+
+// buildRecommendations はユーザベースの協調フィルタリングでおすすめを作り直す
+// 行動が似ているユーザ (コサイン類似度) が関わった配信のうち、まだ関わっていないものを重み付きで数える
+func buildRecommendations(ctx context.Context) error {
+	var interactions []recommendationInteraction
+	if err := dbConn.SelectContext(ctx, &interactions, `
+		SELECT user_id, livestream_id, SUM(weight) AS weight FROM (
+			SELECT user_id, livestream_id, ? AS weight FROM livestream_viewers_history
+			UNION ALL
+			SELECT lc.user_id, lc.livestream_id, ? AS weight FROM `+livecommentsAggregateTable()+` lc WHERE lc.comment_type = ?
+			UNION ALL
+			SELECT r.user_id, r.livestream_id, ? AS weight FROM `+reactionsAllTable()+` r
+			UNION ALL
+			SELECT user_id, livestream_id, LEAST(watched_seconds / ?, ?) AS weight FROM watch_history
+		) i
+		GROUP BY user_id, livestream_id`,
+		recommendationWeightWatch, recommendationWeightComment, livecommentTypeUser, recommendationWeightReaction,
+		recommendationWatchSecondsUnit, recommendationMaxWatchWeight); err != nil {
+		return err
+	}
+
+	// 公開配信で、自分のものでない配信だけをおすすめする
+	var candidates []struct {
+		ID     int64 `db:"id"`
+		UserID int64 `db:"user_id"`
+	}
+	if err := dbConn.SelectContext(ctx, &candidates, "SELECT id, user_id FROM livestreams WHERE visibility = ?", livestreamVisibilityPublic); err != nil {
+		return err
+	}
+	ownerOf := make(map[int64]int64, len(candidates))
+	for _, l := range candidates {
+		ownerOf[l.ID] = l.UserID
+	}
+
+	affinity := map[int64]map[int64]float64{}
+	viewersOf := map[int64][]int64{}
+	for _, in := range interactions {
+		if affinity[in.UserID] == nil {
+			affinity[in.UserID] = map[int64]float64{}
+		}
+		affinity[in.UserID][in.LivestreamID] = in.Weight
+		viewersOf[in.LivestreamID] = append(viewersOf[in.LivestreamID], in.UserID)
+	}
+	norms := make(map[int64]float64, len(affinity))
+	for userID, items := range affinity {
+		var sum float64
+		for _, w := range items {
+			sum += w * w
+		}
+		norms[userID] = math.Sqrt(sum)
+	}
+
+	generatedAt := clock.Now().Unix()
+	for userID, items := range affinity {
+		// 同じ配信に関わったユーザとの類似度
+		similarity := map[int64]float64{}
+		for livestreamID, w := range items {
+			for _, other := range viewersOf[livestreamID] {
+				if other != userID {
+					similarity[other] += w * affinity[other][livestreamID]
+				}
+			}
+		}
+
+		scores := map[int64]float64{}
+		for other, dot := range similarity {
+			sim := dot / (norms[userID] * norms[other])
+			for livestreamID, w := range affinity[other] {
+				if _, seen := items[livestreamID]; seen {
+					continue
+				}
+				if owner, ok := ownerOf[livestreamID]; !ok || owner == userID {
+					continue
+				}
+				scores[livestreamID] += sim * w
+			}
+		}
+
+		ranked := make([]recommendationScore, 0, len(scores))
+		for livestreamID, score := range scores {
+			ranked = append(ranked, recommendationScore{livestreamID: livestreamID, score: score})
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			if ranked[i].score != ranked[j].score {
+				return ranked[i].score > ranked[j].score
+			}
+			return ranked[i].livestreamID > ranked[j].livestreamID
+		})
+		if len(ranked) > recommendationsPerUser {
+			ranked = ranked[:recommendationsPerUser]
+		}
+
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM user_recommendations WHERE user_id = ?", userID); err != nil {
+				return err
+			}
+			for i, r := range ranked {
+				if _, err := tx.ExecContext(ctx, "INSERT INTO user_recommendations (user_id, livestream_id, score, `rank`, generated_at) VALUES (?, ?, ?, ?, ?)", userID, r.livestreamID, r.score, i+1, generatedAt); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// おすすめ配信一覧取得API
+// GET /api/recommendations
+func getRecommendationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	q := newSelectQuery(`SELECT l.* FROM user_recommendations r INNER JOIN livestreams l ON l.id = r.livestream_id`).
+		Where("r.user_id = ?", userID).
+		OrderBy("r.`rank`")
+	if playlistHealthCheckEnabled {
+		q.Where(healthyLivestreamCondition("l"))
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	livestreams := []Livestream{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModels []LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get recommendations: "+err.Error()).SetInternal(err)
+		}
+		for i := range livestreamModels {
+			livestream, err := fillLivestreamResponse(ctx, tx, livestreamModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			livestreams = append(livestreams, livestream)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	redisAddrEnvKey = "ISUCON13_REDIS_ADDR"
+
+	redisDialTimeout = 1 * time.Second
+	redisIOTimeout   = 1 * time.Second
+	redisMaxIdle     = 16
+)
+
+// Redis を使う機能がある場合だけ接続する (アドレスが無ければ nil)
+var redisConn *redisClient
+
+func loadRedisConfig() {
+	if addr, ok := os.LookupEnv(redisAddrEnvKey); ok && addr != "" {
+		redisConn = newRedisClient(addr)
+	}
+}
+
+// redisError は Redis が返したエラー応答
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient は RESP を直接話す最小限のクライアント
+// 使うコマンドが少ないので外部ライブラリには頼らない
+type redisClient struct {
+	addr string
+	idle chan *redisConnection
+}
+
+type redisConnection struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newRedisClient(addr string) *redisClient {
+	return &redisClient{addr: addr, idle: make(chan *redisConnection, redisMaxIdle)}
+}
+
+func (c *redisClient) get(ctx context.Context) (*redisConnection, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	d := net.Dialer{Timeout: redisDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConnection{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+func (c *redisClient) put(rc *redisConnection) {
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// Do はコマンドを1つ送って応答を返す
+func (c *redisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.Pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(redisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline は複数のコマンドをまとめて送る
+// 個々のコマンドのエラー応答は redisError として replies に入る
+func (c *redisClient) Pipeline(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	rc, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(redisIOTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := rc.conn.SetDeadline(deadline); err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	for _, args := range cmds {
+		fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if err := rc.w.Flush(); err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		v, err := readRedisReply(rc.r)
+		if err != nil {
+			// 途中で切れた接続は使い回さない
+			rc.conn.Close()
+			return nil, err
+		}
+		replies[i] = v
+	}
+	c.put(rc)
+	return replies, nil
+}
+
+// Subscribe は channel を購読し、届いたメッセージごとに onMessage を呼ぶ
+// 購読用の接続はプールに戻さない。ctx が終わるか接続が切れるまで戻らない
+func (c *redisClient) Subscribe(ctx context.Context, channel string, onMessage func(payload string)) error {
+	d := net.Dialer{Timeout: redisDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "*2\r\n$9\r\nSUBSCRIBE\r\n$%d\r\n%s\r\n", len(channel), channel)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if e, ok := reply.(redisError); ok {
+			return e
+		}
+		// ["message", channel, payload] 以外 (購読の確認など) は読み捨てる
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+		if payload, ok := items[2].(string); ok {
+			onMessage(payload)
+		}
+	}
+}
+
+// readRedisReply は応答を1つ読む
+// 文字列は string、整数は int64、nil は nil、配列は []interface{} になる
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	registrationAbuseEnabledEnvKey       = "ISUCON13_REGISTRATION_ABUSE_ENABLED"
+	registrationRateLimitEnvKey          = "ISUCON13_REGISTRATION_RATE_LIMIT"
+	registrationChallengeThresholdEnvKey = "ISUCON13_REGISTRATION_CHALLENGE_THRESHOLD"
+
+	// 同じ送信元からの登録を数える期間
+	registrationBurstWindow = 10 * time.Minute
+	// 同じ期間に同じIPから登録できる数
+	defaultRegistrationRateLimit = 20
+	// 同じ期間に同じIP・User-Agentからこの数を超えたらCAPTCHAを求める
+	defaultRegistrationChallengeThreshold = 5
+
+	registrationAnalyzerInterval = 1 * time.Minute
+	// 登録の送信元はこの期間を過ぎたら消す
+	registrationEventRetention = 7 * 24 * time.Hour
+	// User-Agent はインデックスに載せるので切り詰める
+	registrationUserAgentMaxLength = 255
+
+	// レスポンスヘッダでクライアントにCAPTCHAの表示を求める
+	registrationChallengeHeader = "X-Captcha-Challenge"
+
+	suspiciousReasonIPBurst        = "ip_burst"
+	suspiciousReasonUserAgentBurst = "user_agent_burst"
+
+	suspiciousAccountStatusOpen      = "open"
+	suspiciousAccountStatusDismissed = "dismissed"
+
+	auditActionSuspiciousAccountDismiss = "suspicious_account.dismiss"
+	auditTargetSuspiciousAccount        = "suspicious_account"
+)
+
+// 登録の連投検知
+// ベンチマーカーは同じIPから大量に登録するので、デフォルトでは無効
+var (
+	registrationAbuseEnabled       = false
+	registrationRateLimit          = int64(defaultRegistrationRateLimit)
+	registrationChallengeThreshold = int64(defaultRegistrationChallengeThreshold)
+)
+
+func loadRegistrationAbuseConfig() error {
+	if v, ok := os.LookupEnv(registrationAbuseEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", registrationAbuseEnabledEnvKey, err)
+		}
+		registrationAbuseEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(registrationRateLimitEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", registrationRateLimitEnvKey, v)
+		}
+		registrationRateLimit = n
+	}
+	if v, ok := os.LookupEnv(registrationChallengeThresholdEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("failed to parse environment variable '%s' as positive integer: %s", registrationChallengeThresholdEnvKey, v)
+		}
+		registrationChallengeThreshold = n
+	}
+	return nil
+}
+
+type SuspiciousAccountModel struct {
+	UserID            int64  `db:"user_id"`
+	Reason            string `db:"reason"`
+	IP                string `db:"ip"`
+	UserAgent         string `db:"user_agent"`
+	BurstCount        int64  `db:"burst_count"`
+	ChallengeRequired bool   `db:"challenge_required"`
+	Status            string `db:"status"`
+	CreatedAt         int64  `db:"created_at"`
+	UpdatedAt         int64  `db:"updated_at"`
+}
+
+type SuspiciousAccount struct {
+	User              User   `json:"user"`
+	Reason            string `json:"reason"`
+	IP                string `json:"ip"`
+	UserAgent         string `json:"user_agent"`
+	BurstCount        int64  `json:"burst_count"`
+	ChallengeRequired bool   `json:"challenge_required"`
+	Status            string `json:"status"`
+	CreatedAt         int64  `json:"created_at"`
+	UpdatedAt         int64  `json:"updated_at"`
+}
+
+// registrationSource は登録リクエストの送信元
+type registrationSource struct {
+	IP        string
+	UserAgent string
+	// 期間内に同じIPから登録された数 (今回の分は含まない)
+	IPCount int64
+	// 期間内に同じIP・User-Agentから登録された数 (今回の分は含まない)
+	PairCount int64
+}
+
+func (s registrationSource) challengeRequired() bool {
+	return s.PairCount+1 > registrationChallengeThreshold
+}
+
+// checkRegistrationBurst は同じ送信元からの登録数を数え、上限を超えていたら 429 を返す
+func checkRegistrationBurst(ctx context.Context, c echo.Context) (registrationSource, error) {
+	// 送信元ごとの上限なので、X-Forwarded-For を差し替えて逃れられないよう信用するプロキシの分だけを見る
+	src := registrationSource{IP: clientIP(c), UserAgent: c.Request().UserAgent()}
+	if len(src.UserAgent) > registrationUserAgentMaxLength {
+		src.UserAgent = src.UserAgent[:registrationUserAgentMaxLength]
+	}
+	if !registrationAbuseEnabled {
+		return src, nil
+	}
+
+	since := clock.Now().Add(-registrationBurstWindow).Unix()
+	if err := dbConn.GetContext(ctx, &src.IPCount, "SELECT COUNT(*) FROM registration_events WHERE ip = ? AND created_at >= ?", src.IP, since); err != nil {
+		return src, echo.NewHTTPError(http.StatusInternalServerError, "failed to count registrations: "+err.Error()).SetInternal(err)
+	}
+	if src.IPCount >= registrationRateLimit {
+		return src, newReasonedError(http.StatusTooManyRequests, "registration_rate_limited", "too many registrations from the same address")
+	}
+	if err := dbConn.GetContext(ctx, &src.PairCount, "SELECT COUNT(*) FROM registration_events WHERE ip = ? AND user_agent = ? AND created_at >= ?", src.IP, src.UserAgent, since); err != nil {
+		return src, echo.NewHTTPError(http.StatusInternalServerError, "failed to count registrations: "+err.Error()).SetInternal(err)
+	}
+	return src, nil
+}
+
+// recordRegistration は登録の送信元を記録し、連投なら要注意アカウントとして記録する
+func recordRegistration(ctx context.Context, tx *sqlx.Tx, userID int64, src registrationSource) error {
+	if !registrationAbuseEnabled {
+		return nil
+	}
+
+	now := clock.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO registration_events (user_id, ip, user_agent, created_at) VALUES (?, ?, ?, ?)", userID, src.IP, src.UserAgent, now); err != nil {
+		return err
+	}
+	if !src.challengeRequired() {
+		return nil
+	}
+	return flagSuspiciousAccount(ctx, tx, SuspiciousAccountModel{
+		UserID:            userID,
+		Reason:            suspiciousReasonIPBurst,
+		IP:                src.IP,
+		UserAgent:         src.UserAgent,
+		BurstCount:        src.PairCount + 1,
+		ChallengeRequired: true,
+	})
+}
+
+// flagSuspiciousAccount は要注意アカウントとして記録する
+// 既に記録済みなら連投数だけ更新する (解除済みのものは再び開かない)
+func flagSuspiciousAccount(ctx context.Context, tx *sqlx.Tx, m SuspiciousAccountModel) error {
+	now := clock.Now().Unix()
+	m.Status = suspiciousAccountStatusOpen
+	m.CreatedAt = now
+	m.UpdatedAt = now
+	_, err := tx.NamedExecContext(ctx, `
+		INSERT INTO suspicious_accounts (user_id, reason, ip, user_agent, burst_count, challenge_required, status, created_at, updated_at)
+		VALUES (:user_id, :reason, :ip, :user_agent, :burst_count, :challenge_required, :status, :created_at, :updated_at)
+		ON DUPLICATE KEY UPDATE burst_count = GREATEST(burst_count, VALUES(burst_count)), updated_at = VALUES(updated_at)`, m)
+	return err
+}
+
+func runRegistrationAbuseAnalyzer(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(registrationAnalyzerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := analyzeRegistrations(ctx); err != nil {
+			logger.Warnf("failed to analyze registrations: %v", err)
+		}
+	}
+}
+
+type registrationBurst struct {
+	Key   string `db:"k"`
+	Count int64  `db:"n"`
+}
+
+// analyzeRegistrations は登録時には見ていない偏りを探す
+// IPを変えながら同じUser-Agentで登録しているものや、しきい値未満で止まっていたIPの集中を拾う
+func analyzeRegistrations(ctx context.Context) error {
+	now := clock.Now()
+	since := now.Add(-registrationBurstWindow).Unix()
+
+	for _, g := range []struct {
+		column string
+		reason string
+	}{
+		{"user_agent", suspiciousReasonUserAgentBurst},
+		{"ip", suspiciousReasonIPBurst},
+	} {
+		var bursts []registrationBurst
+		if err := dbConn.SelectContext(ctx, &bursts, "SELECT "+g.column+" AS k, COUNT(*) AS n FROM registration_events WHERE created_at >= ? GROUP BY "+g.column+" HAVING COUNT(*) > ?", since, registrationChallengeThreshold); err != nil {
+			return err
+		}
+		for _, b := range bursts {
+			if b.Key == "" {
+				continue
+			}
+			if err := withTx(ctx, func(tx *sqlx.Tx) error {
+				var events []struct {
+					UserID    int64  `db:"user_id"`
+					IP        string `db:"ip"`
+					UserAgent string `db:"user_agent"`
+				}
+				if err := tx.SelectContext(ctx, &events, "SELECT user_id, ip, user_agent FROM registration_events WHERE "+g.column+" = ? AND created_at >= ?", b.Key, since); err != nil {
+					return err
+				}
+				for _, ev := range events {
+					if err := flagSuspiciousAccount(ctx, tx, SuspiciousAccountModel{
+						UserID:     ev.UserID,
+						Reason:     g.reason,
+						IP:         ev.IP,
+						UserAgent:  ev.UserAgent,
+						BurstCount: b.Count,
+					}); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := dbConn.ExecContext(ctx, "DELETE FROM registration_events WHERE created_at < ?", now.Add(-registrationEventRetention).Unix())
+	return err
+}
+
+// 要注意アカウント一覧API (管理者向け)
+// GET /api/admin/suspicious_accounts
+func getSuspiciousAccountsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = suspiciousAccountStatusOpen
+	}
+	q := newSelectQuery("SELECT * FROM suspicious_accounts").
+		Where("status = ?", status).
+		OrderBy("updated_at DESC")
+	if v := c.QueryParam("reason"); v != "" {
+		q.Where("reason = ?", v)
+	}
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	var accounts []SuspiciousAccount
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []SuspiciousAccountModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get suspicious accounts: "+err.Error()).SetInternal(err)
+		}
+		accounts = make([]SuspiciousAccount, len(models))
+		for i, m := range models {
+			user, err := fillUserResponseByID(ctx, tx, m.UserID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+			}
+			accounts[i] = SuspiciousAccount{
+				User:              user,
+				Reason:            m.Reason,
+				IP:                m.IP,
+				UserAgent:         m.UserAgent,
+				BurstCount:        m.BurstCount,
+				ChallengeRequired: m.ChallengeRequired,
+				Status:            m.Status,
+				CreatedAt:         m.CreatedAt,
+				UpdatedAt:         m.UpdatedAt,
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, accounts)
+}
+
+// 要注意アカウントの解除API (管理者向け)
+// POST /api/admin/suspicious_accounts/:username/dismiss
+func dismissSuspiciousAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	username := c.Param("username")
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var flaggedUserID int64
+		if err := tx.GetContext(ctx, &flaggedUserID, "SELECT id FROM users WHERE name = ?", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+
+		var before []SuspiciousAccountModel
+		if err := tx.SelectContext(ctx, &before, "SELECT * FROM suspicious_accounts WHERE user_id = ? FOR UPDATE", flaggedUserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get suspicious account: "+err.Error()).SetInternal(err)
+		}
+		if len(before) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "the user is not flagged as suspicious")
+		}
+
+		now := clock.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "UPDATE suspicious_accounts SET status = ?, challenge_required = FALSE, updated_at = ? WHERE user_id = ?", suspiciousAccountStatusDismissed, now, flaggedUserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to dismiss suspicious account: "+err.Error()).SetInternal(err)
+		}
+
+		after := make([]SuspiciousAccountModel, len(before))
+		for i, m := range before {
+			m.Status = suspiciousAccountStatusDismissed
+			m.ChallengeRequired = false
+			m.UpdatedAt = now
+			after[i] = m
+		}
+		if err := insertAuditLog(ctx, tx, userID, auditActionSuspiciousAccountDismiss, auditTargetSuspiciousAccount, flaggedUserID, 0, before, after); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエストボディの上限 (バイト)
+const (
+	defaultMaxRequestBodyBytes = 1 << 20
+	// コメントは最大 10000 文字 (JSON のエスケープ込みでも収まる)
+	livecommentMaxRequestBodyBytes = 64 << 10
+	// 画像は base64 で 4/3 倍に膨らむ
+	iconMaxRequestBodyBytes = 8 << 20
+	// 字幕は最大 1MB (改行などのエスケープで膨らむ分を見込む)
+	captionMaxRequestBodyBytes = 4 << 20
+	// チャットログはファイルをそのまま受け取る (これより大きいものは import-chat コマンドで取り込む)
+	chatImportMaxRequestBodyBytes = 32 << 20
+)
+
+var errRequestBodyTooLarge = errors.New("request body is too large")
+
+type requestSizeRule struct {
+	Method string
+	// echo のルート定義と同じ形式 (c.Path() と比較する)
+	Path     string
+	MaxBytes int64
+}
+
+// requestSizeRules はルートごとのリクエストボディの上限
+// ここに無いルートは defaultMaxRequestBodyBytes になる
+var requestSizeRules = []requestSizeRule{
+	{http.MethodPost, "/api/livestream/:livestream_id/livecomment", livecommentMaxRequestBodyBytes},
+	{http.MethodPost, "/api/icon", iconMaxRequestBodyBytes},
+	{http.MethodPost, "/api/channel", iconMaxRequestBodyBytes},
+	{http.MethodPost, "/api/livestream/:livestream_id/captions", captionMaxRequestBodyBytes},
+	{http.MethodPost, "/api/livestream/:livestream_id/chat_imports", chatImportMaxRequestBodyBytes},
+}
+
+var requestSizeIndex = func() map[string]int64 {
+	m := make(map[string]int64, len(requestSizeRules))
+	for _, r := range requestSizeRules {
+		m[r.Method+" "+r.Path] = r.MaxBytes
+	}
+	return m
+}()
+
+// limitedRequestBody は上限を超えて読もうとしたらエラーを返す
+type limitedRequestBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedRequestBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errRequestBodyTooLarge
+	}
+	// 上限ちょうどのボディと超えたボディを見分けるため 1 バイト多く読む
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded = true
+		return int(b.remaining), errRequestBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// requestSizeLimitMiddleware はルートに応じてリクエストボディの大きさを制限する
+// Content-Length で超えていると分かる場合は読まずに断る
+// 読んでいる途中で超えた場合は、ハンドラがどのエラーを返しても 413 にする
+func requestSizeLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		limit, ok := requestSizeIndex[req.Method+" "+c.Path()]
+		if !ok {
+			limit = defaultMaxRequestBodyBytes
+		}
+		if req.ContentLength > limit {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, errRequestBodyTooLarge.Error())
+		}
+		if req.Body == nil || req.Body == http.NoBody {
+			return next(c)
+		}
+
+		body := &limitedRequestBody{ReadCloser: req.Body, remaining: limit}
+		req.Body = body
+		err := next(c)
+		if body.exceeded && !c.Response().Committed {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, errRequestBodyTooLarge.Error())
+		}
+		return err
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reservationStrictEnvKey = "ISUCON13_RESERVATION_STRICT"
+
+	// 予約失敗時にレスポンスの reason として返す値
+	reservationReasonOutOfTerm = "out_of_term"
+	reservationReasonSlotFull  = "slot_full"
+	reservationReasonOverlap   = "overlap"
+	reservationReasonPast      = "past"
+
+	// 一度に取得できる予約枠の期間の上限
+	maxReservationSlotsRange = 31 * 24 * time.Hour
+)
+
+// 過去時刻の予約・自分の配信と重なる予約を拒否するかどうか (開始後のキャンセルは strict でなくても拒否する)
+// ベンチマーカーは固定の期間に予約を入れてくるので、デフォルトでは無効
+var reservationStrict = false
+
+func loadReservationConfig() error {
+	if v, ok := os.LookupEnv(reservationStrictEnvKey); ok {
+		strict, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", reservationStrictEnvKey, err)
+		}
+		reservationStrict = strict
+	}
+	return nil
+}
+
+type ReservationSlot struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 残りの予約可能数
+	Remaining int64 `json:"remaining"`
+}
+
+// 予約枠の残数一覧取得API
+// GET /api/reservation/slots?from=<unix>&to=<unix>
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if to <= from {
+		return echo.NewHTTPError(http.StatusBadRequest, "to must be greater than from")
+	}
+	if time.Duration(to-from)*time.Second > maxReservationSlotsRange {
+		return echo.NewHTTPError(http.StatusBadRequest, "reservation slots range must be within 31 days")
+	}
+
+	var slotModels []ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error()).SetInternal(err)
+	}
+
+	slots := make([]ReservationSlot, len(slotModels))
+	for i, m := range slotModels {
+		slots[i] = ReservationSlot{
+			StartAt:   m.StartAt,
+			EndAt:     m.EndAt,
+			Remaining: m.Slot,
+		}
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultReservationSeriesIntervalDays = 7
+	maxReservationSeriesOccurrences      = 52
+)
+
+type ReserveSeriesRequest struct {
+	// 初回の配信 (start_at, end_at が初回の時間帯)
+	ReserveLivestreamRequest
+	// 繰り返しの間隔 (日)。省略時は毎週
+	IntervalDays int64 `json:"interval_days"`
+	// 繰り返す回数 (初回を含む)
+	Occurrences int64 `json:"occurrences"`
+}
+
+type ReservationSeriesModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	IntervalDays int64  `db:"interval_days"`
+	Occurrences  int64  `db:"occurrences"`
+	FirstStartAt int64  `db:"first_start_at"`
+	Duration     int64  `db:"duration"`
+	CanceledAt   *int64 `db:"canceled_at"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type ReservationSeries struct {
+	ID           int64        `json:"id"`
+	IntervalDays int64        `json:"interval_days"`
+	Occurrences  int64        `json:"occurrences"`
+	CanceledAt   *int64       `json:"canceled_at,omitempty"`
+	CreatedAt    int64        `json:"created_at"`
+	Livestreams  []Livestream `json:"livestreams"`
+}
+
+// 繰り返し予約API
+// POST /api/livestream/reservation/series
+// 全ての回を1トランザクションで予約するので、1回でも予約できなければ何も予約されない
+func reserveSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req ReserveSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.IntervalDays == 0 {
+		req.IntervalDays = defaultReservationSeriesIntervalDays
+	}
+	if req.IntervalDays < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "interval_days must be positive")
+	}
+	if req.Occurrences < 1 || req.Occurrences > maxReservationSeriesOccurrences {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("occurrences must be between 1 and %d", maxReservationSeriesOccurrences))
+	}
+	interval := req.IntervalDays * 24 * 60 * 60
+	duration := req.EndAt - req.StartAt
+	if duration <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at must be greater than start_at")
+	}
+	if duration > interval {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestreams in a series must not overlap each other")
+	}
+
+	var series ReservationSeries
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m := ReservationSeriesModel{
+			UserID:       userID,
+			IntervalDays: req.IntervalDays,
+			Occurrences:  req.Occurrences,
+			FirstStartAt: req.StartAt,
+			Duration:     duration,
+			CreatedAt:    clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_series (user_id, interval_days, occurrences, first_start_at, duration, created_at) VALUES (:user_id, :interval_days, :occurrences, :first_start_at, :duration, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation series: "+err.Error()).SetInternal(err)
+		}
+		if m.ID, err = rs.LastInsertId(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation series id: "+err.Error()).SetInternal(err)
+		}
+
+		for i := int64(0); i < req.Occurrences; i++ {
+			occurrence := req.ReserveLivestreamRequest
+			occurrence.StartAt = req.StartAt + i*interval
+			occurrence.EndAt = occurrence.StartAt + duration
+			livestreamModel, err := reserveLivestream(ctx, tx, c.Logger(), userID, &occurrence)
+			if err != nil {
+				var re *reasonedError
+				if errors.As(err, &re) {
+					return newReasonedError(re.Code, re.Reason, fmt.Sprintf("occurrence %d (%d ~ %d): %s", i+1, occurrence.StartAt, occurrence.EndAt, re.Message))
+				}
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO reservation_series_livestreams (series_id, livestream_id, occurrence) VALUES (?, ?, ?)", m.ID, livestreamModel.ID, i+1); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation series livestream: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		series, err = fillReservationSeriesResponse(ctx, tx, m)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	wakeTagFollowWorker()
+	for _, livestream := range series.Livestreams {
+		addLeaderboardMember(ctx, c.Logger(), leaderboardLivestreams, livestreamLeaderboardMember(livestream.ID))
+	}
+	return c.JSON(http.StatusCreated, series)
+}
+
+// 繰り返し予約の取得API
+// GET /api/livestream/reservation/series/:series_id
+func getSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var series ReservationSeries
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getOwnReservationSeries(ctx, tx, c, userID, false)
+		if err != nil {
+			return err
+		}
+		series, err = fillReservationSeriesResponse(ctx, tx, m)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+type PutSeriesRequest struct {
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	Tags         *[]int64 `json:"tags"`
+}
+
+// 繰り返し予約の変更API
+// PUT /api/livestream/reservation/series/:series_id
+// まだ始まっていない回のタイトルなどを変える (時間帯は変えられないので、変えたいときはキャンセルして予約し直す)
+func putSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PutSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var series ReservationSeries
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getOwnReservationSeries(ctx, tx, c, userID, true)
+		if err != nil {
+			return err
+		}
+		if m.CanceledAt != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "reservation series is already canceled")
+		}
+
+		upcoming, err := upcomingSeriesLivestreams(ctx, tx, m.ID)
+		if err != nil {
+			return err
+		}
+		for _, l := range upcoming {
+			if req.Title != nil {
+				l.Title = *req.Title
+			}
+			if req.Description != nil {
+				l.Description = *req.Description
+			}
+			if req.PlaylistUrl != nil {
+				l.PlaylistUrl = *req.PlaylistUrl
+			}
+			if req.ThumbnailUrl != nil {
+				l.ThumbnailUrl = *req.ThumbnailUrl
+			}
+			if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url WHERE id = :id", l); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error()).SetInternal(err)
+			}
+			if req.Tags != nil {
+				if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", l.ID); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error()).SetInternal(err)
+				}
+				for _, tagID := range *req.Tags {
+					if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", l.ID, tagID); err != nil {
+						return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error()).SetInternal(err)
+					}
+				}
+			}
+		}
+
+		series, err = fillReservationSeriesResponse(ctx, tx, m)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// 繰り返し予約のキャンセルAPI
+// DELETE /api/livestream/reservation/series/:series_id
+// まだ始まっていない回をまとめてキャンセルし、予約枠を戻す
+func cancelSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getOwnReservationSeries(ctx, tx, c, userID, true)
+		if err != nil {
+			return err
+		}
+		if m.CanceledAt != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "reservation series is already canceled")
+		}
+
+		upcoming, err := upcomingSeriesLivestreams(ctx, tx, m.ID)
+		if err != nil {
+			return err
+		}
+		for _, l := range upcoming {
+			if err := cancelLivestreamReservation(ctx, tx, l); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_series_livestreams WHERE livestream_id = ?", l.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reservation series livestream: "+err.Error()).SetInternal(err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_series SET canceled_at = ? WHERE id = ?", clock.Now().Unix(), m.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation series: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// 空いた枠をwaitlistに回す
+	select {
+	case waitlistWakeup <- struct{}{}:
+	default:
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getOwnReservationSeries(ctx context.Context, tx *sqlx.Tx, c echo.Context, userID int64, forUpdate bool) (ReservationSeriesModel, error) {
+	var m ReservationSeriesModel
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return m, echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+	query := "SELECT * FROM reservation_series WHERE id = ?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	if err := tx.GetContext(ctx, &m, query, seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return m, echo.NewHTTPError(http.StatusNotFound, "reservation series not found")
+		}
+		return m, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation series: "+err.Error()).SetInternal(err)
+	}
+	if m.UserID != userID {
+		return m, echo.NewHTTPError(http.StatusForbidden, "can't access other streamer's reservation series")
+	}
+	return m, nil
+}
+
+func upcomingSeriesLivestreams(ctx context.Context, tx *sqlx.Tx, seriesID int64) ([]LivestreamModel, error) {
+	var livestreams []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreams, `
+		SELECT l.* FROM livestreams l
+		INNER JOIN reservation_series_livestreams s ON s.livestream_id = l.id
+		WHERE s.series_id = ? AND l.start_at > ?
+		ORDER BY l.start_at
+		FOR UPDATE`, seriesID, clock.Now().Unix()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams of reservation series: "+err.Error()).SetInternal(err)
+	}
+	return livestreams, nil
+}
+
+func fillReservationSeriesResponse(ctx context.Context, tx *sqlx.Tx, m ReservationSeriesModel) (ReservationSeries, error) {
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, `
+		SELECT l.* FROM livestreams l
+		INNER JOIN reservation_series_livestreams s ON s.livestream_id = l.id
+		WHERE s.series_id = ?
+		ORDER BY s.occurrence`, m.ID); err != nil {
+		return ReservationSeries{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams of reservation series: "+err.Error()).SetInternal(err)
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, livestreamModels[i])
+		if err != nil {
+			return ReservationSeries{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+		}
+		livestreams[i] = livestream
+	}
+
+	return ReservationSeries{
+		ID:           m.ID,
+		IntervalDays: m.IntervalDays,
+		Occurrences:  m.Occurrences,
+		CanceledAt:   m.CanceledAt,
+		CreatedAt:    m.CreatedAt,
+		Livestreams:  livestreams,
+	}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	platformCutPercentEnvKey = "ISUCON13_PLATFORM_CUT_PERCENT"
+	revenueTierCutsEnvKey    = "ISUCON13_REVENUE_TIER_CUTS"
+
+	defaultRevenueTier = "default"
+
+	// 台帳に記帳する支払いの種類
+	paymentKindTip        = "tip"
+	paymentKindMembership = "membership"
+
+	auditActionRevenueTierUpdate = "user.revenue_tier_update"
+)
+
+// revenueSharePolicy はチップのうちプラットフォームが受け取る割合
+type revenueSharePolicy struct {
+	// 全配信者に適用する手数料率 (%)
+	PlatformCutPercent int64
+	// 配信者のティアごとの手数料率 (%) の上書き
+	TierCutPercents map[string]int64
+}
+
+var revenuePolicy = revenueSharePolicy{TierCutPercents: map[string]int64{}}
+
+// loadRevenueShareConfig は手数料率を環境変数から読み込む
+// ISUCON13_REVENUE_TIER_CUTS は "partner:10,premium:5" の形式
+func loadRevenueShareConfig() error {
+	if v, ok := os.LookupEnv(platformCutPercentEnvKey); ok {
+		p, err := parseCutPercent(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s': %w", platformCutPercentEnvKey, err)
+		}
+		revenuePolicy.PlatformCutPercent = p
+	}
+	if v, ok := os.LookupEnv(revenueTierCutsEnvKey); ok {
+		for _, item := range splitCommaList(v) {
+			tier, percent, ok := strings.Cut(item, ":")
+			if !ok || tier == "" {
+				return fmt.Errorf("failed to parse environment variable '%s': %q must be <tier>:<percent>", revenueTierCutsEnvKey, item)
+			}
+			p, err := parseCutPercent(percent)
+			if err != nil {
+				return fmt.Errorf("failed to parse environment variable '%s': %w", revenueTierCutsEnvKey, err)
+			}
+			revenuePolicy.TierCutPercents[tier] = p
+		}
+	}
+	return nil
+}
+
+func parseCutPercent(v string) (int64, error) {
+	p, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("cut percent must be integer between 0 and 100: %q", v)
+	}
+	return p, nil
+}
+
+// split はチップの額面を手数料と配信者の取り分に分ける (手数料は切り捨て)
+func (p revenueSharePolicy) split(tier string, gross int64) (fee, net, percent int64) {
+	percent = p.PlatformCutPercent
+	if override, ok := p.TierCutPercents[tier]; ok {
+		percent = override
+	}
+	fee = gross * percent / 100
+	return fee, gross - fee, percent
+}
+
+type PaymentLedgerEntryModel struct {
+	ID            int64  `db:"id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	StreamerID    int64  `db:"streamer_id"`
+	TipperID      int64  `db:"tipper_id"`
+	Tier          string `db:"tier"`
+	CutPercent    int64  `db:"cut_percent"`
+	Gross         int64  `db:"gross"`
+	PlatformFee   int64  `db:"platform_fee"`
+	Net           int64  `db:"net"`
+	CreatedAt     int64  `db:"created_at"`
+	Kind          string `db:"kind"`
+	MembershipID  int64  `db:"membership_id"`
+}
+
+func fetchRevenueTier(ctx context.Context, tx *sqlx.Tx, streamerID int64) (string, error) {
+	var tier string
+	if err := tx.GetContext(ctx, &tier, "SELECT tier FROM revenue_tiers WHERE user_id = ?", streamerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return defaultRevenueTier, nil
+		}
+		return "", err
+	}
+	return tier, nil
+}
+
+// insertPaymentLedgerEntry はチップ付きコメントの投稿と同じトランザクションで台帳に記帳する
+// 記帳時点の手数料率で計算し、後から率を変えても過去の記帳は変えない
+func insertPaymentLedgerEntry(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel, streamerID int64) error {
+	if livecommentModel.Tip <= 0 {
+		return nil
+	}
+
+	tier, err := fetchRevenueTier(ctx, tx, streamerID)
+	if err != nil {
+		return err
+	}
+	fee, net, percent := revenuePolicy.split(tier, livecommentModel.Tip)
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO payment_ledger (livecomment_id, livestream_id, streamer_id, tipper_id, tier, cut_percent, gross, platform_fee, net, created_at, kind)
+		VALUES (:livecomment_id, :livestream_id, :streamer_id, :tipper_id, :tier, :cut_percent, :gross, :platform_fee, :net, :created_at, :kind)`, PaymentLedgerEntryModel{
+		LivecommentID: livecommentModel.ID,
+		LivestreamID:  livecommentModel.LivestreamID,
+		StreamerID:    streamerID,
+		TipperID:      livecommentModel.UserID,
+		Tier:          tier,
+		CutPercent:    percent,
+		Gross:         livecommentModel.Tip,
+		PlatformFee:   fee,
+		Net:           net,
+		CreatedAt:     livecommentModel.CreatedAt,
+		Kind:          paymentKindTip,
+	})
+	return err
+}
+
+type PutRevenueTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+type RevenueTier struct {
+	Username   string `json:"username"`
+	Tier       string `json:"tier"`
+	CutPercent int64  `json:"cut_percent"`
+}
+
+// 配信者の手数料ティア設定API (管理者向け)
+// PUT /api/admin/revenue_tiers/:username
+func putRevenueTierHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var req PutRevenueTierRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Tier == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tier must not be empty")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	username := c.Param("username")
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var streamerID int64
+		if err := tx.GetContext(ctx, &streamerID, "SELECT id FROM users WHERE name = ? FOR UPDATE", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
+		currentTier, err := fetchRevenueTier(ctx, tx, streamerID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get revenue tier: "+err.Error()).SetInternal(err)
+		}
+
+		if req.Tier == defaultRevenueTier {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM revenue_tiers WHERE user_id = ?", streamerID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete revenue tier: "+err.Error()).SetInternal(err)
+			}
+		} else {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO revenue_tiers (user_id, tier, updated_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE tier = VALUES(tier), updated_at = VALUES(updated_at)", streamerID, req.Tier, clock.Now().Unix()); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update revenue tier: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		before := map[string]string{"username": username, "tier": currentTier}
+		after := map[string]string{"username": username, "tier": req.Tier}
+		if err := insertAuditLog(ctx, tx, userID, auditActionRevenueTierUpdate, auditTargetUser, streamerID, 0, before, after); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	_, _, percent := revenuePolicy.split(req.Tier, 0)
+	return c.JSON(http.StatusOK, RevenueTier{Username: username, Tier: req.Tier, CutPercent: percent})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	scheduleDateLayout = "2006-01-02"
+	// 一度に取得できる期間の上限
+	maxScheduleRange = 31 * 24 * time.Hour
+)
+
+type ScheduleDay struct {
+	// 配信開始日 (UTC)
+	Date        string       `json:"date"`
+	Livestreams []Livestream `json:"livestreams"`
+}
+
+type ScheduleResponse struct {
+	From int64         `json:"from"`
+	To   int64         `json:"to"`
+	Days []ScheduleDay `json:"days"`
+}
+
+// 配信予定カレンダー取得API
+// GET /api/schedule?from=<unix>&to=<unix>&tag=<name>
+// tag は複数指定可能で、いずれかのタグが付いた配信を返す
+func getScheduleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if to <= from {
+		return echo.NewHTTPError(http.StatusBadRequest, "to must be greater than from")
+	}
+	if time.Duration(to-from)*time.Second > maxScheduleRange {
+		return echo.NewHTTPError(http.StatusBadRequest, "schedule range must be within 31 days")
+	}
+
+	var tagNames []string
+	for _, v := range c.QueryParams()["tag"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				tagNames = append(tagNames, name)
+			}
+		}
+	}
+
+	q := newSelectQuery("SELECT * FROM livestreams").
+		Where("start_at >= ?", from).
+		Where("start_at < ?", to).
+		Where("visibility <> ?", livestreamVisibilityUnlisted).
+		OrderBy("start_at ASC, id ASC")
+	if len(tagNames) > 0 {
+		q.Where("id IN (SELECT lt.livestream_id FROM livestream_tags lt INNER JOIN tags t ON t.id = lt.tag_id WHERE t.name IN (?))", tagNames)
+	}
+	query, args := q.Build()
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error()).SetInternal(err)
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error()).SetInternal(err)
+	}
+
+	res := ScheduleResponse{From: from, To: to, Days: []ScheduleDay{}}
+	for _, livestream := range livestreams {
+		date := time.Unix(livestream.StartAt, 0).UTC().Format(scheduleDateLayout)
+		if len(res.Days) == 0 || res.Days[len(res.Days)-1].Date != date {
+			res.Days = append(res.Days, ScheduleDay{Date: date})
+		}
+		day := &res.Days[len(res.Days)-1]
+		day.Livestreams = append(day.Livestreams, livestream)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// fillLivestreamResponses は複数の配信について、配信者とタグをまとめて取得してレスポンスを組み立てる
+func fillLivestreamResponses(ctx context.Context, db sqlx.QueryerContext, livestreamModels []LivestreamModel) ([]Livestream, error) {
+	livestreams := make([]Livestream, 0, len(livestreamModels))
+	if len(livestreamModels) == 0 {
+		return livestreams, nil
+	}
+
+	livestreamIDs := make([]int64, len(livestreamModels))
+	userIDs := make([]int64, 0, len(livestreamModels))
+	for i, m := range livestreamModels {
+		livestreamIDs[i] = m.ID
+		userIDs = append(userIDs, m.UserID)
+	}
+
+	owners, err := fetchUsersByIDs(ctx, db, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := fetchTagsByLivestreamIDs(ctx, db, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range livestreamModels {
+		livestreamTags := tags[m.ID]
+		if livestreamTags == nil {
+			livestreamTags = []Tag{}
+		}
+		livestreams = append(livestreams, Livestream{
+			ID:           m.ID,
+			Owner:        owners[m.UserID],
+			Title:        m.Title,
+			Tags:         livestreamTags,
+			Description:  m.Description,
+			PlaylistUrl:  m.PlaylistUrl,
+			ThumbnailUrl: m.ThumbnailUrl,
+			StartAt:      m.StartAt,
+			EndAt:        m.EndAt,
+			ChannelID:    m.ChannelID,
+			Visibility:   responseVisibility(m),
+		})
+	}
+	return livestreams, nil
+}
+
+func fetchUsersByIDs(ctx context.Context, db sqlx.QueryerContext, userIDs []int64) (map[int64]User, error) {
+	var rows []struct {
+		ID          int64  `db:"id"`
+		Name        string `db:"name"`
+		DisplayName string `db:"display_name"`
+		Description string `db:"description"`
+		ThemeID     int64  `db:"theme_id"`
+		DarkMode    bool   `db:"dark_mode"`
+		Image       []byte `db:"image"`
+	}
+	query, args, err := sqlx.In(`
+		SELECT u.id, u.name, u.display_name, u.description, t.id AS theme_id, t.dark_mode, COALESCE(i.image, '') AS image
+		FROM users u
+		LEFT JOIN themes t ON u.id = t.user_id
+		LEFT JOIN icons i ON u.id = i.user_id
+		WHERE u.id IN (?)`, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, db, &rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	users := make(map[int64]User, len(rows))
+	for _, row := range rows {
+		iconHash, err := iconHashOf(row.Image)
+		if err != nil {
+			return nil, err
+		}
+		users[row.ID] = User{
+			ID:          row.ID,
+			Name:        row.Name,
+			DisplayName: row.DisplayName,
+			Description: row.Description,
+			Theme: Theme{
+				ID:       row.ThemeID,
+				DarkMode: row.DarkMode,
+			},
+			IconHash: iconHash,
+		}
+	}
+	return users, nil
+}
+
+func fetchTagsByLivestreamIDs(ctx context.Context, db sqlx.QueryerContext, livestreamIDs []int64) (map[int64][]Tag, error) {
+	var rows []struct {
+		LivestreamID int64  `db:"livestream_id"`
+		ID           int64  `db:"id"`
+		Name         string `db:"name"`
+	}
+	query, args, err := sqlx.In(`
+		SELECT lt.livestream_id, t.id, t.name
+		FROM livestream_tags lt
+		INNER JOIN tags t ON lt.tag_id = t.id
+		WHERE lt.livestream_id IN (?)
+		ORDER BY lt.id`, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, db, &rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[int64][]Tag, len(livestreamIDs))
+	for _, row := range rows {
+		tags[row.LivestreamID] = append(tags[row.LivestreamID], Tag{ID: row.ID, Name: row.Name})
+	}
+	return tags, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	schemaCheckEnvKey         = "ISUCON13_SCHEMA_CHECK"
+	schemaCheckManifestEnvKey = "ISUCON13_SCHEMA_MANIFEST"
+
+	schemaCheckOff    = "off"
+	schemaCheckWarn   = "warn"
+	schemaCheckStrict = "strict"
+
+	// init.sh と同じく、go ディレクトリから見た相対パス
+	defaultSchemaManifestPath = "../sql/initdb.d/10_schema.sql"
+	schemaCheckTimeout        = 10 * time.Second
+)
+
+// 起動時にスキーマ (テーブル・列・索引) が 10_schema.sql の通りになっているかを確かめる
+// 索引が1台だけ当たっていないと、エラーにならずにそのサーバだけ遅くなるので、起動時に気付けるようにする
+// warn (デフォルト) は足りないものをログに出すだけで、strict は足りなければ起動しない
+var (
+	schemaCheckMode    = schemaCheckWarn
+	schemaManifestPath = defaultSchemaManifestPath
+)
+
+func loadSchemaCheckConfig() error {
+	switch v := os.Getenv(schemaCheckEnvKey); v {
+	case "":
+	case schemaCheckOff, schemaCheckWarn, schemaCheckStrict:
+		schemaCheckMode = v
+	default:
+		return fmt.Errorf("unknown schema check mode '%s'", v)
+	}
+	if v, ok := os.LookupEnv(schemaCheckManifestEnvKey); ok && v != "" {
+		schemaManifestPath = v
+	}
+	return nil
+}
+
+// schemaObject は 10_schema.sql にある列・索引 (DDL は足りない場合に流せば直る文)
+type schemaObject struct {
+	Name string
+	Line int
+	DDL  string
+}
+
+type schemaTable struct {
+	Name    string
+	Line    int
+	Columns []schemaObject
+	Indexes []schemaObject
+}
+
+var (
+	schemaCreateTablePattern = regexp.MustCompile("^CREATE TABLE `([^`]+)`")
+	schemaColumnPattern      = regexp.MustCompile("^\\s*`([^`]+)`")
+	schemaIndexPattern       = regexp.MustCompile("^\\s*(?:UNIQUE|INDEX|FULLTEXT)(?: KEY| INDEX)? `([^`]+)`")
+	schemaPrimaryKeyPattern  = regexp.MustCompile(`PRIMARY KEY`)
+	schemaCreateIndexPattern = regexp.MustCompile("^CREATE (?:UNIQUE |FULLTEXT )?INDEX `?([^` ]+)`? ON `?([^` (]+)`?")
+)
+
+// parseSchemaManifest は 10_schema.sql からテーブルごとの列と索引を読む
+// 任意の SQL を解釈するのではなく、このファイルの書き方 (1行に1つの列・索引) だけを前提にしている
+func parseSchemaManifest(path string) ([]*schemaTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tables []*schemaTable
+	byName := map[string]*schemaTable{}
+	var current *schemaTable
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSuffix(strings.TrimSpace(sc.Text()), ",")
+		if current != nil {
+			if strings.HasPrefix(text, ")") {
+				current = nil
+				continue
+			}
+			if m := schemaColumnPattern.FindStringSubmatch(text); m != nil {
+				current.Columns = append(current.Columns, schemaObject{Name: m[1], Line: line, DDL: "ALTER TABLE `" + current.Name + "` ADD COLUMN " + text})
+				if schemaPrimaryKeyPattern.MatchString(text) {
+					current.Indexes = append(current.Indexes, schemaObject{Name: "PRIMARY", Line: line})
+				}
+				continue
+			}
+			if strings.HasPrefix(text, "PRIMARY KEY") {
+				current.Indexes = append(current.Indexes, schemaObject{Name: "PRIMARY", Line: line, DDL: "ALTER TABLE `" + current.Name + "` ADD " + text})
+				continue
+			}
+			if m := schemaIndexPattern.FindStringSubmatch(text); m != nil {
+				current.Indexes = append(current.Indexes, schemaObject{Name: m[1], Line: line, DDL: "ALTER TABLE `" + current.Name + "` ADD " + text})
+			}
+			continue
+		}
+		if m := schemaCreateTablePattern.FindStringSubmatch(text); m != nil {
+			current = &schemaTable{Name: m[1], Line: line}
+			tables = append(tables, current)
+			byName[current.Name] = current
+			continue
+		}
+		if m := schemaCreateIndexPattern.FindStringSubmatch(text); m != nil {
+			table, ok := byName[m[2]]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: index %s refers to unknown table %s", path, line, m[1], m[2])
+			}
+			table.Indexes = append(table.Indexes, schemaObject{Name: m[1], Line: line, DDL: strings.TrimSuffix(text, ";")})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// schemaDrift は DB に足りないもの1つ (Fix はそのまま流せば直る DDL。テーブルごと無い場合は空)
+type schemaDrift struct {
+	Message string
+	Fix     string
+}
+
+// detectSchemaDrift は manifest にあって DB に無いテーブル・列・索引を返す
+// DB にだけある列・索引 (実行時に作るシャードなど) は問題にしない
+func detectSchemaDrift(ctx context.Context, tables []*schemaTable) ([]schemaDrift, error) {
+	var columnRows []struct {
+		Table  string `db:"TABLE_NAME"`
+		Column string `db:"COLUMN_NAME"`
+	}
+	if err := dbConn.SelectContext(ctx, &columnRows, "SELECT TABLE_NAME, COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE()"); err != nil {
+		return nil, err
+	}
+	var indexRows []struct {
+		Table string `db:"TABLE_NAME"`
+		Index string `db:"INDEX_NAME"`
+	}
+	if err := dbConn.SelectContext(ctx, &indexRows, "SELECT DISTINCT TABLE_NAME, INDEX_NAME FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE()"); err != nil {
+		return nil, err
+	}
+	columns := map[string]map[string]struct{}{}
+	for _, r := range columnRows {
+		if columns[r.Table] == nil {
+			columns[r.Table] = map[string]struct{}{}
+		}
+		columns[r.Table][r.Column] = struct{}{}
+	}
+	indexes := map[string]struct{}{}
+	for _, r := range indexRows {
+		indexes[r.Table+"."+r.Index] = struct{}{}
+	}
+
+	var drifts []schemaDrift
+	for _, table := range tables {
+		existing, ok := columns[table.Name]
+		if !ok {
+			drifts = append(drifts, schemaDrift{Message: fmt.Sprintf("table %s is missing (CREATE TABLE at %s:%d)", table.Name, schemaManifestPath, table.Line)})
+			continue
+		}
+		for _, col := range table.Columns {
+			if _, ok := existing[col.Name]; !ok {
+				drifts = append(drifts, schemaDrift{Message: fmt.Sprintf("column %s.%s is missing (%s:%d)", table.Name, col.Name, schemaManifestPath, col.Line), Fix: col.DDL})
+			}
+		}
+		for _, idx := range table.Indexes {
+			key := table.Name + "." + idx.Name
+			if _, ok := indexes[key]; ok {
+				continue
+			}
+			drifts = append(drifts, schemaDrift{Message: fmt.Sprintf("index %s is missing (%s:%d)", key, schemaManifestPath, idx.Line), Fix: idx.DDL})
+		}
+	}
+	return drifts, nil
+}
+
+// runSchemaCheck は起動時のスキーマの確認で、strict で足りないものがあればエラーを返す
+func runSchemaCheck(ctx context.Context, logger echo.Logger) error {
+	if schemaCheckMode == schemaCheckOff {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, schemaCheckTimeout)
+	defer cancel()
+
+	tables, err := parseSchemaManifest(schemaManifestPath)
+	if err != nil {
+		if schemaCheckMode == schemaCheckStrict {
+			return fmt.Errorf("failed to read schema manifest: %w", err)
+		}
+		logger.Warnf("skipped schema check: failed to read schema manifest: %v", err)
+		return nil
+	}
+	drifts, err := detectSchemaDrift(ctx, tables)
+	if err != nil {
+		if schemaCheckMode == schemaCheckStrict {
+			return fmt.Errorf("failed to inspect schema: %w", err)
+		}
+		logger.Warnf("skipped schema check: failed to inspect schema: %v", err)
+		return nil
+	}
+
+	for _, d := range drifts {
+		if d.Fix != "" {
+			logger.Errorf("schema drift: %s; fix with: %s;", d.Message, d.Fix)
+		} else {
+			logger.Errorf("schema drift: %s", d.Message)
+		}
+	}
+	if len(drifts) > 0 && schemaCheckMode == schemaCheckStrict {
+		return fmt.Errorf("%d schema drift(s) found (set %s=%s to start anyway)", len(drifts), schemaCheckEnvKey, schemaCheckWarn)
+	}
+	return nil
+}
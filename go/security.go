@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	cookieDomainEnvKey   = "ISUCON13_COOKIE_DOMAIN"
+	cookieSecureEnvKey   = "ISUCON13_COOKIE_SECURE"
+	cookieSameSiteEnvKey = "ISUCON13_COOKIE_SAMESITE"
+	csrfEnabledEnvKey    = "ISUCON13_CSRF_ENABLED"
+
+	corsAllowedOriginsEnvKey   = "ISUCON13_CORS_ALLOWED_ORIGINS"
+	corsAllowedHeadersEnvKey   = "ISUCON13_CORS_ALLOWED_HEADERS"
+	corsAllowCredentialsEnvKey = "ISUCON13_CORS_ALLOW_CREDENTIALS"
+
+	defaultCookieDomain = "u.isucon.local"
+	sessionCookieMaxAge = 60000
+
+	csrfCookieName = "_csrf"
+)
+
+// cookieConfig はセッション/CSRFのCookieに付与する属性
+// デフォルトは ISUCON 環境 (u.isucon.local, Secure無し, SameSite未指定) に合わせてある
+type cookieConfig struct {
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+var cookieConf = cookieConfig{
+	Domain:   defaultCookieDomain,
+	SameSite: http.SameSiteDefaultMode,
+}
+
+// CSRF対策 (double submit cookie) を有効にするかどうか
+// ベンチマーカーはトークンを送らないので、デフォルトでは無効
+var csrfEnabled = false
+
+func loadCookieConfig() error {
+	if v, ok := os.LookupEnv(cookieDomainEnvKey); ok {
+		cookieConf.Domain = v
+	}
+	if v, ok := os.LookupEnv(cookieSecureEnvKey); ok {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		cookieConf.Secure = secure
+	}
+	if v, ok := os.LookupEnv(cookieSameSiteEnvKey); ok {
+		switch strings.ToLower(v) {
+		case "", "default":
+			cookieConf.SameSite = http.SameSiteDefaultMode
+		case "lax":
+			cookieConf.SameSite = http.SameSiteLaxMode
+		case "strict":
+			cookieConf.SameSite = http.SameSiteStrictMode
+		case "none":
+			cookieConf.SameSite = http.SameSiteNoneMode
+		default:
+			return fmt.Errorf("unknown SameSite mode: %s", v)
+		}
+	}
+	if v, ok := os.LookupEnv(csrfEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		csrfEnabled = enabled
+	}
+	return nil
+}
+
+func sessionCookieOptions() *sessions.Options {
+	return &sessions.Options{
+		Domain:   cookieConf.Domain,
+		MaxAge:   sessionCookieMaxAge,
+		Path:     "/",
+		Secure:   cookieConf.Secure,
+		HttpOnly: true,
+		SameSite: cookieConf.SameSite,
+	}
+}
+
+// csrfMiddleware は状態を変更するリクエスト (POST/PUT/PATCH/DELETE) に対して
+// Cookie `_csrf` と X-CSRF-Token ヘッダの一致を検証する
+// GET等では検証せず、トークンのCookieを発行するだけ
+func csrfMiddleware() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			if !csrfEnabled {
+				return true
+			}
+			// ベンチマーカーからの初期化と、内部API (トークンで認証する) は常に許可
+			return c.Path() == "/api/initialize" || strings.HasPrefix(c.Path(), "/api/internal/")
+		},
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken,
+		CookieName:     csrfCookieName,
+		CookieDomain:   cookieConf.Domain,
+		CookiePath:     "/",
+		CookieMaxAge:   sessionCookieMaxAge,
+		CookieSecure:   cookieConf.Secure,
+		CookieSameSite: cookieConf.SameSite,
+	})
+}
+
+// corsConfig は別オリジンのフロントエンドからAPIを呼ぶための設定
+// AllowedOrigins が空の場合はCORSヘッダを付与しない
+type corsConfig struct {
+	AllowedOrigins   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+var corsConf = corsConfig{
+	AllowedHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderXCSRFToken},
+}
+
+func splitCommaList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func loadCORSConfig() error {
+	if v, ok := os.LookupEnv(corsAllowedOriginsEnvKey); ok {
+		corsConf.AllowedOrigins = splitCommaList(v)
+	}
+	if v, ok := os.LookupEnv(corsAllowedHeadersEnvKey); ok {
+		corsConf.AllowedHeaders = splitCommaList(v)
+	}
+	if v, ok := os.LookupEnv(corsAllowCredentialsEnvKey); ok {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		corsConf.AllowCredentials = allow
+	}
+	// Cookieを送らせる場合にワイルドカードは使えない (ブラウザに拒否される)
+	if corsConf.AllowCredentials {
+		for _, origin := range corsConf.AllowedOrigins {
+			if origin == "*" {
+				return fmt.Errorf("%s=* cannot be combined with %s=true", corsAllowedOriginsEnvKey, corsAllowCredentialsEnvKey)
+			}
+		}
+	}
+	return nil
+}
+
+func corsMiddleware() echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		Skipper: func(c echo.Context) bool {
+			return len(corsConf.AllowedOrigins) == 0
+		},
+		AllowOrigins:     corsConf.AllowedOrigins,
+		AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowHeaders:     corsConf.AllowedHeaders,
+		AllowCredentials: corsConf.AllowCredentials,
+		MaxAge:           600,
+	})
+}
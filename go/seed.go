@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	echolog "github.com/labstack/gommon/log"
+)
+
+const (
+	// 1回の INSERT に載せる行数
+	seedInsertBatchSize = 1000
+	// 本文・絵文字の元にする既存の行数
+	seedSampleSize = 1000
+)
+
+// 既存データが無いときに使う本文・絵文字
+var (
+	seedFallbackComments = []string{"こんにちは！", "最高です", "ありがとう！", "待ってました", "楽しい配信ですね"}
+	seedFallbackEmojis   = []string{"innocent", "tada", "+1", "heart", "joy"}
+)
+
+// seedTips はチップの額と出やすさ (ほとんどのコメントはチップ無し)
+var seedTips = []struct {
+	Amount int64
+	Weight int
+}{
+	{0, 850},
+	{100, 80},
+	{500, 40},
+	{1000, 20},
+	{5000, 8},
+	{10000, 2},
+}
+
+type seedOptions struct {
+	Streams   int
+	Comments  int
+	Reactions int
+	// 同じ値なら同じデータになる
+	Seed int64
+}
+
+// runSeedCommand は `isupipe seed [flags]` としてローカルで性能を測るためのデータを入れる
+// 既存の配信 -streams 件に、コメント (チップ込み) とリアクションを直接 INSERT する
+// 配信・ユーザの人気には偏りを付ける (Zipf 分布)。ランキングなど派生データは作り直しを待つこと
+func runSeedCommand(args []string) int {
+	logger := echolog.New("seed")
+	logger.SetLevel(echolog.INFO)
+
+	var opts seedOptions
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fs.IntVar(&opts.Streams, "streams", 100, "number of livestreams to spread the data across")
+	fs.IntVar(&opts.Comments, "comments", 10000, "number of livecomments to insert")
+	fs.IntVar(&opts.Reactions, "reactions", 20000, "number of reactions to insert")
+	fs.Int64Var(&opts.Seed, "seed", time.Now().UnixNano(), "random seed")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.Streams < 1 || opts.Comments < 0 || opts.Reactions < 0 {
+		logger.Errorf("-streams must be positive and -comments/-reactions must not be negative")
+		return 2
+	}
+
+	conn, err := connectDB(logger)
+	if err != nil {
+		logger.Errorf("failed to connect db: %v", err)
+		return 1
+	}
+	defer conn.Close()
+	dbConn = conn
+
+	ctx := context.Background()
+	if err := loadLivecommentShardConfig(); err != nil {
+		logger.Errorf("failed to load livecomment shard config: %v", err)
+		return 1
+	}
+	if err := prepareLivecommentShards(ctx, false); err != nil {
+		logger.Errorf("failed to prepare livecomment shards: %v", err)
+		return 1
+	}
+	if err := loadColdStorageConfig(); err != nil {
+		logger.Errorf("failed to load cold storage config: %v", err)
+		return 1
+	}
+	if coldStorageEnabled {
+		if err := refreshColdLivestreams(ctx); err != nil {
+			logger.Errorf("failed to refresh cold livestreams: %v", err)
+			return 1
+		}
+	}
+	start := time.Now()
+	comments, reactions, err := seedLivestreamActivity(ctx, opts)
+	if err != nil {
+		logger.Errorf("failed to seed: %v", err)
+		return 1
+	}
+	logger.Infof("inserted %d livecomments and %d reactions across %d livestreams in %s (seed=%d)", comments, reactions, opts.Streams, time.Since(start).Round(time.Millisecond), opts.Seed)
+	return 0
+}
+
+type seedLivestream struct {
+	ID      int64 `db:"id"`
+	StartAt int64 `db:"start_at"`
+	EndAt   int64 `db:"end_at"`
+}
+
+func seedLivestreamActivity(ctx context.Context, opts seedOptions) (comments, reactions int, err error) {
+	rnd := rand.New(rand.NewSource(opts.Seed))
+
+	var livestreams []seedLivestream
+	if err := dbConn.SelectContext(ctx, &livestreams, "SELECT id, start_at, end_at FROM livestreams ORDER BY RAND(?) LIMIT ?", opts.Seed, opts.Streams); err != nil {
+		return 0, 0, err
+	}
+	if len(livestreams) == 0 {
+		return 0, 0, fmt.Errorf("no livestreams to seed")
+	}
+	var userIDs []int64
+	if err := dbConn.SelectContext(ctx, &userIDs, "SELECT id FROM users ORDER BY RAND(?)", opts.Seed); err != nil {
+		return 0, 0, err
+	}
+	if len(userIDs) == 0 {
+		return 0, 0, fmt.Errorf("no users to seed")
+	}
+
+	texts, err := seedSamples(ctx, "SELECT lc.comment FROM "+livecommentsAllTable()+" lc LIMIT ?", seedFallbackComments)
+	if err != nil {
+		return 0, 0, err
+	}
+	emojis, err := seedSamples(ctx, "SELECT DISTINCT r.emoji_name FROM "+reactionsAllTable()+" r LIMIT ?", seedFallbackEmojis)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// 先頭ほど選ばれやすい (一部の人気配信・常連ユーザに集中する)
+	pickLivestream := zipfPicker(rnd, len(livestreams))
+	pickUser := zipfPicker(rnd, len(userIDs))
+
+	commentRows := make([]LivecommentModel, 0, seedInsertBatchSize)
+	for i := 0; i < opts.Comments; i++ {
+		l := livestreams[pickLivestream()]
+		commentRows = append(commentRows, LivecommentModel{
+			UserID:       userIDs[pickUser()],
+			LivestreamID: l.ID,
+			Comment:      texts[rnd.Intn(len(texts))],
+			Tip:          seedTip(rnd),
+			CommentType:  livecommentTypeUser,
+			CreatedAt:    seedTimestamp(rnd, l),
+		})
+		if len(commentRows) == seedInsertBatchSize || i == opts.Comments-1 {
+			if err := withTx(ctx, func(tx *sqlx.Tx) error {
+				return insertLivecomments(ctx, tx, commentRows)
+			}); err != nil {
+				return comments, reactions, err
+			}
+			comments += len(commentRows)
+			commentRows = commentRows[:0]
+		}
+	}
+
+	reactionRows := make([]ReactionModel, 0, seedInsertBatchSize)
+	for i := 0; i < opts.Reactions; i++ {
+		l := livestreams[pickLivestream()]
+		reactionRows = append(reactionRows, ReactionModel{
+			UserID:       userIDs[pickUser()],
+			LivestreamID: l.ID,
+			EmojiName:    emojis[rnd.Intn(len(emojis))],
+			CreatedAt:    seedTimestamp(rnd, l),
+		})
+		if len(reactionRows) == seedInsertBatchSize || i == opts.Reactions-1 {
+			if err := withTx(ctx, func(tx *sqlx.Tx) error {
+				return insertReactions(ctx, tx, reactionRows)
+			}); err != nil {
+				return comments, reactions, err
+			}
+			reactions += len(reactionRows)
+			reactionRows = reactionRows[:0]
+		}
+	}
+	return comments, reactions, nil
+}
+
+func seedSamples(ctx context.Context, query string, fallback []string) ([]string, error) {
+	var samples []string
+	if err := dbConn.SelectContext(ctx, &samples, query, seedSampleSize); err != nil {
+		return nil, err
+	}
+	var nonEmpty []string
+	for _, s := range samples {
+		if strings.TrimSpace(s) != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return fallback, nil
+	}
+	return nonEmpty, nil
+}
+
+// zipfPicker は 0〜n-1 を Zipf 分布で選ぶ関数を返す
+func zipfPicker(rnd *rand.Rand, n int) func() int {
+	if n == 1 {
+		return func() int { return 0 }
+	}
+	z := rand.NewZipf(rnd, 1.1, 1, uint64(n-1))
+	return func() int { return int(z.Uint64()) }
+}
+
+func seedTip(rnd *rand.Rand) int64 {
+	total := 0
+	for _, t := range seedTips {
+		total += t.Weight
+	}
+	n := rnd.Intn(total)
+	for _, t := range seedTips {
+		if n < t.Weight {
+			return t.Amount
+		}
+		n -= t.Weight
+	}
+	return 0
+}
+
+// seedTimestamp は配信中のどこかの時刻を返す (盛り上がる後半ほど多くする)
+func seedTimestamp(rnd *rand.Rand, l seedLivestream) int64 {
+	if l.EndAt <= l.StartAt {
+		return l.StartAt
+	}
+	// 2つの一様乱数の大きい方を取ると、後ろに寄った分布になる
+	f := rnd.Float64()
+	if g := rnd.Float64(); g > f {
+		f = g
+	}
+	return l.StartAt + int64(f*float64(l.EndAt-l.StartAt))
+}
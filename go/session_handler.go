@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sessionSlidingSecondsEnvKey  = "ISUCON13_SESSION_SLIDING_SECONDS"
+	sessionTrackingEnabledEnvKey = "ISUCON13_SESSION_TRACKING_ENABLED"
+
+	// ログイン時のセッションの有効期間
+	sessionLifetime = 1 * time.Hour
+)
+
+var (
+	// 0 より大きければ、アクセスがあるたびに EXPIRES をこの期間だけ先に延ばす
+	// 毎回 Set-Cookie しないよう、残りが半分を切ったときだけ延長する
+	sessionSlidingWindow time.Duration
+	// ログイン中のセッションを user_sessions に記録し、一覧・失効できるようにするか
+	// リクエストごとにセッションの存在を確認するクエリが増えるので、デフォルトでは無効
+	sessionTrackingEnabled = false
+)
+
+func loadSessionConfig() error {
+	if v, ok := os.LookupEnv(sessionSlidingSecondsEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			return fmt.Errorf("failed to parse environment variable '%s' as non-negative integer: %s", sessionSlidingSecondsEnvKey, v)
+		}
+		sessionSlidingWindow = time.Duration(sec) * time.Second
+	}
+	if v, ok := os.LookupEnv(sessionTrackingEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", sessionTrackingEnabledEnvKey, err)
+		}
+		sessionTrackingEnabled = enabled
+	}
+	return nil
+}
+
+type UserSessionModel struct {
+	ID         string `db:"id"`
+	UserID     int64  `db:"user_id"`
+	UserAgent  string `db:"user_agent"`
+	IP         string `db:"ip"`
+	CreatedAt  int64  `db:"created_at"`
+	LastSeenAt int64  `db:"last_seen_at"`
+	ExpiresAt  int64  `db:"expires_at"`
+}
+
+type UserSession struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	// リクエストしたセッション自身か
+	Current bool `json:"current"`
+}
+
+// trackUserSession はログインしたセッションを記録する
+func trackUserSession(ctx context.Context, c echo.Context, sessionID string, userID int64, expiresAt int64) error {
+	if !sessionTrackingEnabled {
+		return nil
+	}
+	now := clock.Now().Unix()
+	_, err := dbConn.ExecContext(ctx, "INSERT INTO user_sessions (id, user_id, user_agent, ip, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)", sessionID, userID, c.Request().UserAgent(), clientIP(c), now, now, expiresAt)
+	return err
+}
+
+// verifyTrackedSession は失効させたセッションを拒否する
+func verifyTrackedSession(ctx context.Context, sess *sessions.Session) error {
+	if !sessionTrackingEnabled {
+		return nil
+	}
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+	var count int64
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM user_sessions WHERE id = ?", sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user session: "+err.Error()).SetInternal(err)
+	}
+	if count == 0 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "session has been revoked")
+	}
+	return nil
+}
+
+// slideSessionExpiry は有効期限の残りが少なくなっていれば延長する
+func slideSessionExpiry(c echo.Context, sess *sessions.Session, expires int64) error {
+	if sessionSlidingWindow <= 0 {
+		return nil
+	}
+	now := clock.Now()
+	if time.Unix(expires, 0).Sub(now) > sessionSlidingWindow/2 {
+		return nil
+	}
+
+	newExpires := now.Add(sessionSlidingWindow).Unix()
+	sess.Options = sessionCookieOptions()
+	sess.Values[defaultSessionExpiresKey] = newExpires
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error()).SetInternal(err)
+	}
+	if sessionTrackingEnabled {
+		sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+		if _, err := dbConn.ExecContext(c.Request().Context(), "UPDATE user_sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?", now.Unix(), newExpires, sessionID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user session: "+err.Error()).SetInternal(err)
+		}
+	}
+	return nil
+}
+
+// ログイン中のセッション一覧取得API
+// GET /api/user/me/sessions
+func getMySessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	if !sessionTrackingEnabled {
+		return echo.NewHTTPError(http.StatusNotFound, "session tracking is disabled")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	currentID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	var models []UserSessionModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM user_sessions WHERE user_id = ? AND expires_at >= ? ORDER BY last_seen_at DESC", userID, clock.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user sessions: "+err.Error()).SetInternal(err)
+	}
+
+	userSessions := make([]UserSession, len(models))
+	for i, m := range models {
+		userSessions[i] = UserSession{
+			ID:         m.ID,
+			UserAgent:  m.UserAgent,
+			IP:         m.IP,
+			CreatedAt:  m.CreatedAt,
+			LastSeenAt: m.LastSeenAt,
+			ExpiresAt:  m.ExpiresAt,
+			Current:    m.ID == currentID,
+		}
+	}
+	return c.JSON(http.StatusOK, userSessions)
+}
+
+// セッションの失効API (他の端末からのログアウト)
+// DELETE /api/user/me/sessions/:session_id
+func deleteMySessionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	if !sessionTrackingEnabled {
+		return echo.NewHTTPError(http.StatusNotFound, "session tracking is disabled")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM user_sessions WHERE id = ? AND user_id = ?", c.Param("session_id"), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user session: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
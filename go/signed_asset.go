@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	assetSigningKeyEnvKey = "ISUCON13_ASSET_SIGNING_KEY"
+
+	// 署名付きURLの有効期間の上限
+	maxSignedAssetTTL = 24 * time.Hour
+
+	signedAssetKindIcon = "icon"
+)
+
+// assetSigningKey は署名付きURLのHMAC鍵
+// 未設定ならセッションの鍵から導出する (複数台でも同じ鍵になるように)
+var assetSigningKey []byte
+
+func loadAssetSigningKey() {
+	if v, ok := os.LookupEnv(assetSigningKeyEnvKey); ok && v != "" {
+		assetSigningKey = []byte(v)
+		return
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("signed-asset"))
+	assetSigningKey = mac.Sum(nil)
+}
+
+// signedAssetResolver は署名付きURLで配信するアセットを取り出す
+// 見つからなければ sql.ErrNoRows を返す
+type signedAssetResolver func(ctx context.Context, id int64) (contentType string, body []byte, err error)
+
+var signedAssetResolvers = map[string]signedAssetResolver{}
+
+// registerSignedAsset は署名付きURLで配信するアセットの種類を登録する
+// 公開前のサムネイルやアーカイブ配信のアセットなど、Cookie なしで取得させたいものはここに足す
+func registerSignedAsset(kind string, resolve signedAssetResolver) {
+	signedAssetResolvers[kind] = resolve
+}
+
+func init() {
+	registerSignedAsset(signedAssetKindIcon, func(ctx context.Context, userID int64) (string, []byte, error) {
+		var image []byte
+		if err := dbConn.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", userID); err != nil {
+			return "", nil, err
+		}
+		return "image/jpeg", image, nil
+	})
+}
+
+func signAsset(kind string, id, expires int64) string {
+	mac := hmac.New(sha256.New, assetSigningKey)
+	mac.Write([]byte(kind + ":" + strconv.FormatInt(id, 10) + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signAssetURL は ttl の間だけ有効な署名付きURL (パス) を返す
+func signAssetURL(kind string, id int64, ttl time.Duration) string {
+	if ttl > maxSignedAssetTTL {
+		ttl = maxSignedAssetTTL
+	}
+	expires := clock.Now().Add(ttl).Unix()
+	q := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {signAsset(kind, id, expires)},
+	}
+	return "/api/assets/" + kind + "/" + strconv.FormatInt(id, 10) + "?" + q.Encode()
+}
+
+// 署名付きURLのアセット取得API
+// GET /api/assets/:kind/:id?expires=...&sig=...
+// セッションは見ず、署名と有効期限だけで認可する
+func getSignedAssetHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	kind := c.Param("kind")
+	resolve, ok := signedAssetResolvers[kind]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown asset kind")
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "id in path must be integer")
+	}
+	expires, err := strconv.ParseInt(c.QueryParam("expires"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires in query must be integer")
+	}
+
+	expected := signAsset(kind, id, expires)
+	if !hmac.Equal([]byte(expected), []byte(c.QueryParam("sig"))) {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid signature")
+	}
+	if clock.Now().Unix() > expires {
+		return echo.NewHTTPError(http.StatusForbidden, "signed url has expired")
+	}
+
+	contentType, body, err := resolve(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "asset not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get asset: "+err.Error()).SetInternal(err)
+	}
+
+	// URL ごとに期限が決まっているので、期限まではキャッシュしてよい
+	maxAge := expires - clock.Now().Unix()
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, max-age="+strconv.FormatInt(maxAge, 10))
+	return c.Blob(http.StatusOK, contentType, body)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	spamScoreEnabledEnvKey   = "ISUCON13_SPAM_SCORE_ENABLED"
+	spamScoreThresholdEnvKey = "ISUCON13_SPAM_SCORE_THRESHOLD"
+	spamScoreActionEnvKey    = "ISUCON13_SPAM_SCORE_ACTION"
+
+	// しきい値を超えたコメントの扱い
+	// shadow_hide は投稿者本人にだけ見せる。review は配信者が承認するまで投稿者本人にだけ見せる
+	spamActionShadowHide = "shadow_hide"
+	spamActionReview     = "review"
+
+	spamHoldStatusHidden   = "hidden"
+	spamHoldStatusPending  = "pending"
+	spamHoldStatusApproved = "approved"
+	spamHoldStatusRejected = "rejected"
+
+	auditActionSpamHoldApprove = "spam_hold.approve"
+	auditActionSpamHoldReject  = "spam_hold.reject"
+	auditTargetSpamHold        = "livecomment_spam_hold"
+
+	// 各シグナルの重み (合計 1)
+	spamWeightAccountAge = 0.2
+	spamWeightRate       = 0.3
+	spamWeightNGWord     = 0.3
+	spamWeightReports    = 0.2
+
+	// この期間に作られたアカウントは新しいとみなす
+	spamNewAccountAge    = 24 * time.Hour
+	spamRecentAccountAge = 7 * 24 * time.Hour
+	// 直近1分のコメント数がこれに達したら連投とみなす
+	spamRateWindow    = 1 * time.Minute
+	spamRateSaturated = 10
+	// 過去のコメントへの報告数がこれに達したら最大とみなす
+	spamReportsSaturated = 5
+)
+
+// コメントのスパムスコア
+// ベンチマーカーは投稿したコメントが一覧に出ることを検証するので、デフォルトでは無効
+var (
+	spamScoreEnabled   = false
+	spamScoreThreshold = 0.6
+	spamScoreAction    = spamActionReview
+)
+
+func loadSpamScoreConfig() error {
+	if v, ok := os.LookupEnv(spamScoreEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", spamScoreEnabledEnvKey, err)
+		}
+		spamScoreEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(spamScoreThresholdEnvKey); ok {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as float: %+v", spamScoreThresholdEnvKey, err)
+		}
+		spamScoreThreshold = threshold
+	}
+	if v, ok := os.LookupEnv(spamScoreActionEnvKey); ok {
+		switch v {
+		case spamActionShadowHide, spamActionReview:
+			spamScoreAction = v
+		default:
+			return fmt.Errorf("unknown spam score action '%s'", v)
+		}
+	}
+	return nil
+}
+
+// spamSignals はスコアの内訳 (それぞれ 0〜1)
+type spamSignals struct {
+	AccountAge float64 `json:"account_age"`
+	Rate       float64 `json:"rate"`
+	NGWord     float64 `json:"ng_word"`
+	Reports    float64 `json:"reports"`
+}
+
+func (s spamSignals) score() float64 {
+	return s.AccountAge*spamWeightAccountAge + s.Rate*spamWeightRate + s.NGWord*spamWeightNGWord + s.Reports*spamWeightReports
+}
+
+// computeSpamSignals は投稿しようとしているコメントのシグナルを集める
+// NGワードそのものを含むコメントはこれより前に弾いているので、ここでは表記揺れや1文字違いを見る
+func computeSpamSignals(ctx context.Context, tx *sqlx.Tx, userID int64, comment string, ngWords []string) (spamSignals, error) {
+	var signals spamSignals
+	now := clock.Now()
+
+	var createdAt int64
+	if err := tx.GetContext(ctx, &createdAt, "SELECT created_at FROM users WHERE id = ?", userID); err != nil {
+		return signals, err
+	}
+	// created_at が無い (0) の初期データは古いアカウントとして扱う
+	if createdAt > 0 {
+		switch age := now.Sub(time.Unix(createdAt, 0)); {
+		case age < spamNewAccountAge:
+			signals.AccountAge = 1
+		case age < spamRecentAccountAge:
+			signals.AccountAge = 0.5
+		}
+	}
+
+	var recent int64
+	if err := tx.GetContext(ctx, &recent, "SELECT COUNT(*) FROM "+livecommentsAllTable()+" lc WHERE lc.user_id = ? AND lc.created_at >= ?", userID, now.Add(-spamRateWindow).Unix()); err != nil {
+		return signals, err
+	}
+	signals.Rate = math.Min(float64(recent)/spamRateSaturated, 1)
+
+	signals.NGWord = ngWordProximity(comment, ngWords)
+
+	var reports int64
+	if err := tx.GetContext(ctx, &reports, `
+		SELECT COUNT(*) FROM livecomment_reports r
+		INNER JOIN `+livecommentsAllTable()+` l ON l.id = r.livecomment_id
+		WHERE l.user_id = ?`, userID); err != nil {
+		return signals, err
+	}
+	signals.Reports = math.Min(float64(reports)/spamReportsSaturated, 1)
+
+	return signals, nil
+}
+
+// normalizeForNGWord は記号や空白を挟んだり全角にしたりした表記を揃える
+func normalizeForNGWord(s string) []rune {
+	var rs []rune
+	for _, r := range strings.ToLower(norm.NFKC.String(s)) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// ngWordProximity はNGワードへの近さを返す
+// 表記を揃えると含む場合は 1、3文字以上の語と1文字違いの部分がある場合は 0.5
+func ngWordProximity(comment string, ngWords []string) float64 {
+	c := normalizeForNGWord(comment)
+	var proximity float64
+	for _, w := range ngWords {
+		word := normalizeForNGWord(w)
+		if len(word) == 0 {
+			continue
+		}
+		if strings.Contains(string(c), string(word)) {
+			return 1
+		}
+		if len(word) >= 3 && containsWithinOneEdit(c, word) {
+			proximity = 0.5
+		}
+	}
+	return proximity
+}
+
+// containsWithinOneEdit は s の部分列に w と編集距離1以内のものがあるかを返す
+func containsWithinOneEdit(s, w []rune) bool {
+	for _, n := range []int{len(w) - 1, len(w), len(w) + 1} {
+		for i := 0; i+n <= len(s); i++ {
+			if withinOneEdit(s[i:i+n], w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func withinOneEdit(a, b []rune) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > 1 {
+		return false
+	}
+	i, j, edits := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			i++
+			j++
+			continue
+		}
+		edits++
+		if edits > 1 {
+			return false
+		}
+		if len(a) == len(b) {
+			i++
+		}
+		j++
+	}
+	return edits+(len(b)-j)+(len(a)-i) <= 1
+}
+
+type LivecommentSpamHoldModel struct {
+	LivecommentID int64         `db:"livecomment_id"`
+	LivestreamID  int64         `db:"livestream_id"`
+	UserID        int64         `db:"user_id"`
+	Score         float64       `db:"score"`
+	Signals       string        `db:"signals"`
+	Status        string        `db:"status"`
+	CreatedAt     int64         `db:"created_at"`
+	ReviewedAt    sql.NullInt64 `db:"reviewed_at"`
+}
+
+type LivecommentSpamHold struct {
+	Livecomment Livecomment `json:"livecomment"`
+	Score       float64     `json:"score"`
+	Signals     spamSignals `json:"signals"`
+	Status      string      `json:"status"`
+	CreatedAt   int64       `json:"created_at"`
+	ReviewedAt  *int64      `json:"reviewed_at,omitempty"`
+}
+
+// holdSpamLivecomment はスコアがしきい値を超えたコメントを保留にする
+// 投稿自体は拒否しない (投稿者には普通に投稿できたように見せる)
+func holdSpamLivecomment(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel, signals spamSignals) error {
+	score := signals.score()
+	if score < spamScoreThreshold {
+		return nil
+	}
+
+	status := spamHoldStatusPending
+	if spamScoreAction == spamActionShadowHide {
+		status = spamHoldStatusHidden
+	}
+	encoded, err := json.Marshal(signals)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO livecomment_spam_holds (livecomment_id, livestream_id, user_id, score, signals, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		livecommentModel.ID, livecommentModel.LivestreamID, livecommentModel.UserID, score, string(encoded), status, livecommentModel.CreatedAt)
+	return err
+}
+
+// excludeHeldLivecomments は保留中のコメントを、投稿者本人以外の一覧から除く
+func excludeHeldLivecomments(q *selectQuery, livestreamID, viewerID int64) {
+	if !spamScoreEnabled {
+		return
+	}
+	q.Where("id NOT IN (SELECT livecomment_id FROM livecomment_spam_holds WHERE livestream_id = ? AND status != ? AND user_id != ?)", livestreamID, spamHoldStatusApproved, viewerID)
+}
+
+// 保留中コメント一覧API (配信者向け)
+// GET /api/livestream/:livestream_id/spam_holds
+func getLivecommentSpamHoldsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = spamHoldStatusPending
+	}
+	q := newSelectQuery("SELECT * FROM livecomment_spam_holds").
+		Where("livestream_id = ?", livestreamID).
+		Where("status = ?", status).
+		OrderBy("created_at DESC")
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	holds := []LivecommentSpamHold{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []LivecommentSpamHoldModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get spam holds: "+err.Error()).SetInternal(err)
+		}
+		for _, m := range models {
+			hold, err := fillLivecommentSpamHoldResponse(ctx, tx, m)
+			if errors.Is(err, sql.ErrNoRows) {
+				// 配信者が削除したコメント
+				continue
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill spam hold: "+err.Error()).SetInternal(err)
+			}
+			holds = append(holds, hold)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, holds)
+}
+
+// 保留中コメントの承認API (配信者向け)
+// POST /api/livestream/:livestream_id/spam_holds/:livecomment_id/approve
+func approveLivecommentSpamHoldHandler(c echo.Context) error {
+	return resolveLivecommentSpamHold(c, spamHoldStatusApproved)
+}
+
+// 保留中コメントの却下API (配信者向け)
+// POST /api/livestream/:livestream_id/spam_holds/:livecomment_id/reject
+// 却下したコメントは引き続き投稿者本人にだけ見える
+func rejectLivecommentSpamHoldHandler(c echo.Context) error {
+	return resolveLivecommentSpamHold(c, spamHoldStatusRejected)
+}
+
+func resolveLivecommentSpamHold(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var hold LivecommentSpamHold
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var m LivecommentSpamHoldModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM livecomment_spam_holds WHERE livecomment_id = ? AND livestream_id = ? FOR UPDATE", livecommentID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "spam hold not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get spam hold: "+err.Error()).SetInternal(err)
+		}
+
+		before := m
+		now := clock.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "UPDATE livecomment_spam_holds SET status = ?, reviewed_at = ? WHERE livecomment_id = ?", status, now, m.LivecommentID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update spam hold: "+err.Error()).SetInternal(err)
+		}
+		m.Status = status
+		m.ReviewedAt = sql.NullInt64{Int64: now, Valid: true}
+		action := auditActionSpamHoldApprove
+		if status == spamHoldStatusRejected {
+			action = auditActionSpamHoldReject
+		}
+		if err := insertAuditLog(ctx, tx, userID, action, auditTargetSpamHold, m.LivecommentID, int64(livestreamID), before, m); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		if status == spamHoldStatusRejected {
+			if err := resolveLivecommentReports(ctx, tx, int64(livestreamID), []int64{m.LivecommentID}); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to resolve livecomment reports: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		hold, err = fillLivecommentSpamHoldResponse(ctx, tx, m)
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill spam hold: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	// 保留中のコメントは投稿者にだけ見えているので、却下したら投稿者の表示からも外す
+	if status == spamHoldStatusRejected {
+		publishModerationEvent(ctx, c.Logger(), ModerationBroadcast{
+			Type:           moderationEventLivecommentsDeleted,
+			LivestreamID:   int64(livestreamID),
+			LivecommentIDs: []int64{int64(livecommentID)},
+			Reason:         moderationReasonSpam,
+			CreatedAt:      clock.Now().Unix(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, hold)
+}
+
+func fillLivecommentSpamHoldResponse(ctx context.Context, tx *sqlx.Tx, m LivecommentSpamHoldModel) (LivecommentSpamHold, error) {
+	livecommentModel, err := getLivecommentWithArchive(ctx, tx, m.LivestreamID, m.LivecommentID)
+	if err != nil {
+		return LivecommentSpamHold{}, err
+	}
+	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	if err != nil {
+		return LivecommentSpamHold{}, err
+	}
+
+	var signals spamSignals
+	if err := json.Unmarshal([]byte(m.Signals), &signals); err != nil {
+		return LivecommentSpamHold{}, err
+	}
+	hold := LivecommentSpamHold{
+		Livecomment: livecomment,
+		Score:       m.Score,
+		Signals:     signals,
+		Status:      m.Status,
+		CreatedAt:   m.CreatedAt,
+	}
+	if m.ReviewedAt.Valid {
+		hold.ReviewedAt = &m.ReviewedAt.Int64
+	}
+	return hold, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamKeyPrefix = "live_"
+
+	// 予約の開始前でも、この時間前からは配信を始められる (接続の確認用)
+	ingestEarlyPublishWindow = 15 * time.Minute
+
+	ingestCallPublish     = "publish"
+	ingestCallPublishDone = "publish_done"
+)
+
+type StreamKeyResponse struct {
+	// 発行した時にだけ返す (保存しているのはハッシュだけ)
+	StreamKey string `json:"stream_key"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// IngestAuthRequest はメディアサーバからの認証の問い合わせ
+// nginx-rtmp の on_publish / on_publish_done はフォームで name と call を送ってくるので、JSON とフォームのどちらでも受ける
+type IngestAuthRequest struct {
+	StreamKey string `json:"stream_key" form:"name"`
+	// publish (配信開始) か publish_done (配信終了)。省略したら publish
+	Call string `json:"call" form:"call"`
+}
+
+type IngestAuthResponse struct {
+	LivestreamID int64  `json:"livestream_id"`
+	Status       string `json:"status"`
+	StartAt      int64  `json:"start_at"`
+	EndAt        int64  `json:"end_at"`
+}
+
+func streamKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ストリームキーの発行API (配信者向け)
+// POST /api/livestream/:livestream_id/stream_key
+// それまでのキーは失効する
+func postStreamKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate stream key: "+err.Error()).SetInternal(err)
+	}
+	res := StreamKeyResponse{StreamKey: streamKeyPrefix + hex.EncodeToString(b), CreatedAt: clock.Now().Unix()}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE livestream_stream_keys SET revoked_at = ? WHERE livestream_id = ? AND revoked_at = 0", res.CreatedAt, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke stream keys: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_stream_keys (livestream_id, key_hash, created_at) VALUES (?, ?, ?)", livestreamID, streamKeyHash(res.StreamKey), res.CreatedAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert stream key: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, res)
+}
+
+// ストリームキーの失効API (配信者向け)
+// DELETE /api/livestream/:livestream_id/stream_key
+func deleteStreamKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE livestream_stream_keys SET revoked_at = ? WHERE livestream_id = ? AND revoked_at = 0", clock.Now().Unix(), livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke stream keys: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "stream key not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信の開始・終了時のストリームキーの検証API (メディアサーバ向け)
+// POST /api/internal/ingest/auth
+// 実際に配信を始めた・終えた時刻で start_at / end_at を詰める (予約した枠の外には広げない)
+func postIngestAuthHandler(c echo.Context) error {
+	return handleIngestCallback(c, "")
+}
+
+// handleIngestCallback はメディアサーバからの通知を処理する
+// call が空ならリクエストの call に従う
+func handleIngestCallback(c echo.Context, call string) error {
+	ctx := c.Request().Context()
+
+	var req IngestAuthRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body")
+	}
+	if req.StreamKey == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "stream key is required")
+	}
+	if call != "" {
+		req.Call = call
+	}
+	if req.Call == "" {
+		req.Call = ingestCallPublish
+	}
+	if req.Call != ingestCallPublish && req.Call != ingestCallPublishDone {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown call: "+req.Call)
+	}
+
+	var res IngestAuthResponse
+	var livestreamModel LivestreamModel
+	var statusChanged bool
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		statusChanged = false
+		var livestreamID int64
+		if err := tx.GetContext(ctx, &livestreamID, "SELECT livestream_id FROM livestream_stream_keys WHERE key_hash = ? AND revoked_at = 0", streamKeyHash(req.StreamKey)); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusForbidden, "invalid stream key")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get stream key: "+err.Error()).SetInternal(err)
+		}
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusForbidden, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+
+		// 予約した枠は最初に配信を始めたときに記録しておく (枠を戻すときに使う)
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livestream_broadcasts (livestream_id, reserved_start_at, reserved_end_at) VALUES (?, ?, ?)", livestreamModel.ID, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream broadcast: "+err.Error()).SetInternal(err)
+		}
+		reservedStartAt, reservedEndAt, err := reservedWindowOf(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream broadcast: "+err.Error()).SetInternal(err)
+		}
+
+		now := clock.Now().Unix()
+		startAt, endAt, status := livestreamModel.StartAt, livestreamModel.EndAt, livestreamStatusLive
+		switch req.Call {
+		case ingestCallPublish:
+			if now < reservedStartAt-int64(ingestEarlyPublishWindow/time.Second) || now >= reservedEndAt {
+				return echo.NewHTTPError(http.StatusForbidden, "the livestream is not reserved for now")
+			}
+			// 再接続では最初に始めた時刻を残す
+			if _, err := tx.ExecContext(ctx, "UPDATE livestream_broadcasts SET live_started_at = ?, live_ended_at = 0 WHERE livestream_id = ? AND live_started_at = 0", now, livestreamModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream broadcast: "+err.Error()).SetInternal(err)
+			}
+			if now > reservedStartAt && startAt == reservedStartAt {
+				startAt = now
+			}
+			endAt = reservedEndAt
+		case ingestCallPublishDone:
+			if _, err := tx.ExecContext(ctx, "UPDATE livestream_broadcasts SET live_ended_at = ? WHERE livestream_id = ?", now, livestreamModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream broadcast: "+err.Error()).SetInternal(err)
+			}
+			if now > startAt && now < reservedEndAt {
+				endAt = now
+			}
+			status = livestreamStatusEnded
+		}
+
+		statusChanged = status != livestreamModel.Status
+		if startAt != livestreamModel.StartAt || endAt != livestreamModel.EndAt || statusChanged {
+			if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET start_at = ?, end_at = ?, status = ? WHERE id = ?", startAt, endAt, status, livestreamModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error()).SetInternal(err)
+			}
+		}
+		livestreamModel.StartAt, livestreamModel.EndAt, livestreamModel.Status = startAt, endAt, status
+		res = IngestAuthResponse{LivestreamID: livestreamModel.ID, Status: status, StartAt: startAt, EndAt: endAt}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if statusChanged {
+		onLivestreamStatusChanged(ctx, c.Logger(), livestreamModel)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// reservedWindowOf は配信の予約した枠を返す (配信を始めて start_at / end_at を詰めていても、予約時の値を返す)
+func reservedWindowOf(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (int64, int64, error) {
+	var reserved struct {
+		StartAt int64 `db:"reserved_start_at"`
+		EndAt   int64 `db:"reserved_end_at"`
+	}
+	if err := tx.GetContext(ctx, &reserved, "SELECT reserved_start_at, reserved_end_at FROM livestream_broadcasts WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return livestreamModel.StartAt, livestreamModel.EndAt, nil
+		}
+		return 0, 0, err
+	}
+	return reserved.StartAt, reserved.EndAt, nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	mailerEnvKey                = "ISUCON13_MAILER"
+	mailerAPIURLEnvKey          = "ISUCON13_MAILER_API_URL"
+	streamerDigestEnabledEnvKey = "ISUCON13_STREAMER_DIGEST_ENABLED"
+
+	mailerNoop = "noop"
+	mailerHTTP = "http"
+
+	mailerAPITimeout = 5 * time.Second
+
+	streamerDigestWorkerInterval = 1 * time.Hour
+	streamerDigestBatchSize      = 100
+	streamerDigestTopComments    = 3
+
+	streamerDigestStatusSending = "sending"
+	streamerDigestStatusSent    = "sent"
+)
+
+// Mail は送信するメール (本文はプレーンテキスト)
+type Mail struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Mailer はユーザにメールを送る
+type Mailer interface {
+	Name() string
+	Send(ctx context.Context, mail Mail) error
+}
+
+// noopMailer は何も送らない (デフォルト)
+type noopMailer struct{}
+
+func (noopMailer) Name() string { return mailerNoop }
+
+func (noopMailer) Send(context.Context, Mail) error { return nil }
+
+// httpMailer は外部の送信APIに Mail を JSON で POST する
+type httpMailer struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpMailer) Name() string { return mailerHTTP }
+
+func (h *httpMailer) Send(ctx context.Context, mail Mail) error {
+	body, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	return getCircuitBreaker(circuitMailer).Do(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := h.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("mailer api returned status %d", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+var mailer Mailer = noopMailer{}
+
+func loadMailerConfig() error {
+	switch v := os.Getenv(mailerEnvKey); v {
+	case "", mailerNoop:
+		mailer = noopMailer{}
+	case mailerHTTP:
+		url, ok := os.LookupEnv(mailerAPIURLEnvKey)
+		if !ok || url == "" {
+			return fmt.Errorf("environment variable '%s' must be provided when '%s' is %s", mailerAPIURLEnvKey, mailerEnvKey, mailerHTTP)
+		}
+		mailer = &httpMailer{url: url, client: &http.Client{Timeout: mailerAPITimeout}}
+	default:
+		return fmt.Errorf("unknown mailer '%s'", v)
+	}
+	return nil
+}
+
+// 配信者向けの週次ダイジェストメール
+// メールアドレスを登録している配信者全員の集計を毎週流すので、デフォルトでは無効
+var streamerDigestEnabled = false
+
+func loadStreamerDigestConfig() error {
+	if v, ok := os.LookupEnv(streamerDigestEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", streamerDigestEnabledEnvKey, err)
+		}
+		streamerDigestEnabled = enabled
+	}
+	return nil
+}
+
+type StreamerDigestSettings struct {
+	Enabled bool `json:"enabled"`
+}
+
+type streamerDigestRecipient struct {
+	UserID      int64  `db:"id"`
+	DisplayName string `db:"display_name"`
+	Email       string `db:"email"`
+}
+
+type streamerDigestComment struct {
+	DisplayName string `db:"display_name"`
+	Comment     string `db:"comment"`
+	Tip         int64  `db:"tip"`
+}
+
+// streamerDigest は配信者1人の1週間分の集計
+// フォロー機能は無いので、新しいフォロワーの代わりに新しいメンバーシップの加入者を数える
+type streamerDigest struct {
+	WeekStart   time.Time
+	NewMembers  int64
+	Tips        int64
+	TipEarnings int64
+	Livestreams int
+	Reactions   int64
+	TopComments []streamerDigestComment
+}
+
+// digestWeekStart は t を含む週の始まり (UTC の月曜 0 時) を返す
+func digestWeekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// runStreamerDigestWorker は1時間ごとに、前の週のダイジェストを未送信の配信者に送る
+// 送信記録を見るので、再起動やワーカーが複数あっても同じ週に二重には送らない
+func runStreamerDigestWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(streamerDigestWorkerInterval)
+	defer ticker.Stop()
+	for {
+		weekStart := digestWeekStart(clock.Now()).AddDate(0, 0, -7)
+		if err := sendStreamerDigests(ctx, logger, weekStart); err != nil {
+			logger.Warnf("failed to send streamer digests: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendStreamerDigests(ctx context.Context, logger echo.Logger, weekStart time.Time) error {
+	// 送信に失敗した配信者は次の tick まで回さない
+	var lastUserID int64
+	for {
+		var recipients []streamerDigestRecipient
+		if err := dbConn.SelectContext(ctx, &recipients, `
+			SELECT u.id, u.display_name, u.email
+			FROM users u
+			LEFT JOIN streamer_digest_settings s ON s.user_id = u.id
+			LEFT JOIN streamer_digest_sends d ON d.user_id = u.id AND d.week_start = ?
+			WHERE u.id > ? AND u.email IS NOT NULL AND COALESCE(s.enabled, TRUE) AND d.user_id IS NULL
+			  AND EXISTS (SELECT 1 FROM livestreams l WHERE l.user_id = u.id)
+			ORDER BY u.id
+			LIMIT ?`, weekStart.Unix(), lastUserID, streamerDigestBatchSize); err != nil {
+			return err
+		}
+		if len(recipients) == 0 {
+			return nil
+		}
+
+		for _, r := range recipients {
+			if err := sendStreamerDigest(ctx, r, weekStart); err != nil {
+				logger.Warnf("failed to send streamer digest to user %d: %v", r.UserID, err)
+			}
+			lastUserID = r.UserID
+		}
+	}
+}
+
+// sendStreamerDigest は送信記録を取ってから1通送る
+// 他のワーカーが先に記録を取っていたら送らない
+// 送信に失敗したら記録を消して次の tick で送り直す (送信後に落ちた場合は送り直さない)
+func sendStreamerDigest(ctx context.Context, r streamerDigestRecipient, weekStart time.Time) error {
+	rs, err := dbConn.ExecContext(ctx, "INSERT IGNORE INTO streamer_digest_sends (user_id, week_start, status, created_at) VALUES (?, ?, ?, ?)", r.UserID, weekStart.Unix(), streamerDigestStatusSending, clock.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := rs.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	digest, err := buildStreamerDigest(ctx, r.UserID, weekStart)
+	if err == nil {
+		err = mailer.Send(ctx, renderStreamerDigest(r, digest))
+	}
+	if err != nil {
+		if _, derr := dbConn.ExecContext(ctx, "DELETE FROM streamer_digest_sends WHERE user_id = ? AND week_start = ?", r.UserID, weekStart.Unix()); derr != nil {
+			return errors.Join(err, derr)
+		}
+		return err
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE streamer_digest_sends SET status = ?, sent_at = ? WHERE user_id = ? AND week_start = ?", streamerDigestStatusSent, clock.Now().Unix(), r.UserID, weekStart.Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// buildStreamerDigest は weekStart からの1週間の集計を作る
+// リアクション数は週の間に始まった配信についてカウンタから引く
+func buildStreamerDigest(ctx context.Context, userID int64, weekStart time.Time) (streamerDigest, error) {
+	from, to := weekStart.Unix(), weekStart.AddDate(0, 0, 7).Unix()
+	digest := streamerDigest{WeekStart: weekStart}
+
+	if err := dbConn.GetContext(ctx, &digest.NewMembers, "SELECT COUNT(*) FROM channel_memberships WHERE owner_id = ? AND started_at >= ? AND started_at < ?", userID, from, to); err != nil {
+		return streamerDigest{}, err
+	}
+
+	var tips struct {
+		Count    int64 `db:"count"`
+		Earnings int64 `db:"earnings"`
+	}
+	if err := dbConn.GetContext(ctx, &tips, "SELECT COUNT(*) AS count, IFNULL(SUM(net), 0) AS earnings FROM payment_ledger WHERE streamer_id = ? AND kind = 'tip' AND created_at >= ? AND created_at < ?", userID, from, to); err != nil {
+		return streamerDigest{}, err
+	}
+	digest.Tips, digest.TipEarnings = tips.Count, tips.Earnings
+
+	var livestreamIDs []int64
+	if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams WHERE user_id = ? AND start_at >= ? AND start_at < ?", userID, from, to); err != nil {
+		return streamerDigest{}, err
+	}
+	digest.Livestreams = len(livestreamIDs)
+	for _, id := range livestreamIDs {
+		n, err := livestreamReactionsCounter.Get(ctx, id)
+		if err != nil {
+			return streamerDigest{}, err
+		}
+		digest.Reactions += n
+	}
+
+	if err := dbConn.SelectContext(ctx, &digest.TopComments, `
+		SELECT u.display_name, lc.comment, lc.tip
+		FROM `+livecommentsAllTable()+` lc
+		INNER JOIN livestreams l ON l.id = lc.livestream_id
+		INNER JOIN users u ON u.id = lc.user_id
+		WHERE l.user_id = ? AND lc.tip > 0 AND lc.created_at >= ? AND lc.created_at < ?
+		ORDER BY lc.tip DESC, lc.created_at
+		LIMIT ?`, userID, from, to, streamerDigestTopComments); err != nil {
+		return streamerDigest{}, err
+	}
+	return digest, nil
+}
+
+func renderStreamerDigest(r streamerDigestRecipient, d streamerDigest) Mail {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s さん\n\n", r.DisplayName)
+	fmt.Fprintf(&b, "%s からの1週間のまとめです。\n\n", d.WeekStart.Format("2006-01-02"))
+	fmt.Fprintf(&b, "新しいメンバー: %d 人\n", d.NewMembers)
+	fmt.Fprintf(&b, "チップ: %d 件 (収益 %d)\n", d.Tips, d.TipEarnings)
+	fmt.Fprintf(&b, "配信: %d 本 (リアクション %d 件)\n", d.Livestreams, d.Reactions)
+	if len(d.TopComments) > 0 {
+		b.WriteString("\nチップの多かったコメント:\n")
+		for _, c := range d.TopComments {
+			fmt.Fprintf(&b, "- %s (%d): %s\n", c.DisplayName, c.Tip, c.Comment)
+		}
+	}
+	b.WriteString("\nこのメールが不要な場合は、設定から週次ダイジェストを無効にしてください。\n")
+	return Mail{
+		To:      r.Email,
+		Subject: "今週の配信のまとめ",
+		Body:    b.String(),
+	}
+}
+
+// 週次ダイジェストの設定取得API
+// GET /api/user/me/streamer_digest_settings
+func getStreamerDigestSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	settings := StreamerDigestSettings{Enabled: true}
+	if err := dbConn.GetContext(ctx, &settings.Enabled, "SELECT enabled FROM streamer_digest_settings WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get streamer digest settings: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// 週次ダイジェストの設定更新API
+// PUT /api/user/me/streamer_digest_settings
+func putStreamerDigestSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req StreamerDigestSettings
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO streamer_digest_settings (user_id, enabled, updated_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE enabled = VALUES(enabled), updated_at = VALUES(updated_at)", userID, req.Enabled, clock.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update streamer digest settings: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, req)
+}
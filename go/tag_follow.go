@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	tagFollowNotificationsEnabledEnvKey = "ISUCON13_TAG_FOLLOW_NOTIFICATIONS_ENABLED"
+
+	notificationKindTagLivestream = "tag.livestream_reserved"
+	notificationKindTagDigest     = "tag.digest"
+
+	tagFollowModeInstant = "instant"
+	tagFollowModeDigest  = "digest"
+
+	tagFollowWorkerInterval    = 10 * time.Second
+	tagFollowWorkerBatchSize   = 100
+	tagFollowDigestInterval    = 1 * time.Hour
+	webhookTimeout             = 3 * time.Second
+	maxTagFollowDigestsPerTick = 1000
+)
+
+// フォロー中のタグで配信が予約されたときの通知
+// 予約のたびにジョブを積むので、デフォルトでは無効
+var (
+	tagFollowNotificationsEnabled = false
+	tagFollowWakeup               = make(chan struct{}, 1)
+	webhookClient                 = &http.Client{Timeout: webhookTimeout}
+)
+
+func loadTagFollowConfig() error {
+	if v, ok := os.LookupEnv(tagFollowNotificationsEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", tagFollowNotificationsEnabledEnvKey, err)
+		}
+		tagFollowNotificationsEnabled = enabled
+	}
+	return nil
+}
+
+type TagFollowSettingsModel struct {
+	UserID     int64          `db:"user_id"`
+	Mode       string         `db:"mode"`
+	WebhookURL sql.NullString `db:"webhook_url"`
+}
+
+type TagFollows struct {
+	Mode       string `json:"mode"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+	Tags       []Tag  `json:"tags"`
+}
+
+type PutTagFollowSettingsRequest struct {
+	Mode       string `json:"mode"`
+	WebhookURL string `json:"webhook_url"`
+}
+
+// tagLivestreamPayload は通知と webhook の本文
+type tagLivestreamPayload struct {
+	LivestreamID int64  `json:"livestream_id"`
+	Title        string `json:"title"`
+	StartAt      int64  `json:"start_at"`
+	TagID        int64  `json:"tag_id"`
+	TagName      string `json:"tag_name"`
+}
+
+// enqueueTagFollowJob は予約された配信をタグのフォロワーへの通知ジョブに積む
+// 予約と同じトランザクションで呼ぶ
+func enqueueTagFollowJob(ctx context.Context, tx *sqlx.Tx, livestreamID int64) error {
+	if !tagFollowNotificationsEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO tag_follow_jobs (livestream_id, created_at) VALUES (?, ?)", livestreamID, clock.Now().Unix())
+	return err
+}
+
+// wakeTagFollowWorker は通知ワーカーを起こす (コミット後に呼ぶ)
+func wakeTagFollowWorker() {
+	if !tagFollowNotificationsEnabled {
+		return
+	}
+	select {
+	case tagFollowWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runTagFollowWorker はジョブを処理し、まとめて通知するユーザには1時間ごとにダイジェストを送る
+func runTagFollowWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(tagFollowWorkerInterval)
+	defer ticker.Stop()
+	lastDigestAt := clock.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-tagFollowWakeup:
+		}
+		if err := processTagFollowJobs(ctx, logger); err != nil {
+			logger.Warnf("failed to process tag follow jobs: %v", err)
+		}
+		if clock.Now().Sub(lastDigestAt) >= tagFollowDigestInterval {
+			if err := flushTagFollowDigests(ctx, logger); err != nil {
+				logger.Warnf("failed to flush tag follow digests: %v", err)
+				continue
+			}
+			lastDigestAt = clock.Now()
+		}
+	}
+}
+
+type tagFollowMatch struct {
+	UserID     int64          `db:"user_id"`
+	Mode       string         `db:"mode"`
+	WebhookURL sql.NullString `db:"webhook_url"`
+	TagID      int64          `db:"tag_id"`
+	TagName    string         `db:"tag_name"`
+}
+
+func processTagFollowJobs(ctx context.Context, logger echo.Logger) error {
+	var jobIDs []int64
+	if err := dbConn.SelectContext(ctx, &jobIDs, "SELECT id FROM tag_follow_jobs ORDER BY id LIMIT ?", tagFollowWorkerBatchSize); err != nil {
+		return err
+	}
+
+	for _, jobID := range jobIDs {
+		type webhook struct {
+			url     string
+			payload tagLivestreamPayload
+		}
+		var webhooks []webhook
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			var livestreamID int64
+			if err := tx.GetContext(ctx, &livestreamID, "SELECT livestream_id FROM tag_follow_jobs WHERE id = ? FOR UPDATE SKIP LOCKED", jobID); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					// 他のワーカーが処理中
+					return nil
+				}
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM tag_follow_jobs WHERE id = ?", jobID); err != nil {
+				return err
+			}
+
+			var livestream LivestreamModel
+			if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					// 処理前にキャンセルされた
+					return nil
+				}
+				return err
+			}
+			if livestream.Visibility != livestreamVisibilityPublic {
+				return nil
+			}
+
+			// 配信者本人には通知しない。複数のタグが一致しても1ユーザ1通
+			var matches []tagFollowMatch
+			if err := tx.SelectContext(ctx, &matches, `
+				SELECT f.user_id, COALESCE(s.mode, ?) AS mode, s.webhook_url, t.id AS tag_id, t.name AS tag_name
+				FROM tag_follows f
+				INNER JOIN livestream_tags lt ON lt.tag_id = f.tag_id
+				INNER JOIN tags t ON t.id = f.tag_id
+				LEFT JOIN tag_follow_settings s ON s.user_id = f.user_id
+				WHERE lt.livestream_id = ? AND f.user_id <> ?
+				ORDER BY f.user_id, t.id`, tagFollowModeInstant, livestreamID, livestream.UserID); err != nil {
+				return err
+			}
+
+			var lastUserID int64
+			for _, m := range matches {
+				if m.UserID == lastUserID {
+					continue
+				}
+				lastUserID = m.UserID
+
+				if m.Mode == tagFollowModeDigest {
+					if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO tag_follow_digests (user_id, livestream_id, tag_id, created_at) VALUES (?, ?, ?, ?)", m.UserID, livestreamID, m.TagID, clock.Now().Unix()); err != nil {
+						return err
+					}
+					continue
+				}
+				payload := tagLivestreamPayload{
+					LivestreamID: livestream.ID,
+					Title:        livestream.Title,
+					StartAt:      livestream.StartAt,
+					TagID:        m.TagID,
+					TagName:      m.TagName,
+				}
+				if err := insertNotification(ctx, tx, m.UserID, notificationKindTagLivestream, payload); err != nil {
+					return err
+				}
+				if m.WebhookURL.Valid {
+					webhooks = append(webhooks, webhook{url: m.WebhookURL.String, payload: payload})
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// webhook は通知を書き込んだ後に送る (失敗しても再送はしない)
+		for _, w := range webhooks {
+			if err := postWebhook(ctx, w.url, notificationKindTagLivestream, w.payload); err != nil {
+				logger.Warnf("failed to post tag follow webhook: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+type tagDigestRow struct {
+	UserID       int64          `db:"user_id"`
+	WebhookURL   sql.NullString `db:"webhook_url"`
+	LivestreamID int64          `db:"livestream_id"`
+	Title        string         `db:"title"`
+	StartAt      int64          `db:"start_at"`
+	TagID        int64          `db:"tag_id"`
+	TagName      string         `db:"tag_name"`
+}
+
+// flushTagFollowDigests は溜まった一致をユーザごとに1通の通知にまとめる
+func flushTagFollowDigests(ctx context.Context, logger echo.Logger) error {
+	type digest struct {
+		userID     int64
+		webhookURL sql.NullString
+		items      []tagLivestreamPayload
+	}
+	var digests []*digest
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var rows []tagDigestRow
+		if err := tx.SelectContext(ctx, &rows, `
+			SELECT d.user_id, s.webhook_url, l.id AS livestream_id, l.title, l.start_at, t.id AS tag_id, t.name AS tag_name
+			FROM tag_follow_digests d
+			INNER JOIN livestreams l ON l.id = d.livestream_id
+			INNER JOIN tags t ON t.id = d.tag_id
+			LEFT JOIN tag_follow_settings s ON s.user_id = d.user_id
+			ORDER BY d.user_id, l.start_at
+			LIMIT ?
+			FOR UPDATE`, maxTagFollowDigestsPerTick); err != nil {
+			return err
+		}
+
+		var current *digest
+		for _, r := range rows {
+			if current == nil || current.userID != r.UserID {
+				current = &digest{userID: r.UserID, webhookURL: r.WebhookURL}
+				digests = append(digests, current)
+			}
+			current.items = append(current.items, tagLivestreamPayload{
+				LivestreamID: r.LivestreamID,
+				Title:        r.Title,
+				StartAt:      r.StartAt,
+				TagID:        r.TagID,
+				TagName:      r.TagName,
+			})
+			if _, err := tx.ExecContext(ctx, "DELETE FROM tag_follow_digests WHERE user_id = ? AND livestream_id = ?", r.UserID, r.LivestreamID); err != nil {
+				return err
+			}
+		}
+		for _, d := range digests {
+			if err := insertNotification(ctx, tx, d.userID, notificationKindTagDigest, d.items); err != nil {
+				return err
+			}
+		}
+		// キャンセルされた配信の一致は捨てる
+		_, err := tx.ExecContext(ctx, "DELETE d FROM tag_follow_digests d LEFT JOIN livestreams l ON l.id = d.livestream_id WHERE l.id IS NULL")
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for _, d := range digests {
+		if !d.webhookURL.Valid {
+			continue
+		}
+		if err := postWebhook(ctx, d.webhookURL.String, notificationKindTagDigest, d.items); err != nil {
+			logger.Warnf("failed to post tag follow webhook: %v", err)
+		}
+	}
+	return nil
+}
+
+// postWebhook は {kind, payload} を JSON で webhookURL に送る (送り先ごとに遮断する)
+func postWebhook(ctx context.Context, webhookURL, kind string, payload interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"kind": kind, "payload": payload})
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return err
+	}
+	return getCircuitBreaker(circuitWebhookPrefix + u.Host).Do(func() error {
+		return deliverWebhook(ctx, webhookURL, body)
+	})
+}
+
+func deliverWebhook(ctx context.Context, webhookURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// フォロー中のタグ一覧API
+// GET /api/user/me/tag_follows
+func getTagFollowsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	follows := TagFollows{Mode: tagFollowModeInstant, Tags: []Tag{}}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var settings TagFollowSettingsModel
+		if err := tx.GetContext(ctx, &settings, "SELECT * FROM tag_follow_settings WHERE user_id = ?", userID); err == nil {
+			follows.Mode = settings.Mode
+			follows.WebhookURL = settings.WebhookURL.String
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag follow settings: "+err.Error()).SetInternal(err)
+		}
+
+		var tags []TagModel
+		if err := tx.SelectContext(ctx, &tags, "SELECT t.* FROM tags t INNER JOIN tag_follows f ON f.tag_id = t.id WHERE f.user_id = ? ORDER BY t.id", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get followed tags: "+err.Error()).SetInternal(err)
+		}
+		for _, t := range tags {
+			follows.Tags = append(follows.Tags, Tag{ID: t.ID, Name: t.Name})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, follows)
+}
+
+// タグのフォローAPI
+// PUT /api/user/me/tag_follows/:tag_id
+// 同義語のタグは正規のタグをフォローする
+func followTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var tag Tag
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		resolver, err := loadTagResolver(ctx, tx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error()).SetInternal(err)
+		}
+		var m TagModel
+		if err := tx.GetContext(ctx, &m, "SELECT * FROM tags WHERE id = ?", resolver.canonicalID(tagID)); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "tag not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO tag_follows (user_id, tag_id, created_at) VALUES (?, ?, ?)", userID, m.ID, clock.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag follow: "+err.Error()).SetInternal(err)
+		}
+		tag = Tag{ID: m.ID, Name: m.Name}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグのフォロー解除API
+// DELETE /api/user/me/tag_follows/:tag_id
+func unfollowTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM tag_follows WHERE user_id = ? AND tag_id = ?", userID, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag follow: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "tag follow not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// タグのフォロー通知の設定API
+// PUT /api/user/me/tag_follow_settings
+func putTagFollowSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PutTagFollowSettingsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Mode != tagFollowModeInstant && req.Mode != tagFollowModeDigest {
+		return echo.NewHTTPError(http.StatusBadRequest, "mode must be instant or digest")
+	}
+	webhookURL := sql.NullString{String: req.WebhookURL, Valid: req.WebhookURL != ""}
+	if webhookURL.Valid {
+		u, err := url.Parse(req.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "webhook_url must be http(s) url")
+		}
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO tag_follow_settings (user_id, mode, webhook_url) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE mode = VALUES(mode), webhook_url = VALUES(webhook_url)", userID, req.Mode, webhookURL); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag follow settings: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, PutTagFollowSettingsRequest{Mode: req.Mode, WebhookURL: req.WebhookURL})
+}
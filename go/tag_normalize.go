@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeTagName はタグ名を照合用に正規化する
+// NFKC で全角英数・半角カナなどの幅を揃え、大文字小文字を畳み、空白を詰める
+func normalizeTagName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(norm.NFKC.String(name))), " ")
+}
+
+const (
+	auditActionTagSynonymUpdate = "tag_synonym.update"
+	auditActionTagSynonymDelete = "tag_synonym.delete"
+	// alias は文字列なので target_id には寄せ先のタグIDを入れる
+	auditTargetTagSynonym = "tag_synonym"
+)
+
+type TagSynonymModel struct {
+	Alias string `db:"alias"`
+	TagID int64  `db:"tag_id"`
+}
+
+// tagResolver はタグ名・タグIDを正規のタグに寄せる
+// 同義語 (tag_synonyms) の alias は正規化済みの名前
+type tagResolver struct {
+	byNormalized map[string][]int64
+	synonyms     map[string]int64
+	canonical    map[int64]int64
+}
+
+func loadTagResolver(ctx context.Context, tx *sqlx.Tx) (*tagResolver, error) {
+	var tags []TagModel
+	if err := tx.SelectContext(ctx, &tags, "SELECT * FROM tags"); err != nil {
+		return nil, err
+	}
+	var synonyms []TagSynonymModel
+	if err := tx.SelectContext(ctx, &synonyms, "SELECT alias, tag_id FROM tag_synonyms"); err != nil {
+		return nil, err
+	}
+
+	r := &tagResolver{
+		byNormalized: make(map[string][]int64, len(tags)),
+		synonyms:     make(map[string]int64, len(synonyms)),
+		canonical:    make(map[int64]int64, len(tags)),
+	}
+	for _, s := range synonyms {
+		r.synonyms[s.Alias] = s.TagID
+	}
+	for _, t := range tags {
+		normalized := normalizeTagName(t.Name)
+		r.byNormalized[normalized] = append(r.byNormalized[normalized], t.ID)
+		if target, ok := r.synonyms[normalized]; ok {
+			r.canonical[t.ID] = target
+		} else {
+			r.canonical[t.ID] = t.ID
+		}
+	}
+	return r, nil
+}
+
+// canonicalID はタグIDを同義語の正規のタグIDにする (同義語が無ければそのまま)
+func (r *tagResolver) canonicalID(tagID int64) int64 {
+	if id, ok := r.canonical[tagID]; ok {
+		return id
+	}
+	return tagID
+}
+
+// canonicalIDs は配信に付けるタグを正規のタグに寄せ、重複を除く
+func (r *tagResolver) canonicalIDs(tagIDs []int64) []int64 {
+	seen := make(map[int64]struct{}, len(tagIDs))
+	ids := make([]int64, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		id := r.canonicalID(tagID)
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// searchIDs はタグ名の検索で対象にするタグIDを返す
+// 寄せる前に付けられた配信も引けるよう、同じ正規のタグに寄るタグを全て含める
+func (r *tagResolver) searchIDs(name string) []int64 {
+	normalized := normalizeTagName(name)
+	targets := map[int64]struct{}{}
+	if id, ok := r.synonyms[normalized]; ok {
+		targets[id] = struct{}{}
+	} else {
+		for _, id := range r.byNormalized[normalized] {
+			targets[r.canonicalID(id)] = struct{}{}
+		}
+	}
+
+	var ids []int64
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	for tagID, canonicalID := range r.canonical {
+		if _, ok := targets[canonicalID]; ok && tagID != canonicalID {
+			ids = append(ids, tagID)
+		}
+	}
+	return ids
+}
+
+type PutTagSynonymRequest struct {
+	TagID int64 `json:"tag_id"`
+}
+
+type TagSynonym struct {
+	Alias string `json:"alias"`
+	Tag   Tag    `json:"tag"`
+}
+
+// タグの同義語一覧API (管理者向け)
+// GET /api/admin/tag_synonyms
+func getTagSynonymsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var synonyms []TagSynonym
+	rows, err := dbConn.QueryxContext(ctx, "SELECT s.alias, t.id, t.name FROM tag_synonyms s INNER JOIN tags t ON t.id = s.tag_id ORDER BY s.alias")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag synonyms: "+err.Error()).SetInternal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s TagSynonym
+		if err := rows.Scan(&s.Alias, &s.Tag.ID, &s.Tag.Name); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan tag synonym: "+err.Error()).SetInternal(err)
+		}
+		synonyms = append(synonyms, s)
+	}
+	if err := rows.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag synonyms: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, synonyms)
+}
+
+// タグの同義語登録API (管理者向け)
+// PUT /api/admin/tag_synonyms/:alias
+// alias は正規化して保存する ("ゲーム" を "game" のタグに寄せる、など)
+func putTagSynonymHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var req PutTagSynonymRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	alias := normalizeTagName(c.Param("alias"))
+	if alias == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "alias must not be empty")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var synonym TagSynonym
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var tag TagModel
+		if err := tx.GetContext(ctx, &tag, "SELECT * FROM tags WHERE id = ?", req.TagID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "tag not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error()).SetInternal(err)
+		}
+		if normalizeTagName(tag.Name) == alias {
+			return echo.NewHTTPError(http.StatusBadRequest, "alias must differ from the tag name")
+		}
+		var before *TagSynonymModel
+		var current TagSynonymModel
+		if err := tx.GetContext(ctx, &current, "SELECT alias, tag_id FROM tag_synonyms WHERE alias = ? FOR UPDATE", alias); err == nil {
+			before = &current
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag synonym: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tag_synonyms (alias, tag_id) VALUES (?, ?) ON DUPLICATE KEY UPDATE tag_id = VALUES(tag_id)", alias, tag.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag synonym: "+err.Error()).SetInternal(err)
+		}
+		after := TagSynonymModel{Alias: alias, TagID: tag.ID}
+		if err := insertAuditLog(ctx, tx, userID, auditActionTagSynonymUpdate, auditTargetTagSynonym, tag.ID, 0, before, after); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		synonym = TagSynonym{Alias: alias, Tag: Tag{ID: tag.ID, Name: tag.Name}}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, synonym)
+}
+
+// タグの同義語削除API (管理者向け)
+// DELETE /api/admin/tag_synonyms/:alias
+func deleteTagSynonymHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	alias := normalizeTagName(c.Param("alias"))
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var synonym TagSynonymModel
+		if err := tx.GetContext(ctx, &synonym, "SELECT alias, tag_id FROM tag_synonyms WHERE alias = ? FOR UPDATE", alias); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "tag synonym not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag synonym: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tag_synonyms WHERE alias = ?", alias); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag synonym: "+err.Error()).SetInternal(err)
+		}
+		if err := insertAuditLog(ctx, tx, userID, auditActionTagSynonymDelete, auditTargetTagSynonym, synonym.TagID, 0, synonym, nil); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert audit log: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
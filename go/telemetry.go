@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 1リクエストで送れるイベント数
+	telemetryMaxBatchSize = 100
+	// 書き込み待ちに積めるイベント数 (超えた分は捨てる)
+	telemetryQueueSize = 10000
+	// まとめて INSERT する件数と間隔
+	telemetryFlushSize     = 500
+	telemetryFlushInterval = 1 * time.Second
+	// クライアントの時計がずれていても受け付ける範囲
+	telemetryMaxClockSkew = 24 * time.Hour
+
+	telemetryEventPageView        = "page_view"
+	telemetryEventPlayerBuffering = "player_buffering"
+	telemetryEventPlayerError     = "player_error"
+)
+
+// telemetryPropertyKind はプロパティの値の型
+type telemetryPropertyKind int
+
+const (
+	telemetryString telemetryPropertyKind = iota
+	telemetryNumber
+)
+
+type telemetryProperty struct {
+	Kind     telemetryPropertyKind
+	Required bool
+}
+
+type telemetrySchema struct {
+	// livestream_id が必須かどうか
+	RequiresLivestream bool
+	Properties         map[string]telemetryProperty
+}
+
+// イベントの種類ごとのスキーマ (ここに無い種類・プロパティは受け付けない)
+var telemetrySchemas = map[string]telemetrySchema{
+	telemetryEventPageView: {
+		Properties: map[string]telemetryProperty{
+			"path":     {Kind: telemetryString, Required: true},
+			"referrer": {Kind: telemetryString},
+		},
+	},
+	telemetryEventPlayerBuffering: {
+		RequiresLivestream: true,
+		Properties: map[string]telemetryProperty{
+			"duration_ms": {Kind: telemetryNumber, Required: true},
+			"position":    {Kind: telemetryNumber},
+		},
+	},
+	telemetryEventPlayerError: {
+		RequiresLivestream: true,
+		Properties: map[string]telemetryProperty{
+			"code":    {Kind: telemetryString, Required: true},
+			"message": {Kind: telemetryString},
+		},
+	},
+}
+
+type PostTelemetryRequest struct {
+	Events []TelemetryEventRequest `json:"events"`
+}
+
+type TelemetryEventRequest struct {
+	Type         string                 `json:"type"`
+	LivestreamID *int64                 `json:"livestream_id"`
+	OccurredAt   int64                  `json:"occurred_at"`
+	Properties   map[string]interface{} `json:"properties"`
+}
+
+type PostTelemetryResponse struct {
+	Accepted int `json:"accepted"`
+	// 書き込みが追いつかずに捨てた数
+	Dropped int `json:"dropped"`
+}
+
+type analyticsEventRow struct {
+	UserID       *int64
+	EventType    string
+	LivestreamID *int64
+	Properties   string
+	OccurredAt   int64
+	ReceivedAt   int64
+}
+
+var (
+	telemetryQueue   = make(chan analyticsEventRow, telemetryQueueSize)
+	telemetryDropped atomic.Int64
+)
+
+// validate はスキーマに合っているかを確認する
+func (e TelemetryEventRequest) validate(now time.Time) error {
+	schema, ok := telemetrySchemas[e.Type]
+	if !ok {
+		return fmt.Errorf("unknown event type '%s'", e.Type)
+	}
+	if schema.RequiresLivestream && e.LivestreamID == nil {
+		return fmt.Errorf("%s requires livestream_id", e.Type)
+	}
+	skew := time.Unix(e.OccurredAt, 0).Sub(now)
+	if e.OccurredAt <= 0 || skew > telemetryMaxClockSkew || skew < -telemetryMaxClockSkew {
+		return fmt.Errorf("occurred_at is out of range")
+	}
+	for key, prop := range schema.Properties {
+		v, ok := e.Properties[key]
+		if !ok {
+			if prop.Required {
+				return fmt.Errorf("%s requires property '%s'", e.Type, key)
+			}
+			continue
+		}
+		switch prop.Kind {
+		case telemetryString:
+			if _, ok := v.(string); !ok {
+				return fmt.Errorf("property '%s' must be string", key)
+			}
+		case telemetryNumber:
+			if _, ok := v.(float64); !ok {
+				return fmt.Errorf("property '%s' must be number", key)
+			}
+		}
+	}
+	for key := range e.Properties {
+		if _, ok := schema.Properties[key]; !ok {
+			return fmt.Errorf("unknown property '%s' for %s", key, e.Type)
+		}
+	}
+	return nil
+}
+
+// クライアントの計測イベント送信API
+// POST /api/events
+// ログインしていなくても送れる。書き込みは非同期なので 202 を返す
+func postTelemetryHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	var req PostTelemetryRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.Events) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "events must not be empty")
+	}
+	if len(req.Events) > telemetryMaxBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("events must be at most %d", telemetryMaxBatchSize))
+	}
+
+	now := clock.Now()
+	rows := make([]analyticsEventRow, len(req.Events))
+	for i, ev := range req.Events {
+		if err := ev.validate(now); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("events[%d]: %s", i, err.Error()))
+		}
+		if ev.Properties == nil {
+			ev.Properties = map[string]interface{}{}
+		}
+		properties, err := json.Marshal(ev.Properties)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to encode properties: "+err.Error())
+		}
+		rows[i] = analyticsEventRow{
+			EventType:    ev.Type,
+			LivestreamID: ev.LivestreamID,
+			Properties:   string(properties),
+			OccurredAt:   ev.OccurredAt,
+			ReceivedAt:   now.Unix(),
+		}
+	}
+
+	if err := verifyUserSession(c); err == nil {
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+		for i := range rows {
+			rows[i].UserID = &userID
+		}
+	}
+
+	var res PostTelemetryResponse
+	for _, row := range rows {
+		select {
+		case telemetryQueue <- row:
+			res.Accepted++
+		default:
+			res.Dropped++
+		}
+	}
+	if res.Dropped > 0 {
+		telemetryDropped.Add(int64(res.Dropped))
+	}
+
+	return c.JSON(http.StatusAccepted, res)
+}
+
+// runTelemetryWriter は積まれたイベントをまとめて書く
+func runTelemetryWriter(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(telemetryFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]analyticsEventRow, 0, telemetryFlushSize)
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := insertAnalyticsEvents(ctx, batch); err != nil {
+			logger.Warnf("failed to insert %d analytics events: %v", len(batch), err)
+		}
+		batch = batch[:0]
+		if n := telemetryDropped.Swap(0); n > 0 {
+			logger.Warnf("dropped %d analytics events because the queue was full", n)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// 残りは止まる前に書いておく
+			for {
+				select {
+				case row := <-telemetryQueue:
+					batch = append(batch, row)
+					if len(batch) >= telemetryFlushSize {
+						flush(context.Background())
+					}
+				default:
+					flush(context.Background())
+					return
+				}
+			}
+		case row := <-telemetryQueue:
+			batch = append(batch, row)
+			if len(batch) >= telemetryFlushSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+func insertAnalyticsEvents(ctx context.Context, rows []analyticsEventRow) error {
+	placeholders := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*6)
+	for i, row := range rows {
+		placeholders[i] = "(?, ?, ?, ?, ?, ?)"
+		args = append(args, row.UserID, row.EventType, row.LivestreamID, row.Properties, row.OccurredAt, row.ReceivedAt)
+	}
+	_, err := dbConn.ExecContext(ctx, "INSERT INTO analytics_events (user_id, event_type, livestream_id, properties, occurred_at, received_at) VALUES "+strings.Join(placeholders, ", "), args...)
+	return err
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	toxicityEnabledEnvKey    = "ISUCON13_TOXICITY_ENABLED"
+	toxicityClassifierEnvKey = "ISUCON13_TOXICITY_CLASSIFIER"
+	toxicityThresholdEnvKey  = "ISUCON13_TOXICITY_THRESHOLD"
+	toxicityKeywordsEnvKey   = "ISUCON13_TOXICITY_KEYWORDS"
+	toxicityAPIURLEnvKey     = "ISUCON13_TOXICITY_API_URL"
+
+	toxicityClassifierKeyword = "keyword"
+	toxicityClassifierHTTP    = "http"
+
+	toxicityWorkerInterval    = 5 * time.Second
+	toxicityWorkerBatchSize   = 100
+	toxicityWorkerConcurrency = 4
+	toxicityAPITimeout        = 3 * time.Second
+	// 1件の採点の上限 (サーキットブレーカーの待ちも含む)
+	toxicityScoreTimeout = 5 * time.Second
+	// 採点に失敗したコメントは toxicityRetryInterval * 失敗回数 だけ空けて再試行し、この回数で諦める
+	toxicityMaxAttempts    = 5
+	toxicityRetryInterval  = 30 * time.Second
+	maxToxicityErrorLength = 255
+
+	// 自動で作られた報告の source
+	livecommentReportSourceUser     = "user"
+	livecommentReportSourceToxicity = "toxicity"
+)
+
+// ライブコメントの有害度スコアリング
+// ベンチマーカーは報告数を検証するので、デフォルトでは無効
+var (
+	toxicityEnabled    = false
+	toxicityThreshold  = 0.8
+	toxicityClassifier livecommentClassifier
+	toxicityWakeup     = make(chan struct{}, 1)
+)
+
+// デフォルトのキーワード判定で使う語
+var defaultToxicityKeywords = []string{"死ね", "殺す", "消えろ", "きもい", "うざい"}
+
+// livecommentClassifier はコメントの有害度を 0〜1 で返す
+type livecommentClassifier interface {
+	Name() string
+	Score(ctx context.Context, comment string) (float64, error)
+}
+
+// keywordClassifier はキーワードを含むかどうかで採点する
+// 1語含めば 0.5、2語以上なら 1
+type keywordClassifier struct {
+	keywords []string
+}
+
+func (k *keywordClassifier) Name() string { return toxicityClassifierKeyword }
+
+func (k *keywordClassifier) Score(_ context.Context, comment string) (float64, error) {
+	var hits int
+	for _, w := range k.keywords {
+		if strings.Contains(comment, w) {
+			hits++
+		}
+	}
+	if hits >= 2 {
+		return 1, nil
+	}
+	return float64(hits) * 0.5, nil
+}
+
+// httpClassifier は外部の推論APIに採点を任せる
+// POST {"text": "..."} に対して {"score": 0.xx} が返ってくる想定
+type httpClassifier struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpClassifier) Name() string { return toxicityClassifierHTTP }
+
+func (h *httpClassifier) Score(ctx context.Context, comment string) (float64, error) {
+	var score float64
+	err := getCircuitBreaker(circuitToxicity).Do(func() error {
+		var err error
+		score, err = h.score(ctx, comment)
+		return err
+	})
+	return score, err
+}
+
+func (h *httpClassifier) score(ctx context.Context, comment string) (float64, error) {
+	body, err := json.Marshal(map[string]string{"text": comment})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("toxicity api returned status %d", resp.StatusCode)
+	}
+	var res struct {
+		Score float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, err
+	}
+	return res.Score, nil
+}
+
+func loadToxicityConfig() error {
+	if v, ok := os.LookupEnv(toxicityEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", toxicityEnabledEnvKey, err)
+		}
+		toxicityEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(toxicityThresholdEnvKey); ok {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as float: %+v", toxicityThresholdEnvKey, err)
+		}
+		toxicityThreshold = threshold
+	}
+
+	switch v := os.Getenv(toxicityClassifierEnvKey); v {
+	case "", toxicityClassifierKeyword:
+		keywords := defaultToxicityKeywords
+		if v, ok := os.LookupEnv(toxicityKeywordsEnvKey); ok {
+			keywords = splitCommaList(v)
+		}
+		toxicityClassifier = &keywordClassifier{keywords: keywords}
+	case toxicityClassifierHTTP:
+		url, ok := os.LookupEnv(toxicityAPIURLEnvKey)
+		if !ok || url == "" {
+			return fmt.Errorf("environment variable '%s' must be provided when '%s' is %s", toxicityAPIURLEnvKey, toxicityClassifierEnvKey, toxicityClassifierHTTP)
+		}
+		toxicityClassifier = &httpClassifier{url: url, client: &http.Client{Timeout: toxicityAPITimeout}}
+	default:
+		return fmt.Errorf("unknown toxicity classifier '%s'", v)
+	}
+	return nil
+}
+
+// enqueueToxicityScoring はコメントを採点待ちに積む
+// 投稿と同じトランザクションで呼ぶこと
+func enqueueToxicityScoring(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) error {
+	if !toxicityEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO livecomment_toxicity_scores (livecomment_id, livestream_id, created_at) VALUES (?, ?, ?)", livecommentModel.ID, livecommentModel.LivestreamID, livecommentModel.CreatedAt)
+	return err
+}
+
+// wakeToxicityWorker は採点ワーカーを起こす (コミット後に呼ぶ)
+func wakeToxicityWorker() {
+	if !toxicityEnabled {
+		return
+	}
+	select {
+	case toxicityWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runToxicityWorker は採点待ちのコメントを採点し続ける
+func runToxicityWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(toxicityWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-toxicityWakeup:
+		}
+		if err := scorePendingLivecomments(ctx, logger); err != nil {
+			logger.Warnf("failed to score livecomments: %v", err)
+		}
+	}
+}
+
+type pendingToxicityScore struct {
+	LivecommentID int64  `db:"livecomment_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	Comment       string `db:"comment"`
+	OwnerID       int64  `db:"owner_id"`
+}
+
+// scorePendingLivecomments は採点待ちを1バッチ取り、toxicityWorkerConcurrency 件ずつ並行に採点する
+// 1件の採点は toxicityScoreTimeout で打ち切り、遅いコメントや失敗し続けるコメントが後ろを詰まらせないようにする
+func scorePendingLivecomments(ctx context.Context, logger echo.Logger) error {
+	var pendings []pendingToxicityScore
+	if err := dbConn.SelectContext(ctx, &pendings, `
+		SELECT s.livecomment_id, s.livestream_id, lc.comment, l.user_id AS owner_id
+		FROM livecomment_toxicity_scores s
+		INNER JOIN `+livecommentsAllTable()+` lc ON lc.id = s.livecomment_id AND lc.livestream_id = s.livestream_id
+		INNER JOIN livestreams l ON l.id = s.livestream_id
+		WHERE s.scored_at IS NULL AND s.failed_at IS NULL AND s.next_attempt_at <= ?
+		ORDER BY s.created_at
+		LIMIT ?`, clock.Now().Unix(), toxicityWorkerBatchSize); err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, toxicityWorkerConcurrency)
+	for _, p := range pendings {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(p pendingToxicityScore) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := scorePendingLivecomment(ctx, logger, p); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// scorePendingLivecomment は1件採点して結果を書き込む
+// 採点に失敗したら間隔を空けて再試行し、toxicityMaxAttempts 回失敗したら failed_at を付けて諦める
+func scorePendingLivecomment(ctx context.Context, logger echo.Logger, p pendingToxicityScore) error {
+	scoreCtx, cancel := context.WithTimeout(ctx, toxicityScoreTimeout)
+	score, err := toxicityClassifier.Score(scoreCtx, p.Comment)
+	cancel()
+	if err != nil {
+		if errors.Is(err, errCircuitOpen) || ctx.Err() != nil {
+			// 外部APIが落ちている間や停止するときは、回数に数えずに次回に回す
+			return nil
+		}
+		return recordToxicityScoreFailure(ctx, logger, p, err)
+	}
+
+	now := clock.Now().Unix()
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		rs, err := tx.ExecContext(ctx, "UPDATE livecomment_toxicity_scores SET score = ?, classifier = ?, scored_at = ? WHERE livecomment_id = ? AND scored_at IS NULL", score, toxicityClassifier.Name(), now, p.LivecommentID)
+		if err != nil {
+			return err
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// 他のプロセスが採点済み
+			return nil
+		}
+		if score < toxicityThreshold {
+			return nil
+		}
+		// 配信者のレビュー待ちに積むため、報告者は配信者自身として記録する
+		_, err = tx.ExecContext(ctx, "INSERT INTO livecomment_reports (user_id, livestream_id, livecomment_id, source, created_at) VALUES (?, ?, ?, ?, ?)", p.OwnerID, p.LivestreamID, p.LivecommentID, livecommentReportSourceToxicity, now)
+		return err
+	})
+}
+
+// recordToxicityScoreFailure は失敗した回数を増やし、次に採点する時刻を attempts * toxicityRetryInterval だけ後にする
+func recordToxicityScoreFailure(ctx context.Context, logger echo.Logger, p pendingToxicityScore, scoreErr error) error {
+	message := scoreErr.Error()
+	if r := []rune(message); len(r) > maxToxicityErrorLength {
+		message = string(r[:maxToxicityErrorLength])
+	}
+	now := clock.Now()
+	// SET は左から順に評価されるので、attempts を増やす前の値で計算する
+	if _, err := dbConn.ExecContext(ctx, `
+		UPDATE livecomment_toxicity_scores
+		SET failed_at = IF(attempts + 1 >= ?, ?, NULL),
+			next_attempt_at = ? + (attempts + 1) * ?,
+			attempts = attempts + 1,
+			last_error = ?
+		WHERE livecomment_id = ? AND scored_at IS NULL`,
+		toxicityMaxAttempts, now.Unix(), now.Unix(), int64(toxicityRetryInterval/time.Second), message, p.LivecommentID); err != nil {
+		return err
+	}
+	logger.Warnf("failed to score livecomment %d: %v", p.LivecommentID, scoreErr)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// デッドロック等でトランザクションを再実行する最大回数
+	maxTxRetries = 3
+	txRetryDelay = 10 * time.Millisecond
+
+	mysqlErrDuplicateEntry  = 1062
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// TxStats はトランザクションの実行結果の累計
+type TxStats struct {
+	Commits   int64 `json:"commits"`
+	Rollbacks int64 `json:"rollbacks"`
+	Retries   int64 `json:"retries"`
+	Failures  int64 `json:"failures"`
+}
+
+var txCounters struct {
+	commits   atomic.Int64
+	rollbacks atomic.Int64
+	retries   atomic.Int64
+	failures  atomic.Int64
+}
+
+func txStats() TxStats {
+	return TxStats{
+		Commits:   txCounters.commits.Load(),
+		Rollbacks: txCounters.rollbacks.Load(),
+		Retries:   txCounters.retries.Load(),
+		Failures:  txCounters.failures.Load(),
+	}
+}
+
+// withTx は fn をトランザクション内で実行し、fn がエラーを返せばロールバック、成功すればコミットする
+// デッドロックやロック待ちタイムアウトで失敗した場合は fn ごと再実行するので、fn はトランザクション外に副作用を残さないこと
+// (外部コマンドや通知などはコミットした後に行う)
+// fn が返したエラー (echo.HTTPError を含む) はそのまま呼び出し元に返る
+// echo.HTTPError で返す場合は、再実行できるよう DB のエラーを SetInternal で入れておくこと
+func withTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, fn)
+		if err == nil {
+			txCounters.commits.Add(1)
+			return nil
+		}
+		if attempt < maxTxRetries && isRetryableTxError(err) && ctx.Err() == nil {
+			txCounters.retries.Add(1)
+			time.Sleep(txRetryDelay * time.Duration(attempt+1))
+			continue
+		}
+		txCounters.failures.Add(1)
+		return err
+	}
+}
+
+func runTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		txCounters.rollbacks.Add(1)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// isRetryableTxError はデッドロック・ロック待ちタイムアウトで失敗したかを返す
+// ハンドラは DB のエラーを echo.HTTPError の Internal に入れて返すので、errors.As で辿れる
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout)
+}
+
+// isDuplicateEntryError はUNIQUE制約違反かどうかを判定する
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
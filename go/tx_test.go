@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+func TestIsRetryableTxError(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found when trying to get lock; try restarting transaction"}
+	lockWait := &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "Lock wait timeout exceeded; try restarting transaction"}
+	duplicate := &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "deadlock", err: deadlock, want: true},
+		{name: "lock wait timeout", err: lockWait, want: true},
+		{name: "wrapped deadlock", err: fmt.Errorf("failed to commit: %w", deadlock), want: true},
+		{name: "http error with deadlock", err: echo.NewHTTPError(http.StatusInternalServerError, "failed to insert: "+deadlock.Error()).SetInternal(deadlock), want: true},
+		{name: "duplicate entry", err: duplicate, want: false},
+		{name: "http error with duplicate entry", err: echo.NewHTTPError(http.StatusInternalServerError, "failed to insert: "+duplicate.Error()).SetInternal(duplicate), want: false},
+		// メッセージに番号が書いてあるだけでは再実行しない
+		{name: "message only", err: echo.NewHTTPError(http.StatusBadRequest, "Error 1213: user input"), want: false},
+		{name: "other error", err: errors.New("connection refused"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableTxError(tt.err); got != tt.want {
+				t.Errorf("isRetryableTxError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// normalizeEmail は照合用にメールアドレスを正規化する (前後の空白を除き、小文字にする)
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// isEmailIdentifier はログインの識別子がメールアドレスかどうか
+// ユーザ名には @ を使えない (DNS のサブドメインになる) ので、@ の有無で見分ける
+func isEmailIdentifier(identifier string) bool {
+	return strings.Contains(identifier, "@")
+}
+
+// findLoginUser はユーザ名またはメールアドレスでログインするユーザを引く
+// メールアドレスは uniq_user_email_normalized だけで id を引いてから本体を取る
+func findLoginUser(ctx context.Context, tx *sqlx.Tx, identifier string) (UserModel, error) {
+	var userModel UserModel
+	identifier = strings.TrimSpace(identifier)
+	if !isEmailIdentifier(identifier) {
+		// usernameはUNIQUEなので、whereで一意に特定できる
+		err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", identifier)
+		return userModel, err
+	}
+
+	var userID int64
+	if err := tx.GetContext(ctx, &userID, "SELECT id FROM users WHERE email_normalized = ?", normalizeEmail(identifier)); err != nil {
+		return userModel, err
+	}
+	err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	return userModel, err
+}
+
+// ユーザが見つからなかったときにも bcrypt の比較をして、応答時間でユーザの有無がわからないようにする
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("dummy-password"), bcryptDefaultCost)
+	return hashed
+})
+
+func compareDummyPassword(password string) {
+	_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+}
+
+// sendAlreadyRegisteredNotice は登録済みのメールアドレスで登録しようとされたことを、そのアドレスに知らせる
+// 応答時間でわからないよう、送信を待たずに返す
+func sendAlreadyRegisteredNotice(logger echo.Logger, email string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailerAPITimeout)
+		defer cancel()
+		if err := mailer.Send(ctx, renderAlreadyRegisteredNotice(email)); err != nil {
+			logger.Warnf("failed to send already registered notice: %v", err)
+		}
+	}()
+}
+
+func renderAlreadyRegisteredNotice(email string) Mail {
+	return Mail{
+		To:      email,
+		Subject: "アカウントの登録について",
+		Body:    "このメールアドレスで新しいアカウントの登録がありましたが、すでに登録されているため受け付けませんでした。\n\nお心当たりがある場合は、このメールアドレスでログインしてください。お心当たりがない場合は、このメールは破棄してください。\n",
+	}
+}
+
+func isDuplicateEmailError(err error) bool {
+	return isDuplicateEntryError(err) && strings.Contains(err.Error(), "uniq_user_email_normalized")
+}
+
+func nullableEmail(email string) (sql.NullString, sql.NullString) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return sql.NullString{}, sql.NullString{}
+	}
+	return sql.NullString{String: email, Valid: true}, sql.NullString{String: normalizeEmail(email), Valid: true}
+}
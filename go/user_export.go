@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	userExportStatusPending = "pending"
+	userExportStatusRunning = "running"
+	userExportStatusDone    = "done"
+	userExportStatusFailed  = "failed"
+
+	userExportWorkerInterval = 10 * time.Second
+	// ダウンロードURLの有効期間
+	userExportDownloadTTL = 1 * time.Hour
+
+	signedAssetKindUserExport = "user_export"
+)
+
+var userExportWakeup = make(chan struct{}, 1)
+
+func init() {
+	registerSignedAsset(signedAssetKindUserExport, func(ctx context.Context, exportID int64) (string, []byte, error) {
+		var archive []byte
+		if err := dbConn.GetContext(ctx, &archive, "SELECT archive FROM user_exports WHERE id = ? AND status = ?", exportID, userExportStatusDone); err != nil {
+			return "", nil, err
+		}
+		return "application/zip", archive, nil
+	})
+}
+
+type UserExportModel struct {
+	ID          int64          `db:"id"`
+	UserID      int64          `db:"user_id"`
+	Status      string         `db:"status"`
+	Archive     []byte         `db:"archive"`
+	Error       sql.NullString `db:"error"`
+	CreatedAt   int64          `db:"created_at"`
+	CompletedAt *int64         `db:"completed_at"`
+}
+
+type UserExport struct {
+	ID          int64  `json:"id"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+	CompletedAt *int64 `json:"completed_at,omitempty"`
+	// 完了したときだけ入る (署名付きURL)
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func newUserExport(m UserExportModel) UserExport {
+	export := UserExport{
+		ID:          m.ID,
+		Status:      m.Status,
+		Error:       m.Error.String,
+		CreatedAt:   m.CreatedAt,
+		CompletedAt: m.CompletedAt,
+	}
+	if m.Status == userExportStatusDone {
+		export.DownloadURL = signAssetURL(signedAssetKindUserExport, m.ID, userExportDownloadTTL)
+	}
+	return export
+}
+
+// データエクスポートの受付API
+// POST /api/user/me/export
+// 処理中のエクスポートがあればそれを返す
+func postUserExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var export UserExportModel
+	created := false
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &export, "SELECT id, user_id, status, error, created_at, completed_at FROM user_exports WHERE user_id = ? AND status IN (?, ?) ORDER BY id DESC LIMIT 1 FOR UPDATE", userID, userExportStatusPending, userExportStatusRunning)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user export: "+err.Error()).SetInternal(err)
+		}
+
+		export = UserExportModel{
+			UserID:    userID,
+			Status:    userExportStatusPending,
+			CreatedAt: clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO user_exports (user_id, status, created_at) VALUES (:user_id, :status, :created_at)", export)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user export: "+err.Error()).SetInternal(err)
+		}
+		if export.ID, err = rs.LastInsertId(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user export id: "+err.Error()).SetInternal(err)
+		}
+		created = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !created {
+		return c.JSON(http.StatusOK, newUserExport(export))
+	}
+	select {
+	case userExportWakeup <- struct{}{}:
+	default:
+	}
+	return c.JSON(http.StatusAccepted, newUserExport(export))
+}
+
+// データエクスポートの状態取得API
+// GET /api/user/me/export/:export_id
+func getUserExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	exportID, err := strconv.ParseInt(c.Param("export_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "export_id in path must be integer")
+	}
+
+	var export UserExportModel
+	if err := dbConn.GetContext(ctx, &export, "SELECT id, user_id, status, error, created_at, completed_at FROM user_exports WHERE id = ? AND user_id = ?", exportID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "user export not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user export: "+err.Error()).SetInternal(err)
+	}
+
+	return c.JSON(http.StatusOK, newUserExport(export))
+}
+
+// runUserExportWorker は受け付けたエクスポートを1件ずつ処理する
+func runUserExportWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(userExportWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-userExportWakeup:
+		}
+		for {
+			processed, err := processNextUserExport(ctx)
+			if err != nil {
+				logger.Warnf("failed to process user export: %v", err)
+				break
+			}
+			if !processed {
+				break
+			}
+		}
+	}
+}
+
+func processNextUserExport(ctx context.Context) (bool, error) {
+	var export UserExportModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &export, "SELECT id, user_id, status, error, created_at, completed_at FROM user_exports WHERE status = ? ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED", userExportStatusPending); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE user_exports SET status = ? WHERE id = ?", userExportStatusRunning, export.ID)
+		return err
+	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	archive, buildErr := buildUserExportArchive(ctx, export.UserID)
+	now := clock.Now().Unix()
+	if buildErr != nil {
+		if _, err := dbConn.ExecContext(ctx, "UPDATE user_exports SET status = ?, error = ?, completed_at = ? WHERE id = ?", userExportStatusFailed, buildErr.Error(), now, export.ID); err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+	if _, err := dbConn.ExecContext(ctx, "UPDATE user_exports SET status = ?, archive = ?, completed_at = ? WHERE id = ?", userExportStatusDone, archive, now, export.ID); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+type userExportProfile struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	Email       string `json:"email,omitempty"`
+	Plan        string `json:"plan"`
+	DarkMode    bool   `json:"dark_mode"`
+}
+
+// buildUserExportArchive はユーザのデータを JSON ファイルにまとめた zip を作る
+// パスワードのハッシュなど、本人にも返さない値は含めない
+func buildUserExportArchive(ctx context.Context, userID int64) ([]byte, error) {
+	files := map[string]interface{}{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var user UserModel
+		if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+			return err
+		}
+		var theme ThemeModel
+		if err := tx.GetContext(ctx, &theme, "SELECT * FROM themes WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		files["profile.json"] = userExportProfile{
+			ID:          user.ID,
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			Description: user.Description,
+			Email:       user.Email.String,
+			Plan:        user.Plan,
+			DarkMode:    theme.DarkMode,
+		}
+
+		livecomments := []LivecommentModel{}
+		if err := tx.SelectContext(ctx, &livecomments, "SELECT lc.* FROM "+livecommentsAggregateTable()+" lc WHERE lc.user_id = ? ORDER BY lc.id", userID); err != nil {
+			return err
+		}
+		files["livecomments.json"] = livecomments
+
+		tips := []LivecommentModel{}
+		for _, lc := range livecomments {
+			if lc.Tip > 0 {
+				tips = append(tips, lc)
+			}
+		}
+		files["tips.json"] = tips
+
+		reactions := []ReactionModel{}
+		if err := tx.SelectContext(ctx, &reactions, "SELECT r.* FROM "+reactionsAllTable()+" r WHERE r.user_id = ? ORDER BY r.id", userID); err != nil {
+			return err
+		}
+		files["reactions.json"] = reactions
+
+		reports := []LivecommentReportModel{}
+		if err := tx.SelectContext(ctx, &reports, "SELECT * FROM livecomment_reports WHERE user_id = ? AND source = ? ORDER BY id", userID, livecommentReportSourceUser); err != nil {
+			return err
+		}
+		files["reports.json"] = reports
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"profile.json", "livecomments.json", "tips.json", "reactions.json", "reports.json"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
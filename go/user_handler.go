@@ -10,10 +10,10 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -36,6 +36,16 @@ type UserModel struct {
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	// プロフィール・テーマ・アイコンが変わるたびに増やす (ETag に使う)
+	ProfileVersion   int64 `db:"profile_version"`
+	ProfileUpdatedAt int64 `db:"profile_updated_at"`
+	// free, creator, pro のいずれか
+	Plan string `db:"plan"`
+	// 任意。ログインでは email_normalized で照合する
+	Email           sql.NullString `db:"email"`
+	EmailNormalized sql.NullString `db:"email_normalized"`
+	// 登録日時 (初期データは 0)
+	CreatedAt int64 `db:"created_at"`
 }
 
 type User struct {
@@ -45,6 +55,12 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// 配信のチャンネルでのバッジ (ライブコメントのユーザにのみ入る)
+	Badges []string `json:"badges,omitempty"`
+	// リンクなどのプロフィール項目 (ユーザ詳細にのみ入る)
+	Profile map[string]string `json:"profile,omitempty"`
+	// 配信者が載せた応援コメント (ユーザ詳細にのみ入る)
+	HighlightedComments []HighlightedComment `json:"highlighted_comments,omitempty"`
 }
 
 type Theme struct {
@@ -62,6 +78,8 @@ type PostUserRequest struct {
 	Name        string `json:"name"`
 	DisplayName string `json:"display_name"`
 	Description string `json:"description"`
+	// Email is optional.
+	Email string `json:"email"`
 	// Password is non-hashed password.
 	Password string               `json:"password"`
 	Theme    PostUserRequestTheme `json:"theme"`
@@ -72,6 +90,7 @@ type PostUserRequestTheme struct {
 }
 
 type LoginRequest struct {
+	// Username is username or email.
 	Username string `json:"username"`
 	// Password is non-hashed password.
 	Password string `json:"password"`
@@ -83,6 +102,8 @@ type PostIconRequest struct {
 
 type PostIconResponse struct {
 	ID int64 `json:"id"`
+	// 画像の審査待ちになったときだけ入る
+	ReviewID int64 `json:"review_id,omitempty"`
 }
 
 func getIconHandler(c echo.Context) error {
@@ -90,30 +111,47 @@ func getIconHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if ok, err := serveIndexedIcon(c, username); ok {
+		return err
 	}
-	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	var image []byte
+	contentType := "image/jpeg"
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var user UserModel
+		if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-	}
 
-	var image []byte
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.File(fallbackImage)
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+		if variantType, variant, ok, err := negotiateIconVariant(ctx, tx, c.Request().Header.Get(echo.HeaderAccept), user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon variant: "+err.Error()).SetInternal(err)
+		} else if ok {
+			contentType, image = variantType, variant
+			return nil
 		}
+
+		if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				image = nil
+				return nil
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	return c.Blob(http.StatusOK, "image/jpeg", image)
+	if len(imageVariantFormats) > 0 {
+		c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	}
+	if image == nil {
+		return c.File(fallbackImage)
+	}
+	return c.Blob(http.StatusOK, contentType, image)
 }
 
 func postIconHandler(c echo.Context) error {
@@ -129,38 +167,75 @@ func postIconHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	// 大きな画像をリクエストごとに丸ごと JSON として溜めないよう、読みながら復号する
+	uploaded, err := readIconUpload(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the uploaded icon: "+err.Error())
 	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	req := &PostIconRequest{}
+	req.Image, err = normalizeUploadedImage(uploaded)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the image: "+err.Error())
+	}
+
+	moderation := moderateImage(ctx, req.Image)
+	if moderation.Verdict == imageVerdictReject {
+		return echo.NewHTTPError(http.StatusBadRequest, "the image was rejected by moderation")
+	}
+
+	var iconID, reviewID int64
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		if moderation.Verdict == imageVerdictFlag {
+			// 審査が終わるまでは今のアイコンのまま
+			reviewID, err = enqueueImageReview(ctx, tx, imageReviewTargetUserIcon, userID, userID, req.Image, moderation)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue image review: "+err.Error()).SetInternal(err)
+			}
+			return nil
+		}
+		iconID, err = replaceUserIcon(ctx, tx, userID, req.Image)
+		return err
+	}); err != nil {
+		return err
 	}
-	defer tx.Rollback()
 
+	if reviewID != 0 {
+		return c.JSON(http.StatusAccepted, &PostIconResponse{
+			ReviewID: reviewID,
+		})
+	}
+	invalidateIconIndex(ctx, c.Logger(), userID)
+	return c.JSON(http.StatusCreated, &PostIconResponse{
+		ID: iconID,
+	})
+}
+
+// replaceUserIcon はユーザのアイコンを差し替える
+func replaceUserIcon(ctx context.Context, tx *sqlx.Tx, userID int64, image []byte) (int64, error) {
 	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error()).SetInternal(err)
 	}
 
-	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, req.Image)
+	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, image)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error()).SetInternal(err)
 	}
 
 	iconID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error()).SetInternal(err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if err := storeIconVariants(ctx, tx, userID, image); err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to store icon variants: "+err.Error()).SetInternal(err)
 	}
 
-	return c.JSON(http.StatusCreated, &PostIconResponse{
-		ID: iconID,
-	})
+	if err := bumpProfileVersion(ctx, tx, userID); err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to bump profile version: "+err.Error()).SetInternal(err)
+	}
+
+	return iconID, nil
 }
 
 func getMeHandler(c echo.Context) error {
@@ -173,12 +248,18 @@ func getMeHandler(c echo.Context) error {
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	if notModified, err := checkProfileNotModified(c, "id = ?", userID); err != nil {
+		return err
+	} else if notModified {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	user, err := fetchUserDetailsByID(ctx, userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch user details: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch user details: "+err.Error()).SetInternal(err)
 	}
 
 	return c.JSON(http.StatusOK, user)
@@ -198,59 +279,153 @@ func registerHandler(c echo.Context) error {
 	if req.Name == "pipe" {
 		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
 	}
+	if isEmailIdentifier(req.Name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "username must not contain '@'")
+	}
+	email, emailNormalized := nullableEmail(req.Email)
+	if email.Valid && !isEmailIdentifier(email.String) {
+		return echo.NewHTTPError(http.StatusBadRequest, "email must contain '@'")
+	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	src, err := checkRegistrationBurst(ctx, c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error()).SetInternal(err)
 	}
-	defer tx.Rollback()
 
-	userModel := UserModel{
-		Name:           req.Name,
-		DisplayName:    req.DisplayName,
-		Description:    req.Description,
-		HashedPassword: string(hashedPassword),
-	}
+	var (
+		user       User
+		emailTaken bool
+	)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		emailTaken = false
+		// チャンネル名と同じユーザ名にすると、プライマリチャンネルとして引けなくなる
+		taken, err := nameTakenForUpdate(ctx, tx, "channels", req.Name)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to check channel name: "+err.Error()).SetInternal(err)
+		}
+		if taken {
+			return newRegistrationConflictError()
+		}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
-	}
+		userModel := UserModel{
+			Name:            req.Name,
+			DisplayName:     req.DisplayName,
+			Description:     req.Description,
+			HashedPassword:  string(hashedPassword),
+			Email:           email,
+			EmailNormalized: emailNormalized,
+			CreatedAt:       clock.Now().Unix(),
+		}
 
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
-	}
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password, email, email_normalized, created_at) VALUES(:name, :display_name, :description, :password, :email, :email_normalized, :created_at)", userModel)
+		if isDuplicateEntryError(err) {
+			emailTaken = isDuplicateEmailError(err)
+			return newRegistrationConflictError()
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error()).SetInternal(err)
+		}
 
-	themeModel := ThemeModel{
-		UserID:   userID,
-		DarkMode: req.Theme.DarkMode,
-	}
+		userID, err := result.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error()).SetInternal(err)
+		}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
+		themeModel := ThemeModel{
+			UserID:   userID,
+			DarkMode: req.Theme.DarkMode,
+		}
+
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error()).SetInternal(err)
+		}
+
+		if err := recordRegistration(ctx, tx, userID, src); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record registration: "+err.Error()).SetInternal(err)
+		}
+		if err := emitDomainEvent(ctx, tx, domainEventUserRegistered, domainEventAggregateUser, userID, UserRegisteredEvent{UserID: userID}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to emit user registered event: "+err.Error()).SetInternal(err)
+		}
+
+		userModel.ID = userID
+		user, err = fillUserResponseForRegisterHandler(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error()).SetInternal(err)
+		}
+
+		return nil
+	}); err != nil {
+		if emailTaken {
+			sendAlreadyRegisteredNotice(c.Logger(), email.String)
+		}
+		return err
 	}
 
-	if out, err := exec.Command("pdnsutil", "add-record", "u.isucon.local", req.Name, "A", "0", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
+	// withTx は失敗するとクロージャごと再実行するので、DNS のレコードはコミットした後に1回だけ足す
+	// 足せなかった場合は同じ名前で登録し直せるよう、作ったユーザを消す
+	if err := addSubdomainRecord(ctx, req.Name); err != nil {
+		if derr := deleteRegisteredUser(ctx, user.ID); derr != nil {
+			c.Logger().Errorf("failed to delete user %d after failing to add subdomain record: %v", user.ID, derr)
+		}
+		return err
 	}
 
-	userModel.ID = userID
-	user, err := fillUserResponseForRegisterHandler(ctx, tx, userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	addLeaderboardMember(ctx, c.Logger(), leaderboardUsers, user.Name)
+	if registrationAbuseEnabled && src.challengeRequired() {
+		c.Response().Header().Set(registrationChallengeHeader, "required")
 	}
+	return c.JSON(http.StatusCreated, user)
+}
+
+// newRegistrationConflictError は登録できなかった場合のエラー
+// ユーザ名・チャンネル名・メールアドレスのどれと衝突しても同じにして、メールアドレスが登録済みかどうかをわからないようにする
+func newRegistrationConflictError() *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusBadRequest, "the username or email is already used")
+}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+// addSubdomainRecord はユーザのサブドメインを PowerDNS に登録する
+func addSubdomainRecord(ctx context.Context, name string) error {
+	var out []byte
+	if err := getCircuitBreaker(circuitPowerDNS).Do(func() error {
+		cmdCtx, cancel := context.WithTimeout(ctx, powerDNSCommandTimeout)
+		defer cancel()
+		var err error
+		out, err = exec.CommandContext(cmdCtx, "pdnsutil", "add-record", "u.isucon.local", name, "A", "0", powerDNSSubdomainAddress).CombinedOutput()
+		return err
+	}); err != nil {
+		if errors.Is(err, errCircuitOpen) {
+			return newReasonedError(http.StatusServiceUnavailable, "dns_unavailable", "failed to add subdomain record: "+err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error()).SetInternal(err)
 	}
+	return nil
+}
 
-	return c.JSON(http.StatusCreated, user)
+// deleteRegisteredUser は登録APIが作った行を消す (サブドメインを登録できなかった場合の巻き戻し)
+func deleteRegisteredUser(ctx context.Context, userID int64) error {
+	return withTx(ctx, func(tx *sqlx.Tx) error {
+		queries := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"DELETE FROM themes WHERE user_id = ?", []interface{}{userID}},
+			{"DELETE FROM registration_events WHERE user_id = ?", []interface{}{userID}},
+			{"DELETE FROM suspicious_accounts WHERE user_id = ?", []interface{}{userID}},
+			{"DELETE FROM events WHERE aggregate_type = ? AND aggregate_id = ?", []interface{}{domainEventAggregateUser, userID}},
+			{"DELETE FROM users WHERE id = ?", []interface{}{userID}},
+		}
+		for _, q := range queries {
+			if _, err := tx.ExecContext(ctx, q.query, q.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // ユーザログインAPI
@@ -264,35 +439,43 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	userModel := UserModel{}
-	// usernameはUNIQUEなので、whereで一意に特定できる
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
-	}
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-	}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		userModel, err = findLoginUser(ctx, tx, req.Username)
+		if errors.Is(err, sql.ErrNoRows) {
+			// ユーザの有無を区別できないよう、パスワード違いと同じエラーを返す
+			compareDummyPassword(req.Password)
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
+	err := bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
 	}
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error()).SetInternal(err)
+	}
+
+	if err := issueUserSession(c, userModel); err != nil {
+		return err
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	return c.NoContent(http.StatusOK)
+}
+
+// issueUserSession はログインしたユーザのセッションを発行する
+// パスワードログインと OAuth ログインで共通
+func issueUserSession(c echo.Context, userModel UserModel) error {
+	sessionEndAt := clock.Now().Add(sessionLifetime)
 
 	sessionID := uuid.NewString()
 
@@ -301,21 +484,19 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.local",
-		MaxAge: int(60000),
-		Path:   "/",
-	}
+	sess.Options = sessionCookieOptions()
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
 	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
 
+	if err := trackUserSession(c.Request().Context(), c, sessionID, userModel.ID, sessionEndAt.Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to track session: "+err.Error()).SetInternal(err)
+	}
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error()).SetInternal(err)
 	}
-
-	return c.NoContent(http.StatusOK)
+	return nil
 }
 
 // / ユーザ詳細API
@@ -328,12 +509,18 @@ func getUserHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
+	if notModified, err := checkProfileNotModified(c, "name = ?", username); err != nil {
+		return err
+	} else if notModified {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	user, err := fetchUserDetailsByName(ctx, username)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch user details: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch user details: "+err.Error()).SetInternal(err)
 	}
 
 	return c.JSON(http.StatusOK, user)
@@ -355,15 +542,54 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
 
-	now := time.Now()
+	now := clock.Now()
 	if now.Unix() > sessionExpires.(int64) {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
+	if err := verifyTrackedSession(c.Request().Context(), sess); err != nil {
+		return err
+	}
+	return slideSessionExpiry(c, sess, sessionExpires.(int64))
+}
+
+// verifyAdminSession はセッションを検証した上で、ユーザが管理者であることを確認する
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, ok := sess.Values[defaultUsernameKey].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERNAME value from session")
+	}
+	if _, ok := adminUsernames[username]; !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "admin privilege is required")
+	}
+
 	return nil
 }
 
+// fillUserResponseByID はリクエスト内で読み込み済みのユーザがあればそれを使い、無ければDBから引く
+func fillUserResponseByID(ctx context.Context, tx *sqlx.Tx, userID int64) (User, error) {
+	if user, ok := loaderFrom(ctx).user(userID); ok {
+		return user, nil
+	}
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		return User{}, err
+	}
+	return fillUserResponse(ctx, tx, userModel)
+}
+
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
+	loader := loaderFrom(ctx)
+	if user, ok := loader.user(userModel.ID); ok {
+		return user, nil
+	}
+
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
 		return User{}, err
@@ -374,12 +600,11 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 		if !errors.Is(err, sql.ErrNoRows) {
 			return User{}, err
 		}
-		image, err = os.ReadFile(fallbackImage)
-		if err != nil {
-			return User{}, err
-		}
 	}
-	iconHash := sha256.Sum256(image)
+	iconHash, err := iconHashOf(image)
+	if err != nil {
+		return User{}, err
+	}
 
 	user := User{
 		ID:          userModel.ID,
@@ -390,19 +615,14 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: fmt.Sprintf("%x", iconHash),
+		IconHash: iconHash,
 	}
+	loader.setUser(user)
 
 	return user, nil
 }
 
 func fetchUserDetailsByName(ctx context.Context, username string) (User, error) {
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return User{}, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
 	var user User
 	query := `
 	SELECT u.id, u.name, u.display_name, u.description, t.id, t.dark_mode, COALESCE(i.image, '') as image
@@ -412,13 +632,26 @@ func fetchUserDetailsByName(ctx context.Context, username string) (User, error)
 	WHERE u.name = ?
 	`
 
-	row := tx.QueryRowxContext(ctx, query, username)
 	var image []byte
-	if err := row.Scan(&user.ID, &user.Name, &user.DisplayName, &user.Description, &user.Theme.ID, &user.Theme.DarkMode, &image); err != nil {
-		return User{}, fmt.Errorf("failed to scan user details: %w", err)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		row := tx.QueryRowxContext(ctx, query, username)
+		if err := row.Scan(&user.ID, &user.Name, &user.DisplayName, &user.Description, &user.Theme.ID, &user.Theme.DarkMode, &image); err != nil {
+			return fmt.Errorf("failed to scan user details: %w", err)
+		}
+		var err error
+		if user.Profile, err = fetchProfileFields(ctx, tx, user.ID); err != nil {
+			return fmt.Errorf("failed to get profile fields: %w", err)
+		}
+		if user.HighlightedComments, err = fetchHighlightedComments(ctx, tx, user.ID); err != nil {
+			return fmt.Errorf("failed to get highlighted comments: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return User{}, err
 	}
 
 	if len(image) == 0 {
+		var err error
 		image, err = os.ReadFile(fallbackImage)
 		if err != nil {
 			return User{}, fmt.Errorf("failed to read fallback image: %w", err)
@@ -428,10 +661,6 @@ func fetchUserDetailsByName(ctx context.Context, username string) (User, error)
 	iconHash := sha256.Sum256(image)
 	user.IconHash = fmt.Sprintf("%x", iconHash)
 
-	if err := tx.Commit(); err != nil {
-		return User{}, fmt.Errorf("failed to commit: %w", err)
-	}
-
 	return user, nil
 }
 
@@ -477,12 +706,6 @@ func fillUserResponseForRegisterHandler(ctx context.Context, tx *sqlx.Tx, userMo
 
 // memo
 func fetchUserDetailsByID(ctx context.Context, userID int64) (User, error) {
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return User{}, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
 	var user User
 	query := `
 		SELECT u.id, u.name, u.display_name, u.description, t.id, t.dark_mode, COALESCE(i.image, '') as image
@@ -492,13 +715,26 @@ func fetchUserDetailsByID(ctx context.Context, userID int64) (User, error) {
 		WHERE u.id = ?
 	`
 
-	row := tx.QueryRowxContext(ctx, query, userID)
 	var image []byte
-	if err := row.Scan(&user.ID, &user.Name, &user.DisplayName, &user.Description, &user.Theme.ID, &user.Theme.DarkMode, &image); err != nil {
-		return User{}, fmt.Errorf("failed to scan user details: %w", err)
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		row := tx.QueryRowxContext(ctx, query, userID)
+		if err := row.Scan(&user.ID, &user.Name, &user.DisplayName, &user.Description, &user.Theme.ID, &user.Theme.DarkMode, &image); err != nil {
+			return fmt.Errorf("failed to scan user details: %w", err)
+		}
+		var err error
+		if user.Profile, err = fetchProfileFields(ctx, tx, user.ID); err != nil {
+			return fmt.Errorf("failed to get profile fields: %w", err)
+		}
+		if user.HighlightedComments, err = fetchHighlightedComments(ctx, tx, user.ID); err != nil {
+			return fmt.Errorf("failed to get highlighted comments: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return User{}, err
 	}
 
 	if len(image) == 0 {
+		var err error
 		image, err = os.ReadFile(fallbackImage)
 		if err != nil {
 			return User{}, fmt.Errorf("failed to read fallback image: %w", err)
@@ -508,9 +744,51 @@ func fetchUserDetailsByID(ctx context.Context, userID int64) (User, error) {
 	iconHash := sha256.Sum256(image)
 	user.IconHash = fmt.Sprintf("%x", iconHash)
 
-	if err := tx.Commit(); err != nil {
-		return User{}, fmt.Errorf("failed to commit: %w", err)
+	return user, nil
+}
+
+// bumpProfileVersion はユーザ詳細のレスポンスが変わる更新のたびに呼ぶ
+func bumpProfileVersion(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE users SET profile_version = profile_version + 1, profile_updated_at = ? WHERE id = ?", clock.Now().Unix(), userID)
+	return err
+}
+
+// checkProfileNotModified はユーザ詳細に ETag/Last-Modified を付け、
+// クライアントのキャッシュが最新なら true を返す
+// ユーザが見つからない場合は false を返し、後続の取得処理で404にする
+func checkProfileNotModified(c echo.Context, cond string, arg interface{}) (bool, error) {
+	var v struct {
+		ID        int64 `db:"id"`
+		Version   int64 `db:"profile_version"`
+		UpdatedAt int64 `db:"profile_updated_at"`
+	}
+	if err := dbConn.GetContext(c.Request().Context(), &v, "SELECT id, profile_version, profile_updated_at FROM users WHERE "+cond, arg); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get profile version: "+err.Error()).SetInternal(err)
 	}
 
-	return user, nil
+	etag := fmt.Sprintf(`W/"%d-%d"`, v.ID, v.Version)
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	if v.UpdatedAt > 0 {
+		header.Set("Last-Modified", time.Unix(v.UpdatedAt, 0).UTC().Format(http.TimeFormat))
+	}
+
+	// If-None-Match があれば If-Modified-Since より優先する (RFC 9110)
+	if inm := c.Request().Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			if t = strings.TrimSpace(t); t == etag || t == "*" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if ims := c.Request().Header.Get("If-Modified-Since"); ims != "" && v.UpdatedAt > 0 {
+		if t, err := http.ParseTime(ims); err == nil && v.UpdatedAt <= t.Unix() {
+			return true, nil
+		}
+	}
+	return false, nil
 }
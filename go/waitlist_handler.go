@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	waitlistStatusWaiting   = "waiting"
+	waitlistStatusPromoted  = "promoted"
+	waitlistStatusCancelled = "cancelled"
+	// 繰り上げようとしたが予約できなくなった (期間外・過去・重複)
+	waitlistStatusRejected = "rejected"
+
+	waitlistWorkerInterval  = 30 * time.Second
+	waitlistWorkerBatchSize = 100
+)
+
+// キャンセルで枠が空いたときにワーカーを即座に起こすためのチャネル
+var waitlistWakeup = make(chan struct{}, 1)
+
+type ReservationWaitlistModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Title        string `db:"title"`
+	Description  string `db:"description"`
+	PlaylistUrl  string `db:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url"`
+	Tags         []byte `db:"tags"`
+	StartAt      int64  `db:"start_at"`
+	EndAt        int64  `db:"end_at"`
+	ChannelID    int64  `db:"channel_id"`
+	Visibility   string `db:"visibility"`
+	PasswordHash string `db:"password_hash"`
+	Status       string `db:"status"`
+	LivestreamID int64  `db:"livestream_id"`
+	CreatedAt    int64  `db:"created_at"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID           int64   `json:"id"`
+	Title        string  `json:"title"`
+	Tags         []int64 `json:"tags"`
+	StartAt      int64   `json:"start_at"`
+	EndAt        int64   `json:"end_at"`
+	Status       string  `json:"status"`
+	LivestreamID int64   `json:"livestream_id,omitempty"`
+	CreatedAt    int64   `json:"created_at"`
+}
+
+func (m ReservationWaitlistModel) request() (*ReserveLivestreamRequest, error) {
+	req := &ReserveLivestreamRequest{
+		Title:        m.Title,
+		Description:  m.Description,
+		PlaylistUrl:  m.PlaylistUrl,
+		ThumbnailUrl: m.ThumbnailUrl,
+		StartAt:      m.StartAt,
+		EndAt:        m.EndAt,
+		ChannelID:    m.ChannelID,
+		Visibility:   m.Visibility,
+		passwordHash: m.PasswordHash,
+	}
+	if err := json.Unmarshal(m.Tags, &req.Tags); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (m ReservationWaitlistModel) response() (ReservationWaitlistEntry, error) {
+	entry := ReservationWaitlistEntry{
+		ID:           m.ID,
+		Title:        m.Title,
+		StartAt:      m.StartAt,
+		EndAt:        m.EndAt,
+		Status:       m.Status,
+		LivestreamID: m.LivestreamID,
+		CreatedAt:    m.CreatedAt,
+	}
+	if err := json.Unmarshal(m.Tags, &entry.Tags); err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	return entry, nil
+}
+
+// joinReservationWaitlist は満席だった予約リクエストをwaitlistに登録する
+func joinReservationWaitlist(ctx context.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest) (ReservationWaitlistEntry, error) {
+	tags := req.Tags
+	if tags == nil {
+		tags = []int64{}
+	}
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+
+	if req.Visibility == "" {
+		req.Visibility = livestreamVisibilityPublic
+	}
+	if err := hashLivestreamPassword(req); err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+
+	now := clock.Now().Unix()
+	m := ReservationWaitlistModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		Tags:         b,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		ChannelID:    req.ChannelID,
+		Visibility:   req.Visibility,
+		PasswordHash: req.passwordHash,
+		Status:       waitlistStatusWaiting,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, start_at, end_at, channel_id, visibility, password_hash, status, created_at, updated_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :tags, :start_at, :end_at, :channel_id, :visibility, :password_hash, :status, :created_at, :updated_at)", m)
+	if err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	if m.ID, err = rs.LastInsertId(); err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	return m.response()
+}
+
+// 自分のwaitlist一覧取得API
+// GET /api/livestream/reservation/waitlist
+func getReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var models []ReservationWaitlistModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM reservation_waitlist WHERE user_id = ? ORDER BY created_at DESC, id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error()).SetInternal(err)
+	}
+
+	entries := make([]ReservationWaitlistEntry, len(models))
+	for i, m := range models {
+		entry, err := m.response()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode reservation waitlist: "+err.Error()).SetInternal(err)
+		}
+		entries[i] = entry
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// waitlistからの離脱API
+// DELETE /api/livestream/reservation/waitlist/:waitlist_id
+func leaveReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	waitlistID, err := strconv.Atoi(c.Param("waitlist_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "waitlist_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE id = ? AND user_id = ? AND status = ?", waitlistStatusCancelled, clock.Now().Unix(), waitlistID, userID, waitlistStatusWaiting)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel reservation waitlist: "+err.Error()).SetInternal(err)
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not found waiting entry that has the given id")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信予約のキャンセルAPI
+// DELETE /api/livestream/:livestream_id/reservation
+func cancelReservationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		// 始まった配信は視聴者がいるので、strict でなくてもキャンセルさせない
+		if livestreamModel.StartAt <= clock.Now().Unix() {
+			return newReasonedError(http.StatusBadRequest, reservationReasonPast, "can't cancel livestream that has already started")
+		}
+
+		return cancelLivestreamReservation(ctx, tx, livestreamModel)
+	}); err != nil {
+		return err
+	}
+
+	// 空いた枠をwaitlistに回す
+	select {
+	case waitlistWakeup <- struct{}{}:
+	default:
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// cancelLivestreamReservation は配信を削除して予約枠を戻す
+// 開始前の配信に付いたコメント・リアクションや、繰り上げで予約したwaitlistの行も同じトランザクションで消す
+func cancelLivestreamReservation(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livecomment_reports WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomment reports: "+err.Error()).SetInternal(err)
+	}
+	for _, table := range []string{livecommentTable(livestreamModel.ID), "livecomments_archive"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomments: "+err.Error()).SetInternal(err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+reactionTable(livestreamModel.ID)+" WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reactions: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_waitlist WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reservation waitlist: "+err.Error()).SetInternal(err)
+	}
+	// 配信を始めていると start_at / end_at が詰まっているので、予約した枠を戻す
+	startAt, endAt, err := reservedWindowOf(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream broadcast: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestreams WHERE id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_stream_keys WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete stream keys: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_announcements WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete announcements: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_broadcasts WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream broadcast: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error()).SetInternal(err)
+	}
+	return nil
+}
+
+// runWaitlistWorker はキャンセル時および定期的にwaitlistの繰り上げを試みる
+func runWaitlistWorker(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(waitlistWorkerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-waitlistWakeup:
+		}
+		if err := promoteWaitlist(ctx, logger); err != nil {
+			logger.Warnf("failed to promote reservation waitlist: %v", err)
+		}
+	}
+}
+
+// promoteWaitlist は登録順にwaitlistの予約を試み、成功したユーザに通知する
+func promoteWaitlist(ctx context.Context, logger echo.Logger) error {
+	var ids []int64
+	if err := dbConn.SelectContext(ctx, &ids, "SELECT id FROM reservation_waitlist WHERE status = ? ORDER BY created_at, id LIMIT ?", waitlistStatusWaiting, waitlistWorkerBatchSize); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := withTx(ctx, func(tx *sqlx.Tx) error {
+			var m ReservationWaitlistModel
+			if err := tx.GetContext(ctx, &m, "SELECT * FROM reservation_waitlist WHERE id = ? AND status = ? FOR UPDATE", id, waitlistStatusWaiting); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					// 他のワーカーが処理済み、もしくは離脱済み
+					return nil
+				}
+				return err
+			}
+			req, err := m.request()
+			if err != nil {
+				return err
+			}
+
+			now := clock.Now().Unix()
+			livestreamModel, err := reserveLivestream(ctx, tx, logger, m.UserID, req)
+			var re *reasonedError
+			if errors.As(err, &re) {
+				if re.Reason == reservationReasonSlotFull {
+					// まだ空きが無いので待ち続ける
+					return nil
+				}
+				if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE id = ?", waitlistStatusRejected, now, m.ID); err != nil {
+					return err
+				}
+				return insertNotification(ctx, tx, m.UserID, notificationKindWaitlistRejected, map[string]interface{}{
+					"waitlist_id": m.ID,
+					"reason":      re.Reason,
+				})
+			}
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ?, updated_at = ? WHERE id = ?", waitlistStatusPromoted, livestreamModel.ID, now, m.ID); err != nil {
+				return err
+			}
+			return insertNotification(ctx, tx, m.UserID, notificationKindWaitlistPromoted, map[string]int64{
+				"waitlist_id":   m.ID,
+				"livestream_id": livestreamModel.ID,
+				"start_at":      livestreamModel.StartAt,
+				"end_at":        livestreamModel.EndAt,
+			})
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultWatchHistoryLimit = 50
+
+type HeartbeatRequest struct {
+	// 再生位置 (配信開始からの秒数)。アーカイブの続きから再生するのに使う
+	Position *int64 `json:"position"`
+}
+
+type WatchHistoryModel struct {
+	UserID         int64 `db:"user_id"`
+	LivestreamID   int64 `db:"livestream_id"`
+	LastPosition   int64 `db:"last_position"`
+	WatchedSeconds int64 `db:"watched_seconds"`
+	CreatedAt      int64 `db:"created_at"`
+	UpdatedAt      int64 `db:"updated_at"`
+}
+
+type WatchHistoryEntry struct {
+	Livestream     Livestream `json:"livestream"`
+	LastPosition   int64      `json:"last_position"`
+	WatchedSeconds int64      `json:"watched_seconds"`
+	// 配信が終わっていてアーカイブとして見ていたか
+	Archived  bool  `json:"archived"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// recordWatchHistory は heartbeat から視聴履歴を更新する
+// 前回の heartbeat からの間隔が presence の期限内なら、その間は見続けていたものとして視聴秒数に足す
+func recordWatchHistory(ctx context.Context, tx *sqlx.Tx, userID, livestreamID int64, position *int64) error {
+	now := clock.Now().Unix()
+	pos := int64(-1)
+	if position != nil && *position >= 0 {
+		pos = *position
+	}
+	ttl := int64(presenceTTL.Seconds())
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO watch_history (user_id, livestream_id, last_position, watched_seconds, created_at, updated_at)
+		VALUES (?, ?, GREATEST(?, 0), 0, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			watched_seconds = watched_seconds + IF(? - updated_at <= ?, ? - updated_at, 0),
+			last_position = IF(? >= 0, ?, last_position),
+			updated_at = ?`,
+		userID, livestreamID, pos, now, now,
+		now, ttl, now,
+		pos, pos,
+		now)
+	return err
+}
+
+// 視聴履歴取得API
+// GET /api/user/me/history
+func getWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	q := newSelectQuery("SELECT * FROM watch_history").
+		Where("user_id = ?", userID).
+		OrderBy("updated_at DESC").
+		Limit(defaultWatchHistoryLimit)
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	history := []WatchHistoryEntry{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var models []WatchHistoryModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error()).SetInternal(err)
+		}
+
+		now := clock.Now().Unix()
+		for _, m := range models {
+			var livestreamModel LivestreamModel
+			if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", m.LivestreamID); err != nil {
+				// 削除された配信は履歴に出さない
+				continue
+			}
+			livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			history = append(history, WatchHistoryEntry{
+				Livestream:     livestream,
+				LastPosition:   m.LastPosition,
+				WatchedSeconds: m.WatchedSeconds,
+				Archived:       livestreamModel.EndAt <= now,
+				UpdatedAt:      m.UpdatedAt,
+			})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultWatchRoomCapacity = 10
+	maxWatchRoomCapacity     = 50
+	maxWatchRoomNameLength   = 64
+	maxWatchRoomMessageLen   = 500
+)
+
+// WatchRoomModel は配信を一緒に見るためのルーム (ルームのチャットは配信のコメントとは別)
+type WatchRoomModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	OwnerID      int64  `db:"owner_id"`
+	Name         string `db:"name"`
+	Capacity     int64  `db:"capacity"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type WatchRoomMessageModel struct {
+	ID        int64  `db:"id"`
+	RoomID    int64  `db:"room_id"`
+	UserID    int64  `db:"user_id"`
+	Message   string `db:"message"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type WatchRoom struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	Owner        User   `json:"owner"`
+	Name         string `json:"name"`
+	Capacity     int64  `json:"capacity"`
+	// 参加した順
+	Members   []User `json:"members"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type WatchRoomMessage struct {
+	ID        int64  `json:"id"`
+	RoomID    int64  `json:"room_id"`
+	User      User   `json:"user"`
+	Message   string `json:"message"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type PostWatchRoomRequest struct {
+	Name string `json:"name"`
+	// 省略したら defaultWatchRoomCapacity
+	Capacity int64 `json:"capacity"`
+}
+
+type PostWatchRoomMessageRequest struct {
+	Message string `json:"message"`
+}
+
+func fillWatchRoomResponse(ctx context.Context, tx *sqlx.Tx, m WatchRoomModel) (WatchRoom, error) {
+	var memberIDs []int64
+	if err := tx.SelectContext(ctx, &memberIDs, "SELECT user_id FROM watch_room_members WHERE room_id = ? ORDER BY joined_at, user_id", m.ID); err != nil {
+		return WatchRoom{}, err
+	}
+	if err := loaderFrom(ctx).primeUsers(ctx, tx, append(memberIDs, m.OwnerID)); err != nil {
+		return WatchRoom{}, err
+	}
+
+	owner, err := fillUserResponseByID(ctx, tx, m.OwnerID)
+	if err != nil {
+		return WatchRoom{}, err
+	}
+	members := make([]User, len(memberIDs))
+	for i, id := range memberIDs {
+		if members[i], err = fillUserResponseByID(ctx, tx, id); err != nil {
+			return WatchRoom{}, err
+		}
+	}
+
+	return WatchRoom{
+		ID:           m.ID,
+		LivestreamID: m.LivestreamID,
+		Owner:        owner,
+		Name:         m.Name,
+		Capacity:     m.Capacity,
+		Members:      members,
+		CreatedAt:    m.CreatedAt,
+	}, nil
+}
+
+func fillWatchRoomMessageResponse(ctx context.Context, tx *sqlx.Tx, m WatchRoomMessageModel) (WatchRoomMessage, error) {
+	user, err := fillUserResponseByID(ctx, tx, m.UserID)
+	if err != nil {
+		return WatchRoomMessage{}, err
+	}
+	return WatchRoomMessage{
+		ID:        m.ID,
+		RoomID:    m.RoomID,
+		User:      user,
+		Message:   m.Message,
+		CreatedAt: m.CreatedAt,
+	}, nil
+}
+
+func parseWatchRoomID(c echo.Context) (int64, error) {
+	roomID, err := strconv.ParseInt(c.Param("room_id"), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "room_id in path must be integer")
+	}
+	return roomID, nil
+}
+
+func getWatchRoom(ctx context.Context, tx *sqlx.Tx, roomID int64, forUpdate bool) (WatchRoomModel, error) {
+	query := "SELECT * FROM watch_rooms WHERE id = ?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var m WatchRoomModel
+	if err := tx.GetContext(ctx, &m, query, roomID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WatchRoomModel{}, echo.NewHTTPError(http.StatusNotFound, "watch room not found")
+		}
+		return WatchRoomModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch room: "+err.Error()).SetInternal(err)
+	}
+	return m, nil
+}
+
+// getWatchRoomAsMember はルームを返す。参加していなければ 403 にする
+func getWatchRoomAsMember(ctx context.Context, tx *sqlx.Tx, roomID, userID int64) (WatchRoomModel, error) {
+	m, err := getWatchRoom(ctx, tx, roomID, false)
+	if err != nil {
+		return WatchRoomModel{}, err
+	}
+	var joined bool
+	if err := tx.GetContext(ctx, &joined, "SELECT EXISTS (SELECT 1 FROM watch_room_members WHERE room_id = ? AND user_id = ?)", roomID, userID); err != nil {
+		return WatchRoomModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch room member: "+err.Error()).SetInternal(err)
+	}
+	if !joined {
+		return WatchRoomModel{}, echo.NewHTTPError(http.StatusForbidden, "not a member of the watch room")
+	}
+	return m, nil
+}
+
+// 視聴ルームの作成API
+// POST /api/livestream/:livestream_id/rooms
+// 作成したユーザはそのまま参加する
+func postWatchRoomHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req PostWatchRoomRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	if utf8.RuneCountInString(req.Name) > maxWatchRoomNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is too long")
+	}
+	if req.Capacity == 0 {
+		req.Capacity = defaultWatchRoomCapacity
+	}
+	if req.Capacity < 2 || req.Capacity > maxWatchRoomCapacity {
+		return echo.NewHTTPError(http.StatusBadRequest, "capacity must be between 2 and "+strconv.Itoa(maxWatchRoomCapacity))
+	}
+
+	var room WatchRoom
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+		}
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, livestreamID, userID); err != nil {
+			return err
+		}
+
+		m := WatchRoomModel{
+			LivestreamID: livestreamID,
+			OwnerID:      userID,
+			Name:         req.Name,
+			Capacity:     req.Capacity,
+			CreatedAt:    clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO watch_rooms (livestream_id, owner_id, name, capacity, created_at) VALUES (:livestream_id, :owner_id, :name, :capacity, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert watch room: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted watch room id: "+err.Error()).SetInternal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO watch_room_members (room_id, user_id, joined_at) VALUES (?, ?, ?)", m.ID, userID, m.CreatedAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert watch room member: "+err.Error()).SetInternal(err)
+		}
+
+		room, err = fillWatchRoomResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill watch room: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, room)
+}
+
+// 視聴ルームの取得API
+// GET /api/rooms/:room_id
+// 参加する前に中を確認できるよう、配信を見られるユーザなら誰でも取得できる
+func getWatchRoomHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	roomID, err := parseWatchRoomID(c)
+	if err != nil {
+		return err
+	}
+
+	var room WatchRoom
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getWatchRoom(ctx, tx, roomID, false)
+		if err != nil {
+			return err
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, m.LivestreamID, userID); err != nil {
+			return err
+		}
+		room, err = fillWatchRoomResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill watch room: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, room)
+}
+
+// 視聴ルームへの参加API
+// POST /api/rooms/:room_id/members
+// 定員に達していたら 409 を返す。参加済みならそのまま返す
+func postWatchRoomMemberHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	roomID, err := parseWatchRoomID(c)
+	if err != nil {
+		return err
+	}
+
+	var room WatchRoom
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		// 同時に参加されても定員を超えないよう、ルームの行をロックしておく
+		m, err := getWatchRoom(ctx, tx, roomID, true)
+		if err != nil {
+			return err
+		}
+		if err := verifyLivestreamAccess(ctx, tx, c, m.LivestreamID, userID); err != nil {
+			return err
+		}
+
+		var count int64
+		var joined bool
+		if err := tx.QueryRowxContext(ctx, "SELECT COUNT(*), IFNULL(SUM(user_id = ?), 0) > 0 FROM watch_room_members WHERE room_id = ?", userID, roomID).Scan(&count, &joined); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count watch room members: "+err.Error()).SetInternal(err)
+		}
+		if !joined {
+			if count >= m.Capacity {
+				return echo.NewHTTPError(http.StatusConflict, "watch room is full")
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO watch_room_members (room_id, user_id, joined_at) VALUES (?, ?, ?)", roomID, userID, clock.Now().Unix()); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert watch room member: "+err.Error()).SetInternal(err)
+			}
+		}
+
+		room, err = fillWatchRoomResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill watch room: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, room)
+}
+
+// 視聴ルームからの退出API
+// DELETE /api/rooms/:room_id/members/me
+// 作成したユーザが抜けたらルームを閉じる
+func deleteWatchRoomMemberHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	roomID, err := parseWatchRoomID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := getWatchRoom(ctx, tx, roomID, true)
+		if err != nil {
+			return err
+		}
+		rs, err := tx.ExecContext(ctx, "DELETE FROM watch_room_members WHERE room_id = ? AND user_id = ?", roomID, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete watch room member: "+err.Error()).SetInternal(err)
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error()).SetInternal(err)
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "not a member of the watch room")
+		}
+		if m.OwnerID != userID {
+			return nil
+		}
+
+		for _, query := range []string{
+			"DELETE FROM watch_room_members WHERE room_id = ?",
+			"DELETE FROM watch_room_messages WHERE room_id = ?",
+			"DELETE FROM watch_rooms WHERE id = ?",
+		} {
+			if _, err := tx.ExecContext(ctx, query, roomID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to close watch room: "+err.Error()).SetInternal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 視聴ルームのチャット取得API (新しい順)
+// GET /api/rooms/:room_id/messages?limit=
+func getWatchRoomMessagesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	roomID, err := parseWatchRoomID(c)
+	if err != nil {
+		return err
+	}
+
+	q := newSelectQuery("SELECT * FROM watch_room_messages").
+		Where("room_id = ?", roomID).
+		OrderBy("id DESC")
+	if err := q.LimitFromParam(c, "limit"); err != nil {
+		return err
+	}
+	query, args := q.Build()
+
+	messages := []WatchRoomMessage{}
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := getWatchRoomAsMember(ctx, tx, roomID, userID); err != nil {
+			return err
+		}
+
+		var models []WatchRoomMessageModel
+		if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch room messages: "+err.Error()).SetInternal(err)
+		}
+		userIDs := make([]int64, len(models))
+		for i := range models {
+			userIDs[i] = models[i].UserID
+		}
+		if err := loaderFrom(ctx).primeUsers(ctx, tx, userIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error()).SetInternal(err)
+		}
+		for _, m := range models {
+			message, err := fillWatchRoomMessageResponse(ctx, tx, m)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill watch room message: "+err.Error()).SetInternal(err)
+			}
+			messages = append(messages, message)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, messages)
+}
+
+// 視聴ルームのチャット投稿API
+// POST /api/rooms/:room_id/messages
+// 配信のイベントストリームを room_id 付きで購読しているメンバーにも流す
+func postWatchRoomMessageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	roomID, err := parseWatchRoomID(c)
+	if err != nil {
+		return err
+	}
+
+	var req PostWatchRoomMessageRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message must not be empty")
+	}
+	if utf8.RuneCountInString(req.Message) > maxWatchRoomMessageLen {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is too long")
+	}
+
+	var room WatchRoomModel
+	var message WatchRoomMessage
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		room, err = getWatchRoomAsMember(ctx, tx, roomID, userID)
+		if err != nil {
+			return err
+		}
+
+		m := WatchRoomMessageModel{
+			RoomID:    roomID,
+			UserID:    userID,
+			Message:   req.Message,
+			CreatedAt: clock.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO watch_room_messages (room_id, user_id, message, created_at) VALUES (:room_id, :user_id, :message, :created_at)", m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert watch room message: "+err.Error()).SetInternal(err)
+		}
+		m.ID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted watch room message id: "+err.Error()).SetInternal(err)
+		}
+
+		message, err = fillWatchRoomMessageResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill watch room message: "+err.Error()).SetInternal(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	publishModerationEvent(ctx, c.Logger(), ModerationBroadcast{
+		Type:         moderationEventRoomMessage,
+		LivestreamID: room.LivestreamID,
+		RoomID:       room.ID,
+		RoomMessage:  &message,
+		CreatedAt:    message.CreatedAt,
+	})
+
+	return c.JSON(http.StatusCreated, message)
+}
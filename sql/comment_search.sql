@@ -0,0 +1,12 @@
+-- 配信者による自分の配信のコメント検索 (ISUCON13_COMMENT_SEARCH_ENABLED) 用の FULLTEXT インデックス
+-- 最も書き込みの多い livecomments に ngram のインデックスを張るとコメントの投稿が重くなるので、検索を有効にしたときだけ init.sh から流す
+-- (cold・退避先はバッチでしか書き込まないので 10_schema.sql で常に張っている)
+-- init.sh は初期化のたびに流すので、既にある場合も失敗しないようにする
+SET @livecomments_fulltext_ddl = IF(
+	(SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'livecomments' AND index_name = 'livecomments_comment') = 0,
+	'CREATE FULLTEXT INDEX livecomments_comment ON livecomments(`comment`) WITH PARSER ngram',
+	'DO 0'
+);
+PREPARE livecomments_fulltext_stmt FROM @livecomments_fulltext_ddl;
+EXECUTE livecomments_fulltext_stmt;
+DEALLOCATE PREPARE livecomments_fulltext_stmt;
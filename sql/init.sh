@@ -20,6 +20,15 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < init.sql
 
+# livecomments / reactions のパーティション分割 (テーブルが空のうちに行う)
+if [ "${ISUCON13_PARTITIONING_ENABLED:-0}" = "1" ]; then
+	mysql -u"$ISUCON_DB_USER" \
+			-p"$ISUCON_DB_PASSWORD" \
+			--host "$ISUCON_DB_HOST" \
+			--port "$ISUCON_DB_PORT" \
+			"$ISUCON_DB_NAME" < partitioning.sql
+fi
+
 mysql -u"$ISUCON_DB_USER" \
 		-p"$ISUCON_DB_PASSWORD" \
 		--host "$ISUCON_DB_HOST" \
@@ -68,6 +77,15 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < initial_livecomments.sql
 
+# コメント検索用の FULLTEXT インデックス (パーティション分割したテーブルには張れないので、その場合は LIKE で引く)
+if [ "${ISUCON13_COMMENT_SEARCH_ENABLED:-0}" = "1" ] && [ "${ISUCON13_PARTITIONING_ENABLED:-0}" != "1" ]; then
+	mysql -u"$ISUCON_DB_USER" \
+			-p"$ISUCON_DB_PASSWORD" \
+			--host "$ISUCON_DB_HOST" \
+			--port "$ISUCON_DB_PORT" \
+			"$ISUCON_DB_NAME" < comment_search.sql
+fi
+
 bash ../pdns/init_zone.sh 
 
 
@@ -10,6 +10,83 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+TRUNCATE TABLE audit_logs;
+TRUNCATE TABLE livestream_presences;
+TRUNCATE TABLE livestream_viewer_samples;
+TRUNCATE TABLE livestream_analytics;
+TRUNCATE TABLE reservation_waitlist;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE channels;
+TRUNCATE TABLE livecomment_toxicity_scores;
+TRUNCATE TABLE blocklists;
+TRUNCATE TABLE blocklist_words;
+TRUNCATE TABLE livestream_blocklists;
+TRUNCATE TABLE channel_roles;
+TRUNCATE TABLE livestream_access_tokens;
+TRUNCATE TABLE client_metadata;
+TRUNCATE TABLE livecomments_archive;
+TRUNCATE TABLE livecomments_cold;
+TRUNCATE TABLE reactions_cold;
+TRUNCATE TABLE cold_livestreams;
+TRUNCATE TABLE revenue_tiers;
+TRUNCATE TABLE payment_ledger;
+TRUNCATE TABLE payment_receipts;
+TRUNCATE TABLE reaction_buckets;
+TRUNCATE TABLE highlights;
+TRUNCATE TABLE highlight_detections;
+TRUNCATE TABLE questions;
+TRUNCATE TABLE question_upvotes;
+TRUNCATE TABLE raids;
+TRUNCATE TABLE raid_viewers;
+TRUNCATE TABLE livestream_chat_commands;
+TRUNCATE TABLE livestream_comment_rules;
+TRUNCATE TABLE link_unfurls;
+TRUNCATE TABLE livecomment_links;
+TRUNCATE TABLE highlighted_comments;
+TRUNCATE TABLE user_mute_words;
+TRUNCATE TABLE livestream_stream_keys;
+TRUNCATE TABLE livestream_broadcasts;
+TRUNCATE TABLE livestream_url_health;
+TRUNCATE TABLE livestream_captions;
+TRUNCATE TABLE watch_rooms;
+TRUNCATE TABLE watch_room_members;
+TRUNCATE TABLE watch_room_messages;
+TRUNCATE TABLE donation_goals;
+TRUNCATE TABLE channel_membership_tiers;
+TRUNCATE TABLE channel_memberships;
+TRUNCATE TABLE livestream_announcements;
+TRUNCATE TABLE livecomment_languages;
+TRUNCATE TABLE duplicate_account_candidates;
+TRUNCATE TABLE streamer_digest_settings;
+TRUNCATE TABLE streamer_digest_sends;
+TRUNCATE TABLE channel_emojis;
+TRUNCATE TABLE chat_imports;
+TRUNCATE TABLE chat_import_guests;
+TRUNCATE TABLE api_keys;
+TRUNCATE TABLE api_key_usages;
+TRUNCATE TABLE clips;
+TRUNCATE TABLE clip_views;
+TRUNCATE TABLE user_sessions;
+TRUNCATE TABLE external_identities;
+TRUNCATE TABLE image_reviews;
+TRUNCATE TABLE icon_variants;
+TRUNCATE TABLE user_exports;
+TRUNCATE TABLE user_anonymizations;
+TRUNCATE TABLE user_profile_fields;
+TRUNCATE TABLE reservation_series;
+TRUNCATE TABLE reservation_series_livestreams;
+TRUNCATE TABLE tag_synonyms;
+TRUNCATE TABLE tag_follows;
+TRUNCATE TABLE tag_follow_settings;
+TRUNCATE TABLE tag_follow_jobs;
+TRUNCATE TABLE tag_follow_digests;
+TRUNCATE TABLE user_recommendations;
+TRUNCATE TABLE watch_history;
+TRUNCATE TABLE registration_events;
+TRUNCATE TABLE suspicious_accounts;
+TRUNCATE TABLE livecomment_spam_holds;
+TRUNCATE TABLE events;
+TRUNCATE TABLE analytics_events;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
@@ -22,4 +99,26 @@ ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `audit_logs` auto_increment = 1;
+ALTER TABLE `livestream_viewer_samples` auto_increment = 1;
+ALTER TABLE `reservation_waitlist` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `channels` auto_increment = 1;
+ALTER TABLE `blocklists` auto_increment = 1;
+ALTER TABLE `blocklist_words` auto_increment = 1;
+ALTER TABLE `payment_ledger` auto_increment = 1;
+ALTER TABLE `highlights` auto_increment = 1;
+ALTER TABLE `questions` auto_increment = 1;
+ALTER TABLE `raids` auto_increment = 1;
+ALTER TABLE `clips` auto_increment = 1;
+ALTER TABLE `clip_views` auto_increment = 1;
+ALTER TABLE `external_identities` auto_increment = 1;
+ALTER TABLE `image_reviews` auto_increment = 1;
+ALTER TABLE `user_exports` auto_increment = 1;
+ALTER TABLE `user_anonymizations` auto_increment = 1;
+ALTER TABLE `reservation_series` auto_increment = 1;
+ALTER TABLE `tag_follow_jobs` auto_increment = 1;
+ALTER TABLE `registration_events` auto_increment = 1;
+ALTER TABLE `events` auto_increment = 1;
+ALTER TABLE `analytics_events` auto_increment = 1;
\ No newline at end of file
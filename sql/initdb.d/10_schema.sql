@@ -7,7 +7,18 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
-  UNIQUE `uniq_user_name` (`name`)
+  -- プロフィール・テーマ・アイコンの更新ごとに増やす (条件付きGET用)
+  `profile_version` BIGINT NOT NULL DEFAULT 0,
+  `profile_updated_at` BIGINT NOT NULL DEFAULT 0,
+  -- 利用プラン (free, creator, pro)
+  `plan` VARCHAR(16) NOT NULL DEFAULT 'free',
+  -- メールアドレス (任意) と、ログインの照合用に正規化したもの
+  `email` VARCHAR(255) DEFAULT NULL,
+  `email_normalized` VARCHAR(255) DEFAULT NULL,
+  -- 登録日時 (初期データは 0)
+  `created_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_user_name` (`name`),
+  UNIQUE `uniq_user_email_normalized` (`email_normalized`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- プロフィール画像
@@ -35,7 +46,14 @@ CREATE TABLE `livestreams` (
   `playlist_url` VARCHAR(255) NOT NULL,
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
-  `end_at` BIGINT NOT NULL
+  `end_at` BIGINT NOT NULL,
+  -- 0 は配信者のプライマリチャンネル
+  `channel_id` BIGINT NOT NULL DEFAULT 0,
+  -- public / unlisted (検索に出さない) / password (閲覧にトークンが必要)
+  `visibility` VARCHAR(16) NOT NULL DEFAULT 'public',
+  `password_hash` VARCHAR(255) NULL,
+  -- upcoming / live / ended (メディアサーバからの通知で切り替わる)
+  `status` VARCHAR(16) NOT NULL DEFAULT 'upcoming'
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信予約枠
@@ -76,6 +94,7 @@ CREATE TABLE `livecomments` (
   `livestream_id` BIGINT NOT NULL,
   `comment` VARCHAR(255) NOT NULL,
   `tip` BIGINT NOT NULL DEFAULT 0,
+  `comment_type` VARCHAR(16) NOT NULL DEFAULT 'user',
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -85,7 +104,11 @@ CREATE TABLE `livecomment_reports` (
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `livecomment_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `source` VARCHAR(32) NOT NULL DEFAULT 'user',
+  `created_at` BIGINT NOT NULL,
+  -- 削除・却下・配信者の判断で解決した日時 (未解決なら 0)
+  `resolved_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_resolved_at` (`resolved_at`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- 配信者からのNGワード登録
@@ -106,4 +129,897 @@ CREATE TABLE `reactions` (
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
   `created_at` BIGINT NOT NULL
-) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
\ No newline at end of file
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- モデレーション・管理操作の監査ログ
+CREATE TABLE `audit_logs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `actor_id` BIGINT NOT NULL,
+  `action` VARCHAR(64) NOT NULL,
+  `target_type` VARCHAR(64) NOT NULL,
+  `target_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `before_snapshot` JSON NULL,
+  `after_snapshot` JSON NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_actor_id_created_at` (`actor_id`, `created_at`),
+  INDEX `idx_target` (`target_type`, `target_id`),
+  INDEX `idx_livestream_id_created_at` (`livestream_id`, `created_at`),
+  INDEX `idx_created_at` (`created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信の現在の視聴者 (heartbeatで更新され、一定時間更新が無いものは掃除される)
+CREATE TABLE `livestream_presences` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `last_seen_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`),
+  INDEX `idx_last_seen_at` (`last_seen_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 同時視聴者数の定期サンプル
+CREATE TABLE `livestream_viewer_samples` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `viewers_count` BIGINT NOT NULL,
+  `sampled_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id_viewers_count` (`livestream_id`, `viewers_count`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信終了後の分析レポート
+CREATE TABLE `livestream_analytics` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `report` JSON NOT NULL,
+  `generated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザごとのアクティビティフィード用
+CREATE INDEX livecomments_user_id_created_at ON livecomments(`user_id`, `created_at`);
+CREATE INDEX reactions_user_id_created_at ON reactions(`user_id`, `created_at`);
+CREATE INDEX livestreams_user_id_start_at ON livestreams(`user_id`, `start_at`);
+
+-- 配信ごとのコメント・リアクション一覧用 (explain-check で確かめている)
+CREATE INDEX livecomments_livestream_id_created_at ON livecomments(`livestream_id`, `created_at`);
+CREATE INDEX reactions_livestream_id_created_at ON reactions(`livestream_id`, `created_at`);
+
+-- 配信予定カレンダー用
+CREATE INDEX livestreams_start_at ON livestreams(`start_at`);
+
+-- 予約枠の範囲検索用
+CREATE INDEX reservation_slots_start_at_end_at ON reservation_slots(`start_at`, `end_at`);
+
+-- 満席の予約枠に対するキャンセル待ち
+CREATE TABLE `reservation_waitlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `description` TEXT NOT NULL,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `thumbnail_url` VARCHAR(255) NOT NULL,
+  `tags` JSON NOT NULL,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  `channel_id` BIGINT NOT NULL DEFAULT 0,
+  `visibility` VARCHAR(16) NOT NULL DEFAULT 'public',
+  `password_hash` VARCHAR(255) NOT NULL DEFAULT '',
+  `status` VARCHAR(16) NOT NULL,
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  INDEX `idx_status_created_at` (`status`, `created_at`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザへの通知
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `kind` VARCHAR(64) NOT NULL,
+  `payload` JSON NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id_created_at` (`user_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザが持つ追加のチャンネル (プライマリチャンネルはユーザ自身のプロフィールで、ここには含まれない)
+CREATE TABLE `channels` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `display_name` VARCHAR(255) NOT NULL,
+  `description` TEXT NOT NULL,
+  `dark_mode` BOOLEAN NOT NULL,
+  `icon` LONGBLOB NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_channel_name` (`name`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- フィーチャーフラグ (各プロセスがメモリにキャッシュする)
+CREATE TABLE `feature_flags` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `name` VARCHAR(255) NOT NULL,
+  `enabled` BOOLEAN NOT NULL,
+  `rollout_percent` BIGINT NOT NULL DEFAULT 100,
+  `description` TEXT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_feature_flag_name` (`name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブコメントの有害度スコア (scored_at と failed_at が NULL のものが採点待ち)
+CREATE TABLE `livecomment_toxicity_scores` (
+  `livecomment_id` BIGINT NOT NULL PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `score` DOUBLE NULL,
+  `classifier` VARCHAR(64) NULL,
+  `created_at` BIGINT NOT NULL,
+  `scored_at` BIGINT NULL,
+  -- 採点に失敗した回数と、次に採点する時刻
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL DEFAULT 0,
+  -- 上限まで失敗して諦めた時刻 (dead letter)
+  `failed_at` BIGINT NULL,
+  `last_error` VARCHAR(255) NULL,
+  INDEX `idx_scored_at` (`scored_at`, `failed_at`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者が公開できるNGワードのリスト
+CREATE TABLE `blocklists` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `description` TEXT NOT NULL,
+  `published` BOOLEAN NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_published` (`published`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ブロックリストに含まれる語
+CREATE TABLE `blocklist_words` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `blocklist_id` BIGINT NOT NULL,
+  `word` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_blocklist_id` (`blocklist_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとに購読しているブロックリスト
+CREATE TABLE `livestream_blocklists` (
+  `livestream_id` BIGINT NOT NULL,
+  `blocklist_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `blocklist_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チャンネルでの視聴者の役割 (VIPなど)
+-- プライマリチャンネルの channel_id は全員 0 なので、配信者の user_id と組で引く
+CREATE TABLE `channel_roles` (
+  `owner_id` BIGINT NOT NULL,
+  `channel_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `role` VARCHAR(32) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`owner_id`, `channel_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- パスワード付き配信の閲覧トークン
+CREATE TABLE `livestream_access_tokens` (
+  `token` VARCHAR(255) NOT NULL PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id_user_id` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブコメント・報告の送信元 (荒らし調査用、保持期間を過ぎたら消す)
+CREATE TABLE `client_metadata` (
+  `target_type` VARCHAR(32) NOT NULL,
+  `target_id` BIGINT NOT NULL,
+  `ip` VARCHAR(64) NOT NULL,
+  `country` VARCHAR(8) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`target_type`, `target_id`),
+  INDEX `idx_ip` (`ip`),
+  INDEX `idx_created_at` (`created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの保持上限を超えて livecomments から退避したコメント
+CREATE TABLE `livecomments_archive` (
+  `id` BIGINT NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `comment` VARCHAR(255) NOT NULL,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `comment_type` VARCHAR(16) NOT NULL DEFAULT 'user',
+  `created_at` BIGINT NOT NULL,
+  `archived_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`),
+  FULLTEXT `ft_comment` (`comment`) WITH PARSER ngram
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 終了した配信のコメント・リアクション (hot のテーブルから移したもの。ISUCON13_COLD_STORAGE_ENABLED)
+CREATE TABLE `livecomments_cold` (
+  `id` BIGINT NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `comment` VARCHAR(255) NOT NULL,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `comment_type` VARCHAR(16) NOT NULL DEFAULT 'user',
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`),
+  INDEX `idx_user_id_created_at` (`user_id`, `created_at`),
+  FULLTEXT `ft_comment` (`comment`) WITH PARSER ngram
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE TABLE `reactions_cold` (
+  `id` BIGINT NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `emoji_name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`),
+  INDEX `idx_user_id_created_at` (`user_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- cold のテーブルに移した配信
+CREATE TABLE `cold_livestreams` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  -- 移した時点の最大ID (これより後に hot に書かれた分は後から移す)
+  `last_livecomment_id` BIGINT NOT NULL,
+  `last_reaction_id` BIGINT NOT NULL,
+  `moved_at` BIGINT NOT NULL,
+  -- hot に残したコピーを消した時刻
+  `purged_at` BIGINT DEFAULT NULL,
+  INDEX `idx_purged_at_moved_at` (`purged_at`, `moved_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者ごとの手数料ティア (無ければ default)
+CREATE TABLE `revenue_tiers` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `tier` VARCHAR(32) NOT NULL,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チップの台帳 (記帳時点の手数料率で配信者の取り分を計算する)
+CREATE TABLE `payment_ledger` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livecomment_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `streamer_id` BIGINT NOT NULL,
+  `tipper_id` BIGINT NOT NULL,
+  `tier` VARCHAR(32) NOT NULL,
+  `cut_percent` BIGINT NOT NULL,
+  `gross` BIGINT NOT NULL,
+  `platform_fee` BIGINT NOT NULL,
+  `net` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  -- tip ならチップ付きコメント、membership ならメンバーシップの月額 (livecomment_id, livestream_id は 0)
+  `kind` VARCHAR(16) NOT NULL DEFAULT 'tip',
+  `membership_id` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_streamer_id_livestream_id` (`streamer_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 締まった月の領収書 (内容が変わらないので作ったものをそのまま返す)
+CREATE TABLE `payment_receipts` (
+  `user_id` BIGINT NOT NULL,
+  `month` CHAR(7) NOT NULL,
+  `body` MEDIUMBLOB NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `month`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの10秒単位のリアクション数
+CREATE TABLE `reaction_buckets` (
+  `livestream_id` BIGINT NOT NULL,
+  `bucket_start` BIGINT NOT NULL,
+  `count` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`livestream_id`, `bucket_start`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 見どころの候補 (リアクション・コメントの盛り上がりから検出する)
+CREATE TABLE `highlights` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `start_offset` BIGINT NOT NULL,
+  `end_offset` BIGINT NOT NULL,
+  `score` BIGINT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 見どころの検出が済んだ配信
+CREATE TABLE `highlight_detections` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `detected_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信への質問 (Q&A)
+CREATE TABLE `questions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `question` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `upvotes` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `resolved_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_livestream_id_upvotes` (`livestream_id`, `upvotes`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 質問への投票
+CREATE TABLE `question_upvotes` (
+  `question_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`question_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- レイド (配信者が視聴者を別の配信に送った記録)
+CREATE TABLE `raids` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `from_livestream_id` BIGINT NOT NULL,
+  `to_livestream_id` BIGINT NOT NULL,
+  `viewers_count` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_from_livestream_id` (`from_livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- レイドで送られた視聴者
+CREATE TABLE `raid_viewers` (
+  `raid_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  PRIMARY KEY (`raid_id`, `user_id`),
+  INDEX `idx_livestream_id_user_id` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのチャットコマンドの有効・無効 (無ければコマンドのデフォルト)
+CREATE TABLE `livestream_chat_commands` (
+  `livestream_id` BIGINT NOT NULL,
+  `command` VARCHAR(32) NOT NULL,
+  `enabled` BOOLEAN NOT NULL,
+  PRIMARY KEY (`livestream_id`, `command`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのコメントの内容ルール (無ければ制限なし。0 はその項目を制限しない)
+CREATE TABLE `livestream_comment_rules` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `max_length` INT NOT NULL DEFAULT 0,
+  `block_emoji_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `block_links` BOOLEAN NOT NULL DEFAULT FALSE,
+  `max_caps_percent` INT NOT NULL DEFAULT 0,
+  `members_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- コメント中のリンクの展開結果 (URL ごとに使い回す。status が pending のものが取得待ち)
+CREATE TABLE `link_unfurls` (
+  `url_hash` CHAR(64) NOT NULL PRIMARY KEY,
+  `url` TEXT NOT NULL,
+  `domain` VARCHAR(255) NOT NULL,
+  `title` VARCHAR(255) NOT NULL DEFAULT '',
+  `status` VARCHAR(16) NOT NULL,
+  `requested_at` BIGINT NOT NULL,
+  `fetched_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `idx_status_requested_at` (`status`, `requested_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- コメントと、展開するリンクの対応
+CREATE TABLE `livecomment_links` (
+  `livecomment_id` BIGINT NOT NULL,
+  `url_hash` CHAR(64) NOT NULL,
+  `position` INT NOT NULL,
+  PRIMARY KEY (`livecomment_id`, `url_hash`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者がプロフィールに載せた応援コメント (本文とチップは載せた時点のもの)
+CREATE TABLE `highlighted_comments` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livecomment_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `commenter_id` BIGINT NOT NULL,
+  `comment` VARCHAR(255) NOT NULL,
+  `tip` BIGINT NOT NULL,
+  `position` INT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_livecomment` (`user_id`, `livecomment_id`),
+  INDEX `idx_user_id_position` (`user_id`, `position`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 視聴者が自分にだけ適用するミュートワード (配信者の NG ワードとは別)
+CREATE TABLE `user_mute_words` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `word` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_id_word` (`user_id`, `word`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ソフトに設定するストリームキー (ハッシュだけを持つ)
+CREATE TABLE `livestream_stream_keys` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `key_hash` CHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `revoked_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_key_hash` (`key_hash`),
+  INDEX `idx_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- メディアサーバから通知された実際の配信の開始・終了 (予約した枠も残しておく)
+CREATE TABLE `livestream_broadcasts` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `reserved_start_at` BIGINT NOT NULL,
+  `reserved_end_at` BIGINT NOT NULL,
+  `live_started_at` BIGINT NOT NULL DEFAULT 0,
+  `live_ended_at` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信の playlist_url / thumbnail_url を最後に確認した結果
+CREATE TABLE `livestream_url_health` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `playlist_broken` BOOLEAN NOT NULL,
+  `thumbnail_url` VARCHAR(255) NOT NULL,
+  `thumbnail_broken` BOOLEAN NOT NULL,
+  `checked_at` BIGINT NOT NULL,
+  INDEX `idx_checked_at` (`checked_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- アーカイブの字幕 (WebVTT)。言語ごとに1つ
+CREATE TABLE `livestream_captions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `language` VARCHAR(35) NOT NULL,
+  `label` VARCHAR(255) NOT NULL,
+  `body` MEDIUMBLOB NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_id_language` (`livestream_id`, `language`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信を一緒に見る視聴ルーム
+CREATE TABLE `watch_rooms` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `owner_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `capacity` INT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE `watch_room_members` (
+  `room_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `joined_at` BIGINT NOT NULL,
+  PRIMARY KEY (`room_id`, `user_id`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 視聴ルームのチャット (配信のコメントとは別)
+CREATE TABLE `watch_room_messages` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `room_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `message` VARCHAR(2048) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_room_id` (`room_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者が決めたチップの目標 (期間中に受け取ったチップを数える)
+CREATE TABLE `donation_goals` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `target_amount` BIGINT NOT NULL,
+  `current_amount` BIGINT NOT NULL DEFAULT 0,
+  `starts_at` BIGINT NOT NULL,
+  `ends_at` BIGINT NOT NULL,
+  `webhook_url` VARCHAR(2048) NULL,
+  `completed_at` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id_ends_at` (`user_id`, `ends_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チャンネルのメンバーシップのプラン (月額)
+-- プライマリチャンネルの channel_id は全員 0 なので、配信者の user_id と組で引く
+CREATE TABLE `channel_membership_tiers` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `owner_id` BIGINT NOT NULL,
+  `channel_id` BIGINT NOT NULL,
+  `name` VARCHAR(64) NOT NULL,
+  `price` BIGINT NOT NULL,
+  `flair` VARCHAR(32) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_owner_id_channel_id` (`owner_id`, `channel_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チャンネルのメンバー (解約しても expires_at まではメンバーのまま)
+CREATE TABLE `channel_memberships` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `owner_id` BIGINT NOT NULL,
+  `channel_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `tier_id` BIGINT NOT NULL,
+  `started_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  `canceled_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_owner_id_channel_id_user_id` (`owner_id`, `channel_id`, `user_id`),
+  INDEX `idx_expires_at` (`expires_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信中に定期的に投稿するお知らせ (システムコメントとして投稿する)
+CREATE TABLE `livestream_announcements` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `interval_minutes` INT NOT NULL,
+  `next_post_at` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`),
+  INDEX `idx_next_post_at` (`next_post_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- コメントの言語判定 (detected_at が NULL のものが判定待ち)
+CREATE TABLE `livecomment_languages` (
+  `livecomment_id` BIGINT NOT NULL PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `language` VARCHAR(16) NULL,
+  `created_at` BIGINT NOT NULL,
+  `detected_at` BIGINT NULL,
+  INDEX `idx_detected_at` (`detected_at`, `created_at`),
+  INDEX `idx_livestream_id_language` (`livestream_id`, `language`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チャンネルのカスタム絵文字 (リアクションとコメントの :shortcode: で使う)
+-- 審査待ちの間は approved が FALSE で、一覧や表示には出さない
+CREATE TABLE `channel_emojis` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `owner_id` BIGINT NOT NULL,
+  `channel_id` BIGINT NOT NULL,
+  `shortcode` VARCHAR(32) NOT NULL,
+  `image` LONGBLOB NOT NULL,
+  `approved` BOOLEAN NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_owner_id_channel_id_shortcode` (`owner_id`, `channel_id`, `shortcode`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 他の配信サービスから書き出したチャットログの取り込みジョブ (payload は取り込み前のファイル)
+CREATE TABLE `chat_imports` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `platform` VARCHAR(32) NOT NULL,
+  `format` VARCHAR(16) NOT NULL,
+  `payload` LONGBLOB NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `total` BIGINT NOT NULL DEFAULT 0,
+  `processed` BIGINT NOT NULL DEFAULT 0,
+  `imported` BIGINT NOT NULL DEFAULT 0,
+  `skipped` BIGINT NOT NULL DEFAULT 0,
+  `error` TEXT DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  `completed_at` BIGINT DEFAULT NULL,
+  INDEX `idx_status_id` (`status`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チャットログの投稿者に対応するゲストユーザ (取り込み元のサービスと投稿者名の組ごとに1人)
+CREATE TABLE `chat_import_guests` (
+  `platform` VARCHAR(32) NOT NULL,
+  `external_name` VARCHAR(255) NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  PRIMARY KEY (`platform`, `external_name`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 公開APIのキー (保存するのはハッシュだけ。上限は発行時のプランで決める)
+CREATE TABLE `api_keys` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `key_hash` CHAR(64) NOT NULL,
+  `key_prefix` VARCHAR(16) NOT NULL,
+  `rate_limit_per_minute` BIGINT NOT NULL,
+  `daily_quota` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `revoked_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_key_hash` (`key_hash`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 公開APIのキーごと・日ごと (UTC) のリクエスト数
+CREATE TABLE `api_key_usages` (
+  `api_key_id` BIGINT NOT NULL,
+  `day` BIGINT NOT NULL,
+  `requests` BIGINT NOT NULL,
+  PRIMARY KEY (`api_key_id`, `day`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者向けの週次ダイジェストメールの設定 (行が無ければ送る)
+CREATE TABLE `streamer_digest_settings` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `enabled` BOOLEAN NOT NULL DEFAULT TRUE,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 週次ダイジェストの送信記録 (同じ週に二重に送らないためのもの)
+CREATE TABLE `streamer_digest_sends` (
+  `user_id` BIGINT NOT NULL,
+  `week_start` BIGINT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `sent_at` BIGINT NULL,
+  PRIMARY KEY (`user_id`, `week_start`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- アーカイブから切り出したクリップ
+CREATE TABLE `clips` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `start_offset` BIGINT NOT NULL,
+  `end_offset` BIGINT NOT NULL,
+  `view_count` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id_created_at` (`livestream_id`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- クリップの再生記録 (トレンドの集計用)
+CREATE TABLE `clip_views` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `clip_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `viewed_at` BIGINT NOT NULL,
+  INDEX `idx_viewed_at_clip_id` (`viewed_at`, `clip_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ログイン中のセッション (端末一覧・失効用)
+CREATE TABLE `user_sessions` (
+  `id` VARCHAR(64) NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `user_agent` VARCHAR(255) NOT NULL,
+  `ip` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `last_seen_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 外部 (OAuth) アカウントとの連携
+CREATE TABLE `external_identities` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `provider` VARCHAR(32) NOT NULL,
+  `external_id` VARCHAR(255) NOT NULL,
+  `email` VARCHAR(255) DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_provider_external_id` (`provider`, `external_id`),
+  UNIQUE `uniq_user_provider` (`user_id`, `provider`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 判定で flag されたアップロード画像の審査待ち
+CREATE TABLE `image_reviews` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `target_type` VARCHAR(32) NOT NULL,
+  `target_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `image` LONGBLOB NOT NULL,
+  `moderator` VARCHAR(32) NOT NULL,
+  `reason` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `reviewed_at` BIGINT DEFAULT NULL,
+  INDEX `idx_status_id` (`status`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- アイコンの別形式 (WebP/AVIF)。元の画像は icons に置く
+CREATE TABLE `icon_variants` (
+  `user_id` BIGINT NOT NULL,
+  `format` VARCHAR(16) NOT NULL,
+  `image` LONGBLOB NOT NULL,
+  PRIMARY KEY (`user_id`, `format`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザデータのエクスポート (zip はできあがったら archive に置く)
+CREATE TABLE `user_exports` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `archive` LONGBLOB DEFAULT NULL,
+  `error` TEXT DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  `completed_at` BIGINT DEFAULT NULL,
+  INDEX `idx_user_id` (`user_id`),
+  INDEX `idx_status_id` (`status`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザの匿名化 (個人情報の削除) ジョブ
+CREATE TABLE `user_anonymizations` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `requested_by` BIGINT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `error` TEXT DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  `completed_at` BIGINT DEFAULT NULL,
+  INDEX `idx_status_id` (`status`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- プロフィールの追加項目 (リンクや自由項目)
+CREATE TABLE `user_profile_fields` (
+  `user_id` BIGINT NOT NULL,
+  `field_key` VARCHAR(64) NOT NULL,
+  `value` VARCHAR(255) NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `field_key`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約 (毎週金曜 20:00〜22:00 を8週分、など)
+CREATE TABLE `reservation_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `interval_days` BIGINT NOT NULL,
+  `occurrences` BIGINT NOT NULL,
+  `first_start_at` BIGINT NOT NULL,
+  `duration` BIGINT NOT NULL,
+  `canceled_at` BIGINT DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約で作られた配信
+CREATE TABLE `reservation_series_livestreams` (
+  `series_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `occurrence` BIGINT NOT NULL,
+  PRIMARY KEY (`series_id`, `occurrence`),
+  UNIQUE `uniq_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- タグの同義語 (alias は正規化済みのタグ名)
+CREATE TABLE `tag_synonyms` (
+  `alias` VARCHAR(255) NOT NULL PRIMARY KEY,
+  `tag_id` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- タグのフォロー
+CREATE TABLE `tag_follows` (
+  `user_id` BIGINT NOT NULL,
+  `tag_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `tag_id`),
+  INDEX `idx_tag_id` (`tag_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- タグのフォロー通知の設定 (instant: 予約ごとに通知, digest: 1時間ごとにまとめて通知)
+CREATE TABLE `tag_follow_settings` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `mode` VARCHAR(16) NOT NULL DEFAULT 'instant',
+  `webhook_url` VARCHAR(255) DEFAULT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- タグのフォロワーへの通知待ちの配信
+CREATE TABLE `tag_follow_jobs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ダイジェストで送る予定の一致
+CREATE TABLE `tag_follow_digests` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `tag_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザごとのおすすめ配信 (定期的に作り直す)
+CREATE TABLE `user_recommendations` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `score` DOUBLE NOT NULL,
+  `rank` INT NOT NULL,
+  `generated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`),
+  INDEX `idx_user_id_rank` (`user_id`, `rank`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 視聴履歴 (heartbeat ごとに更新する。アーカイブの再生位置も持つ)
+CREATE TABLE `watch_history` (
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `last_position` BIGINT NOT NULL DEFAULT 0,
+  `watched_seconds` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `livestream_id`),
+  INDEX `idx_user_id_updated_at` (`user_id`, `updated_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 登録の送信元 (連投検知に使う。一定期間で消す)
+CREATE TABLE `registration_events` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `ip` VARCHAR(255) NOT NULL,
+  `user_agent` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_ip_created_at` (`ip`, `created_at`),
+  INDEX `idx_user_agent_created_at` (`user_agent`, `created_at`),
+  INDEX `idx_created_at` (`created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 連投などで要注意と判定されたアカウント
+CREATE TABLE `suspicious_accounts` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `reason` VARCHAR(255) NOT NULL,
+  `ip` VARCHAR(255) NOT NULL,
+  `user_agent` VARCHAR(255) NOT NULL,
+  `burst_count` BIGINT NOT NULL,
+  `challenge_required` BOOLEAN NOT NULL DEFAULT FALSE,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  INDEX `idx_status_updated_at` (`status`, `updated_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 同一人物の別アカウントかもしれないユーザの組 (user_id < other_user_id)
+CREATE TABLE `duplicate_account_candidates` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `other_user_id` BIGINT NOT NULL,
+  `ip_overlap` BOOLEAN NOT NULL DEFAULT FALSE,
+  `icon_match` BOOLEAN NOT NULL DEFAULT FALSE,
+  `name_similar` BOOLEAN NOT NULL DEFAULT FALSE,
+  `score` INT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_id_other_user_id` (`user_id`, `other_user_id`),
+  INDEX `idx_status_score` (`status`, `score`, `updated_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- スパムスコアがしきい値を超えて保留になったライブコメント
+CREATE TABLE `livecomment_spam_holds` (
+  `livecomment_id` BIGINT NOT NULL PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `score` DOUBLE NOT NULL,
+  -- スコアの内訳 (JSON)
+  `signals` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `reviewed_at` BIGINT DEFAULT NULL,
+  INDEX `idx_livestream_id_status` (`livestream_id`, `status`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ドメインイベント (append-only。webhook・通知・分析はここから読む)
+CREATE TABLE `events` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `event_type` VARCHAR(64) NOT NULL,
+  `aggregate_type` VARCHAR(32) NOT NULL,
+  `aggregate_id` BIGINT NOT NULL,
+  `payload` TEXT NOT NULL,
+  -- 同じ出来事を二重に書かないためのキー (定期的に拾うイベントだけ使う)
+  `dedupe_key` VARCHAR(255) DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_dedupe_key` (`dedupe_key`),
+  INDEX `idx_event_type_id` (`event_type`, `id`),
+  INDEX `idx_aggregate` (`aggregate_type`, `aggregate_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- クライアントから送られた計測イベント (ページビュー・再生のバッファリングなど)
+CREATE TABLE `analytics_events` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  -- 未ログインなら NULL
+  `user_id` BIGINT DEFAULT NULL,
+  `event_type` VARCHAR(64) NOT NULL,
+  `livestream_id` BIGINT DEFAULT NULL,
+  `properties` TEXT NOT NULL,
+  `occurred_at` BIGINT NOT NULL,
+  `received_at` BIGINT NOT NULL,
+  INDEX `idx_event_type_received_at` (`event_type`, `received_at`),
+  INDEX `idx_livestream_id_event_type` (`livestream_id`, `event_type`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;